@@ -0,0 +1,276 @@
+package main
+
+import (
+	"context"
+	"crypto/rand"
+	"database/sql"
+	"fmt"
+	"math/big"
+	"net/http"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+
+	"bank/servicekit"
+
+	"github.com/gorilla/mux"
+	"go.uber.org/zap"
+)
+
+// Every account gets an account number when it is opened, besides its serial
+// ID. ACCOUNT_NUMBER_SCHEME "internal" (the default) issues 10 digits ending
+// in a Luhn check digit; "iban" issues an IBAN for IBAN_COUNTRY_CODE under
+// IBAN_BANK_CODE. Routes naming an account in their path take either.
+
+// ibanFormat is the national part (BBAN) of a country's IBANs: the bank code
+// the bank is configured with, followed by an account number of
+// accountDigits digits
+type ibanFormat struct {
+	bankCode      *regexp.Regexp
+	accountDigits int
+}
+
+// ibanFormats are the countries IBANs can be issued for
+var ibanFormats = map[string]ibanFormat{
+	"GB": {regexp.MustCompile(`^[A-Z]{4}[0-9]{6}$`), 8}, // bank and sort code
+	"IE": {regexp.MustCompile(`^[A-Z]{4}[0-9]{6}$`), 8}, // bank and sort code
+	"DE": {regexp.MustCompile(`^[0-9]{8}$`), 10},        // Bankleitzahl
+	"NL": {regexp.MustCompile(`^[A-Z]{4}$`), 10},
+	"AT": {regexp.MustCompile(`^[0-9]{5}$`), 11},
+	"CH": {regexp.MustCompile(`^[0-9]{5}$`), 12},
+}
+
+// accountNumberScheme issues account numbers
+type accountNumberScheme struct {
+	name     string // internal or iban
+	country  string
+	bankCode string
+	format   ibanFormat
+}
+
+var accountNumbers accountNumberScheme
+
+// initAccountNumbers reads the account number scheme from the environment
+func initAccountNumbers() {
+	switch name := getEnv("ACCOUNT_NUMBER_SCHEME", "internal"); name {
+	case "internal":
+		accountNumbers = accountNumberScheme{name: name}
+	case "iban":
+		country := strings.ToUpper(getEnv("IBAN_COUNTRY_CODE", "GB"))
+		format, ok := ibanFormats[country]
+		if !ok {
+			logger.Fatal("unsupported IBAN country", zap.String("country", country))
+		}
+		bankCode := strings.ToUpper(getEnv("IBAN_BANK_CODE", ""))
+		if !format.bankCode.MatchString(bankCode) {
+			logger.Fatal("IBAN_BANK_CODE does not fit the country's IBAN format", zap.String("country", country))
+		}
+		accountNumbers = accountNumberScheme{name: name, country: country, bankCode: bankCode, format: format}
+	default:
+		logger.Fatal("unsupported account number scheme", zap.String("scheme", name))
+	}
+}
+
+// randomDigits returns n random digits, the first not zero
+func randomDigits(n int) string {
+	digits := make([]byte, n)
+	for i := range digits {
+		limit := int64(10)
+		if i == 0 {
+			limit = 9
+		}
+		d, _ := rand.Int(rand.Reader, big.NewInt(limit))
+		digits[i] = byte('0' + d.Int64())
+		if i == 0 {
+			digits[i]++
+		}
+	}
+	return string(digits)
+}
+
+// luhnCheckDigit returns the digit that makes number followed by it pass the
+// Luhn check
+func luhnCheckDigit(number string) string {
+	for d := 0; d < 10; d++ {
+		if candidate := number + strconv.Itoa(d); luhnValid(candidate) {
+			return candidate[len(candidate)-1:]
+		}
+	}
+	return "0"
+}
+
+// ibanMod97 is the ISO 7064 MOD 97-10 remainder of an IBAN rearranged with its
+// first four characters moved to the end and letters counted as 10 to 35
+func ibanMod97(iban string) int {
+	rearranged := iban[4:] + iban[:4]
+	remainder := 0
+	for _, c := range rearranged {
+		switch {
+		case c >= '0' && c <= '9':
+			remainder = (remainder*10 + int(c-'0')) % 97
+		case c >= 'A' && c <= 'Z':
+			remainder = (remainder*100 + int(c-'A') + 10) % 97
+		}
+	}
+	return remainder
+}
+
+// newIBAN returns the IBAN for bban in country, with its check digits
+func newIBAN(country, bban string) string {
+	return fmt.Sprintf("%s%02d%s", country, 98-ibanMod97(country+"00"+bban), bban)
+}
+
+// validIBAN checks an IBAN's shape and check digits
+func validIBAN(iban string) bool {
+	if len(iban) < 15 || len(iban) > 34 || strings.Trim(iban, "ABCDEFGHIJKLMNOPQRSTUVWXYZ0123456789") != "" {
+		return false
+	}
+	if iban[0] < 'A' || iban[0] > 'Z' || iban[1] < 'A' || iban[1] > 'Z' {
+		return false
+	}
+	return ibanMod97(iban) == 1
+}
+
+// validAccountNumber reports whether number could have been issued by either
+// scheme, so malformed ones need no lookup
+func validAccountNumber(number string) bool {
+	if len(number) == 10 && strings.Trim(number, "0123456789") == "" {
+		return luhnValid(number)
+	}
+	return validIBAN(number)
+}
+
+// normalizeAccountNumber drops the spaces IBANs are often written with
+func normalizeAccountNumber(number string) string {
+	return strings.ToUpper(strings.ReplaceAll(strings.TrimSpace(number), " ", ""))
+}
+
+func (s accountNumberScheme) generate() string {
+	if s.name == "iban" {
+		return newIBAN(s.country, s.bankCode+randomDigits(s.format.accountDigits))
+	}
+	base := randomDigits(9)
+	return base + luhnCheckDigit(base)
+}
+
+// newAccountNumber returns a number no account holds yet. Called inside the
+// transaction that opens the account, it also sees numbers that transaction
+// issued; the unique index catches the rare race with another one.
+func newAccountNumber(ctx context.Context, q interface {
+	QueryRowContext(ctx context.Context, query string, args ...interface{}) *sql.Row
+}) (string, error) {
+	for attempt := 0; attempt < 10; attempt++ {
+		number := accountNumbers.generate()
+		var taken bool
+		err := q.QueryRowContext(ctx, `SELECT EXISTS (SELECT 1 FROM accounts WHERE account_number = $1)`,
+			number).Scan(&taken)
+		if err != nil {
+			return "", err
+		}
+		if !taken {
+			return number, nil
+		}
+	}
+	return "", fmt.Errorf("no free account number found")
+}
+
+// accountIDByNumber returns the ID of the account with number, or 0 when
+// there is none
+func accountIDByNumber(ctx context.Context, number string) (int, error) {
+	number = normalizeAccountNumber(number)
+	if !validAccountNumber(number) {
+		return 0, nil
+	}
+	var id int
+	err := db.QueryRowContext(ctx, `SELECT id FROM accounts WHERE account_number = $1`, number).Scan(&id)
+	if err == sql.ErrNoRows {
+		return 0, nil
+	}
+	return id, err
+}
+
+// accountNumberMiddleware lets routes naming an account in their path, such
+// as /accounts/{id}/balance, take its account number instead of its ID. An
+// unknown number is replaced by an ID no account has, so the route answers as
+// for any missing account. IDs are serial and shorter than account numbers.
+func accountNumberMiddleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		template := ""
+		if route := mux.CurrentRoute(r); route != nil {
+			template, _ = route.GetPathTemplate()
+		}
+		collection, value, ok := routeResource(r, template)
+		if !ok || (collection != "accounts" && collection != "prepaid") || len(value) < 10 {
+			next.ServeHTTP(w, r)
+			return
+		}
+
+		id, err := accountIDByNumber(r.Context(), value)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		vars := mux.Vars(r)
+		for name, v := range vars {
+			if v == value {
+				vars[name] = strconv.Itoa(id)
+			}
+		}
+		next.ServeHTTP(w, mux.SetURLVars(r, vars))
+	})
+}
+
+// startAccountNumberBackfill gives accounts opened before account numbers
+// existed a number, a batch at a time. Replicas may run it side by side; an
+// account claimed twice keeps the first number.
+func startAccountNumberBackfill() {
+	go func() {
+		defer servicekit.ReportJobPanic("Account number backfill")
+		for {
+			assigned, err := backfillAccountNumbers(serviceContext)
+			if err != nil {
+				servicekit.ReportJobError("Account number backfill", err)
+				time.Sleep(time.Minute)
+				continue
+			}
+			if assigned == 0 {
+				return
+			}
+			logger.Info("account numbers assigned", zap.Int("accounts", assigned))
+		}
+	}()
+}
+
+func backfillAccountNumbers(ctx context.Context) (int, error) {
+	rows, err := db.QueryContext(ctx, `SELECT id FROM accounts WHERE account_number IS NULL ORDER BY id LIMIT 500`)
+	if err != nil {
+		return 0, err
+	}
+	var ids []int
+	for rows.Next() {
+		var id int
+		if err := rows.Scan(&id); err != nil {
+			rows.Close()
+			return 0, err
+		}
+		ids = append(ids, id)
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return 0, err
+	}
+
+	for _, id := range ids {
+		number, err := newAccountNumber(ctx, db)
+		if err != nil {
+			return 0, err
+		}
+		_, err = db.ExecContext(ctx, `UPDATE accounts SET account_number = $2 WHERE id = $1 AND account_number IS NULL`,
+			id, number)
+		if err != nil {
+			return 0, err
+		}
+	}
+	return len(ids), nil
+}
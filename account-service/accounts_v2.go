@@ -0,0 +1,232 @@
+package main
+
+import (
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/gorilla/mux"
+)
+
+// AccountV2 is the v2 account representation with optional linked resources
+type AccountV2 struct {
+	Account
+	Owner                 *OwnerSummary        `json:"owner,omitempty"`
+	Product               *Product             `json:"product,omitempty"`
+	RecentTransactions    []TransactionSummary `json:"recent_transactions,omitempty"`
+	UnavailableExpansions []string             `json:"unavailable_expansions,omitempty"`
+}
+
+// OwnerSummary is the subset of the auth-service user exposed with an account
+type OwnerSummary struct {
+	ID       int    `json:"id"`
+	Username string `json:"username"`
+	Email    string `json:"email"`
+}
+
+// Product describes the banking product an account type belongs to
+type Product struct {
+	Code        string `json:"code"`
+	Name        string `json:"name"`
+	Description string `json:"description"`
+}
+
+// TransactionSummary is a transaction as returned by the transaction service
+type TransactionSummary struct {
+	ID          int    `json:"id"`
+	AccountID   int    `json:"account_id,omitempty"`
+	Type        string `json:"transaction_type"`
+	Amount      Money  `json:"amount"`
+	Description string `json:"description"`
+	CreatedAt   string `json:"created_at"`
+}
+
+// productCatalog maps account types to their product definition
+var productCatalog = map[string]Product{
+	"checking": {Code: "checking", Name: "Everyday Checking", Description: "Current account for daily payments"},
+	"savings":  {Code: "savings", Name: "Savings", Description: "Interest-bearing savings account"},
+	"business": {Code: "business", Name: "Business Current", Description: "Current account for business customers"},
+	"loan":     {Code: "loan", Name: "Personal Loan", Description: "Loan account; the balance is the amount outstanding"},
+}
+
+var supportedExpansions = map[string]bool{
+	"owner":        true,
+	"product":      true,
+	"transactions": true,
+}
+
+var serviceClient = &http.Client{Timeout: 3 * time.Second}
+
+// registerV2Routes defines the v2 account API. Reads support ?expand=, every
+// other route is unchanged from v1.
+func registerV2Routes(r *mux.Router) {
+	r.HandleFunc("/accounts", getAccountsV2).Methods("GET")
+	r.HandleFunc("/accounts/{id}", getAccountV2).Methods("GET")
+	registerV1Routes(r)
+}
+
+// parseExpand reads the comma separated expand parameter
+func parseExpand(r *http.Request) (map[string]bool, error) {
+	expand := map[string]bool{}
+	for _, value := range strings.Split(r.URL.Query().Get("expand"), ",") {
+		value = strings.TrimSpace(value)
+		if value == "" {
+			continue
+		}
+		if !supportedExpansions[value] {
+			return nil, fmt.Errorf("Unsupported expansion: %s", value)
+		}
+		expand[value] = true
+	}
+	return expand, nil
+}
+
+func getAccountsV2(w http.ResponseWriter, r *http.Request) {
+	if !requireAccountReader(w, r) {
+		return
+	}
+	expand, err := parseExpand(r)
+	if err != nil {
+		http.Error(w, "Unsupported expansion", http.StatusBadRequest)
+		return
+	}
+
+	limit := r.URL.Query().Get("limit")
+	offset := r.URL.Query().Get("offset")
+	if limit == "" {
+		limit = "100"
+	}
+	if offset == "" {
+		offset = "0"
+	}
+
+	query := `SELECT id, customer_id, account_type, balance, currency_code, status,
+			  overdraft_limit, created_at, updated_at, metadata, branch_code,
+			  COALESCE(account_number, '') FROM accounts WHERE ($3 = 0 OR customer_id = $3)
+			  ORDER BY id LIMIT $1 OFFSET $2`
+
+	rows, err := db.QueryContext(r.Context(), query, limit, offset, accountListFilter(r))
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	defer rows.Close()
+
+	accounts := []AccountV2{}
+	for rows.Next() {
+		var a Account
+		err := rows.Scan(&a.ID, &a.CustomerID, &a.AccountType, &a.Balance,
+			&a.CurrencyCode, &a.Status, &a.OverdraftLimit, &a.CreatedAt, &a.UpdatedAt, &a.Metadata, &a.BranchCode,
+			&a.AccountNumber)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		accounts = append(accounts, AccountV2{Account: a})
+	}
+
+	for i := range accounts {
+		expandAccount(r, &accounts[i], expand)
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(accounts)
+}
+
+func getAccountV2(w http.ResponseWriter, r *http.Request) {
+	if !requireAccountReader(w, r) {
+		return
+	}
+	expand, err := parseExpand(r)
+	if err != nil {
+		http.Error(w, "Unsupported expansion", http.StatusBadRequest)
+		return
+	}
+
+	params := mux.Vars(r)
+	id := params["id"]
+
+	var account Account
+	query := `SELECT id, customer_id, account_type, balance, currency_code, status,
+			  overdraft_limit, created_at, updated_at, metadata, branch_code,
+			  COALESCE(account_number, '') FROM accounts WHERE id = $1`
+
+	err = db.QueryRowContext(r.Context(), query, id).Scan(&account.ID, &account.CustomerID, &account.AccountType,
+		&account.Balance, &account.CurrencyCode, &account.Status,
+		&account.OverdraftLimit, &account.CreatedAt, &account.UpdatedAt, &account.Metadata,
+		&account.BranchCode, &account.AccountNumber)
+	if err != nil {
+		if err == sql.ErrNoRows {
+			http.Error(w, "Account not found", http.StatusNotFound)
+		} else {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+		}
+		return
+	}
+
+	result := AccountV2{Account: account}
+	expandAccount(r, &result, expand)
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(result)
+}
+
+// expandAccount attaches the requested linked resources. A failing downstream
+// service does not fail the request; the expansion is reported as unavailable.
+func expandAccount(r *http.Request, account *AccountV2, expand map[string]bool) {
+	if expand["product"] {
+		if product, ok := productCatalog[account.AccountType]; ok {
+			account.Product = &product
+		} else {
+			account.Product = &Product{Code: account.AccountType, Name: account.AccountType}
+		}
+	}
+
+	if expand["owner"] {
+		var owner OwnerSummary
+		url := fmt.Sprintf("%s/v1/users/%d", getEnv("AUTH_SERVICE_URL", "http://localhost:8082"), account.CustomerID)
+		if err := fetchJSON(r, url, &owner); err != nil {
+			account.UnavailableExpansions = append(account.UnavailableExpansions, "owner")
+		} else {
+			account.Owner = &owner
+		}
+	}
+
+	if expand["transactions"] {
+		transactions := []TransactionSummary{}
+		url := fmt.Sprintf("%s/v1/accounts/%d/transactions?limit=%s",
+			getEnv("TRANSACTION_SERVICE_URL", "http://localhost:8081"), account.ID,
+			getEnv("EXPAND_TRANSACTIONS_LIMIT", "5"))
+		if err := fetchJSON(r, url, &transactions); err != nil {
+			account.UnavailableExpansions = append(account.UnavailableExpansions, "transactions")
+		} else {
+			account.RecentTransactions = transactions
+		}
+	}
+}
+
+// fetchJSON performs a GET against another service, forwarding the caller's
+// credentials, and decodes the JSON response into out
+func fetchJSON(r *http.Request, url string, out interface{}) error {
+	req, err := http.NewRequestWithContext(r.Context(), http.MethodGet, url, nil)
+	if err != nil {
+		return err
+	}
+	if auth := r.Header.Get("Authorization"); auth != "" {
+		req.Header.Set("Authorization", auth)
+	}
+
+	resp, err := serviceClient.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("unexpected status %d from %s", resp.StatusCode, url)
+	}
+	return json.NewDecoder(resp.Body).Decode(out)
+}
@@ -0,0 +1,740 @@
+package main
+
+import (
+	"context"
+	"crypto/rand"
+	"database/sql"
+	"encoding/hex"
+	"encoding/json"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"bank/servicekit"
+
+	"github.com/gorilla/mux"
+	"go.uber.org/zap"
+)
+
+// Banking agents take cash deposits for the bank. Each agent holds a float
+// account with the bank; a deposit debits the agent's float and credits the
+// customer in one database transaction, since the agent keeps the cash, and
+// pays the agent a commission on the amount out of the agent_commission GL
+// account. Agents sign in as users with the agent role and use the /agent
+// routes; the agent network team registers them under /agents.
+
+// Agent is a banking agent and the terms of its commission:
+// commission_rate_bps basis points of each deposit, raised to commission_min
+// and capped at commission_max when set, and never more than the deposit
+type Agent struct {
+	ID                int    `json:"id"`
+	AgentCode         string `json:"agent_code"`
+	Name              string `json:"name"`
+	UserID            int    `json:"user_id"`
+	FloatAccountID    int    `json:"float_account_id"`
+	Status            string `json:"status"` // active or suspended
+	CommissionRateBPS int    `json:"commission_rate_bps"`
+	CommissionMin     Money  `json:"commission_min"`
+	CommissionMax     *Money `json:"commission_max,omitempty"`
+	CreatedBy         string `json:"created_by"`
+	CreatedAt         string `json:"created_at"`
+}
+
+// AgentDeposit is one cash deposit taken by an agent
+type AgentDeposit struct {
+	Reference      string `json:"reference"`
+	AgentID        int    `json:"agent_id"`
+	AccountID      int    `json:"account_id"`
+	Amount         Money  `json:"amount"`
+	Commission     Money  `json:"commission"`
+	CurrencyCode   string `json:"currency_code"`
+	DepositorName  string `json:"depositor_name,omitempty"`
+	Status         string `json:"status"` // completed or reversed
+	ReversalReason string `json:"reversal_reason,omitempty"`
+	CreatedAt      string `json:"created_at"`
+}
+
+// AgentCommissionDay totals a day's completed deposits of one currency
+type AgentCommissionDay struct {
+	Date         string `json:"date"`
+	CurrencyCode string `json:"currency_code"`
+	Deposits     int    `json:"deposits"`
+	Amount       Money  `json:"amount"`
+	Commission   Money  `json:"commission"`
+}
+
+// agentNetworkRoles register agents, set their terms and reverse their
+// deposits; agentRole is the role agents themselves sign in with
+var agentNetworkRoles = []string{"agent_network", "admin"}
+
+const agentRole = "agent"
+
+// glAgentCommission is the bank's side of agent commission, an expense
+const glAgentCommission = "agent_commission"
+
+const agentColumns = `id, agent_code, name, user_id, float_account_id, status, commission_rate_bps,
+	commission_min, commission_max, created_by, created_at::text`
+
+func scanAgent(row interface{ Scan(...interface{}) error }, a *Agent) error {
+	return row.Scan(&a.ID, &a.AgentCode, &a.Name, &a.UserID, &a.FloatAccountID, &a.Status, &a.CommissionRateBPS,
+		&a.CommissionMin, &a.CommissionMax, &a.CreatedBy, &a.CreatedAt)
+}
+
+const agentDepositColumns = `reference, agent_id, account_id, amount, commission, currency_code, depositor_name,
+	status, reversal_reason, created_at::text`
+
+func scanAgentDeposit(row interface{ Scan(...interface{}) error }, d *AgentDeposit) error {
+	return row.Scan(&d.Reference, &d.AgentID, &d.AccountID, &d.Amount, &d.Commission, &d.CurrencyCode,
+		&d.DepositorName, &d.Status, &d.ReversalReason, &d.CreatedAt)
+}
+
+func newAgentDepositReference() string {
+	raw := make([]byte, 8)
+	rand.Read(raw)
+	return "AGD-" + strings.ToUpper(hex.EncodeToString(raw))
+}
+
+// commissionOn is the agent's commission on a deposit of amount, rounded to
+// the nearest cent. It never exceeds the deposit, so splitting cash into
+// deposits smaller than commission_min earns no more than the cash itself.
+func (a Agent) commissionOn(amount Money) Money {
+	commission := (amount*Money(a.CommissionRateBPS) + 5000) / 10000
+	if commission < a.CommissionMin {
+		commission = a.CommissionMin
+	}
+	if a.CommissionMax != nil && commission > *a.CommissionMax {
+		commission = *a.CommissionMax
+	}
+	if commission > amount {
+		commission = amount
+	}
+	return commission
+}
+
+// agentCommissionTerms are the commission fields of a request; unset ones
+// keep their current value, or for a new agent the AGENT_COMMISSION_RATE_BPS,
+// AGENT_COMMISSION_MIN and AGENT_COMMISSION_MAX defaults
+type agentCommissionTerms struct {
+	CommissionRateBPS *int   `json:"commission_rate_bps"`
+	CommissionMin     *Money `json:"commission_min"`
+	CommissionMax     *Money `json:"commission_max"`
+}
+
+// apply sets a's terms from t and checks them, returning the client error
+func (t agentCommissionTerms) apply(a *Agent) string {
+	if t.CommissionRateBPS != nil {
+		a.CommissionRateBPS = *t.CommissionRateBPS
+	}
+	if t.CommissionMin != nil {
+		a.CommissionMin = *t.CommissionMin
+	}
+	if t.CommissionMax != nil {
+		a.CommissionMax = t.CommissionMax
+		if *t.CommissionMax == 0 {
+			a.CommissionMax = nil
+		}
+	}
+	switch {
+	case a.CommissionRateBPS < 0 || a.CommissionRateBPS > 10000:
+		return "commission_rate_bps must be from 0 to 10000 basis points"
+	case a.CommissionMin < 0:
+		return "commission_min must not be negative"
+	case a.CommissionMax != nil && *a.CommissionMax < a.CommissionMin:
+		return "commission_max must be at least commission_min"
+	}
+	return ""
+}
+
+// defaultAgentTerms are the commission terms new agents get unless the
+// request sets them
+func defaultAgentTerms() (Agent, error) {
+	a := Agent{}
+	var err error
+	if a.CommissionRateBPS, err = strconv.Atoi(getEnv("AGENT_COMMISSION_RATE_BPS", "50")); err != nil {
+		return a, err
+	}
+	if a.CommissionMin, err = parseMoney(getEnv("AGENT_COMMISSION_MIN", "0")); err != nil {
+		return a, err
+	}
+	if value := getEnv("AGENT_COMMISSION_MAX", ""); value != "" {
+		max, err := parseMoney(value)
+		if err != nil {
+			return a, err
+		}
+		a.CommissionMax = &max
+	}
+	return a, nil
+}
+
+// createAgent registers a user as an agent with an active account of theirs
+// as the float
+func createAgent(w http.ResponseWriter, r *http.Request) {
+	if !requireRole(w, r, agentNetworkRoles...) {
+		return
+	}
+
+	var req struct {
+		agentCommissionTerms
+		AgentCode          string `json:"agent_code"`
+		Name               string `json:"name"`
+		UserID             int    `json:"user_id"`
+		FloatAccountID     int    `json:"float_account_id"`
+		FloatAccountNumber string `json:"float_account_number"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, "Invalid request body", http.StatusBadRequest)
+		return
+	}
+	req.AgentCode = strings.ToUpper(strings.TrimSpace(req.AgentCode))
+	req.Name = strings.TrimSpace(req.Name)
+	if req.AgentCode == "" || len(req.AgentCode) > 20 || req.Name == "" || req.UserID <= 0 {
+		http.Error(w, "agent_code (at most 20 characters), name and user_id are required", http.StatusBadRequest)
+		return
+	}
+	if req.FloatAccountNumber != "" {
+		id, err := accountIDByNumber(r.Context(), req.FloatAccountNumber)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		req.FloatAccountID = id
+	}
+
+	agent, err := defaultAgentTerms()
+	if err != nil {
+		http.Error(w, "Agent commission defaults are invalid", http.StatusInternalServerError)
+		return
+	}
+	if msg := req.agentCommissionTerms.apply(&agent); msg != "" {
+		http.Error(w, msg, http.StatusBadRequest)
+		return
+	}
+
+	var status string
+	err = db.QueryRowContext(r.Context(), `SELECT status FROM accounts WHERE id = $1`, req.FloatAccountID).Scan(&status)
+	if err == sql.ErrNoRows {
+		http.Error(w, "Float account not found", http.StatusNotFound)
+		return
+	}
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	if status != "active" {
+		http.Error(w, "Float account is not active", http.StatusConflict)
+		return
+	}
+
+	err = scanAgent(db.QueryRowContext(r.Context(), `INSERT INTO agents (agent_code, name, user_id, float_account_id,
+												 commission_rate_bps, commission_min, commission_max, created_by)
+												 VALUES ($1, $2, $3, $4, $5, $6, $7, $8) RETURNING `+agentColumns,
+		req.AgentCode, req.Name, req.UserID, req.FloatAccountID, agent.CommissionRateBPS, agent.CommissionMin,
+		agent.CommissionMax, requestActor(r)), &agent)
+	if err != nil {
+		writeDBError(w, err)
+		return
+	}
+
+	servicekit.RequestLogger(r.Context()).Info("agent registered", zap.Int("agent_id", agent.ID), zap.String("agent_code", agent.AgentCode),
+		zap.Int("float_account_id", agent.FloatAccountID), zap.String("actor", agent.CreatedBy))
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusCreated)
+	json.NewEncoder(w).Encode(agent)
+}
+
+// listAgents returns every agent, optionally only those with ?status=
+func listAgents(w http.ResponseWriter, r *http.Request) {
+	if !requireRole(w, r, agentNetworkRoles...) {
+		return
+	}
+
+	status := r.URL.Query().Get("status")
+	rows, err := db.QueryContext(r.Context(), `SELECT `+agentColumns+` FROM agents
+											   WHERE $1 = '' OR status = $1 ORDER BY agent_code`, status)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	defer rows.Close()
+
+	agents := []Agent{}
+	for rows.Next() {
+		var a Agent
+		if err := scanAgent(rows, &a); err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		agents = append(agents, a)
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(agents)
+}
+
+// loadAgent loads the agent the route's {id} names, writing a 404 when there
+// is none
+func loadAgent(w http.ResponseWriter, r *http.Request) (Agent, bool) {
+	var a Agent
+	err := scanAgent(db.QueryRowContext(r.Context(), `SELECT `+agentColumns+` FROM agents WHERE id = $1`,
+		mux.Vars(r)["id"]), &a)
+	if err != nil {
+		if err == sql.ErrNoRows {
+			http.Error(w, "Agent not found", http.StatusNotFound)
+		} else {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+		}
+		return a, false
+	}
+	return a, true
+}
+
+func getAgent(w http.ResponseWriter, r *http.Request) {
+	if !requireRole(w, r, agentNetworkRoles...) {
+		return
+	}
+	agent, ok := loadAgent(w, r)
+	if !ok {
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(agent)
+}
+
+// updateAgentStatus suspends an agent, which stops it taking deposits, or
+// reinstates it
+func updateAgentStatus(w http.ResponseWriter, r *http.Request) {
+	if !requireRole(w, r, agentNetworkRoles...) {
+		return
+	}
+
+	var req struct {
+		Status string `json:"status"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, "Invalid request body", http.StatusBadRequest)
+		return
+	}
+	if req.Status != "active" && req.Status != "suspended" {
+		http.Error(w, "status must be active or suspended", http.StatusBadRequest)
+		return
+	}
+
+	var agent Agent
+	err := scanAgent(db.QueryRowContext(r.Context(), `UPDATE agents SET status = $2, updated_at = NOW()
+												 WHERE id = $1 RETURNING `+agentColumns, mux.Vars(r)["id"], req.Status), &agent)
+	if err != nil {
+		if err == sql.ErrNoRows {
+			http.Error(w, "Agent not found", http.StatusNotFound)
+		} else {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+		}
+		return
+	}
+
+	servicekit.RequestLogger(r.Context()).Info("agent status changed", zap.Int("agent_id", agent.ID),
+		zap.String("status", agent.Status), zap.String("actor", requestActor(r)))
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(agent)
+}
+
+// updateAgentCommission changes an agent's commission terms for deposits
+// from now on; a commission_max of 0 removes the cap
+func updateAgentCommission(w http.ResponseWriter, r *http.Request) {
+	if !requireRole(w, r, agentNetworkRoles...) {
+		return
+	}
+
+	var terms agentCommissionTerms
+	if err := json.NewDecoder(r.Body).Decode(&terms); err != nil {
+		http.Error(w, "Invalid request body", http.StatusBadRequest)
+		return
+	}
+	agent, ok := loadAgent(w, r)
+	if !ok {
+		return
+	}
+	if msg := terms.apply(&agent); msg != "" {
+		http.Error(w, msg, http.StatusBadRequest)
+		return
+	}
+
+	err := scanAgent(db.QueryRowContext(r.Context(), `UPDATE agents SET commission_rate_bps = $2, commission_min = $3,
+												 commission_max = $4, updated_at = NOW() WHERE id = $1
+												 RETURNING `+agentColumns,
+		agent.ID, agent.CommissionRateBPS, agent.CommissionMin, agent.CommissionMax), &agent)
+	if err != nil {
+		writeDBError(w, err)
+		return
+	}
+
+	servicekit.RequestLogger(r.Context()).Info("agent commission changed", zap.Int("agent_id", agent.ID),
+		zap.Int("commission_rate_bps", agent.CommissionRateBPS), zap.String("actor", requestActor(r)))
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(agent)
+}
+
+// listAgentDepositsByID lets the agent network team see an agent's deposits
+func listAgentDepositsByID(w http.ResponseWriter, r *http.Request) {
+	if !requireRole(w, r, agentNetworkRoles...) {
+		return
+	}
+	agent, ok := loadAgent(w, r)
+	if !ok {
+		return
+	}
+	writeAgentDeposits(w, r, agent)
+}
+
+// callingAgent loads the agent the caller signs in as, writing a 403 when the
+// caller is not one
+func callingAgent(w http.ResponseWriter, r *http.Request) (Agent, bool) {
+	var a Agent
+	if !requireRole(w, r, agentRole) {
+		return a, false
+	}
+	err := scanAgent(db.QueryRowContext(r.Context(), `SELECT `+agentColumns+` FROM agents WHERE user_id = $1`,
+		r.Header.Get("X-User-ID")), &a)
+	if err != nil {
+		if _, invalid := constraintViolation(err); err == sql.ErrNoRows || invalid {
+			http.Error(w, "Caller is not a registered agent", http.StatusForbidden)
+		} else {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+		}
+		return a, false
+	}
+	return a, true
+}
+
+// getAgentProfile returns the calling agent with its float's available
+// balance, which bounds the deposits it can take
+func getAgentProfile(w http.ResponseWriter, r *http.Request) {
+	agent, ok := callingAgent(w, r)
+	if !ok {
+		return
+	}
+
+	var balance Money
+	var currency string
+	err := db.QueryRowContext(r.Context(), `SELECT balance, currency_code FROM accounts WHERE id = $1`,
+		agent.FloatAccountID).Scan(&balance, &currency)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	liens, err := activeLienTotal(r.Context(), db, agent.FloatAccountID)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"agent":                   agent,
+		"float_balance":           balance,
+		"float_available_balance": balance - liens,
+		"currency_code":           currency,
+	})
+}
+
+// createAgentDeposit takes a customer's cash at the calling agent: the
+// agent's float is debited and the customer's account, named by account_number
+// or account_id, credited in one transaction together with the agent's
+// commission. The agent row stays locked until commit, so a suspension waits
+// for deposits in flight.
+func createAgentDeposit(w http.ResponseWriter, r *http.Request) {
+	agent, ok := callingAgent(w, r)
+	if !ok {
+		return
+	}
+
+	var req struct {
+		AccountID     int    `json:"account_id"`
+		AccountNumber string `json:"account_number"`
+		Amount        Money  `json:"amount"`
+		DepositorName string `json:"depositor_name"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, "Invalid request body", http.StatusBadRequest)
+		return
+	}
+	req.DepositorName = strings.TrimSpace(req.DepositorName)
+	if req.Amount <= 0 {
+		http.Error(w, "Amount must be positive", http.StatusBadRequest)
+		return
+	}
+	if len(req.DepositorName) > 100 {
+		http.Error(w, "depositor_name must be at most 100 characters", http.StatusBadRequest)
+		return
+	}
+	if req.AccountNumber != "" {
+		id, err := accountIDByNumber(r.Context(), req.AccountNumber)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		if id == 0 {
+			http.Error(w, ErrTransferAccountNotFound.Error(), http.StatusNotFound)
+			return
+		}
+		req.AccountID = id
+	}
+	if req.AccountID <= 0 || req.AccountID == agent.FloatAccountID {
+		http.Error(w, "account_number or account_id must name a customer account", http.StatusBadRequest)
+		return
+	}
+
+	tx, err := db.BeginTx(r.Context(), nil)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	defer tx.Rollback()
+
+	err = scanAgent(tx.QueryRowContext(r.Context(), `SELECT `+agentColumns+` FROM agents WHERE id = $1 FOR UPDATE`,
+		agent.ID), &agent)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	if agent.Status != "active" {
+		http.Error(w, "Agent is suspended", http.StatusForbidden)
+		return
+	}
+
+	description := "Cash deposit at agent " + agent.AgentCode
+	commission := agent.commissionOn(req.Amount)
+	err = internalTransfer(r.Context(), tx, agent.FloatAccountID, req.AccountID, req.Amount, description)
+	if err == nil && commission > 0 {
+		err = payAgentCommission(r.Context(), tx, agent, commission, "Commission on "+strings.ToLower(description))
+	}
+	if err != nil {
+		writeTransferError(w, err)
+		return
+	}
+
+	var deposit AgentDeposit
+	err = scanAgentDeposit(tx.QueryRowContext(r.Context(), `INSERT INTO agent_deposits (reference, agent_id, account_id,
+												 amount, commission, currency_code, depositor_name)
+												 SELECT $1, $2, id, $4, $5, currency_code, $6 FROM accounts WHERE id = $3
+												 RETURNING `+agentDepositColumns,
+		newAgentDepositReference(), agent.ID, req.AccountID, req.Amount, commission, req.DepositorName), &deposit)
+	if err == nil {
+		err = enqueueEvent(r.Context(), tx, "funds.deposited", "account:"+strconv.Itoa(deposit.AccountID), map[string]interface{}{
+			"account_id": deposit.AccountID, "amount": deposit.Amount, "currency_code": deposit.CurrencyCode,
+			"channel": "agent", "agent_code": agent.AgentCode, "reference": deposit.Reference,
+		})
+	}
+	if err == nil {
+		err = tx.Commit()
+	}
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	publishAccountEvent(AccountEvent{AccountID: deposit.AccountID, Type: "deposit", Amount: deposit.Amount})
+	servicekit.RequestLogger(r.Context()).Info("agent deposit completed", zap.String("reference", deposit.Reference),
+		zap.String("agent_code", agent.AgentCode), zap.Int("account_id", deposit.AccountID),
+		zap.String("amount", deposit.Amount.String()), zap.String("commission", deposit.Commission.String()))
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusCreated)
+	json.NewEncoder(w).Encode(deposit)
+}
+
+// payAgentCommission credits (positive amount) or claws back (negative
+// amount) commission on the agent's float against glAgentCommission
+func payAgentCommission(ctx context.Context, tx *sql.Tx, agent Agent, amount Money, description string) error {
+	currency, err := applyBalanceChange(ctx, tx, agent.FloatAccountID, amount, description)
+	if err != nil {
+		return err
+	}
+	posting := ledgerChange(agent.FloatAccountID, amount, currency, description)
+	posting.Type, posting.GLAccount = "commission", glAgentCommission
+	return recordInLedger(ctx, tx, posting)
+}
+
+// listAgentDeposits returns the calling agent's deposits
+func listAgentDeposits(w http.ResponseWriter, r *http.Request) {
+	agent, ok := callingAgent(w, r)
+	if !ok {
+		return
+	}
+	writeAgentDeposits(w, r, agent)
+}
+
+// agentReportRange reads ?from=&to= (YYYY-MM-DD, default the current month),
+// writing a 400 when either is malformed
+func agentReportRange(w http.ResponseWriter, r *http.Request) (time.Time, time.Time, bool) {
+	now := time.Now().UTC()
+	from := time.Date(now.Year(), now.Month(), 1, 0, 0, 0, 0, time.UTC)
+	to := now
+	for name, target := range map[string]*time.Time{"from": &from, "to": &to} {
+		if value := r.URL.Query().Get(name); value != "" {
+			parsed, err := time.Parse("2006-01-02", value)
+			if err != nil {
+				http.Error(w, name+" must be YYYY-MM-DD", http.StatusBadRequest)
+				return from, to, false
+			}
+			*target = parsed
+		}
+	}
+	return from, to, true
+}
+
+// writeAgentDeposits writes an agent's deposits between ?from= and ?to=,
+// newest first
+func writeAgentDeposits(w http.ResponseWriter, r *http.Request, agent Agent) {
+	from, to, ok := agentReportRange(w, r)
+	if !ok {
+		return
+	}
+
+	rows, err := db.QueryContext(r.Context(), `SELECT `+agentDepositColumns+` FROM agent_deposits
+											   WHERE agent_id = $1 AND created_at::date BETWEEN $2 AND $3
+											   ORDER BY created_at DESC, id DESC`,
+		agent.ID, from.Format("2006-01-02"), to.Format("2006-01-02"))
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	defer rows.Close()
+
+	deposits := []AgentDeposit{}
+	for rows.Next() {
+		var d AgentDeposit
+		if err := scanAgentDeposit(rows, &d); err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		deposits = append(deposits, d)
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(deposits)
+}
+
+// getAgentCommissions totals the calling agent's completed deposits and the
+// commission earned on them by day between ?from= and ?to=
+func getAgentCommissions(w http.ResponseWriter, r *http.Request) {
+	agent, ok := callingAgent(w, r)
+	if !ok {
+		return
+	}
+	from, to, ok := agentReportRange(w, r)
+	if !ok {
+		return
+	}
+
+	rows, err := db.QueryContext(r.Context(), `SELECT created_at::date::text, currency_code, COUNT(*), SUM(amount),
+											   SUM(commission) FROM agent_deposits
+											   WHERE agent_id = $1 AND status = 'completed'
+											   AND created_at::date BETWEEN $2 AND $3
+											   GROUP BY 1, 2 ORDER BY 1, 2`,
+		agent.ID, from.Format("2006-01-02"), to.Format("2006-01-02"))
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	defer rows.Close()
+
+	days := []AgentCommissionDay{}
+	totals := map[string]Money{}
+	for rows.Next() {
+		var d AgentCommissionDay
+		if err := rows.Scan(&d.Date, &d.CurrencyCode, &d.Deposits, &d.Amount, &d.Commission); err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		days = append(days, d)
+		totals[d.CurrencyCode] += d.Commission
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"agent_code":        agent.AgentCode,
+		"from":              from.Format("2006-01-02"),
+		"to":                to.Format("2006-01-02"),
+		"days":              days,
+		"total_commissions": totals,
+	})
+}
+
+// reverseAgentDeposit undoes a deposit taken in error: the customer's
+// account is debited back to the agent's float and the commission clawed
+// back. It fails like a transfer when the customer has spent the funds.
+func reverseAgentDeposit(w http.ResponseWriter, r *http.Request) {
+	if !requireRole(w, r, agentNetworkRoles...) {
+		return
+	}
+
+	var req struct {
+		Reason string `json:"reason"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, "Invalid request body", http.StatusBadRequest)
+		return
+	}
+	req.Reason = strings.TrimSpace(req.Reason)
+	if req.Reason == "" || len(req.Reason) > 200 {
+		http.Error(w, "reason is required and at most 200 characters", http.StatusBadRequest)
+		return
+	}
+
+	tx, err := db.BeginTx(r.Context(), nil)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	defer tx.Rollback()
+
+	var deposit AgentDeposit
+	err = scanAgentDeposit(tx.QueryRowContext(r.Context(), `SELECT `+agentDepositColumns+` FROM agent_deposits
+															 WHERE reference = $1 FOR UPDATE`, mux.Vars(r)["reference"]), &deposit)
+	if err != nil {
+		if err == sql.ErrNoRows {
+			http.Error(w, "Deposit not found", http.StatusNotFound)
+		} else {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+		}
+		return
+	}
+	if deposit.Status != "completed" {
+		http.Error(w, "Deposit is "+deposit.Status, http.StatusConflict)
+		return
+	}
+	var agent Agent
+	err = scanAgent(tx.QueryRowContext(r.Context(), `SELECT `+agentColumns+` FROM agents WHERE id = $1`,
+		deposit.AgentID), &agent)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	description := "Reversal of agent deposit " + deposit.Reference
+	err = internalTransfer(r.Context(), tx, deposit.AccountID, agent.FloatAccountID, deposit.Amount, description)
+	if err == nil && deposit.Commission > 0 {
+		err = payAgentCommission(r.Context(), tx, agent, -deposit.Commission, "Commission clawback on "+deposit.Reference)
+	}
+	if err != nil {
+		writeTransferError(w, err)
+		return
+	}
+	err = scanAgentDeposit(tx.QueryRowContext(r.Context(), `UPDATE agent_deposits SET status = 'reversed',
+												 reversal_reason = $2, updated_at = NOW() WHERE reference = $1
+												 RETURNING `+agentDepositColumns, deposit.Reference, req.Reason), &deposit)
+	if err == nil {
+		err = tx.Commit()
+	}
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	publishAccountEvent(AccountEvent{AccountID: deposit.AccountID, Type: "withdrawal", Amount: deposit.Amount})
+	servicekit.RequestLogger(r.Context()).Info("agent deposit reversed", zap.String("reference", deposit.Reference),
+		zap.String("reason", deposit.ReversalReason), zap.String("actor", requestActor(r)))
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(deposit)
+}
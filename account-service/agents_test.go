@@ -0,0 +1,31 @@
+package main
+
+import "testing"
+
+func TestCommissionOn(t *testing.T) {
+	max := Money(500)
+	cases := []struct {
+		name    string
+		agent   Agent
+		deposit Money
+		want    Money
+	}{
+		{"rate", Agent{CommissionRateBPS: 50}, 100000, 500},
+		{"rounded half up", Agent{CommissionRateBPS: 50}, 100, 1},
+		{"rounded down", Agent{CommissionRateBPS: 50}, 99, 0},
+		{"fraction of a cent exact", Agent{CommissionRateBPS: 1}, 1000000, 100},
+		{"raised to the minimum", Agent{CommissionRateBPS: 50, CommissionMin: 200}, 10000, 200},
+		{"capped at the maximum", Agent{CommissionRateBPS: 50, CommissionMax: &max}, 1000000, 500},
+		{"never more than the deposit", Agent{CommissionRateBPS: 50, CommissionMin: 200}, 150, 150},
+		{"whole deposit at 100%", Agent{CommissionRateBPS: 10000}, 12345, 12345},
+		{"no commission", Agent{}, 12345, 0},
+		{"largest deposit", Agent{CommissionRateBPS: 10000}, 99999999999999, 99999999999999},
+	}
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			if got := c.agent.commissionOn(c.deposit); got != c.want {
+				t.Errorf("commission on %s at %d bps: %s, want %s", c.deposit, c.agent.CommissionRateBPS, got, c.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,343 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strings"
+	"time"
+
+	"bank/servicekit"
+
+	"github.com/gorilla/mux"
+	"go.uber.org/zap"
+)
+
+// AlertRule notifies the customer when an account event matches a condition
+type AlertRule struct {
+	ID              int    `json:"id"`
+	AccountID       int    `json:"account_id"`
+	RuleType        string `json:"rule_type"` // balance_below, transaction_over or foreign_transaction
+	Threshold       Money  `json:"threshold,omitempty"`
+	HomeCountry     string `json:"home_country,omitempty"`
+	Channel         string `json:"channel"`
+	Enabled         bool   `json:"enabled"`
+	LastTriggeredAt string `json:"last_triggered_at,omitempty"`
+	CreatedAt       string `json:"created_at"`
+	UpdatedAt       string `json:"updated_at"`
+}
+
+// AccountEvent is a balance-affecting event that alert rules are evaluated against
+type AccountEvent struct {
+	AccountID int
+	Type      string // deposit, withdrawal or card_authorization
+	Amount    Money
+	Country   string
+	Merchant  string
+}
+
+const alertRuleTablesSQL = `
+	CREATE TABLE IF NOT EXISTS alert_rules (
+		id SERIAL PRIMARY KEY,
+		account_id INTEGER NOT NULL REFERENCES accounts(id),
+		rule_type VARCHAR(30) NOT NULL,
+		threshold DECIMAL(15,2) NOT NULL DEFAULT 0,
+		home_country VARCHAR(2) NOT NULL DEFAULT '',
+		channel VARCHAR(10) NOT NULL DEFAULT 'push',
+		enabled BOOLEAN NOT NULL DEFAULT TRUE,
+		below_triggered BOOLEAN NOT NULL DEFAULT FALSE,
+		last_triggered_at TIMESTAMP,
+		created_at TIMESTAMP NOT NULL DEFAULT NOW(),
+		updated_at TIMESTAMP NOT NULL DEFAULT NOW()
+	);
+	CREATE INDEX IF NOT EXISTS idx_alert_rules_account ON alert_rules(account_id) WHERE enabled;`
+
+// maxAlertRules bounds the rules per account
+const maxAlertRules = 20
+
+var alertRuleTypes = map[string]bool{"balance_below": true, "transaction_over": true, "foreign_transaction": true}
+
+var alertChannels = map[string]bool{"push": true, "email": true, "sms": true}
+
+const alertRuleColumns = `id, account_id, rule_type, threshold, home_country, channel, enabled,
+	COALESCE(last_triggered_at::text, ''), created_at, updated_at`
+
+func scanAlertRule(row interface{ Scan(...interface{}) error }, a *AlertRule) error {
+	return row.Scan(&a.ID, &a.AccountID, &a.RuleType, &a.Threshold, &a.HomeCountry, &a.Channel, &a.Enabled,
+		&a.LastTriggeredAt, &a.CreatedAt, &a.UpdatedAt)
+}
+
+// validate checks the rule and fills defaults
+func (a *AlertRule) validate() error {
+	a.HomeCountry = strings.ToUpper(strings.TrimSpace(a.HomeCountry))
+	if a.Channel == "" {
+		a.Channel = "push"
+	}
+	if !alertChannels[a.Channel] {
+		return fmt.Errorf("channel must be push, email or sms")
+	}
+	switch a.RuleType {
+	case "balance_below":
+		if a.Threshold < 0 {
+			return fmt.Errorf("threshold must not be negative")
+		}
+	case "transaction_over":
+		if a.Threshold <= 0 {
+			return fmt.Errorf("threshold must be positive")
+		}
+	case "foreign_transaction":
+		if len(a.HomeCountry) != 2 {
+			return fmt.Errorf("home_country must be an ISO 3166-1 alpha-2 code")
+		}
+	default:
+		return fmt.Errorf("rule_type must be balance_below, transaction_over or foreign_transaction")
+	}
+	return nil
+}
+
+func createAlertRule(w http.ResponseWriter, r *http.Request) {
+	var a AlertRule
+	err := json.NewDecoder(r.Body).Decode(&a)
+	if err != nil {
+		http.Error(w, "Invalid request body", http.StatusBadRequest)
+		return
+	}
+
+	// Foreign transaction rules default to the home country of the geo rule
+	if a.RuleType == "foreign_transaction" && a.HomeCountry == "" {
+		db.QueryRowContext(r.Context(), `SELECT home_country FROM account_geo_rules WHERE account_id = $1`,
+			mux.Vars(r)["id"]).Scan(&a.HomeCountry)
+	}
+	if err := a.validate(); err != nil {
+		http.Error(w, "Invalid alert rule", http.StatusBadRequest)
+		return
+	}
+
+	err = scanAlertRule(db.QueryRowContext(r.Context(), `INSERT INTO alert_rules (account_id, rule_type, threshold, home_country, channel)
+								  SELECT id, $2, $3, $4, $5 FROM accounts
+								  WHERE id = $1 AND (SELECT COUNT(*) FROM alert_rules WHERE account_id = $1) < $6
+								  RETURNING `+alertRuleColumns, mux.Vars(r)["id"], a.RuleType, a.Threshold, a.HomeCountry,
+		a.Channel, maxAlertRules), &a)
+	if err != nil {
+		if err == sql.ErrNoRows {
+			http.Error(w, fmt.Sprintf("Account not found or already has %d alert rules", maxAlertRules), http.StatusConflict)
+		} else {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+		}
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusCreated)
+	json.NewEncoder(w).Encode(a)
+}
+
+func listAlertRules(w http.ResponseWriter, r *http.Request) {
+	rows, err := db.QueryContext(r.Context(), `SELECT `+alertRuleColumns+` FROM alert_rules
+											   WHERE account_id = $1 ORDER BY id`, mux.Vars(r)["id"])
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	defer rows.Close()
+
+	rules := []AlertRule{}
+	for rows.Next() {
+		var a AlertRule
+		if err := scanAlertRule(rows, &a); err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		rules = append(rules, a)
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(rules)
+}
+
+// updateAlertRule replaces the rule's condition, channel and enabled flag
+func updateAlertRule(w http.ResponseWriter, r *http.Request) {
+	var a AlertRule
+	err := json.NewDecoder(r.Body).Decode(&a)
+	if err != nil {
+		http.Error(w, "Invalid request body", http.StatusBadRequest)
+		return
+	}
+
+	params := mux.Vars(r)
+	var ruleType string
+	err = db.QueryRowContext(r.Context(), `SELECT rule_type FROM alert_rules WHERE id = $1 AND account_id = $2`,
+		params["ruleId"], params["id"]).Scan(&ruleType)
+	if err == sql.ErrNoRows {
+		http.Error(w, "Alert rule not found", http.StatusNotFound)
+		return
+	}
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	a.RuleType = ruleType
+	if err := a.validate(); err != nil {
+		http.Error(w, "Invalid alert rule", http.StatusBadRequest)
+		return
+	}
+
+	err = scanAlertRule(db.QueryRowContext(r.Context(), `UPDATE alert_rules SET threshold = $3, home_country = $4,
+								  channel = $5, enabled = $6, below_triggered = FALSE, updated_at = NOW()
+								  WHERE id = $1 AND account_id = $2 RETURNING `+alertRuleColumns,
+		params["ruleId"], params["id"], a.Threshold, a.HomeCountry, a.Channel, a.Enabled), &a)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(a)
+}
+
+func deleteAlertRule(w http.ResponseWriter, r *http.Request) {
+	params := mux.Vars(r)
+	result, err := db.ExecContext(r.Context(), `DELETE FROM alert_rules WHERE id = $1 AND account_id = $2`,
+		params["ruleId"], params["id"])
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	if n, _ := result.RowsAffected(); n == 0 {
+		http.Error(w, "Alert rule not found", http.StatusNotFound)
+		return
+	}
+
+	w.WriteHeader(http.StatusNoContent)
+}
+
+var (
+	depositsTotal    = servicekit.NewCounterVec("bank_deposits_total", "Deposits posted to customer accounts.")
+	withdrawalsTotal = servicekit.NewCounterVec("bank_withdrawals_total", "Withdrawals posted from customer accounts.")
+)
+
+// publishAccountEvent evaluates the account's alert rules and auto top-up
+// against the event and notifies the customer of deposits and withdrawals, in
+// the background so the request that caused it is not delayed
+func publishAccountEvent(event AccountEvent) {
+	switch event.Type {
+	case "deposit":
+		depositsTotal.Inc()
+	case "withdrawal":
+		withdrawalsTotal.Inc()
+	}
+	go func() {
+		ctx := serviceContext
+		if err := evaluateAlertRules(ctx, event); err != nil {
+			logger.Error("alert rule evaluation failed", zap.Int("account_id", event.AccountID), zap.Error(err))
+		}
+		if event.Type == "deposit" || event.Type == "withdrawal" {
+			if err := notifyAccountEvent(ctx, event); err != nil {
+				logger.Error("failed to notify account event", zap.String("event", event.Type), zap.Int("account_id", event.AccountID), zap.Error(err))
+			}
+		}
+		if event.Type != "deposit" {
+			if err := applyAutoTopUp(ctx, event.AccountID); err != nil {
+				logger.Error("auto top-up failed", zap.Int("account_id", event.AccountID), zap.Error(err))
+			}
+		}
+	}()
+}
+
+// notifyAccountEvent publishes a deposit or withdrawal to the notification
+// service with the balance after it
+func notifyAccountEvent(ctx context.Context, event AccountEvent) error {
+	var customerID int
+	var balance Money
+	var currencyCode string
+	err := db.QueryRowContext(ctx, `SELECT customer_id, balance, currency_code FROM accounts WHERE id = $1`,
+		event.AccountID).Scan(&customerID, &balance, &currencyCode)
+	if err != nil {
+		return err
+	}
+	return publishNotificationEvent(ctx, NotificationEvent{
+		Type:       event.Type,
+		CustomerID: customerID,
+		Data: map[string]interface{}{
+			"account_id":    event.AccountID,
+			"amount":        event.Amount.String(),
+			"balance":       balance.String(),
+			"currency_code": currencyCode,
+			"time":          time.Now().UTC().Format(time.RFC3339),
+		},
+	})
+}
+
+func evaluateAlertRules(ctx context.Context, event AccountEvent) error {
+	var customerID int
+	var balance Money
+	err := db.QueryRowContext(ctx, `SELECT customer_id, balance FROM accounts WHERE id = $1`, event.AccountID).Scan(&customerID, &balance)
+	if err != nil {
+		return err
+	}
+
+	rows, err := db.QueryContext(ctx, `SELECT `+alertRuleColumns+` FROM alert_rules WHERE account_id = $1 AND enabled`, event.AccountID)
+	if err != nil {
+		return err
+	}
+	var rules []AlertRule
+	for rows.Next() {
+		var a AlertRule
+		if err := scanAlertRule(rows, &a); err != nil {
+			rows.Close()
+			return err
+		}
+		rules = append(rules, a)
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return err
+	}
+
+	for _, rule := range rules {
+		var matched bool
+		switch rule.RuleType {
+		case "balance_below":
+			// Alert once when the balance drops below the threshold and re-arm
+			// when it recovers, instead of alerting on every transaction
+			below := balance < rule.Threshold
+			result, err := db.ExecContext(ctx, `UPDATE alert_rules SET below_triggered = $2 WHERE id = $1 AND below_triggered <> $2`,
+				rule.ID, below)
+			if err != nil {
+				return err
+			}
+			changed, _ := result.RowsAffected()
+			matched = below && changed > 0
+		case "transaction_over":
+			matched = event.Type != "deposit" && event.Amount > rule.Threshold
+		case "foreign_transaction":
+			matched = event.Country != "" && event.Country != rule.HomeCountry
+		}
+		if !matched {
+			continue
+		}
+
+		err := sendNotification(ctx, Notification{
+			CustomerID: customerID,
+			Channel:    rule.Channel,
+			Template:   "alert_" + rule.RuleType,
+			Data: map[string]interface{}{
+				"account_id": event.AccountID,
+				"event_type": event.Type,
+				"amount":     event.Amount,
+				"merchant":   event.Merchant,
+				"country":    event.Country,
+				"balance":    balance,
+				"threshold":  rule.Threshold,
+			},
+		})
+		if err != nil {
+			servicekit.RequestLogger(ctx).Error("failed to send alert", zap.String("rule_type", rule.RuleType), zap.Error(err))
+			continue
+		}
+		db.ExecContext(ctx, `UPDATE alert_rules SET last_triggered_at = NOW() WHERE id = $1`, rule.ID)
+	}
+	return nil
+}
@@ -0,0 +1,161 @@
+package main
+
+import "bank/servicekit"
+
+// apiDocs annotates the routes in the OpenAPI document served at
+// /openapi.json. Routes without an entry are still listed, with their path
+// parameters and a tag from their first path segment; add an entry when a
+// route is added or its request or response changes.
+var apiDocs = map[string]servicekit.APIOperation{
+	"GET /accounts": {
+		Summary:  "List accounts",
+		Tags:     []string{"accounts"},
+		Query:    map[string]string{"limit": "Page size, default 100", "offset": "Accounts to skip"},
+		Response: []Account{},
+	},
+	"POST /accounts": {
+		Summary:  "Open an account",
+		Tags:     []string{"accounts"},
+		Request:  Account{},
+		Response: Account{},
+		Status:   201,
+	},
+	"POST /accounts/bulk": {
+		Summary:     "Open accounts in bulk for an onboarding migration",
+		Description: "Up to 5000 accounts, written in transactions of chunk_size (default 100). The report lists the outcome of every item; send an Idempotency-Key header to make retries safe.",
+		Tags:        []string{"accounts"},
+		Request:     bulkAccountsRequest{},
+		Response:    BulkAccountsReport{},
+	},
+	"GET /accounts/{id}": {
+		Summary:  "Get an account",
+		Tags:     []string{"accounts"},
+		Response: Account{},
+	},
+	"PUT /accounts/{id}": {
+		Summary:  "Update an account",
+		Tags:     []string{"accounts"},
+		Request:  Account{},
+		Response: Account{},
+	},
+	"PUT /accounts/{id}/metadata": {
+		Summary:  "Set the nickname, colour and icon of an account",
+		Tags:     []string{"accounts"},
+		Request:  AccountMetadata{},
+		Response: Account{},
+	},
+	"PUT /accounts/{id}/overdraft-limit": {
+		Summary:     "Set the overdraft limit of an account",
+		Description: "Withdrawals and transfers may take the balance down to -overdraft_limit; 0 removes the overdraft. Refused with 409 below the amount the account is overdrawn by.",
+		Tags:        []string{"accounts"},
+		Request:     overdraftLimitRequest{},
+		Response:    Account{},
+	},
+	"GET /accounts/{id}/balance": {
+		Summary:  "Get the ledger and available balance",
+		Tags:     []string{"balances"},
+		Response: balanceResponse{},
+	},
+	"POST /accounts/balances:batch": {
+		Summary:     "Get the balances of several accounts",
+		Description: "Up to 500 account IDs. Accounts that do not exist or that the caller may not read are listed in not_found.",
+		Tags:        []string{"balances"},
+		Request:     batchBalancesRequest{},
+		Response:    batchBalancesResponse{},
+	},
+	"GET /accounts/{id}/balance-history": {
+		Summary: "Get end of day balances",
+		Tags:    []string{"balances"},
+		Query: map[string]string{
+			"granularity": "day (default) or month",
+			"from":        "First date, YYYY-MM-DD",
+			"to":          "Last date, YYYY-MM-DD",
+		},
+	},
+	"POST /accounts/{id}/deposit": {
+		Summary:     "Deposit funds",
+		Description: "Send an Idempotency-Key header to make retries safe.",
+		Tags:        []string{"funds"},
+		Request:     amountRequest{},
+		Response:    fundsResponse{},
+	},
+	"POST /accounts/{id}/withdraw": {
+		Summary:     "Withdraw funds",
+		Description: "Send an Idempotency-Key header to make retries safe.",
+		Tags:        []string{"funds"},
+		Request:     amountRequest{},
+		Response:    fundsResponse{},
+	},
+	"POST /accounts/transfer": {
+		Summary:     "Transfer between two accounts",
+		Description: "Send an Idempotency-Key header to make retries safe.",
+		Tags:        []string{"transfers"},
+		Request:     Transfer{},
+		Response:    Transfer{},
+		Status:      201,
+	},
+	"GET /transfers/{reference}": {
+		Summary:  "Get a transfer by reference",
+		Tags:     []string{"transfers"},
+		Response: Transfer{},
+	},
+	"POST /accounts/{id}/authorizations": {
+		Summary:  "Authorize a card or bill payment",
+		Tags:     []string{"authorizations"},
+		Request:  AuthorizationRequest{},
+		Response: AuthorizationDecision{},
+	},
+	"POST /accounts/{id}/reconciliations": {
+		Summary:     "Reconcile a ledger extract against a business account",
+		Description: "The body is CSV with a header naming date (YYYY-MM-DD) and amount columns, money received positive, and optionally reference and description; at most 20000 entries over 366 days. The report is generated asynchronously; poll the Location returned.",
+		Tags:        []string{"reconciliations"},
+		Query:       map[string]string{"date_tolerance_days": "Days an entry and its transaction may be apart, default 3, at most 10"},
+		Response:    ReconciliationJob{},
+		Status:      202,
+	},
+	"GET /accounts/{id}/reconciliations/{reconciliationId}": {
+		Summary:  "Get a reconciliation and, once completed, its report",
+		Tags:     []string{"reconciliations"},
+		Response: ReconciliationJob{},
+	},
+	"GET /pay-in/{reference}": {
+		Summary: "Look up the account a pay-in reference credits",
+		Tags:    []string{"payments"},
+		Public:  true,
+	},
+
+	// v2 differs from v1 in its account representation
+	"GET /v2/accounts": {
+		Summary:  "List accounts",
+		Tags:     []string{"accounts"},
+		Query:    map[string]string{"limit": "Page size, default 100", "offset": "Accounts to skip", "expand": "owner, product or transactions, comma separated"},
+		Response: []AccountV2{},
+	},
+	"GET /v2/accounts/{id}": {
+		Summary:  "Get an account",
+		Tags:     []string{"accounts"},
+		Query:    map[string]string{"expand": "owner, product or transactions, comma separated"},
+		Response: AccountV2{},
+	},
+}
+
+// Handlers that answer with a map have their shape described here
+
+type amountRequest struct {
+	Amount Money `json:"amount"`
+}
+
+type fundsResponse struct {
+	AccountID    int    `json:"account_id"`
+	Balance      Money  `json:"balance"`
+	CurrencyCode string `json:"currency_code"`
+	Message      string `json:"message"`
+}
+
+type balanceResponse struct {
+	AccountID        int    `json:"account_id"`
+	Balance          Money  `json:"balance"`
+	AvailableBalance Money  `json:"available_balance"`
+	LienAmount       Money  `json:"lien_amount"`
+	CurrencyCode     string `json:"currency_code"`
+}
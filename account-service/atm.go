@@ -0,0 +1,728 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"database/sql"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"bank/servicekit"
+
+	"github.com/gorilla/mux"
+	"go.uber.org/zap"
+)
+
+// ATM withdrawals are authorized apart from counter withdrawals. The ATM
+// switch presents the card number and PIN block; once the PIN verifies and
+// the card's daily limit and the authorization pipeline allow it, the cash is
+// reserved with a lien for ATM_RESERVATION_TTL. The switch then confirms what
+// the ATM dispensed, which debits the account, or reverses the withdrawal
+// when the dispense failed.
+
+// ATMCard links a card number to the account its ATM withdrawals draw on.
+// Only a keyed hash of the number and its last four digits are stored.
+type ATMCard struct {
+	ID          int    `json:"id"`
+	AccountID   int    `json:"account_id"`
+	LastFour    string `json:"last_four"`
+	Status      string `json:"status"` // active, blocked or pin_locked
+	DailyLimit  Money  `json:"daily_limit"`
+	PINFailures int    `json:"pin_failures"`
+	IssuedBy    string `json:"issued_by"`
+	CreatedAt   string `json:"created_at"`
+}
+
+// ATMWithdrawal is one authorized ATM withdrawal
+type ATMWithdrawal struct {
+	Reference       string `json:"reference"`
+	CardID          int    `json:"card_id"`
+	AccountID       int    `json:"account_id"`
+	TerminalID      string `json:"terminal_id"`
+	Amount          Money  `json:"amount"`
+	DispensedAmount *Money `json:"dispensed_amount,omitempty"`
+	CurrencyCode    string `json:"currency_code"`
+	Status          string `json:"status"` // reserved, completed, reversed or expired
+	LienID          int    `json:"lien_id"`
+	ReversalReason  string `json:"reversal_reason,omitempty"`
+	ExpiresAt       string `json:"expires_at"`
+	CreatedAt       string `json:"created_at"`
+}
+
+// ATMAuthorization answers an ATM authorization; approved ones carry the
+// reference to confirm or reverse
+type ATMAuthorization struct {
+	AuthorizationDecision
+	Reference string `json:"reference,omitempty"`
+	ExpiresAt string `json:"expires_at,omitempty"`
+}
+
+// cardOperationsRoles link and block ATM cards; atmSwitchRoles authorize,
+// confirm and reverse ATM withdrawals
+var (
+	cardOperationsRoles = []string{"card_operations", "admin"}
+	atmSwitchRoles      = []string{"atm_switch", "admin"}
+)
+
+// atmLienReason marks the liens that reserve ATM cash
+const atmLienReason = "atm_withdrawal"
+
+const atmCardColumns = `id, account_id, last_four, status, daily_limit, pin_failures, issued_by, created_at::text`
+
+func scanATMCard(row interface{ Scan(...interface{}) error }, c *ATMCard) error {
+	return row.Scan(&c.ID, &c.AccountID, &c.LastFour, &c.Status, &c.DailyLimit, &c.PINFailures, &c.IssuedBy,
+		&c.CreatedAt)
+}
+
+const atmWithdrawalColumns = `reference, card_id, account_id, terminal_id, amount, dispensed_amount, currency_code,
+	status, lien_id, reversal_reason, expires_at::text, created_at::text`
+
+func scanATMWithdrawal(row interface{ Scan(...interface{}) error }, a *ATMWithdrawal) error {
+	return row.Scan(&a.Reference, &a.CardID, &a.AccountID, &a.TerminalID, &a.Amount, &a.DispensedAmount,
+		&a.CurrencyCode, &a.Status, &a.LienID, &a.ReversalReason, &a.ExpiresAt, &a.CreatedAt)
+}
+
+// PINVerifier checks a card's PIN block, normally in the card processor's HSM
+type PINVerifier interface {
+	VerifyPIN(ctx context.Context, cardNumber, pinBlock string) (bool, error)
+}
+
+var pinVerifier PINVerifier
+
+var errPINVerifierUnavailable = errors.New("PIN verification unavailable")
+
+// newPINVerifier returns the verifier selected by ATM_PIN_VERIFIER: "http"
+// asks the service at PIN_VERIFICATION_URL and "simulator" accepts
+// ATM_SIMULATOR_PIN in development. "none" (the default) declines every ATM
+// authorization.
+func newPINVerifier(name string) PINVerifier {
+	switch name {
+	case "", "none":
+		return nil
+	case "http":
+		url := getEnv("PIN_VERIFICATION_URL", "")
+		if url == "" {
+			logger.Fatal("PIN_VERIFICATION_URL is required for the http PIN verifier")
+		}
+		return &httpPINVerifier{url: url, client: &http.Client{Timeout: 2 * time.Second}}
+	case "simulator":
+		if getEnv("APP_ENV", "development") != "development" {
+			logger.Fatal("the simulator PIN verifier is only allowed in development")
+		}
+		return simulatedPINVerifier{pin: getEnv("ATM_SIMULATOR_PIN", "1234")}
+	default:
+		logger.Fatal("unsupported PIN verifier", zap.String("verifier", name))
+		return nil
+	}
+}
+
+// httpPINVerifier posts {"card_number", "pin_block"} and expects
+// {"verified": bool}
+type httpPINVerifier struct {
+	url    string
+	client *http.Client
+}
+
+func (v *httpPINVerifier) VerifyPIN(ctx context.Context, cardNumber, pinBlock string) (bool, error) {
+	payload, _ := json.Marshal(map[string]string{"card_number": cardNumber, "pin_block": pinBlock})
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, v.url, bytes.NewReader(payload))
+	if err != nil {
+		return false, err
+	}
+	req.Header.Set("Content-Type", "application/json")
+
+	resp, err := v.client.Do(req)
+	if err != nil {
+		return false, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return false, fmt.Errorf("PIN verification returned status %d", resp.StatusCode)
+	}
+	var result struct {
+		Verified bool `json:"verified"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&result); err != nil {
+		return false, err
+	}
+	return result.Verified, nil
+}
+
+// simulatedPINVerifier takes the PIN block to be the plain PIN
+type simulatedPINVerifier struct {
+	pin string
+}
+
+func (v simulatedPINVerifier) VerifyPIN(_ context.Context, _, pinBlock string) (bool, error) {
+	return pinBlock == v.pin, nil
+}
+
+// atmReservationTTL is how long reserved cash waits for the switch to confirm
+// or reverse, ATM_RESERVATION_TTL
+func atmReservationTTL() time.Duration {
+	ttl, err := time.ParseDuration(getEnv("ATM_RESERVATION_TTL", "5m"))
+	if err != nil || ttl <= 0 {
+		return 5 * time.Minute
+	}
+	return ttl
+}
+
+// atmPINAttempts is how many wrong PINs in a row lock a card, ATM_PIN_ATTEMPTS
+func atmPINAttempts() int {
+	attempts, err := strconv.Atoi(getEnv("ATM_PIN_ATTEMPTS", "3"))
+	if err != nil || attempts <= 0 {
+		return 3
+	}
+	return attempts
+}
+
+func newATMReference() string {
+	raw := make([]byte, 8)
+	rand.Read(raw)
+	return "ATM-" + strings.ToUpper(hex.EncodeToString(raw))
+}
+
+// linkATMCard links a card to an account with a daily ATM limit, by default
+// ATM_DAILY_LIMIT
+func linkATMCard(w http.ResponseWriter, r *http.Request) {
+	if !requireRole(w, r, cardOperationsRoles...) {
+		return
+	}
+
+	var req struct {
+		CardNumber string `json:"card_number"`
+		DailyLimit Money  `json:"daily_limit"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, "Invalid request body", http.StatusBadRequest)
+		return
+	}
+	pan, err := normalizeTokenValue("pan", req.CardNumber)
+	if err != nil {
+		http.Error(w, "card_number is not a valid card number", http.StatusBadRequest)
+		return
+	}
+	if req.DailyLimit == 0 {
+		if req.DailyLimit, err = parseMoney(getEnv("ATM_DAILY_LIMIT", "500")); err != nil {
+			http.Error(w, "ATM_DAILY_LIMIT is invalid", http.StatusInternalServerError)
+			return
+		}
+	}
+	if req.DailyLimit <= 0 {
+		http.Error(w, "daily_limit must be positive", http.StatusBadRequest)
+		return
+	}
+
+	var card ATMCard
+	err = scanATMCard(db.QueryRowContext(r.Context(), `INSERT INTO atm_cards (account_id, pan_lookup, last_four,
+												 daily_limit, issued_by) VALUES ($1, $2, $3, $4, $5)
+												 RETURNING `+atmCardColumns,
+		mux.Vars(r)["id"], tokenValueLookup("atm_card", pan), pan[len(pan)-4:], req.DailyLimit, requestActor(r)), &card)
+	if err != nil {
+		writeDBError(w, err)
+		return
+	}
+
+	servicekit.RequestLogger(r.Context()).Info("atm card linked", zap.Int("card_id", card.ID), zap.Int("account_id", card.AccountID),
+		zap.String("actor", card.IssuedBy))
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusCreated)
+	json.NewEncoder(w).Encode(card)
+}
+
+// listATMCards returns the cards linked to an account
+func listATMCards(w http.ResponseWriter, r *http.Request) {
+	if requestRole(r) != "customer" && !requireRole(w, r, cardOperationsRoles...) {
+		return
+	}
+
+	rows, err := db.QueryContext(r.Context(), `SELECT `+atmCardColumns+` FROM atm_cards WHERE account_id = $1
+											   ORDER BY id`, mux.Vars(r)["id"])
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	defer rows.Close()
+
+	cards := []ATMCard{}
+	for rows.Next() {
+		var c ATMCard
+		if err := scanATMCard(rows, &c); err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		cards = append(cards, c)
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(cards)
+}
+
+// updateATMCardStatus blocks a card or reactivates it, which also clears a PIN
+// lock
+func updateATMCardStatus(w http.ResponseWriter, r *http.Request) {
+	if !requireRole(w, r, cardOperationsRoles...) {
+		return
+	}
+
+	var req struct {
+		Status string `json:"status"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, "Invalid request body", http.StatusBadRequest)
+		return
+	}
+	if req.Status != "active" && req.Status != "blocked" {
+		http.Error(w, "status must be active or blocked", http.StatusBadRequest)
+		return
+	}
+
+	var card ATMCard
+	err := scanATMCard(db.QueryRowContext(r.Context(), `UPDATE atm_cards SET status = $2, pin_failures = 0,
+												 updated_at = NOW() WHERE id = $1 RETURNING `+atmCardColumns,
+		mux.Vars(r)["id"], req.Status), &card)
+	if err != nil {
+		if err == sql.ErrNoRows {
+			http.Error(w, "Card not found", http.StatusNotFound)
+		} else {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+		}
+		return
+	}
+
+	servicekit.RequestLogger(r.Context()).Info("atm card status changed", zap.Int("card_id", card.ID),
+		zap.String("status", card.Status), zap.String("actor", requestActor(r)))
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(card)
+}
+
+// authorizeATMWithdrawal verifies the card and PIN, runs the authorization
+// pipeline on the atm channel and reserves the cash. Declines are answered
+// with a 200 and their code, like card authorizations; every outcome after
+// the card is found is written to authorization_log.
+func authorizeATMWithdrawal(w http.ResponseWriter, r *http.Request) {
+	if !requireRole(w, r, atmSwitchRoles...) {
+		return
+	}
+
+	var req struct {
+		CardNumber string `json:"card_number"`
+		PINBlock   string `json:"pin_block"`
+		TerminalID string `json:"terminal_id"`
+		Amount     Money  `json:"amount"`
+		Country    string `json:"country"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, "Invalid request body", http.StatusBadRequest)
+		return
+	}
+	req.TerminalID = strings.TrimSpace(req.TerminalID)
+	if req.Amount <= 0 {
+		http.Error(w, "Amount must be positive", http.StatusBadRequest)
+		return
+	}
+	if req.TerminalID == "" || req.PINBlock == "" {
+		http.Error(w, "terminal_id and pin_block are required", http.StatusBadRequest)
+		return
+	}
+	pan, err := normalizeTokenValue("pan", req.CardNumber)
+	if err != nil {
+		http.Error(w, "card_number is not a valid card number", http.StatusBadRequest)
+		return
+	}
+	if pinVerifier == nil {
+		http.Error(w, "PIN verification is not configured", http.StatusServiceUnavailable)
+		return
+	}
+
+	var card ATMCard
+	err = scanATMCard(db.QueryRowContext(r.Context(), `SELECT `+atmCardColumns+` FROM atm_cards WHERE pan_lookup = $1`,
+		tokenValueLookup("atm_card", pan)), &card)
+	if err == sql.ErrNoRows {
+		writeATMAuthorization(w, ATMAuthorization{AuthorizationDecision: *decline("unknown_card", "Card not recognised")})
+		return
+	}
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	authReq := AuthorizationRequest{AccountID: card.AccountID, Amount: req.Amount, Channel: "atm",
+		MerchantID: req.TerminalID, MerchantName: "ATM " + req.TerminalID, MerchantCategory: "atm",
+		Country: strings.ToUpper(strings.TrimSpace(req.Country))}
+	result, err := decideATMWithdrawal(r, card, pan, req.PINBlock, &authReq)
+	if err != nil {
+		if err == errPINVerifierUnavailable {
+			http.Error(w, err.Error(), http.StatusBadGateway)
+		} else {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+		}
+		return
+	}
+	if err := recordAuthorization(r.Context(), &authReq, result.AuthorizationDecision); err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	if !result.Approved {
+		servicekit.RecordOpsEvent(servicekit.MetricDeclinedTransactions)
+	}
+	writeATMAuthorization(w, result)
+}
+
+// decideATMWithdrawal checks the card, PIN and pipeline, then reserves the
+// cash. The card and account rows are locked while the daily limit and funds
+// are checked, so concurrent withdrawals cannot both pass.
+func decideATMWithdrawal(r *http.Request, card ATMCard, pan, pinBlock string, authReq *AuthorizationRequest) (ATMAuthorization, error) {
+	ctx := r.Context()
+	switch card.Status {
+	case "blocked":
+		return ATMAuthorization{AuthorizationDecision: *decline("card_blocked", "Card is blocked")}, nil
+	case "pin_locked":
+		return ATMAuthorization{AuthorizationDecision: *decline("pin_tries_exceeded", "Too many incorrect PINs")}, nil
+	}
+
+	verified, err := pinVerifier.VerifyPIN(ctx, pan, pinBlock)
+	if err != nil {
+		servicekit.RequestLogger(ctx).Error("pin verification failed", zap.Int("card_id", card.ID), zap.Error(err))
+		return ATMAuthorization{}, errPINVerifierUnavailable
+	}
+	if !verified {
+		var status string
+		err := db.QueryRowContext(ctx, `UPDATE atm_cards SET pin_failures = pin_failures + 1,
+										status = CASE WHEN pin_failures + 1 >= $2 THEN 'pin_locked' ELSE status END,
+										updated_at = NOW() WHERE id = $1 RETURNING status`,
+			card.ID, atmPINAttempts()).Scan(&status)
+		if err != nil {
+			return ATMAuthorization{}, err
+		}
+		if status == "pin_locked" {
+			servicekit.RequestLogger(ctx).Warn("atm card pin locked", zap.Int("card_id", card.ID))
+		}
+		return ATMAuthorization{AuthorizationDecision: *decline("incorrect_pin", "Incorrect PIN")}, nil
+	}
+	if card.PINFailures > 0 {
+		if _, err := db.ExecContext(ctx, `UPDATE atm_cards SET pin_failures = 0 WHERE id = $1`, card.ID); err != nil {
+			return ATMAuthorization{}, err
+		}
+	}
+
+	decision, err := runAuthorization(ctx, authReq)
+	if err != nil {
+		return ATMAuthorization{}, err
+	}
+	if !decision.Approved {
+		return ATMAuthorization{AuthorizationDecision: decision}, nil
+	}
+
+	tx, err := db.BeginTx(ctx, nil)
+	if err != nil {
+		return ATMAuthorization{}, err
+	}
+	defer tx.Rollback()
+
+	amount := authReq.Amount
+	_, err = tx.ExecContext(ctx, `SELECT id FROM atm_cards WHERE id = $1 FOR UPDATE`, card.ID)
+	if err != nil {
+		return ATMAuthorization{}, err
+	}
+	var used Money
+	err = tx.QueryRowContext(ctx, `SELECT COALESCE(SUM(COALESCE(dispensed_amount, amount)), 0) FROM atm_withdrawals
+								   WHERE card_id = $1 AND status IN ('reserved', 'completed')
+								   AND created_at >= date_trunc('day', NOW())`, card.ID).Scan(&used)
+	if err != nil {
+		return ATMAuthorization{}, err
+	}
+	if used+amount > card.DailyLimit {
+		return ATMAuthorization{AuthorizationDecision: *decline("atm_daily_limit", "Daily ATM limit exceeded")}, nil
+	}
+
+	var balance Money
+	var currency string
+	err = tx.QueryRowContext(ctx, `SELECT balance, currency_code FROM accounts WHERE id = $1 FOR UPDATE`,
+		card.AccountID).Scan(&balance, &currency)
+	if err != nil {
+		return ATMAuthorization{}, err
+	}
+	liens, err := activeLienTotal(ctx, tx, card.AccountID)
+	if err != nil {
+		return ATMAuthorization{}, err
+	}
+	if balance-liens < amount {
+		return ATMAuthorization{AuthorizationDecision: *decline("insufficient_funds", "Insufficient funds")}, nil
+	}
+
+	reference := newATMReference()
+	expiresAt := time.Now().Add(atmReservationTTL()).UTC()
+	lien := Lien{AccountID: card.AccountID, Amount: amount, Reason: atmLienReason, Reference: reference,
+		CreatedBy: requestActor(r)}
+	if err := insertLien(ctx, tx, &lien, expiresAt); err != nil {
+		return ATMAuthorization{}, err
+	}
+	var withdrawal ATMWithdrawal
+	err = scanATMWithdrawal(tx.QueryRowContext(ctx, `INSERT INTO atm_withdrawals (reference, card_id, account_id,
+												 terminal_id, amount, currency_code, lien_id, expires_at)
+												 VALUES ($1, $2, $3, $4, $5, $6, $7, $8) RETURNING `+atmWithdrawalColumns,
+		reference, card.ID, card.AccountID, authReq.MerchantID, amount, currency, lien.ID, expiresAt), &withdrawal)
+	if err != nil {
+		return ATMAuthorization{}, err
+	}
+	if err := tx.Commit(); err != nil {
+		return ATMAuthorization{}, err
+	}
+
+	servicekit.RequestLogger(ctx).Info("atm cash reserved", zap.String("reference", reference), zap.Int("card_id", card.ID),
+		zap.String("terminal_id", withdrawal.TerminalID), zap.String("amount", amount.String()))
+	return ATMAuthorization{AuthorizationDecision: decision, Reference: reference, ExpiresAt: withdrawal.ExpiresAt}, nil
+}
+
+func writeATMAuthorization(w http.ResponseWriter, a ATMAuthorization) {
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(a)
+}
+
+// lockATMWithdrawal loads a withdrawal for update inside tx, writing a 404
+// when the reference is unknown
+func lockATMWithdrawal(w http.ResponseWriter, r *http.Request, tx *sql.Tx) (ATMWithdrawal, bool) {
+	var a ATMWithdrawal
+	err := scanATMWithdrawal(tx.QueryRowContext(r.Context(), `SELECT `+atmWithdrawalColumns+` FROM atm_withdrawals
+															  WHERE reference = $1 FOR UPDATE`, mux.Vars(r)["reference"]), &a)
+	if err != nil {
+		if err == sql.ErrNoRows {
+			http.Error(w, "Withdrawal not found", http.StatusNotFound)
+		} else {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+		}
+		return a, false
+	}
+	return a, true
+}
+
+// releaseATMReservation releases the lien that reserves a withdrawal's cash,
+// unless it already lapsed
+func releaseATMReservation(r *http.Request, tx *sql.Tx, a ATMWithdrawal, note string) error {
+	_, err := changeLien(r.Context(), tx, a.LienID, "released", requestActor(r), note,
+		"status = 'released', released_at = NOW()")
+	if err == sql.ErrNoRows {
+		return nil
+	}
+	return err
+}
+
+// confirmATMWithdrawal debits what the ATM dispensed, by default the whole
+// amount, and releases the reservation. A partial dispense debits only the
+// cash that came out.
+func confirmATMWithdrawal(w http.ResponseWriter, r *http.Request) {
+	if !requireRole(w, r, atmSwitchRoles...) {
+		return
+	}
+
+	var req struct {
+		DispensedAmount *Money `json:"dispensed_amount"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, "Invalid request body", http.StatusBadRequest)
+		return
+	}
+
+	tx, err := db.BeginTx(r.Context(), nil)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	defer tx.Rollback()
+
+	a, ok := lockATMWithdrawal(w, r, tx)
+	if !ok {
+		return
+	}
+	if a.Status != "reserved" {
+		http.Error(w, "Withdrawal is "+a.Status, http.StatusConflict)
+		return
+	}
+	dispensed := a.Amount
+	if req.DispensedAmount != nil {
+		dispensed = *req.DispensedAmount
+	}
+	if dispensed <= 0 || dispensed > a.Amount {
+		http.Error(w, "dispensed_amount must be positive and at most the authorized amount", http.StatusBadRequest)
+		return
+	}
+
+	description := "ATM withdrawal at " + a.TerminalID
+	err = releaseATMReservation(r, tx, a, "ATM cash dispensed")
+	if err == nil {
+		_, err = applyBalanceChange(r.Context(), tx, a.AccountID, -dispensed, description)
+	}
+	if err == nil {
+		posting := ledgerChange(a.AccountID, -dispensed, a.CurrencyCode, description)
+		posting.Type = "withdrawal"
+		err = recordInLedger(r.Context(), tx, posting)
+	}
+	if err != nil {
+		writeTransferError(w, err)
+		return
+	}
+	err = scanATMWithdrawal(tx.QueryRowContext(r.Context(), `UPDATE atm_withdrawals SET status = 'completed',
+												 dispensed_amount = $2, updated_at = NOW() WHERE reference = $1
+												 RETURNING `+atmWithdrawalColumns, a.Reference, dispensed), &a)
+	if err == nil {
+		err = enqueueEvent(r.Context(), tx, "funds.withdrawn", "account:"+strconv.Itoa(a.AccountID), map[string]interface{}{
+			"account_id": a.AccountID, "amount": dispensed, "currency_code": a.CurrencyCode, "channel": "atm",
+			"terminal_id": a.TerminalID, "reference": a.Reference,
+		})
+	}
+	if err == nil {
+		err = tx.Commit()
+	}
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	publishAccountEvent(AccountEvent{AccountID: a.AccountID, Type: "withdrawal", Amount: dispensed})
+	servicekit.RequestLogger(r.Context()).Info("atm withdrawal completed", zap.String("reference", a.Reference),
+		zap.String("dispensed_amount", dispensed.String()))
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(a)
+}
+
+// reverseATMWithdrawal undoes a withdrawal whose dispense failed: a reserved
+// one has its reservation released, a completed one is credited back
+func reverseATMWithdrawal(w http.ResponseWriter, r *http.Request) {
+	if !requireRole(w, r, atmSwitchRoles...) {
+		return
+	}
+
+	var req struct {
+		Reason string `json:"reason"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, "Invalid request body", http.StatusBadRequest)
+		return
+	}
+	req.Reason = strings.TrimSpace(req.Reason)
+	if req.Reason == "" {
+		http.Error(w, "reason is required", http.StatusBadRequest)
+		return
+	}
+
+	tx, err := db.BeginTx(r.Context(), nil)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	defer tx.Rollback()
+
+	a, ok := lockATMWithdrawal(w, r, tx)
+	if !ok {
+		return
+	}
+	switch a.Status {
+	case "reserved":
+		err = releaseATMReservation(r, tx, a, "ATM withdrawal reversed: "+req.Reason)
+	case "completed":
+		err = postBalanceChange(r.Context(), tx, a.AccountID, *a.DispensedAmount,
+			"ATM withdrawal reversal at "+a.TerminalID)
+	default:
+		http.Error(w, "Withdrawal is "+a.Status, http.StatusConflict)
+		return
+	}
+	if err != nil {
+		writeTransferError(w, err)
+		return
+	}
+	err = scanATMWithdrawal(tx.QueryRowContext(r.Context(), `UPDATE atm_withdrawals SET status = 'reversed',
+												 reversal_reason = $2, updated_at = NOW() WHERE reference = $1
+												 RETURNING `+atmWithdrawalColumns, a.Reference, req.Reason), &a)
+	if err == nil {
+		err = tx.Commit()
+	}
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	servicekit.RequestLogger(r.Context()).Info("atm withdrawal reversed", zap.String("reference", a.Reference),
+		zap.String("reason", a.ReversalReason))
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(a)
+}
+
+// getATMWithdrawal lets the switch look up a withdrawal's outcome, e.g. after
+// a timeout
+func getATMWithdrawal(w http.ResponseWriter, r *http.Request) {
+	if !requireRole(w, r, atmSwitchRoles...) {
+		return
+	}
+
+	var a ATMWithdrawal
+	err := scanATMWithdrawal(db.QueryRowContext(r.Context(), `SELECT `+atmWithdrawalColumns+` FROM atm_withdrawals
+															  WHERE reference = $1`, mux.Vars(r)["reference"]), &a)
+	if err != nil {
+		if err == sql.ErrNoRows {
+			http.Error(w, "Withdrawal not found", http.StatusNotFound)
+		} else {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+		}
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(a)
+}
+
+// startATMReservationExpiry marks withdrawals the switch never confirmed as
+// expired every minute and lets their cash go
+func startATMReservationExpiry() {
+	go func() {
+		defer servicekit.ReportJobPanic("ATM reservation expiry")
+		for {
+			if err := expireATMReservations(serviceContext); err != nil {
+				servicekit.ReportJobError("ATM reservation expiry", err)
+			}
+			time.Sleep(time.Minute)
+		}
+	}()
+}
+
+func expireATMReservations(ctx context.Context) error {
+	tx, err := db.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	rows, err := tx.QueryContext(ctx, `UPDATE atm_withdrawals SET status = 'expired', updated_at = NOW()
+									   WHERE status = 'reserved' AND expires_at <= NOW() RETURNING lien_id`)
+	if err != nil {
+		return err
+	}
+	var lienIDs []int
+	for rows.Next() {
+		var id int
+		if err := rows.Scan(&id); err != nil {
+			rows.Close()
+			return err
+		}
+		lienIDs = append(lienIDs, id)
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return err
+	}
+
+	for _, id := range lienIDs {
+		_, err := changeLien(ctx, tx, id, "expired", "system", "ATM reservation expired", "status = 'expired'")
+		if err != nil && err != sql.ErrNoRows {
+			return err
+		}
+	}
+	return tx.Commit()
+}
@@ -0,0 +1,37 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+// TestATMAuthorizationAmounts checks withdrawal amounts are taken in exact
+// cents: precision the switch did not send is refused instead of rounded
+func TestATMAuthorizationAmounts(t *testing.T) {
+	t.Setenv("GATEWAY_IDENTITY_KEY", testGatewayKey)
+	useOwnershipDB()
+	router := apiRouter()
+
+	cases := []struct {
+		amount string
+		status int
+	}{
+		// Past validation, authorization stops at the missing PIN verifier
+		{`60.10`, http.StatusServiceUnavailable},
+		{`"60.10"`, http.StatusServiceUnavailable},
+		{`0.30`, http.StatusServiceUnavailable},
+		{`60.105`, http.StatusBadRequest},
+		{`6e1`, http.StatusBadRequest},
+		{`0`, http.StatusBadRequest},
+		{`-20`, http.StatusBadRequest},
+	}
+	for _, c := range cases {
+		body := `{"card_number": "4111111111111111", "pin_block": "0412AC89ABCDEF67", "terminal_id": "T1", "amount": ` + c.amount + `}`
+		w := httptest.NewRecorder()
+		router.ServeHTTP(w, signedRequest(t, "POST", "/v1/atm/authorizations", body, 1, "atm_switch"))
+		if w.Code != c.status {
+			t.Errorf("amount %s: status %d, want %d: %s", c.amount, w.Code, c.status, w.Body)
+		}
+	}
+}
@@ -0,0 +1,327 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"bank/authrpc"
+	"bank/servicekit"
+
+	"github.com/golang-jwt/jwt/v5"
+	"github.com/gorilla/mux"
+)
+
+// Identity is the authenticated caller of a request
+type Identity struct {
+	UserID     int              `json:"user_id"`
+	Username   string           `json:"username"`
+	Role       string           `json:"role"`
+	Privileges map[string]int64 `json:"privileges,omitempty"` // elevated privileges and their Unix expiry
+}
+
+// activePrivileges returns the privileges that have not expired at now
+func (i Identity) activePrivileges(now time.Time) []string {
+	var active []string
+	for name, expires := range i.Privileges {
+		if expires > now.Unix() {
+			active = append(active, name)
+		}
+	}
+	sort.Strings(active)
+	return active
+}
+
+// accountReaderRoles may list and read every account; customers only see
+// their own
+var accountReaderRoles = []string{"admin", "teller"}
+
+// tellerRoles open accounts for any customer, take cash deposits and maintain
+// accounts; customers may only open accounts for themselves
+var tellerRoles = []string{"teller", "admin"}
+
+// fundsMovementRoles withdraw from and transfer out of accounts; customers
+// only out of their own. Other staff roles and agents, who move money through
+// their own routes, may not.
+var fundsMovementRoles = []string{"customer", "teller", "admin"}
+
+// Just-in-time privileges, granted by auth-service for a few hours on a
+// manager's approval. Holding the role a route requires is not enough
+// without them.
+const (
+	privilegeApproveWires   = "approve-wires"   // release supervised outbound transfers
+	privilegeOverrideLimits = "override-limits" // lift credit limits past what scoring allows
+)
+
+var ErrInvalidToken = errors.New("Invalid or expired token")
+
+// publicRoutes are reachable without a token: probes, metrics and SLO
+// reports (METRICS_TOKEN protects those), the API documentation, provider
+// callbacks and partner-facing lookups. Downloads are authorized by their signed link
+// instead.
+var publicRoutes = map[string]bool{
+	"/health":                true,
+	"/startup":               true,
+	"/metrics":               true,
+	"/slo":                   true,
+	"/openapi.json":          true,
+	"/docs/":                 true,
+	"/esignature/webhook":    true,
+	"/pay-in/{reference}":    true,
+	"/webhooks/signing-keys": true,
+}
+
+func publicRoute(template string) bool {
+	for _, prefix := range []string{"/v1", "/v2"} {
+		template = strings.TrimPrefix(template, prefix)
+	}
+	return publicRoutes[template] || strings.HasSuffix(template, "/download")
+}
+
+// validateToken checks a bearer token was issued for this service's
+// audience. AUTH_VALIDATION_MODE "remote" (the default) asks auth-service,
+// which also enforces session idle timeouts, revocation and pending terms;
+// "grpc" asks the same over its gRPC interface at AUTH_GRPC_ADDR; "local"
+// verifies the HS256 signature and registered claims with the shared
+// JWT_SECRET only, so it carries no privileges.
+func validateToken(ctx context.Context, token string) (Identity, error) {
+	switch getEnv("AUTH_VALIDATION_MODE", "remote") {
+	case "local":
+		return validateTokenLocally(token)
+	case "grpc":
+		return validateTokenOverGRPC(ctx, token)
+	}
+
+	payload, _ := json.Marshal(map[string]string{"token": token, "audience": servicekit.JWTAudience()})
+	url := getEnv("AUTH_SERVICE_URL", "http://localhost:8082") + "/v1/auth/validate"
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, url, bytes.NewReader(payload))
+	if err != nil {
+		return Identity{}, err
+	}
+	req.Header.Set("Content-Type", "application/json")
+
+	resp, err := serviceClient.Do(req)
+	if err != nil {
+		return Identity{}, err
+	}
+	defer resp.Body.Close()
+	switch {
+	case resp.StatusCode == http.StatusUnauthorized || resp.StatusCode == http.StatusForbidden:
+		return Identity{}, ErrInvalidToken
+	case resp.StatusCode != http.StatusOK:
+		return Identity{}, fmt.Errorf("auth service returned status %d", resp.StatusCode)
+	}
+
+	var identity Identity
+	err = json.NewDecoder(resp.Body).Decode(&identity)
+	return identity, err
+}
+
+var (
+	authClientOnce sync.Once
+	authClient     *authrpc.Client
+	authClientErr  error
+)
+
+// authRPCClient connects to the auth service gRPC server on first use,
+// presenting the SVID and service token as serviceClient does
+func authRPCClient() (*authrpc.Client, error) {
+	authClientOnce.Do(func() {
+		opts := []authrpc.Option{
+			authrpc.WithTimeout(serviceClient.Timeout),
+			authrpc.WithMetadata(func(ctx context.Context, method string) (map[string]string, error) {
+				md := map[string]string{}
+				if id := servicekit.RequestID(ctx); id != "" {
+					md["x-request-id"] = id
+				}
+				if servicekit.ServiceTokensIssued() {
+					token, err := servicekit.IssueServiceToken("auth-service", http.MethodPost, method)
+					if err != nil {
+						return nil, err
+					}
+					md[strings.ToLower(servicekit.ServiceTokenHeader)] = token
+				}
+				return md, nil
+			}),
+		}
+		if servicekit.WorkloadIdentity != nil {
+			opts = append(opts, authrpc.WithTLS(servicekit.WorkloadIdentity.ClientTLSConfig()))
+		}
+		authClient, authClientErr = authrpc.Dial(getEnv("AUTH_GRPC_ADDR", "localhost:9082"), opts...)
+	})
+	return authClient, authClientErr
+}
+
+func validateTokenOverGRPC(ctx context.Context, token string) (Identity, error) {
+	client, err := authRPCClient()
+	if err != nil {
+		return Identity{}, err
+	}
+	resp, err := client.ValidateToken(ctx, token, servicekit.JWTAudience())
+	if errors.Is(err, authrpc.ErrInvalidToken) || errors.Is(err, authrpc.ErrTermsRequired) {
+		return Identity{}, ErrInvalidToken
+	}
+	if err != nil {
+		return Identity{}, err
+	}
+	return Identity{UserID: int(resp.UserId), Username: resp.Username, Role: resp.Role, Privileges: resp.Privileges}, nil
+}
+
+func validateTokenLocally(tokenString string) (Identity, error) {
+	secret := getEnv("JWT_SECRET", "")
+	if secret == "" {
+		return Identity{}, fmt.Errorf("JWT_SECRET is required for local token validation")
+	}
+	claims, err := servicekit.ParseAccessToken(tokenString, jwt.SigningMethodHS256.Alg(), servicekit.JWTAudience(),
+		func(*jwt.Token) (interface{}, error) { return []byte(secret), nil })
+	if err != nil {
+		return Identity{}, ErrInvalidToken
+	}
+	return Identity{UserID: claims.UserID, Username: claims.Username, Role: claims.Role}, nil
+}
+
+// The API gateway validates tokens at the edge and passes the caller on in
+// X-Gateway-Identity, signed with GATEWAY_IDENTITY_KEY for one method and
+// path, so requests through it are not validated twice
+const gatewayIdentityHeader = "X-Gateway-Identity"
+
+var errNoGatewayIdentity = errors.New("no gateway identity")
+
+// GatewayIdentityClaims are the claims of an identity signed by the gateway
+type GatewayIdentityClaims struct {
+	Issuer   string `json:"iss"`
+	Audience string `json:"aud"`
+	UserID   int    `json:"sub"`
+	Username string `json:"name"`
+	Role     string `json:"role"`
+	Method   string `json:"htm"`
+	Path     string `json:"htu"`
+	Expires  int64  `json:"exp"`
+	// Privileges are the caller's elevated privileges and their Unix expiry
+	Privileges map[string]int64 `json:"priv,omitempty"`
+}
+
+// gatewayIdentity returns the identity the gateway signed for the request,
+// errNoGatewayIdentity when there is none or GATEWAY_IDENTITY_KEY is unset,
+// or ErrInvalidToken
+func gatewayIdentity(r *http.Request) (Identity, error) {
+	key := getEnv("GATEWAY_IDENTITY_KEY", "")
+	value := r.Header.Get(gatewayIdentityHeader)
+	if key == "" || value == "" {
+		return Identity{}, errNoGatewayIdentity
+	}
+	payload, signature, _ := strings.Cut(value, ".")
+	mac := hmac.New(sha256.New, []byte(key))
+	mac.Write([]byte(payload))
+	if !hmac.Equal([]byte(signature), []byte(base64.RawURLEncoding.EncodeToString(mac.Sum(nil)))) {
+		return Identity{}, ErrInvalidToken
+	}
+	raw, err := base64.RawURLEncoding.DecodeString(payload)
+	if err != nil {
+		return Identity{}, ErrInvalidToken
+	}
+	var claims GatewayIdentityClaims
+	if err := json.Unmarshal(raw, &claims); err != nil {
+		return Identity{}, ErrInvalidToken
+	}
+	if claims.Audience != serviceName || claims.Method != r.Method || claims.Path != r.URL.Path ||
+		time.Now().Add(-servicekit.ServiceTokenSkew).Unix() > claims.Expires {
+		return Identity{}, ErrInvalidToken
+	}
+	return Identity{UserID: claims.UserID, Username: claims.Username, Role: claims.Role,
+		Privileges: claims.Privileges}, nil
+}
+
+// bearerToken returns the token from the Authorization header or, for
+// browser sessions, the session cookie
+func bearerToken(r *http.Request, sessionCookie string) string {
+	if token := strings.TrimPrefix(r.Header.Get("Authorization"), "Bearer "); token != r.Header.Get("Authorization") {
+		return strings.TrimSpace(token)
+	}
+	if cookie, err := r.Cookie(sessionCookie); err == nil {
+		return cookie.Value
+	}
+	return ""
+}
+
+// authMiddleware authenticates every non-public request and replaces the
+// X-User-ID and X-User-Role headers with the token's identity, so handlers
+// can rely on requestActor and requestRole. Customers may only reach
+// resources they own (requireResourceOwner).
+func authMiddleware(sessionCookie string) func(http.Handler) http.Handler {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			// Identity headers are only ever set from a verified token
+			r.Header.Del("X-User-ID")
+			r.Header.Del("X-User-Role")
+			r.Header.Del("X-Username")
+			r.Header.Del("X-User-Privileges")
+
+			template := ""
+			if route := mux.CurrentRoute(r); route != nil {
+				template, _ = route.GetPathTemplate()
+			}
+			if publicRoute(template) {
+				next.ServeHTTP(w, r)
+				return
+			}
+
+			identity, err := gatewayIdentity(r)
+			if err == errNoGatewayIdentity {
+				token := bearerToken(r, sessionCookie)
+				if token == "" {
+					http.Error(w, "Authentication required", http.StatusUnauthorized)
+					return
+				}
+				identity, err = validateToken(r.Context(), token)
+			}
+			if errors.Is(err, ErrInvalidToken) {
+				http.Error(w, ErrInvalidToken.Error(), http.StatusUnauthorized)
+				return
+			}
+			if err != nil {
+				http.Error(w, "Token validation unavailable", http.StatusBadGateway)
+				return
+			}
+			r.Header.Set("X-User-ID", strconv.Itoa(identity.UserID))
+			r.Header.Set("X-User-Role", identity.Role)
+			r.Header.Set("X-Username", identity.Username)
+			if active := identity.activePrivileges(time.Now()); len(active) > 0 {
+				r.Header.Set("X-User-Privileges", strings.Join(active, ","))
+			}
+
+			if ownerScoped(identity.Role) && !requireResourceOwner(w, r, template, identity.UserID) {
+				return
+			}
+			next.ServeHTTP(w, r)
+		})
+	}
+}
+
+// requireAccountReader writes a 403 and returns false unless the caller is a
+// customer or agent, whose access authMiddleware limits to their own
+// accounts, or has one of accountReaderRoles
+func requireAccountReader(w http.ResponseWriter, r *http.Request) bool {
+	return ownerScoped(requestRole(r)) || requireRole(w, r, accountReaderRoles...)
+}
+
+// accountListFilter returns the customer or agent an account listing is
+// limited to, or 0 for all accounts
+func accountListFilter(r *http.Request) int {
+	if !ownerScoped(requestRole(r)) {
+		return 0
+	}
+	customerID, _ := strconv.Atoi(r.Header.Get("X-User-ID"))
+	return customerID
+}
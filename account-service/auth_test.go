@@ -0,0 +1,105 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"bank/servicekit"
+
+	"github.com/golang-jwt/jwt/v5"
+)
+
+// TestValidateTokenLocallyAudience checks access tokens minted for another
+// service are refused
+func TestValidateTokenLocallyAudience(t *testing.T) {
+	t.Setenv("JWT_SECRET", "test-jwt-secret")
+	sign := func(audience string, expires time.Time) string {
+		now := time.Now()
+		token, err := jwt.NewWithClaims(jwt.SigningMethodHS256, servicekit.AccessClaims{
+			UserID: 7,
+			Role:   "customer",
+			RegisteredClaims: jwt.RegisteredClaims{
+				Issuer:    servicekit.JWTIssuer(),
+				Audience:  jwt.ClaimStrings{audience},
+				IssuedAt:  jwt.NewNumericDate(now.Add(-time.Hour)),
+				ExpiresAt: jwt.NewNumericDate(expires),
+			},
+		}).SignedString([]byte("test-jwt-secret"))
+		if err != nil {
+			t.Fatal(err)
+		}
+		return token
+	}
+
+	if _, err := validateTokenLocally(sign(serviceName, time.Now().Add(time.Minute))); err != nil {
+		t.Errorf("token for %s rejected: %v", serviceName, err)
+	}
+	if _, err := validateTokenLocally(sign("auth-service", time.Now().Add(time.Minute))); err != ErrInvalidToken {
+		t.Errorf("token for auth-service: error %v, want ErrInvalidToken", err)
+	}
+	if _, err := validateTokenLocally(sign(serviceName, time.Now().Add(-time.Hour))); err != ErrInvalidToken {
+		t.Errorf("expired token: error %v, want ErrInvalidToken", err)
+	}
+}
+
+// TestPrivilegedRoutes checks estate transfer approval and credit limit
+// overrides are refused to a caller holding the role but not the
+// just-in-time privilege
+func TestPrivilegedRoutes(t *testing.T) {
+	t.Setenv("GATEWAY_IDENTITY_KEY", testGatewayKey)
+	useOwnershipDB()
+	router := apiRouter()
+
+	active := func(privilege string) map[string]int64 {
+		return map[string]int64{privilege: time.Now().Add(time.Hour).Unix()}
+	}
+	expired := func(privilege string) map[string]int64 {
+		return map[string]int64{privilege: time.Now().Add(-time.Minute).Unix()}
+	}
+	cases := []struct {
+		name       string
+		path       string
+		role       string
+		privileges map[string]int64
+		denied     bool
+	}{
+		{"approve an estate transfer without approve-wires", "/v1/estate-transfers/1/approve", "estate_supervisor", nil, true},
+		{"approve an estate transfer as an admin without approve-wires", "/v1/estate-transfers/1/approve", "admin", nil, true},
+		{"approve an estate transfer with another privilege", "/v1/estate-transfers/1/approve", "estate_supervisor",
+			active(privilegeOverrideLimits), true},
+		{"approve an estate transfer with an expired approve-wires", "/v1/estate-transfers/1/approve", "estate_supervisor",
+			expired(privilegeApproveWires), true},
+		{"approve an estate transfer with approve-wires", "/v1/estate-transfers/1/approve", "estate_supervisor",
+			active(privilegeApproveWires), false},
+		{"reject an estate transfer without approve-wires", "/v1/estate-transfers/1/reject", "estate_supervisor", nil, false},
+		{"boost a credit limit without override-limits", "/v1/customers/8/credit-limits/card/boost", "credit_officer", nil, true},
+		{"boost a credit limit with an expired override-limits", "/v1/customers/8/credit-limits/card/boost", "credit_officer",
+			expired(privilegeOverrideLimits), true},
+		{"boost a credit limit with override-limits", "/v1/customers/8/credit-limits/card/boost", "credit_officer",
+			active(privilegeOverrideLimits), false},
+		{"approve a limit increase without override-limits", "/v1/credit-limit-requests/1/approve", "credit_officer", nil, true},
+		{"approve a limit increase with override-limits", "/v1/credit-limit-requests/1/approve", "credit_officer",
+			active(privilegeOverrideLimits), false},
+		{"reject a limit increase without override-limits", "/v1/credit-limit-requests/1/reject", "credit_officer", nil, false},
+	}
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			w := httptest.NewRecorder()
+			router.ServeHTTP(w, privilegedRequest(t, "POST", c.path, "", ownerID, c.role, c.privileges))
+			if denied := w.Code == http.StatusForbidden; denied != c.denied {
+				t.Errorf("status %d, denied %v, want %v: %s", w.Code, denied, c.denied, w.Body)
+			}
+		})
+	}
+
+	// A privilege header sent by the client is discarded
+	r := signedRequest(t, "POST", "/v1/estate-transfers/1/approve", "", ownerID, "estate_supervisor")
+	r.Header.Set("X-User-Privileges", privilegeApproveWires)
+	w := httptest.NewRecorder()
+	router.ServeHTTP(w, r)
+	if w.Code != http.StatusForbidden {
+		t.Errorf("forged privilege header: status %d, want 403", w.Code)
+	}
+}
@@ -0,0 +1,213 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"net/http"
+	"strconv"
+	"strings"
+
+	"bank/servicekit"
+
+	"github.com/gorilla/mux"
+)
+
+// AuthorizationRequest is a card authorization or bill-pay initiation to approve or decline
+type AuthorizationRequest struct {
+	AccountID        int    `json:"account_id"`
+	Amount           Money  `json:"amount"`
+	Currency         string `json:"currency"`
+	Channel          string `json:"channel"` // card or bill_pay
+	MerchantID       string `json:"merchant_id"`
+	MerchantName     string `json:"merchant_name"`
+	MerchantCategory string `json:"merchant_category"`
+	Country          string `json:"country"` // ISO 3166-1 alpha-2 of the merchant or terminal
+
+	// Flags raised by checks that do not decline
+	Flags []string `json:"-"`
+}
+
+// AuthorizationDecision is the outcome of the authorization pipeline
+type AuthorizationDecision struct {
+	Approved bool     `json:"approved"`
+	Code     string   `json:"code,omitempty"`
+	Reason   string   `json:"reason,omitempty"`
+	Flags    []string `json:"flags,omitempty"`
+}
+
+const authorizationTablesSQL = `
+	CREATE TABLE IF NOT EXISTS authorization_log (
+		id SERIAL PRIMARY KEY,
+		account_id INTEGER NOT NULL REFERENCES accounts(id),
+		channel VARCHAR(20) NOT NULL,
+		amount DECIMAL(15,2) NOT NULL,
+		currency_code VARCHAR(3) NOT NULL DEFAULT '',
+		merchant_id VARCHAR(100) NOT NULL DEFAULT '',
+		merchant_name VARCHAR(100) NOT NULL DEFAULT '',
+		merchant_category VARCHAR(50) NOT NULL DEFAULT '',
+		approved BOOLEAN NOT NULL,
+		decline_code VARCHAR(50) NOT NULL DEFAULT '',
+		created_at TIMESTAMP NOT NULL DEFAULT NOW()
+	);
+	CREATE INDEX IF NOT EXISTS idx_authorization_log_account ON authorization_log(account_id, created_at);`
+
+// authorizationCheck inspects a request and returns a decline, or nil to let
+// the next check run
+type authorizationCheck func(ctx context.Context, req *AuthorizationRequest) (*AuthorizationDecision, error)
+
+// authorizationChecks run in order; the first decline wins
+var authorizationChecks = []authorizationCheck{
+	checkAccountActive,
+	checkPrepaidRestrictions,
+	checkSpendingBlocks,
+	checkHighRiskCountry,
+	checkGeofence,
+	checkFraudRules,
+	checkAvailableFunds,
+}
+
+func decline(code, reason string) *AuthorizationDecision {
+	return &AuthorizationDecision{Approved: false, Code: code, Reason: reason}
+}
+
+// runAuthorization evaluates the rule checks against the request and then
+// combines the outcome with the risk model score
+func runAuthorization(ctx context.Context, req *AuthorizationRequest) (AuthorizationDecision, error) {
+	decision := AuthorizationDecision{Approved: true}
+	for _, check := range authorizationChecks {
+		d, err := check(ctx, req)
+		if err != nil {
+			return AuthorizationDecision{}, err
+		}
+		if d != nil {
+			decision = *d
+			break
+		}
+	}
+	decision = applyRiskScore(ctx, req, decision)
+	decision.Flags = req.Flags
+	return decision, nil
+}
+
+// recordAuthorization stores the decision; the log feeds recurring-charge
+// detection and alerting
+func recordAuthorization(ctx context.Context, req *AuthorizationRequest, d AuthorizationDecision) error {
+	_, err := db.ExecContext(ctx, `INSERT INTO authorization_log (account_id, channel, amount, currency_code,
+								   merchant_id, merchant_name, merchant_category, approved, decline_code)
+								   VALUES ($1, $2, $3, $4, $5, $6, $7, $8, $9)`,
+		req.AccountID, req.Channel, req.Amount, req.Currency, req.MerchantID, req.MerchantName,
+		req.MerchantCategory, d.Approved, d.Code)
+	return err
+}
+
+func authorizeTransaction(w http.ResponseWriter, r *http.Request) {
+	params := mux.Vars(r)
+	accountID, err := strconv.Atoi(params["id"])
+	if err != nil {
+		http.Error(w, "Invalid account ID", http.StatusBadRequest)
+		return
+	}
+
+	var req AuthorizationRequest
+	err = json.NewDecoder(r.Body).Decode(&req)
+	if err != nil {
+		http.Error(w, "Invalid request body", http.StatusBadRequest)
+		return
+	}
+	req.AccountID = accountID
+	req.MerchantCategory = strings.ToLower(strings.TrimSpace(req.MerchantCategory))
+	req.Country = strings.ToUpper(strings.TrimSpace(req.Country))
+
+	if req.Amount <= 0 {
+		http.Error(w, "Amount must be positive", http.StatusBadRequest)
+		return
+	}
+	if req.Channel != "card" && req.Channel != "bill_pay" {
+		http.Error(w, "Channel must be card or bill_pay", http.StatusBadRequest)
+		return
+	}
+
+	decision, err := runAuthorization(r.Context(), &req)
+	if err != nil {
+		if err == sql.ErrNoRows {
+			http.Error(w, "Account not found", http.StatusNotFound)
+		} else {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+		}
+		return
+	}
+
+	err = recordAuthorization(r.Context(), &req, decision)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	if decision.Approved {
+		notifyRecurringCharge(r.Context(), &req)
+		publishAccountEvent(AccountEvent{AccountID: req.AccountID, Type: "card_authorization", Amount: req.Amount,
+			Country: req.Country, Merchant: req.MerchantName})
+	} else {
+		servicekit.RecordOpsEvent(servicekit.MetricDeclinedTransactions)
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(decision)
+}
+
+func checkAccountActive(ctx context.Context, req *AuthorizationRequest) (*AuthorizationDecision, error) {
+	var status string
+	err := db.QueryRowContext(ctx, "SELECT status FROM accounts WHERE id = $1", req.AccountID).Scan(&status)
+	if err != nil {
+		return nil, err
+	}
+	if status != "active" {
+		return decline("account_inactive", "Account is not active"), nil
+	}
+	return nil, nil
+}
+
+func checkAvailableFunds(ctx context.Context, req *AuthorizationRequest) (*AuthorizationDecision, error) {
+	var balance Money
+	err := db.QueryRowContext(ctx, "SELECT balance FROM accounts WHERE id = $1", req.AccountID).Scan(&balance)
+	if err != nil {
+		return nil, err
+	}
+	liens, err := activeLienTotal(ctx, db, req.AccountID)
+	if err != nil {
+		return nil, err
+	}
+	if balance-liens < req.Amount {
+		return decline("insufficient_funds", "Insufficient funds"), nil
+	}
+	return nil, nil
+}
+
+// checkHighRiskCountry declines card spend in the FRAUD_HIGH_RISK_COUNTRIES list
+// unless the customer registered a travel notice covering the country
+func checkHighRiskCountry(ctx context.Context, req *AuthorizationRequest) (*AuthorizationDecision, error) {
+	if req.Country == "" || req.Channel != "card" {
+		return nil, nil
+	}
+
+	highRisk := false
+	for _, c := range strings.Split(getEnv("FRAUD_HIGH_RISK_COUNTRIES", ""), ",") {
+		if strings.EqualFold(strings.TrimSpace(c), req.Country) {
+			highRisk = true
+			break
+		}
+	}
+	if !highRisk {
+		return nil, nil
+	}
+
+	covered, err := travelNoticeCovers(ctx, req.AccountID, req.Country)
+	if err != nil {
+		return nil, err
+	}
+	if !covered {
+		return decline("geo_high_risk", "Card use in this country requires a travel notice"), nil
+	}
+	return nil, nil
+}
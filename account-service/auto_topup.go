@@ -0,0 +1,302 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"net/http"
+	"time"
+
+	"bank/servicekit"
+
+	"github.com/gorilla/mux"
+	"go.uber.org/zap"
+)
+
+// AutoTopUp refills an account from a linked funding account whenever its
+// balance falls below the threshold, up to a daily cap
+type AutoTopUp struct {
+	AccountID        int    `json:"account_id"`
+	FundingAccountID int    `json:"funding_account_id"`
+	Threshold        Money  `json:"threshold"`
+	Amount           Money  `json:"amount"`
+	DailyCap         Money  `json:"daily_cap"`
+	Enabled          bool   `json:"enabled"`
+	CreatedAt        string `json:"created_at"`
+	UpdatedAt        string `json:"updated_at"`
+}
+
+// AutoTopUpExecution is one entry of the top-up execution log
+type AutoTopUpExecution struct {
+	ID               int    `json:"id"`
+	FundingAccountID int    `json:"funding_account_id"`
+	Amount           Money  `json:"amount"`
+	Status           string `json:"status"` // completed, failed or capped
+	Reason           string `json:"reason,omitempty"`
+	CreatedAt        string `json:"created_at"`
+}
+
+const autoTopUpTablesSQL = `
+	CREATE TABLE IF NOT EXISTS auto_topups (
+		account_id INTEGER PRIMARY KEY REFERENCES accounts(id),
+		funding_account_id INTEGER NOT NULL REFERENCES accounts(id),
+		threshold DECIMAL(15,2) NOT NULL,
+		amount DECIMAL(15,2) NOT NULL,
+		daily_cap DECIMAL(15,2) NOT NULL,
+		enabled BOOLEAN NOT NULL DEFAULT TRUE,
+		created_at TIMESTAMP NOT NULL DEFAULT NOW(),
+		updated_at TIMESTAMP NOT NULL DEFAULT NOW()
+	);
+	CREATE TABLE IF NOT EXISTS auto_topup_executions (
+		id SERIAL PRIMARY KEY,
+		account_id INTEGER NOT NULL REFERENCES accounts(id),
+		funding_account_id INTEGER NOT NULL REFERENCES accounts(id),
+		amount DECIMAL(15,2) NOT NULL,
+		status VARCHAR(20) NOT NULL,
+		reason VARCHAR(255) NOT NULL DEFAULT '',
+		created_at TIMESTAMP NOT NULL DEFAULT NOW()
+	);
+	CREATE INDEX IF NOT EXISTS idx_auto_topup_executions_account ON auto_topup_executions(account_id, created_at);`
+
+const autoTopUpColumns = `account_id, funding_account_id, threshold, amount, daily_cap, enabled, created_at, updated_at`
+
+func scanAutoTopUp(row interface{ Scan(...interface{}) error }, t *AutoTopUp) error {
+	return row.Scan(&t.AccountID, &t.FundingAccountID, &t.Threshold, &t.Amount, &t.DailyCap, &t.Enabled,
+		&t.CreatedAt, &t.UpdatedAt)
+}
+
+// setAutoTopUp creates or replaces the account's auto top-up
+func setAutoTopUp(w http.ResponseWriter, r *http.Request) {
+	var t AutoTopUp
+	err := json.NewDecoder(r.Body).Decode(&t)
+	if err != nil {
+		http.Error(w, "Invalid request body", http.StatusBadRequest)
+		return
+	}
+
+	if t.Threshold < 0 || t.Amount <= 0 {
+		http.Error(w, "threshold must not be negative and amount must be positive", http.StatusBadRequest)
+		return
+	}
+	if t.DailyCap == 0 {
+		t.DailyCap = t.Amount
+	}
+	if t.DailyCap < t.Amount {
+		http.Error(w, "daily_cap must be at least the top-up amount", http.StatusBadRequest)
+		return
+	}
+
+	// The funding account must belong to the same customer and use the same currency
+	err = scanAutoTopUp(db.QueryRowContext(r.Context(), `INSERT INTO auto_topups (account_id, funding_account_id, threshold, amount, daily_cap, enabled)
+								  SELECT a.id, f.id, $3, $4, $5, $6 FROM accounts a JOIN accounts f
+								  ON f.id = $2 AND f.id <> a.id AND f.customer_id = a.customer_id AND f.currency_code = a.currency_code
+								  WHERE a.id = $1
+								  ON CONFLICT (account_id) DO UPDATE SET funding_account_id = EXCLUDED.funding_account_id,
+									  threshold = EXCLUDED.threshold, amount = EXCLUDED.amount, daily_cap = EXCLUDED.daily_cap,
+									  enabled = EXCLUDED.enabled, updated_at = NOW()
+								  RETURNING `+autoTopUpColumns, mux.Vars(r)["id"], t.FundingAccountID, t.Threshold, t.Amount,
+		t.DailyCap, t.Enabled), &t)
+	if err != nil {
+		if err == sql.ErrNoRows {
+			http.Error(w, "funding_account_id must be another account of the same customer in the same currency", http.StatusBadRequest)
+		} else {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+		}
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(t)
+}
+
+func getAutoTopUp(w http.ResponseWriter, r *http.Request) {
+	var t AutoTopUp
+	err := scanAutoTopUp(db.QueryRowContext(r.Context(), `SELECT `+autoTopUpColumns+` FROM auto_topups WHERE account_id = $1`,
+		mux.Vars(r)["id"]), &t)
+	if err != nil {
+		if err == sql.ErrNoRows {
+			http.Error(w, "Auto top-up not configured", http.StatusNotFound)
+		} else {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+		}
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(t)
+}
+
+func deleteAutoTopUp(w http.ResponseWriter, r *http.Request) {
+	result, err := db.ExecContext(r.Context(), `DELETE FROM auto_topups WHERE account_id = $1`, mux.Vars(r)["id"])
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	if n, _ := result.RowsAffected(); n == 0 {
+		http.Error(w, "Auto top-up not configured", http.StatusNotFound)
+		return
+	}
+
+	w.WriteHeader(http.StatusNoContent)
+}
+
+func listAutoTopUpExecutions(w http.ResponseWriter, r *http.Request) {
+	rows, err := db.QueryContext(r.Context(), `SELECT id, funding_account_id, amount, status, reason, created_at
+											   FROM auto_topup_executions WHERE account_id = $1
+											   ORDER BY created_at DESC LIMIT 100`, mux.Vars(r)["id"])
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	defer rows.Close()
+
+	executions := []AutoTopUpExecution{}
+	for rows.Next() {
+		var e AutoTopUpExecution
+		if err := rows.Scan(&e.ID, &e.FundingAccountID, &e.Amount, &e.Status, &e.Reason, &e.CreatedAt); err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		executions = append(executions, e)
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(executions)
+}
+
+// startAutoTopUpMonitor catches balances that dropped through paths that do
+// not publish account events, such as internal transfers
+func startAutoTopUpMonitor() {
+	go func() {
+		defer servicekit.ReportJobPanic("Auto top-up monitor")
+		for {
+			if err := runAutoTopUps(serviceContext); err != nil {
+				servicekit.ReportJobError("Auto top-up monitor", err)
+			}
+			time.Sleep(time.Hour)
+		}
+	}()
+}
+
+func runAutoTopUps(ctx context.Context) error {
+	rows, err := db.QueryContext(ctx, `SELECT t.account_id FROM auto_topups t JOIN accounts a ON a.id = t.account_id
+									   WHERE t.enabled AND a.balance < t.threshold`)
+	if err != nil {
+		return err
+	}
+	var ids []int
+	for rows.Next() {
+		var id int
+		if err := rows.Scan(&id); err != nil {
+			rows.Close()
+			return err
+		}
+		ids = append(ids, id)
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return err
+	}
+
+	for _, id := range ids {
+		if err := applyAutoTopUp(ctx, id); err != nil {
+			servicekit.RequestLogger(ctx).Error("auto top-up failed", zap.Int("account_id", id), zap.Error(err))
+		}
+	}
+	return nil
+}
+
+// applyAutoTopUp tops the account up if it is below its threshold and the
+// daily cap allows it. The configuration row is locked so concurrent events
+// cannot top up twice.
+func applyAutoTopUp(ctx context.Context, accountID int) error {
+	tx, err := db.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	var t AutoTopUp
+	var balance, toppedUpToday Money
+	var cappedToday bool
+	err = tx.QueryRowContext(ctx, `SELECT t.funding_account_id, t.threshold, t.amount, t.daily_cap, a.balance,
+								   (SELECT COALESCE(SUM(amount), 0) FROM auto_topup_executions
+									WHERE account_id = t.account_id AND status = 'completed' AND created_at >= CURRENT_DATE),
+								   EXISTS (SELECT 1 FROM auto_topup_executions
+									WHERE account_id = t.account_id AND status = 'capped' AND created_at >= CURRENT_DATE)
+								   FROM auto_topups t JOIN accounts a ON a.id = t.account_id
+								   WHERE t.account_id = $1 AND t.enabled FOR UPDATE OF t`, accountID).Scan(
+		&t.FundingAccountID, &t.Threshold, &t.Amount, &t.DailyCap, &balance, &toppedUpToday, &cappedToday)
+	if err == sql.ErrNoRows {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	if balance >= t.Threshold {
+		return nil
+	}
+
+	if toppedUpToday+t.Amount > t.DailyCap {
+		// Record and notify the cap once a day
+		if cappedToday {
+			return nil
+		}
+		if err := logAutoTopUp(ctx, tx, accountID, t, "capped", "Daily cap reached"); err != nil {
+			return err
+		}
+		if err := tx.Commit(); err != nil {
+			return err
+		}
+		notifyAutoTopUp(ctx, accountID, t, "auto_topup_capped", "Daily cap reached")
+		return nil
+	}
+
+	err = internalTransfer(ctx, tx, t.FundingAccountID, accountID, t.Amount, "Auto top-up")
+	if err != nil {
+		tx.Rollback()
+		if logErr := logAutoTopUp(ctx, nil, accountID, t, "failed", err.Error()); logErr != nil {
+			return logErr
+		}
+		notifyAutoTopUp(ctx, accountID, t, "auto_topup_failed", err.Error())
+		return nil
+	}
+	if err := logAutoTopUp(ctx, tx, accountID, t, "completed", ""); err != nil {
+		return err
+	}
+	return tx.Commit()
+}
+
+// logAutoTopUp appends to the execution log, inside tx when given
+func logAutoTopUp(ctx context.Context, tx *sql.Tx, accountID int, t AutoTopUp, status, reason string) error {
+	query := `INSERT INTO auto_topup_executions (account_id, funding_account_id, amount, status, reason)
+			  VALUES ($1, $2, $3, $4, $5)`
+	var err error
+	if tx != nil {
+		_, err = tx.ExecContext(ctx, query, accountID, t.FundingAccountID, t.Amount, status, reason)
+	} else {
+		_, err = db.ExecContext(ctx, query, accountID, t.FundingAccountID, t.Amount, status, reason)
+	}
+	return err
+}
+
+func notifyAutoTopUp(ctx context.Context, accountID int, t AutoTopUp, template, reason string) {
+	var customerID int
+	err := db.QueryRowContext(ctx, "SELECT customer_id FROM accounts WHERE id = $1", accountID).Scan(&customerID)
+	if err == nil {
+		err = sendNotification(ctx, Notification{
+			CustomerID: customerID,
+			Channel:    "push",
+			Template:   template,
+			Data: map[string]interface{}{
+				"account_id":         accountID,
+				"funding_account_id": t.FundingAccountID,
+				"amount":             t.Amount,
+				"reason":             reason,
+			},
+		})
+	}
+	if err != nil {
+		servicekit.RequestLogger(ctx).Error("failed to send notification", zap.String("template", template), zap.Error(err))
+	}
+}
@@ -0,0 +1,250 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strconv"
+	"time"
+
+	"bank/servicekit"
+
+	"github.com/gorilla/mux"
+	"go.uber.org/zap"
+)
+
+// BalancePoint is the end-of-day balance of an account, or the closing
+// balance of a month
+type BalancePoint struct {
+	Date    string `json:"date"`
+	Balance Money  `json:"balance"`
+}
+
+const balanceSnapshotTablesSQL = `
+	CREATE TABLE IF NOT EXISTS balance_snapshots (
+		account_id INTEGER NOT NULL REFERENCES accounts(id),
+		snapshot_date DATE NOT NULL,
+		balance DECIMAL(15,2) NOT NULL,
+		source VARCHAR(10) NOT NULL DEFAULT 'eod',
+		created_at TIMESTAMP NOT NULL DEFAULT NOW(),
+		PRIMARY KEY (account_id, snapshot_date)
+	);`
+
+// maxBackfillDays bounds how far back missing snapshots are rebuilt from the ledger
+const maxBackfillDays = 400
+
+// startBalanceSnapshots records yesterday's closing balance for every open
+// account once the day is over, filling any days missed since the last run
+func startBalanceSnapshots() {
+	go func() {
+		defer servicekit.ReportJobPanic("Balance snapshot job")
+		for {
+			if err := runBalanceSnapshots(serviceContext); err != nil {
+				servicekit.ReportJobError("Balance snapshot job", err)
+			}
+			time.Sleep(time.Hour)
+		}
+	}()
+}
+
+func runBalanceSnapshots(ctx context.Context) error {
+	rows, err := db.QueryContext(ctx, `SELECT a.id FROM accounts a WHERE a.status <> 'closed'
+									   AND a.created_at < CURRENT_DATE AND NOT EXISTS (
+										   SELECT 1 FROM balance_snapshots s
+										   WHERE s.account_id = a.id AND s.snapshot_date = CURRENT_DATE - 1)`)
+	if err != nil {
+		return err
+	}
+	var ids []int
+	for rows.Next() {
+		var id int
+		if err := rows.Scan(&id); err != nil {
+			rows.Close()
+			return err
+		}
+		ids = append(ids, id)
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return err
+	}
+
+	for _, id := range ids {
+		if err := backfillSnapshots(ctx, id, "eod"); err != nil {
+			servicekit.RequestLogger(ctx).Error("failed to snapshot balance", zap.Int("account_id", id), zap.Error(err))
+		}
+	}
+	return nil
+}
+
+// backfillSnapshots rebuilds every missing end-of-day balance between the
+// latest snapshot (or account opening) and yesterday by walking the ledger
+// back from the current balance
+func backfillSnapshots(ctx context.Context, accountID int, source string) error {
+	var balance Money
+	var opened time.Time
+	err := db.QueryRowContext(ctx, `SELECT balance, created_at FROM accounts WHERE id = $1`, accountID).Scan(&balance, &opened)
+	if err != nil {
+		return err
+	}
+
+	now := time.Now().UTC()
+	today := time.Date(now.Year(), now.Month(), now.Day(), 0, 0, 0, 0, time.UTC)
+	earliest := today.AddDate(0, 0, -maxBackfillDays)
+	if openedDay := time.Date(opened.Year(), opened.Month(), opened.Day(), 0, 0, 0, 0, time.UTC); openedDay.After(earliest) {
+		earliest = openedDay
+	}
+
+	existing := map[string]bool{}
+	rows, err := db.QueryContext(ctx, `SELECT snapshot_date::text FROM balance_snapshots
+									   WHERE account_id = $1 AND snapshot_date >= $2`, accountID, earliest)
+	if err != nil {
+		return err
+	}
+	for rows.Next() {
+		var d string
+		if err := rows.Scan(&d); err != nil {
+			rows.Close()
+			return err
+		}
+		existing[d] = true
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return err
+	}
+
+	req, _ := http.NewRequestWithContext(ctx, http.MethodGet, "/", nil)
+	transactions, err := fetchAllTransactions(req, accountID)
+	if err != nil {
+		return err
+	}
+
+	// Net movement per day, so the balance at the end of day D is the current
+	// balance less everything posted after D
+	movements := map[string]Money{}
+	for _, t := range transactions {
+		if len(t.CreatedAt) >= 10 {
+			movements[t.CreatedAt[:10]] += signedAmount(t)
+		}
+	}
+
+	running := balance - movements[today.Format("2006-01-02")]
+	for day := today.AddDate(0, 0, -1); !day.Before(earliest); day = day.AddDate(0, 0, -1) {
+		date := day.Format("2006-01-02")
+		if !existing[date] {
+			_, err := db.ExecContext(ctx, `INSERT INTO balance_snapshots (account_id, snapshot_date, balance, source)
+										   VALUES ($1, $2, $3, $4) ON CONFLICT (account_id, snapshot_date) DO NOTHING`,
+				accountID, date, running, source)
+			if err != nil {
+				return err
+			}
+		}
+		running -= movements[date]
+	}
+	return nil
+}
+
+// signedAmount is a transaction's effect on the balance
+func signedAmount(t TransactionSummary) Money {
+	amount := t.Amount.Abs()
+	if creditTransactionTypes[t.Type] {
+		return amount
+	}
+	return -amount
+}
+
+// getBalanceHistory returns end-of-day balances for charting. Gaps in the
+// range are backfilled from the ledger before the series is returned.
+func getBalanceHistory(w http.ResponseWriter, r *http.Request) {
+	accountID, err := strconv.Atoi(mux.Vars(r)["id"])
+	if err != nil {
+		http.Error(w, "Invalid account ID", http.StatusBadRequest)
+		return
+	}
+
+	granularity := r.URL.Query().Get("granularity")
+	if granularity == "" {
+		granularity = "day"
+	}
+	if granularity != "day" && granularity != "month" {
+		http.Error(w, "granularity must be day or month", http.StatusBadRequest)
+		return
+	}
+
+	to := time.Now().UTC().AddDate(0, 0, -1)
+	from := to.AddDate(0, 0, -89)
+	if granularity == "month" {
+		from = to.AddDate(-1, 0, 0)
+	}
+	for param, target := range map[string]*time.Time{"from": &from, "to": &to} {
+		if value := r.URL.Query().Get(param); value != "" {
+			parsed, err := time.Parse("2006-01-02", value)
+			if err != nil {
+				http.Error(w, fmt.Sprintf("%s must be a date (YYYY-MM-DD)", param), http.StatusBadRequest)
+				return
+			}
+			*target = parsed
+		}
+	}
+
+	var currency string
+	var balance Money
+	var missing bool
+	err = db.QueryRowContext(r.Context(), `SELECT a.currency_code, a.balance,
+										   (SELECT COUNT(*) FROM balance_snapshots s WHERE s.account_id = a.id
+											AND s.snapshot_date BETWEEN GREATEST($2::date, a.created_at::date) AND LEAST($3::date, CURRENT_DATE - 1))
+										   < GREATEST(LEAST($3::date, CURRENT_DATE - 1) - GREATEST($2::date, a.created_at::date) + 1, 0)
+										   FROM accounts a WHERE a.id = $1`, accountID, from.Format("2006-01-02"),
+		to.Format("2006-01-02")).Scan(&currency, &balance, &missing)
+	if err != nil {
+		if err == sql.ErrNoRows {
+			http.Error(w, "Account not found", http.StatusNotFound)
+		} else {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+		}
+		return
+	}
+
+	if missing {
+		if err := backfillSnapshots(r.Context(), accountID, "backfill"); err != nil {
+			servicekit.RequestLogger(r.Context()).Error("balance backfill failed", zap.Int("account_id", accountID), zap.Error(err))
+		}
+	}
+
+	// A month's point is its last snapshot, i.e. the closing balance
+	query := `SELECT snapshot_date::text, balance FROM balance_snapshots
+			  WHERE account_id = $1 AND snapshot_date BETWEEN $2 AND $3 ORDER BY snapshot_date`
+	if granularity == "month" {
+		query = `SELECT DISTINCT ON (date_trunc('month', snapshot_date)) to_char(snapshot_date, 'YYYY-MM'), balance
+				 FROM balance_snapshots WHERE account_id = $1 AND snapshot_date BETWEEN $2 AND $3
+				 ORDER BY date_trunc('month', snapshot_date), snapshot_date DESC`
+	}
+	rows, err := db.QueryContext(r.Context(), query, accountID, from.Format("2006-01-02"), to.Format("2006-01-02"))
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	defer rows.Close()
+
+	points := []BalancePoint{}
+	for rows.Next() {
+		var p BalancePoint
+		if err := rows.Scan(&p.Date, &p.Balance); err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		points = append(points, p)
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"account_id":      accountID,
+		"currency_code":   currency,
+		"granularity":     granularity,
+		"current_balance": balance,
+		"points":          points,
+	})
+}
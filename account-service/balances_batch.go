@@ -0,0 +1,92 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+
+	"github.com/lib/pq"
+)
+
+// maxBatchBalances bounds the accounts one batch balance request may name
+const maxBatchBalances = 500
+
+type batchBalancesRequest struct {
+	AccountIDs []int `json:"account_ids"`
+}
+
+type batchBalancesResponse struct {
+	Balances []balanceResponse `json:"balances"`
+	// NotFound lists the requested accounts that do not exist or that the
+	// caller may not read
+	NotFound []int `json:"not_found"`
+}
+
+// getBatchBalances returns the balances of up to maxBatchBalances accounts
+// with one query, in the order requested. A customer only gets their own
+// accounts; the others are reported as not found, like missing ones.
+func getBatchBalances(w http.ResponseWriter, r *http.Request) {
+	if !requireAccountReader(w, r) {
+		return
+	}
+	var req batchBalancesRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, "Invalid request body", http.StatusBadRequest)
+		return
+	}
+	if len(req.AccountIDs) == 0 || len(req.AccountIDs) > maxBatchBalances {
+		http.Error(w, fmt.Sprintf("account_ids must name 1 to %d accounts", maxBatchBalances), http.StatusBadRequest)
+		return
+	}
+
+	rows, err := db.QueryContext(r.Context(), `SELECT a.id, a.customer_id, a.balance, a.currency_code, COALESCE(l.total, 0)
+											   FROM accounts a
+											   LEFT JOIN (SELECT account_id, SUM(amount) AS total FROM liens
+														  WHERE account_id = ANY($1) AND status = 'active'
+														  AND (expires_at IS NULL OR expires_at > NOW())
+														  GROUP BY account_id) l ON l.account_id = a.id
+											   WHERE a.id = ANY($1)`, pq.Array(req.AccountIDs))
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	defer rows.Close()
+
+	// Customers may only read their own accounts
+	customerID := accountListFilter(r)
+	found := map[int]balanceResponse{}
+	for rows.Next() {
+		var b balanceResponse
+		var owner int
+		if err := rows.Scan(&b.AccountID, &owner, &b.Balance, &b.CurrencyCode, &b.LienAmount); err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		if customerID != 0 && owner != customerID {
+			continue
+		}
+		b.AvailableBalance = b.Balance - b.LienAmount
+		found[b.AccountID] = b
+	}
+	if err := rows.Err(); err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	resp := batchBalancesResponse{Balances: []balanceResponse{}, NotFound: []int{}}
+	seen := map[int]bool{}
+	for _, id := range req.AccountIDs {
+		if seen[id] {
+			continue
+		}
+		seen[id] = true
+		if b, ok := found[id]; ok {
+			resp.Balances = append(resp.Balances, b)
+		} else {
+			resp.NotFound = append(resp.NotFound, id)
+		}
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(resp)
+}
@@ -0,0 +1,45 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"net/http"
+
+	"bank/servicekit"
+
+	"go.uber.org/zap"
+)
+
+// Break-glass scopes granted by auth-service
+const scopeExceedLimits = "exceed_limits"
+
+// useBreakGlass asks auth-service whether the caller holds an active
+// break-glass grant for scope, forwarding the caller's credentials. The use is
+// audited and alerted on by auth-service, so a restriction is only bypassed
+// when it confirms the grant; any failure keeps the restriction in place.
+func useBreakGlass(r *http.Request, scope, target string) bool {
+	auth := r.Header.Get("Authorization")
+	if auth == "" || !hasRole(r, "admin") {
+		return false
+	}
+
+	payload, _ := json.Marshal(map[string]string{"scope": scope, "service": serviceName, "target": target})
+	url := getEnv("AUTH_SERVICE_URL", "http://localhost:8082") + "/v1/break-glass/uses"
+	req, err := http.NewRequestWithContext(r.Context(), http.MethodPost, url, bytes.NewReader(payload))
+	if err != nil {
+		return false
+	}
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("Authorization", auth)
+	if forwarded := r.Header.Get("X-Forwarded-For"); forwarded != "" {
+		req.Header.Set("X-Forwarded-For", forwarded)
+	}
+
+	resp, err := serviceClient.Do(req)
+	if err != nil {
+		servicekit.RequestLogger(r.Context()).Error("break-glass check failed", zap.Error(err))
+		return false
+	}
+	resp.Body.Close()
+	return resp.StatusCode == http.StatusCreated
+}
@@ -0,0 +1,284 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"strings"
+
+	"bank/servicekit"
+
+	"github.com/lib/pq"
+	"go.uber.org/zap"
+)
+
+// Onboarding migrations open accounts in bulk, with the balances carried over
+// from the previous system. Accounts are created in chunks, each in one
+// transaction: an item that fails validation is reported and skipped, while a
+// failure while writing rolls back and reports its whole chunk. A legacy
+// reference, unique among accounts, lets a partly failed file be submitted
+// again without opening accounts twice.
+
+const bulkAccountTablesSQL = `
+	ALTER TABLE accounts ADD COLUMN IF NOT EXISTS legacy_reference VARCHAR(100);
+	CREATE UNIQUE INDEX IF NOT EXISTS idx_accounts_legacy_reference ON accounts(legacy_reference)
+		WHERE legacy_reference IS NOT NULL;`
+
+// accountMigrationRoles may create accounts in bulk
+var accountMigrationRoles = []string{"admin"}
+
+const (
+	maxBulkAccounts                 = 5000
+	defaultBulkChunkSize            = 100
+	maxBulkChunkSize                = 500
+	bulkMigrationPostingDescription = "Opening balance (migration)"
+)
+
+// BulkAccount is one account to open
+type BulkAccount struct {
+	CustomerID      int    `json:"customer_id"`
+	Product         string `json:"product"`
+	CurrencyCode    string `json:"currency_code"`
+	InitialBalance  Money  `json:"initial_balance"`
+	Status          string `json:"status,omitempty"`
+	LegacyReference string `json:"legacy_reference,omitempty"`
+}
+
+type bulkAccountsRequest struct {
+	Accounts  []BulkAccount `json:"accounts"`
+	ChunkSize int           `json:"chunk_size,omitempty"`
+}
+
+// BulkAccountResult is the outcome for the item at Index of the request
+type BulkAccountResult struct {
+	Index           int    `json:"index"`
+	CustomerID      int    `json:"customer_id"`
+	LegacyReference string `json:"legacy_reference,omitempty"`
+	Status          string `json:"status"` // created or failed
+	AccountID       int    `json:"account_id,omitempty"`
+	AccountNumber   string `json:"account_number,omitempty"`
+	Error           string `json:"error,omitempty"`
+}
+
+// BulkAccountsReport summarizes a bulk creation
+type BulkAccountsReport struct {
+	Requested int                 `json:"requested"`
+	Created   int                 `json:"created"`
+	Failed    int                 `json:"failed"`
+	Results   []BulkAccountResult `json:"results"`
+}
+
+// validateBulkAccount returns why an item cannot be created, or ""
+func validateBulkAccount(a *BulkAccount) string {
+	if a.CurrencyCode == "" {
+		a.CurrencyCode = "USD"
+	}
+	if a.Status == "" {
+		a.Status = "active"
+	}
+	a.CurrencyCode = strings.ToUpper(a.CurrencyCode)
+	switch {
+	case a.CustomerID <= 0:
+		return "customer_id is required"
+	case a.Product == "":
+		return "product is required"
+	}
+	if _, ok := productCatalog[a.Product]; !ok {
+		return fmt.Sprintf("unknown product %q", a.Product)
+	}
+	switch {
+	case len(a.CurrencyCode) != 3:
+		return "currency_code must be a three-letter code"
+	case a.InitialBalance < 0:
+		return "initial_balance must not be negative"
+	case a.Status != "active" && a.Status != "frozen":
+		return "status must be active or frozen"
+	case len(a.LegacyReference) > 100:
+		return "legacy_reference must be at most 100 characters"
+	}
+	return ""
+}
+
+// createBulkAccounts opens the accounts of an onboarding migration and
+// reports the outcome of every item
+func createBulkAccounts(w http.ResponseWriter, r *http.Request) {
+	if !requireRole(w, r, accountMigrationRoles...) {
+		return
+	}
+	var req bulkAccountsRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, "Invalid request body", http.StatusBadRequest)
+		return
+	}
+	if len(req.Accounts) == 0 || len(req.Accounts) > maxBulkAccounts {
+		http.Error(w, fmt.Sprintf("accounts must list 1 to %d accounts", maxBulkAccounts), http.StatusBadRequest)
+		return
+	}
+	if req.ChunkSize == 0 {
+		req.ChunkSize = defaultBulkChunkSize
+	}
+	if req.ChunkSize < 0 || req.ChunkSize > maxBulkChunkSize {
+		http.Error(w, fmt.Sprintf("chunk_size must be 1 to %d", maxBulkChunkSize), http.StatusBadRequest)
+		return
+	}
+
+	report := BulkAccountsReport{Requested: len(req.Accounts), Results: make([]BulkAccountResult, len(req.Accounts))}
+	var valid []int
+	references := map[string]int{}
+	for i := range req.Accounts {
+		a := &req.Accounts[i]
+		report.Results[i] = BulkAccountResult{Index: i, CustomerID: a.CustomerID, LegacyReference: a.LegacyReference}
+		reason := validateBulkAccount(a)
+		if first, dup := references[a.LegacyReference]; reason == "" && dup && a.LegacyReference != "" {
+			reason = fmt.Sprintf("legacy_reference repeats item %d", first)
+		}
+		if reason != "" {
+			report.Results[i].Status, report.Results[i].Error = "failed", reason
+			continue
+		}
+		references[a.LegacyReference] = i
+		valid = append(valid, i)
+	}
+	if err := markRestrictedCustomers(r.Context(), req.Accounts, valid, report.Results); err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	for start := 0; start < len(valid); start += req.ChunkSize {
+		end := start + req.ChunkSize
+		if end > len(valid) {
+			end = len(valid)
+		}
+		chunk := []int{}
+		for _, i := range valid[start:end] {
+			if report.Results[i].Status == "" {
+				chunk = append(chunk, i)
+			}
+		}
+		if err := createAccountChunk(r.Context(), req.Accounts, chunk, report.Results); err != nil {
+			if r.Context().Err() != nil {
+				http.Error(w, "Request canceled; chunks reported as created were committed", http.StatusServiceUnavailable)
+				return
+			}
+			servicekit.RequestLogger(r.Context()).Warn("bulk account chunk failed", zap.Int("first_index", valid[start]), zap.Error(err))
+		}
+	}
+
+	for _, result := range report.Results {
+		if result.Status == "created" {
+			report.Created++
+		} else {
+			report.Failed++
+		}
+	}
+	servicekit.RequestLogger(r.Context()).Info("bulk accounts created", zap.String("actor", requestActor(r)),
+		zap.Int("requested", report.Requested), zap.Int("created", report.Created), zap.Int("failed", report.Failed))
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(report)
+}
+
+// markRestrictedCustomers fails the items of customers whose accounts are
+// restricted for an overdue KYC refresh, as createAccount refuses them
+func markRestrictedCustomers(ctx context.Context, accounts []BulkAccount, items []int, results []BulkAccountResult) error {
+	customers := []int{}
+	for _, i := range items {
+		customers = append(customers, accounts[i].CustomerID)
+	}
+	rows, err := db.QueryContext(ctx, `SELECT customer_id FROM kyc_schedules
+									   WHERE customer_id = ANY($1) AND restricted_at IS NOT NULL`, pq.Array(customers))
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+	restricted := map[int]bool{}
+	for rows.Next() {
+		var customerID int
+		if err := rows.Scan(&customerID); err != nil {
+			return err
+		}
+		restricted[customerID] = true
+	}
+	for _, i := range items {
+		if restricted[accounts[i].CustomerID] {
+			results[i].Status, results[i].Error = "failed", "KYC refresh is overdue"
+		}
+	}
+	return rows.Err()
+}
+
+// createAccountChunk opens the accounts of one chunk in a transaction and
+// queues their opening balances for the ledger in it. On error
+// every item of the chunk is marked failed with the reason.
+func createAccountChunk(ctx context.Context, accounts []BulkAccount, chunk []int, results []BulkAccountResult) error {
+	if len(chunk) == 0 {
+		return nil
+	}
+	fail := func(reason string, err error) error {
+		for _, i := range chunk {
+			results[i].Status, results[i].AccountID, results[i].AccountNumber, results[i].Error = "failed", 0, "", reason
+		}
+		return err
+	}
+
+	tx, err := db.BeginTx(ctx, nil)
+	if err != nil {
+		return fail("chunk could not be written (request "+servicekit.RequestID(ctx)+")", err)
+	}
+	defer tx.Rollback()
+
+	for _, i := range chunk {
+		a := accounts[i]
+		var reference interface{}
+		if a.LegacyReference != "" {
+			reference = a.LegacyReference
+		}
+		results[i].AccountNumber, err = newAccountNumber(ctx, tx)
+		if err == nil {
+			err = tx.QueryRowContext(ctx, `INSERT INTO accounts (customer_id, account_type, balance, currency_code, status,
+										   legacy_reference, account_number) VALUES ($1, $2, $3, $4, $5, $6, $7) RETURNING id`,
+				a.CustomerID, a.Product, a.InitialBalance, a.CurrencyCode, a.Status, reference,
+				results[i].AccountNumber).Scan(&results[i].AccountID)
+		}
+		if e, ok := constraintViolation(err); ok {
+			return fail(fmt.Sprintf("chunk rolled back: item %d: %s", i, e.Message), err)
+		}
+		if err == nil {
+			err = enqueueEvent(ctx, tx, "account.created", fmt.Sprintf("account:%d", results[i].AccountID),
+				map[string]interface{}{"account_id": results[i].AccountID, "customer_id": a.CustomerID,
+					"account_type": a.Product, "currency_code": a.CurrencyCode, "status": a.Status,
+					"account_number": results[i].AccountNumber})
+		}
+		if err != nil {
+			return fail(fmt.Sprintf("chunk rolled back: item %d could not be written (request %s)", i, servicekit.RequestID(ctx)), err)
+		}
+	}
+
+	// The balances are queued once the whole chunk is inserted; a failing
+	// insert rolls them back with the chunk
+	for _, i := range chunk {
+		a := accounts[i]
+		if a.InitialBalance == 0 {
+			continue
+		}
+		posting := ledgerChange(results[i].AccountID, a.InitialBalance, a.CurrencyCode, bulkMigrationPostingDescription)
+		posting.Type = "deposit"
+		if err := recordInLedger(ctx, tx, posting); err != nil {
+			return fail(fmt.Sprintf("chunk rolled back: item %d could not be written (request %s)", i, servicekit.RequestID(ctx)), err)
+		}
+	}
+
+	if err := tx.Commit(); err != nil {
+		if errors.Is(err, sql.ErrTxDone) {
+			err = ctx.Err()
+		}
+		return fail("chunk could not be committed (request "+servicekit.RequestID(ctx)+")", err)
+	}
+	for _, i := range chunk {
+		results[i].Status = "created"
+	}
+	return nil
+}
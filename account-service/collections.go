@@ -0,0 +1,555 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"net/http"
+	"strings"
+	"time"
+
+	"bank/servicekit"
+
+	"github.com/gorilla/mux"
+	"github.com/lib/pq"
+	"go.uber.org/zap"
+)
+
+// Delinquency tracks a loan in arrears or an account overdrawn, from the day
+// it first fell behind until it is cured
+type Delinquency struct {
+	ID             int           `json:"id"`
+	AccountID      int           `json:"account_id"`
+	Kind           string        `json:"kind"` // loan or overdraft
+	StartedOn      string        `json:"started_on"`
+	DaysPastDue    int           `json:"days_past_due"`
+	Bucket         string        `json:"bucket"`
+	AmountPastDue  Money         `json:"amount_past_due"`
+	Status         string        `json:"status"` // open or cured
+	DunningLevel   int           `json:"dunning_level"`
+	LastDunnedAt   string        `json:"last_dunned_at,omitempty"`
+	AssignedTo     string        `json:"assigned_to,omitempty"`
+	CuredAt        string        `json:"cured_at,omitempty"`
+	CreatedAt      string        `json:"created_at"`
+	PendingPromise *PromiseToPay `json:"pending_promise,omitempty"`
+}
+
+// PromiseToPay is a customer's commitment to pay an amount by a date
+type PromiseToPay struct {
+	ID               int    `json:"id"`
+	DelinquencyID    int    `json:"delinquency_id"`
+	Amount           Money  `json:"amount"`
+	PromisedDate     string `json:"promised_date"`
+	Status           string `json:"status"` // pending, kept, broken or replaced
+	PastDueAtPromise Money  `json:"past_due_at_promise"`
+	CreatedBy        string `json:"created_by"`
+	CreatedAt        string `json:"created_at"`
+	ResolvedAt       string `json:"resolved_at,omitempty"`
+}
+
+const collectionTablesSQL = `
+	CREATE TABLE IF NOT EXISTS delinquencies (
+		id SERIAL PRIMARY KEY,
+		account_id INTEGER NOT NULL REFERENCES accounts(id),
+		kind VARCHAR(20) NOT NULL,
+		started_on DATE NOT NULL,
+		amount_past_due DECIMAL(15,2) NOT NULL,
+		status VARCHAR(20) NOT NULL DEFAULT 'open',
+		dunning_level INTEGER NOT NULL DEFAULT 0,
+		last_dunned_at TIMESTAMP,
+		assigned_to VARCHAR(100) NOT NULL DEFAULT '',
+		cured_at TIMESTAMP,
+		created_at TIMESTAMP NOT NULL DEFAULT NOW(),
+		updated_at TIMESTAMP NOT NULL DEFAULT NOW()
+	);
+	CREATE UNIQUE INDEX IF NOT EXISTS idx_delinquencies_open ON delinquencies(account_id) WHERE status = 'open';
+	CREATE TABLE IF NOT EXISTS promises_to_pay (
+		id SERIAL PRIMARY KEY,
+		delinquency_id INTEGER NOT NULL REFERENCES delinquencies(id),
+		amount DECIMAL(15,2) NOT NULL,
+		promised_date DATE NOT NULL,
+		status VARCHAR(20) NOT NULL DEFAULT 'pending',
+		past_due_at_promise DECIMAL(15,2) NOT NULL,
+		created_by VARCHAR(100) NOT NULL,
+		created_at TIMESTAMP NOT NULL DEFAULT NOW(),
+		resolved_at TIMESTAMP
+	);
+	CREATE TABLE IF NOT EXISTS dunning_notices (
+		id SERIAL PRIMARY KEY,
+		delinquency_id INTEGER NOT NULL REFERENCES delinquencies(id),
+		level INTEGER NOT NULL,
+		template VARCHAR(50) NOT NULL,
+		days_past_due INTEGER NOT NULL,
+		sent_at TIMESTAMP NOT NULL DEFAULT NOW()
+	);`
+
+// collectionsRoles may work the collections queue
+var collectionsRoles = []string{"collections", "admin"}
+
+// dunningLevels escalate by days past due; each level is sent once per delinquency
+var dunningLevels = []struct {
+	days     int
+	template string
+}{
+	{1, "dunning_reminder"},
+	{15, "dunning_second_notice"},
+	{30, "dunning_final_notice"},
+	{60, "dunning_default_notice"},
+}
+
+// delinquencyBucketSQL buckets days past due the way the queue is filtered
+const delinquencyBucketSQL = `CASE WHEN CURRENT_DATE - d.started_on >= 90 THEN '90+'
+	WHEN CURRENT_DATE - d.started_on >= 60 THEN '60-89'
+	WHEN CURRENT_DATE - d.started_on >= 30 THEN '30-59' ELSE '1-29' END`
+
+var delinquencyBuckets = map[string]bool{"1-29": true, "30-59": true, "60-89": true, "90+": true}
+
+const delinquencyColumns = `d.id, d.account_id, d.kind, d.started_on::text, CURRENT_DATE - d.started_on, ` + delinquencyBucketSQL + `,
+	d.amount_past_due, d.status, d.dunning_level, COALESCE(d.last_dunned_at::text, ''), d.assigned_to,
+	COALESCE(d.cured_at::text, ''), d.created_at`
+
+const promiseColumns = `id, delinquency_id, amount, promised_date::text, status, past_due_at_promise, created_by, created_at,
+	COALESCE(resolved_at::text, '')`
+
+func scanDelinquency(row interface{ Scan(...interface{}) error }, d *Delinquency) error {
+	return row.Scan(&d.ID, &d.AccountID, &d.Kind, &d.StartedOn, &d.DaysPastDue, &d.Bucket, &d.AmountPastDue, &d.Status,
+		&d.DunningLevel, &d.LastDunnedAt, &d.AssignedTo, &d.CuredAt, &d.CreatedAt)
+}
+
+func scanPromise(row interface{ Scan(...interface{}) error }, p *PromiseToPay) error {
+	return row.Scan(&p.ID, &p.DelinquencyID, &p.Amount, &p.PromisedDate, &p.Status, &p.PastDueAtPromise, &p.CreatedBy,
+		&p.CreatedAt, &p.ResolvedAt)
+}
+
+// startCollections refreshes delinquencies, promises and dunning every hour
+func startCollections() {
+	go func() {
+		defer servicekit.ReportJobPanic("Collections job")
+		for {
+			if err := runCollections(serviceContext); err != nil {
+				servicekit.ReportJobError("Collections job", err)
+			}
+			time.Sleep(time.Hour)
+		}
+	}()
+}
+
+func runCollections(ctx context.Context) error {
+	if err := refreshDelinquencies(ctx); err != nil {
+		return err
+	}
+	if err := resolvePromises(ctx); err != nil {
+		return err
+	}
+	return sendDunningNotices(ctx)
+}
+
+// refreshDelinquencies marks covered installments paid, then opens, updates
+// or cures delinquencies. An installment is covered once the loan balance is
+// at or below its scheduled closing balance; a loan is in arrears from the
+// due date of its oldest uncovered past installment. Overdrafts count from the
+// first day the balance was seen below the overdraft limit, for the amount
+// beyond it.
+func refreshDelinquencies(ctx context.Context) error {
+	_, err := db.ExecContext(ctx, `UPDATE loan_installments i SET paid_at = NOW() FROM accounts a
+								   WHERE a.id = i.account_id AND i.paid_at IS NULL AND i.closing_balance >= a.balance`)
+	if err != nil {
+		return err
+	}
+
+	rows, err := db.QueryContext(ctx, `SELECT l.account_id, 'loan', MIN(i.due_date)::text, a.balance - MIN(i.closing_balance)
+									   FROM loans l JOIN accounts a ON a.id = l.account_id
+									   JOIN loan_installments i ON i.account_id = l.account_id
+									   WHERE l.status = 'active' AND i.due_date < CURRENT_DATE AND i.paid_at IS NULL
+									   GROUP BY l.account_id, a.balance
+									   UNION ALL
+									   SELECT id, 'overdraft', CURRENT_DATE::text, -balance - overdraft_limit FROM accounts
+									   WHERE balance < -overdraft_limit AND status <> 'closed' AND account_type <> ALL($1)`,
+		pq.Array(liabilityAccountTypeList()))
+	if err != nil {
+		return err
+	}
+	type arrears struct {
+		accountID int
+		kind      string
+		startedOn string
+		amount    Money
+	}
+	var current []arrears
+	accountIDs := []int64{}
+	for rows.Next() {
+		var a arrears
+		if err := rows.Scan(&a.accountID, &a.kind, &a.startedOn, &a.amount); err != nil {
+			rows.Close()
+			return err
+		}
+		current = append(current, a)
+		accountIDs = append(accountIDs, int64(a.accountID))
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return err
+	}
+
+	for _, a := range current {
+		// Overdrafts keep the day they started; loans follow the oldest missed installment
+		_, err := db.ExecContext(ctx, `INSERT INTO delinquencies (account_id, kind, started_on, amount_past_due)
+									   VALUES ($1, $2, $3, $4)
+									   ON CONFLICT (account_id) WHERE status = 'open' DO UPDATE SET
+										   amount_past_due = EXCLUDED.amount_past_due, updated_at = NOW(),
+										   started_on = CASE WHEN delinquencies.kind = 'loan' THEN EXCLUDED.started_on
+											   ELSE delinquencies.started_on END`,
+			a.accountID, a.kind, a.startedOn, a.amount)
+		if err != nil {
+			return err
+		}
+	}
+
+	_, err = db.ExecContext(ctx, `UPDATE delinquencies SET status = 'cured', cured_at = NOW(), updated_at = NOW()
+								  WHERE status = 'open' AND NOT (account_id = ANY($1))`, pq.Array(accountIDs))
+	return err
+}
+
+func liabilityAccountTypeList() []string {
+	types := make([]string, 0, len(liabilityAccountTypes))
+	for t := range liabilityAccountTypes {
+		types = append(types, t)
+	}
+	return types
+}
+
+// resolvePromises settles promises whose date has passed: kept when the
+// delinquency was cured or the arrears fell by at least the promised amount
+func resolvePromises(ctx context.Context) error {
+	_, err := db.ExecContext(ctx, `UPDATE promises_to_pay p SET resolved_at = NOW(),
+								   status = CASE WHEN d.status = 'cured'
+									   OR d.amount_past_due <= p.past_due_at_promise - p.amount THEN 'kept' ELSE 'broken' END
+								   FROM delinquencies d
+								   WHERE d.id = p.delinquency_id AND p.status = 'pending'
+								   AND (p.promised_date < CURRENT_DATE OR d.status = 'cured')`)
+	return err
+}
+
+// sendDunningNotices sends the next escalation for every open delinquency
+// that has reached it, unless a promise to pay is pending
+func sendDunningNotices(ctx context.Context) error {
+	rows, err := db.QueryContext(ctx, `SELECT `+delinquencyColumns+`, a.customer_id FROM delinquencies d
+									   JOIN accounts a ON a.id = d.account_id
+									   WHERE d.status = 'open' AND NOT EXISTS (
+										   SELECT 1 FROM promises_to_pay p WHERE p.delinquency_id = d.id AND p.status = 'pending')`)
+	if err != nil {
+		return err
+	}
+	type dunning struct {
+		d          Delinquency
+		customerID int
+	}
+	var open []dunning
+	for rows.Next() {
+		var item dunning
+		d := &item.d
+		if err := rows.Scan(&d.ID, &d.AccountID, &d.Kind, &d.StartedOn, &d.DaysPastDue, &d.Bucket, &d.AmountPastDue,
+			&d.Status, &d.DunningLevel, &d.LastDunnedAt, &d.AssignedTo, &d.CuredAt, &d.CreatedAt, &item.customerID); err != nil {
+			rows.Close()
+			return err
+		}
+		open = append(open, item)
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return err
+	}
+
+	for _, item := range open {
+		level := 0
+		for i, l := range dunningLevels {
+			if item.d.DaysPastDue >= l.days {
+				level = i + 1
+			}
+		}
+		if level <= item.d.DunningLevel {
+			continue
+		}
+		template := dunningLevels[level-1].template
+
+		// Claim the level first so a slow notification service cannot cause duplicates
+		result, err := db.ExecContext(ctx, `UPDATE delinquencies SET dunning_level = $2, last_dunned_at = NOW()
+											WHERE id = $1 AND dunning_level < $2`, item.d.ID, level)
+		if err != nil {
+			return err
+		}
+		if n, _ := result.RowsAffected(); n == 0 {
+			continue
+		}
+		_, err = db.ExecContext(ctx, `INSERT INTO dunning_notices (delinquency_id, level, template, days_past_due)
+									  VALUES ($1, $2, $3, $4)`, item.d.ID, level, template, item.d.DaysPastDue)
+		if err != nil {
+			return err
+		}
+
+		err = sendNotification(ctx, Notification{
+			CustomerID: item.customerID,
+			Channel:    "email",
+			Template:   template,
+			Data: map[string]interface{}{
+				"account_id":      item.d.AccountID,
+				"kind":            item.d.Kind,
+				"days_past_due":   item.d.DaysPastDue,
+				"amount_past_due": item.d.AmountPastDue,
+			},
+		})
+		if err != nil {
+			servicekit.RequestLogger(ctx).Error("failed to send notification", zap.String("template", template), zap.Error(err))
+		}
+	}
+	return nil
+}
+
+// getCollectionsQueue lists open delinquencies, most overdue first
+// (?bucket=, ?assigned_to=, ?kind= filter)
+func getCollectionsQueue(w http.ResponseWriter, r *http.Request) {
+	if !requireRole(w, r, collectionsRoles...) {
+		return
+	}
+
+	query := r.URL.Query()
+	bucket := query.Get("bucket")
+	if bucket != "" && !delinquencyBuckets[bucket] {
+		http.Error(w, "bucket must be 1-29, 30-59, 60-89 or 90+", http.StatusBadRequest)
+		return
+	}
+
+	rows, err := db.QueryContext(r.Context(), `SELECT `+delinquencyColumns+` FROM delinquencies d
+											   WHERE d.status = 'open' AND ($1 = '' OR `+delinquencyBucketSQL+` = $1)
+											   AND ($2 = '' OR d.assigned_to = $2) AND ($3 = '' OR d.kind = $3)
+											   ORDER BY d.started_on, d.amount_past_due DESC LIMIT 500`,
+		bucket, query.Get("assigned_to"), query.Get("kind"))
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	defer rows.Close()
+
+	queue := []Delinquency{}
+	index := map[int]int{}
+	var ids []int64
+	for rows.Next() {
+		var d Delinquency
+		if err := scanDelinquency(rows, &d); err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		index[d.ID] = len(queue)
+		ids = append(ids, int64(d.ID))
+		queue = append(queue, d)
+	}
+	if err := rows.Err(); err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	promises, err := db.QueryContext(r.Context(), `SELECT `+promiseColumns+` FROM promises_to_pay
+												   WHERE status = 'pending' AND delinquency_id = ANY($1)`, pq.Array(ids))
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	defer promises.Close()
+	for promises.Next() {
+		var p PromiseToPay
+		if err := scanPromise(promises, &p); err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		queue[index[p.DelinquencyID]].PendingPromise = &p
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(queue)
+}
+
+// getDelinquency returns a delinquency with its promises and dunning history
+func getDelinquency(w http.ResponseWriter, r *http.Request) {
+	if !requireRole(w, r, collectionsRoles...) {
+		return
+	}
+
+	var d Delinquency
+	err := scanDelinquency(db.QueryRowContext(r.Context(), `SELECT `+delinquencyColumns+` FROM delinquencies d WHERE d.id = $1`,
+		mux.Vars(r)["id"]), &d)
+	if err != nil {
+		if err == sql.ErrNoRows {
+			http.Error(w, "Delinquency not found", http.StatusNotFound)
+		} else {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+		}
+		return
+	}
+
+	promises := []PromiseToPay{}
+	rows, err := db.QueryContext(r.Context(), `SELECT `+promiseColumns+` FROM promises_to_pay
+											   WHERE delinquency_id = $1 ORDER BY id`, d.ID)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var p PromiseToPay
+		if err := scanPromise(rows, &p); err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		promises = append(promises, p)
+	}
+
+	type notice struct {
+		Level       int    `json:"level"`
+		Template    string `json:"template"`
+		DaysPastDue int    `json:"days_past_due"`
+		SentAt      string `json:"sent_at"`
+	}
+	notices := []notice{}
+	noticeRows, err := db.QueryContext(r.Context(), `SELECT level, template, days_past_due, sent_at FROM dunning_notices
+													 WHERE delinquency_id = $1 ORDER BY sent_at`, d.ID)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	defer noticeRows.Close()
+	for noticeRows.Next() {
+		var n notice
+		if err := noticeRows.Scan(&n.Level, &n.Template, &n.DaysPastDue, &n.SentAt); err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		notices = append(notices, n)
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"delinquency":     d,
+		"promises":        promises,
+		"dunning_notices": notices,
+	})
+}
+
+// getAccountDelinquency returns the account's open delinquency, if any
+func getAccountDelinquency(w http.ResponseWriter, r *http.Request) {
+	var d Delinquency
+	err := scanDelinquency(db.QueryRowContext(r.Context(), `SELECT `+delinquencyColumns+` FROM delinquencies d
+															 WHERE d.account_id = $1 AND d.status = 'open'`, mux.Vars(r)["id"]), &d)
+	if err != nil {
+		if err == sql.ErrNoRows {
+			http.Error(w, "Account is not delinquent", http.StatusNotFound)
+		} else {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+		}
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(d)
+}
+
+// assignDelinquency assigns an open delinquency to a collector
+func assignDelinquency(w http.ResponseWriter, r *http.Request) {
+	if !requireRole(w, r, collectionsRoles...) {
+		return
+	}
+
+	var requestBody struct {
+		AssignedTo string `json:"assigned_to"`
+	}
+	err := json.NewDecoder(r.Body).Decode(&requestBody)
+	if err != nil {
+		http.Error(w, "Invalid request body", http.StatusBadRequest)
+		return
+	}
+
+	var d Delinquency
+	err = scanDelinquency(db.QueryRowContext(r.Context(), `UPDATE delinquencies d SET assigned_to = $2, updated_at = NOW()
+															WHERE d.id = $1 AND d.status = 'open' RETURNING `+delinquencyColumns,
+		mux.Vars(r)["id"], strings.TrimSpace(requestBody.AssignedTo)), &d)
+	if err != nil {
+		if err == sql.ErrNoRows {
+			http.Error(w, "Open delinquency not found", http.StatusNotFound)
+		} else {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+		}
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(d)
+}
+
+// createPromiseToPay records a promise on an open delinquency. Dunning is
+// paused while the promise is pending; a new promise replaces a pending one.
+func createPromiseToPay(w http.ResponseWriter, r *http.Request) {
+	if !requireRole(w, r, collectionsRoles...) {
+		return
+	}
+
+	var p PromiseToPay
+	err := json.NewDecoder(r.Body).Decode(&p)
+	if err != nil {
+		http.Error(w, "Invalid request body", http.StatusBadRequest)
+		return
+	}
+	if p.Amount <= 0 {
+		http.Error(w, "Amount must be positive", http.StatusBadRequest)
+		return
+	}
+	promised, err := time.Parse("2006-01-02", p.PromisedDate)
+	if err != nil {
+		http.Error(w, "promised_date must be YYYY-MM-DD", http.StatusBadRequest)
+		return
+	}
+	if promised.Before(time.Now().UTC().Truncate(24 * time.Hour)) {
+		http.Error(w, "promised_date must not be in the past", http.StatusBadRequest)
+		return
+	}
+
+	tx, err := db.BeginTx(r.Context(), nil)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	defer tx.Rollback()
+
+	var pastDue Money
+	err = tx.QueryRowContext(r.Context(), `SELECT amount_past_due FROM delinquencies WHERE id = $1 AND status = 'open' FOR UPDATE`,
+		mux.Vars(r)["id"]).Scan(&pastDue)
+	if err != nil {
+		if err == sql.ErrNoRows {
+			http.Error(w, "Open delinquency not found", http.StatusNotFound)
+		} else {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+		}
+		return
+	}
+
+	_, err = tx.ExecContext(r.Context(), `UPDATE promises_to_pay SET status = 'replaced', resolved_at = NOW()
+										  WHERE delinquency_id = $1 AND status = 'pending'`, mux.Vars(r)["id"])
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	err = scanPromise(tx.QueryRowContext(r.Context(), `INSERT INTO promises_to_pay (delinquency_id, amount, promised_date,
+									  past_due_at_promise, created_by) VALUES ($1, $2, $3, $4, $5) RETURNING `+promiseColumns,
+		mux.Vars(r)["id"], p.Amount, p.PromisedDate, pastDue, requestActor(r)), &p)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	if err := tx.Commit(); err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusCreated)
+	json.NewEncoder(w).Encode(p)
+}
@@ -0,0 +1,77 @@
+package main
+
+import (
+	"errors"
+	"net/http"
+
+	"github.com/lib/pq"
+)
+
+// constraintError is the client error a violated constraint stands for
+type constraintError struct {
+	Status  int
+	Message string
+}
+
+// constraintErrors maps the constraints that guard client input to the error
+// the client gets, so violations never answer with the Postgres message and
+// the schema details it names
+var constraintErrors = map[string]constraintError{
+	"accounts_balance_within_overdraft":     {http.StatusBadRequest, "Insufficient funds"},
+	"accounts_overdraft_limit_non_negative": {http.StatusBadRequest, "overdraft_limit must not be negative"},
+	"accounts_currency_code_valid":          {http.StatusBadRequest, "currency_code must be a three-letter ISO 4217 code"},
+	"accounts_status_valid":                 {http.StatusBadRequest, "status must be active, frozen, restricted or closed"},
+	"accounts_customer_id_fkey":             {http.StatusBadRequest, "customer_id does not name a customer"},
+	"idx_accounts_legacy_reference":         {http.StatusConflict, "legacy_reference already exists"},
+	"idx_spending_blocks_unique":            {http.StatusConflict, "The account already has this block"},
+	"idx_matching_rules_name":               {http.StatusConflict, "The account already has a matching rule with this name"},
+	"idx_atm_cards_pan":                     {http.StatusConflict, "The card is already linked to an account"},
+	"agents_agent_code_key":                 {http.StatusConflict, "agent_code is already taken"},
+	"idx_agents_user":                       {http.StatusConflict, "The user is already an agent"},
+	"idx_agents_float_account":              {http.StatusConflict, "The account is already an agent's float account"},
+}
+
+// constraintViolation returns the client error for err when it is a
+// constraint violation or a value the column cannot hold
+func constraintViolation(err error) (constraintError, bool) {
+	var pqErr *pq.Error
+	if !errors.As(err, &pqErr) {
+		return constraintError{}, false
+	}
+	if e, ok := constraintErrors[pqErr.Constraint]; ok {
+		return e, true
+	}
+	switch pqErr.Code.Class() {
+	case "23": // integrity constraint violation
+		switch pqErr.Code {
+		case "23505":
+			return constraintError{http.StatusConflict, "The record already exists"}, true
+		case "23503":
+			return constraintError{http.StatusBadRequest, "The request refers to a record that does not exist"}, true
+		}
+		return constraintError{http.StatusBadRequest, "The request contains an invalid value"}, true
+	case "22": // data exception, such as a value too long or out of range
+		return constraintError{http.StatusBadRequest, "The request contains a value out of range"}, true
+	}
+	return constraintError{}, false
+}
+
+// writeDBError answers a failed write with the client error a constraint
+// violation stands for, and with a 500 otherwise
+func writeDBError(w http.ResponseWriter, err error) {
+	if e, ok := constraintViolation(err); ok {
+		http.Error(w, e.Message, e.Status)
+		return
+	}
+	http.Error(w, err.Error(), http.StatusInternalServerError)
+}
+
+// balanceUpdateError returns ErrInsufficientFunds when a balance update was
+// refused for taking the balance below the overdraft limit, and err otherwise
+func balanceUpdateError(err error) error {
+	var pqErr *pq.Error
+	if errors.As(err, &pqErr) && pqErr.Constraint == "accounts_balance_within_overdraft" {
+		return ErrInsufficientFunds
+	}
+	return err
+}
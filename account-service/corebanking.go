@@ -0,0 +1,187 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math/rand"
+	"strconv"
+	"sync"
+	"time"
+
+	"bank/servicekit"
+
+	"go.uber.org/zap"
+)
+
+// CorePosting is a single balance movement sent to the core banking system
+type CorePosting struct {
+	AccountID   int    `json:"account_id"`
+	Amount      Money  `json:"amount"` // positive for credits, negative for debits
+	Currency    string `json:"currency"`
+	Reference   string `json:"reference"` // the core posts each reference once
+	Description string `json:"description"`
+}
+
+// CorePostingResult is the core's acknowledgement of a posting
+type CorePostingResult struct {
+	CoreReference string
+	Balance       Money
+	PostedAt      time.Time
+}
+
+// CoreBalance is an account balance as held by the core
+type CoreBalance struct {
+	AccountID int
+	Balance   Money
+	Currency  string
+	AsOf      time.Time
+}
+
+// CoreCustomer is the customer record as held by the core
+type CoreCustomer struct {
+	CustomerID int
+	FullName   string
+	Segment    string
+}
+
+// CoreBankingConnector abstracts the core banking system of record so a real
+// core (Temenos, Finacle) can replace the simulator without touching handlers.
+// PostTransaction may be called more than once for a posting; a connector
+// posts each reference once and answers a repeat with the original result.
+type CoreBankingConnector interface {
+	PostTransaction(ctx context.Context, posting CorePosting) (CorePostingResult, error)
+	FetchBalance(ctx context.Context, accountID int) (CoreBalance, error)
+	FetchCustomer(ctx context.Context, customerID int) (CoreCustomer, error)
+}
+
+var ErrCoreUnavailable = errors.New("core banking system unavailable")
+
+var core CoreBankingConnector
+
+// newCoreBankingConnector returns the connector selected by CORE_BANKING_CONNECTOR.
+// "none" (the default) disables core postings.
+func newCoreBankingConnector(name string) CoreBankingConnector {
+	switch name {
+	case "", "none":
+		return nil
+	case "simulator":
+		return newSimulatedCore()
+	default:
+		logger.Fatal("unsupported core banking connector", zap.String("connector", name))
+		return nil
+	}
+}
+
+// simulatedCore is an in-memory core with configurable latency and failure rate
+type simulatedCore struct {
+	mu          sync.Mutex
+	balances    map[int]Money
+	posted      map[string]CorePostingResult // by reference
+	sequence    int
+	latency     time.Duration
+	failureRate float64
+}
+
+func newSimulatedCore() *simulatedCore {
+	s := &simulatedCore{balances: map[int]Money{}, posted: map[string]CorePostingResult{}}
+	if d, err := time.ParseDuration(getEnv("CORE_SIMULATOR_LATENCY", "0s")); err == nil {
+		s.latency = d
+	}
+	if rate, err := strconv.ParseFloat(getEnv("CORE_SIMULATOR_FAILURE_RATE", "0"), 64); err == nil {
+		s.failureRate = rate
+	}
+	return s
+}
+
+func (s *simulatedCore) simulate(ctx context.Context) error {
+	if s.latency > 0 {
+		select {
+		case <-time.After(s.latency):
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+	}
+	if s.failureRate > 0 && rand.Float64() < s.failureRate {
+		return ErrCoreUnavailable
+	}
+	return nil
+}
+
+func (s *simulatedCore) PostTransaction(ctx context.Context, posting CorePosting) (CorePostingResult, error) {
+	if err := s.simulate(ctx); err != nil {
+		return CorePostingResult{}, err
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if result, ok := s.posted[posting.Reference]; ok && posting.Reference != "" {
+		return result, nil
+	}
+	s.sequence++
+	s.balances[posting.AccountID] += posting.Amount
+	result := CorePostingResult{
+		CoreReference: fmt.Sprintf("SIM%010d", s.sequence),
+		Balance:       s.balances[posting.AccountID],
+		PostedAt:      time.Now().UTC(),
+	}
+	if posting.Reference != "" {
+		s.posted[posting.Reference] = result
+	}
+	return result, nil
+}
+
+func (s *simulatedCore) FetchBalance(ctx context.Context, accountID int) (CoreBalance, error) {
+	if err := s.simulate(ctx); err != nil {
+		return CoreBalance{}, err
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	return CoreBalance{AccountID: accountID, Balance: s.balances[accountID], Currency: "USD", AsOf: time.Now().UTC()}, nil
+}
+
+func (s *simulatedCore) FetchCustomer(ctx context.Context, customerID int) (CoreCustomer, error) {
+	if err := s.simulate(ctx); err != nil {
+		return CoreCustomer{}, err
+	}
+	return CoreCustomer{CustomerID: customerID, FullName: fmt.Sprintf("Simulated Customer %d", customerID), Segment: "retail"}, nil
+}
+
+// corePostingEvent is the outbox event type of core postings, which the relay
+// sends to the core instead of the broker
+const corePostingEvent = "core.posting"
+
+// queueCorePosting mirrors a local balance change to the core. The posting is
+// written to the outbox inside tx, so the core sees it only once tx commits
+// and no remote call is made while the transaction holds its row locks. The
+// relay retries until the core accepts it; the reference makes the retries
+// post once.
+func queueCorePosting(ctx context.Context, tx *sql.Tx, posting CorePosting) error {
+	if core == nil {
+		return nil
+	}
+	if posting.Reference == "" {
+		posting.Reference = "CP-" + servicekit.NewCorrelationID()
+	}
+	return enqueueEvent(ctx, tx, corePostingEvent, "account:"+strconv.Itoa(posting.AccountID), posting)
+}
+
+// sendToCore delivers a queued posting to the core
+func sendToCore(ctx context.Context, payload []byte) error {
+	var posting CorePosting
+	if err := json.Unmarshal(payload, &posting); err != nil {
+		return err
+	}
+	// Postings queued before the connector was switched off have nowhere to go
+	if core == nil {
+		logger.Warn("core posting dropped: no core banking connector", zap.String("reference", posting.Reference))
+		return nil
+	}
+	_, err := core.PostTransaction(ctx, posting)
+	return err
+}
@@ -0,0 +1,35 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"testing"
+)
+
+// TestCorePostingRedelivery checks a core posting the relay delivers twice
+// moves the core balance once
+func TestCorePostingRedelivery(t *testing.T) {
+	previous := core
+	t.Cleanup(func() { core = previous })
+	simulator := newSimulatedCore()
+	core = simulator
+
+	payload, _ := json.Marshal(CorePosting{AccountID: 70, Amount: 25_00, Currency: "USD", Reference: "CP-1",
+		Description: "Deposit"})
+	event := OutboxEvent{ID: "event-1", Type: corePostingEvent, Key: "account:70", Data: payload}
+	for i := 0; i < 2; i++ {
+		if err := deliverOutboxEvent(context.Background(), event); err != nil {
+			t.Fatal(err)
+		}
+	}
+	balance, err := core.FetchBalance(context.Background(), 70)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if balance.Balance != 25_00 {
+		t.Fatalf("core balance %s, want 25.00", balance.Balance)
+	}
+	if simulator.sequence != 1 {
+		t.Fatalf("%d core postings, want 1", simulator.sequence)
+	}
+}
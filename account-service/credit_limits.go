@@ -0,0 +1,544 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gorilla/mux"
+	"github.com/lib/pq"
+)
+
+// CreditLimit is a customer's limit for one revolving product. The effective
+// limit is the approved limit plus any unexpired temporary boost.
+type CreditLimit struct {
+	CustomerID     int    `json:"customer_id"`
+	Product        string `json:"product"` // overdraft or card
+	ComputedLimit  Money  `json:"computed_limit"`
+	ApprovedLimit  Money  `json:"approved_limit"`
+	TemporaryBoost Money  `json:"temporary_boost"`
+	BoostExpiresAt string `json:"boost_expires_at,omitempty"`
+	EffectiveLimit Money  `json:"effective_limit"`
+	ComputedAt     string `json:"computed_at"`
+	UpdatedAt      string `json:"updated_at"`
+}
+
+// CreditLimitRequest asks for a higher approved limit
+type CreditLimitRequest struct {
+	ID             int    `json:"id"`
+	CustomerID     int    `json:"customer_id"`
+	Product        string `json:"product"`
+	CurrentLimit   Money  `json:"current_limit"`
+	RequestedLimit Money  `json:"requested_limit"`
+	Reason         string `json:"reason,omitempty"`
+	Status         string `json:"status"` // pending, approved or rejected
+	RequestedBy    string `json:"requested_by"`
+	ReviewedBy     string `json:"reviewed_by,omitempty"`
+	ReviewNote     string `json:"review_note,omitempty"`
+	CreatedAt      string `json:"created_at"`
+	ReviewedAt     string `json:"reviewed_at,omitempty"`
+}
+
+const creditLimitTablesSQL = `
+	CREATE TABLE IF NOT EXISTS credit_profiles (
+		customer_id INTEGER PRIMARY KEY,
+		annual_income DECIMAL(15,2) NOT NULL,
+		income_source VARCHAR(20) NOT NULL DEFAULT 'stated',
+		updated_at TIMESTAMP NOT NULL DEFAULT NOW()
+	);
+	CREATE TABLE IF NOT EXISTS credit_limits (
+		customer_id INTEGER NOT NULL,
+		product VARCHAR(20) NOT NULL,
+		computed_limit DECIMAL(15,2) NOT NULL,
+		approved_limit DECIMAL(15,2) NOT NULL,
+		temporary_boost DECIMAL(15,2) NOT NULL DEFAULT 0,
+		boost_expires_at TIMESTAMP,
+		computed_at TIMESTAMP NOT NULL DEFAULT NOW(),
+		updated_at TIMESTAMP NOT NULL DEFAULT NOW(),
+		PRIMARY KEY (customer_id, product)
+	);
+	CREATE TABLE IF NOT EXISTS credit_limit_requests (
+		id SERIAL PRIMARY KEY,
+		customer_id INTEGER NOT NULL,
+		product VARCHAR(20) NOT NULL,
+		current_limit DECIMAL(15,2) NOT NULL,
+		requested_limit DECIMAL(15,2) NOT NULL,
+		reason VARCHAR(255) NOT NULL DEFAULT '',
+		status VARCHAR(20) NOT NULL DEFAULT 'pending',
+		requested_by VARCHAR(100) NOT NULL,
+		reviewed_by VARCHAR(100) NOT NULL DEFAULT '',
+		review_note VARCHAR(255) NOT NULL DEFAULT '',
+		created_at TIMESTAMP NOT NULL DEFAULT NOW(),
+		reviewed_at TIMESTAMP
+	);`
+
+// creditOfficerRoles may record credit profiles and recalculate, boost and
+// review credit limits
+var creditOfficerRoles = []string{"credit_officer", "admin"}
+
+// creditProducts share of annual income and of average balances that the
+// computed limit may reach, before the behaviour factor is applied
+var creditProducts = map[string]struct{ incomeShare, balanceShare float64 }{
+	"overdraft": {0.10, 0.50},
+	"card":      {0.25, 0.50},
+}
+
+// maxCreditLimit caps computed limits per product, at 50,000.00
+const maxCreditLimit Money = 50000_00
+
+// unverifiedCreditLimitCap caps limits computed from stated income, at 1,000.00
+const unverifiedCreditLimitCap Money = 1000_00
+
+const creditLimitColumns = `customer_id, product, computed_limit, approved_limit,
+	CASE WHEN boost_expires_at > NOW() THEN temporary_boost ELSE 0 END,
+	CASE WHEN boost_expires_at > NOW() THEN boost_expires_at::text ELSE '' END,
+	approved_limit + CASE WHEN boost_expires_at > NOW() THEN temporary_boost ELSE 0 END,
+	computed_at, updated_at`
+
+const creditLimitRequestColumns = `id, customer_id, product, current_limit, requested_limit, reason, status, requested_by,
+	reviewed_by, review_note, created_at, COALESCE(reviewed_at::text, '')`
+
+func scanCreditLimit(row interface{ Scan(...interface{}) error }, c *CreditLimit) error {
+	return row.Scan(&c.CustomerID, &c.Product, &c.ComputedLimit, &c.ApprovedLimit, &c.TemporaryBoost, &c.BoostExpiresAt,
+		&c.EffectiveLimit, &c.ComputedAt, &c.UpdatedAt)
+}
+
+func scanCreditLimitRequest(row interface{ Scan(...interface{}) error }, c *CreditLimitRequest) error {
+	return row.Scan(&c.ID, &c.CustomerID, &c.Product, &c.CurrentLimit, &c.RequestedLimit, &c.Reason, &c.Status,
+		&c.RequestedBy, &c.ReviewedBy, &c.ReviewNote, &c.CreatedAt, &c.ReviewedAt)
+}
+
+// setCreditProfile records the customer's annual income used for limits
+func setCreditProfile(w http.ResponseWriter, r *http.Request) {
+	if !requireRole(w, r, creditOfficerRoles...) {
+		return
+	}
+
+	var requestBody struct {
+		AnnualIncome Money `json:"annual_income"`
+	}
+	err := json.NewDecoder(r.Body).Decode(&requestBody)
+	if err != nil {
+		http.Error(w, "Invalid request body", http.StatusBadRequest)
+		return
+	}
+	if requestBody.AnnualIncome < 0 {
+		http.Error(w, "annual_income must not be negative", http.StatusBadRequest)
+		return
+	}
+
+	result, err := db.ExecContext(r.Context(), `INSERT INTO credit_profiles (customer_id, annual_income) VALUES ($1, $2)
+												ON CONFLICT (customer_id) DO UPDATE SET annual_income = EXCLUDED.annual_income,
+													updated_at = NOW()
+												WHERE credit_profiles.income_source = 'stated'`,
+		mux.Vars(r)["id"], requestBody.AnnualIncome)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	if n, _ := result.RowsAffected(); n == 0 {
+		http.Error(w, "Income is verified; submit a new income verification to change it", http.StatusConflict)
+		return
+	}
+
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// computeCreditLimit derives a product limit from income and behaviour: a
+// share of annual income plus a share of the 90 day average balance, halved
+// after any delinquency in the last year and zero while one is open. Limits
+// on stated income are capped; verified income is scaled by affordability.
+func computeCreditLimit(ctx context.Context, customerID int, product string) (Money, error) {
+	shares := creditProducts[product]
+
+	var income, averageBalance Money
+	var incomeSource string
+	var openDelinquencies, recentDelinquencies int
+	err := db.QueryRowContext(ctx, `SELECT
+										COALESCE((SELECT annual_income FROM credit_profiles WHERE customer_id = $1), 0),
+										COALESCE((SELECT income_source FROM credit_profiles WHERE customer_id = $1), 'stated'),
+										COALESCE((SELECT SUM(avg_balance) FROM (
+											SELECT ROUND(AVG(s.balance), 2) AS avg_balance FROM balance_snapshots s
+											JOIN accounts a ON a.id = s.account_id
+											WHERE a.customer_id = $1 AND a.account_type <> ALL($2)
+											AND s.snapshot_date >= CURRENT_DATE - 90
+											GROUP BY s.account_id) per_account), 0),
+										(SELECT COUNT(*) FROM delinquencies d JOIN accounts a ON a.id = d.account_id
+										 WHERE a.customer_id = $1 AND d.status = 'open'),
+										(SELECT COUNT(*) FROM delinquencies d JOIN accounts a ON a.id = d.account_id
+										 WHERE a.customer_id = $1 AND d.created_at >= NOW() - INTERVAL '1 year')`,
+		customerID, pq.Array(liabilityAccountTypeList())).Scan(&income, &incomeSource, &averageBalance,
+		&openDelinquencies, &recentDelinquencies)
+	if err != nil {
+		return 0, err
+	}
+
+	limit := income.Times(shares.incomeShare)
+	if averageBalance > 0 {
+		limit += averageBalance.Times(shares.balanceShare)
+	}
+	switch {
+	case openDelinquencies > 0:
+		limit = 0
+	case recentDelinquencies > 0:
+		limit /= 2
+	}
+	if incomeSource == "stated" {
+		if limit > unverifiedCreditLimitCap {
+			limit = unverifiedCreditLimitCap
+		}
+	} else {
+		a, err := assessAffordability(ctx, customerID, 0)
+		if err != nil {
+			return 0, err
+		}
+		limit = limit * Money(a.Score) / 100
+	}
+	if limit > maxCreditLimit {
+		limit = maxCreditLimit
+	}
+	// Round down to the nearest 100.00
+	return limit - limit%100_00, nil
+}
+
+// recalculateCreditLimits recomputes every product limit of a customer. New
+// limits are approved as computed; existing approved limits follow the
+// computed limit down but only rise through an increase request.
+func recalculateCreditLimits(w http.ResponseWriter, r *http.Request) {
+	if !requireRole(w, r, creditOfficerRoles...) {
+		return
+	}
+	customerID, err := strconv.Atoi(mux.Vars(r)["id"])
+	if err != nil {
+		http.Error(w, "Invalid customer ID", http.StatusBadRequest)
+		return
+	}
+
+	limits := []CreditLimit{}
+	for product := range creditProducts {
+		computed, err := computeCreditLimit(r.Context(), customerID, product)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+
+		var c CreditLimit
+		err = scanCreditLimit(db.QueryRowContext(r.Context(), `INSERT INTO credit_limits (customer_id, product, computed_limit, approved_limit)
+										  VALUES ($1, $2, $3, $3)
+										  ON CONFLICT (customer_id, product) DO UPDATE SET computed_limit = EXCLUDED.computed_limit,
+											  approved_limit = LEAST(credit_limits.approved_limit, EXCLUDED.computed_limit),
+											  computed_at = NOW(), updated_at = NOW()
+										  RETURNING `+creditLimitColumns, customerID, product, computed), &c)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		limits = append(limits, c)
+	}
+	sort.Slice(limits, func(i, j int) bool { return limits[i].Product < limits[j].Product })
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(limits)
+}
+
+func listCreditLimits(w http.ResponseWriter, r *http.Request) {
+	rows, err := db.QueryContext(r.Context(), `SELECT `+creditLimitColumns+` FROM credit_limits
+											   WHERE customer_id = $1 ORDER BY product`, mux.Vars(r)["id"])
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	defer rows.Close()
+
+	limits := []CreditLimit{}
+	for rows.Next() {
+		var c CreditLimit
+		if err := scanCreditLimit(rows, &c); err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		limits = append(limits, c)
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(limits)
+}
+
+// boostCreditLimit grants a temporary addition to the approved limit until
+// expires_at. It overrides the scored limit, so it needs the override-limits
+// privilege.
+func boostCreditLimit(w http.ResponseWriter, r *http.Request) {
+	if !requireRole(w, r, creditOfficerRoles...) {
+		return
+	}
+	if !requirePrivilege(w, r, privilegeOverrideLimits) {
+		return
+	}
+
+	var requestBody struct {
+		Amount    Money  `json:"amount"`
+		ExpiresAt string `json:"expires_at"`
+	}
+	err := json.NewDecoder(r.Body).Decode(&requestBody)
+	if err != nil {
+		http.Error(w, "Invalid request body", http.StatusBadRequest)
+		return
+	}
+	if requestBody.Amount <= 0 {
+		http.Error(w, "Amount must be positive", http.StatusBadRequest)
+		return
+	}
+	expires, err := time.Parse(time.RFC3339, requestBody.ExpiresAt)
+	if err != nil || !expires.After(time.Now()) || expires.After(time.Now().AddDate(1, 0, 0)) {
+		http.Error(w, "expires_at must be an RFC 3339 time within the next 3 months", http.StatusBadRequest)
+		return
+	}
+
+	params := mux.Vars(r)
+	// Boosts beyond 3 months need an admin's exceed_limits break-glass grant
+	if expires.After(time.Now().AddDate(0, 3, 0)) &&
+		!useBreakGlass(r, scopeExceedLimits, "customer:"+params["id"]+"/credit-limits/"+params["product"]+"/boost") {
+		http.Error(w, "expires_at must be an RFC 3339 time within the next 3 months", http.StatusBadRequest)
+		return
+	}
+	var c CreditLimit
+	err = scanCreditLimit(db.QueryRowContext(r.Context(), `UPDATE credit_limits SET temporary_boost = $3, boost_expires_at = $4,
+									  updated_at = NOW() WHERE customer_id = $1 AND product = $2 RETURNING `+creditLimitColumns,
+		params["id"], params["product"], requestBody.Amount, expires), &c)
+	if err != nil {
+		if err == sql.ErrNoRows {
+			http.Error(w, "Credit limit not found", http.StatusNotFound)
+		} else {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+		}
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(c)
+}
+
+// requestCreditLimitIncrease asks for a higher approved limit. Requests
+// within the computed limit are approved straight away; larger ones wait for
+// a credit officer.
+func requestCreditLimitIncrease(w http.ResponseWriter, r *http.Request) {
+	var c CreditLimitRequest
+	err := json.NewDecoder(r.Body).Decode(&c)
+	if err != nil {
+		http.Error(w, "Invalid request body", http.StatusBadRequest)
+		return
+	}
+
+	params := mux.Vars(r)
+	tx, err := db.BeginTx(r.Context(), nil)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	defer tx.Rollback()
+
+	var limit CreditLimit
+	err = scanCreditLimit(tx.QueryRowContext(r.Context(), `SELECT `+creditLimitColumns+` FROM credit_limits
+									  WHERE customer_id = $1 AND product = $2 FOR UPDATE`, params["id"], params["product"]), &limit)
+	if err != nil {
+		if err == sql.ErrNoRows {
+			http.Error(w, "Credit limit not found", http.StatusNotFound)
+		} else {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+		}
+		return
+	}
+	if c.RequestedLimit <= limit.ApprovedLimit {
+		http.Error(w, "requested_limit must be above the approved limit", http.StatusBadRequest)
+		return
+	}
+
+	status := "pending"
+	if c.RequestedLimit <= limit.ComputedLimit {
+		status = "approved"
+	}
+	err = scanCreditLimitRequest(tx.QueryRowContext(r.Context(), `INSERT INTO credit_limit_requests (customer_id, product,
+									  current_limit, requested_limit, reason, status, requested_by, reviewed_by, reviewed_at)
+									  SELECT $1, $2, $3, $4, $5, $6::text, $7, CASE WHEN $6::text = 'approved' THEN 'auto' ELSE '' END,
+										  CASE WHEN $6::text = 'approved' THEN NOW() END
+									  WHERE NOT EXISTS (SELECT 1 FROM credit_limit_requests
+										  WHERE customer_id = $1 AND product = $2 AND status = 'pending')
+									  RETURNING `+creditLimitRequestColumns,
+		limit.CustomerID, limit.Product, limit.ApprovedLimit, c.RequestedLimit, strings.TrimSpace(c.Reason), status,
+		requestActor(r)), &c)
+	if err != nil {
+		if err == sql.ErrNoRows {
+			http.Error(w, "An increase request is already pending", http.StatusConflict)
+		} else {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+		}
+		return
+	}
+	if status == "approved" {
+		if err := applyApprovedLimit(r.Context(), tx, c); err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+	}
+
+	if err := tx.Commit(); err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusCreated)
+	json.NewEncoder(w).Encode(c)
+}
+
+func approveCreditLimitRequest(w http.ResponseWriter, r *http.Request) {
+	reviewCreditLimitRequest(w, r, "approved")
+}
+
+func rejectCreditLimitRequest(w http.ResponseWriter, r *http.Request) {
+	reviewCreditLimitRequest(w, r, "rejected")
+}
+
+// reviewCreditLimitRequest decides a pending increase request. The reviewer
+// cannot be the person who asked. Pending requests are above the computed
+// limit, so approving one needs the override-limits privilege.
+func reviewCreditLimitRequest(w http.ResponseWriter, r *http.Request, decision string) {
+	if !requireRole(w, r, creditOfficerRoles...) {
+		return
+	}
+	if decision == "approved" && !requirePrivilege(w, r, privilegeOverrideLimits) {
+		return
+	}
+
+	var requestBody struct {
+		Note string `json:"note"`
+	}
+	if r.ContentLength != 0 {
+		if err := json.NewDecoder(r.Body).Decode(&requestBody); err != nil {
+			http.Error(w, "Invalid request body", http.StatusBadRequest)
+			return
+		}
+	}
+
+	tx, err := db.BeginTx(r.Context(), nil)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	defer tx.Rollback()
+
+	var c CreditLimitRequest
+	err = scanCreditLimitRequest(tx.QueryRowContext(r.Context(), `SELECT `+creditLimitRequestColumns+` FROM credit_limit_requests
+									  WHERE id = $1 FOR UPDATE`, mux.Vars(r)["id"]), &c)
+	if err != nil {
+		if err == sql.ErrNoRows {
+			http.Error(w, "Credit limit request not found", http.StatusNotFound)
+		} else {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+		}
+		return
+	}
+	if c.Status != "pending" {
+		http.Error(w, fmt.Sprintf("Credit limit request is already %s", c.Status), http.StatusConflict)
+		return
+	}
+	if !enforceMakerChecker(w, r, "credit_limit.review", fmt.Sprintf("credit_limit_request:%d", c.ID), 0,
+		map[string]string{"credit_limit.request": c.RequestedBy}) {
+		return
+	}
+
+	err = scanCreditLimitRequest(tx.QueryRowContext(r.Context(), `UPDATE credit_limit_requests SET status = $2, reviewed_by = $3,
+									  review_note = $4, reviewed_at = NOW() WHERE id = $1 RETURNING `+creditLimitRequestColumns,
+		c.ID, decision, requestActor(r), requestBody.Note), &c)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	if decision == "approved" {
+		if err := applyApprovedLimit(r.Context(), tx, c); err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+	}
+
+	if err := tx.Commit(); err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(c)
+}
+
+func applyApprovedLimit(ctx context.Context, tx *sql.Tx, c CreditLimitRequest) error {
+	_, err := tx.ExecContext(ctx, `UPDATE credit_limits SET approved_limit = $3, updated_at = NOW()
+								   WHERE customer_id = $1 AND product = $2`, c.CustomerID, c.Product, c.RequestedLimit)
+	return err
+}
+
+// getCustomerExposure aggregates what the customer owes and may still draw
+// across products: overdrawn balances, card balances and loans outstanding
+func getCustomerExposure(w http.ResponseWriter, r *http.Request) {
+	customerID, err := strconv.Atoi(mux.Vars(r)["id"])
+	if err != nil {
+		http.Error(w, "Invalid customer ID", http.StatusBadRequest)
+		return
+	}
+
+	var overdrawn, cards, loans Money
+	err = db.QueryRowContext(r.Context(), `SELECT
+										   COALESCE(SUM(-balance) FILTER (WHERE balance < 0 AND account_type <> ALL($2)), 0),
+										   COALESCE(SUM(balance) FILTER (WHERE account_type = 'credit_card'), 0),
+										   COALESCE(SUM(balance) FILTER (WHERE account_type IN ('loan', 'mortgage')), 0)
+										   FROM accounts WHERE customer_id = $1 AND status <> 'closed'`,
+		customerID, pq.Array(liabilityAccountTypeList())).Scan(&overdrawn, &cards, &loans)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	used := map[string]Money{"overdraft": overdrawn, "card": cards}
+	type productExposure struct {
+		Product        string `json:"product"`
+		EffectiveLimit Money  `json:"effective_limit"`
+		Used           Money  `json:"used"`
+		Available      Money  `json:"available"`
+	}
+	products := []productExposure{}
+	var totalLimit Money
+	rows, err := db.QueryContext(r.Context(), `SELECT `+creditLimitColumns+` FROM credit_limits
+											   WHERE customer_id = $1 ORDER BY product`, customerID)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var c CreditLimit
+		if err := scanCreditLimit(rows, &c); err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		available := c.EffectiveLimit - used[c.Product]
+		if available < 0 {
+			available = 0
+		}
+		totalLimit += c.EffectiveLimit
+		products = append(products, productExposure{c.Product, c.EffectiveLimit, used[c.Product], available})
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"customer_id":       customerID,
+		"products":          products,
+		"loans_outstanding": loans,
+		"total_limit":       totalLimit,
+		"total_exposure":    overdrawn + cards + loans,
+	})
+}
@@ -0,0 +1,74 @@
+package main
+
+import (
+	"crypto/subtle"
+	"net/http"
+	"strings"
+)
+
+// csrfConfig controls the double-submit cookie used to protect cookie sessions
+type csrfConfig struct {
+	SessionCookie string
+	CookieName    string
+	HeaderName    string
+	SameSite      http.SameSite
+	Secure        bool
+	Domain        string
+}
+
+func loadCSRFConfig() csrfConfig {
+	cfg := csrfConfig{
+		SessionCookie: getEnv("SESSION_COOKIE_NAME", "bank_session"),
+		CookieName:    getEnv("CSRF_COOKIE_NAME", "csrf_token"),
+		HeaderName:    "X-CSRF-Token",
+		SameSite:      http.SameSiteStrictMode,
+		Secure:        getEnv("CSRF_COOKIE_SECURE", "true") == "true",
+		Domain:        getEnv("CSRF_COOKIE_DOMAIN", ""),
+	}
+
+	switch strings.ToLower(getEnv("CSRF_COOKIE_SAMESITE", "strict")) {
+	case "lax":
+		cfg.SameSite = http.SameSiteLaxMode
+	case "none":
+		// Browsers reject SameSite=None cookies that are not Secure
+		cfg.SameSite = http.SameSiteNoneMode
+		cfg.Secure = true
+	}
+
+	return cfg
+}
+
+// csrfMiddleware validates the CSRF token on state-changing requests made with a
+// session cookie. Requests authenticated with a bearer token are exempt because
+// browsers never attach the Authorization header automatically.
+func csrfMiddleware(cfg csrfConfig) func(http.Handler) http.Handler {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			switch r.Method {
+			case http.MethodGet, http.MethodHead, http.MethodOptions:
+				next.ServeHTTP(w, r)
+				return
+			}
+
+			if strings.HasPrefix(r.Header.Get("Authorization"), "Bearer ") {
+				next.ServeHTTP(w, r)
+				return
+			}
+
+			if _, err := r.Cookie(cfg.SessionCookie); err != nil {
+				next.ServeHTTP(w, r)
+				return
+			}
+
+			cookie, err := r.Cookie(cfg.CookieName)
+			header := r.Header.Get(cfg.HeaderName)
+			if err != nil || cookie.Value == "" || header == "" ||
+				subtle.ConstantTimeCompare([]byte(cookie.Value), []byte(header)) != 1 {
+				http.Error(w, "Invalid CSRF token", http.StatusForbidden)
+				return
+			}
+
+			next.ServeHTTP(w, r)
+		})
+	}
+}
@@ -0,0 +1,42 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+)
+
+var ErrKYCUnavailable = errors.New("KYC status unavailable")
+
+// customerKYCStatus asks customer-service for the customer's KYC status:
+// pending, verified or rejected, or "" when the customer has no profile
+func customerKYCStatus(ctx context.Context, customerID int) (string, error) {
+	url := fmt.Sprintf("%s/v1/customers/%d/kyc-status", getEnv("CUSTOMER_SERVICE_URL", "http://localhost:8084"), customerID)
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, url, nil)
+	if err != nil {
+		return "", err
+	}
+
+	resp, err := serviceClient.Do(req)
+	if err != nil {
+		return "", fmt.Errorf("%w: %v", ErrKYCUnavailable, err)
+	}
+	defer resp.Body.Close()
+	switch resp.StatusCode {
+	case http.StatusOK:
+	case http.StatusNotFound:
+		return "", nil
+	default:
+		return "", fmt.Errorf("%w: status %d", ErrKYCUnavailable, resp.StatusCode)
+	}
+
+	var status struct {
+		KYCStatus string `json:"kyc_status"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&status); err != nil {
+		return "", fmt.Errorf("%w: %v", ErrKYCUnavailable, err)
+	}
+	return status.KYCStatus, nil
+}
@@ -0,0 +1,177 @@
+package main
+
+import (
+	"database/sql"
+	"encoding/json"
+	"net/http"
+	"strconv"
+
+	"github.com/gorilla/mux"
+	"github.com/lib/pq"
+)
+
+// CustomerReparent records the accounts and history moved from a duplicate
+// customer to the surviving one when auth-service merges their records
+type CustomerReparent struct {
+	MergeID        int     `json:"merge_id"`
+	FromCustomerID int     `json:"from_customer_id"`
+	ToCustomerID   int     `json:"to_customer_id"`
+	AccountIDs     []int64 `json:"account_ids"`
+	MovedBy        string  `json:"moved_by"`
+	CreatedAt      string  `json:"created_at"`
+}
+
+const customerMergeTablesSQL = `
+	CREATE TABLE IF NOT EXISTS customer_reparents (
+		merge_id INTEGER PRIMARY KEY,
+		from_customer_id INTEGER NOT NULL,
+		to_customer_id INTEGER NOT NULL,
+		account_ids INTEGER[] NOT NULL,
+		moved_by VARCHAR(100) NOT NULL,
+		created_at TIMESTAMP NOT NULL DEFAULT NOW()
+	);
+	ALTER TABLE account_owner_history ALTER COLUMN transfer_id DROP NOT NULL;
+	ALTER TABLE account_owner_history ADD COLUMN IF NOT EXISTS merge_id INTEGER;`
+
+// customerMergeRoles may re-parent a customer's accounts
+var customerMergeRoles = []string{"admin"}
+
+// customerHistoryUpdates move customer-level history to the surviving
+// customer. Where the survivor already has a one-per-customer row, the
+// survivor's row is kept and the duplicate's is dropped afterwards.
+var customerHistoryUpdates = []string{
+	`UPDATE income_verifications SET customer_id = $2 WHERE customer_id = $1`,
+	`UPDATE credit_limit_requests SET customer_id = $2 WHERE customer_id = $1`,
+	`UPDATE credit_profiles SET customer_id = $2 WHERE customer_id = $1
+	 AND NOT EXISTS (SELECT 1 FROM credit_profiles WHERE customer_id = $2)`,
+	`DELETE FROM credit_profiles WHERE customer_id = $1`,
+	`UPDATE credit_limits l SET customer_id = $2 WHERE customer_id = $1
+	 AND NOT EXISTS (SELECT 1 FROM credit_limits s WHERE s.customer_id = $2 AND s.product = l.product)`,
+	`DELETE FROM credit_limits WHERE customer_id = $1`,
+	`UPDATE kyc_refreshes SET customer_id = $2 WHERE customer_id = $1`,
+	`UPDATE kyc_restricted_accounts SET customer_id = $2 WHERE customer_id = $1`,
+	`UPDATE kyc_schedules SET customer_id = $2 WHERE customer_id = $1
+	 AND NOT EXISTS (SELECT 1 FROM kyc_schedules WHERE customer_id = $2)`,
+	`DELETE FROM kyc_schedules WHERE customer_id = $1`,
+	`UPDATE customer_documents SET customer_id = $2 WHERE customer_id = $1`,
+	`UPDATE signature_envelopes SET customer_id = $2 WHERE customer_id = $1`,
+}
+
+// reparentCustomer moves every account and the customer-level history of a
+// duplicate customer to the surviving customer. It is keyed by the merge ID
+// from auth-service so a retried merge returns the original result.
+func reparentCustomer(w http.ResponseWriter, r *http.Request) {
+	if !requireRole(w, r, customerMergeRoles...) {
+		return
+	}
+	fromID, err := strconv.Atoi(mux.Vars(r)["id"])
+	if err != nil {
+		http.Error(w, "Invalid customer ID", http.StatusBadRequest)
+		return
+	}
+
+	var requestBody struct {
+		ToCustomerID int `json:"to_customer_id"`
+		MergeID      int `json:"merge_id"`
+	}
+	err = json.NewDecoder(r.Body).Decode(&requestBody)
+	if err != nil {
+		http.Error(w, "Invalid request body", http.StatusBadRequest)
+		return
+	}
+	if requestBody.MergeID <= 0 || requestBody.ToCustomerID <= 0 || requestBody.ToCustomerID == fromID {
+		http.Error(w, "merge_id and a different to_customer_id are required", http.StatusBadRequest)
+		return
+	}
+
+	tx, err := db.BeginTx(r.Context(), nil)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	defer tx.Rollback()
+
+	// Serialize retries of the same merge
+	_, err = tx.ExecContext(r.Context(), `SELECT pg_advisory_xact_lock(hashtext('customer_merge'), $1)`, requestBody.MergeID)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	c := CustomerReparent{AccountIDs: []int64{}}
+	err = tx.QueryRowContext(r.Context(), `SELECT merge_id, from_customer_id, to_customer_id, account_ids, moved_by,
+										   created_at FROM customer_reparents WHERE merge_id = $1`, requestBody.MergeID).Scan(
+		&c.MergeID, &c.FromCustomerID, &c.ToCustomerID, pq.Array(&c.AccountIDs), &c.MovedBy, &c.CreatedAt)
+	if err == nil {
+		if c.FromCustomerID != fromID || c.ToCustomerID != requestBody.ToCustomerID {
+			http.Error(w, "merge_id was used for different customers", http.StatusConflict)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(c)
+		return
+	}
+	if err != sql.ErrNoRows {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	rows, err := tx.QueryContext(r.Context(), `UPDATE accounts SET customer_id = $2, updated_at = NOW()
+											   WHERE customer_id = $1 RETURNING id`, fromID, requestBody.ToCustomerID)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	for rows.Next() {
+		var id int64
+		if err := rows.Scan(&id); err != nil {
+			rows.Close()
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		c.AccountIDs = append(c.AccountIDs, id)
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	// Close the duplicate's ownership period on each account it held
+	_, err = tx.ExecContext(r.Context(), `INSERT INTO account_owner_history (account_id, customer_id, owned_from,
+										  owned_until, merge_id)
+										  SELECT a.id, $2, COALESCE((SELECT MAX(owned_until) FROM account_owner_history
+											  WHERE account_id = a.id), a.created_at), NOW(), $3
+										  FROM accounts a WHERE a.id = ANY($1)`,
+		pq.Array(c.AccountIDs), fromID, requestBody.MergeID)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	for _, stmt := range customerHistoryUpdates {
+		if _, err := tx.ExecContext(r.Context(), stmt, fromID, requestBody.ToCustomerID); err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+	}
+
+	err = tx.QueryRowContext(r.Context(), `INSERT INTO customer_reparents (merge_id, from_customer_id, to_customer_id,
+										   account_ids, moved_by) VALUES ($1, $2, $3, $4, $5)
+										   RETURNING merge_id, from_customer_id, to_customer_id, moved_by, created_at`,
+		requestBody.MergeID, fromID, requestBody.ToCustomerID, pq.Array(c.AccountIDs), requestActor(r)).Scan(
+		&c.MergeID, &c.FromCustomerID, &c.ToCustomerID, &c.MovedBy, &c.CreatedAt)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	if err := tx.Commit(); err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusCreated)
+	json.NewEncoder(w).Encode(c)
+}
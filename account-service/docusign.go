@@ -0,0 +1,285 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/json"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"go.uber.org/zap"
+)
+
+// docuSignEventStatuses maps DocuSign Connect events to envelope statuses
+var docuSignEventStatuses = map[string]string{
+	"envelope-sent":      "sent",
+	"envelope-delivered": "delivered",
+	"envelope-completed": "completed",
+	"envelope-declined":  "declined",
+	"envelope-voided":    "voided",
+}
+
+// docuSignProvider uses the DocuSign eSignature REST API with the JWT grant
+// and receives status updates through a DocuSign Connect webhook signed with
+// HMAC
+type docuSignProvider struct {
+	client        *http.Client
+	baseURL       string // e.g. https://demo.docusign.net/restapi
+	oauthHost     string // account-d.docusign.com for the demo environment
+	accountID     string
+	integrationID string
+	userID        string
+	key           *rsa.PrivateKey
+	connectSecret string
+
+	mu      sync.Mutex
+	token   string
+	expires time.Time
+}
+
+func newDocuSignProvider() *docuSignProvider {
+	pemBytes, err := os.ReadFile(os.Getenv("DOCUSIGN_PRIVATE_KEY_PATH"))
+	if err != nil {
+		logger.Fatal("failed to read DocuSign private key", zap.Error(err))
+	}
+	key, err := parseRSAPrivateKey(pemBytes)
+	if err != nil {
+		logger.Fatal("failed to parse DocuSign private key", zap.Error(err))
+	}
+	return &docuSignProvider{
+		client:        &http.Client{Timeout: 15 * time.Second},
+		baseURL:       getEnv("DOCUSIGN_BASE_URL", "https://demo.docusign.net/restapi"),
+		oauthHost:     getEnv("DOCUSIGN_OAUTH_HOST", "account-d.docusign.com"),
+		accountID:     os.Getenv("DOCUSIGN_ACCOUNT_ID"),
+		integrationID: os.Getenv("DOCUSIGN_INTEGRATION_KEY"),
+		userID:        os.Getenv("DOCUSIGN_USER_ID"),
+		key:           key,
+		connectSecret: os.Getenv("DOCUSIGN_CONNECT_HMAC_KEY"),
+	}
+}
+
+func parseRSAPrivateKey(pemBytes []byte) (*rsa.PrivateKey, error) {
+	block, _ := pem.Decode(pemBytes)
+	if block == nil {
+		return nil, errors.New("no PEM block found")
+	}
+	if key, err := x509.ParsePKCS1PrivateKey(block.Bytes); err == nil {
+		return key, nil
+	}
+	parsed, err := x509.ParsePKCS8PrivateKey(block.Bytes)
+	if err != nil {
+		return nil, err
+	}
+	key, ok := parsed.(*rsa.PrivateKey)
+	if !ok {
+		return nil, errors.New("private key is not RSA")
+	}
+	return key, nil
+}
+
+func (d *docuSignProvider) Name() string { return "docusign" }
+
+// assertion builds the RS256-signed JWT exchanged for an access token
+func (d *docuSignProvider) assertion() (string, error) {
+	now := time.Now()
+	header, _ := json.Marshal(map[string]string{"alg": "RS256", "typ": "JWT"})
+	claims, _ := json.Marshal(map[string]interface{}{
+		"iss":   d.integrationID,
+		"sub":   d.userID,
+		"aud":   d.oauthHost,
+		"iat":   now.Unix(),
+		"exp":   now.Add(time.Hour).Unix(),
+		"scope": "signature impersonation",
+	})
+	signingInput := base64.RawURLEncoding.EncodeToString(header) + "." + base64.RawURLEncoding.EncodeToString(claims)
+	digest := sha256.Sum256([]byte(signingInput))
+	signature, err := rsa.SignPKCS1v15(rand.Reader, d.key, crypto.SHA256, digest[:])
+	if err != nil {
+		return "", err
+	}
+	return signingInput + "." + base64.RawURLEncoding.EncodeToString(signature), nil
+}
+
+// accessToken returns a cached JWT grant token
+func (d *docuSignProvider) accessToken(ctx context.Context) (string, error) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	if d.token != "" && time.Now().Before(d.expires) {
+		return d.token, nil
+	}
+
+	assertion, err := d.assertion()
+	if err != nil {
+		return "", err
+	}
+	form := url.Values{}
+	form.Set("grant_type", "urn:ietf:params:oauth:grant-type:jwt-bearer")
+	form.Set("assertion", assertion)
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, "https://"+d.oauthHost+"/oauth/token",
+		strings.NewReader(form.Encode()))
+	if err != nil {
+		return "", err
+	}
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+
+	var resp struct {
+		AccessToken string `json:"access_token"`
+		ExpiresIn   int    `json:"expires_in"`
+	}
+	if err := d.do(req, &resp); err != nil {
+		return "", err
+	}
+	d.token = resp.AccessToken
+	d.expires = time.Now().Add(time.Duration(resp.ExpiresIn)*time.Second - time.Minute)
+	return d.token, nil
+}
+
+// do sends the request and decodes a JSON response into out, or copies the
+// raw body when out is a *[]byte
+func (d *docuSignProvider) do(req *http.Request, out interface{}) error {
+	resp, err := d.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	body, err := io.ReadAll(io.LimitReader(resp.Body, maxAttachmentBytes+1))
+	if err != nil {
+		return err
+	}
+	if resp.StatusCode >= 300 {
+		return fmt.Errorf("docusign returned status %d: %s", resp.StatusCode, strings.TrimSpace(string(body)))
+	}
+	if raw, ok := out.(*[]byte); ok {
+		*raw = body
+		return nil
+	}
+	return json.Unmarshal(body, out)
+}
+
+func (d *docuSignProvider) authorizedRequest(ctx context.Context, method, path string, body []byte) (*http.Request, error) {
+	token, err := d.accessToken(ctx)
+	if err != nil {
+		return nil, err
+	}
+	req, err := http.NewRequestWithContext(ctx, method,
+		fmt.Sprintf("%s/v2.1/accounts/%s%s", d.baseURL, d.accountID, path), bytes.NewReader(body))
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Authorization", "Bearer "+token)
+	if body != nil {
+		req.Header.Set("Content-Type", "application/json")
+	}
+	return req, nil
+}
+
+// CreateEnvelope sends the document to the signer with free-form signing and
+// a per-envelope Connect webhook for status changes
+func (d *docuSignProvider) CreateEnvelope(ctx context.Context, s SignatureRequest) (string, error) {
+	events := []map[string]string{}
+	for event := range docuSignEventStatuses {
+		events = append(events, map[string]string{"envelopeEventStatusCode": strings.TrimPrefix(event, "envelope-")})
+	}
+	body, err := json.Marshal(map[string]interface{}{
+		"emailSubject": s.Subject,
+		"status":       "sent",
+		"documents": []map[string]string{{
+			"documentId":     "1",
+			"name":           s.DocumentName,
+			"fileExtension":  "pdf",
+			"documentBase64": base64.StdEncoding.EncodeToString(s.Document),
+		}},
+		"recipients": map[string]interface{}{
+			"signers": []map[string]string{{
+				"recipientId":  "1",
+				"routingOrder": "1",
+				"name":         s.SignerName,
+				"email":        s.SignerEmail,
+			}},
+		},
+		"eventNotification": map[string]interface{}{
+			"url":                   s.CallbackURL,
+			"requireAcknowledgment": "true",
+			"includeHMAC":           "true",
+			"envelopeEvents":        events,
+			"eventData":             map[string]string{"version": "restv2.1", "format": "json"},
+		},
+	})
+	if err != nil {
+		return "", err
+	}
+
+	req, err := d.authorizedRequest(ctx, http.MethodPost, "/envelopes", body)
+	if err != nil {
+		return "", err
+	}
+	var resp struct {
+		EnvelopeID string `json:"envelopeId"`
+	}
+	if err := d.do(req, &resp); err != nil {
+		return "", err
+	}
+	if resp.EnvelopeID == "" {
+		return "", errors.New("docusign returned no envelope ID")
+	}
+	return resp.EnvelopeID, nil
+}
+
+// DownloadSigned returns the executed document with the certificate of completion
+func (d *docuSignProvider) DownloadSigned(ctx context.Context, envelopeID string) ([]byte, error) {
+	req, err := d.authorizedRequest(ctx, http.MethodGet,
+		"/envelopes/"+url.PathEscape(envelopeID)+"/documents/combined", nil)
+	if err != nil {
+		return nil, err
+	}
+	var pdf []byte
+	if err := d.do(req, &pdf); err != nil {
+		return nil, err
+	}
+	if len(pdf) > maxAttachmentBytes {
+		return nil, errors.New("signed document exceeds the size limit")
+	}
+	return pdf, nil
+}
+
+// ParseWebhook checks the X-DocuSign-Signature-1 HMAC of a Connect delivery
+func (d *docuSignProvider) ParseWebhook(r *http.Request, body []byte) (SignatureEvent, error) {
+	if d.connectSecret == "" {
+		return SignatureEvent{}, ErrInvalidWebhookSignature
+	}
+	mac := hmac.New(sha256.New, []byte(d.connectSecret))
+	mac.Write(body)
+	expected := base64.StdEncoding.EncodeToString(mac.Sum(nil))
+	if !hmac.Equal([]byte(expected), []byte(r.Header.Get("X-DocuSign-Signature-1"))) {
+		return SignatureEvent{}, ErrInvalidWebhookSignature
+	}
+
+	var payload struct {
+		Event string `json:"event"`
+		Data  struct {
+			EnvelopeID string `json:"envelopeId"`
+		} `json:"data"`
+	}
+	if err := json.Unmarshal(body, &payload); err != nil {
+		return SignatureEvent{}, err
+	}
+	if payload.Data.EnvelopeID == "" {
+		return SignatureEvent{}, errors.New("webhook has no envelope ID")
+	}
+	return SignatureEvent{EnvelopeID: payload.Data.EnvelopeID, Status: docuSignEventStatuses[payload.Event]}, nil
+}
@@ -0,0 +1,418 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strings"
+	"time"
+
+	"bank/servicekit"
+
+	"github.com/gorilla/mux"
+	"go.uber.org/zap"
+)
+
+// Escrow holds funds taken from the payer until they are released to the
+// beneficiary or refunded. An outcome executes once both parties approve it,
+// or when an arbiter decides, or when the timeout policy applies.
+type Escrow struct {
+	ID                   int              `json:"id"`
+	PayerAccountID       int              `json:"payer_account_id"`
+	BeneficiaryAccountID int              `json:"beneficiary_account_id"`
+	Amount               Money            `json:"amount"`
+	CurrencyCode         string           `json:"currency_code"`
+	Description          string           `json:"description"`
+	Status               string           `json:"status"` // funded, released or refunded
+	TimeoutAt            string           `json:"timeout_at"`
+	TimeoutAction        string           `json:"timeout_action"` // refund or release
+	TimeoutDays          int              `json:"timeout_days,omitempty"`
+	Approvals            []EscrowApproval `json:"approvals"`
+	ResolvedAt           string           `json:"resolved_at,omitempty"`
+	CreatedAt            string           `json:"created_at"`
+}
+
+// EscrowApproval is one party's vote for an outcome
+type EscrowApproval struct {
+	Party     string `json:"party"`  // payer, beneficiary or arbiter
+	Action    string `json:"action"` // release or refund
+	Actor     string `json:"actor"`
+	CreatedAt string `json:"created_at"`
+}
+
+const escrowTablesSQL = `
+	CREATE TABLE IF NOT EXISTS escrows (
+		id SERIAL PRIMARY KEY,
+		payer_account_id INTEGER NOT NULL REFERENCES accounts(id),
+		beneficiary_account_id INTEGER NOT NULL REFERENCES accounts(id),
+		amount DECIMAL(15,2) NOT NULL,
+		currency_code VARCHAR(3) NOT NULL,
+		description VARCHAR(255) NOT NULL DEFAULT '',
+		status VARCHAR(20) NOT NULL DEFAULT 'funded',
+		timeout_at TIMESTAMP NOT NULL,
+		timeout_action VARCHAR(10) NOT NULL DEFAULT 'refund',
+		resolved_at TIMESTAMP,
+		created_at TIMESTAMP NOT NULL DEFAULT NOW()
+	);
+	CREATE TABLE IF NOT EXISTS escrow_approvals (
+		escrow_id INTEGER NOT NULL REFERENCES escrows(id),
+		party VARCHAR(20) NOT NULL,
+		action VARCHAR(10) NOT NULL,
+		actor VARCHAR(100) NOT NULL,
+		created_at TIMESTAMP NOT NULL DEFAULT NOW(),
+		PRIMARY KEY (escrow_id, party)
+	);`
+
+// maxEscrowDays bounds the timeout of an escrow
+const maxEscrowDays = 365
+
+const escrowColumns = `id, payer_account_id, beneficiary_account_id, amount, currency_code, description, status,
+	timeout_at, timeout_action, COALESCE(resolved_at::text, ''), created_at`
+
+func scanEscrow(row interface{ Scan(...interface{}) error }, e *Escrow) error {
+	return row.Scan(&e.ID, &e.PayerAccountID, &e.BeneficiaryAccountID, &e.Amount, &e.CurrencyCode, &e.Description,
+		&e.Status, &e.TimeoutAt, &e.TimeoutAction, &e.ResolvedAt, &e.CreatedAt)
+}
+
+// createEscrow debits the payer and holds the funds in a new escrow
+func createEscrow(w http.ResponseWriter, r *http.Request) {
+	var e Escrow
+	err := json.NewDecoder(r.Body).Decode(&e)
+	if err != nil {
+		http.Error(w, "Invalid request body", http.StatusBadRequest)
+		return
+	}
+
+	if e.Amount <= 0 {
+		http.Error(w, "Amount must be positive", http.StatusBadRequest)
+		return
+	}
+	if e.PayerAccountID == e.BeneficiaryAccountID {
+		http.Error(w, "Payer and beneficiary must be different accounts", http.StatusBadRequest)
+		return
+	}
+	if !requireOwnAccount(w, r, e.PayerAccountID) {
+		return
+	}
+	if e.TimeoutDays < 1 || e.TimeoutDays > maxEscrowDays {
+		http.Error(w, fmt.Sprintf("timeout_days must be between 1 and %d", maxEscrowDays), http.StatusBadRequest)
+		return
+	}
+	if e.TimeoutAction == "" {
+		e.TimeoutAction = "refund"
+	}
+	if e.TimeoutAction != "refund" && e.TimeoutAction != "release" {
+		http.Error(w, "timeout_action must be refund or release", http.StatusBadRequest)
+		return
+	}
+
+	tx, err := db.BeginTx(r.Context(), nil)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	defer tx.Rollback()
+
+	err = scanEscrow(tx.QueryRowContext(r.Context(), `INSERT INTO escrows (payer_account_id, beneficiary_account_id, amount, currency_code,
+								  description, timeout_at, timeout_action)
+								  SELECT payer.id, beneficiary.id, $3, payer.currency_code, $4, NOW() + $5 * INTERVAL '1 day', $6
+								  FROM accounts payer, accounts beneficiary
+								  WHERE payer.id = $1 AND beneficiary.id = $2 AND payer.currency_code = beneficiary.currency_code
+								  RETURNING `+escrowColumns, e.PayerAccountID, e.BeneficiaryAccountID, e.Amount,
+		strings.TrimSpace(e.Description), e.TimeoutDays, e.TimeoutAction), &e)
+	if err != nil {
+		if err == sql.ErrNoRows {
+			http.Error(w, "Both accounts must exist and use the same currency", http.StatusBadRequest)
+		} else {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+		}
+		return
+	}
+
+	err = postBalanceChange(r.Context(), tx, e.PayerAccountID, -e.Amount, fmt.Sprintf("Escrow %d funding", e.ID))
+	if err != nil {
+		writeTransferError(w, err)
+		return
+	}
+
+	err = tx.Commit()
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	e.Approvals = []EscrowApproval{}
+	notifyEscrow(r.Context(), e, "escrow_funded")
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusCreated)
+	json.NewEncoder(w).Encode(e)
+}
+
+// listAccountEscrows returns escrows where the account is payer or beneficiary
+func listAccountEscrows(w http.ResponseWriter, r *http.Request) {
+	rows, err := db.QueryContext(r.Context(), `SELECT `+escrowColumns+` FROM escrows
+											   WHERE payer_account_id = $1 OR beneficiary_account_id = $1
+											   ORDER BY created_at DESC`, mux.Vars(r)["id"])
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	defer rows.Close()
+
+	escrows := []Escrow{}
+	for rows.Next() {
+		var e Escrow
+		if err := scanEscrow(rows, &e); err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		escrows = append(escrows, e)
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(escrows)
+}
+
+func getEscrow(w http.ResponseWriter, r *http.Request) {
+	e, err := loadEscrow(r.Context(), db, mux.Vars(r)["id"], false)
+	if err != nil {
+		if err == sql.ErrNoRows {
+			http.Error(w, "Escrow not found", http.StatusNotFound)
+		} else {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+		}
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(e)
+}
+
+// approveEscrow records a party's vote and executes the outcome once it is agreed
+func approveEscrow(w http.ResponseWriter, r *http.Request) {
+	var approval EscrowApproval
+	err := json.NewDecoder(r.Body).Decode(&approval)
+	if err != nil {
+		http.Error(w, "Invalid request body", http.StatusBadRequest)
+		return
+	}
+	if approval.Action != "release" && approval.Action != "refund" {
+		http.Error(w, "action must be release or refund", http.StatusBadRequest)
+		return
+	}
+	switch approval.Party {
+	case "payer", "beneficiary":
+	case "arbiter":
+		if !requireRole(w, r, "arbiter", "admin") {
+			return
+		}
+	default:
+		http.Error(w, "party must be payer, beneficiary or arbiter", http.StatusBadRequest)
+		return
+	}
+	approval.Actor = requestActor(r)
+
+	tx, err := db.BeginTx(r.Context(), nil)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	defer tx.Rollback()
+
+	e, err := loadEscrow(r.Context(), tx, mux.Vars(r)["id"], true)
+	if err != nil {
+		if err == sql.ErrNoRows {
+			http.Error(w, "Escrow not found", http.StatusNotFound)
+		} else {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+		}
+		return
+	}
+	if e.Status != "funded" {
+		http.Error(w, fmt.Sprintf("Escrow is already %s", e.Status), http.StatusConflict)
+		return
+	}
+
+	// A party may change its vote until the escrow resolves
+	_, err = tx.ExecContext(r.Context(), `INSERT INTO escrow_approvals (escrow_id, party, action, actor) VALUES ($1, $2, $3, $4)
+										  ON CONFLICT (escrow_id, party) DO UPDATE SET action = EXCLUDED.action,
+											  actor = EXCLUDED.actor, created_at = NOW()`,
+		e.ID, approval.Party, approval.Action, approval.Actor)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	votes := map[string]string{approval.Party: approval.Action}
+	for _, a := range e.Approvals {
+		if a.Party != approval.Party {
+			votes[a.Party] = a.Action
+		}
+	}
+	outcome := votes["arbiter"]
+	if outcome == "" && votes["payer"] != "" && votes["payer"] == votes["beneficiary"] {
+		outcome = votes["payer"]
+	}
+
+	if outcome != "" {
+		if err := resolveEscrow(r.Context(), tx, &e, outcome); err != nil {
+			writeTransferError(w, err)
+			return
+		}
+	}
+
+	err = tx.Commit()
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	if outcome != "" {
+		notifyEscrow(r.Context(), e, "escrow_"+e.Status)
+	}
+
+	e, err = loadEscrow(r.Context(), db, mux.Vars(r)["id"], false)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(e)
+}
+
+// resolveEscrow pays the held funds out to the beneficiary or back to the payer
+func resolveEscrow(ctx context.Context, tx *sql.Tx, e *Escrow, outcome string) error {
+	accountID, status := e.BeneficiaryAccountID, "released"
+	if outcome == "refund" {
+		accountID, status = e.PayerAccountID, "refunded"
+	}
+
+	err := postBalanceChange(ctx, tx, accountID, e.Amount, fmt.Sprintf("Escrow %d %s", e.ID, status))
+	if err != nil {
+		return err
+	}
+	_, err = tx.ExecContext(ctx, `UPDATE escrows SET status = $2, resolved_at = NOW() WHERE id = $1`, e.ID, status)
+	e.Status = status
+	return err
+}
+
+func loadEscrow(ctx context.Context, q interface {
+	QueryRowContext(ctx context.Context, query string, args ...interface{}) *sql.Row
+	QueryContext(ctx context.Context, query string, args ...interface{}) (*sql.Rows, error)
+}, id string, forUpdate bool) (Escrow, error) {
+	var e Escrow
+	query := `SELECT ` + escrowColumns + ` FROM escrows WHERE id = $1`
+	if forUpdate {
+		query += ` FOR UPDATE`
+	}
+	if err := scanEscrow(q.QueryRowContext(ctx, query, id), &e); err != nil {
+		return e, err
+	}
+
+	rows, err := q.QueryContext(ctx, `SELECT party, action, actor, created_at FROM escrow_approvals
+									  WHERE escrow_id = $1 ORDER BY created_at`, e.ID)
+	if err != nil {
+		return e, err
+	}
+	defer rows.Close()
+
+	e.Approvals = []EscrowApproval{}
+	for rows.Next() {
+		var a EscrowApproval
+		if err := rows.Scan(&a.Party, &a.Action, &a.Actor, &a.CreatedAt); err != nil {
+			return e, err
+		}
+		e.Approvals = append(e.Approvals, a)
+	}
+	return e, rows.Err()
+}
+
+// startEscrowTimeouts applies the timeout action to escrows nobody resolved
+func startEscrowTimeouts() {
+	go func() {
+		defer servicekit.ReportJobPanic("Escrow timeout job")
+		for {
+			if err := applyEscrowTimeouts(serviceContext); err != nil {
+				servicekit.ReportJobError("Escrow timeout job", err)
+			}
+			time.Sleep(time.Hour)
+		}
+	}()
+}
+
+func applyEscrowTimeouts(ctx context.Context) error {
+	rows, err := db.QueryContext(ctx, `SELECT id FROM escrows WHERE status = 'funded' AND timeout_at <= NOW()`)
+	if err != nil {
+		return err
+	}
+	var ids []string
+	for rows.Next() {
+		var id string
+		if err := rows.Scan(&id); err != nil {
+			rows.Close()
+			return err
+		}
+		ids = append(ids, id)
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return err
+	}
+
+	for _, id := range ids {
+		if err := timeoutEscrow(ctx, id); err != nil {
+			servicekit.RequestLogger(ctx).Error("failed to apply escrow timeout", zap.String("escrow_id", id), zap.Error(err))
+		}
+	}
+	return nil
+}
+
+func timeoutEscrow(ctx context.Context, id string) error {
+	tx, err := db.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	e, err := loadEscrow(ctx, tx, id, true)
+	if err != nil {
+		return err
+	}
+	if e.Status != "funded" {
+		return nil
+	}
+	if err := resolveEscrow(ctx, tx, &e, e.TimeoutAction); err != nil {
+		return err
+	}
+	if err := tx.Commit(); err != nil {
+		return err
+	}
+	notifyEscrow(ctx, e, "escrow_timed_out")
+	return nil
+}
+
+// notifyEscrow tells both parties about a change to the escrow
+func notifyEscrow(ctx context.Context, e Escrow, template string) {
+	for _, accountID := range []int{e.PayerAccountID, e.BeneficiaryAccountID} {
+		var customerID int
+		err := db.QueryRowContext(ctx, "SELECT customer_id FROM accounts WHERE id = $1", accountID).Scan(&customerID)
+		if err == nil {
+			err = sendNotification(ctx, Notification{
+				CustomerID: customerID,
+				Channel:    "push",
+				Template:   template,
+				Data: map[string]interface{}{
+					"escrow_id":     e.ID,
+					"amount":        e.Amount,
+					"currency_code": e.CurrencyCode,
+					"status":        e.Status,
+					"timeout_at":    e.TimeoutAt,
+				},
+			})
+		}
+		if err != nil {
+			servicekit.RequestLogger(ctx).Error("failed to send notification", zap.String("template", template), zap.Error(err))
+		}
+	}
+}
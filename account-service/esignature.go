@@ -0,0 +1,506 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/mail"
+	"strconv"
+	"strings"
+
+	"bank/servicekit"
+
+	"github.com/gorilla/mux"
+	"go.uber.org/zap"
+)
+
+// SignatureRequest is a document sent to a single signer
+type SignatureRequest struct {
+	Subject      string
+	DocumentName string
+	Document     []byte // PDF
+	SignerName   string
+	SignerEmail  string
+	CallbackURL  string
+}
+
+// SignatureEvent is a status change reported by the provider's webhook
+type SignatureEvent struct {
+	EnvelopeID string
+	Status     string // sent, delivered, completed, declined or voided
+}
+
+// SignatureProvider abstracts the e-signature service so providers can be
+// swapped by configuration
+type SignatureProvider interface {
+	Name() string
+	CreateEnvelope(ctx context.Context, req SignatureRequest) (string, error)
+	DownloadSigned(ctx context.Context, envelopeID string) ([]byte, error)
+	// ParseWebhook authenticates a webhook delivery and returns its event
+	ParseWebhook(r *http.Request, body []byte) (SignatureEvent, error)
+}
+
+var ErrInvalidWebhookSignature = errors.New("invalid webhook signature")
+
+var signatureProvider SignatureProvider
+
+// newSignatureProvider returns the provider selected by ESIGNATURE_PROVIDER.
+// "none" (the default) disables e-signature.
+func newSignatureProvider(name string) SignatureProvider {
+	switch name {
+	case "", "none":
+		return nil
+	case "docusign":
+		return newDocuSignProvider()
+	default:
+		logger.Fatal("unsupported e-signature provider", zap.String("provider", name))
+		return nil
+	}
+}
+
+// SignatureEnvelope is a document out for signature with the customer. Once
+// signed, the executed copy is stored as a customer document.
+type SignatureEnvelope struct {
+	ID               int    `json:"id"`
+	CustomerID       int    `json:"customer_id"`
+	AccountID        int    `json:"account_id"`
+	DocumentType     string `json:"document_type"` // loan_agreement or direct_debit_mandate
+	Provider         string `json:"provider"`
+	EnvelopeID       string `json:"envelope_id"`
+	Status           string `json:"status"` // sent, delivered, completed, declined or voided
+	SignerName       string `json:"signer_name"`
+	SignerEmail      string `json:"signer_email"`
+	SignedDocumentID int    `json:"signed_document_id,omitempty"`
+	RequestedBy      string `json:"requested_by"`
+	CreatedAt        string `json:"created_at"`
+	UpdatedAt        string `json:"updated_at"`
+	CompletedAt      string `json:"completed_at,omitempty"`
+}
+
+// CustomerDocument is an executed document kept against the customer
+type CustomerDocument struct {
+	ID           int    `json:"id"`
+	CustomerID   int    `json:"customer_id"`
+	AccountID    int    `json:"account_id,omitempty"`
+	DocumentType string `json:"document_type"`
+	Filename     string `json:"filename"`
+	ContentType  string `json:"content_type"`
+	SizeBytes    int    `json:"size_bytes"`
+	EnvelopeID   int    `json:"envelope_id,omitempty"`
+	DownloadURL  string `json:"download_url"`
+	CreatedAt    string `json:"created_at"`
+}
+
+const esignatureTablesSQL = `
+	CREATE TABLE IF NOT EXISTS customer_documents (
+		id SERIAL PRIMARY KEY,
+		customer_id INTEGER NOT NULL,
+		account_id INTEGER REFERENCES accounts(id),
+		document_type VARCHAR(30) NOT NULL,
+		filename VARCHAR(255) NOT NULL,
+		content_type VARCHAR(100) NOT NULL,
+		size_bytes INTEGER NOT NULL,
+		object_key VARCHAR(255) NOT NULL,
+		created_at TIMESTAMP NOT NULL DEFAULT NOW()
+	);
+	CREATE INDEX IF NOT EXISTS idx_customer_documents_customer ON customer_documents(customer_id);
+	CREATE TABLE IF NOT EXISTS signature_envelopes (
+		id SERIAL PRIMARY KEY,
+		customer_id INTEGER NOT NULL,
+		account_id INTEGER NOT NULL REFERENCES accounts(id),
+		document_type VARCHAR(30) NOT NULL,
+		provider VARCHAR(20) NOT NULL,
+		envelope_id VARCHAR(100) NOT NULL,
+		status VARCHAR(20) NOT NULL DEFAULT 'sent',
+		signer_name VARCHAR(255) NOT NULL,
+		signer_email VARCHAR(255) NOT NULL,
+		signed_document_id INTEGER REFERENCES customer_documents(id),
+		requested_by VARCHAR(100) NOT NULL,
+		created_at TIMESTAMP NOT NULL DEFAULT NOW(),
+		updated_at TIMESTAMP NOT NULL DEFAULT NOW(),
+		completed_at TIMESTAMP,
+		UNIQUE (provider, envelope_id)
+	);
+	CREATE UNIQUE INDEX IF NOT EXISTS idx_signature_envelopes_open ON signature_envelopes(account_id, document_type)
+		WHERE status IN ('sent', 'delivered');`
+
+// esignatureRoles may send documents for signature
+var esignatureRoles = []string{"loan_officer", "payments_ops", "admin"}
+
+// finalSignatureStatuses are not changed by later webhook deliveries
+var finalSignatureStatuses = map[string]bool{"completed": true, "declined": true, "voided": true}
+
+const signatureEnvelopeColumns = `id, customer_id, account_id, document_type, provider, envelope_id, status, signer_name,
+	signer_email, COALESCE(signed_document_id, 0), requested_by, created_at, updated_at, COALESCE(completed_at::text, '')`
+
+func scanSignatureEnvelope(row interface{ Scan(...interface{}) error }, e *SignatureEnvelope) error {
+	return row.Scan(&e.ID, &e.CustomerID, &e.AccountID, &e.DocumentType, &e.Provider, &e.EnvelopeID, &e.Status,
+		&e.SignerName, &e.SignerEmail, &e.SignedDocumentID, &e.RequestedBy, &e.CreatedAt, &e.UpdatedAt, &e.CompletedAt)
+}
+
+// loanAgreementDocument renders the loan's terms and repayment schedule
+func loanAgreementDocument(ctx context.Context, accountID int, signerName string) ([]byte, error) {
+	var l Loan
+	err := scanLoan(db.QueryRowContext(ctx, `SELECT `+loanColumns+` FROM loans WHERE account_id = $1`, accountID), &l)
+	if err != nil {
+		return nil, err
+	}
+	l.Schedule, err = loadInstallments(ctx, accountID)
+	if err != nil {
+		return nil, err
+	}
+
+	lines := []string{
+		fmt.Sprintf("Borrower: %s", signerName),
+		fmt.Sprintf("Loan account: %d", l.AccountID),
+		fmt.Sprintf("Principal: %s", l.Principal),
+		fmt.Sprintf("Term: %d months from %s", l.TermMonths, l.StartDate),
+		"",
+		"Repayment schedule",
+	}
+	for _, i := range l.Schedule {
+		lines = append(lines, fmt.Sprintf("%3d  %s  %10s  rate %.2f%%", i.Number, i.DueDate, i.Payment, i.Rate))
+	}
+	lines = append(lines, "", "The borrower agrees to repay the loan on the terms above.", "", "Signature:")
+	return renderTextPDF("Loan Agreement", lines), nil
+}
+
+// mandateDocument renders a direct debit mandate for the account
+func mandateDocument(accountID int, signerName, creditor, reference string) []byte {
+	return renderTextPDF("Direct Debit Mandate", []string{
+		fmt.Sprintf("Account holder: %s", signerName),
+		fmt.Sprintf("Account: %d", accountID),
+		fmt.Sprintf("Creditor: %s", creditor),
+		fmt.Sprintf("Mandate reference: %s", reference),
+		"",
+		"I authorise the creditor to collect payments from this account by direct debit.",
+		"",
+		"Signature:",
+	})
+}
+
+// createSignatureEnvelope sends a loan agreement or direct debit mandate for
+// the account to the signer. Only one envelope per account and document type
+// may be awaiting signature.
+func createSignatureEnvelope(w http.ResponseWriter, r *http.Request) {
+	if !requireRole(w, r, esignatureRoles...) {
+		return
+	}
+	if signatureProvider == nil {
+		http.Error(w, "E-signature is not configured", http.StatusServiceUnavailable)
+		return
+	}
+	accountID, err := strconv.Atoi(mux.Vars(r)["id"])
+	if err != nil {
+		http.Error(w, "Invalid account ID", http.StatusBadRequest)
+		return
+	}
+
+	var requestBody struct {
+		DocumentType string `json:"document_type"`
+		SignerName   string `json:"signer_name"`
+		SignerEmail  string `json:"signer_email"`
+		Creditor     string `json:"creditor"`
+		Reference    string `json:"reference"`
+	}
+	err = json.NewDecoder(r.Body).Decode(&requestBody)
+	if err != nil {
+		http.Error(w, "Invalid request body", http.StatusBadRequest)
+		return
+	}
+	if strings.TrimSpace(requestBody.SignerName) == "" {
+		http.Error(w, "signer_name is required", http.StatusBadRequest)
+		return
+	}
+	if _, err := mail.ParseAddress(requestBody.SignerEmail); err != nil {
+		http.Error(w, "signer_email must be a valid email address", http.StatusBadRequest)
+		return
+	}
+
+	var customerID int
+	err = db.QueryRowContext(r.Context(), "SELECT customer_id FROM accounts WHERE id = $1", accountID).Scan(&customerID)
+	if err == sql.ErrNoRows {
+		http.Error(w, "Account not found", http.StatusNotFound)
+		return
+	}
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	req := SignatureRequest{
+		SignerName:  requestBody.SignerName,
+		SignerEmail: requestBody.SignerEmail,
+		CallbackURL: getEnv("PUBLIC_BASE_URL", "http://localhost:8080") + "/v1/esignature/webhook",
+	}
+	switch requestBody.DocumentType {
+	case "loan_agreement":
+		req.Subject = "Please sign your loan agreement"
+		req.DocumentName = fmt.Sprintf("loan-agreement-%d.pdf", accountID)
+		req.Document, err = loanAgreementDocument(r.Context(), accountID, requestBody.SignerName)
+		if err == sql.ErrNoRows {
+			http.Error(w, "Loan not found", http.StatusNotFound)
+			return
+		}
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+	case "direct_debit_mandate":
+		if requestBody.Creditor == "" || requestBody.Reference == "" {
+			http.Error(w, "creditor and reference are required for a mandate", http.StatusBadRequest)
+			return
+		}
+		req.Subject = "Please sign your direct debit mandate"
+		req.DocumentName = fmt.Sprintf("mandate-%s.pdf", requestBody.Reference)
+		req.Document = mandateDocument(accountID, requestBody.SignerName, requestBody.Creditor, requestBody.Reference)
+	default:
+		http.Error(w, "document_type must be loan_agreement or direct_debit_mandate", http.StatusBadRequest)
+		return
+	}
+
+	var pending bool
+	err = db.QueryRowContext(r.Context(), `SELECT EXISTS (SELECT 1 FROM signature_envelopes WHERE account_id = $1
+											AND document_type = $2 AND status IN ('sent', 'delivered'))`,
+		accountID, requestBody.DocumentType).Scan(&pending)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	if pending {
+		http.Error(w, "A document of this type is already awaiting signature", http.StatusConflict)
+		return
+	}
+
+	envelopeID, err := signatureProvider.CreateEnvelope(r.Context(), req)
+	if err != nil {
+		servicekit.RequestLogger(r.Context()).Error("failed to create signature envelope", zap.String("provider", signatureProvider.Name()), zap.Error(err))
+		http.Error(w, "E-signature provider is unavailable", http.StatusBadGateway)
+		return
+	}
+
+	var e SignatureEnvelope
+	err = scanSignatureEnvelope(db.QueryRowContext(r.Context(), `INSERT INTO signature_envelopes (customer_id, account_id,
+									  document_type, provider, envelope_id, signer_name, signer_email, requested_by)
+									  VALUES ($1, $2, $3, $4, $5, $6, $7, $8) RETURNING `+signatureEnvelopeColumns,
+		customerID, accountID, requestBody.DocumentType, signatureProvider.Name(), envelopeID, requestBody.SignerName,
+		requestBody.SignerEmail, requestActor(r)), &e)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusCreated)
+	json.NewEncoder(w).Encode(e)
+}
+
+func listSignatureEnvelopes(w http.ResponseWriter, r *http.Request) {
+	rows, err := db.QueryContext(r.Context(), `SELECT `+signatureEnvelopeColumns+` FROM signature_envelopes
+											   WHERE account_id = $1 ORDER BY id DESC`, mux.Vars(r)["id"])
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	defer rows.Close()
+
+	envelopes := []SignatureEnvelope{}
+	for rows.Next() {
+		var e SignatureEnvelope
+		if err := scanSignatureEnvelope(rows, &e); err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		envelopes = append(envelopes, e)
+	}
+	if err := rows.Err(); err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(envelopes)
+}
+
+func getSignatureEnvelope(w http.ResponseWriter, r *http.Request) {
+	var e SignatureEnvelope
+	err := scanSignatureEnvelope(db.QueryRowContext(r.Context(), `SELECT `+signatureEnvelopeColumns+`
+									  FROM signature_envelopes WHERE id = $1`, mux.Vars(r)["id"]), &e)
+	if err == sql.ErrNoRows {
+		http.Error(w, "Envelope not found", http.StatusNotFound)
+		return
+	}
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(e)
+}
+
+// receiveSignatureWebhook applies a provider status change. On completion the
+// executed document is downloaded and stored before the envelope is marked
+// completed, so a failed download is retried by the provider's redelivery.
+func receiveSignatureWebhook(w http.ResponseWriter, r *http.Request) {
+	if signatureProvider == nil {
+		http.Error(w, "E-signature is not configured", http.StatusServiceUnavailable)
+		return
+	}
+	body, err := io.ReadAll(io.LimitReader(r.Body, 1<<20))
+	if err != nil {
+		http.Error(w, "Invalid request body", http.StatusBadRequest)
+		return
+	}
+	event, err := signatureProvider.ParseWebhook(r, body)
+	if err == ErrInvalidWebhookSignature {
+		http.Error(w, "Invalid webhook signature", http.StatusUnauthorized)
+		return
+	}
+	if err != nil {
+		http.Error(w, "Invalid webhook payload", http.StatusBadRequest)
+		return
+	}
+
+	var e SignatureEnvelope
+	err = scanSignatureEnvelope(db.QueryRowContext(r.Context(), `SELECT `+signatureEnvelopeColumns+`
+									  FROM signature_envelopes WHERE provider = $1 AND envelope_id = $2`,
+		signatureProvider.Name(), event.EnvelopeID), &e)
+	if err == sql.ErrNoRows {
+		// Not one of ours; acknowledge so the provider stops retrying
+		w.WriteHeader(http.StatusOK)
+		return
+	}
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	if finalSignatureStatuses[e.Status] || event.Status == e.Status || event.Status == "" {
+		w.WriteHeader(http.StatusOK)
+		return
+	}
+
+	if event.Status != "completed" {
+		_, err = db.ExecContext(r.Context(), `UPDATE signature_envelopes SET status = $2, updated_at = NOW()
+											  WHERE id = $1 AND status NOT IN ('completed', 'declined', 'voided')`, e.ID, event.Status)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		w.WriteHeader(http.StatusOK)
+		return
+	}
+
+	if err := storeSignedDocument(r.Context(), e); err != nil {
+		servicekit.RequestLogger(r.Context()).Error("failed to store signed document", zap.Int("envelope_id", e.ID), zap.Error(err))
+		http.Error(w, "Failed to store signed document", http.StatusInternalServerError)
+		return
+	}
+	w.WriteHeader(http.StatusOK)
+}
+
+// storeSignedDocument downloads the executed document, files it against the
+// customer and completes the envelope
+func storeSignedDocument(ctx context.Context, e SignatureEnvelope) error {
+	data, err := signatureProvider.DownloadSigned(ctx, e.EnvelopeID)
+	if err != nil {
+		return err
+	}
+	key := fmt.Sprintf("customers/%d/signed/%d.pdf", e.CustomerID, e.ID)
+	if err := objectStore.Put(ctx, key, data); err != nil {
+		return err
+	}
+
+	tx, err := db.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	var documentID int
+	err = tx.QueryRowContext(ctx, `INSERT INTO customer_documents (customer_id, account_id, document_type, filename,
+								   content_type, size_bytes, object_key) VALUES ($1, $2, $3, $4, 'application/pdf', $5, $6)
+								   RETURNING id`,
+		e.CustomerID, e.AccountID, e.DocumentType, fmt.Sprintf("%s-%d-signed.pdf", e.DocumentType, e.AccountID),
+		len(data), key).Scan(&documentID)
+	if err != nil {
+		return err
+	}
+	result, err := tx.ExecContext(ctx, `UPDATE signature_envelopes SET status = 'completed', signed_document_id = $2,
+										completed_at = NOW(), updated_at = NOW()
+										WHERE id = $1 AND status NOT IN ('completed', 'declined', 'voided')`, e.ID, documentID)
+	if err != nil {
+		return err
+	}
+	if n, _ := result.RowsAffected(); n == 0 {
+		// A concurrent delivery completed it first
+		return nil
+	}
+	return tx.Commit()
+}
+
+// listCustomerDocuments returns the customer's executed documents with signed download links
+func listCustomerDocuments(w http.ResponseWriter, r *http.Request) {
+	rows, err := db.QueryContext(r.Context(), `SELECT d.id, d.customer_id, COALESCE(d.account_id, 0), d.document_type,
+											   d.filename, d.content_type, d.size_bytes, COALESCE(e.id, 0), d.created_at
+											   FROM customer_documents d
+											   LEFT JOIN signature_envelopes e ON e.signed_document_id = d.id
+											   WHERE d.customer_id = $1 ORDER BY d.id DESC`, mux.Vars(r)["id"])
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	defer rows.Close()
+
+	documents := []CustomerDocument{}
+	for rows.Next() {
+		var d CustomerDocument
+		if err := rows.Scan(&d.ID, &d.CustomerID, &d.AccountID, &d.DocumentType, &d.Filename, &d.ContentType,
+			&d.SizeBytes, &d.EnvelopeID, &d.CreatedAt); err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		d.DownloadURL = signDownloadPath(fmt.Sprintf("/v1/customer-documents/%d/download", d.ID), attachmentLinkTTL)
+		documents = append(documents, d)
+	}
+	if err := rows.Err(); err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(documents)
+}
+
+func downloadCustomerDocument(w http.ResponseWriter, r *http.Request) {
+	if !verifyDownloadSignature(r) {
+		http.Error(w, "Invalid or expired link", http.StatusForbidden)
+		return
+	}
+
+	var filename, contentType, key string
+	err := db.QueryRowContext(r.Context(), `SELECT filename, content_type, object_key FROM customer_documents
+											WHERE id = $1`, mux.Vars(r)["id"]).Scan(&filename, &contentType, &key)
+	if err != nil {
+		if err == sql.ErrNoRows {
+			http.Error(w, "Document not found", http.StatusNotFound)
+		} else {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+		}
+		return
+	}
+
+	data, err := objectStore.Get(r.Context(), key)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", contentType)
+	w.Header().Set("Content-Disposition", fmt.Sprintf("attachment; filename=%q", filename))
+	w.Write(data)
+}
@@ -0,0 +1,666 @@
+package main
+
+import (
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gorilla/mux"
+)
+
+// Estate tracks the accounts of a deceased customer from the death report to
+// the final distribution. Reporting the death freezes every open account;
+// funds leave them only through supervised transfers to the estate account.
+type Estate struct {
+	ID              int              `json:"id"`
+	CustomerID      int              `json:"customer_id"`
+	DateOfDeath     string           `json:"date_of_death"`
+	Status          string           `json:"status"` // reported, verified or closed
+	EstateAccountID int              `json:"estate_account_id,omitempty"`
+	ReportedBy      string           `json:"reported_by"`
+	VerifiedBy      string           `json:"verified_by,omitempty"`
+	VerifiedAt      string           `json:"verified_at,omitempty"`
+	ClosedAt        string           `json:"closed_at,omitempty"`
+	CreatedAt       string           `json:"created_at"`
+	Accounts        []EstateAccount  `json:"accounts"`
+	Documents       []EstateDocument `json:"documents"`
+	Transfers       []EstateTransfer `json:"transfers"`
+}
+
+// EstateAccount is an account frozen by the estate
+type EstateAccount struct {
+	AccountID       int    `json:"account_id"`
+	AccountType     string `json:"account_type"`
+	CurrencyCode    string `json:"currency_code"`
+	BalanceAtReport Money  `json:"balance_at_report"`
+	Balance         Money  `json:"balance"`
+	Status          string `json:"status"`
+	PreviousStatus  string `json:"previous_status"`
+}
+
+// EstateDocument is executor documentation such as a death certificate or grant of probate
+type EstateDocument struct {
+	ID           int    `json:"id"`
+	DocumentType string `json:"document_type"`
+	ExecutorName string `json:"executor_name"`
+	Filename     string `json:"filename"`
+	ContentType  string `json:"content_type"`
+	SizeBytes    int    `json:"size_bytes"`
+	UploadedBy   string `json:"uploaded_by"`
+	DownloadURL  string `json:"download_url"`
+	CreatedAt    string `json:"created_at"`
+}
+
+// EstateTransfer moves funds from a frozen account to the estate account
+// once a supervisor other than the requester approves it
+type EstateTransfer struct {
+	ID            int    `json:"id"`
+	FromAccountID int    `json:"from_account_id"`
+	Amount        Money  `json:"amount"`
+	Status        string `json:"status"` // pending, completed or rejected
+	RequestedBy   string `json:"requested_by"`
+	ReviewedBy    string `json:"reviewed_by,omitempty"`
+	CreatedAt     string `json:"created_at"`
+	ResolvedAt    string `json:"resolved_at,omitempty"`
+}
+
+// EstateReport summarises an estate for probate and regulatory reporting
+type EstateReport struct {
+	Estate
+	TotalAtReport    Money  `json:"total_at_report"`
+	TotalTransferred Money  `json:"total_transferred"`
+	TotalRemaining   Money  `json:"total_remaining"`
+	GeneratedAt      string `json:"generated_at"`
+}
+
+const estateTablesSQL = `
+	CREATE TABLE IF NOT EXISTS estates (
+		id SERIAL PRIMARY KEY,
+		customer_id INTEGER NOT NULL UNIQUE,
+		date_of_death DATE NOT NULL,
+		status VARCHAR(20) NOT NULL DEFAULT 'reported',
+		estate_account_id INTEGER REFERENCES accounts(id),
+		reported_by VARCHAR(100) NOT NULL,
+		verified_by VARCHAR(100),
+		verified_at TIMESTAMP,
+		closed_at TIMESTAMP,
+		created_at TIMESTAMP NOT NULL DEFAULT NOW()
+	);
+	CREATE TABLE IF NOT EXISTS estate_accounts (
+		estate_id INTEGER NOT NULL REFERENCES estates(id),
+		account_id INTEGER NOT NULL REFERENCES accounts(id),
+		balance_at_report DECIMAL(15,2) NOT NULL,
+		previous_status VARCHAR(20) NOT NULL,
+		PRIMARY KEY (estate_id, account_id)
+	);
+	CREATE TABLE IF NOT EXISTS estate_documents (
+		id SERIAL PRIMARY KEY,
+		estate_id INTEGER NOT NULL REFERENCES estates(id),
+		document_type VARCHAR(40) NOT NULL,
+		executor_name VARCHAR(200) NOT NULL,
+		filename VARCHAR(255) NOT NULL,
+		content_type VARCHAR(100) NOT NULL,
+		size_bytes INTEGER NOT NULL,
+		object_key VARCHAR(500) NOT NULL,
+		uploaded_by VARCHAR(100) NOT NULL,
+		created_at TIMESTAMP NOT NULL DEFAULT NOW()
+	);
+	CREATE TABLE IF NOT EXISTS estate_transfers (
+		id SERIAL PRIMARY KEY,
+		estate_id INTEGER NOT NULL REFERENCES estates(id),
+		from_account_id INTEGER NOT NULL REFERENCES accounts(id),
+		amount DECIMAL(15,2) NOT NULL,
+		status VARCHAR(20) NOT NULL DEFAULT 'pending',
+		requested_by VARCHAR(100) NOT NULL,
+		reviewed_by VARCHAR(100),
+		created_at TIMESTAMP NOT NULL DEFAULT NOW(),
+		resolved_at TIMESTAMP
+	);`
+
+// estateOfficerRoles report deaths, collect documents and request transfers;
+// estateSupervisorRoles verify estates, approve transfers and close estates
+var (
+	estateOfficerRoles    = []string{"estate_officer", "estate_supervisor", "admin"}
+	estateSupervisorRoles = []string{"estate_supervisor", "admin"}
+)
+
+var estateDocumentTypes = map[string]bool{
+	"death_certificate":         true,
+	"grant_of_probate":          true,
+	"letters_of_administration": true,
+	"executor_identification":   true,
+	"will":                      true,
+}
+
+const estateColumns = `id, customer_id, date_of_death::text, status, COALESCE(estate_account_id, 0), reported_by,
+	COALESCE(verified_by, ''), COALESCE(verified_at::text, ''), COALESCE(closed_at::text, ''), created_at`
+
+func scanEstate(row interface{ Scan(...interface{}) error }, e *Estate) error {
+	return row.Scan(&e.ID, &e.CustomerID, &e.DateOfDeath, &e.Status, &e.EstateAccountID, &e.ReportedBy,
+		&e.VerifiedBy, &e.VerifiedAt, &e.ClosedAt, &e.CreatedAt)
+}
+
+// reportDeath marks the customer deceased and freezes their open accounts
+func reportDeath(w http.ResponseWriter, r *http.Request) {
+	if !requireRole(w, r, estateOfficerRoles...) {
+		return
+	}
+
+	customerID, err := strconv.Atoi(mux.Vars(r)["customerId"])
+	if err != nil {
+		http.Error(w, "Invalid customer ID", http.StatusBadRequest)
+		return
+	}
+
+	var requestBody struct {
+		DateOfDeath string `json:"date_of_death"`
+	}
+	err = json.NewDecoder(r.Body).Decode(&requestBody)
+	if err != nil {
+		http.Error(w, "Invalid request body", http.StatusBadRequest)
+		return
+	}
+	dateOfDeath, err := time.Parse("2006-01-02", requestBody.DateOfDeath)
+	if err != nil || dateOfDeath.After(time.Now()) {
+		http.Error(w, "date_of_death must be a past YYYY-MM-DD date", http.StatusBadRequest)
+		return
+	}
+
+	tx, err := db.BeginTx(r.Context(), nil)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	defer tx.Rollback()
+
+	var e Estate
+	err = scanEstate(tx.QueryRowContext(r.Context(), `INSERT INTO estates (customer_id, date_of_death, reported_by)
+								  VALUES ($1, $2, $3) ON CONFLICT (customer_id) DO NOTHING RETURNING `+estateColumns,
+		customerID, requestBody.DateOfDeath, requestActor(r)), &e)
+	if err == sql.ErrNoRows {
+		http.Error(w, "An estate already exists for this customer", http.StatusConflict)
+		return
+	}
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	_, err = tx.ExecContext(r.Context(), `INSERT INTO estate_accounts (estate_id, account_id, balance_at_report, previous_status)
+										  SELECT $1, id, balance, status FROM accounts
+										  WHERE customer_id = $2 AND status <> 'closed' FOR UPDATE`, e.ID, customerID)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	_, err = tx.ExecContext(r.Context(), `UPDATE accounts SET status = 'frozen', updated_at = NOW()
+										  WHERE id IN (SELECT account_id FROM estate_accounts WHERE estate_id = $1)`, e.ID)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	err = tx.Commit()
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	writeEstate(w, r, strconv.Itoa(e.ID), http.StatusCreated)
+}
+
+func getEstate(w http.ResponseWriter, r *http.Request) {
+	writeEstate(w, r, mux.Vars(r)["id"], http.StatusOK)
+}
+
+func writeEstate(w http.ResponseWriter, r *http.Request, id string, status int) {
+	e, err := loadEstate(r, id)
+	if err != nil {
+		if err == sql.ErrNoRows {
+			http.Error(w, "Estate not found", http.StatusNotFound)
+		} else {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+		}
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(e)
+}
+
+// loadEstate reads an estate with its accounts, documents and transfers
+func loadEstate(r *http.Request, id string) (Estate, error) {
+	var e Estate
+	ctx := r.Context()
+	err := scanEstate(db.QueryRowContext(ctx, `SELECT `+estateColumns+` FROM estates WHERE id = $1`, id), &e)
+	if err != nil {
+		return e, err
+	}
+
+	e.Accounts = []EstateAccount{}
+	rows, err := db.QueryContext(ctx, `SELECT a.id, a.account_type, a.currency_code, ea.balance_at_report, a.balance,
+									   a.status, ea.previous_status
+									   FROM estate_accounts ea JOIN accounts a ON a.id = ea.account_id
+									   WHERE ea.estate_id = $1 ORDER BY a.id`, e.ID)
+	if err != nil {
+		return e, err
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var a EstateAccount
+		if err := rows.Scan(&a.AccountID, &a.AccountType, &a.CurrencyCode, &a.BalanceAtReport, &a.Balance, &a.Status,
+			&a.PreviousStatus); err != nil {
+			return e, err
+		}
+		e.Accounts = append(e.Accounts, a)
+	}
+	if err := rows.Err(); err != nil {
+		return e, err
+	}
+
+	e.Documents = []EstateDocument{}
+	docs, err := db.QueryContext(ctx, `SELECT id, document_type, executor_name, filename, content_type, size_bytes,
+									   uploaded_by, created_at FROM estate_documents WHERE estate_id = $1 ORDER BY id`, e.ID)
+	if err != nil {
+		return e, err
+	}
+	defer docs.Close()
+	for docs.Next() {
+		var d EstateDocument
+		if err := docs.Scan(&d.ID, &d.DocumentType, &d.ExecutorName, &d.Filename, &d.ContentType, &d.SizeBytes,
+			&d.UploadedBy, &d.CreatedAt); err != nil {
+			return e, err
+		}
+		d.DownloadURL = signDownloadPath(fmt.Sprintf("/v1/estate-documents/%d/download", d.ID), attachmentLinkTTL)
+		e.Documents = append(e.Documents, d)
+	}
+	if err := docs.Err(); err != nil {
+		return e, err
+	}
+
+	e.Transfers = []EstateTransfer{}
+	transfers, err := db.QueryContext(ctx, `SELECT id, from_account_id, amount, status, requested_by,
+											COALESCE(reviewed_by, ''), created_at, COALESCE(resolved_at::text, '')
+											FROM estate_transfers WHERE estate_id = $1 ORDER BY id`, e.ID)
+	if err != nil {
+		return e, err
+	}
+	defer transfers.Close()
+	for transfers.Next() {
+		var t EstateTransfer
+		if err := transfers.Scan(&t.ID, &t.FromAccountID, &t.Amount, &t.Status, &t.RequestedBy, &t.ReviewedBy,
+			&t.CreatedAt, &t.ResolvedAt); err != nil {
+			return e, err
+		}
+		e.Transfers = append(e.Transfers, t)
+	}
+	return e, transfers.Err()
+}
+
+// uploadEstateDocument stores executor documentation sent as multipart field
+// "file" with "document_type" and "executor_name"
+func uploadEstateDocument(w http.ResponseWriter, r *http.Request) {
+	if !requireRole(w, r, estateOfficerRoles...) {
+		return
+	}
+
+	r.Body = http.MaxBytesReader(w, r.Body, maxAttachmentBytes+1<<20)
+	file, header, err := r.FormFile("file")
+	if err != nil {
+		http.Error(w, "A file upload is required", http.StatusBadRequest)
+		return
+	}
+	defer file.Close()
+
+	d := EstateDocument{
+		DocumentType: r.FormValue("document_type"),
+		ExecutorName: strings.TrimSpace(r.FormValue("executor_name")),
+		Filename:     filepath.Base(header.Filename),
+		UploadedBy:   requestActor(r),
+	}
+	if !estateDocumentTypes[d.DocumentType] {
+		http.Error(w, "Unsupported document_type", http.StatusBadRequest)
+		return
+	}
+	if d.ExecutorName == "" {
+		http.Error(w, "executor_name is required", http.StatusBadRequest)
+		return
+	}
+
+	data, err := io.ReadAll(io.LimitReader(file, maxAttachmentBytes+1))
+	if err != nil {
+		http.Error(w, "The uploaded file could not be read", http.StatusBadRequest)
+		return
+	}
+	if len(data) > maxAttachmentBytes {
+		http.Error(w, "Documents are limited to 10 MB", http.StatusRequestEntityTooLarge)
+		return
+	}
+	d.ContentType = http.DetectContentType(data)
+	d.SizeBytes = len(data)
+	if !attachmentContentTypes[d.ContentType] {
+		http.Error(w, "Documents must be PDF, JPEG or PNG", http.StatusUnsupportedMediaType)
+		return
+	}
+
+	estateID := mux.Vars(r)["id"]
+	key := fmt.Sprintf("estates/%s/%d", estateID, time.Now().UnixNano())
+	err = objectStore.Put(r.Context(), key, data)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	err = db.QueryRowContext(r.Context(), `INSERT INTO estate_documents (estate_id, document_type, executor_name, filename,
+											content_type, size_bytes, object_key, uploaded_by)
+											SELECT id, $2, $3, $4, $5, $6, $7, $8 FROM estates WHERE id = $1 AND status <> 'closed'
+											RETURNING id, created_at`, estateID, d.DocumentType, d.ExecutorName, d.Filename,
+		d.ContentType, d.SizeBytes, key, d.UploadedBy).Scan(&d.ID, &d.CreatedAt)
+	if err != nil {
+		objectStore.Delete(r.Context(), key)
+		if err == sql.ErrNoRows {
+			http.Error(w, "Open estate not found", http.StatusNotFound)
+		} else {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+		}
+		return
+	}
+	d.DownloadURL = signDownloadPath(fmt.Sprintf("/v1/estate-documents/%d/download", d.ID), attachmentLinkTTL)
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusCreated)
+	json.NewEncoder(w).Encode(d)
+}
+
+func downloadEstateDocument(w http.ResponseWriter, r *http.Request) {
+	if !verifyDownloadSignature(r) {
+		http.Error(w, "Invalid or expired link", http.StatusForbidden)
+		return
+	}
+
+	var filename, contentType, key string
+	err := db.QueryRowContext(r.Context(), `SELECT filename, content_type, object_key FROM estate_documents WHERE id = $1`,
+		mux.Vars(r)["id"]).Scan(&filename, &contentType, &key)
+	if err != nil {
+		if err == sql.ErrNoRows {
+			http.Error(w, "Document not found", http.StatusNotFound)
+		} else {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+		}
+		return
+	}
+
+	data, err := objectStore.Get(r.Context(), key)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", contentType)
+	w.Header().Set("Content-Disposition", fmt.Sprintf("attachment; filename=%q", filename))
+	w.Write(data)
+}
+
+// verifyEstate confirms the executor documentation and designates the estate
+// account that frozen funds may be transferred to
+func verifyEstate(w http.ResponseWriter, r *http.Request) {
+	if !requireRole(w, r, estateSupervisorRoles...) {
+		return
+	}
+
+	var requestBody struct {
+		EstateAccountID int `json:"estate_account_id"`
+	}
+	err := json.NewDecoder(r.Body).Decode(&requestBody)
+	if err != nil {
+		http.Error(w, "Invalid request body", http.StatusBadRequest)
+		return
+	}
+
+	id := mux.Vars(r)["id"]
+	var hasCertificate, hasAuthority bool
+	err = db.QueryRowContext(r.Context(), `SELECT
+										   COALESCE(BOOL_OR(document_type = 'death_certificate'), false),
+										   COALESCE(BOOL_OR(document_type IN ('grant_of_probate', 'letters_of_administration')), false)
+										   FROM estate_documents WHERE estate_id = $1`, id).Scan(&hasCertificate, &hasAuthority)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	if !hasCertificate || !hasAuthority {
+		http.Error(w, "A death certificate and a grant of probate or letters of administration are required", http.StatusConflict)
+		return
+	}
+
+	// The estate account must be an active account outside the frozen estate
+	result, err := db.ExecContext(r.Context(), `UPDATE estates SET status = 'verified', estate_account_id = $2,
+												verified_by = $3, verified_at = NOW()
+												WHERE id = $1 AND status = 'reported'
+												AND EXISTS (SELECT 1 FROM accounts WHERE id = $2 AND status = 'active')
+												AND NOT EXISTS (SELECT 1 FROM estate_accounts WHERE estate_id = $1 AND account_id = $2)`,
+		id, requestBody.EstateAccountID, requestActor(r))
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	if n, _ := result.RowsAffected(); n == 0 {
+		http.Error(w, "Estate must be awaiting verification and estate_account_id an active account outside the estate", http.StatusConflict)
+		return
+	}
+
+	writeEstate(w, r, id, http.StatusOK)
+}
+
+// requestEstateTransfer asks for funds to move from a frozen account to the estate account
+func requestEstateTransfer(w http.ResponseWriter, r *http.Request) {
+	if !requireRole(w, r, estateOfficerRoles...) {
+		return
+	}
+
+	var t EstateTransfer
+	err := json.NewDecoder(r.Body).Decode(&t)
+	if err != nil {
+		http.Error(w, "Invalid request body", http.StatusBadRequest)
+		return
+	}
+	if t.Amount <= 0 {
+		http.Error(w, "Amount must be positive", http.StatusBadRequest)
+		return
+	}
+
+	t.RequestedBy = requestActor(r)
+	err = db.QueryRowContext(r.Context(), `INSERT INTO estate_transfers (estate_id, from_account_id, amount, requested_by)
+										   SELECT e.id, ea.account_id, $3, $4 FROM estates e
+										   JOIN estate_accounts ea ON ea.estate_id = e.id AND ea.account_id = $2
+										   WHERE e.id = $1 AND e.status = 'verified'
+										   RETURNING id, status, created_at`,
+		mux.Vars(r)["id"], t.FromAccountID, t.Amount, t.RequestedBy).Scan(&t.ID, &t.Status, &t.CreatedAt)
+	if err != nil {
+		if err == sql.ErrNoRows {
+			http.Error(w, "The estate must be verified and from_account_id one of its accounts", http.StatusConflict)
+		} else {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+		}
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusCreated)
+	json.NewEncoder(w).Encode(t)
+}
+
+func approveEstateTransfer(w http.ResponseWriter, r *http.Request) {
+	reviewEstateTransfer(w, r, true)
+}
+
+func rejectEstateTransfer(w http.ResponseWriter, r *http.Request) {
+	reviewEstateTransfer(w, r, false)
+}
+
+// reviewEstateTransfer completes or rejects a pending transfer. The reviewer
+// must be a supervisor other than the requester, and approving releases the
+// funds only with the approve-wires privilege.
+func reviewEstateTransfer(w http.ResponseWriter, r *http.Request, approve bool) {
+	if !requireRole(w, r, estateSupervisorRoles...) {
+		return
+	}
+	if approve && !requirePrivilege(w, r, privilegeApproveWires) {
+		return
+	}
+
+	tx, err := db.BeginTx(r.Context(), nil)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	defer tx.Rollback()
+
+	var t EstateTransfer
+	var estateAccountID int
+	err = tx.QueryRowContext(r.Context(), `SELECT t.id, t.from_account_id, t.amount, t.status, t.requested_by, t.created_at,
+										   e.estate_account_id
+										   FROM estate_transfers t JOIN estates e ON e.id = t.estate_id
+										   WHERE t.id = $1 FOR UPDATE OF t`, mux.Vars(r)["id"]).Scan(&t.ID, &t.FromAccountID,
+		&t.Amount, &t.Status, &t.RequestedBy, &t.CreatedAt, &estateAccountID)
+	if err != nil {
+		if err == sql.ErrNoRows {
+			http.Error(w, "Estate transfer not found", http.StatusNotFound)
+		} else {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+		}
+		return
+	}
+	if t.Status != "pending" {
+		http.Error(w, fmt.Sprintf("Estate transfer is already %s", t.Status), http.StatusConflict)
+		return
+	}
+	if !enforceMakerChecker(w, r, "estate_transfer.review", fmt.Sprintf("estate_transfer:%d", t.ID), t.FromAccountID,
+		map[string]string{"estate_transfer.request": t.RequestedBy}) {
+		return
+	}
+	t.ReviewedBy = requestActor(r)
+
+	t.Status = "rejected"
+	if approve {
+		t.Status = "completed"
+		err = transferFunds(r.Context(), tx, t.FromAccountID, estateAccountID, t.Amount,
+			fmt.Sprintf("Estate transfer %d", t.ID), "frozen")
+		if err != nil {
+			writeTransferError(w, err)
+			return
+		}
+	}
+
+	err = tx.QueryRowContext(r.Context(), `UPDATE estate_transfers SET status = $2, reviewed_by = $3, resolved_at = NOW()
+										   WHERE id = $1 RETURNING resolved_at::text`, t.ID, t.Status, t.ReviewedBy).Scan(&t.ResolvedAt)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	err = tx.Commit()
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(t)
+}
+
+// closeEstate closes the frozen accounts once they are fully distributed
+func closeEstate(w http.ResponseWriter, r *http.Request) {
+	if !requireRole(w, r, estateSupervisorRoles...) {
+		return
+	}
+
+	tx, err := db.BeginTx(r.Context(), nil)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	defer tx.Rollback()
+
+	id := mux.Vars(r)["id"]
+	var status string
+	var remaining Money
+	var pending int
+	err = tx.QueryRowContext(r.Context(), `SELECT e.status,
+										   (SELECT COALESCE(SUM(a.balance), 0) FROM estate_accounts ea
+											JOIN accounts a ON a.id = ea.account_id WHERE ea.estate_id = e.id),
+										   (SELECT COUNT(*) FROM estate_transfers WHERE estate_id = e.id AND status = 'pending')
+										   FROM estates e WHERE e.id = $1 FOR UPDATE OF e`, id).Scan(&status, &remaining, &pending)
+	if err != nil {
+		if err == sql.ErrNoRows {
+			http.Error(w, "Estate not found", http.StatusNotFound)
+		} else {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+		}
+		return
+	}
+	if status != "verified" {
+		http.Error(w, "Only a verified estate can be closed", http.StatusConflict)
+		return
+	}
+	if remaining != 0 || pending > 0 {
+		http.Error(w, "All estate accounts must be empty with no pending transfers", http.StatusConflict)
+		return
+	}
+
+	_, err = tx.ExecContext(r.Context(), `UPDATE accounts SET status = 'closed', updated_at = NOW()
+										  WHERE id IN (SELECT account_id FROM estate_accounts WHERE estate_id = $1)`, id)
+	if err == nil {
+		_, err = tx.ExecContext(r.Context(), `UPDATE estates SET status = 'closed', closed_at = NOW() WHERE id = $1`, id)
+	}
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	err = tx.Commit()
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	writeEstate(w, r, id, http.StatusOK)
+}
+
+// getEstateReport returns the estate with balances at the death report, the
+// amounts transferred to the estate account and what remains
+func getEstateReport(w http.ResponseWriter, r *http.Request) {
+	if !requireRole(w, r, estateOfficerRoles...) {
+		return
+	}
+
+	e, err := loadEstate(r, mux.Vars(r)["id"])
+	if err != nil {
+		if err == sql.ErrNoRows {
+			http.Error(w, "Estate not found", http.StatusNotFound)
+		} else {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+		}
+		return
+	}
+
+	report := EstateReport{Estate: e, GeneratedAt: time.Now().UTC().Format(time.RFC3339)}
+	for _, a := range e.Accounts {
+		report.TotalAtReport += a.BalanceAtReport
+		report.TotalRemaining += a.Balance
+	}
+	for _, t := range e.Transfers {
+		if t.Status == "completed" {
+			report.TotalTransferred += t.Amount
+		}
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(report)
+}
@@ -0,0 +1,344 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"database/sql"
+	"encoding/csv"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strconv"
+	"time"
+
+	"bank/servicekit"
+
+	"github.com/gorilla/mux"
+	"go.uber.org/zap"
+)
+
+// ExportJob is an asynchronous data export requested by a customer
+type ExportJob struct {
+	ID          int    `json:"id"`
+	AccountID   int    `json:"account_id"`
+	ExportType  string `json:"export_type"`
+	Format      string `json:"format"`
+	Status      string `json:"status"`
+	Error       string `json:"error,omitempty"`
+	NotifyEmail string `json:"notify_email,omitempty"`
+	ObjectKey   string `json:"-"`
+	DownloadURL string `json:"download_url,omitempty"`
+	CreatedAt   string `json:"created_at"`
+	CompletedAt string `json:"completed_at,omitempty"`
+}
+
+const exportTablesSQL = `
+	CREATE TABLE IF NOT EXISTS export_jobs (
+		id SERIAL PRIMARY KEY,
+		account_id INTEGER NOT NULL REFERENCES accounts(id),
+		export_type VARCHAR(30) NOT NULL,
+		format VARCHAR(10) NOT NULL DEFAULT 'csv',
+		status VARCHAR(20) NOT NULL DEFAULT 'pending',
+		error TEXT NOT NULL DEFAULT '',
+		notify_email VARCHAR(100) NOT NULL DEFAULT '',
+		object_key VARCHAR(255) NOT NULL DEFAULT '',
+		created_at TIMESTAMP NOT NULL DEFAULT NOW(),
+		completed_at TIMESTAMP
+	);`
+
+// exportLinkTTL is how long an export download link stays valid
+const exportLinkTTL = 24 * time.Hour
+
+var exportTypes = map[string]bool{
+	"transactions": true,
+	"account":      true,
+}
+
+var exportQueue = make(chan int, 100)
+
+func requestExport(w http.ResponseWriter, r *http.Request) {
+	params := mux.Vars(r)
+	accountID, err := strconv.Atoi(params["id"])
+	if err != nil {
+		http.Error(w, "Invalid account ID", http.StatusBadRequest)
+		return
+	}
+
+	var job ExportJob
+	err = json.NewDecoder(r.Body).Decode(&job)
+	if err != nil {
+		http.Error(w, "Invalid request body", http.StatusBadRequest)
+		return
+	}
+
+	if !exportTypes[job.ExportType] {
+		http.Error(w, "export_type must be transactions or account", http.StatusBadRequest)
+		return
+	}
+	if job.Format == "" {
+		job.Format = "csv"
+	}
+	if job.Format != "csv" && job.Format != "json" {
+		http.Error(w, "format must be csv or json", http.StatusBadRequest)
+		return
+	}
+
+	query := `INSERT INTO export_jobs (account_id, export_type, format, notify_email)
+			  VALUES ($1, $2, $3, $4) RETURNING id, account_id, status, created_at`
+
+	err = db.QueryRowContext(r.Context(), query, accountID, job.ExportType, job.Format, job.NotifyEmail).Scan(&job.ID,
+		&job.AccountID, &job.Status, &job.CreatedAt)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	// The worker also picks up pending jobs on its poll, so a full queue only
+	// delays the export
+	select {
+	case exportQueue <- job.ID:
+	default:
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Location", fmt.Sprintf("/v1/exports/%d", job.ID))
+	w.WriteHeader(http.StatusAccepted)
+	json.NewEncoder(w).Encode(job)
+}
+
+func getExport(w http.ResponseWriter, r *http.Request) {
+	params := mux.Vars(r)
+
+	job, err := loadExportJob(r.Context(), params["id"])
+	if err != nil {
+		if err == sql.ErrNoRows {
+			http.Error(w, "Export not found", http.StatusNotFound)
+		} else {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+		}
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(job)
+}
+
+func listExports(w http.ResponseWriter, r *http.Request) {
+	params := mux.Vars(r)
+
+	rows, err := db.QueryContext(r.Context(), `SELECT id FROM export_jobs WHERE account_id = $1
+						   ORDER BY created_at DESC LIMIT 100`, params["id"])
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	var ids []string
+	for rows.Next() {
+		var id string
+		if err := rows.Scan(&id); err != nil {
+			rows.Close()
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		ids = append(ids, id)
+	}
+	rows.Close()
+
+	jobs := []ExportJob{}
+	for _, id := range ids {
+		job, err := loadExportJob(r.Context(), id)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		jobs = append(jobs, job)
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(jobs)
+}
+
+// downloadExport serves a completed export to holders of a valid signed link
+func downloadExport(w http.ResponseWriter, r *http.Request) {
+	if !verifyDownloadSignature(r) {
+		http.Error(w, "Invalid or expired link", http.StatusForbidden)
+		return
+	}
+
+	params := mux.Vars(r)
+	job, err := loadExportJob(r.Context(), params["id"])
+	if err != nil || job.Status != "completed" {
+		http.Error(w, "Export not found", http.StatusNotFound)
+		return
+	}
+
+	data, err := objectStore.Get(r.Context(), job.ObjectKey)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	contentType := "text/csv"
+	if job.Format == "json" {
+		contentType = "application/json"
+	}
+	w.Header().Set("Content-Type", contentType)
+	w.Header().Set("Content-Disposition", fmt.Sprintf("attachment; filename=\"export-%d.%s\"", job.ID, job.Format))
+	w.Write(data)
+}
+
+func loadExportJob(ctx context.Context, id string) (ExportJob, error) {
+	var job ExportJob
+	query := `SELECT id, account_id, export_type, format, status, error, notify_email, object_key,
+			  created_at, COALESCE(completed_at::text, '') FROM export_jobs WHERE id = $1`
+
+	err := db.QueryRowContext(ctx, query, id).Scan(&job.ID, &job.AccountID, &job.ExportType, &job.Format,
+		&job.Status, &job.Error, &job.NotifyEmail, &job.ObjectKey, &job.CreatedAt, &job.CompletedAt)
+	if err != nil {
+		return job, err
+	}
+
+	// Links are minted on every read so past exports can be re-downloaded
+	if job.Status == "completed" {
+		job.DownloadURL = signDownloadPath(fmt.Sprintf("/v1/exports/%d/download", job.ID), exportLinkTTL)
+	}
+	return job, nil
+}
+
+// startExportWorker processes queued export jobs, polling for pending jobs left
+// behind by restarts or other replicas
+func startExportWorker() {
+	go func() {
+		defer servicekit.ReportJobPanic("Export worker")
+		ticker := time.NewTicker(30 * time.Second)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-exportQueue:
+			case <-ticker.C:
+			}
+			for processNextExport(serviceContext) {
+			}
+		}
+	}()
+}
+
+// processNextExport claims one pending job and runs it. It reports whether a
+// job was found so the caller can drain the backlog.
+func processNextExport(ctx context.Context) bool {
+	var job ExportJob
+	err := db.QueryRowContext(ctx, `UPDATE export_jobs SET status = 'running'
+								   WHERE id = (SELECT id FROM export_jobs WHERE status = 'pending'
+											   ORDER BY id LIMIT 1 FOR UPDATE SKIP LOCKED)
+								   RETURNING id, account_id, export_type, format, notify_email`).Scan(&job.ID,
+		&job.AccountID, &job.ExportType, &job.Format, &job.NotifyEmail)
+	if err != nil {
+		if err != sql.ErrNoRows {
+			servicekit.RequestLogger(ctx).Error("failed to claim export job", zap.Error(err))
+		}
+		return false
+	}
+
+	data, err := buildExport(ctx, job)
+	if err == nil {
+		job.ObjectKey = fmt.Sprintf("exports/%d/%d.%s", job.AccountID, job.ID, job.Format)
+		err = objectStore.Put(ctx, job.ObjectKey, data)
+	}
+
+	if err != nil {
+		// The cause stays in the log; whoever polls the job only learns it failed
+		servicekit.RequestLogger(ctx).Error("export job failed", zap.Int("export_id", job.ID), zap.Error(err))
+		db.ExecContext(ctx, `UPDATE export_jobs SET status = 'failed', error = $1, completed_at = NOW()
+							 WHERE id = $2`, "The export could not be generated", job.ID)
+		return true
+	}
+
+	_, err = db.ExecContext(ctx, `UPDATE export_jobs SET status = 'completed', object_key = $1, completed_at = NOW()
+								  WHERE id = $2`, job.ObjectKey, job.ID)
+	if err != nil {
+		servicekit.RequestLogger(ctx).Error("failed to complete export job", zap.Int("export_id", job.ID), zap.Error(err))
+		return true
+	}
+
+	if job.NotifyEmail != "" {
+		err = sendNotification(ctx, Notification{
+			Channel:   "email",
+			Recipient: job.NotifyEmail,
+			Template:  "export_ready",
+			Data: map[string]interface{}{
+				"export_id":    job.ID,
+				"download_url": signDownloadPath(fmt.Sprintf("/v1/exports/%d/download", job.ID), exportLinkTTL),
+			},
+		})
+		if err != nil {
+			servicekit.RequestLogger(ctx).Error("failed to notify export", zap.Int("export_id", job.ID), zap.Error(err))
+		}
+	}
+	return true
+}
+
+// buildExport renders the export contents in the requested format
+func buildExport(ctx context.Context, job ExportJob) ([]byte, error) {
+	var header []string
+	var records [][]string
+	var items interface{}
+
+	switch job.ExportType {
+	case "account":
+		var a Account
+		err := db.QueryRowContext(ctx, `SELECT id, customer_id, account_type, balance, currency_code, status,
+										created_at, updated_at, COALESCE(account_number, '') FROM accounts WHERE id = $1`,
+			job.AccountID).Scan(&a.ID, &a.CustomerID, &a.AccountType, &a.Balance, &a.CurrencyCode, &a.Status,
+			&a.CreatedAt, &a.UpdatedAt, &a.AccountNumber)
+		if err != nil {
+			return nil, err
+		}
+		items = a
+		header = []string{"id", "account_number", "customer_id", "account_type", "balance", "currency_code", "status",
+			"created_at"}
+		records = append(records, []string{strconv.Itoa(a.ID), a.AccountNumber, strconv.Itoa(a.CustomerID),
+			a.AccountType, a.Balance.String(), a.CurrencyCode, a.Status, a.CreatedAt})
+
+	case "transactions":
+		req, _ := http.NewRequestWithContext(ctx, http.MethodGet, "/", nil)
+		all, err := fetchAllTransactions(req, job.AccountID)
+		if err != nil {
+			return nil, err
+		}
+		items = all
+		header = []string{"id", "transaction_type", "amount", "description", "created_at"}
+		for _, t := range all {
+			records = append(records, []string{strconv.Itoa(t.ID), t.Type,
+				t.Amount.String(), t.Description, t.CreatedAt})
+		}
+	}
+
+	if job.Format == "json" {
+		return json.Marshal(items)
+	}
+
+	var buf bytes.Buffer
+	writer := csv.NewWriter(&buf)
+	writer.Write(header)
+	writer.WriteAll(records)
+	return buf.Bytes(), writer.Error()
+}
+
+// fetchAllTransactions pages through the transaction service for every
+// transaction on the account
+func fetchAllTransactions(r *http.Request, accountID int) ([]TransactionSummary, error) {
+	var all []TransactionSummary
+	base := getEnv("TRANSACTION_SERVICE_URL", "http://localhost:8081")
+	for offset := 0; ; offset += 500 {
+		var page []TransactionSummary
+		url := fmt.Sprintf("%s/v1/accounts/%d/transactions?limit=500&offset=%d", base, accountID, offset)
+		if err := fetchJSON(r, url, &page); err != nil {
+			return nil, err
+		}
+		all = append(all, page...)
+		if len(page) < 500 {
+			return all, nil
+		}
+	}
+}
@@ -0,0 +1,147 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"strconv"
+	"strings"
+
+	"bank/servicekit"
+
+	"github.com/gorilla/mux"
+	"go.uber.org/zap"
+)
+
+// AccountFee is a fee charged to an account and posted to fee income. A fee
+// charged in error is refunded with a fee_reversal ledger adjustment.
+type AccountFee struct {
+	ID           int    `json:"id"`
+	AccountID    int    `json:"account_id"`
+	FeeType      string `json:"fee_type"`
+	Amount       Money  `json:"amount"`
+	CurrencyCode string `json:"currency_code"`
+	Description  string `json:"description,omitempty"`
+	ChargedBy    string `json:"charged_by"`
+	CreatedAt    string `json:"created_at"`
+}
+
+// feeRoles may charge fees and see the fees of every account
+var feeRoles = []string{"operations", "operations_supervisor", "admin"}
+
+var feeTypes = map[string]bool{
+	"maintenance":      true,
+	"overdraft":        true,
+	"wire_transfer":    true,
+	"card_replacement": true,
+	"statement_copy":   true,
+	"returned_payment": true,
+	"other":            true,
+}
+
+const accountFeeColumns = `id, account_id, fee_type, amount, currency_code, description, charged_by, created_at::text`
+
+func scanAccountFee(row interface{ Scan(...interface{}) error }, f *AccountFee) error {
+	return row.Scan(&f.ID, &f.AccountID, &f.FeeType, &f.Amount, &f.CurrencyCode, &f.Description, &f.ChargedBy,
+		&f.CreatedAt)
+}
+
+// chargeFee debits a fee from an active account, subject to its available
+// funds like any other debit, and posts it against fee_income
+func chargeFee(w http.ResponseWriter, r *http.Request) {
+	if !requireRole(w, r, feeRoles...) {
+		return
+	}
+
+	var f AccountFee
+	if err := json.NewDecoder(r.Body).Decode(&f); err != nil {
+		http.Error(w, "Invalid request body", http.StatusBadRequest)
+		return
+	}
+	f.Description = strings.TrimSpace(f.Description)
+	if !feeTypes[f.FeeType] {
+		http.Error(w, "Unknown fee_type", http.StatusBadRequest)
+		return
+	}
+	if f.Amount <= 0 {
+		http.Error(w, "Amount must be positive", http.StatusBadRequest)
+		return
+	}
+	if f.FeeType == "other" && f.Description == "" {
+		http.Error(w, "description is required for other fees", http.StatusBadRequest)
+		return
+	}
+
+	accountID, err := strconv.Atoi(mux.Vars(r)["id"])
+	if err != nil {
+		http.Error(w, "Invalid account ID", http.StatusBadRequest)
+		return
+	}
+
+	tx, err := db.BeginTx(r.Context(), nil)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	defer tx.Rollback()
+
+	description := "Fee: " + strings.ReplaceAll(f.FeeType, "_", " ")
+	if f.Description != "" {
+		description += " - " + f.Description
+	}
+	currency, err := applyBalanceChange(r.Context(), tx, accountID, -f.Amount, description)
+	if err == nil {
+		err = recordInLedger(r.Context(), tx, LedgerPosting{Type: "fee", Amount: f.Amount, CurrencyCode: currency,
+			SourceAccountID: &accountID, GLAccount: glFeeIncome, Description: description})
+	}
+	if err != nil {
+		writeTransferError(w, err)
+		return
+	}
+
+	f.ChargedBy = requestActor(r)
+	err = scanAccountFee(tx.QueryRowContext(r.Context(), `INSERT INTO account_fees (account_id, fee_type, amount,
+									  currency_code, description, charged_by) VALUES ($1, $2, $3, $4, $5, $6)
+									  RETURNING `+accountFeeColumns,
+		accountID, f.FeeType, f.Amount, currency, f.Description, f.ChargedBy), &f)
+	if err == nil {
+		err = tx.Commit()
+	}
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	servicekit.RequestLogger(r.Context()).Info("fee charged", zap.Int("fee_id", f.ID), zap.Int("account_id", f.AccountID),
+		zap.String("fee_type", f.FeeType), zap.String("amount", f.Amount.String()), zap.String("charged_by", f.ChargedBy))
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusCreated)
+	json.NewEncoder(w).Encode(f)
+}
+
+// listFees returns an account's fees, newest first
+func listFees(w http.ResponseWriter, r *http.Request) {
+	if requestRole(r) != "customer" && !requireRole(w, r, feeRoles...) {
+		return
+	}
+
+	rows, err := db.QueryContext(r.Context(), `SELECT `+accountFeeColumns+` FROM account_fees WHERE account_id = $1
+											   ORDER BY created_at DESC, id DESC LIMIT 500`, mux.Vars(r)["id"])
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	defer rows.Close()
+
+	fees := []AccountFee{}
+	for rows.Next() {
+		var f AccountFee
+		if err := scanAccountFee(rows, &f); err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		fees = append(fees, f)
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(fees)
+}
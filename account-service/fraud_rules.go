@@ -0,0 +1,665 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"hash/fnv"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/gorilla/mux"
+)
+
+// FraudRuleset is a versioned set of fraud rules. Drafts are editable; staged
+// rulesets apply to a percentage of accounts; one ruleset is active.
+type FraudRuleset struct {
+	ID             int         `json:"id"`
+	Version        int         `json:"version"`
+	Status         string      `json:"status"` // draft, staged, active or retired
+	RolloutPercent int         `json:"rollout_percent"`
+	Rules          []FraudRule `json:"rules"`
+	CreatedAt      string      `json:"created_at"`
+	ActivatedAt    string      `json:"activated_at,omitempty"`
+}
+
+// FraudRule is one condition with the action taken when it matches
+type FraudRule struct {
+	ID            int      `json:"id"`
+	RulesetID     int      `json:"ruleset_id"`
+	Name          string   `json:"name"`
+	RuleType      string   `json:"rule_type"` // amount_threshold, velocity or category
+	Threshold     Money    `json:"threshold,omitempty"`
+	WindowMinutes int      `json:"window_minutes,omitempty"`
+	MaxCount      int      `json:"max_count,omitempty"`
+	Categories    []string `json:"categories,omitempty"`
+	Action        string   `json:"action"` // decline or flag
+	Enabled       bool     `json:"enabled"`
+}
+
+const fraudRuleTablesSQL = `
+	CREATE TABLE IF NOT EXISTS fraud_rulesets (
+		id SERIAL PRIMARY KEY,
+		version INTEGER NOT NULL UNIQUE,
+		status VARCHAR(20) NOT NULL DEFAULT 'draft',
+		rollout_percent INTEGER NOT NULL DEFAULT 0,
+		created_by VARCHAR(100) NOT NULL DEFAULT '',
+		created_at TIMESTAMP NOT NULL DEFAULT NOW(),
+		activated_at TIMESTAMP
+	);
+
+	CREATE TABLE IF NOT EXISTS fraud_rules (
+		id SERIAL PRIMARY KEY,
+		ruleset_id INTEGER NOT NULL REFERENCES fraud_rulesets(id) ON DELETE CASCADE,
+		name VARCHAR(100) NOT NULL,
+		rule_type VARCHAR(30) NOT NULL,
+		params JSONB NOT NULL DEFAULT '{}',
+		action VARCHAR(20) NOT NULL DEFAULT 'decline',
+		enabled BOOLEAN NOT NULL DEFAULT TRUE
+	);`
+
+// fraudRoles manage, simulate and roll out fraud rulesets
+var fraudRoles = []string{"fraud_analyst", "admin"}
+
+var fraudRuleTypes = map[string]bool{
+	"amount_threshold": true,
+	"velocity":         true,
+	"category":         true,
+}
+
+// fraudRuleParams is the JSONB representation of the type-specific fields
+type fraudRuleParams struct {
+	Threshold     Money    `json:"threshold,omitempty"`
+	WindowMinutes int      `json:"window_minutes,omitempty"`
+	MaxCount      int      `json:"max_count,omitempty"`
+	Categories    []string `json:"categories,omitempty"`
+}
+
+func (rule FraudRule) validate() error {
+	if rule.Name == "" {
+		return fmt.Errorf("Rule name is required")
+	}
+	if !fraudRuleTypes[rule.RuleType] {
+		return fmt.Errorf("rule_type must be amount_threshold, velocity or category")
+	}
+	if rule.Action != "decline" && rule.Action != "flag" {
+		return fmt.Errorf("action must be decline or flag")
+	}
+	switch rule.RuleType {
+	case "amount_threshold":
+		if rule.Threshold <= 0 {
+			return fmt.Errorf("threshold must be positive")
+		}
+	case "velocity":
+		if rule.WindowMinutes <= 0 || rule.MaxCount <= 0 {
+			return fmt.Errorf("window_minutes and max_count must be positive")
+		}
+	case "category":
+		if len(rule.Categories) == 0 {
+			return fmt.Errorf("categories are required")
+		}
+	}
+	return nil
+}
+
+func createFraudRuleset(w http.ResponseWriter, r *http.Request) {
+	if !requireRole(w, r, fraudRoles...) {
+		return
+	}
+
+	var requestBody struct {
+		CloneFrom int `json:"clone_from"`
+	}
+	// An empty body creates an empty draft
+	json.NewDecoder(r.Body).Decode(&requestBody)
+
+	tx, err := db.BeginTx(r.Context(), nil)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	defer tx.Rollback()
+
+	var rs FraudRuleset
+	err = tx.QueryRowContext(r.Context(), `INSERT INTO fraud_rulesets (version, created_by)
+					   SELECT COALESCE(MAX(version), 0) + 1, $1 FROM fraud_rulesets
+					   RETURNING id, version, status, rollout_percent, created_at`, requestActor(r)).Scan(&rs.ID,
+		&rs.Version, &rs.Status, &rs.RolloutPercent, &rs.CreatedAt)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	if requestBody.CloneFrom != 0 {
+		_, err = tx.ExecContext(r.Context(), `INSERT INTO fraud_rules (ruleset_id, name, rule_type, params, action, enabled)
+						  SELECT $1, name, rule_type, params, action, enabled FROM fraud_rules WHERE ruleset_id = $2`,
+			rs.ID, requestBody.CloneFrom)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+	}
+
+	err = tx.Commit()
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	rs, err = loadFraudRuleset(r.Context(), rs.ID)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusCreated)
+	json.NewEncoder(w).Encode(rs)
+}
+
+func listFraudRulesets(w http.ResponseWriter, r *http.Request) {
+	if !requireRole(w, r, fraudRoles...) {
+		return
+	}
+
+	rows, err := db.QueryContext(r.Context(), "SELECT id FROM fraud_rulesets ORDER BY version DESC")
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	var ids []int
+	for rows.Next() {
+		var id int
+		rows.Scan(&id)
+		ids = append(ids, id)
+	}
+	rows.Close()
+
+	rulesets := []FraudRuleset{}
+	for _, id := range ids {
+		rs, err := loadFraudRuleset(r.Context(), id)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		rulesets = append(rulesets, rs)
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(rulesets)
+}
+
+func getFraudRuleset(w http.ResponseWriter, r *http.Request) {
+	if !requireRole(w, r, fraudRoles...) {
+		return
+	}
+
+	params := mux.Vars(r)
+	id, _ := strconv.Atoi(params["id"])
+
+	rs, err := loadFraudRuleset(r.Context(), id)
+	if err != nil {
+		if err == sql.ErrNoRows {
+			http.Error(w, "Ruleset not found", http.StatusNotFound)
+		} else {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+		}
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(rs)
+}
+
+func createFraudRule(w http.ResponseWriter, r *http.Request) {
+	saveFraudRule(w, r, false)
+}
+
+func updateFraudRule(w http.ResponseWriter, r *http.Request) {
+	saveFraudRule(w, r, true)
+}
+
+// saveFraudRule inserts or updates a rule; only draft rulesets can be changed
+func saveFraudRule(w http.ResponseWriter, r *http.Request, update bool) {
+	if !requireRole(w, r, fraudRoles...) {
+		return
+	}
+
+	params := mux.Vars(r)
+
+	var rule FraudRule
+	rule.Enabled = true
+	err := json.NewDecoder(r.Body).Decode(&rule)
+	if err != nil {
+		http.Error(w, "Invalid request body", http.StatusBadRequest)
+		return
+	}
+	if err := rule.validate(); err != nil {
+		http.Error(w, "Invalid fraud rule", http.StatusBadRequest)
+		return
+	}
+
+	var status string
+	err = db.QueryRowContext(r.Context(), "SELECT status FROM fraud_rulesets WHERE id = $1", params["id"]).Scan(&status)
+	if err != nil {
+		if err == sql.ErrNoRows {
+			http.Error(w, "Ruleset not found", http.StatusNotFound)
+		} else {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+		}
+		return
+	}
+	if status != "draft" {
+		http.Error(w, "Only draft rulesets can be modified", http.StatusConflict)
+		return
+	}
+
+	ruleParams, _ := json.Marshal(fraudRuleParams{
+		Threshold:     rule.Threshold,
+		WindowMinutes: rule.WindowMinutes,
+		MaxCount:      rule.MaxCount,
+		Categories:    rule.Categories,
+	})
+
+	if update {
+		err = db.QueryRowContext(r.Context(), `UPDATE fraud_rules SET name = $1, rule_type = $2, params = $3, action = $4, enabled = $5
+						   WHERE id = $6 AND ruleset_id = $7 RETURNING id, ruleset_id`,
+			rule.Name, rule.RuleType, string(ruleParams), rule.Action, rule.Enabled,
+			params["ruleId"], params["id"]).Scan(&rule.ID, &rule.RulesetID)
+	} else {
+		err = db.QueryRowContext(r.Context(), `INSERT INTO fraud_rules (ruleset_id, name, rule_type, params, action, enabled)
+						   VALUES ($1, $2, $3, $4, $5, $6) RETURNING id, ruleset_id`,
+			params["id"], rule.Name, rule.RuleType, string(ruleParams), rule.Action, rule.Enabled).Scan(&rule.ID, &rule.RulesetID)
+	}
+	if err != nil {
+		if err == sql.ErrNoRows {
+			http.Error(w, "Rule not found", http.StatusNotFound)
+		} else {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+		}
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	if !update {
+		w.WriteHeader(http.StatusCreated)
+	}
+	json.NewEncoder(w).Encode(rule)
+}
+
+func deleteFraudRule(w http.ResponseWriter, r *http.Request) {
+	if !requireRole(w, r, fraudRoles...) {
+		return
+	}
+
+	params := mux.Vars(r)
+
+	result, err := db.ExecContext(r.Context(), `DELETE FROM fraud_rules WHERE id = $1 AND ruleset_id = $2
+							AND ruleset_id IN (SELECT id FROM fraud_rulesets WHERE status = 'draft')`,
+		params["ruleId"], params["id"])
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	if n, _ := result.RowsAffected(); n == 0 {
+		http.Error(w, "Draft rule not found", http.StatusNotFound)
+		return
+	}
+
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// rolloutFraudRuleset stages a ruleset for a percentage of accounts. At 100
+// percent it becomes the active ruleset and the previous one is retired.
+func rolloutFraudRuleset(w http.ResponseWriter, r *http.Request) {
+	if !requireRole(w, r, fraudRoles...) {
+		return
+	}
+
+	params := mux.Vars(r)
+
+	var requestBody struct {
+		Percent int `json:"percent"`
+	}
+	err := json.NewDecoder(r.Body).Decode(&requestBody)
+	if err != nil {
+		http.Error(w, "Invalid request body", http.StatusBadRequest)
+		return
+	}
+	if requestBody.Percent < 1 || requestBody.Percent > 100 {
+		http.Error(w, "percent must be between 1 and 100", http.StatusBadRequest)
+		return
+	}
+
+	tx, err := db.BeginTx(r.Context(), nil)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	defer tx.Rollback()
+
+	var status string
+	err = tx.QueryRowContext(r.Context(), "SELECT status FROM fraud_rulesets WHERE id = $1 FOR UPDATE", params["id"]).Scan(&status)
+	if err != nil {
+		if err == sql.ErrNoRows {
+			http.Error(w, "Ruleset not found", http.StatusNotFound)
+		} else {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+		}
+		return
+	}
+	if status != "draft" && status != "staged" {
+		http.Error(w, "Only draft or staged rulesets can be rolled out", http.StatusConflict)
+		return
+	}
+
+	// Only one ruleset is staged at a time
+	_, err = tx.ExecContext(r.Context(), `UPDATE fraud_rulesets SET status = 'draft', rollout_percent = 0
+					  WHERE status = 'staged' AND id <> $1`, params["id"])
+	if err == nil && requestBody.Percent == 100 {
+		_, err = tx.ExecContext(r.Context(), "UPDATE fraud_rulesets SET status = 'retired' WHERE status = 'active'")
+		if err == nil {
+			_, err = tx.ExecContext(r.Context(), `UPDATE fraud_rulesets SET status = 'active', rollout_percent = 100, activated_at = NOW()
+							  WHERE id = $1`, params["id"])
+		}
+	} else if err == nil {
+		_, err = tx.ExecContext(r.Context(), "UPDATE fraud_rulesets SET status = 'staged', rollout_percent = $1 WHERE id = $2",
+			requestBody.Percent, params["id"])
+	}
+	if err == nil {
+		err = tx.Commit()
+	}
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	fraudRulesCache.invalidate()
+
+	id, _ := strconv.Atoi(params["id"])
+	rs, err := loadFraudRuleset(r.Context(), id)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(rs)
+}
+
+// simulateFraudRuleset replays logged authorizations against a ruleset and
+// reports the decisions that would change
+func simulateFraudRuleset(w http.ResponseWriter, r *http.Request) {
+	if !requireRole(w, r, fraudRoles...) {
+		return
+	}
+
+	params := mux.Vars(r)
+	id, _ := strconv.Atoi(params["id"])
+
+	var requestBody struct {
+		From  string `json:"from"`
+		To    string `json:"to"`
+		Limit int    `json:"limit"`
+	}
+	err := json.NewDecoder(r.Body).Decode(&requestBody)
+	if err != nil {
+		http.Error(w, "Invalid request body", http.StatusBadRequest)
+		return
+	}
+	if requestBody.Limit <= 0 || requestBody.Limit > 10000 {
+		requestBody.Limit = 10000
+	}
+	if requestBody.To == "" {
+		requestBody.To = time.Now().UTC().Format(time.RFC3339)
+	}
+	if requestBody.From == "" {
+		requestBody.From = time.Now().UTC().AddDate(0, 0, -7).Format(time.RFC3339)
+	}
+
+	rs, err := loadFraudRuleset(r.Context(), id)
+	if err != nil {
+		if err == sql.ErrNoRows {
+			http.Error(w, "Ruleset not found", http.StatusNotFound)
+		} else {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+		}
+		return
+	}
+
+	rows, err := db.QueryContext(r.Context(), `SELECT id, account_id, channel, amount, merchant_category,
+											   approved, decline_code, created_at
+											   FROM authorization_log WHERE created_at BETWEEN $1 AND $2
+											   ORDER BY created_at LIMIT $3`,
+		requestBody.From, requestBody.To, requestBody.Limit)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	type replayed struct {
+		LogID        int
+		Request      AuthorizationRequest
+		Approved     bool
+		DeclineCode  string
+		AuthorizedAt time.Time
+	}
+	var history []replayed
+	for rows.Next() {
+		var h replayed
+		err := rows.Scan(&h.LogID, &h.Request.AccountID, &h.Request.Channel, &h.Request.Amount,
+			&h.Request.MerchantCategory, &h.Approved, &h.DeclineCode, &h.AuthorizedAt)
+		if err != nil {
+			rows.Close()
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		history = append(history, h)
+	}
+	rows.Close()
+
+	type change struct {
+		LogID       int    `json:"authorization_id"`
+		AccountID   int    `json:"account_id"`
+		WasApproved bool   `json:"was_approved"`
+		Approved    bool   `json:"approved"`
+		Rule        string `json:"rule"`
+	}
+	report := struct {
+		RulesetID    int      `json:"ruleset_id"`
+		Replayed     int      `json:"replayed"`
+		WouldDecline int      `json:"would_decline"`
+		WouldFlag    int      `json:"would_flag"`
+		NewDeclines  int      `json:"new_declines"`
+		Changes      []change `json:"changes"`
+	}{RulesetID: rs.ID, Replayed: len(history), Changes: []change{}}
+
+	for _, h := range history {
+		rule, err := evaluateFraudRules(r.Context(), rs, &h.Request, h.AuthorizedAt)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		if rule == nil {
+			continue
+		}
+		if rule.Action == "flag" {
+			report.WouldFlag++
+			continue
+		}
+		report.WouldDecline++
+		if h.Approved {
+			report.NewDeclines++
+			if len(report.Changes) < 100 {
+				report.Changes = append(report.Changes, change{LogID: h.LogID, AccountID: h.Request.AccountID,
+					WasApproved: true, Approved: false, Rule: rule.Name})
+			}
+		}
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(report)
+}
+
+func loadFraudRuleset(ctx context.Context, id int) (FraudRuleset, error) {
+	var rs FraudRuleset
+	err := db.QueryRowContext(ctx, `SELECT id, version, status, rollout_percent, created_at, COALESCE(activated_at::text, '')
+									FROM fraud_rulesets WHERE id = $1`, id).Scan(&rs.ID, &rs.Version, &rs.Status,
+		&rs.RolloutPercent, &rs.CreatedAt, &rs.ActivatedAt)
+	if err != nil {
+		return rs, err
+	}
+
+	rows, err := db.QueryContext(ctx, `SELECT id, ruleset_id, name, rule_type, params, action, enabled
+									   FROM fraud_rules WHERE ruleset_id = $1 ORDER BY id`, id)
+	if err != nil {
+		return rs, err
+	}
+	defer rows.Close()
+
+	rs.Rules = []FraudRule{}
+	for rows.Next() {
+		var rule FraudRule
+		var raw []byte
+		if err := rows.Scan(&rule.ID, &rule.RulesetID, &rule.Name, &rule.RuleType, &raw, &rule.Action, &rule.Enabled); err != nil {
+			return rs, err
+		}
+		var p fraudRuleParams
+		json.Unmarshal(raw, &p)
+		rule.Threshold, rule.WindowMinutes, rule.MaxCount, rule.Categories = p.Threshold, p.WindowMinutes, p.MaxCount, p.Categories
+		rs.Rules = append(rs.Rules, rule)
+	}
+	return rs, rows.Err()
+}
+
+// evaluateFraudRules returns the first enabled rule matching the request as of at
+func evaluateFraudRules(ctx context.Context, rs FraudRuleset, req *AuthorizationRequest, at time.Time) (*FraudRule, error) {
+	for i := range rs.Rules {
+		rule := &rs.Rules[i]
+		if !rule.Enabled {
+			continue
+		}
+
+		switch rule.RuleType {
+		case "amount_threshold":
+			if req.Amount > rule.Threshold {
+				return rule, nil
+			}
+		case "category":
+			for _, c := range rule.Categories {
+				if c == req.MerchantCategory {
+					return rule, nil
+				}
+			}
+		case "velocity":
+			var count int
+			err := db.QueryRowContext(ctx, `SELECT COUNT(*) FROM authorization_log
+											WHERE account_id = $1 AND created_at < $2
+											AND created_at >= $2 - $3 * INTERVAL '1 minute'`,
+				req.AccountID, at, rule.WindowMinutes).Scan(&count)
+			if err != nil {
+				return nil, err
+			}
+			// The current attempt counts towards the window
+			if count+1 > rule.MaxCount {
+				return rule, nil
+			}
+		}
+	}
+	return nil, nil
+}
+
+// fraudRulesCache keeps the active and staged rulesets for a short time so the
+// authorization hot path does not reload them on every request. A rollout
+// invalidates it on the replica that served it; the others pick the change up
+// within the 30 second lifetime.
+var fraudRulesCache = &rulesetCache{}
+
+type rulesetCache struct {
+	mu       sync.Mutex
+	loadedAt time.Time
+	active   *FraudRuleset
+	staged   *FraudRuleset
+}
+
+func (c *rulesetCache) invalidate() {
+	c.mu.Lock()
+	c.loadedAt = time.Time{}
+	c.mu.Unlock()
+}
+
+func (c *rulesetCache) get(ctx context.Context) (*FraudRuleset, *FraudRuleset, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if time.Since(c.loadedAt) < 30*time.Second {
+		return c.active, c.staged, nil
+	}
+
+	c.active, c.staged = nil, nil
+	rows, err := db.QueryContext(ctx, "SELECT id, status FROM fraud_rulesets WHERE status IN ('active', 'staged')")
+	if err != nil {
+		return nil, nil, err
+	}
+	var ids = map[string]int{}
+	for rows.Next() {
+		var id int
+		var status string
+		rows.Scan(&id, &status)
+		ids[status] = id
+	}
+	rows.Close()
+
+	for status, id := range ids {
+		rs, err := loadFraudRuleset(ctx, id)
+		if err != nil {
+			return nil, nil, err
+		}
+		if status == "active" {
+			c.active = &rs
+		} else {
+			c.staged = &rs
+		}
+	}
+	c.loadedAt = time.Now()
+	return c.active, c.staged, nil
+}
+
+// rolloutBucket deterministically places an account in 0-99 so staged rules
+// apply to a stable subset of accounts
+func rolloutBucket(accountID int) int {
+	h := fnv.New32a()
+	h.Write([]byte(strconv.Itoa(accountID)))
+	return int(h.Sum32() % 100)
+}
+
+// checkFraudRules applies the live ruleset: the staged ruleset for accounts in
+// its rollout percentage, the active ruleset otherwise
+func checkFraudRules(ctx context.Context, req *AuthorizationRequest) (*AuthorizationDecision, error) {
+	active, staged, err := fraudRulesCache.get(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	rs := active
+	if staged != nil && rolloutBucket(req.AccountID) < staged.RolloutPercent {
+		rs = staged
+	}
+	if rs == nil {
+		return nil, nil
+	}
+
+	rule, err := evaluateFraudRules(ctx, *rs, req, time.Now())
+	if err != nil || rule == nil {
+		return nil, err
+	}
+	if rule.Action == "flag" {
+		req.Flags = append(req.Flags, fmt.Sprintf("fraud_rule:%s", rule.Name))
+		return nil, nil
+	}
+	return decline("fraud_rule", fmt.Sprintf("Declined by fraud rule %s (v%d)", rule.Name, rs.Version)), nil
+}
@@ -0,0 +1,46 @@
+package main
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+
+	"go.uber.org/zap"
+)
+
+// fxRates holds the value of one unit of each currency in fxBaseCurrency.
+// FX_RATES lists them as "EUR=1.08,GBP=1.27"; the base currency is always 1.
+var (
+	fxBaseCurrency = "USD"
+	fxRates        = map[string]float64{}
+)
+
+func loadExchangeRates() {
+	fxBaseCurrency = strings.ToUpper(getEnv("FX_BASE_CURRENCY", "USD"))
+	fxRates = map[string]float64{fxBaseCurrency: 1}
+	for _, entry := range strings.Split(getEnv("FX_RATES", ""), ",") {
+		parts := strings.SplitN(strings.TrimSpace(entry), "=", 2)
+		if len(parts) != 2 {
+			continue
+		}
+		rate, err := strconv.ParseFloat(parts[1], 64)
+		if err != nil || rate <= 0 {
+			logger.Warn("ignoring invalid FX rate", zap.String("entry", entry))
+			continue
+		}
+		fxRates[strings.ToUpper(parts[0])] = rate
+	}
+}
+
+// convertCurrency converts amount between two currencies through the base currency
+func convertCurrency(amount Money, from, to string) (Money, error) {
+	fromRate, ok := fxRates[strings.ToUpper(from)]
+	if !ok {
+		return 0, fmt.Errorf("no exchange rate for %s", from)
+	}
+	toRate, ok := fxRates[strings.ToUpper(to)]
+	if !ok {
+		return 0, fmt.Errorf("no exchange rate for %s", to)
+	}
+	return amount.Times(fromRate / toRate), nil
+}
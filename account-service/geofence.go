@@ -0,0 +1,152 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"net/http"
+	"strings"
+
+	"github.com/gorilla/mux"
+)
+
+// GeoRule restricts where the account's cards can be used
+type GeoRule struct {
+	AccountID        int      `json:"account_id"`
+	Mode             string   `json:"mode"` // off, home_only or allow_list
+	HomeCountry      string   `json:"home_country"`
+	AllowedCountries []string `json:"allowed_countries"`
+	UpdatedAt        string   `json:"updated_at"`
+}
+
+const geoRuleTablesSQL = `
+	CREATE TABLE IF NOT EXISTS account_geo_rules (
+		account_id INTEGER PRIMARY KEY REFERENCES accounts(id),
+		mode VARCHAR(20) NOT NULL DEFAULT 'off',
+		home_country VARCHAR(2) NOT NULL,
+		allowed_countries VARCHAR(255) NOT NULL DEFAULT '',
+		updated_at TIMESTAMP NOT NULL DEFAULT NOW()
+	);`
+
+var geoRuleModes = map[string]bool{
+	"off":        true,
+	"home_only":  true,
+	"allow_list": true,
+}
+
+func getGeoRule(w http.ResponseWriter, r *http.Request) {
+	params := mux.Vars(r)
+
+	rule, err := loadGeoRule(r.Context(), params["id"])
+	if err != nil {
+		if err == sql.ErrNoRows {
+			http.Error(w, "Geo rule not found", http.StatusNotFound)
+		} else {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+		}
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(rule)
+}
+
+func setGeoRule(w http.ResponseWriter, r *http.Request) {
+	params := mux.Vars(r)
+
+	var rule GeoRule
+	err := json.NewDecoder(r.Body).Decode(&rule)
+	if err != nil {
+		http.Error(w, "Invalid request body", http.StatusBadRequest)
+		return
+	}
+
+	if !geoRuleModes[rule.Mode] {
+		http.Error(w, "mode must be off, home_only or allow_list", http.StatusBadRequest)
+		return
+	}
+	rule.HomeCountry = strings.ToUpper(strings.TrimSpace(rule.HomeCountry))
+	if !countryCodePattern.MatchString(rule.HomeCountry) {
+		http.Error(w, "home_country must be an ISO 3166-1 alpha-2 code", http.StatusBadRequest)
+		return
+	}
+	for i, c := range rule.AllowedCountries {
+		rule.AllowedCountries[i] = strings.ToUpper(strings.TrimSpace(c))
+		if !countryCodePattern.MatchString(rule.AllowedCountries[i]) {
+			http.Error(w, "allowed_countries must be ISO 3166-1 alpha-2 codes", http.StatusBadRequest)
+			return
+		}
+	}
+
+	query := `INSERT INTO account_geo_rules (account_id, mode, home_country, allowed_countries)
+			  SELECT id, $2, $3, $4 FROM accounts WHERE id = $1
+			  ON CONFLICT (account_id) DO UPDATE SET mode = EXCLUDED.mode, home_country = EXCLUDED.home_country,
+				  allowed_countries = EXCLUDED.allowed_countries, updated_at = NOW()
+			  RETURNING account_id, updated_at`
+
+	err = db.QueryRowContext(r.Context(), query, params["id"], rule.Mode, rule.HomeCountry,
+		strings.Join(rule.AllowedCountries, ",")).Scan(&rule.AccountID, &rule.UpdatedAt)
+	if err != nil {
+		if err == sql.ErrNoRows {
+			http.Error(w, "Account not found", http.StatusNotFound)
+		} else {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+		}
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(rule)
+}
+
+func loadGeoRule(ctx context.Context, accountID interface{}) (GeoRule, error) {
+	var rule GeoRule
+	var allowed string
+	err := db.QueryRowContext(ctx, `SELECT account_id, mode, home_country, allowed_countries, updated_at
+									FROM account_geo_rules WHERE account_id = $1`, accountID).Scan(&rule.AccountID,
+		&rule.Mode, &rule.HomeCountry, &allowed, &rule.UpdatedAt)
+	rule.AllowedCountries = []string{}
+	if allowed != "" {
+		rule.AllowedCountries = strings.Split(allowed, ",")
+	}
+	return rule, err
+}
+
+// checkGeofence enforces the account's geo rule on card transactions. Countries
+// outside the rule are still allowed while a travel notice covers them.
+func checkGeofence(ctx context.Context, req *AuthorizationRequest) (*AuthorizationDecision, error) {
+	if req.Channel != "card" {
+		return nil, nil
+	}
+
+	rule, err := loadGeoRule(ctx, req.AccountID)
+	if err == sql.ErrNoRows || rule.Mode == "off" {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	if req.Country == "" {
+		return decline("geo_metadata_missing", "Transaction location is required by the account's geo rule"), nil
+	}
+	if req.Country == rule.HomeCountry {
+		return nil, nil
+	}
+	if rule.Mode == "allow_list" {
+		for _, c := range rule.AllowedCountries {
+			if c == req.Country {
+				return nil, nil
+			}
+		}
+	}
+
+	covered, err := travelNoticeCovers(ctx, req.AccountID, req.Country)
+	if err != nil {
+		return nil, err
+	}
+	if covered {
+		return nil, nil
+	}
+	return decline("geo_restricted", "Card use outside the allowed countries is blocked"), nil
+}
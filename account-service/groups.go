@@ -0,0 +1,627 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+
+	"bank/servicekit"
+
+	"github.com/gorilla/mux"
+	"go.uber.org/zap"
+)
+
+// ExpenseGroup is a set of accounts sharing bills, e.g. housemates or a trip
+type ExpenseGroup struct {
+	ID           int           `json:"id"`
+	Name         string        `json:"name"`
+	CurrencyCode string        `json:"currency_code"`
+	Members      []GroupMember `json:"members"`
+	CreatedAt    string        `json:"created_at"`
+}
+
+// GroupMember is a participant identified by the account used to settle up
+type GroupMember struct {
+	AccountID   int    `json:"account_id"`
+	CustomerID  int    `json:"customer_id"`
+	DisplayName string `json:"display_name"`
+}
+
+// GroupExpense is a bill paid by one member and shared between members
+type GroupExpense struct {
+	ID          int          `json:"id"`
+	GroupID     int          `json:"group_id"`
+	PaidBy      int          `json:"paid_by_account_id"`
+	Amount      Money        `json:"amount"`
+	Description string       `json:"description"`
+	Shares      []GroupShare `json:"shares"`
+	CreatedAt   string       `json:"created_at"`
+}
+
+// GroupShare is one member's part of an expense
+type GroupShare struct {
+	AccountID int   `json:"account_id"`
+	Amount    Money `json:"amount"`
+}
+
+// GroupSettlement is a transfer that pays back what one member owes another
+type GroupSettlement struct {
+	FromAccountID int   `json:"from_account_id"`
+	ToAccountID   int   `json:"to_account_id"`
+	Amount        Money `json:"amount"`
+}
+
+const groupTablesSQL = `
+	CREATE TABLE IF NOT EXISTS expense_groups (
+		id SERIAL PRIMARY KEY,
+		name VARCHAR(100) NOT NULL,
+		currency_code VARCHAR(3) NOT NULL,
+		created_at TIMESTAMP NOT NULL DEFAULT NOW()
+	);
+	CREATE TABLE IF NOT EXISTS expense_group_members (
+		group_id INTEGER NOT NULL REFERENCES expense_groups(id),
+		account_id INTEGER NOT NULL REFERENCES accounts(id),
+		display_name VARCHAR(100) NOT NULL,
+		PRIMARY KEY (group_id, account_id)
+	);
+	CREATE TABLE IF NOT EXISTS group_expenses (
+		id SERIAL PRIMARY KEY,
+		group_id INTEGER NOT NULL REFERENCES expense_groups(id),
+		paid_by_account_id INTEGER NOT NULL,
+		amount DECIMAL(15,2) NOT NULL,
+		description VARCHAR(255) NOT NULL DEFAULT '',
+		created_at TIMESTAMP NOT NULL DEFAULT NOW()
+	);
+	CREATE TABLE IF NOT EXISTS group_expense_shares (
+		expense_id INTEGER NOT NULL REFERENCES group_expenses(id),
+		account_id INTEGER NOT NULL,
+		amount DECIMAL(15,2) NOT NULL,
+		PRIMARY KEY (expense_id, account_id)
+	);
+	CREATE TABLE IF NOT EXISTS group_settlements (
+		id SERIAL PRIMARY KEY,
+		group_id INTEGER NOT NULL REFERENCES expense_groups(id),
+		from_account_id INTEGER NOT NULL,
+		to_account_id INTEGER NOT NULL,
+		amount DECIMAL(15,2) NOT NULL,
+		created_at TIMESTAMP NOT NULL DEFAULT NOW()
+	);`
+
+func createExpenseGroup(w http.ResponseWriter, r *http.Request) {
+	var group ExpenseGroup
+	err := json.NewDecoder(r.Body).Decode(&group)
+	if err != nil {
+		http.Error(w, "Invalid request body", http.StatusBadRequest)
+		return
+	}
+
+	group.Name = strings.TrimSpace(group.Name)
+	if group.Name == "" || len(group.Name) > 100 {
+		http.Error(w, "name is required (at most 100 characters)", http.StatusBadRequest)
+		return
+	}
+	if len(group.Members) < 2 {
+		http.Error(w, "A group needs at least two members", http.StatusBadRequest)
+		return
+	}
+	// Customers may group their own account with anyone's
+	memberAccounts := make([]int, len(group.Members))
+	for i, m := range group.Members {
+		memberAccounts[i] = m.AccountID
+	}
+	if !requireOwnAccount(w, r, memberAccounts...) {
+		return
+	}
+
+	tx, err := db.BeginTx(r.Context(), nil)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	defer tx.Rollback()
+
+	// The group uses the currency of its members' accounts
+	err = tx.QueryRowContext(r.Context(), `SELECT currency_code FROM accounts WHERE id = $1`, group.Members[0].AccountID).Scan(&group.CurrencyCode)
+	if err != nil {
+		if err == sql.ErrNoRows {
+			http.Error(w, "Account not found", http.StatusNotFound)
+		} else {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+		}
+		return
+	}
+
+	err = tx.QueryRowContext(r.Context(), `INSERT INTO expense_groups (name, currency_code) VALUES ($1, $2) RETURNING id, created_at`,
+		group.Name, group.CurrencyCode).Scan(&group.ID, &group.CreatedAt)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	for i := range group.Members {
+		if err := addGroupMember(r.Context(), tx, group.ID, group.CurrencyCode, &group.Members[i]); err != nil {
+			writeGroupMemberError(w, err)
+			return
+		}
+	}
+
+	err = tx.Commit()
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	notifyGroupMembers(r.Context(), group.Members, "group_expense_invite", map[string]interface{}{
+		"group_id": group.ID,
+		"name":     group.Name,
+	})
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusCreated)
+	json.NewEncoder(w).Encode(group)
+}
+
+// Errors returned by addGroupMember
+var (
+	errGroupMemberNotFound = errors.New("Member account not found")
+	errGroupMemberCurrency = errors.New("All member accounts must use the group's currency")
+)
+
+// addGroupMember adds an account in the group's currency
+func addGroupMember(ctx context.Context, tx *sql.Tx, groupID int, currency string, m *GroupMember) error {
+	var accountCurrency string
+	err := tx.QueryRowContext(ctx, `SELECT customer_id, currency_code FROM accounts WHERE id = $1`, m.AccountID).Scan(&m.CustomerID,
+		&accountCurrency)
+	if err == sql.ErrNoRows {
+		return errGroupMemberNotFound
+	}
+	if err != nil {
+		return err
+	}
+	if accountCurrency != currency {
+		return errGroupMemberCurrency
+	}
+
+	m.DisplayName = strings.TrimSpace(m.DisplayName)
+	if m.DisplayName == "" {
+		m.DisplayName = fmt.Sprintf("Account %d", m.AccountID)
+	}
+	_, err = tx.ExecContext(ctx, `INSERT INTO expense_group_members (group_id, account_id, display_name) VALUES ($1, $2, $3)
+					  ON CONFLICT (group_id, account_id) DO UPDATE SET display_name = EXCLUDED.display_name`,
+		groupID, m.AccountID, m.DisplayName)
+	return err
+}
+
+// writeGroupMemberError answers an addGroupMember error
+func writeGroupMemberError(w http.ResponseWriter, err error) {
+	switch err {
+	case errGroupMemberNotFound:
+		http.Error(w, errGroupMemberNotFound.Error(), http.StatusNotFound)
+	case errGroupMemberCurrency:
+		http.Error(w, errGroupMemberCurrency.Error(), http.StatusBadRequest)
+	default:
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+	}
+}
+
+func addExpenseGroupMember(w http.ResponseWriter, r *http.Request) {
+	group, err := loadExpenseGroup(r.Context(), mux.Vars(r)["id"])
+	if err != nil {
+		groupError(w, err)
+		return
+	}
+
+	var member GroupMember
+	err = json.NewDecoder(r.Body).Decode(&member)
+	if err != nil {
+		http.Error(w, "Invalid request body", http.StatusBadRequest)
+		return
+	}
+
+	tx, err := db.BeginTx(r.Context(), nil)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	defer tx.Rollback()
+
+	if err := addGroupMember(r.Context(), tx, group.ID, group.CurrencyCode, &member); err != nil {
+		writeGroupMemberError(w, err)
+		return
+	}
+	err = tx.Commit()
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	notifyGroupMembers(r.Context(), []GroupMember{member}, "group_expense_invite", map[string]interface{}{
+		"group_id": group.ID,
+		"name":     group.Name,
+	})
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusCreated)
+	json.NewEncoder(w).Encode(member)
+}
+
+func getExpenseGroup(w http.ResponseWriter, r *http.Request) {
+	group, err := loadExpenseGroup(r.Context(), mux.Vars(r)["id"])
+	if err != nil {
+		groupError(w, err)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(group)
+}
+
+func loadExpenseGroup(ctx context.Context, id string) (ExpenseGroup, error) {
+	var group ExpenseGroup
+	err := db.QueryRowContext(ctx, `SELECT id, name, currency_code, created_at FROM expense_groups WHERE id = $1`, id).Scan(&group.ID,
+		&group.Name, &group.CurrencyCode, &group.CreatedAt)
+	if err != nil {
+		return group, err
+	}
+
+	rows, err := db.QueryContext(ctx, `SELECT m.account_id, a.customer_id, m.display_name FROM expense_group_members m
+						   JOIN accounts a ON a.id = m.account_id WHERE m.group_id = $1 ORDER BY m.account_id`, group.ID)
+	if err != nil {
+		return group, err
+	}
+	defer rows.Close()
+
+	group.Members = []GroupMember{}
+	for rows.Next() {
+		var m GroupMember
+		if err := rows.Scan(&m.AccountID, &m.CustomerID, &m.DisplayName); err != nil {
+			return group, err
+		}
+		group.Members = append(group.Members, m)
+	}
+	return group, rows.Err()
+}
+
+func groupError(w http.ResponseWriter, err error) {
+	if err == sql.ErrNoRows {
+		http.Error(w, "Group not found", http.StatusNotFound)
+	} else {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+	}
+}
+
+// addGroupExpense logs a bill. Without explicit shares the amount is split
+// equally between all members, with leftover cents going to the first members.
+func addGroupExpense(w http.ResponseWriter, r *http.Request) {
+	group, err := loadExpenseGroup(r.Context(), mux.Vars(r)["id"])
+	if err != nil {
+		groupError(w, err)
+		return
+	}
+
+	var expense GroupExpense
+	err = json.NewDecoder(r.Body).Decode(&expense)
+	if err != nil {
+		http.Error(w, "Invalid request body", http.StatusBadRequest)
+		return
+	}
+	if expense.Amount <= 0 {
+		http.Error(w, "Amount must be positive", http.StatusBadRequest)
+		return
+	}
+
+	members := map[int]bool{}
+	for _, m := range group.Members {
+		members[m.AccountID] = true
+	}
+	if !members[expense.PaidBy] {
+		http.Error(w, "paid_by_account_id must be a group member", http.StatusBadRequest)
+		return
+	}
+
+	total := expense.Amount
+	if len(expense.Shares) == 0 {
+		per := total / Money(len(group.Members))
+		remainder := total % Money(len(group.Members))
+		for i, m := range group.Members {
+			share := per
+			if Money(i) < remainder {
+				share++
+			}
+			expense.Shares = append(expense.Shares, GroupShare{AccountID: m.AccountID, Amount: share})
+		}
+	} else {
+		var sum Money
+		seen := map[int]bool{}
+		for _, s := range expense.Shares {
+			if !members[s.AccountID] || seen[s.AccountID] || s.Amount < 0 {
+				http.Error(w, "Shares must be non-negative and for distinct group members", http.StatusBadRequest)
+				return
+			}
+			seen[s.AccountID] = true
+			sum += s.Amount
+		}
+		if sum != total {
+			http.Error(w, "Shares must add up to the expense amount", http.StatusBadRequest)
+			return
+		}
+	}
+
+	tx, err := db.BeginTx(r.Context(), nil)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	defer tx.Rollback()
+
+	expense.GroupID = group.ID
+	err = tx.QueryRowContext(r.Context(), `INSERT INTO group_expenses (group_id, paid_by_account_id, amount, description)
+					   VALUES ($1, $2, $3, $4) RETURNING id, created_at`, group.ID, expense.PaidBy, expense.Amount,
+		strings.TrimSpace(expense.Description)).Scan(&expense.ID, &expense.CreatedAt)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	for _, s := range expense.Shares {
+		_, err = tx.ExecContext(r.Context(), `INSERT INTO group_expense_shares (expense_id, account_id, amount) VALUES ($1, $2, $3)`,
+			expense.ID, s.AccountID, s.Amount)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+	}
+
+	err = tx.Commit()
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	notifyGroupMembers(r.Context(), group.Members, "group_expense_added", map[string]interface{}{
+		"group_id":    group.ID,
+		"name":        group.Name,
+		"amount":      expense.Amount,
+		"description": expense.Description,
+	})
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusCreated)
+	json.NewEncoder(w).Encode(expense)
+}
+
+func listGroupExpenses(w http.ResponseWriter, r *http.Request) {
+	rows, err := db.QueryContext(r.Context(), `SELECT e.id, e.group_id, e.paid_by_account_id, e.amount, e.description, e.created_at,
+						   s.account_id, s.amount
+						   FROM group_expenses e JOIN group_expense_shares s ON s.expense_id = e.id
+						   WHERE e.group_id = $1 ORDER BY e.created_at DESC, e.id, s.account_id`, mux.Vars(r)["id"])
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	defer rows.Close()
+
+	expenses := []GroupExpense{}
+	for rows.Next() {
+		var e GroupExpense
+		var s GroupShare
+		err := rows.Scan(&e.ID, &e.GroupID, &e.PaidBy, &e.Amount, &e.Description, &e.CreatedAt, &s.AccountID, &s.Amount)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		if n := len(expenses); n > 0 && expenses[n-1].ID == e.ID {
+			expenses[n-1].Shares = append(expenses[n-1].Shares, s)
+			continue
+		}
+		e.Shares = []GroupShare{s}
+		expenses = append(expenses, e)
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(expenses)
+}
+
+// groupBalances returns each member's net position: positive when
+// the group owes them, negative when they owe the group
+func groupBalances(ctx context.Context, q interface {
+	QueryContext(ctx context.Context, query string, args ...interface{}) (*sql.Rows, error)
+}, groupID int) (map[int]Money, error) {
+	rows, err := q.QueryContext(ctx, `SELECT account_id, SUM(amount) FROM (
+							  SELECT paid_by_account_id AS account_id, amount FROM group_expenses WHERE group_id = $1
+							  UNION ALL
+							  SELECT s.account_id, -s.amount FROM group_expense_shares s
+								  JOIN group_expenses e ON e.id = s.expense_id WHERE e.group_id = $1
+							  UNION ALL
+							  SELECT from_account_id, amount FROM group_settlements WHERE group_id = $1
+							  UNION ALL
+							  SELECT to_account_id, -amount FROM group_settlements WHERE group_id = $1
+						  ) AS entries GROUP BY account_id`, groupID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	balances := map[int]Money{}
+	for rows.Next() {
+		var id int
+		var amount Money
+		if err := rows.Scan(&id, &amount); err != nil {
+			return nil, err
+		}
+		balances[id] = amount
+	}
+	return balances, rows.Err()
+}
+
+// planSettlements pairs the largest debtors with the largest creditors, which
+// settles the group in at most one transfer fewer than the number of members
+func planSettlements(balances map[int]Money) []GroupSettlement {
+	type position struct {
+		account int
+		amount  Money
+	}
+	var debtors, creditors []position
+	for account, amount := range balances {
+		if amount < 0 {
+			debtors = append(debtors, position{account, -amount})
+		} else if amount > 0 {
+			creditors = append(creditors, position{account, amount})
+		}
+	}
+	byAmount := func(p []position) func(i, j int) bool {
+		return func(i, j int) bool {
+			if p[i].amount != p[j].amount {
+				return p[i].amount > p[j].amount
+			}
+			return p[i].account < p[j].account
+		}
+	}
+	sort.Slice(debtors, byAmount(debtors))
+	sort.Slice(creditors, byAmount(creditors))
+
+	settlements := []GroupSettlement{}
+	for i, j := 0, 0; i < len(debtors) && j < len(creditors); {
+		amount := debtors[i].amount
+		if creditors[j].amount < amount {
+			amount = creditors[j].amount
+		}
+		settlements = append(settlements, GroupSettlement{FromAccountID: debtors[i].account,
+			ToAccountID: creditors[j].account, Amount: amount})
+		debtors[i].amount -= amount
+		creditors[j].amount -= amount
+		if debtors[i].amount == 0 {
+			i++
+		}
+		if creditors[j].amount == 0 {
+			j++
+		}
+	}
+	return settlements
+}
+
+func getGroupBalances(w http.ResponseWriter, r *http.Request) {
+	group, err := loadExpenseGroup(r.Context(), mux.Vars(r)["id"])
+	if err != nil {
+		groupError(w, err)
+		return
+	}
+
+	balances, err := groupBalances(r.Context(), db, group.ID)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	net := map[string]Money{}
+	for _, m := range group.Members {
+		net[strconv.Itoa(m.AccountID)] = balances[m.AccountID]
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"group_id":    group.ID,
+		"balances":    net,
+		"settlements": planSettlements(balances),
+	})
+}
+
+// settleGroup executes the planned settlements as internal transfers in one
+// database transaction. With an account_id only that member's debts are paid.
+func settleGroup(w http.ResponseWriter, r *http.Request) {
+	group, err := loadExpenseGroup(r.Context(), mux.Vars(r)["id"])
+	if err != nil {
+		groupError(w, err)
+		return
+	}
+
+	var req struct {
+		AccountID int `json:"account_id"`
+	}
+	if r.ContentLength != 0 {
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			http.Error(w, "Invalid request body", http.StatusBadRequest)
+			return
+		}
+	}
+
+	tx, err := db.BeginTx(r.Context(), nil)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	defer tx.Rollback()
+
+	// Serialize settlement runs for the group so a plan is not executed twice
+	_, err = tx.ExecContext(r.Context(), `SELECT id FROM expense_groups WHERE id = $1 FOR UPDATE`, group.ID)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	balances, err := groupBalances(r.Context(), tx, group.ID)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	executed := []GroupSettlement{}
+	for _, s := range planSettlements(balances) {
+		if req.AccountID != 0 && s.FromAccountID != req.AccountID {
+			continue
+		}
+		err = internalTransfer(r.Context(), tx, s.FromAccountID, s.ToAccountID, s.Amount,
+			fmt.Sprintf("Group settlement: %s", group.Name))
+		if err != nil {
+			http.Error(w, fmt.Sprintf("Settlement from account %d failed: %s", s.FromAccountID, transferErrorMessage(err)),
+				transferErrorStatus(err))
+			return
+		}
+		_, err = tx.ExecContext(r.Context(), `INSERT INTO group_settlements (group_id, from_account_id, to_account_id, amount)
+						  VALUES ($1, $2, $3, $4)`, group.ID, s.FromAccountID, s.ToAccountID, s.Amount)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		executed = append(executed, s)
+	}
+
+	err = tx.Commit()
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	if len(executed) > 0 {
+		notifyGroupMembers(r.Context(), group.Members, "group_expense_settled", map[string]interface{}{
+			"group_id":    group.ID,
+			"name":        group.Name,
+			"settlements": executed,
+		})
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"group_id":    group.ID,
+		"settlements": executed,
+	})
+}
+
+func notifyGroupMembers(ctx context.Context, members []GroupMember, template string, data map[string]interface{}) {
+	for _, m := range members {
+		err := sendNotification(ctx, Notification{
+			CustomerID: m.CustomerID,
+			Channel:    "push",
+			Template:   template,
+			Data:       data,
+		})
+		if err != nil {
+			servicekit.RequestLogger(ctx).Error("failed to notify group member", zap.Int("account_id", m.AccountID), zap.Error(err))
+		}
+	}
+}
@@ -0,0 +1,183 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"database/sql"
+	"encoding/hex"
+	"io"
+	"net/http"
+	"time"
+
+	"bank/servicekit"
+
+	"go.uber.org/zap"
+)
+
+const idempotencyTablesSQL = `
+	CREATE TABLE IF NOT EXISTS idempotency_keys (
+		actor VARCHAR(100) NOT NULL,
+		idempotency_key VARCHAR(255) NOT NULL,
+		request_hash VARCHAR(64) NOT NULL,
+		status VARCHAR(20) NOT NULL DEFAULT 'in_progress',
+		response_code INTEGER,
+		response_content_type VARCHAR(100),
+		response_body BYTEA,
+		created_at TIMESTAMP NOT NULL DEFAULT NOW(),
+		completed_at TIMESTAMP,
+		PRIMARY KEY (actor, idempotency_key)
+	);
+	CREATE INDEX IF NOT EXISTS idx_idempotency_keys_created ON idempotency_keys(created_at);`
+
+// idempotencyKeyTTL is how long a key and its stored response are kept
+func idempotencyKeyTTL() time.Duration {
+	ttl, err := time.ParseDuration(getEnv("IDEMPOTENCY_KEY_TTL", "24h"))
+	if err != nil || ttl <= 0 {
+		return 24 * time.Hour
+	}
+	return ttl
+}
+
+// responseRecorder passes a response through while keeping a copy of it
+type responseRecorder struct {
+	http.ResponseWriter
+	status int
+	body   bytes.Buffer
+}
+
+func (r *responseRecorder) WriteHeader(status int) {
+	r.status = status
+	r.ResponseWriter.WriteHeader(status)
+}
+
+func (r *responseRecorder) Write(b []byte) (int, error) {
+	r.body.Write(b)
+	return r.ResponseWriter.Write(b)
+}
+
+// idempotent makes a money-moving POST safe to retry. A request with an
+// Idempotency-Key header runs once per caller and key; repeats get the stored
+// response with Idempotent-Replayed: true. Reusing a key for a different
+// request is rejected with 422, and a repeat while the first request is still
+// running with 409. Server errors and panics are not stored, since the
+// handlers roll back on them, so the request may be retried with the same key.
+func idempotent(next http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		key := r.Header.Get("Idempotency-Key")
+		if key == "" {
+			next(w, r)
+			return
+		}
+		if len(key) > 255 {
+			http.Error(w, "Idempotency-Key must be at most 255 characters", http.StatusBadRequest)
+			return
+		}
+
+		body, err := io.ReadAll(r.Body)
+		if err != nil {
+			http.Error(w, "Invalid request body", http.StatusBadRequest)
+			return
+		}
+		r.Body = io.NopCloser(bytes.NewReader(body))
+		hash := sha256.New()
+		io.WriteString(hash, r.Method+" "+r.URL.Path+"\n")
+		hash.Write(body)
+		requestHash := hex.EncodeToString(hash.Sum(nil))
+		actor := requestActor(r)
+
+		result, err := db.ExecContext(r.Context(), `INSERT INTO idempotency_keys (actor, idempotency_key, request_hash)
+													VALUES ($1, $2, $3) ON CONFLICT DO NOTHING`, actor, key, requestHash)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		if n, _ := result.RowsAffected(); n == 0 {
+			replayIdempotentResponse(w, r, actor, key, requestHash)
+			return
+		}
+
+		rec := &responseRecorder{ResponseWriter: w, status: http.StatusOK}
+		finished := false
+		defer func() {
+			// A panicking handler rolled back too: release the key before the
+			// panic goes on to RecoveryMiddleware
+			if !finished {
+				releaseIdempotencyKey(r, actor, key)
+			}
+		}()
+		next(rec, r)
+		finished = true
+
+		if rec.status >= 500 {
+			releaseIdempotencyKey(r, actor, key)
+			return
+		}
+		// Use a fresh context: the stored result must not depend on the client
+		// waiting for it
+		_, err = db.ExecContext(context.Background(), `UPDATE idempotency_keys SET status = 'completed', response_code = $3,
+									  response_content_type = $4, response_body = $5, completed_at = NOW()
+									  WHERE actor = $1 AND idempotency_key = $2`,
+			actor, key, rec.status, rec.Header().Get("Content-Type"), rec.body.Bytes())
+		if err != nil {
+			servicekit.RequestLogger(r.Context()).Error("failed to store idempotent response", zap.String("idempotency_key", key), zap.Error(err))
+		}
+	}
+}
+
+// releaseIdempotencyKey deletes the key of a request that failed, so it may be
+// retried with the same key
+func releaseIdempotencyKey(r *http.Request, actor, key string) {
+	_, err := db.ExecContext(context.Background(), `DELETE FROM idempotency_keys WHERE actor = $1 AND idempotency_key = $2`, actor, key)
+	if err != nil {
+		servicekit.RequestLogger(r.Context()).Error("failed to release idempotency key", zap.String("idempotency_key", key), zap.Error(err))
+	}
+}
+
+func replayIdempotentResponse(w http.ResponseWriter, r *http.Request, actor, key, requestHash string) {
+	var storedHash, status string
+	var code sql.NullInt64
+	var contentType sql.NullString
+	var body []byte
+	err := db.QueryRowContext(r.Context(), `SELECT request_hash, status, response_code, response_content_type, response_body
+											 FROM idempotency_keys WHERE actor = $1 AND idempotency_key = $2`,
+		actor, key).Scan(&storedHash, &status, &code, &contentType, &body)
+	if err == sql.ErrNoRows {
+		// The first attempt failed and released the key in the meantime
+		http.Error(w, "A request with this Idempotency-Key failed; retry it", http.StatusConflict)
+		return
+	}
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	if storedHash != requestHash {
+		http.Error(w, "Idempotency-Key was already used for a different request", http.StatusUnprocessableEntity)
+		return
+	}
+	if status != "completed" {
+		http.Error(w, "A request with this Idempotency-Key is still being processed", http.StatusConflict)
+		return
+	}
+
+	if contentType.String != "" {
+		w.Header().Set("Content-Type", contentType.String)
+	}
+	w.Header().Set("Idempotent-Replayed", "true")
+	w.WriteHeader(int(code.Int64))
+	w.Write(body)
+}
+
+// startIdempotencyKeyExpiry removes keys older than IDEMPOTENCY_KEY_TTL every hour
+func startIdempotencyKeyExpiry() {
+	go func() {
+		defer servicekit.ReportJobPanic("Idempotency key expiry")
+		for {
+			_, err := db.ExecContext(serviceContext, `DELETE FROM idempotency_keys WHERE created_at < $1`, time.Now().Add(-idempotencyKeyTTL()))
+			if err != nil {
+				servicekit.ReportJobError("Idempotency key expiry", err)
+			}
+			time.Sleep(time.Hour)
+		}
+	}()
+}
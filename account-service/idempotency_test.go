@@ -0,0 +1,136 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"database/sql/driver"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+)
+
+// idempotencyDriver is a database/sql driver keeping the idempotency_keys
+// rows of idempotent in memory. It tells the statements of idempotency.go
+// apart by their first word.
+type idempotencyDriver struct{}
+
+// idempotencyKey is a stored row: the request hash and status
+type idempotencyKey struct {
+	hash, status string
+}
+
+var (
+	registerIdempotencyDriver sync.Once
+	idempotencyKeys           map[string]idempotencyKey
+)
+
+// useIdempotencyDB points db at an empty idempotencyDriver database
+func useIdempotencyDB(t *testing.T) {
+	registerIdempotencyDriver.Do(func() {
+		sql.Register("idempotency", idempotencyDriver{})
+	})
+	conn, err := sql.Open("idempotency", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	previous := db
+	t.Cleanup(func() { db = previous })
+	db = conn
+	idempotencyKeys = map[string]idempotencyKey{}
+}
+
+func (idempotencyDriver) Open(string) (driver.Conn, error) { return idempotencyConn{}, nil }
+
+type idempotencyConn struct{}
+
+func (idempotencyConn) Prepare(query string) (driver.Stmt, error) {
+	return nil, fmt.Errorf("idempotency db: unexpected statement %q", query)
+}
+func (idempotencyConn) Close() error { return nil }
+func (idempotencyConn) Begin() (driver.Tx, error) {
+	return nil, fmt.Errorf("idempotency db: no transactions")
+}
+
+func (idempotencyConn) ExecContext(_ context.Context, query string, args []driver.NamedValue) (driver.Result, error) {
+	id := fmt.Sprint(args[0].Value, "/", args[1].Value)
+	switch strings.Fields(query)[0] {
+	case "INSERT":
+		if _, ok := idempotencyKeys[id]; ok {
+			return driver.RowsAffected(0), nil
+		}
+		idempotencyKeys[id] = idempotencyKey{hash: fmt.Sprint(args[2].Value), status: "in_progress"}
+	case "UPDATE":
+		k := idempotencyKeys[id]
+		k.status = "completed"
+		idempotencyKeys[id] = k
+	case "DELETE":
+		delete(idempotencyKeys, id)
+	default:
+		return nil, fmt.Errorf("idempotency db: unexpected statement %q", query)
+	}
+	return driver.RowsAffected(1), nil
+}
+
+func (idempotencyConn) QueryContext(_ context.Context, query string, args []driver.NamedValue) (driver.Rows, error) {
+	k, ok := idempotencyKeys[fmt.Sprint(args[0].Value, "/", args[1].Value)]
+	return &idempotencyRows{key: k, done: !ok}, nil
+}
+
+type idempotencyRows struct {
+	key  idempotencyKey
+	done bool
+}
+
+func (*idempotencyRows) Columns() []string {
+	return []string{"request_hash", "status", "response_code", "response_content_type", "response_body"}
+}
+func (*idempotencyRows) Close() error { return nil }
+func (r *idempotencyRows) Next(dest []driver.Value) error {
+	if r.done {
+		return io.EOF
+	}
+	r.done = true
+	dest[0], dest[1] = r.key.hash, r.key.status
+	return nil
+}
+
+// TestIdempotentReleasesKeyOnPanic checks a request whose handler panicked
+// can be retried with the same key instead of being refused as still running
+func TestIdempotentReleasesKeyOnPanic(t *testing.T) {
+	useIdempotencyDB(t)
+	runs := 0
+	handler := idempotent(func(w http.ResponseWriter, r *http.Request) {
+		runs++
+		if runs == 1 {
+			panic("handler failed")
+		}
+		w.WriteHeader(http.StatusCreated)
+	})
+	send := func() *httptest.ResponseRecorder {
+		r := httptest.NewRequest("POST", "/v1/accounts/transfer", strings.NewReader(`{"amount": 100}`))
+		r.Header.Set("X-User-ID", "7")
+		r.Header.Set("Idempotency-Key", "test-panic")
+		w := httptest.NewRecorder()
+		handler(w, r)
+		return w
+	}
+
+	func() {
+		defer func() {
+			if recover() == nil {
+				t.Fatal("the handler panic did not reach the caller")
+			}
+		}()
+		send()
+	}()
+	if len(idempotencyKeys) != 0 {
+		t.Fatalf("keys after the panic: %v, want none", idempotencyKeys)
+	}
+	if retry := send(); retry.Code != http.StatusCreated || runs != 2 {
+		t.Fatalf("retry: status %d after %d runs, want 201 after 2", retry.Code, runs)
+	}
+}
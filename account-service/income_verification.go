@@ -0,0 +1,518 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"io"
+	"math"
+	"net/http"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+	"unicode"
+
+	"github.com/gorilla/mux"
+	"github.com/lib/pq"
+)
+
+// IncomeVerification is evidence of a customer's monthly income, either
+// detected from salary credits or read from an uploaded document by staff
+type IncomeVerification struct {
+	ID             int    `json:"id"`
+	CustomerID     int    `json:"customer_id"`
+	Method         string `json:"method"` // transactions or document
+	Status         string `json:"status"` // pending, verified or rejected
+	MonthlyIncome  Money  `json:"monthly_income"`
+	DeclaredIncome Money  `json:"declared_income,omitempty"`
+	Sources        string `json:"sources,omitempty"` // detected payers or the document type
+	Filename       string `json:"filename,omitempty"`
+	SubmittedBy    string `json:"submitted_by"`
+	ReviewedBy     string `json:"reviewed_by,omitempty"`
+	ReviewNote     string `json:"review_note,omitempty"`
+	CreatedAt      string `json:"created_at"`
+	ReviewedAt     string `json:"reviewed_at,omitempty"`
+	DownloadURL    string `json:"download_url,omitempty"`
+}
+
+// Affordability compares verified income with existing monthly commitments
+type Affordability struct {
+	CustomerID         int     `json:"customer_id"`
+	IncomeVerified     bool    `json:"income_verified"`
+	MonthlyIncome      Money   `json:"monthly_income"`
+	MonthlyCommitments Money   `json:"monthly_commitments"`
+	DisposableIncome   Money   `json:"disposable_income"`
+	DebtToIncome       float64 `json:"debt_to_income"`
+	Score              int     `json:"score"` // 0-100
+}
+
+const incomeVerificationTablesSQL = `
+	CREATE TABLE IF NOT EXISTS income_verifications (
+		id SERIAL PRIMARY KEY,
+		customer_id INTEGER NOT NULL,
+		method VARCHAR(20) NOT NULL,
+		status VARCHAR(20) NOT NULL,
+		monthly_income DECIMAL(15,2) NOT NULL DEFAULT 0,
+		declared_income DECIMAL(15,2) NOT NULL DEFAULT 0,
+		sources VARCHAR(255) NOT NULL DEFAULT '',
+		filename VARCHAR(255) NOT NULL DEFAULT '',
+		content_type VARCHAR(100) NOT NULL DEFAULT '',
+		object_key VARCHAR(255) NOT NULL DEFAULT '',
+		submitted_by VARCHAR(100) NOT NULL,
+		reviewed_by VARCHAR(100) NOT NULL DEFAULT '',
+		review_note VARCHAR(255) NOT NULL DEFAULT '',
+		created_at TIMESTAMP NOT NULL DEFAULT NOW(),
+		reviewed_at TIMESTAMP
+	);
+	CREATE INDEX IF NOT EXISTS idx_income_verifications_customer ON income_verifications(customer_id, created_at);`
+
+// incomeDocumentTypes are the documents accepted as proof of income
+var incomeDocumentTypes = map[string]bool{
+	"payslip":           true,
+	"tax_return":        true,
+	"employment_letter": true,
+	"bank_statement":    true,
+}
+
+// Affordability parameters
+const (
+	// salaryLookbackMonths is how far back credits are searched for salaries
+	salaryLookbackMonths = 6
+	// incomeVerificationValidity is how long a verified income is relied upon
+	incomeVerificationValidity = "1 year"
+	// revolvingPaymentRate is the monthly minimum payment assumed on card and
+	// overdraft balances
+	revolvingPaymentRate = 0.03
+	// maxDebtToIncome is the commitment ratio at which the score reaches zero
+	maxDebtToIncome = 0.5
+)
+
+const incomeVerificationColumns = `id, customer_id, method, status, monthly_income, declared_income, sources, filename,
+	submitted_by, reviewed_by, review_note, created_at, COALESCE(reviewed_at::text, '')`
+
+func scanIncomeVerification(row interface{ Scan(...interface{}) error }, v *IncomeVerification) error {
+	err := row.Scan(&v.ID, &v.CustomerID, &v.Method, &v.Status, &v.MonthlyIncome, &v.DeclaredIncome, &v.Sources,
+		&v.Filename, &v.SubmittedBy, &v.ReviewedBy, &v.ReviewNote, &v.CreatedAt, &v.ReviewedAt)
+	if err == nil && v.Method == "document" {
+		v.DownloadURL = signDownloadPath(fmt.Sprintf("/v1/income-verifications/%d/download", v.ID), attachmentLinkTTL)
+	}
+	return err
+}
+
+// salaryPayer reduces a credit description to its payer by dropping digits
+// and punctuation, so "ACME LTD SALARY 2024-03" and "ACME LTD SALARY 2024-04"
+// group together
+func salaryPayer(description string) string {
+	fields := strings.FieldsFunc(strings.ToLower(description), func(c rune) bool {
+		return !unicode.IsLetter(c)
+	})
+	return strings.Join(fields, " ")
+}
+
+// detectSalaries looks for payers crediting the customer about monthly with a
+// stable amount and returns the average monthly amount per payer
+func detectSalaries(r *http.Request, customerID int) (map[string]Money, error) {
+	rows, err := db.QueryContext(r.Context(), `SELECT id FROM accounts WHERE customer_id = $1 AND status <> 'closed'
+											   AND account_type <> ALL($2)`, customerID, pq.Array(liabilityAccountTypeList()))
+	if err != nil {
+		return nil, err
+	}
+	var accountIDs []int
+	for rows.Next() {
+		var id int
+		if err := rows.Scan(&id); err != nil {
+			rows.Close()
+			return nil, err
+		}
+		accountIDs = append(accountIDs, id)
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+
+	since := time.Now().UTC().AddDate(0, -salaryLookbackMonths, 0)
+	credits := map[string][]merchantCharge{}
+	for _, id := range accountIDs {
+		transactions, err := fetchAllTransactions(r, id)
+		if err != nil {
+			return nil, err
+		}
+		for _, t := range transactions {
+			if t.Type != "deposit" || t.Amount <= 0 {
+				continue
+			}
+			if len(t.CreatedAt) < 10 {
+				continue
+			}
+			at, err := time.Parse("2006-01-02", t.CreatedAt[:10])
+			if err != nil || at.Before(since) {
+				continue
+			}
+			if payer := salaryPayer(t.Description); payer != "" {
+				credits[payer] = append(credits[payer], merchantCharge{Amount: t.Amount, At: at})
+			}
+		}
+	}
+
+	salaries := map[string]Money{}
+	for payer, list := range credits {
+		sort.Slice(list, func(i, j int) bool { return list[i].At.Before(list[j].At) })
+		// Salaries are paid monthly in about the same amount, the same test
+		// recurring card charges have to pass
+		c, ok := classifyRecurring(payer, list)
+		if ok && c.Frequency == "monthly" {
+			salaries[payer] = c.AverageAmount
+		}
+	}
+	return salaries, nil
+}
+
+// applyVerifiedIncome makes a verified monthly income the basis of the
+// customer's credit profile
+func applyVerifiedIncome(ctx context.Context, q interface {
+	ExecContext(ctx context.Context, query string, args ...interface{}) (sql.Result, error)
+}, customerID int, monthlyIncome Money, method string) error {
+	_, err := q.ExecContext(ctx, `INSERT INTO credit_profiles (customer_id, annual_income, income_source) VALUES ($1, $2, $3)
+								  ON CONFLICT (customer_id) DO UPDATE SET annual_income = EXCLUDED.annual_income,
+									  income_source = EXCLUDED.income_source, updated_at = NOW()`,
+		customerID, monthlyIncome*12, method)
+	return err
+}
+
+// verifyIncomeFromTransactions detects salary credits on the customer's
+// accounts and records the total as verified monthly income
+func verifyIncomeFromTransactions(w http.ResponseWriter, r *http.Request) {
+	customerID, err := strconv.Atoi(mux.Vars(r)["id"])
+	if err != nil {
+		http.Error(w, "Invalid customer ID", http.StatusBadRequest)
+		return
+	}
+
+	salaries, err := detectSalaries(r, customerID)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadGateway)
+		return
+	}
+	if len(salaries) == 0 {
+		http.Error(w, "No regular salary credits found; upload a proof of income instead", http.StatusUnprocessableEntity)
+		return
+	}
+
+	var payers []string
+	var total Money
+	for payer, amount := range salaries {
+		payers = append(payers, payer)
+		total += amount
+	}
+	sort.Strings(payers)
+	sources := strings.Join(payers, ", ")
+	if len(sources) > 255 {
+		sources = sources[:255]
+	}
+
+	tx, err := db.BeginTx(r.Context(), nil)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	defer tx.Rollback()
+
+	var v IncomeVerification
+	err = scanIncomeVerification(tx.QueryRowContext(r.Context(), `INSERT INTO income_verifications (customer_id, method,
+									  status, monthly_income, sources, submitted_by, reviewed_by, reviewed_at)
+									  VALUES ($1, 'transactions', 'verified', $2, $3, $4, 'auto', NOW())
+									  RETURNING `+incomeVerificationColumns,
+		customerID, total, sources, requestActor(r)), &v)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	if err := applyVerifiedIncome(r.Context(), tx, customerID, v.MonthlyIncome, v.Method); err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	if err := tx.Commit(); err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusCreated)
+	json.NewEncoder(w).Encode(v)
+}
+
+// uploadIncomeDocument stores a proof of income sent as multipart field
+// "file" with "document_type" and the "declared_income" per month, for a
+// credit officer to review
+func uploadIncomeDocument(w http.ResponseWriter, r *http.Request) {
+	customerID, err := strconv.Atoi(mux.Vars(r)["id"])
+	if err != nil {
+		http.Error(w, "Invalid customer ID", http.StatusBadRequest)
+		return
+	}
+
+	r.Body = http.MaxBytesReader(w, r.Body, maxAttachmentBytes+1<<20)
+	file, header, err := r.FormFile("file")
+	if err != nil {
+		http.Error(w, "A file upload is required", http.StatusBadRequest)
+		return
+	}
+	defer file.Close()
+
+	documentType := r.FormValue("document_type")
+	if !incomeDocumentTypes[documentType] {
+		http.Error(w, "Unsupported document_type", http.StatusBadRequest)
+		return
+	}
+	declared, err := parseMoney(r.FormValue("declared_income"))
+	if err != nil || declared <= 0 {
+		http.Error(w, "declared_income must be a positive monthly amount", http.StatusBadRequest)
+		return
+	}
+
+	data, err := io.ReadAll(io.LimitReader(file, maxAttachmentBytes+1))
+	if err != nil {
+		http.Error(w, "The uploaded file could not be read", http.StatusBadRequest)
+		return
+	}
+	if len(data) > maxAttachmentBytes {
+		http.Error(w, "Documents are limited to 10 MB", http.StatusRequestEntityTooLarge)
+		return
+	}
+	contentType := http.DetectContentType(data)
+	if !attachmentContentTypes[contentType] {
+		http.Error(w, "Documents must be PDF, JPEG or PNG", http.StatusUnsupportedMediaType)
+		return
+	}
+
+	key := fmt.Sprintf("income/%d/%d", customerID, time.Now().UnixNano())
+	err = objectStore.Put(r.Context(), key, data)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	var v IncomeVerification
+	err = scanIncomeVerification(db.QueryRowContext(r.Context(), `INSERT INTO income_verifications (customer_id, method,
+									  status, declared_income, sources, filename, content_type, object_key, submitted_by)
+									  VALUES ($1, 'document', 'pending', $2, $3, $4, $5, $6, $7)
+									  RETURNING `+incomeVerificationColumns,
+		customerID, declared, documentType, filepath.Base(header.Filename), contentType, key, requestActor(r)), &v)
+	if err != nil {
+		objectStore.Delete(r.Context(), key)
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusCreated)
+	json.NewEncoder(w).Encode(v)
+}
+
+func downloadIncomeDocument(w http.ResponseWriter, r *http.Request) {
+	if !verifyDownloadSignature(r) {
+		http.Error(w, "Invalid or expired link", http.StatusForbidden)
+		return
+	}
+
+	var filename, contentType, key string
+	err := db.QueryRowContext(r.Context(), `SELECT filename, content_type, object_key FROM income_verifications
+											WHERE id = $1 AND method = 'document'`, mux.Vars(r)["id"]).Scan(&filename, &contentType, &key)
+	if err != nil {
+		if err == sql.ErrNoRows {
+			http.Error(w, "Document not found", http.StatusNotFound)
+		} else {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+		}
+		return
+	}
+
+	data, err := objectStore.Get(r.Context(), key)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", contentType)
+	w.Header().Set("Content-Disposition", fmt.Sprintf("attachment; filename=%q", filename))
+	w.Write(data)
+}
+
+func listIncomeVerifications(w http.ResponseWriter, r *http.Request) {
+	rows, err := db.QueryContext(r.Context(), `SELECT `+incomeVerificationColumns+` FROM income_verifications
+											   WHERE customer_id = $1 ORDER BY created_at DESC, id DESC`, mux.Vars(r)["id"])
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	defer rows.Close()
+
+	verifications := []IncomeVerification{}
+	for rows.Next() {
+		var v IncomeVerification
+		if err := scanIncomeVerification(rows, &v); err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		verifications = append(verifications, v)
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(verifications)
+}
+
+func approveIncomeVerification(w http.ResponseWriter, r *http.Request) {
+	reviewIncomeVerification(w, r, "verified")
+}
+
+func rejectIncomeVerification(w http.ResponseWriter, r *http.Request) {
+	reviewIncomeVerification(w, r, "rejected")
+}
+
+// reviewIncomeVerification decides a pending document. The reviewer may
+// confirm a monthly_income other than the declared one, e.g. net of tax.
+func reviewIncomeVerification(w http.ResponseWriter, r *http.Request, status string) {
+	if !requireRole(w, r, creditOfficerRoles...) {
+		return
+	}
+
+	var requestBody struct {
+		MonthlyIncome Money  `json:"monthly_income"`
+		Note          string `json:"note"`
+	}
+	if r.ContentLength != 0 {
+		if err := json.NewDecoder(r.Body).Decode(&requestBody); err != nil {
+			http.Error(w, "Invalid request body", http.StatusBadRequest)
+			return
+		}
+	}
+	if requestBody.MonthlyIncome < 0 {
+		http.Error(w, "monthly_income must not be negative", http.StatusBadRequest)
+		return
+	}
+
+	tx, err := db.BeginTx(r.Context(), nil)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	defer tx.Rollback()
+
+	var v IncomeVerification
+	err = scanIncomeVerification(tx.QueryRowContext(r.Context(), `SELECT `+incomeVerificationColumns+`
+									  FROM income_verifications WHERE id = $1 FOR UPDATE`, mux.Vars(r)["id"]), &v)
+	if err != nil {
+		if err == sql.ErrNoRows {
+			http.Error(w, "Income verification not found", http.StatusNotFound)
+		} else {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+		}
+		return
+	}
+	if v.Status != "pending" {
+		http.Error(w, "Income verification is not pending", http.StatusConflict)
+		return
+	}
+	if !enforceMakerChecker(w, r, "income_verification.review", fmt.Sprintf("income_verification:%d", v.ID), 0,
+		map[string]string{"income_verification.submit": v.SubmittedBy}) {
+		return
+	}
+	reviewer := requestActor(r)
+
+	var income Money
+	if status == "verified" {
+		income = v.DeclaredIncome
+		if requestBody.MonthlyIncome > 0 {
+			income = requestBody.MonthlyIncome
+		}
+	}
+	err = scanIncomeVerification(tx.QueryRowContext(r.Context(), `UPDATE income_verifications SET status = $2,
+									  monthly_income = $3, reviewed_by = $4, review_note = $5, reviewed_at = NOW()
+									  WHERE id = $1 RETURNING `+incomeVerificationColumns,
+		v.ID, status, income, reviewer, strings.TrimSpace(requestBody.Note)), &v)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	if status == "verified" {
+		if err := applyVerifiedIncome(r.Context(), tx, v.CustomerID, v.MonthlyIncome, v.Method); err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+	}
+
+	if err := tx.Commit(); err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(v)
+}
+
+// assessAffordability scores how much of the customer's latest verified
+// monthly income is already committed to loan installments and revolving
+// balances, plus newCommitment for a facility being decided. The score falls
+// linearly from 100 with no commitments to 0 at maxDebtToIncome.
+func assessAffordability(ctx context.Context, customerID int, newCommitment Money) (Affordability, error) {
+	a := Affordability{CustomerID: customerID}
+	var verified, installments, revolving Money
+	err := db.QueryRowContext(ctx, `SELECT
+									(SELECT monthly_income FROM income_verifications
+									 WHERE customer_id = $1 AND status = 'verified'
+									 AND reviewed_at >= NOW() - $3::interval
+									 ORDER BY reviewed_at DESC, id DESC LIMIT 1),
+									COALESCE((SELECT SUM(i.payment) FROM loans l
+										JOIN accounts a ON a.id = l.account_id
+										JOIN loan_installments i ON i.account_id = l.account_id
+										AND i.number = (SELECT MIN(number) FROM loan_installments n
+											WHERE n.account_id = l.account_id AND n.paid_at IS NULL)
+										WHERE a.customer_id = $1 AND l.status = 'active'), 0),
+									COALESCE((SELECT SUM(CASE WHEN account_type = 'credit_card' THEN balance ELSE -balance END)
+										FROM accounts WHERE customer_id = $1 AND status <> 'closed'
+										AND (account_type = 'credit_card' OR (balance < 0 AND account_type <> ALL($2)))), 0)`,
+		customerID, pq.Array(liabilityAccountTypeList()), incomeVerificationValidity).Scan(&verified, &installments, &revolving)
+	if err != nil {
+		return a, err
+	}
+
+	a.MonthlyCommitments = installments + newCommitment
+	if revolving > 0 {
+		a.MonthlyCommitments += revolving.Times(revolvingPaymentRate)
+	}
+	if verified <= 0 {
+		return a, nil
+	}
+
+	a.IncomeVerified = true
+	a.MonthlyIncome = verified
+	a.DisposableIncome = a.MonthlyIncome - a.MonthlyCommitments
+	a.DebtToIncome = math.Round(float64(a.MonthlyCommitments)/float64(a.MonthlyIncome)*10000) / 10000
+	a.Score = int(math.Round(100 * (1 - a.DebtToIncome/maxDebtToIncome)))
+	if a.Score < 0 {
+		a.Score = 0
+	}
+	return a, nil
+}
+
+func getAffordability(w http.ResponseWriter, r *http.Request) {
+	customerID, err := strconv.Atoi(mux.Vars(r)["id"])
+	if err != nil {
+		http.Error(w, "Invalid customer ID", http.StatusBadRequest)
+		return
+	}
+
+	a, err := assessAffordability(r.Context(), customerID, 0)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(a)
+}
@@ -0,0 +1,571 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"net/http"
+	"strconv"
+	"time"
+
+	"bank/servicekit"
+
+	"github.com/gorilla/mux"
+	"go.uber.org/zap"
+)
+
+// KYCSchedule tracks when a customer's KYC is next due for refresh. The cycle
+// follows the customer's risk rating; once a refresh is overdue past the grace
+// period, the customer's active accounts are restricted until it is completed.
+type KYCSchedule struct {
+	CustomerID      int          `json:"customer_id"`
+	RiskRating      string       `json:"risk_rating"` // low, medium or high
+	LastRefreshedOn string       `json:"last_refreshed_on"`
+	NextDueOn       string       `json:"next_due_on"`
+	DaysUntilDue    int          `json:"days_until_due"`
+	Status          string       `json:"status"` // current, due, overdue or restricted
+	ReminderLevel   int          `json:"reminder_level"`
+	LastRemindedAt  string       `json:"last_reminded_at,omitempty"`
+	RestrictedAt    string       `json:"restricted_at,omitempty"`
+	UpdatedBy       string       `json:"updated_by"`
+	UpdatedAt       string       `json:"updated_at"`
+	Refreshes       []KYCRefresh `json:"refreshes,omitempty"`
+}
+
+// KYCRefresh is a completed KYC review
+type KYCRefresh struct {
+	ID          int    `json:"id"`
+	CustomerID  int    `json:"customer_id"`
+	RiskRating  string `json:"risk_rating"`
+	RefreshedOn string `json:"refreshed_on"`
+	Reference   string `json:"reference"`
+	CompletedBy string `json:"completed_by"`
+	CreatedAt   string `json:"created_at"`
+}
+
+const kycRefreshTablesSQL = `
+	CREATE TABLE IF NOT EXISTS kyc_schedules (
+		customer_id INTEGER PRIMARY KEY,
+		risk_rating VARCHAR(10) NOT NULL,
+		last_refreshed_on DATE NOT NULL,
+		next_due_on DATE NOT NULL,
+		reminder_level INTEGER NOT NULL DEFAULT 0,
+		last_reminded_at TIMESTAMP,
+		restricted_at TIMESTAMP,
+		updated_by VARCHAR(100) NOT NULL,
+		created_at TIMESTAMP NOT NULL DEFAULT NOW(),
+		updated_at TIMESTAMP NOT NULL DEFAULT NOW()
+	);
+	CREATE INDEX IF NOT EXISTS idx_kyc_schedules_due ON kyc_schedules(next_due_on);
+	CREATE TABLE IF NOT EXISTS kyc_refreshes (
+		id SERIAL PRIMARY KEY,
+		customer_id INTEGER NOT NULL,
+		risk_rating VARCHAR(10) NOT NULL,
+		refreshed_on DATE NOT NULL,
+		reference VARCHAR(100) NOT NULL,
+		completed_by VARCHAR(100) NOT NULL,
+		created_at TIMESTAMP NOT NULL DEFAULT NOW()
+	);
+	CREATE INDEX IF NOT EXISTS idx_kyc_refreshes_customer ON kyc_refreshes(customer_id);
+	CREATE TABLE IF NOT EXISTS kyc_restricted_accounts (
+		account_id INTEGER PRIMARY KEY REFERENCES accounts(id),
+		customer_id INTEGER NOT NULL,
+		previous_status VARCHAR(20) NOT NULL,
+		restricted_at TIMESTAMP NOT NULL DEFAULT NOW()
+	);`
+
+// kycRoles may rate customers, record refreshes and view the dashboard
+var kycRoles = []string{"compliance", "admin"}
+
+// kycRefreshYears is the refresh cycle for each risk rating
+var kycRefreshYears = map[string]int{"high": 1, "medium": 3, "low": 5}
+
+// kycReminderLevels escalate as the due date approaches; each level is sent
+// once per cycle
+var kycReminderLevels = []struct {
+	daysBefore int
+	template   string
+}{
+	{60, "kyc_refresh_reminder"},
+	{30, "kyc_refresh_reminder"},
+	{7, "kyc_refresh_final_reminder"},
+	{-1, "kyc_refresh_overdue"},
+}
+
+// kycDueWindowDays is how far ahead a refresh counts as due, matching the first reminder
+const kycDueWindowDays = 60
+
+// kycScheduleColumns treats a refresh within kycDueWindowDays as due
+const kycScheduleColumns = `customer_id, risk_rating, last_refreshed_on::text, next_due_on::text,
+	next_due_on - CURRENT_DATE, CASE WHEN restricted_at IS NOT NULL THEN 'restricted'
+		WHEN next_due_on < CURRENT_DATE THEN 'overdue'
+		WHEN next_due_on <= CURRENT_DATE + 60 THEN 'due' ELSE 'current' END,
+	reminder_level, COALESCE(last_reminded_at::text, ''), COALESCE(restricted_at::text, ''), updated_by, updated_at`
+
+func scanKYCSchedule(row interface{ Scan(...interface{}) error }, s *KYCSchedule) error {
+	return row.Scan(&s.CustomerID, &s.RiskRating, &s.LastRefreshedOn, &s.NextDueOn, &s.DaysUntilDue, &s.Status,
+		&s.ReminderLevel, &s.LastRemindedAt, &s.RestrictedAt, &s.UpdatedBy, &s.UpdatedAt)
+}
+
+// kycGraceDays is how long a refresh may be overdue before accounts are restricted
+func kycGraceDays() int {
+	days, err := strconv.Atoi(getEnv("KYC_REFRESH_GRACE_DAYS", "30"))
+	if err != nil || days < 0 {
+		return 30
+	}
+	return days
+}
+
+// kycRestricted reports whether the customer's accounts are restricted for an overdue refresh
+func kycRestricted(ctx context.Context, customerID int) (bool, error) {
+	var restricted bool
+	err := db.QueryRowContext(ctx, `SELECT EXISTS (SELECT 1 FROM kyc_schedules
+									WHERE customer_id = $1 AND restricted_at IS NOT NULL)`, customerID).Scan(&restricted)
+	return restricted, err
+}
+
+// liftKYCRestriction restores the accounts restricted for the customer. An
+// account whose status was changed since, such as by an estate freeze, is
+// left as it is.
+func liftKYCRestriction(ctx context.Context, tx *sql.Tx, customerID int) error {
+	_, err := tx.ExecContext(ctx, `UPDATE accounts a SET status = k.previous_status, updated_at = NOW()
+								   FROM kyc_restricted_accounts k
+								   WHERE k.account_id = a.id AND k.customer_id = $1 AND a.status = 'restricted'`, customerID)
+	if err != nil {
+		return err
+	}
+	_, err = tx.ExecContext(ctx, `DELETE FROM kyc_restricted_accounts WHERE customer_id = $1`, customerID)
+	if err != nil {
+		return err
+	}
+	_, err = tx.ExecContext(ctx, `UPDATE kyc_schedules SET restricted_at = NULL WHERE customer_id = $1`, customerID)
+	return err
+}
+
+// startKYCRefreshMonitor sends refresh reminders and restricts overdue
+// customers every hour
+func startKYCRefreshMonitor() {
+	go func() {
+		defer servicekit.ReportJobPanic("KYC refresh job")
+		for {
+			if err := runKYCRefreshJobs(serviceContext); err != nil {
+				servicekit.ReportJobError("KYC refresh job", err)
+			}
+			time.Sleep(time.Hour)
+		}
+	}()
+}
+
+func runKYCRefreshJobs(ctx context.Context) error {
+	if err := sendKYCReminders(ctx); err != nil {
+		return err
+	}
+	return restrictOverdueKYC(ctx)
+}
+
+// sendKYCReminders sends the next reminder for every unrestricted customer
+// whose refresh has reached it
+func sendKYCReminders(ctx context.Context) error {
+	rows, err := db.QueryContext(ctx, `SELECT `+kycScheduleColumns+` FROM kyc_schedules
+									   WHERE restricted_at IS NULL AND next_due_on <= CURRENT_DATE + $1::int
+									   AND reminder_level < $2`, kycDueWindowDays, len(kycReminderLevels))
+	if err != nil {
+		return err
+	}
+	var due []KYCSchedule
+	for rows.Next() {
+		var s KYCSchedule
+		if err := scanKYCSchedule(rows, &s); err != nil {
+			rows.Close()
+			return err
+		}
+		due = append(due, s)
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return err
+	}
+
+	for _, s := range due {
+		level := 0
+		for i, l := range kycReminderLevels {
+			if s.DaysUntilDue <= l.daysBefore {
+				level = i + 1
+			}
+		}
+		if level <= s.ReminderLevel {
+			continue
+		}
+		template := kycReminderLevels[level-1].template
+
+		// Claim the level first so a slow notification service cannot cause duplicates
+		result, err := db.ExecContext(ctx, `UPDATE kyc_schedules SET reminder_level = $2, last_reminded_at = NOW()
+											WHERE customer_id = $1 AND reminder_level < $2`, s.CustomerID, level)
+		if err != nil {
+			return err
+		}
+		if n, _ := result.RowsAffected(); n == 0 {
+			continue
+		}
+
+		err = sendNotification(ctx, Notification{
+			CustomerID: s.CustomerID,
+			Channel:    "email",
+			Template:   template,
+			Data: map[string]interface{}{
+				"next_due_on":    s.NextDueOn,
+				"days_until_due": s.DaysUntilDue,
+			},
+		})
+		if err != nil {
+			servicekit.RequestLogger(ctx).Error("failed to send notification", zap.String("template", template), zap.Error(err))
+		}
+	}
+	return nil
+}
+
+// restrictOverdueKYC restricts the active accounts of every customer whose
+// refresh is overdue past the grace period. Restricted accounts decline
+// authorizations like any other inactive account.
+func restrictOverdueKYC(ctx context.Context) error {
+	rows, err := db.QueryContext(ctx, `SELECT customer_id, next_due_on::text FROM kyc_schedules
+									   WHERE restricted_at IS NULL AND next_due_on < CURRENT_DATE - $1::int`, kycGraceDays())
+	if err != nil {
+		return err
+	}
+	type overdue struct {
+		customerID int
+		nextDueOn  string
+	}
+	var customers []overdue
+	for rows.Next() {
+		var o overdue
+		if err := rows.Scan(&o.customerID, &o.nextDueOn); err != nil {
+			rows.Close()
+			return err
+		}
+		customers = append(customers, o)
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return err
+	}
+
+	for _, o := range customers {
+		if err := restrictCustomerAccounts(ctx, o.customerID); err != nil {
+			servicekit.RequestLogger(ctx).Error("failed to restrict customer accounts", zap.Int("customer_id", o.customerID), zap.Error(err))
+			continue
+		}
+		err = sendNotification(ctx, Notification{
+			CustomerID: o.customerID,
+			Channel:    "email",
+			Template:   "kyc_refresh_restricted",
+			Data:       map[string]interface{}{"next_due_on": o.nextDueOn},
+		})
+		if err != nil {
+			servicekit.RequestLogger(ctx).Error("failed to send notification", zap.String("template", "kyc_refresh_restricted"), zap.Error(err))
+		}
+	}
+	return nil
+}
+
+func restrictCustomerAccounts(ctx context.Context, customerID int) error {
+	tx, err := db.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	result, err := tx.ExecContext(ctx, `UPDATE kyc_schedules SET restricted_at = NOW()
+										WHERE customer_id = $1 AND restricted_at IS NULL`, customerID)
+	if err != nil {
+		return err
+	}
+	if n, _ := result.RowsAffected(); n == 0 {
+		return nil
+	}
+	_, err = tx.ExecContext(ctx, `INSERT INTO kyc_restricted_accounts (account_id, customer_id, previous_status)
+								  SELECT id, customer_id, status FROM accounts
+								  WHERE customer_id = $1 AND status = 'active' FOR UPDATE
+								  ON CONFLICT (account_id) DO NOTHING`, customerID)
+	if err != nil {
+		return err
+	}
+	_, err = tx.ExecContext(ctx, `UPDATE accounts SET status = 'restricted', updated_at = NOW()
+								  WHERE id IN (SELECT account_id FROM kyc_restricted_accounts WHERE customer_id = $1)
+								  AND status = 'active'`, customerID)
+	if err != nil {
+		return err
+	}
+	return tx.Commit()
+}
+
+// setKYCSchedule sets a customer's risk rating and, optionally, the date of
+// their last refresh (defaulting to the one on file, or today for a new
+// customer). Changing the rating recalculates the due date.
+func setKYCSchedule(w http.ResponseWriter, r *http.Request) {
+	if !requireRole(w, r, kycRoles...) {
+		return
+	}
+	customerID, err := strconv.Atoi(mux.Vars(r)["id"])
+	if err != nil {
+		http.Error(w, "Invalid customer ID", http.StatusBadRequest)
+		return
+	}
+
+	var requestBody struct {
+		RiskRating      string `json:"risk_rating"`
+		LastRefreshedOn string `json:"last_refreshed_on"`
+	}
+	err = json.NewDecoder(r.Body).Decode(&requestBody)
+	if err != nil {
+		http.Error(w, "Invalid request body", http.StatusBadRequest)
+		return
+	}
+	if _, ok := kycRefreshYears[requestBody.RiskRating]; !ok {
+		http.Error(w, "risk_rating must be low, medium or high", http.StatusBadRequest)
+		return
+	}
+	if requestBody.LastRefreshedOn != "" {
+		refreshed, err := time.Parse("2006-01-02", requestBody.LastRefreshedOn)
+		if err != nil || refreshed.After(time.Now()) {
+			http.Error(w, "last_refreshed_on must be a past date (YYYY-MM-DD)", http.StatusBadRequest)
+			return
+		}
+	}
+
+	tx, err := db.BeginTx(r.Context(), nil)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	defer tx.Rollback()
+
+	lastRefreshedOn := requestBody.LastRefreshedOn
+	if lastRefreshedOn == "" {
+		err = tx.QueryRowContext(r.Context(), `SELECT COALESCE((SELECT last_refreshed_on::text FROM kyc_schedules
+											   WHERE customer_id = $1), CURRENT_DATE::text)`, customerID).Scan(&lastRefreshedOn)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+	}
+
+	if err := saveKYCSchedule(r.Context(), tx, customerID, requestBody.RiskRating, lastRefreshedOn, requestActor(r)); err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	if err := tx.Commit(); err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	writeKYCSchedule(w, r, customerID, http.StatusOK)
+}
+
+// recordKYCRefresh records a completed refresh, starting a new cycle and
+// lifting any restriction. The risk rating is re-assessed at each refresh and
+// defaults to the current one.
+func recordKYCRefresh(w http.ResponseWriter, r *http.Request) {
+	if !requireRole(w, r, kycRoles...) {
+		return
+	}
+	customerID, err := strconv.Atoi(mux.Vars(r)["id"])
+	if err != nil {
+		http.Error(w, "Invalid customer ID", http.StatusBadRequest)
+		return
+	}
+
+	var requestBody struct {
+		RiskRating string `json:"risk_rating"`
+		Reference  string `json:"reference"`
+	}
+	err = json.NewDecoder(r.Body).Decode(&requestBody)
+	if err != nil {
+		http.Error(w, "Invalid request body", http.StatusBadRequest)
+		return
+	}
+	if requestBody.Reference == "" {
+		http.Error(w, "reference is required", http.StatusBadRequest)
+		return
+	}
+
+	tx, err := db.BeginTx(r.Context(), nil)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	defer tx.Rollback()
+
+	rating := requestBody.RiskRating
+	if rating == "" {
+		err = tx.QueryRowContext(r.Context(), `SELECT risk_rating FROM kyc_schedules WHERE customer_id = $1`,
+			customerID).Scan(&rating)
+		if err == sql.ErrNoRows {
+			http.Error(w, "risk_rating is required for a customer without a KYC schedule", http.StatusBadRequest)
+			return
+		}
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+	}
+	if _, ok := kycRefreshYears[rating]; !ok {
+		http.Error(w, "risk_rating must be low, medium or high", http.StatusBadRequest)
+		return
+	}
+
+	_, err = tx.ExecContext(r.Context(), `INSERT INTO kyc_refreshes (customer_id, risk_rating, refreshed_on, reference,
+										  completed_by) VALUES ($1, $2, CURRENT_DATE, $3, $4)`,
+		customerID, rating, requestBody.Reference, requestActor(r))
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	today := time.Now().Format("2006-01-02")
+	if err := saveKYCSchedule(r.Context(), tx, customerID, rating, today, requestActor(r)); err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	if err := tx.Commit(); err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	writeKYCSchedule(w, r, customerID, http.StatusCreated)
+}
+
+// saveKYCSchedule upserts the schedule, restarting reminders when the due date
+// moves, and lifts any restriction once the refresh is within the grace period
+func saveKYCSchedule(ctx context.Context, tx *sql.Tx, customerID int, rating, lastRefreshedOn, actor string) error {
+	var stillOverdue bool
+	err := tx.QueryRowContext(ctx, `INSERT INTO kyc_schedules (customer_id, risk_rating, last_refreshed_on, next_due_on,
+									updated_by)
+									VALUES ($1, $2, $3::date, $3::date + make_interval(years => $4), $5)
+									ON CONFLICT (customer_id) DO UPDATE SET risk_rating = EXCLUDED.risk_rating,
+										last_refreshed_on = EXCLUDED.last_refreshed_on, next_due_on = EXCLUDED.next_due_on,
+										updated_by = EXCLUDED.updated_by, updated_at = NOW(),
+										reminder_level = CASE WHEN kyc_schedules.next_due_on = EXCLUDED.next_due_on
+											THEN kyc_schedules.reminder_level ELSE 0 END
+									RETURNING next_due_on < CURRENT_DATE - $6::int`,
+		customerID, rating, lastRefreshedOn, kycRefreshYears[rating], actor, kycGraceDays()).Scan(&stillOverdue)
+	if err != nil {
+		return err
+	}
+	if stillOverdue {
+		return nil
+	}
+	return liftKYCRestriction(ctx, tx, customerID)
+}
+
+func writeKYCSchedule(w http.ResponseWriter, r *http.Request, customerID int, status int) {
+	var s KYCSchedule
+	err := scanKYCSchedule(db.QueryRowContext(r.Context(), `SELECT `+kycScheduleColumns+` FROM kyc_schedules
+											  WHERE customer_id = $1`, customerID), &s)
+	if err == sql.ErrNoRows {
+		http.Error(w, "KYC schedule not found", http.StatusNotFound)
+		return
+	}
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	rows, err := db.QueryContext(r.Context(), `SELECT id, customer_id, risk_rating, refreshed_on::text, reference,
+											   completed_by, created_at FROM kyc_refreshes
+											   WHERE customer_id = $1 ORDER BY id DESC`, customerID)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	defer rows.Close()
+	s.Refreshes = []KYCRefresh{}
+	for rows.Next() {
+		var k KYCRefresh
+		if err := rows.Scan(&k.ID, &k.CustomerID, &k.RiskRating, &k.RefreshedOn, &k.Reference, &k.CompletedBy,
+			&k.CreatedAt); err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		s.Refreshes = append(s.Refreshes, k)
+	}
+	if err := rows.Err(); err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(s)
+}
+
+// getKYCSchedule returns a customer's KYC schedule and refresh history
+func getKYCSchedule(w http.ResponseWriter, r *http.Request) {
+	customerID, err := strconv.Atoi(mux.Vars(r)["id"])
+	if err != nil {
+		http.Error(w, "Invalid customer ID", http.StatusBadRequest)
+		return
+	}
+	writeKYCSchedule(w, r, customerID, http.StatusOK)
+}
+
+// getKYCRefreshDashboard lists refreshes that are restricted, overdue or due
+// within ?within_days= (default 90, max 730), soonest first, with counts by
+// status and risk rating (?risk_rating= filters)
+func getKYCRefreshDashboard(w http.ResponseWriter, r *http.Request) {
+	if !requireRole(w, r, kycRoles...) {
+		return
+	}
+
+	query := r.URL.Query()
+	withinDays := 90
+	if v := query.Get("within_days"); v != "" {
+		days, err := strconv.Atoi(v)
+		if err != nil || days < 0 || days > 730 {
+			http.Error(w, "within_days must be between 0 and 730", http.StatusBadRequest)
+			return
+		}
+		withinDays = days
+	}
+	rating := query.Get("risk_rating")
+	if _, ok := kycRefreshYears[rating]; rating != "" && !ok {
+		http.Error(w, "risk_rating must be low, medium or high", http.StatusBadRequest)
+		return
+	}
+
+	rows, err := db.QueryContext(r.Context(), `SELECT `+kycScheduleColumns+` FROM kyc_schedules
+											   WHERE next_due_on <= CURRENT_DATE + $1::int AND ($2 = '' OR risk_rating = $2)
+											   ORDER BY next_due_on, customer_id LIMIT 500`, withinDays, rating)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	defer rows.Close()
+
+	upcoming := []KYCSchedule{}
+	byStatus := map[string]int{}
+	byRating := map[string]int{}
+	for rows.Next() {
+		var s KYCSchedule
+		if err := scanKYCSchedule(rows, &s); err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		upcoming = append(upcoming, s)
+		byStatus[s.Status]++
+		byRating[s.RiskRating]++
+	}
+	if err := rows.Err(); err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"within_days": withinDays,
+		"grace_days":  kycGraceDays(),
+		"by_status":   byStatus,
+		"by_rating":   byRating,
+		"refreshes":   upcoming,
+	})
+}
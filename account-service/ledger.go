@@ -0,0 +1,83 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"net/http"
+
+	"bank/servicekit"
+)
+
+// LedgerPosting is a balance movement recorded by the transaction service. A
+// nil account is the bank's side of the movement.
+type LedgerPosting struct {
+	Type                 string `json:"transaction_type"`
+	Amount               Money  `json:"amount"`
+	CurrencyCode         string `json:"currency_code"`
+	SourceAccountID      *int   `json:"source_account_id,omitempty"`
+	DestinationAccountID *int   `json:"destination_account_id,omitempty"`
+	GLAccount            string `json:"gl_account,omitempty"` // the bank's side; the transaction service defaults it
+	Description          string `json:"description"`
+	Reference            string `json:"reference"` // the transaction service records each reference once
+}
+
+// GL accounts of the bank's side of interest and fees, which profitability
+// reports are built from
+const (
+	glInterestIncome  = "interest_income"
+	glInterestExpense = "interest_expense"
+	glFeeIncome       = "fee_income"
+)
+
+var ErrLedgerPosting = errors.New("Ledger posting failed")
+
+// ledgerPostingEvent is the outbox event type of ledger postings, which the
+// relay sends to the transaction service instead of the broker
+const ledgerPostingEvent = "ledger.posting"
+
+// recordInLedger queues a movement for the transaction service, which keeps
+// it as a debit/credit pair. The posting is written to the outbox inside tx,
+// so it reaches the ledger only if tx commits, and it carries a reference the
+// ledger records once however often the relay delivers it.
+func recordInLedger(ctx context.Context, tx *sql.Tx, posting LedgerPosting) error {
+	if posting.Reference == "" {
+		posting.Reference = "LP-" + servicekit.NewCorrelationID()
+	}
+	return enqueueEvent(ctx, tx, ledgerPostingEvent, "ledger", posting)
+}
+
+// sendToLedger delivers a queued posting to the transaction service
+func sendToLedger(ctx context.Context, payload []byte) error {
+	url := getEnv("TRANSACTION_SERVICE_URL", "http://localhost:8081") + "/v1/transactions"
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, url, bytes.NewReader(payload))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+
+	resp, err := serviceClient.Do(req)
+	if err != nil {
+		return fmt.Errorf("%w: %v", ErrLedgerPosting, err)
+	}
+	resp.Body.Close()
+	// 200 answers a reference the ledger already recorded
+	if resp.StatusCode != http.StatusCreated && resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("%w: status %d", ErrLedgerPosting, resp.StatusCode)
+	}
+	return nil
+}
+
+// ledgerChange is the posting for a single-account credit (positive amount)
+// or debit (negative amount)
+func ledgerChange(accountID int, amount Money, currency, description string) LedgerPosting {
+	posting := LedgerPosting{Type: "credit", Amount: amount, CurrencyCode: currency, Description: description,
+		DestinationAccountID: &accountID}
+	if amount < 0 {
+		posting = LedgerPosting{Type: "debit", Amount: -amount, CurrencyCode: currency, Description: description,
+			SourceAccountID: &accountID}
+	}
+	return posting
+}
@@ -0,0 +1,333 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"regexp"
+	"strings"
+
+	"bank/servicekit"
+
+	"github.com/gorilla/mux"
+	"go.uber.org/zap"
+)
+
+// LedgerAdjustment is a manual credit or debit to an account, balanced in the
+// ledger against a GL contra account. Operations request it; it posts only
+// once a second person approves it, so corrections never need direct SQL.
+type LedgerAdjustment struct {
+	ID           int    `json:"id"`
+	AccountID    int    `json:"account_id"`
+	Direction    string `json:"direction"` // credit or debit, from the customer's side
+	Amount       Money  `json:"amount"`
+	CurrencyCode string `json:"currency_code"`
+	GLAccount    string `json:"gl_account"`
+	ReasonCode   string `json:"reason_code"`
+	Note         string `json:"note"`
+	Reference    string `json:"reference,omitempty"`
+	Status       string `json:"status"` // pending, completed or rejected
+	RequestedBy  string `json:"requested_by"`
+	ReviewedBy   string `json:"reviewed_by,omitempty"`
+	ReviewNote   string `json:"review_note,omitempty"`
+	CreatedAt    string `json:"created_at"`
+	ResolvedAt   string `json:"resolved_at,omitempty"`
+}
+
+// ledgerAdjusterRoles request adjustments; ledgerApproverRoles review them
+var (
+	ledgerAdjusterRoles = []string{"operations", "operations_supervisor", "admin"}
+	ledgerApproverRoles = []string{"operations_supervisor", "admin"}
+)
+
+var ledgerAdjustmentReasons = map[string]bool{
+	"posting_error":       true,
+	"duplicate_posting":   true,
+	"fee_reversal":        true,
+	"interest_correction": true,
+	"goodwill":            true,
+	"fraud_recovery":      true,
+	"migration_fix":       true,
+}
+
+var glAccountPattern = regexp.MustCompile(`^[a-z0-9_.:-]{1,30}$`)
+
+// ledgerAdjustmentGLAccounts are the contra accounts an adjustment may post
+// against, from LEDGER_ADJUSTMENT_GL_ACCOUNTS
+func ledgerAdjustmentGLAccounts() map[string]bool {
+	accounts := map[string]bool{}
+	list := getEnv("LEDGER_ADJUSTMENT_GL_ACCOUNTS", "suspense,operational_losses,fee_income,interest_income,interest_expense")
+	for _, account := range strings.Split(list, ",") {
+		if account = strings.TrimSpace(account); glAccountPattern.MatchString(account) {
+			accounts[account] = true
+		}
+	}
+	return accounts
+}
+
+const ledgerAdjustmentColumns = `id, account_id, direction, amount, currency_code, gl_account, reason_code, note,
+	reference, status, requested_by, COALESCE(reviewed_by, ''), review_note, created_at::text,
+	COALESCE(resolved_at::text, '')`
+
+func scanLedgerAdjustment(row interface{ Scan(...interface{}) error }, a *LedgerAdjustment) error {
+	return row.Scan(&a.ID, &a.AccountID, &a.Direction, &a.Amount, &a.CurrencyCode, &a.GLAccount, &a.ReasonCode,
+		&a.Note, &a.Reference, &a.Status, &a.RequestedBy, &a.ReviewedBy, &a.ReviewNote, &a.CreatedAt, &a.ResolvedAt)
+}
+
+// requestLedgerAdjustment records a pending adjustment in the account's currency
+func requestLedgerAdjustment(w http.ResponseWriter, r *http.Request) {
+	if !requireRole(w, r, ledgerAdjusterRoles...) {
+		return
+	}
+
+	var a LedgerAdjustment
+	err := json.NewDecoder(r.Body).Decode(&a)
+	if err != nil {
+		http.Error(w, "Invalid request body", http.StatusBadRequest)
+		return
+	}
+	a.Direction = strings.ToLower(strings.TrimSpace(a.Direction))
+	a.GLAccount = strings.TrimSpace(a.GLAccount)
+	a.Note = strings.TrimSpace(a.Note)
+	a.Reference = strings.TrimSpace(a.Reference)
+	if a.Direction != "credit" && a.Direction != "debit" {
+		http.Error(w, "direction must be credit or debit", http.StatusBadRequest)
+		return
+	}
+	if a.Amount <= 0 {
+		http.Error(w, "Amount must be positive", http.StatusBadRequest)
+		return
+	}
+	if !ledgerAdjustmentGLAccounts()[a.GLAccount] {
+		http.Error(w, "gl_account is not an adjustment contra account", http.StatusBadRequest)
+		return
+	}
+	if !ledgerAdjustmentReasons[a.ReasonCode] {
+		http.Error(w, "Unknown reason_code", http.StatusBadRequest)
+		return
+	}
+	if a.Note == "" {
+		http.Error(w, "note is required", http.StatusBadRequest)
+		return
+	}
+	if len(a.Reference) > 100 {
+		http.Error(w, "reference must be at most 100 characters", http.StatusBadRequest)
+		return
+	}
+
+	a.RequestedBy = requestActor(r)
+	err = scanLedgerAdjustment(db.QueryRowContext(r.Context(), `INSERT INTO ledger_adjustments (account_id, direction,
+											amount, currency_code, gl_account, reason_code, note, reference, requested_by)
+											SELECT id, $2, $3, currency_code, $4, $5, $6, $7, $8 FROM accounts
+											WHERE id = $1 AND status <> 'closed'
+											RETURNING `+ledgerAdjustmentColumns,
+		mux.Vars(r)["id"], a.Direction, a.Amount, a.GLAccount, a.ReasonCode, a.Note, a.Reference, a.RequestedBy), &a)
+	if err != nil {
+		if err == sql.ErrNoRows {
+			http.Error(w, "Account not found or closed", http.StatusNotFound)
+		} else {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+		}
+		return
+	}
+
+	servicekit.RequestLogger(r.Context()).Info("ledger adjustment requested", zap.Int("adjustment_id", a.ID),
+		zap.Int("account_id", a.AccountID), zap.String("direction", a.Direction),
+		zap.String("amount", a.Amount.String()), zap.String("gl_account", a.GLAccount),
+		zap.String("reason_code", a.ReasonCode), zap.String("requested_by", a.RequestedBy))
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusCreated)
+	json.NewEncoder(w).Encode(a)
+}
+
+// listLedgerAdjustments lists adjustments, newest first, optionally filtered
+// by account_id and status (e.g. the pending review queue)
+func listLedgerAdjustments(w http.ResponseWriter, r *http.Request) {
+	if !requireRole(w, r, ledgerAdjusterRoles...) {
+		return
+	}
+
+	accountID := mux.Vars(r)["id"]
+	if accountID == "" {
+		accountID = r.URL.Query().Get("account_id")
+	}
+	rows, err := db.QueryContext(r.Context(), `SELECT `+ledgerAdjustmentColumns+` FROM ledger_adjustments
+											   WHERE ($1 = '' OR account_id::text = $1) AND ($2 = '' OR status = $2)
+											   ORDER BY created_at DESC LIMIT 500`, accountID, r.URL.Query().Get("status"))
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	defer rows.Close()
+
+	adjustments := []LedgerAdjustment{}
+	for rows.Next() {
+		var a LedgerAdjustment
+		if err := scanLedgerAdjustment(rows, &a); err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		adjustments = append(adjustments, a)
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(adjustments)
+}
+
+func getLedgerAdjustment(w http.ResponseWriter, r *http.Request) {
+	if !requireRole(w, r, ledgerAdjusterRoles...) {
+		return
+	}
+
+	var a LedgerAdjustment
+	err := scanLedgerAdjustment(db.QueryRowContext(r.Context(), `SELECT `+ledgerAdjustmentColumns+`
+											FROM ledger_adjustments WHERE id = $1`, mux.Vars(r)["id"]), &a)
+	if err != nil {
+		if err == sql.ErrNoRows {
+			http.Error(w, "Ledger adjustment not found", http.StatusNotFound)
+		} else {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+		}
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(a)
+}
+
+func approveLedgerAdjustment(w http.ResponseWriter, r *http.Request) {
+	reviewLedgerAdjustment(w, r, true)
+}
+
+func rejectLedgerAdjustment(w http.ResponseWriter, r *http.Request) {
+	reviewLedgerAdjustment(w, r, false)
+}
+
+// reviewLedgerAdjustment posts or rejects a pending adjustment. The reviewer
+// must be an approver other than the requester.
+func reviewLedgerAdjustment(w http.ResponseWriter, r *http.Request, approve bool) {
+	if !requireRole(w, r, ledgerApproverRoles...) {
+		return
+	}
+
+	var req struct {
+		Note string `json:"note"`
+	}
+	if r.ContentLength != 0 {
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			http.Error(w, "Invalid request body", http.StatusBadRequest)
+			return
+		}
+	}
+	req.Note = strings.TrimSpace(req.Note)
+	if !approve && req.Note == "" {
+		http.Error(w, "note is required to reject an adjustment", http.StatusBadRequest)
+		return
+	}
+
+	tx, err := db.BeginTx(r.Context(), nil)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	defer tx.Rollback()
+
+	var a LedgerAdjustment
+	err = scanLedgerAdjustment(tx.QueryRowContext(r.Context(), `SELECT `+ledgerAdjustmentColumns+`
+											FROM ledger_adjustments WHERE id = $1 FOR UPDATE`, mux.Vars(r)["id"]), &a)
+	if err != nil {
+		if err == sql.ErrNoRows {
+			http.Error(w, "Ledger adjustment not found", http.StatusNotFound)
+		} else {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+		}
+		return
+	}
+	if a.Status != "pending" {
+		http.Error(w, fmt.Sprintf("Ledger adjustment is already %s", a.Status), http.StatusConflict)
+		return
+	}
+	// Whatever the separation of duties policies say, nobody reviews their own
+	// adjustment
+	if a.RequestedBy == requestActor(r) {
+		http.Error(w, "The user who requested an adjustment cannot review it", http.StatusForbidden)
+		return
+	}
+	if !enforceMakerChecker(w, r, "ledger_adjustment.review", fmt.Sprintf("ledger_adjustment:%d", a.ID), a.AccountID,
+		map[string]string{"ledger_adjustment.request": a.RequestedBy}) {
+		return
+	}
+	a.ReviewedBy = requestActor(r)
+
+	a.Status = "rejected"
+	if approve {
+		a.Status = "completed"
+		if err := postLedgerAdjustment(r.Context(), tx, a); err != nil {
+			writeTransferError(w, err)
+			return
+		}
+	}
+
+	err = tx.QueryRowContext(r.Context(), `UPDATE ledger_adjustments SET status = $2, reviewed_by = $3, review_note = $4,
+										   resolved_at = NOW() WHERE id = $1 RETURNING resolved_at::text`,
+		a.ID, a.Status, a.ReviewedBy, req.Note).Scan(&a.ResolvedAt)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	a.ReviewNote = req.Note
+
+	err = tx.Commit()
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	servicekit.RequestLogger(r.Context()).Info("ledger adjustment reviewed", zap.Int("adjustment_id", a.ID),
+		zap.Int("account_id", a.AccountID), zap.String("status", a.Status),
+		zap.String("requested_by", a.RequestedBy), zap.String("reviewed_by", a.ReviewedBy))
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(a)
+}
+
+// postLedgerAdjustment applies an approved adjustment inside tx. Unlike
+// postBalanceChange it also reaches frozen and restricted accounts and
+// ignores liens, as a correction is not the customer spending; the overdraft
+// constraint still bounds debits. The ledger pairs the movement with the
+// adjustment's GL account.
+func postLedgerAdjustment(ctx context.Context, tx *sql.Tx, a LedgerAdjustment) error {
+	var status string
+	err := tx.QueryRowContext(ctx, `SELECT status FROM accounts WHERE id = $1 FOR UPDATE`, a.AccountID).Scan(&status)
+	if err == sql.ErrNoRows {
+		return ErrTransferAccountNotFound
+	}
+	if err != nil {
+		return err
+	}
+	if status == "closed" {
+		return ErrTransferAccountInactive
+	}
+
+	amount := a.Amount
+	if a.Direction == "debit" {
+		amount = -amount
+	}
+	_, err = tx.ExecContext(ctx, `UPDATE accounts SET balance = balance + $1, updated_at = NOW() WHERE id = $2`,
+		amount, a.AccountID)
+	if err != nil {
+		return balanceUpdateError(err)
+	}
+
+	description := fmt.Sprintf("Ledger adjustment %d (%s)", a.ID, a.ReasonCode)
+	err = queueCorePosting(ctx, tx, CorePosting{AccountID: a.AccountID, Amount: amount, Currency: a.CurrencyCode,
+		Description: description})
+	if err != nil {
+		return err
+	}
+	posting := ledgerChange(a.AccountID, amount, a.CurrencyCode, description)
+	posting.Type = "adjustment"
+	posting.GLAccount = a.GLAccount
+	return recordInLedger(ctx, tx, posting)
+}
@@ -0,0 +1,404 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+
+	"bank/servicekit"
+
+	"github.com/gorilla/mux"
+	"go.uber.org/zap"
+)
+
+// LegalOrder is a court-ordered hold or levy served on an account. Both freeze
+// the ordered amount with a lien; a levy is then swept to a GL account.
+type LegalOrder struct {
+	ID                 int    `json:"id"`
+	AccountID          int    `json:"account_id"`
+	OrderType          string `json:"order_type"` // hold or levy
+	CaseReference      string `json:"case_reference"`
+	IssuingAuthority   string `json:"issuing_authority"`
+	DocumentReference  string `json:"document_reference,omitempty"`
+	Amount             Money  `json:"amount"`
+	SweptAmount        Money  `json:"swept_amount"`
+	GLAccountID        int    `json:"gl_account_id,omitempty"`
+	LienID             int    `json:"lien_id,omitempty"`
+	Status             string `json:"status"` // held, swept or released
+	ExpiresAt          string `json:"expires_at,omitempty"`
+	CreatedBy          string `json:"created_by"`
+	CreatedAt          string `json:"created_at"`
+	ResolvedAt         string `json:"resolved_at,omitempty"`
+	CustomerNotifiedAt string `json:"customer_notified_at,omitempty"`
+}
+
+const legalOrderTablesSQL = `
+	CREATE TABLE IF NOT EXISTS legal_orders (
+		id SERIAL PRIMARY KEY,
+		account_id INTEGER NOT NULL REFERENCES accounts(id),
+		order_type VARCHAR(10) NOT NULL,
+		case_reference VARCHAR(100) NOT NULL,
+		issuing_authority VARCHAR(200) NOT NULL,
+		document_reference VARCHAR(255) NOT NULL DEFAULT '',
+		amount DECIMAL(15,2) NOT NULL,
+		swept_amount DECIMAL(15,2) NOT NULL DEFAULT 0,
+		gl_account_id INTEGER REFERENCES accounts(id),
+		lien_id INTEGER REFERENCES liens(id),
+		status VARCHAR(20) NOT NULL DEFAULT 'held',
+		created_by VARCHAR(100) NOT NULL,
+		created_at TIMESTAMP NOT NULL DEFAULT NOW(),
+		resolved_at TIMESTAMP,
+		customer_notified_at TIMESTAMP
+	);`
+
+// legalOrderRoles may serve, sweep and release legal orders
+var legalOrderRoles = []string{"legal", "compliance", "admin"}
+
+const legalOrderColumns = `o.id, o.account_id, o.order_type, o.case_reference, o.issuing_authority, o.document_reference,
+	o.amount, o.swept_amount, COALESCE(o.gl_account_id, 0), COALESCE(o.lien_id, 0), o.status,
+	COALESCE(l.expires_at::text, ''), o.created_by, o.created_at, COALESCE(o.resolved_at::text, ''),
+	COALESCE(o.customer_notified_at::text, '')`
+
+const legalOrderFrom = ` FROM legal_orders o LEFT JOIN liens l ON l.id = o.lien_id`
+
+func scanLegalOrder(row interface{ Scan(...interface{}) error }, o *LegalOrder) error {
+	return row.Scan(&o.ID, &o.AccountID, &o.OrderType, &o.CaseReference, &o.IssuingAuthority, &o.DocumentReference,
+		&o.Amount, &o.SweptAmount, &o.GLAccountID, &o.LienID, &o.Status, &o.ExpiresAt, &o.CreatedBy, &o.CreatedAt,
+		&o.ResolvedAt, &o.CustomerNotifiedAt)
+}
+
+// serveLegalOrder records a hold or levy and freezes the ordered amount
+func serveLegalOrder(w http.ResponseWriter, r *http.Request) {
+	if !requireRole(w, r, legalOrderRoles...) {
+		return
+	}
+
+	var o LegalOrder
+	err := json.NewDecoder(r.Body).Decode(&o)
+	if err != nil {
+		http.Error(w, "Invalid request body", http.StatusBadRequest)
+		return
+	}
+
+	o.CaseReference = strings.TrimSpace(o.CaseReference)
+	o.IssuingAuthority = strings.TrimSpace(o.IssuingAuthority)
+	if o.OrderType != "hold" && o.OrderType != "levy" {
+		http.Error(w, "order_type must be hold or levy", http.StatusBadRequest)
+		return
+	}
+	if o.Amount <= 0 {
+		http.Error(w, "Amount must be positive", http.StatusBadRequest)
+		return
+	}
+	if o.CaseReference == "" || o.IssuingAuthority == "" {
+		http.Error(w, "case_reference and issuing_authority are required", http.StatusBadRequest)
+		return
+	}
+	if o.OrderType == "levy" && o.GLAccountID == 0 {
+		o.GLAccountID, _ = strconv.Atoi(getEnv("LEGAL_ORDER_GL_ACCOUNT_ID", "0"))
+		if o.GLAccountID == 0 {
+			http.Error(w, "gl_account_id is required for a levy", http.StatusBadRequest)
+			return
+		}
+	}
+	expiresAt, err := parseLienExpiry(o.ExpiresAt)
+	if err != nil {
+		http.Error(w, "expires_at must be a future RFC 3339 timestamp or YYYY-MM-DD date", http.StatusBadRequest)
+		return
+	}
+	o.AccountID, err = strconv.Atoi(mux.Vars(r)["id"])
+	if err != nil {
+		http.Error(w, "Invalid account ID", http.StatusBadRequest)
+		return
+	}
+
+	tx, err := db.BeginTx(r.Context(), nil)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	defer tx.Rollback()
+
+	lien := Lien{AccountID: o.AccountID, Amount: o.Amount, Reason: "legal_order", Reference: o.CaseReference,
+		CreatedBy: requestActor(r)}
+	err = insertLien(r.Context(), tx, &lien, expiresAt)
+	if err != nil {
+		if err == sql.ErrNoRows {
+			http.Error(w, "Account not found", http.StatusNotFound)
+		} else {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+		}
+		return
+	}
+
+	var glAccountID interface{}
+	if o.GLAccountID != 0 {
+		glAccountID = o.GLAccountID
+	}
+	err = tx.QueryRowContext(r.Context(), `INSERT INTO legal_orders (account_id, order_type, case_reference, issuing_authority,
+								  document_reference, amount, gl_account_id, lien_id, created_by)
+								  VALUES ($1, $2, $3, $4, $5, $6, $7, $8, $9) RETURNING id`,
+		o.AccountID, o.OrderType, o.CaseReference, o.IssuingAuthority, strings.TrimSpace(o.DocumentReference), o.Amount,
+		glAccountID, lien.ID, lien.CreatedBy).Scan(&o.ID)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	err = tx.Commit()
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	o = notifyLegalOrder(r.Context(), o.ID, "legal_order_served")
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusCreated)
+	json.NewEncoder(w).Encode(o)
+}
+
+func listLegalOrders(w http.ResponseWriter, r *http.Request) {
+	rows, err := db.QueryContext(r.Context(), `SELECT `+legalOrderColumns+legalOrderFrom+`
+											   WHERE o.account_id = $1 ORDER BY o.created_at DESC`, mux.Vars(r)["id"])
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	defer rows.Close()
+
+	orders := []LegalOrder{}
+	for rows.Next() {
+		var o LegalOrder
+		if err := scanLegalOrder(rows, &o); err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		orders = append(orders, o)
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(orders)
+}
+
+func getLegalOrder(w http.ResponseWriter, r *http.Request) {
+	var o LegalOrder
+	err := scanLegalOrder(db.QueryRowContext(r.Context(), `SELECT `+legalOrderColumns+legalOrderFrom+` WHERE o.id = $1`,
+		mux.Vars(r)["id"]), &o)
+	if err != nil {
+		if err == sql.ErrNoRows {
+			http.Error(w, "Legal order not found", http.StatusNotFound)
+		} else {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+		}
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(o)
+}
+
+// sweepLegalOrder moves the levied amount to the GL account. When the account
+// cannot cover the levy in full, the outstanding amount stays frozen so a
+// later sweep can collect it.
+func sweepLegalOrder(w http.ResponseWriter, r *http.Request) {
+	if !requireRole(w, r, legalOrderRoles...) {
+		return
+	}
+
+	tx, err := db.BeginTx(r.Context(), nil)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	defer tx.Rollback()
+
+	o, ok := lockLegalOrder(w, r, tx)
+	if !ok {
+		return
+	}
+	if o.OrderType != "levy" {
+		http.Error(w, "Only a levy can be swept", http.StatusConflict)
+		return
+	}
+
+	var balance Money
+	err = tx.QueryRowContext(r.Context(), `SELECT balance FROM accounts WHERE id = $1 FOR UPDATE`, o.AccountID).Scan(&balance)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	// Free this order's lien so only other holds limit the sweep
+	actor := requestActor(r)
+	_, err = changeLien(r.Context(), tx, o.LienID, "released", actor, "Swept under "+o.CaseReference,
+		`status = 'released', released_at = NOW()`)
+	if err != nil && err != sql.ErrNoRows {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	otherLiens, err := activeLienTotal(r.Context(), tx, o.AccountID)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	outstanding := o.Amount - o.SweptAmount
+	amount := balance - otherLiens
+	if amount > outstanding {
+		amount = outstanding
+	}
+	if amount <= 0 {
+		http.Error(w, "No funds available to sweep", http.StatusConflict)
+		return
+	}
+
+	err = internalTransfer(r.Context(), tx, o.AccountID, o.GLAccountID, amount,
+		fmt.Sprintf("Legal order levy %s", o.CaseReference))
+	if err != nil {
+		writeTransferError(w, err)
+		return
+	}
+
+	status, lienID := "swept", interface{}(nil)
+	if remaining := outstanding - amount; remaining > 0 {
+		lien := Lien{AccountID: o.AccountID, Amount: remaining, Reason: "legal_order",
+			Reference: o.CaseReference, CreatedBy: actor}
+		if err := insertLien(r.Context(), tx, &lien, nil); err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		status, lienID = "held", lien.ID
+	}
+
+	_, err = tx.ExecContext(r.Context(), `UPDATE legal_orders SET swept_amount = swept_amount + $2, status = $3,
+										  lien_id = COALESCE($4, lien_id),
+										  resolved_at = CASE WHEN $5 THEN NOW() END
+										  WHERE id = $1`, o.ID, amount, status, lienID, status == "swept")
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	err = tx.Commit()
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	o = notifyLegalOrder(r.Context(), o.ID, "legal_order_swept")
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(o)
+}
+
+// releaseLegalOrder lifts the order once it is discharged by the issuing authority
+func releaseLegalOrder(w http.ResponseWriter, r *http.Request) {
+	if !requireRole(w, r, legalOrderRoles...) {
+		return
+	}
+
+	var requestBody struct {
+		Note string `json:"note"`
+	}
+	err := json.NewDecoder(r.Body).Decode(&requestBody)
+	if err != nil {
+		http.Error(w, "Invalid request body", http.StatusBadRequest)
+		return
+	}
+
+	tx, err := db.BeginTx(r.Context(), nil)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	defer tx.Rollback()
+
+	o, ok := lockLegalOrder(w, r, tx)
+	if !ok {
+		return
+	}
+
+	_, err = changeLien(r.Context(), tx, o.LienID, "released", requestActor(r), requestBody.Note,
+		`status = 'released', released_at = NOW()`)
+	if err != nil && err != sql.ErrNoRows {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	_, err = tx.ExecContext(r.Context(), `UPDATE legal_orders SET status = 'released', resolved_at = NOW() WHERE id = $1`, o.ID)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	err = tx.Commit()
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	o = notifyLegalOrder(r.Context(), o.ID, "legal_order_released")
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(o)
+}
+
+// lockLegalOrder loads an open order for update, writing the error response if it cannot
+func lockLegalOrder(w http.ResponseWriter, r *http.Request, tx *sql.Tx) (LegalOrder, bool) {
+	var o LegalOrder
+	err := scanLegalOrder(tx.QueryRowContext(r.Context(), `SELECT `+legalOrderColumns+legalOrderFrom+`
+								  WHERE o.id = $1 FOR UPDATE OF o`, mux.Vars(r)["id"]), &o)
+	if err != nil {
+		if err == sql.ErrNoRows {
+			http.Error(w, "Legal order not found", http.StatusNotFound)
+		} else {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+		}
+		return o, false
+	}
+	if o.Status != "held" {
+		http.Error(w, fmt.Sprintf("Legal order is already %s", o.Status), http.StatusConflict)
+		return o, false
+	}
+	return o, true
+}
+
+// notifyLegalOrder informs the account holder of the order and the case it
+// relates to, records when they were notified and returns the current order
+func notifyLegalOrder(ctx context.Context, id int, template string) LegalOrder {
+	var o LegalOrder
+	var customerID int
+	err := scanLegalOrder(db.QueryRowContext(ctx, `SELECT `+legalOrderColumns+legalOrderFrom+` WHERE o.id = $1`, id), &o)
+	if err == nil {
+		err = db.QueryRowContext(ctx, "SELECT customer_id FROM accounts WHERE id = $1", o.AccountID).Scan(&customerID)
+	}
+	if err == nil {
+		err = sendNotification(ctx, Notification{
+			CustomerID: customerID,
+			Channel:    "push",
+			Template:   template,
+			Data: map[string]interface{}{
+				"legal_order_id":    o.ID,
+				"account_id":        o.AccountID,
+				"order_type":        o.OrderType,
+				"case_reference":    o.CaseReference,
+				"issuing_authority": o.IssuingAuthority,
+				"amount":            o.Amount,
+				"swept_amount":      o.SweptAmount,
+				"status":            o.Status,
+			},
+		})
+	}
+	if err != nil {
+		servicekit.RequestLogger(ctx).Error("failed to send notification", zap.String("template", template), zap.Error(err))
+		return o
+	}
+
+	err = db.QueryRowContext(ctx, `UPDATE legal_orders SET customer_notified_at = NOW() WHERE id = $1
+								  RETURNING customer_notified_at::text`, id).Scan(&o.CustomerNotifiedAt)
+	if err != nil {
+		servicekit.RequestLogger(ctx).Error("failed to record legal order notification", zap.Int("legal_order_id", id), zap.Error(err))
+	}
+	return o
+}
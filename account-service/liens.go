@@ -0,0 +1,378 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"bank/servicekit"
+
+	"github.com/gorilla/mux"
+)
+
+// Lien earmarks part of an account balance for loan collateral or a legal
+// order. Active liens reduce the available balance until they are released
+// or expire.
+type Lien struct {
+	ID         int    `json:"id"`
+	AccountID  int    `json:"account_id"`
+	Amount     Money  `json:"amount"`
+	Reason     string `json:"reason"` // loan_collateral or legal_order
+	Reference  string `json:"reference"`
+	Status     string `json:"status"` // active, released or expired
+	ExpiresAt  string `json:"expires_at,omitempty"`
+	CreatedBy  string `json:"created_by"`
+	CreatedAt  string `json:"created_at"`
+	ReleasedAt string `json:"released_at,omitempty"`
+}
+
+// LienEvent is one entry of a lien's audit trail
+type LienEvent struct {
+	Event     string `json:"event"` // placed, amended, released or expired
+	Amount    Money  `json:"amount"`
+	ExpiresAt string `json:"expires_at,omitempty"`
+	Actor     string `json:"actor"`
+	Note      string `json:"note,omitempty"`
+	CreatedAt string `json:"created_at"`
+}
+
+const lienTablesSQL = `
+	CREATE TABLE IF NOT EXISTS liens (
+		id SERIAL PRIMARY KEY,
+		account_id INTEGER NOT NULL REFERENCES accounts(id),
+		amount DECIMAL(15,2) NOT NULL,
+		reason VARCHAR(20) NOT NULL,
+		reference VARCHAR(100) NOT NULL,
+		status VARCHAR(20) NOT NULL DEFAULT 'active',
+		expires_at TIMESTAMP,
+		created_by VARCHAR(100) NOT NULL,
+		created_at TIMESTAMP NOT NULL DEFAULT NOW(),
+		released_at TIMESTAMP
+	);
+	CREATE INDEX IF NOT EXISTS idx_liens_account_status ON liens(account_id, status);
+	CREATE TABLE IF NOT EXISTS lien_events (
+		id SERIAL PRIMARY KEY,
+		lien_id INTEGER NOT NULL REFERENCES liens(id),
+		event VARCHAR(20) NOT NULL,
+		amount DECIMAL(15,2) NOT NULL,
+		expires_at TIMESTAMP,
+		actor VARCHAR(100) NOT NULL,
+		note VARCHAR(500) NOT NULL DEFAULT '',
+		created_at TIMESTAMP NOT NULL DEFAULT NOW()
+	);`
+
+// lienRoles may place, amend and release liens
+var lienRoles = []string{"lien_officer", "legal", "admin"}
+
+var lienReasons = map[string]bool{"loan_collateral": true, "legal_order": true}
+
+const lienColumns = `id, account_id, amount, reason, reference, status, COALESCE(expires_at::text, ''), created_by,
+	created_at, COALESCE(released_at::text, '')`
+
+func scanLien(row interface{ Scan(...interface{}) error }, l *Lien) error {
+	return row.Scan(&l.ID, &l.AccountID, &l.Amount, &l.Reason, &l.Reference, &l.Status, &l.ExpiresAt, &l.CreatedBy,
+		&l.CreatedAt, &l.ReleasedAt)
+}
+
+// activeLienTotal sums the liens currently held against an account. Liens past
+// their expiry no longer count even before the expiry job marks them.
+func activeLienTotal(ctx context.Context, q interface {
+	QueryRowContext(ctx context.Context, query string, args ...interface{}) *sql.Row
+}, accountID interface{}) (Money, error) {
+	var total Money
+	err := q.QueryRowContext(ctx, `SELECT COALESCE(SUM(amount), 0) FROM liens
+								  WHERE account_id = $1 AND status = 'active' AND (expires_at IS NULL OR expires_at > NOW())`,
+		accountID).Scan(&total)
+	return total, err
+}
+
+// parseLienExpiry accepts an RFC 3339 timestamp or a YYYY-MM-DD date that must lie in the future
+func parseLienExpiry(value string) (interface{}, error) {
+	if value == "" {
+		return nil, nil
+	}
+	t, err := time.Parse(time.RFC3339, value)
+	if err != nil {
+		t, err = time.Parse("2006-01-02", value)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("expires_at must be an RFC 3339 timestamp or a YYYY-MM-DD date")
+	}
+	if !t.After(time.Now()) {
+		return nil, fmt.Errorf("expires_at must be in the future")
+	}
+	return t, nil
+}
+
+func recordLienEvent(ctx context.Context, tx *sql.Tx, l Lien, event, actor, note string) error {
+	var expiresAt interface{}
+	if l.ExpiresAt != "" {
+		expiresAt = l.ExpiresAt
+	}
+	_, err := tx.ExecContext(ctx, `INSERT INTO lien_events (lien_id, event, amount, expires_at, actor, note)
+								   VALUES ($1, $2, $3, $4, $5, $6)`, l.ID, event, l.Amount, expiresAt, actor, note)
+	return err
+}
+
+// insertLien places l inside tx and records it in the audit trail. A lien may
+// exceed the balance; the shortfall simply blocks all debits. The account row
+// is locked like for a debit, so a withdrawal running meanwhile cannot spend
+// the funds the lien holds.
+func insertLien(ctx context.Context, tx *sql.Tx, l *Lien, expiresAt interface{}) error {
+	err := scanLien(tx.QueryRowContext(ctx, `INSERT INTO liens (account_id, amount, reason, reference, expires_at, created_by)
+								   SELECT id, $2, $3, $4, $5, $6 FROM accounts WHERE id = $1 FOR UPDATE
+								   RETURNING `+lienColumns, l.AccountID, l.Amount, l.Reason, l.Reference, expiresAt, l.CreatedBy), l)
+	if err != nil {
+		return err
+	}
+	return recordLienEvent(ctx, tx, *l, "placed", l.CreatedBy, "")
+}
+
+// changeLien applies set to an active lien inside tx and records the event.
+// It returns sql.ErrNoRows when the lien is not active.
+func changeLien(ctx context.Context, tx *sql.Tx, id interface{}, event, actor, note, set string, args ...interface{}) (Lien, error) {
+	var l Lien
+	err := scanLien(tx.QueryRowContext(ctx, `UPDATE liens SET `+set+` WHERE id = $1 AND status = 'active'
+								  RETURNING `+lienColumns, append([]interface{}{id}, args...)...), &l)
+	if err != nil {
+		return l, err
+	}
+	return l, recordLienEvent(ctx, tx, l, event, actor, strings.TrimSpace(note))
+}
+
+func placeLien(w http.ResponseWriter, r *http.Request) {
+	if !requireRole(w, r, lienRoles...) {
+		return
+	}
+
+	var l Lien
+	err := json.NewDecoder(r.Body).Decode(&l)
+	if err != nil {
+		http.Error(w, "Invalid request body", http.StatusBadRequest)
+		return
+	}
+
+	l.Reference = strings.TrimSpace(l.Reference)
+	if l.Amount <= 0 {
+		http.Error(w, "Amount must be positive", http.StatusBadRequest)
+		return
+	}
+	if !lienReasons[l.Reason] {
+		http.Error(w, "reason must be loan_collateral or legal_order", http.StatusBadRequest)
+		return
+	}
+	if l.Reference == "" {
+		http.Error(w, "reference is required", http.StatusBadRequest)
+		return
+	}
+	expiresAt, err := parseLienExpiry(l.ExpiresAt)
+	if err != nil {
+		http.Error(w, "expires_at must be a future RFC 3339 timestamp or YYYY-MM-DD date", http.StatusBadRequest)
+		return
+	}
+
+	l.AccountID, err = strconv.Atoi(mux.Vars(r)["id"])
+	if err != nil {
+		http.Error(w, "Invalid account ID", http.StatusBadRequest)
+		return
+	}
+
+	tx, err := db.BeginTx(r.Context(), nil)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	defer tx.Rollback()
+
+	l.CreatedBy = requestActor(r)
+	err = insertLien(r.Context(), tx, &l, expiresAt)
+	if err != nil {
+		if err == sql.ErrNoRows {
+			http.Error(w, "Account not found", http.StatusNotFound)
+		} else {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+		}
+		return
+	}
+
+	err = tx.Commit()
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusCreated)
+	json.NewEncoder(w).Encode(l)
+}
+
+func listLiens(w http.ResponseWriter, r *http.Request) {
+	query := `SELECT ` + lienColumns + ` FROM liens WHERE account_id = $1`
+	if r.URL.Query().Get("status") != "all" {
+		query += ` AND status = 'active'`
+	}
+	rows, err := db.QueryContext(r.Context(), query+` ORDER BY created_at DESC`, mux.Vars(r)["id"])
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	defer rows.Close()
+
+	liens := []Lien{}
+	for rows.Next() {
+		var l Lien
+		if err := scanLien(rows, &l); err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		liens = append(liens, l)
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(liens)
+}
+
+// amendLien changes the amount or expiry of an active lien
+func amendLien(w http.ResponseWriter, r *http.Request) {
+	if !requireRole(w, r, lienRoles...) {
+		return
+	}
+
+	var requestBody struct {
+		Amount    Money  `json:"amount"`
+		ExpiresAt string `json:"expires_at"`
+		Note      string `json:"note"`
+	}
+	err := json.NewDecoder(r.Body).Decode(&requestBody)
+	if err != nil {
+		http.Error(w, "Invalid request body", http.StatusBadRequest)
+		return
+	}
+	if requestBody.Amount <= 0 {
+		http.Error(w, "Amount must be positive", http.StatusBadRequest)
+		return
+	}
+	expiresAt, err := parseLienExpiry(requestBody.ExpiresAt)
+	if err != nil {
+		http.Error(w, "expires_at must be a future RFC 3339 timestamp or YYYY-MM-DD date", http.StatusBadRequest)
+		return
+	}
+
+	updateLienStatus(w, r, "amended", requestBody.Note, `amount = $2, expires_at = $3`, requestBody.Amount, expiresAt)
+}
+
+// releaseLien lifts an active lien, freeing the earmarked funds
+func releaseLien(w http.ResponseWriter, r *http.Request) {
+	if !requireRole(w, r, lienRoles...) {
+		return
+	}
+	updateLienStatus(w, r, "released", r.URL.Query().Get("note"), `status = 'released', released_at = NOW()`)
+}
+
+func updateLienStatus(w http.ResponseWriter, r *http.Request, event, note, set string, args ...interface{}) {
+	tx, err := db.BeginTx(r.Context(), nil)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	defer tx.Rollback()
+
+	l, err := changeLien(r.Context(), tx, mux.Vars(r)["id"], event, requestActor(r), note, set, args...)
+	if err == sql.ErrNoRows {
+		http.Error(w, "Active lien not found", http.StatusNotFound)
+		return
+	}
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	err = tx.Commit()
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(l)
+}
+
+// getLienHistory returns the audit trail of a lien, oldest first
+func getLienHistory(w http.ResponseWriter, r *http.Request) {
+	rows, err := db.QueryContext(r.Context(), `SELECT event, amount, COALESCE(expires_at::text, ''), actor, note, created_at
+											   FROM lien_events WHERE lien_id = $1 ORDER BY id`, mux.Vars(r)["id"])
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	defer rows.Close()
+
+	events := []LienEvent{}
+	for rows.Next() {
+		var e LienEvent
+		if err := rows.Scan(&e.Event, &e.Amount, &e.ExpiresAt, &e.Actor, &e.Note, &e.CreatedAt); err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		events = append(events, e)
+	}
+	if len(events) == 0 {
+		http.Error(w, "Lien not found", http.StatusNotFound)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(events)
+}
+
+// startLienExpiry marks liens past their expiry and records it in the audit trail
+func startLienExpiry() {
+	go func() {
+		defer servicekit.ReportJobPanic("Lien expiry")
+		for {
+			if err := expireLiens(serviceContext); err != nil {
+				servicekit.ReportJobError("Lien expiry", err)
+			}
+			time.Sleep(time.Hour)
+		}
+	}()
+}
+
+func expireLiens(ctx context.Context) error {
+	tx, err := db.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	rows, err := tx.QueryContext(ctx, `UPDATE liens SET status = 'expired'
+									   WHERE status = 'active' AND expires_at <= NOW() RETURNING `+lienColumns)
+	if err != nil {
+		return err
+	}
+	var expired []Lien
+	for rows.Next() {
+		var l Lien
+		if err := scanLien(rows, &l); err != nil {
+			rows.Close()
+			return err
+		}
+		expired = append(expired, l)
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return err
+	}
+
+	for _, l := range expired {
+		if err := recordLienEvent(ctx, tx, l, "expired", "system", ""); err != nil {
+			return err
+		}
+	}
+	return tx.Commit()
+}
@@ -0,0 +1,374 @@
+package main
+
+import (
+	"database/sql"
+	"encoding/json"
+	"math"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gorilla/mux"
+)
+
+// PayoffQuote is what settles a loan in full on a given date
+type PayoffQuote struct {
+	AccountID       int     `json:"account_id"`
+	AsOf            string  `json:"as_of"`
+	Principal       Money   `json:"principal"`
+	AccruedInterest Money   `json:"accrued_interest"`
+	InterestFrom    string  `json:"interest_from"`
+	PenaltyPercent  float64 `json:"penalty_percent"`
+	Penalty         Money   `json:"penalty"`
+	Total           Money   `json:"total"`
+}
+
+// LoanRestructure records a change of a loan's term or rate and the schedule
+// it replaced
+type LoanRestructure struct {
+	ID                int               `json:"id"`
+	AccountID         int               `json:"account_id"`
+	FromInstallment   int               `json:"from_installment"`
+	Outstanding       Money             `json:"outstanding"`
+	PreviousTerm      int               `json:"previous_term_months"`
+	NewTerm           int               `json:"new_term_months"`
+	PreviousFixedRate *float64          `json:"previous_fixed_rate,omitempty"`
+	NewFixedRate      *float64          `json:"new_fixed_rate,omitempty"`
+	Reason            string            `json:"reason"`
+	RestructuredBy    string            `json:"restructured_by"`
+	CreatedAt         string            `json:"created_at"`
+	Superseded        []LoanInstallment `json:"superseded_installments,omitempty"`
+}
+
+const loanRestructureTablesSQL = `
+	CREATE TABLE IF NOT EXISTS loan_restructures (
+		id SERIAL PRIMARY KEY,
+		account_id INTEGER NOT NULL REFERENCES loans(account_id),
+		from_installment INTEGER NOT NULL,
+		outstanding DECIMAL(15,2) NOT NULL,
+		previous_term INTEGER NOT NULL,
+		new_term INTEGER NOT NULL,
+		previous_fixed_rate DECIMAL(7,4),
+		new_fixed_rate DECIMAL(7,4),
+		reason VARCHAR(255) NOT NULL,
+		restructured_by VARCHAR(100) NOT NULL,
+		created_at TIMESTAMP NOT NULL DEFAULT NOW()
+	);
+	CREATE TABLE IF NOT EXISTS loan_installment_history (
+		restructure_id INTEGER NOT NULL REFERENCES loan_restructures(id),
+		number INTEGER NOT NULL,
+		due_date DATE NOT NULL,
+		payment DECIMAL(15,2) NOT NULL,
+		principal DECIMAL(15,2) NOT NULL,
+		interest DECIMAL(15,2) NOT NULL,
+		rate DECIMAL(7,4) NOT NULL,
+		closing_balance DECIMAL(15,2) NOT NULL,
+		PRIMARY KEY (restructure_id, number)
+	);`
+
+// loanOfficerRoles may set the terms of loans and restructure them
+var loanOfficerRoles = []string{"loan_officer", "admin"}
+
+// getPayoffQuote quotes the early payoff of a loan as of ?date= (default
+// today): the outstanding balance, interest accrued day by day since the last
+// due date, and the prepayment penalty when paying off before maturity
+func getPayoffQuote(w http.ResponseWriter, r *http.Request) {
+	now := time.Now().UTC()
+	today := time.Date(now.Year(), now.Month(), now.Day(), 0, 0, 0, 0, time.UTC)
+	asOf := today
+	if value := r.URL.Query().Get("date"); value != "" {
+		var err error
+		asOf, err = time.Parse("2006-01-02", value)
+		if err != nil {
+			http.Error(w, "date must be YYYY-MM-DD", http.StatusBadRequest)
+			return
+		}
+		if asOf.Before(today) {
+			http.Error(w, "date must not be in the past", http.StatusBadRequest)
+			return
+		}
+	}
+
+	var l Loan
+	var accountType string
+	var balance Money
+	err := db.QueryRowContext(r.Context(), `SELECT a.account_type, a.balance FROM loans l JOIN accounts a ON a.id = l.account_id
+											WHERE l.account_id = $1`, mux.Vars(r)["id"]).Scan(&accountType, &balance)
+	if err == nil {
+		err = scanLoan(db.QueryRowContext(r.Context(), `SELECT `+loanColumns+` FROM loans WHERE account_id = $1`,
+			mux.Vars(r)["id"]), &l)
+	}
+	if err != nil {
+		if err == sql.ErrNoRows {
+			http.Error(w, "Loan not found", http.StatusNotFound)
+		} else {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+		}
+		return
+	}
+	if l.Status != "active" {
+		http.Error(w, "Loan is not active", http.StatusConflict)
+		return
+	}
+
+	var lastDue, maturity string
+	err = db.QueryRowContext(r.Context(), `SELECT COALESCE(MAX(due_date) FILTER (WHERE due_date <= $2)::text, $3),
+										   COALESCE(MAX(due_date)::text, $3)
+										   FROM loan_installments WHERE account_id = $1`,
+		l.AccountID, asOf.Format("2006-01-02"), l.StartDate).Scan(&lastDue, &maturity)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	var rates rateTable
+	if l.FixedRate != nil {
+		rates = fixedRateTable(*l.FixedRate)
+	} else if rates, err = loadRateTable(r.Context(), db, accountType); err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	// Interest accrues on the outstanding balance for each day after the last
+	// due date, in fractions of a cent until the total is rounded
+	from, _ := time.Parse("2006-01-02", lastDue)
+	interest := 0.0
+	for day := from; day.Before(asOf); day = day.AddDate(0, 0, 1) {
+		rate, err := rates.on(day)
+		if err != nil {
+			http.Error(w, "No interest rate is in effect for the whole period", http.StatusConflict)
+			return
+		}
+		interest += float64(balance) * rate / 100 / 365
+	}
+
+	quote := PayoffQuote{
+		AccountID:       l.AccountID,
+		AsOf:            asOf.Format("2006-01-02"),
+		Principal:       balance,
+		AccruedInterest: Money(math.Round(interest)),
+		InterestFrom:    lastDue,
+	}
+	if quote.AsOf < maturity {
+		quote.PenaltyPercent, _ = strconv.ParseFloat(getEnv("LOAN_PREPAYMENT_PENALTY_PERCENT", "1"), 64)
+		quote.Penalty = balance.Times(quote.PenaltyPercent / 100)
+	}
+	quote.Total = quote.Principal + quote.AccruedInterest + quote.Penalty
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(quote)
+}
+
+// restructureLoan re-amortizes the outstanding balance over a new remaining
+// term and optionally at a new fixed rate, from the first installment due
+// today or later. The replaced installments are kept with the restructure.
+func restructureLoan(w http.ResponseWriter, r *http.Request) {
+	if !requireRole(w, r, loanOfficerRoles...) {
+		return
+	}
+
+	var requestBody struct {
+		RemainingMonths int      `json:"remaining_months"`
+		Rate            *float64 `json:"rate"`
+		Reason          string   `json:"reason"`
+	}
+	err := json.NewDecoder(r.Body).Decode(&requestBody)
+	if err != nil {
+		http.Error(w, "Invalid request body", http.StatusBadRequest)
+		return
+	}
+	if requestBody.RemainingMonths < 1 || requestBody.RemainingMonths > maxLoanTermMonths {
+		http.Error(w, "remaining_months must be between 1 and 480", http.StatusBadRequest)
+		return
+	}
+	if requestBody.Rate != nil && (*requestBody.Rate < 0 || *requestBody.Rate >= 100) {
+		http.Error(w, "rate must be between 0 and 100", http.StatusBadRequest)
+		return
+	}
+	if strings.TrimSpace(requestBody.Reason) == "" {
+		http.Error(w, "reason is required", http.StatusBadRequest)
+		return
+	}
+
+	tx, err := db.BeginTx(r.Context(), nil)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	defer tx.Rollback()
+
+	var l Loan
+	err = scanLoan(tx.QueryRowContext(r.Context(), `SELECT `+loanColumns+` FROM loans WHERE account_id = $1 FOR UPDATE`,
+		mux.Vars(r)["id"]), &l)
+	if err != nil {
+		if err == sql.ErrNoRows {
+			http.Error(w, "Loan not found", http.StatusNotFound)
+		} else {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+		}
+		return
+	}
+	if l.Status != "active" {
+		http.Error(w, "Loan is not active", http.StatusConflict)
+		return
+	}
+
+	var accountType string
+	var outstanding Money
+	var first int
+	err = tx.QueryRowContext(r.Context(), `SELECT a.account_type, a.balance, COALESCE(
+											   (SELECT MIN(number) FROM loan_installments
+												WHERE account_id = a.id AND due_date >= CURRENT_DATE AND paid_at IS NULL),
+											   (SELECT MAX(number) + 1 FROM loan_installments WHERE account_id = a.id), 1)
+										   FROM accounts a WHERE a.id = $1`, l.AccountID).Scan(&accountType, &outstanding, &first)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	if outstanding <= 0 {
+		http.Error(w, "Loan has no outstanding balance", http.StatusConflict)
+		return
+	}
+
+	// A new rate fixes the loan; otherwise the current rate arrangement carries over
+	fixedRate := l.FixedRate
+	if requestBody.Rate != nil {
+		fixedRate = requestBody.Rate
+	}
+	var rates rateTable
+	if fixedRate != nil {
+		rates = fixedRateTable(*fixedRate)
+	} else if rates, err = loadRateTable(r.Context(), tx, accountType); err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	start, err := time.Parse("2006-01-02", l.StartDate)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	newTerm := first - 1 + requestBody.RemainingMonths
+	installments, err := amortize(rates, start, newTerm, first, outstanding)
+	if err != nil {
+		http.Error(w, "No interest rate is in effect for the whole term", http.StatusConflict)
+		return
+	}
+
+	var restructure LoanRestructure
+	err = tx.QueryRowContext(r.Context(), `INSERT INTO loan_restructures (account_id, from_installment, outstanding,
+										   previous_term, new_term, previous_fixed_rate, new_fixed_rate, reason, restructured_by)
+										   VALUES ($1, $2, $3, $4, $5, $6, $7, $8, $9) RETURNING id, created_at`,
+		l.AccountID, first, outstanding, l.TermMonths, newTerm, l.FixedRate, fixedRate, requestBody.Reason,
+		requestActor(r)).Scan(&restructure.ID, &restructure.CreatedAt)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	restructure.AccountID, restructure.FromInstallment, restructure.Outstanding = l.AccountID, first, outstanding
+	restructure.PreviousTerm, restructure.NewTerm = l.TermMonths, newTerm
+	restructure.PreviousFixedRate, restructure.NewFixedRate = l.FixedRate, fixedRate
+	restructure.Reason, restructure.RestructuredBy = requestBody.Reason, requestActor(r)
+
+	_, err = tx.ExecContext(r.Context(), `INSERT INTO loan_installment_history (restructure_id, number, due_date, payment,
+										  principal, interest, rate, closing_balance)
+										  SELECT $1, number, due_date, payment, principal, interest, rate, closing_balance
+										  FROM loan_installments WHERE account_id = $2 AND number >= $3`,
+		restructure.ID, l.AccountID, first)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	_, err = tx.ExecContext(r.Context(), `DELETE FROM loan_installments WHERE account_id = $1 AND number >= $2`, l.AccountID, first)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	if err := insertInstallments(r.Context(), tx, l.AccountID, installments); err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	err = scanLoan(tx.QueryRowContext(r.Context(), `UPDATE loans SET term_months = $2, fixed_rate = $3, updated_at = NOW()
+									  WHERE account_id = $1 RETURNING `+loanColumns, l.AccountID, newTerm, fixedRate), &l)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	if err := tx.Commit(); err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"loan":        l,
+		"restructure": restructure,
+		"schedule":    installments,
+	})
+}
+
+// listLoanRestructures returns a loan's restructures, newest first, each with
+// the installments it superseded
+func listLoanRestructures(w http.ResponseWriter, r *http.Request) {
+	rows, err := db.QueryContext(r.Context(), `SELECT id, account_id, from_installment, outstanding, previous_term, new_term,
+											   previous_fixed_rate, new_fixed_rate, reason, restructured_by, created_at
+											   FROM loan_restructures WHERE account_id = $1 ORDER BY id DESC`, mux.Vars(r)["id"])
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	defer rows.Close()
+
+	restructures := []LoanRestructure{}
+	byID := map[int]int{}
+	for rows.Next() {
+		var lr LoanRestructure
+		var previousRate, newRate sql.NullFloat64
+		if err := rows.Scan(&lr.ID, &lr.AccountID, &lr.FromInstallment, &lr.Outstanding, &lr.PreviousTerm, &lr.NewTerm,
+			&previousRate, &newRate, &lr.Reason, &lr.RestructuredBy, &lr.CreatedAt); err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		if previousRate.Valid {
+			lr.PreviousFixedRate = &previousRate.Float64
+		}
+		if newRate.Valid {
+			lr.NewFixedRate = &newRate.Float64
+		}
+		byID[lr.ID] = len(restructures)
+		restructures = append(restructures, lr)
+	}
+	if err := rows.Err(); err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	history, err := db.QueryContext(r.Context(), `SELECT h.restructure_id, h.number, h.due_date::text, h.payment, h.principal,
+												  h.interest, h.rate, h.closing_balance
+												  FROM loan_installment_history h JOIN loan_restructures lr ON lr.id = h.restructure_id
+												  WHERE lr.account_id = $1 ORDER BY h.restructure_id, h.number`, mux.Vars(r)["id"])
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	defer history.Close()
+
+	for history.Next() {
+		var restructureID int
+		var i LoanInstallment
+		if err := history.Scan(&restructureID, &i.Number, &i.DueDate, &i.Payment, &i.Principal, &i.Interest, &i.Rate,
+			&i.ClosingBalance); err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		if idx, ok := byID[restructureID]; ok {
+			restructures[idx].Superseded = append(restructures[idx].Superseded, i)
+		}
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(restructures)
+}
@@ -0,0 +1,362 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"math"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/gorilla/mux"
+)
+
+// Loan holds the terms of a loan account. Unless a fixed rate was agreed, the
+// rate is variable: every installment uses the product rate effective on its
+// due date.
+type Loan struct {
+	AccountID  int               `json:"account_id"`
+	Principal  Money             `json:"principal"`
+	TermMonths int               `json:"term_months"`
+	StartDate  string            `json:"start_date"`
+	Status     string            `json:"status"`
+	FixedRate  *float64          `json:"fixed_rate,omitempty"` // set by a restructure; overrides product rates
+	CreatedAt  string            `json:"created_at"`
+	UpdatedAt  string            `json:"updated_at"`
+	Schedule   []LoanInstallment `json:"schedule,omitempty"`
+}
+
+// LoanInstallment is one monthly repayment of the amortization schedule
+type LoanInstallment struct {
+	Number         int     `json:"number"`
+	DueDate        string  `json:"due_date"`
+	Payment        Money   `json:"payment"`
+	Principal      Money   `json:"principal"`
+	Interest       Money   `json:"interest"`
+	Rate           float64 `json:"rate"`
+	ClosingBalance Money   `json:"closing_balance"`
+	PaidAt         string  `json:"paid_at,omitempty"`
+}
+
+const loanTablesSQL = `
+	CREATE TABLE IF NOT EXISTS loans (
+		account_id INTEGER PRIMARY KEY REFERENCES accounts(id),
+		principal DECIMAL(15,2) NOT NULL,
+		term_months INTEGER NOT NULL,
+		start_date DATE NOT NULL,
+		status VARCHAR(20) NOT NULL DEFAULT 'active',
+		created_at TIMESTAMP NOT NULL DEFAULT NOW(),
+		updated_at TIMESTAMP NOT NULL DEFAULT NOW()
+	);
+	CREATE TABLE IF NOT EXISTS loan_installments (
+		account_id INTEGER NOT NULL REFERENCES loans(account_id),
+		number INTEGER NOT NULL,
+		due_date DATE NOT NULL,
+		payment DECIMAL(15,2) NOT NULL,
+		principal DECIMAL(15,2) NOT NULL,
+		interest DECIMAL(15,2) NOT NULL,
+		rate DECIMAL(7,4) NOT NULL,
+		closing_balance DECIMAL(15,2) NOT NULL,
+		paid_at TIMESTAMP,
+		PRIMARY KEY (account_id, number)
+	);
+	ALTER TABLE loans ADD COLUMN IF NOT EXISTS fixed_rate DECIMAL(7,4);`
+
+// maxLoanTermMonths bounds loan terms to 40 years
+const maxLoanTermMonths = 480
+
+// minLoanAffordabilityScore is the lowest affordability score, counting the
+// new installment, at which a loan is granted
+const minLoanAffordabilityScore = 20
+
+const loanColumns = `account_id, principal, term_months, start_date::text, status, fixed_rate, created_at, updated_at`
+
+func scanLoan(row interface{ Scan(...interface{}) error }, l *Loan) error {
+	var fixed sql.NullFloat64
+	err := row.Scan(&l.AccountID, &l.Principal, &l.TermMonths, &l.StartDate, &l.Status, &fixed, &l.CreatedAt, &l.UpdatedAt)
+	if fixed.Valid {
+		l.FixedRate = &fixed.Float64
+	}
+	return err
+}
+
+// fixedRateTable is a rate table that applies one rate on every date
+func fixedRateTable(rate float64) rateTable {
+	return rateTable{{Rate: rate, EffectiveFrom: "0001-01-01"}}
+}
+
+// amortize builds installments from number `from` to the end of the term,
+// starting with the given outstanding principal. The payment is recomputed
+// for each installment from its rate and the installments left, so a rate
+// change only reshapes the payments from the installment it first applies to.
+func amortize(rates rateTable, start time.Time, termMonths, from int, outstanding Money) ([]LoanInstallment, error) {
+	var installments []LoanInstallment
+	remaining := outstanding
+	for n := from; n <= termMonths; n++ {
+		due := start.AddDate(0, n, 0)
+		rate, err := rates.on(due)
+		if err != nil {
+			return nil, err
+		}
+
+		monthly := rate / 100 / 12
+		left := float64(termMonths - n + 1)
+		payment := float64(remaining) / left
+		if monthly > 0 {
+			payment = float64(remaining) * monthly / (1 - math.Pow(1+monthly, -left))
+		}
+		interest := remaining.Times(monthly)
+		principal := Money(math.Round(payment)) - interest
+		if n == termMonths || principal > remaining {
+			principal = remaining
+		}
+		remaining -= principal
+
+		installments = append(installments, LoanInstallment{
+			Number:         n,
+			DueDate:        due.Format("2006-01-02"),
+			Payment:        principal + interest,
+			Principal:      principal,
+			Interest:       interest,
+			Rate:           rate,
+			ClosingBalance: remaining,
+		})
+	}
+	return installments, nil
+}
+
+func insertInstallments(ctx context.Context, tx *sql.Tx, accountID int, installments []LoanInstallment) error {
+	for _, i := range installments {
+		_, err := tx.ExecContext(ctx, `INSERT INTO loan_installments (account_id, number, due_date, payment, principal,
+									   interest, rate, closing_balance) VALUES ($1, $2, $3, $4, $5, $6, $7, $8)`,
+			accountID, i.Number, i.DueDate, i.Payment, i.Principal, i.Interest, i.Rate, i.ClosingBalance)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// createLoan records the terms of a loan account and generates its schedule
+func createLoan(w http.ResponseWriter, r *http.Request) {
+	if !requireRole(w, r, loanOfficerRoles...) {
+		return
+	}
+
+	accountID, err := strconv.Atoi(mux.Vars(r)["id"])
+	if err != nil {
+		http.Error(w, "Invalid account ID", http.StatusBadRequest)
+		return
+	}
+
+	var l Loan
+	err = json.NewDecoder(r.Body).Decode(&l)
+	if err != nil {
+		http.Error(w, "Invalid request body", http.StatusBadRequest)
+		return
+	}
+	if l.Principal <= 0 || l.TermMonths < 1 || l.TermMonths > maxLoanTermMonths {
+		http.Error(w, "principal must be positive and term_months between 1 and 480", http.StatusBadRequest)
+		return
+	}
+	start := time.Now().UTC()
+	if l.StartDate != "" {
+		start, err = time.Parse("2006-01-02", l.StartDate)
+		if err != nil {
+			http.Error(w, "start_date must be YYYY-MM-DD", http.StatusBadRequest)
+			return
+		}
+	}
+	l.StartDate = start.Format("2006-01-02")
+
+	tx, err := db.BeginTx(r.Context(), nil)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	defer tx.Rollback()
+
+	var accountType string
+	var customerID int
+	err = tx.QueryRowContext(r.Context(), `SELECT account_type, customer_id FROM accounts WHERE id = $1`,
+		accountID).Scan(&accountType, &customerID)
+	if err == sql.ErrNoRows {
+		http.Error(w, "Account not found", http.StatusNotFound)
+		return
+	}
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	if !liabilityAccountTypes[accountType] {
+		http.Error(w, "Loan terms can only be set on loan accounts", http.StatusConflict)
+		return
+	}
+
+	rates, err := loadRateTable(r.Context(), tx, accountType)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	l.Schedule, err = amortize(rates, start, l.TermMonths, 1, l.Principal)
+	if err != nil {
+		http.Error(w, "No interest rate is in effect for the whole term", http.StatusConflict)
+		return
+	}
+
+	// The first installment is added to the customer's commitments
+	a, err := assessAffordability(r.Context(), customerID, l.Schedule[0].Payment)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	if !a.IncomeVerified {
+		http.Error(w, "Income must be verified before a loan is granted", http.StatusConflict)
+		return
+	}
+	if a.Score < minLoanAffordabilityScore {
+		http.Error(w, fmt.Sprintf("Loan is not affordable (affordability score %d)", a.Score), http.StatusConflict)
+		return
+	}
+
+	err = scanLoan(tx.QueryRowContext(r.Context(), `INSERT INTO loans (account_id, principal, term_months, start_date)
+									  VALUES ($1, $2, $3, $4) ON CONFLICT (account_id) DO NOTHING RETURNING `+loanColumns,
+		accountID, l.Principal, l.TermMonths, l.StartDate), &l)
+	if err != nil {
+		if err == sql.ErrNoRows {
+			http.Error(w, "Loan terms already exist for this account", http.StatusConflict)
+		} else {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+		}
+		return
+	}
+	if err := insertInstallments(r.Context(), tx, accountID, l.Schedule); err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	if err := tx.Commit(); err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusCreated)
+	json.NewEncoder(w).Encode(l)
+}
+
+// getLoan returns the loan terms with the full amortization schedule
+func getLoan(w http.ResponseWriter, r *http.Request) {
+	var l Loan
+	err := scanLoan(db.QueryRowContext(r.Context(), `SELECT `+loanColumns+` FROM loans WHERE account_id = $1`,
+		mux.Vars(r)["id"]), &l)
+	if err != nil {
+		if err == sql.ErrNoRows {
+			http.Error(w, "Loan not found", http.StatusNotFound)
+		} else {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+		}
+		return
+	}
+
+	l.Schedule, err = loadInstallments(r.Context(), l.AccountID)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(l)
+}
+
+// loadInstallments returns the loan's amortization schedule in order
+func loadInstallments(ctx context.Context, accountID int) ([]LoanInstallment, error) {
+	rows, err := db.QueryContext(ctx, `SELECT number, due_date::text, payment, principal, interest, rate,
+									   closing_balance, COALESCE(paid_at::text, '')
+									   FROM loan_installments WHERE account_id = $1 ORDER BY number`, accountID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	installments := []LoanInstallment{}
+	for rows.Next() {
+		var i LoanInstallment
+		if err := rows.Scan(&i.Number, &i.DueDate, &i.Payment, &i.Principal, &i.Interest, &i.Rate,
+			&i.ClosingBalance, &i.PaidAt); err != nil {
+			return nil, err
+		}
+		installments = append(installments, i)
+	}
+	return installments, rows.Err()
+}
+
+// regenerateSchedule rebuilds the unpaid installments of a loan due on or
+// after from, continuing from the closing balance of the installment before
+func regenerateSchedule(ctx context.Context, tx *sql.Tx, l Loan, rates rateTable, from time.Time) error {
+	var first int
+	var outstanding Money
+	err := tx.QueryRowContext(ctx, `SELECT i.number, COALESCE((SELECT closing_balance FROM loan_installments p
+									WHERE p.account_id = i.account_id AND p.number = i.number - 1), $3)
+									FROM loan_installments i WHERE i.account_id = $1 AND i.due_date >= $2 AND i.paid_at IS NULL
+									ORDER BY i.number LIMIT 1`, l.AccountID, from.Format("2006-01-02"), l.Principal).Scan(&first, &outstanding)
+	if err == sql.ErrNoRows {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+
+	start, err := time.Parse("2006-01-02", l.StartDate)
+	if err != nil {
+		return err
+	}
+	installments, err := amortize(rates, start, l.TermMonths, first, outstanding)
+	if err != nil {
+		return err
+	}
+
+	_, err = tx.ExecContext(ctx, `DELETE FROM loan_installments WHERE account_id = $1 AND number >= $2`, l.AccountID, first)
+	if err != nil {
+		return err
+	}
+	return insertInstallments(ctx, tx, l.AccountID, installments)
+}
+
+// regenerateProductSchedules reschedules every active variable-rate loan of
+// the product from the date a new rate takes effect and returns how many were touched
+func regenerateProductSchedules(ctx context.Context, tx *sql.Tx, productCode string, from time.Time) (int, error) {
+	rates, err := loadRateTable(ctx, tx, productCode)
+	if err != nil {
+		return 0, err
+	}
+
+	rows, err := tx.QueryContext(ctx, `SELECT `+loanColumns+` FROM loans WHERE status = 'active' AND fixed_rate IS NULL
+									   AND account_id IN (SELECT id FROM accounts WHERE account_type = $1)
+									   ORDER BY account_id FOR UPDATE`, productCode)
+	if err != nil {
+		return 0, err
+	}
+	var loans []Loan
+	for rows.Next() {
+		var l Loan
+		if err := scanLoan(rows, &l); err != nil {
+			rows.Close()
+			return 0, err
+		}
+		loans = append(loans, l)
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return 0, err
+	}
+
+	for _, l := range loans {
+		if err := regenerateSchedule(ctx, tx, l, rates, from); err != nil {
+			return 0, err
+		}
+	}
+	return len(loans), nil
+}
@@ -4,54 +4,404 @@ import (
 	"database/sql"
 	"encoding/json"
 	"fmt"
-	"log"
 	"net/http"
 	"os"
 	"strconv"
 
+	"bank/servicekit"
+
 	"github.com/gorilla/mux"
 	_ "github.com/lib/pq"
+	"go.uber.org/zap"
 )
 
 // Account represents a bank account
 type Account struct {
-	ID           int     `json:"id"`
-	CustomerID   int     `json:"customer_id"`
-	AccountType  string  `json:"account_type"`
-	Balance      float64 `json:"balance"`
-	CurrencyCode string  `json:"currency_code"`
-	Status       string  `json:"status"`
-	CreatedAt    string  `json:"created_at"`
-	UpdatedAt    string  `json:"updated_at"`
+	ID             int             `json:"id"`
+	CustomerID     int             `json:"customer_id"`
+	AccountType    string          `json:"account_type"`
+	Balance        Money           `json:"balance"`
+	CurrencyCode   string          `json:"currency_code"`
+	Status         string          `json:"status"`
+	OverdraftLimit Money           `json:"overdraft_limit"`
+	CreatedAt      string          `json:"created_at"`
+	UpdatedAt      string          `json:"updated_at"`
+	Metadata       AccountMetadata `json:"metadata"`
+	BranchCode     string          `json:"branch_code"`
+	AccountNumber  string          `json:"account_number"`
 }
 
+// serviceName identifies this service in logs and alerts
+const serviceName = "account-service"
+
 var db *sql.DB
 
+// peerPermissions are the routes other services may call with their SPIFFE
+// identity or a service token; serviceOnlyRoutes reject callers without one
+var (
+	peerPermissions = map[string][]string{
+		"auth-service": {"POST /customers/{id}/reparent"},
+		"atm-switch": {"POST /atm/authorizations", "POST /atm/withdrawals/{reference}/confirm",
+			"POST /atm/withdrawals/{reference}/reverse", "GET /atm/withdrawals/{reference}"},
+		"api-gateway": {"*"},
+	}
+	serviceOnlyRoutes = map[string]bool{"POST /customers/{id}/reparent": true, "POST /atm/authorizations": true,
+		"POST /atm/withdrawals/{reference}/confirm": true, "POST /atm/withdrawals/{reference}/reverse": true,
+		"GET /atm/withdrawals/{reference}": true}
+)
+
+// routePriorities decide what is shed first under overload: card and ATM
+// authorizations and money movement last, lists, reports and exports first
+var routePriorities = map[string]string{
+	"POST /accounts/{id}/authorizations":        "critical",
+	"POST /atm/authorizations":                  "critical",
+	"POST /atm/withdrawals/{reference}/confirm": "critical",
+	"POST /atm/withdrawals/{reference}/reverse": "critical",
+	"POST /agent/deposits":                      "critical",
+	"POST /accounts/{id}/deposit":               "critical",
+	"POST /accounts/{id}/withdraw":              "critical",
+	"POST /accounts/transfer":                   "critical",
+	"GET /accounts/{id}/balance":                "high",
+	"POST /accounts/balances:batch":             "high",
+	"GET /accounts/{id}":                        "high",
+	"GET /transfers/{reference}":                "high",
+	"GET /accounts":                             "low",
+	"GET /agents":                               "low",
+	"POST /accounts/bulk":                       "low",
+	"GET /accounts/{id}/balance-history":        "low",
+	"GET /accounts/{id}/statements":             "low",
+	"GET /statements/{id}/download":             "low",
+	"GET /accounts/{id}/exports":                "low",
+	"POST /accounts/{id}/exports":               "low",
+	"GET /exports/{id}/download":                "low",
+	"POST /accounts/{id}/reconciliations":       "low",
+	"GET /accounts/{id}/transactions/search":    "low",
+	"GET /accounts/{id}/reports/spending":       "low",
+	"GET /accounts/{id}/insights/merchants":     "low",
+	"GET /compliance/sod-report":                "low",
+	"GET /estates/{id}/report":                  "low",
+	"GET /reports/profitability":                "low",
+}
+
+// routeRateLimits bound money movement and account opening per client IP, on
+// top of RATE_LIMIT_PER_IP
+var routeRateLimits = map[string]string{
+	"POST /accounts":               "20/1m",
+	"POST /accounts/transfer":      "60/1m",
+	"POST /accounts/{id}/withdraw": "60/1m",
+}
+
 func main() {
+	servicekit.InitErrorReporting()
+	servicekit.InitSPIFFE()
+	servicekit.InitServiceTokens()
+	servicekit.UseWorkloadIdentity(serviceClient)
+	initWebhookSigner()
+
+	// "account-service migrate ..." runs the migrate subcommand and exits
+	servicekit.MigrateCommand(connectDB, baselineSchema)
+
+	// Answer probes while the database is migrated
+	port := getEnv("PORT", "8080")
+	if err := startServer(":" + port); err != nil {
+		logger.Fatal("server failed", zap.Error(err))
+	}
+
 	// Initialize database connection
 	initDB()
 	defer db.Close()
 
+	// Initialize core banking connector
+	core = newCoreBankingConnector(getEnv("CORE_BANKING_CONNECTOR", "none"))
+	riskScorer = newRiskScorer()
+	signatureProvider = newSignatureProvider(getEnv("ESIGNATURE_PROVIDER", "none"))
+	pinVerifier = newPINVerifier(getEnv("ATM_PIN_VERIFIER", "none"))
+	initAccountNumbers()
+	initEventPublisher()
+	loadExchangeRates()
+
+	// Initialize document storage and background jobs
+	objectStore = newFileObjectStore(getEnv("OBJECT_STORE_DIR", "/var/lib/bank/objects"))
+	startStatementScheduler()
+	startExportWorker()
+	startReconciliationWorker()
+	startTravelNoticeExpiry()
+	startPaymentRequestJobs()
+	startPrepaidExpiry()
+	startEscrowTimeouts()
+	startLienExpiry()
+	startATMReservationExpiry()
+	startAccountNumberBackfill()
+	startBalanceSnapshots()
+	startMerchantProjection()
+	startAutoTopUpMonitor()
+	startSweeps()
+	startInterestAccrual()
+	startCollections()
+	startKYCRefreshMonitor()
+	startIdempotencyKeyExpiry()
+	startOutboxRelay()
+	servicekit.StartServiceTokenNonceExpiry()
+	servicekit.StartSLOTracking()
+	servicekit.StartSigningKeyUsageFlush()
+
 	// Create router
 	router := mux.NewRouter()
+	router.Use(servicekit.MetricsMiddleware)
+	router.Use(servicekit.LoadSheddingMiddleware(servicekit.LoadRoutePriorities(routePriorities)))
+	router.Use(servicekit.ErrorReportingMiddleware)
+	router.Use(securityHeadersMiddleware(loadSecurityHeaders("api", apiSecurityHeaders)))
+	csrfCfg := loadCSRFConfig()
+	router.Use(servicekit.ServiceIdentityMiddleware(servicekit.LoadServicePermissions(peerPermissions), serviceOnlyRoutes))
+	limiter := servicekit.NewRateLimiter("600/1m", "300/1m", routeRateLimits)
+	router.Use(limiter.IPMiddleware)
+	router.Use(accountNumberMiddleware)
+	router.Use(authMiddleware(csrfCfg.SessionCookie))
+	router.Use(limiter.UserMiddleware(func(r *http.Request) string { return r.Header.Get("X-User-ID") }))
+	router.Use(csrfMiddleware(csrfCfg))
+	router.Use(sodMiddleware)
 
 	// Define routes
-	router.HandleFunc("/health", healthCheck).Methods("GET")
-	router.HandleFunc("/accounts", getAccounts).Methods("GET")
-	router.HandleFunc("/accounts/{id}", getAccount).Methods("GET")
-	router.HandleFunc("/accounts", createAccount).Methods("POST")
-	router.HandleFunc("/accounts/{id}", updateAccount).Methods("PUT")
-	router.HandleFunc("/accounts/{id}/balance", getBalance).Methods("GET")
-	router.HandleFunc("/accounts/{id}/deposit", depositFunds).Methods("POST")
-	router.HandleFunc("/accounts/{id}/withdraw", withdrawFunds).Methods("POST")
+	router.HandleFunc("/health", servicekit.HealthCheck).Methods("GET")
+	router.HandleFunc("/startup", servicekit.StartupProbe).Methods("GET")
+	router.HandleFunc("/metrics", servicekit.MetricsHandler).Methods("GET")
+	router.HandleFunc("/slo", servicekit.SLOHandler).Methods("GET")
+	v1 := servicekit.APIVersion{Prefix: "/v1", Register: registerV1Routes}
+	v2 := servicekit.APIVersion{Prefix: "/v2", Register: registerV2Routes}
+	servicekit.MountAPIVersions(router, v1, v2)
+	servicekit.MountLegacyRoutes(router, v1)
+	router.HandleFunc("/openapi.json", servicekit.OpenAPIHandler(router, apiDocs, "Account Service API")).Methods("GET")
+	router.PathPrefix("/docs/").Handler(securityHeadersMiddleware(loadSecurityHeaders("html", htmlSecurityHeaders))(servicekit.SwaggerUIHandler())).Methods("GET")
 
 	// Start server
-	port := getEnv("PORT", "8080")
-	log.Printf("Account service starting on port %s...", port)
-	log.Fatal(http.ListenAndServe(":"+port, router))
+	logger.Info("account service starting", zap.String("port", port))
+	router.Use(servicekit.ServerErrorMiddleware)
+	servicekit.StartAnomalyDetection()
+
+	handler := servicekit.RecoveryMiddleware(corsMiddleware(loadCORSConfig())(router))
+	if err := listenAndServe(":"+port, handler); err != nil {
+		logger.Fatal("server failed", zap.Error(err))
+	}
+}
+
+// registerV1Routes defines the v1 account API
+func registerV1Routes(r *mux.Router) {
+	r.HandleFunc("/accounts", getAccounts).Methods("GET")
+	r.HandleFunc("/accounts/{id}", getAccount).Methods("GET")
+	r.HandleFunc("/accounts", createAccount).Methods("POST")
+	r.HandleFunc("/accounts/bulk", idempotent(createBulkAccounts)).Methods("POST")
+	r.HandleFunc("/accounts/{id}", updateAccount).Methods("PUT")
+	r.HandleFunc("/accounts/{id}/overdraft-limit", setOverdraftLimit).Methods("PUT")
+	r.HandleFunc("/accounts/{id}/metadata", updateAccountMetadata).Methods("PUT")
+	r.HandleFunc("/accounts/{id}/balance", getBalance).Methods("GET")
+	r.HandleFunc("/accounts/balances:batch", getBatchBalances).Methods("POST")
+	r.HandleFunc("/accounts/{id}/balance-history", getBalanceHistory).Methods("GET")
+	r.HandleFunc("/accounts/{id}/deposit", idempotent(sandboxed(depositFunds))).Methods("POST")
+	r.HandleFunc("/accounts/{id}/withdraw", idempotent(sandboxed(withdrawFunds))).Methods("POST")
+	r.HandleFunc("/accounts/transfer", idempotent(createTransfer)).Methods("POST")
+	r.HandleFunc("/transfers/{reference}", getTransfer).Methods("GET")
+	r.HandleFunc("/accounts/{id}/statement-subscription", subscribeStatements).Methods("PUT")
+	r.HandleFunc("/accounts/{id}/statement-subscription", unsubscribeStatements).Methods("DELETE")
+	r.HandleFunc("/accounts/{id}/statements", listStatements).Methods("GET")
+	r.HandleFunc("/statements/{id}/download", downloadStatement).Methods("GET")
+	r.HandleFunc("/accounts/{id}/exports", requestExport).Methods("POST")
+	r.HandleFunc("/accounts/{id}/exports", listExports).Methods("GET")
+	r.HandleFunc("/exports/{id}", getExport).Methods("GET")
+	r.HandleFunc("/exports/{id}/download", downloadExport).Methods("GET")
+	r.HandleFunc("/accounts/{id}/reconciliations", requestReconciliation).Methods("POST")
+	r.HandleFunc("/accounts/{id}/reconciliations", listReconciliations).Methods("GET")
+	r.HandleFunc("/accounts/{id}/reconciliations/{reconciliationId}", getReconciliation).Methods("GET")
+	r.HandleFunc("/accounts/{id}/authorizations", authorizeTransaction).Methods("POST")
+	r.HandleFunc("/accounts/{id}/spending-blocks", createSpendingBlock).Methods("POST")
+	r.HandleFunc("/accounts/{id}/spending-blocks", listSpendingBlocks).Methods("GET")
+	r.HandleFunc("/accounts/{id}/spending-blocks/{blockId}", liftSpendingBlock).Methods("DELETE")
+	r.HandleFunc("/accounts/{id}/subscriptions", listRecurringCharges).Methods("GET")
+	r.HandleFunc("/accounts/{id}/subscriptions/{merchant}/alert", setRecurringChargeAlert).Methods("PUT")
+	r.HandleFunc("/accounts/{id}/subscriptions/{merchant}/block", blockRecurringCharge).Methods("POST")
+	r.HandleFunc("/accounts/{id}/travel-notices", createTravelNotice).Methods("POST")
+	r.HandleFunc("/accounts/{id}/travel-notices", listTravelNotices).Methods("GET")
+	r.HandleFunc("/accounts/{id}/travel-notices/{noticeId}", cancelTravelNotice).Methods("DELETE")
+	r.HandleFunc("/accounts/{id}/geo-rules", getGeoRule).Methods("GET")
+	r.HandleFunc("/accounts/{id}/geo-rules", setGeoRule).Methods("PUT")
+	r.HandleFunc("/fraud/rulesets", createFraudRuleset).Methods("POST")
+	r.HandleFunc("/fraud/rulesets", listFraudRulesets).Methods("GET")
+	r.HandleFunc("/fraud/rulesets/{id}", getFraudRuleset).Methods("GET")
+	r.HandleFunc("/fraud/rulesets/{id}/rules", createFraudRule).Methods("POST")
+	r.HandleFunc("/fraud/rulesets/{id}/rules/{ruleId}", updateFraudRule).Methods("PUT")
+	r.HandleFunc("/fraud/rulesets/{id}/rules/{ruleId}", deleteFraudRule).Methods("DELETE")
+	r.HandleFunc("/fraud/rulesets/{id}/simulate", simulateFraudRuleset).Methods("POST")
+	r.HandleFunc("/fraud/rulesets/{id}/rollout", rolloutFraudRuleset).Methods("POST")
+	r.HandleFunc("/accounts/{id}/transactions/search", searchTransactionAnnotations).Methods("GET")
+	r.HandleFunc("/accounts/{id}/transactions/{txnId}/annotations", getTransactionAnnotation).Methods("GET")
+	r.HandleFunc("/accounts/{id}/transactions/{txnId}/note", setTransactionNote).Methods("PUT")
+	r.HandleFunc("/accounts/{id}/transactions/{txnId}/attachments", uploadTransactionAttachment).Methods("POST")
+	r.HandleFunc("/accounts/{id}/transactions/{txnId}/attachments/{attachmentId}", deleteTransactionAttachment).Methods("DELETE")
+	r.HandleFunc("/attachments/{id}/download", downloadAttachment).Methods("GET")
+	r.HandleFunc("/accounts/{id}/transactions/{txnId}/splits", getTransactionSplit).Methods("GET")
+	r.HandleFunc("/accounts/{id}/transactions/{txnId}/splits", setTransactionSplit).Methods("PUT")
+	r.HandleFunc("/accounts/{id}/transactions/{txnId}/splits", deleteTransactionSplit).Methods("DELETE")
+	r.HandleFunc("/accounts/{id}/reports/spending", getSpendingReport).Methods("GET")
+	r.HandleFunc("/accounts/{id}/insights/merchants", getMerchantInsights).Methods("GET")
+	r.HandleFunc("/groups", createExpenseGroup).Methods("POST")
+	r.HandleFunc("/groups/{id}", getExpenseGroup).Methods("GET")
+	r.HandleFunc("/groups/{id}/members", addExpenseGroupMember).Methods("POST")
+	r.HandleFunc("/groups/{id}/expenses", addGroupExpense).Methods("POST")
+	r.HandleFunc("/groups/{id}/expenses", listGroupExpenses).Methods("GET")
+	r.HandleFunc("/groups/{id}/balances", getGroupBalances).Methods("GET")
+	r.HandleFunc("/groups/{id}/settle", settleGroup).Methods("POST")
+	r.HandleFunc("/payment-requests", createPaymentRequest).Methods("POST")
+	r.HandleFunc("/accounts/{id}/payment-requests", listPaymentRequests).Methods("GET")
+	r.HandleFunc("/payment-requests/{id}/approve", approvePaymentRequest).Methods("POST")
+	r.HandleFunc("/payment-requests/{id}/decline", declinePaymentRequest).Methods("POST")
+	r.HandleFunc("/payment-requests/{id}/cancel", cancelPaymentRequest).Methods("POST")
+	r.HandleFunc("/payment-requests/{id}/remind", remindPaymentRequest).Methods("POST")
+	r.HandleFunc("/accounts/{id}/prepaid", createPrepaidAccount).Methods("POST")
+	r.HandleFunc("/accounts/{id}/prepaid", listPrepaidAccounts).Methods("GET")
+	r.HandleFunc("/prepaid/{prepaidId}/close", closePrepaidAccount).Methods("POST")
+	r.HandleFunc("/pay-in/{reference}", getPayInDetails).Methods("GET")
+	r.HandleFunc("/escrows", createEscrow).Methods("POST")
+	r.HandleFunc("/escrows/{id}", getEscrow).Methods("GET")
+	r.HandleFunc("/accounts/{id}/escrows", listAccountEscrows).Methods("GET")
+	r.HandleFunc("/escrows/{id}/approvals", approveEscrow).Methods("POST")
+	r.HandleFunc("/accounts/{id}/liens", placeLien).Methods("POST")
+	r.HandleFunc("/accounts/{id}/liens", listLiens).Methods("GET")
+	r.HandleFunc("/liens/{id}", amendLien).Methods("PUT")
+	r.HandleFunc("/liens/{id}", releaseLien).Methods("DELETE")
+	r.HandleFunc("/liens/{id}/history", getLienHistory).Methods("GET")
+	r.HandleFunc("/accounts/{id}/legal-orders", serveLegalOrder).Methods("POST")
+	r.HandleFunc("/accounts/{id}/legal-orders", listLegalOrders).Methods("GET")
+	r.HandleFunc("/legal-orders/{id}", getLegalOrder).Methods("GET")
+	r.HandleFunc("/legal-orders/{id}/sweep", sweepLegalOrder).Methods("POST")
+	r.HandleFunc("/legal-orders/{id}/release", releaseLegalOrder).Methods("POST")
+	r.HandleFunc("/customers/{customerId}/estate", reportDeath).Methods("POST")
+	r.HandleFunc("/estates/{id}", getEstate).Methods("GET")
+	r.HandleFunc("/estates/{id}/documents", uploadEstateDocument).Methods("POST")
+	r.HandleFunc("/estate-documents/{id}/download", downloadEstateDocument).Methods("GET")
+	r.HandleFunc("/estates/{id}/verify", verifyEstate).Methods("POST")
+	r.HandleFunc("/estates/{id}/transfers", requestEstateTransfer).Methods("POST")
+	r.HandleFunc("/estate-transfers/{id}/approve", approveEstateTransfer).Methods("POST")
+	r.HandleFunc("/estate-transfers/{id}/reject", rejectEstateTransfer).Methods("POST")
+	r.HandleFunc("/estates/{id}/close", closeEstate).Methods("POST")
+	r.HandleFunc("/estates/{id}/report", getEstateReport).Methods("GET")
+	r.HandleFunc("/accounts/{id}/ledger-adjustments", requestLedgerAdjustment).Methods("POST")
+	r.HandleFunc("/accounts/{id}/ledger-adjustments", listLedgerAdjustments).Methods("GET")
+	r.HandleFunc("/ledger-adjustments", listLedgerAdjustments).Methods("GET")
+	r.HandleFunc("/ledger-adjustments/{id}", getLedgerAdjustment).Methods("GET")
+	r.HandleFunc("/ledger-adjustments/{id}/approve", approveLedgerAdjustment).Methods("POST")
+	r.HandleFunc("/ledger-adjustments/{id}/reject", rejectLedgerAdjustment).Methods("POST")
+	r.HandleFunc("/accounts/{id}/branch", updateAccountBranch).Methods("PUT")
+	r.HandleFunc("/accounts/{id}/fees", chargeFee).Methods("POST")
+	r.HandleFunc("/accounts/{id}/fees", listFees).Methods("GET")
+	r.HandleFunc("/reports/profitability", getProfitabilityReport).Methods("GET")
+	r.HandleFunc("/accounts/{id}/atm-cards", linkATMCard).Methods("POST")
+	r.HandleFunc("/accounts/{id}/atm-cards", listATMCards).Methods("GET")
+	r.HandleFunc("/atm-cards/{id}/status", updateATMCardStatus).Methods("PUT")
+	r.HandleFunc("/atm/authorizations", authorizeATMWithdrawal).Methods("POST")
+	r.HandleFunc("/atm/withdrawals/{reference}", getATMWithdrawal).Methods("GET")
+	r.HandleFunc("/atm/withdrawals/{reference}/confirm", confirmATMWithdrawal).Methods("POST")
+	r.HandleFunc("/atm/withdrawals/{reference}/reverse", reverseATMWithdrawal).Methods("POST")
+	r.HandleFunc("/agents", createAgent).Methods("POST")
+	r.HandleFunc("/agents", listAgents).Methods("GET")
+	r.HandleFunc("/agents/{id}", getAgent).Methods("GET")
+	r.HandleFunc("/agents/{id}/status", updateAgentStatus).Methods("PUT")
+	r.HandleFunc("/agents/{id}/commission", updateAgentCommission).Methods("PUT")
+	r.HandleFunc("/agents/{id}/deposits", listAgentDepositsByID).Methods("GET")
+	r.HandleFunc("/agent-deposits/{reference}/reverse", reverseAgentDeposit).Methods("POST")
+	r.HandleFunc("/agent/profile", getAgentProfile).Methods("GET")
+	r.HandleFunc("/agent/deposits", idempotent(createAgentDeposit)).Methods("POST")
+	r.HandleFunc("/agent/deposits", listAgentDeposits).Methods("GET")
+	r.HandleFunc("/agent/commissions", getAgentCommissions).Methods("GET")
+	r.HandleFunc("/accounts/{id}/ownership-transfers", requestOwnershipTransfer).Methods("POST")
+	r.HandleFunc("/accounts/{id}/ownership-history", getOwnershipHistory).Methods("GET")
+	r.HandleFunc("/ownership-transfers/{id}", getOwnershipTransfer).Methods("GET")
+	r.HandleFunc("/ownership-transfers/{id}/confirm", confirmOwnershipTransfer).Methods("POST")
+	r.HandleFunc("/ownership-transfers/{id}/kyc", reviewOwnershipKYC).Methods("POST")
+	r.HandleFunc("/ownership-transfers/{id}/cancel", cancelOwnershipTransfer).Methods("POST")
+	r.HandleFunc("/customers/{id}/net-worth", getNetWorth).Methods("GET")
+	r.HandleFunc("/accounts/{id}/alert-rules", createAlertRule).Methods("POST")
+	r.HandleFunc("/accounts/{id}/alert-rules", listAlertRules).Methods("GET")
+	r.HandleFunc("/accounts/{id}/alert-rules/{ruleId}", updateAlertRule).Methods("PUT")
+	r.HandleFunc("/accounts/{id}/alert-rules/{ruleId}", deleteAlertRule).Methods("DELETE")
+	r.HandleFunc("/accounts/{id}/auto-topup", setAutoTopUp).Methods("PUT")
+	r.HandleFunc("/accounts/{id}/auto-topup", getAutoTopUp).Methods("GET")
+	r.HandleFunc("/accounts/{id}/auto-topup", deleteAutoTopUp).Methods("DELETE")
+	r.HandleFunc("/accounts/{id}/auto-topup/executions", listAutoTopUpExecutions).Methods("GET")
+	r.HandleFunc("/accounts/{id}/sweep", setSweepConfig).Methods("PUT")
+	r.HandleFunc("/accounts/{id}/sweep", getSweepConfig).Methods("GET")
+	r.HandleFunc("/accounts/{id}/sweep", deleteSweepConfig).Methods("DELETE")
+	r.HandleFunc("/accounts/{id}/sweep/runs", listSweepRuns).Methods("GET")
+	r.HandleFunc("/accounts/{id}/virtual-accounts", createVirtualAccount).Methods("POST")
+	r.HandleFunc("/accounts/{id}/virtual-accounts", listVirtualAccounts).Methods("GET")
+	r.HandleFunc("/accounts/{id}/incoming-payments", receiveIncomingPayment).Methods("POST")
+	r.HandleFunc("/accounts/{id}/incoming-payments", listIncomingPayments).Methods("GET")
+	r.HandleFunc("/incoming-payments/{id}/match", matchIncomingPaymentManually).Methods("POST")
+	r.HandleFunc("/accounts/{id}/matching-rules", createMatchingRule).Methods("POST")
+	r.HandleFunc("/accounts/{id}/matching-rules", listMatchingRules).Methods("GET")
+	r.HandleFunc("/matching-rules/{id}", deleteMatchingRule).Methods("DELETE")
+	r.HandleFunc("/virtual-accounts/{id}", getVirtualAccount).Methods("GET")
+	r.HandleFunc("/virtual-accounts/{id}/entries", listVirtualAccountEntries).Methods("GET")
+	r.HandleFunc("/virtual-accounts/{id}/payouts", payOutVirtualAccount).Methods("POST")
+	r.HandleFunc("/virtual-accounts/{id}/close", closeVirtualAccount).Methods("POST")
+	r.HandleFunc("/rates", publishRate).Methods("POST")
+	r.HandleFunc("/rates", listRates).Methods("GET")
+	r.HandleFunc("/rates/effective", getEffectiveRate).Methods("GET")
+	r.HandleFunc("/accounts/{id}/interest-accruals", getInterestAccruals).Methods("GET")
+	r.HandleFunc("/accounts/{id}/loan", createLoan).Methods("POST")
+	r.HandleFunc("/accounts/{id}/loan", getLoan).Methods("GET")
+	r.HandleFunc("/accounts/{id}/loan/payoff-quote", getPayoffQuote).Methods("GET")
+	r.HandleFunc("/accounts/{id}/loan/restructure", restructureLoan).Methods("POST")
+	r.HandleFunc("/accounts/{id}/loan/restructures", listLoanRestructures).Methods("GET")
+	r.HandleFunc("/accounts/{id}/delinquency", getAccountDelinquency).Methods("GET")
+	r.HandleFunc("/collections/queue", getCollectionsQueue).Methods("GET")
+	r.HandleFunc("/delinquencies/{id}", getDelinquency).Methods("GET")
+	r.HandleFunc("/delinquencies/{id}/assign", assignDelinquency).Methods("POST")
+	r.HandleFunc("/delinquencies/{id}/promises", createPromiseToPay).Methods("POST")
+	r.HandleFunc("/customers/{id}/credit-profile", setCreditProfile).Methods("PUT")
+	r.HandleFunc("/customers/{id}/credit-limits", listCreditLimits).Methods("GET")
+	r.HandleFunc("/customers/{id}/credit-limits/recalculate", recalculateCreditLimits).Methods("POST")
+	r.HandleFunc("/customers/{id}/credit-limits/{product}/boost", boostCreditLimit).Methods("POST")
+	r.HandleFunc("/customers/{id}/credit-limits/{product}/increase-requests", requestCreditLimitIncrease).Methods("POST")
+	r.HandleFunc("/credit-limit-requests/{id}/approve", approveCreditLimitRequest).Methods("POST")
+	r.HandleFunc("/credit-limit-requests/{id}/reject", rejectCreditLimitRequest).Methods("POST")
+	r.HandleFunc("/customers/{id}/exposure", getCustomerExposure).Methods("GET")
+	r.HandleFunc("/customers/{id}/income-verifications", listIncomeVerifications).Methods("GET")
+	r.HandleFunc("/customers/{id}/income-verifications/transactions", verifyIncomeFromTransactions).Methods("POST")
+	r.HandleFunc("/customers/{id}/income-verifications/documents", uploadIncomeDocument).Methods("POST")
+	r.HandleFunc("/income-verifications/{id}/approve", approveIncomeVerification).Methods("POST")
+	r.HandleFunc("/income-verifications/{id}/reject", rejectIncomeVerification).Methods("POST")
+	r.HandleFunc("/income-verifications/{id}/download", downloadIncomeDocument).Methods("GET")
+	r.HandleFunc("/customers/{id}/affordability", getAffordability).Methods("GET")
+	r.HandleFunc("/customers/{id}/reparent", reparentCustomer).Methods("POST")
+	r.HandleFunc("/customers/{id}/kyc-schedule", getKYCSchedule).Methods("GET")
+	r.HandleFunc("/customers/{id}/kyc-schedule", setKYCSchedule).Methods("PUT")
+	r.HandleFunc("/customers/{id}/kyc-refreshes", recordKYCRefresh).Methods("POST")
+	r.HandleFunc("/compliance/kyc-refreshes", getKYCRefreshDashboard).Methods("GET")
+	r.HandleFunc("/accounts/{id}/signature-envelopes", createSignatureEnvelope).Methods("POST")
+	r.HandleFunc("/accounts/{id}/signature-envelopes", listSignatureEnvelopes).Methods("GET")
+	r.HandleFunc("/signature-envelopes/{id}", getSignatureEnvelope).Methods("GET")
+	r.HandleFunc("/esignature/webhook", receiveSignatureWebhook).Methods("POST")
+	r.HandleFunc("/customers/{id}/documents", listCustomerDocuments).Methods("GET")
+	r.HandleFunc("/customer-documents/{id}/download", downloadCustomerDocument).Methods("GET")
+	r.HandleFunc("/sod-rules", listSoDRules).Methods("GET")
+	r.HandleFunc("/sod-rules/{name}", putSoDRule).Methods("PUT")
+	r.HandleFunc("/compliance/sod-report", getSoDReport).Methods("GET")
+	r.HandleFunc("/tokens", tokenizeValue).Methods("POST")
+	r.HandleFunc("/tokens/detokenize", detokenizeValue).Methods("POST")
+	r.HandleFunc("/tokens/audit", getTokenAccessLog).Methods("GET")
+	r.HandleFunc("/webhooks/test", sendTestWebhook).Methods("POST")
+	r.HandleFunc("/webhooks/signing-keys", listWebhookSigningKeys).Methods("GET")
+	r.HandleFunc("/signing-keys/usage", getSigningKeyUsage).Methods("GET")
 }
 
 func initDB() {
+	connectDB()
+	servicekit.SetStartupPhase(servicekit.PhaseMigrating)
+	if err := servicekit.RunMigrations(serviceContext, baselineSchema()); err != nil {
+		logger.Fatal("failed to migrate database", zap.Error(err))
+	}
+}
+
+func connectDB() {
 	// Get database connection parameters from environment variables
 	host := getEnv("DB_HOST", "localhost")
 	port := getEnv("DB_PORT", "5432")
@@ -67,17 +417,21 @@ func initDB() {
 	var err error
 	db, err = sql.Open("postgres", connStr)
 	if err != nil {
-		log.Fatalf("Failed to connect to database: %v", err)
+		logger.Fatal("failed to connect to database", zap.Error(err))
 	}
 
 	// Check connection
-	err = db.Ping()
+	err = db.PingContext(serviceContext)
 	if err != nil {
-		log.Fatalf("Failed to ping database: %v", err)
+		logger.Fatal("failed to ping database", zap.Error(err))
 	}
 
-	log.Println("Successfully connected to database")
+	logger.Info("connected to database")
+}
 
+// baselineSchema is the schema before it was versioned, applied as version 1.
+// It is frozen: change the schema with a new file in migrations/.
+func baselineSchema() []string {
 	// Create accounts table if it doesn't exist
 	createTableSQL := `
 	CREATE TABLE IF NOT EXISTS accounts (
@@ -91,17 +445,40 @@ func initDB() {
 		updated_at TIMESTAMP NOT NULL DEFAULT NOW()
 	);`
 
-	_, err = db.Exec(createTableSQL)
-	if err != nil {
-		log.Fatalf("Failed to create accounts table: %v", err)
+	// Create the accounts table and the tables owned by the feature modules
+	return []string{
+		createTableSQL,
+		statementTablesSQL,
+		exportTablesSQL,
+		spendingBlockTablesSQL,
+		authorizationTablesSQL,
+		recurringTablesSQL,
+		travelTablesSQL,
+		geoRuleTablesSQL,
+		riskTablesSQL,
+		fraudRuleTablesSQL,
+		metadataTablesSQL,
+		transactionNoteTablesSQL,
+		splitTablesSQL,
+		groupTablesSQL,
+		paymentRequestTablesSQL,
+		prepaidTablesSQL,
+		escrowTablesSQL,
+		lienTablesSQL,
+		legalOrderTablesSQL,
+		estateTablesSQL,
+		ownershipTablesSQL,
+		balanceSnapshotTablesSQL,
+		merchantInsightTablesSQL,
+		alertRuleTablesSQL, autoTopUpTablesSQL, sweepTablesSQL, virtualAccountTablesSQL, paymentMatchingTablesSQL, rateTablesSQL, loanTablesSQL, loanRestructureTablesSQL, collectionTablesSQL, creditLimitTablesSQL, incomeVerificationTablesSQL, customerMergeTablesSQL, kycRefreshTablesSQL, esignatureTablesSQL, sodTablesSQL, transferTablesSQL, tokenizationTablesSQL, idempotencyTablesSQL, servicekit.ServiceTokenTablesSQL, servicekit.SLOTablesSQL, servicekit.AnomalyTablesSQL, servicekit.SigningUsageTablesSQL, bulkAccountTablesSQL,
 	}
 }
 
-func healthCheck(w http.ResponseWriter, r *http.Request) {
-	json.NewEncoder(w).Encode(map[string]bool{"status": true})
-}
-
 func getAccounts(w http.ResponseWriter, r *http.Request) {
+	if !requireAccountReader(w, r) {
+		return
+	}
+
 	// Get query parameters for pagination
 	limit := r.URL.Query().Get("limit")
 	offset := r.URL.Query().Get("offset")
@@ -114,11 +491,12 @@ func getAccounts(w http.ResponseWriter, r *http.Request) {
 		offset = "0" // Default offset
 	}
 
-	// Query accounts with pagination
+	// Query accounts with pagination; customers only list their own
 	query := `SELECT id, customer_id, account_type, balance, currency_code, status, 
-			  created_at, updated_at FROM accounts LIMIT $1 OFFSET $2`
+			  overdraft_limit, created_at, updated_at, metadata, branch_code, COALESCE(account_number, '') FROM accounts WHERE ($3 = 0 OR customer_id = $3)
+			  ORDER BY id LIMIT $1 OFFSET $2`
 	
-	rows, err := db.Query(query, limit, offset)
+	rows, err := db.QueryContext(r.Context(), query, limit, offset, accountListFilter(r))
 	if err != nil {
 		http.Error(w, err.Error(), http.StatusInternalServerError)
 		return
@@ -129,7 +507,7 @@ func getAccounts(w http.ResponseWriter, r *http.Request) {
 	for rows.Next() {
 		var a Account
 		err := rows.Scan(&a.ID, &a.CustomerID, &a.AccountType, &a.Balance, 
-						&a.CurrencyCode, &a.Status, &a.CreatedAt, &a.UpdatedAt)
+						&a.CurrencyCode, &a.Status, &a.OverdraftLimit, &a.CreatedAt, &a.UpdatedAt, &a.Metadata, &a.BranchCode, &a.AccountNumber)
 		if err != nil {
 			http.Error(w, err.Error(), http.StatusInternalServerError)
 			return
@@ -142,16 +520,20 @@ func getAccounts(w http.ResponseWriter, r *http.Request) {
 }
 
 func getAccount(w http.ResponseWriter, r *http.Request) {
+	if !requireAccountReader(w, r) {
+		return
+	}
+
 	params := mux.Vars(r)
 	id := params["id"]
 
 	var account Account
 	query := `SELECT id, customer_id, account_type, balance, currency_code, status, 
-			  created_at, updated_at FROM accounts WHERE id = $1`
+			  overdraft_limit, created_at, updated_at, metadata, branch_code, COALESCE(account_number, '') FROM accounts WHERE id = $1`
 	
-	err := db.QueryRow(query, id).Scan(&account.ID, &account.CustomerID, &account.AccountType, 
+	err := db.QueryRowContext(r.Context(), query, id).Scan(&account.ID, &account.CustomerID, &account.AccountType, 
 									  &account.Balance, &account.CurrencyCode, &account.Status, 
-									  &account.CreatedAt, &account.UpdatedAt)
+									  &account.OverdraftLimit, &account.CreatedAt, &account.UpdatedAt, &account.Metadata, &account.BranchCode, &account.AccountNumber)
 	if err != nil {
 		if err == sql.ErrNoRows {
 			http.Error(w, "Account not found", http.StatusNotFound)
@@ -166,25 +548,108 @@ func getAccount(w http.ResponseWriter, r *http.Request) {
 }
 
 func createAccount(w http.ResponseWriter, r *http.Request) {
+	if requestRole(r) != "customer" && !requireRole(w, r, tellerRoles...) {
+		return
+	}
+
 	var account Account
 	err := json.NewDecoder(r.Body).Decode(&account)
 	if err != nil {
-		http.Error(w, err.Error(), http.StatusBadRequest)
+		http.Error(w, "Invalid request body", http.StatusBadRequest)
 		return
 	}
 
+	// Customers open accounts for themselves only
+	if requestRole(r) == "customer" {
+		customerID, _ := strconv.Atoi(r.Header.Get("X-User-ID"))
+		if account.CustomerID != 0 && account.CustomerID != customerID {
+			http.Error(w, "Customers may only open accounts for themselves", http.StatusForbidden)
+			return
+		}
+		account.CustomerID = customerID
+	}
+
 	// Validate required fields
 	if account.CustomerID == 0 || account.AccountType == "" {
 		http.Error(w, "Customer ID and account type are required", http.StatusBadRequest)
 		return
 	}
 
+	// Accounts open empty and are funded by deposits or transfers; opening
+	// balances of migrated accounts go through POST /accounts/bulk
+	if account.Balance != 0 {
+		http.Error(w, "balance must not be set when opening an account", http.StatusBadRequest)
+		return
+	}
+	if account.Status != "" && account.Status != "active" {
+		http.Error(w, "Accounts open active", http.StatusBadRequest)
+		return
+	}
+
+	restricted, err := kycRestricted(r.Context(), account.CustomerID)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	if restricted {
+		http.Error(w, "KYC refresh is overdue; complete it before opening accounts", http.StatusConflict)
+		return
+	}
+
+	kycStatus, err := customerKYCStatus(r.Context(), account.CustomerID)
+	if err != nil {
+		servicekit.RequestLogger(r.Context()).Error("could not check kyc status", zap.Int("customer_id", account.CustomerID), zap.Error(err))
+		http.Error(w, ErrKYCUnavailable.Error(), http.StatusBadGateway)
+		return
+	}
+	if kycStatus != "verified" {
+		http.Error(w, "The customer's KYC must be verified before opening accounts", http.StatusConflict)
+		return
+	}
+
+	if account.CurrencyCode == "" {
+		account.CurrencyCode = "USD"
+	}
+	// Overdrafts are granted with PUT /accounts/{id}/overdraft-limit
+	account.OverdraftLimit = 0
+	account.Status = "active"
+	if account.BranchCode, err = normalizeBranchCode(account.BranchCode); err != nil {
+		http.Error(w, "branch_code must be 2 to 10 letters or digits", http.StatusBadRequest)
+		return
+	}
+
+	tx, err := db.BeginTx(r.Context(), nil)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	defer tx.Rollback()
+
+	account.AccountNumber, err = newAccountNumber(r.Context(), tx)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
 	// Insert new account
-	query := `INSERT INTO accounts (customer_id, account_type, balance, currency_code, status) 
-			  VALUES ($1, $2, $3, $4, $5) RETURNING id, created_at, updated_at`
+	query := `INSERT INTO accounts (customer_id, account_type, balance, currency_code, status, branch_code, account_number) 
+			  VALUES ($1, $2, $3, $4, $5, $6, $7) RETURNING id, created_at, updated_at`
 	
-	err = db.QueryRow(query, account.CustomerID, account.AccountType, account.Balance, 
-					 account.CurrencyCode, account.Status).Scan(&account.ID, &account.CreatedAt, &account.UpdatedAt)
+	err = tx.QueryRowContext(r.Context(), query, account.CustomerID, account.AccountType, account.Balance, 
+					 account.CurrencyCode, account.Status, account.BranchCode, account.AccountNumber).Scan(&account.ID, &account.CreatedAt, &account.UpdatedAt)
+	if err != nil {
+		writeDBError(w, err)
+		return
+	}
+
+	err = enqueueEvent(r.Context(), tx, "account.created", fmt.Sprintf("account:%d", account.ID), map[string]interface{}{
+		"account_id": account.ID, "customer_id": account.CustomerID, "account_type": account.AccountType,
+		"currency_code": account.CurrencyCode, "status": account.Status, "branch_code": account.BranchCode,
+		"account_number": account.AccountNumber,
+	})
+	if err == nil {
+		err = tx.Commit()
+	}
 	if err != nil {
 		http.Error(w, err.Error(), http.StatusInternalServerError)
 		return
@@ -195,25 +660,41 @@ func createAccount(w http.ResponseWriter, r *http.Request) {
 	json.NewEncoder(w).Encode(account)
 }
 
+// accountStatusChanges are the status changes PUT /accounts/{id} may make.
+// Frozen estate accounts, KYC-restricted accounts and closed ones are only
+// left through their own workflows.
+var accountStatusChanges = map[string]map[string]bool{
+	"active": {"closed": true},
+}
+
+// updateAccount changes an account's type or closes it. Unset fields keep
+// their value; an account closes only once it is empty.
 func updateAccount(w http.ResponseWriter, r *http.Request) {
+	if !requireRole(w, r, tellerRoles...) {
+		return
+	}
+
 	params := mux.Vars(r)
 	id := params["id"]
 
 	var account Account
 	err := json.NewDecoder(r.Body).Decode(&account)
 	if err != nil {
-		http.Error(w, err.Error(), http.StatusBadRequest)
+		http.Error(w, "Invalid request body", http.StatusBadRequest)
 		return
 	}
 
-	// Update account
-	query := `UPDATE accounts SET account_type = $1, status = $2, updated_at = NOW() 
-			  WHERE id = $3 RETURNING id, customer_id, account_type, balance, currency_code, status, created_at, updated_at`
-	
-	err = db.QueryRow(query, account.AccountType, account.Status, id).Scan(&account.ID, &account.CustomerID, 
-																		 &account.AccountType, &account.Balance, 
-																		 &account.CurrencyCode, &account.Status, 
-																		 &account.CreatedAt, &account.UpdatedAt)
+	tx, err := db.BeginTx(r.Context(), nil)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	defer tx.Rollback()
+
+	var accountType, status string
+	var balance Money
+	err = tx.QueryRowContext(r.Context(), `SELECT account_type, status, balance FROM accounts WHERE id = $1 FOR UPDATE`,
+		id).Scan(&accountType, &status, &balance)
 	if err != nil {
 		if err == sql.ErrNoRows {
 			http.Error(w, "Account not found", http.StatusNotFound)
@@ -222,7 +703,53 @@ func updateAccount(w http.ResponseWriter, r *http.Request) {
 		}
 		return
 	}
+	if account.AccountType == "" {
+		account.AccountType = accountType
+	}
+	if account.Status == "" {
+		account.Status = status
+	}
+	if account.Status != status {
+		if !accountStatusChanges[status][account.Status] {
+			http.Error(w, fmt.Sprintf("Account cannot change from %s to %s here", status, account.Status), http.StatusConflict)
+			return
+		}
+		if account.Status == "closed" {
+			liens, err := activeLienTotal(r.Context(), tx, id)
+			if err != nil {
+				http.Error(w, err.Error(), http.StatusInternalServerError)
+				return
+			}
+			if balance != 0 || liens != 0 {
+				http.Error(w, "Only an empty account without active liens can be closed", http.StatusConflict)
+				return
+			}
+		}
+	} else if account.AccountType != accountType && status != "active" {
+		http.Error(w, "Account is not active", http.StatusConflict)
+		return
+	}
 
+	// Update account
+	query := `UPDATE accounts SET account_type = $1, status = $2, updated_at = NOW() 
+			  WHERE id = $3 RETURNING id, customer_id, account_type, balance, currency_code, status, overdraft_limit,
+			  created_at, updated_at, metadata, branch_code, COALESCE(account_number, '')`
+	
+	err = tx.QueryRowContext(r.Context(), query, account.AccountType, account.Status, id).Scan(&account.ID, &account.CustomerID, 
+																		 &account.AccountType, &account.Balance, 
+																		 &account.CurrencyCode, &account.Status, 
+																		 &account.OverdraftLimit, &account.CreatedAt, &account.UpdatedAt, &account.Metadata, &account.BranchCode, &account.AccountNumber)
+	if err != nil {
+		writeDBError(w, err)
+		return
+	}
+	if err := tx.Commit(); err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	servicekit.RequestLogger(r.Context()).Info("account updated", zap.String("account_id", id), zap.String("status", account.Status),
+		zap.String("account_type", account.AccountType), zap.String("actor", requestActor(r)))
 	w.Header().Set("Content-Type", "application/json")
 	json.NewEncoder(w).Encode(account)
 }
@@ -231,11 +758,11 @@ func getBalance(w http.ResponseWriter, r *http.Request) {
 	params := mux.Vars(r)
 	id := params["id"]
 
-	var balance float64
+	var balance Money
 	var currencyCode string
 	query := `SELECT balance, currency_code FROM accounts WHERE id = $1`
 	
-	err := db.QueryRow(query, id).Scan(&balance, &currencyCode)
+	err := db.QueryRowContext(r.Context(), query, id).Scan(&balance, &currencyCode)
 	if err != nil {
 		if err == sql.ErrNoRows {
 			http.Error(w, "Account not found", http.StatusNotFound)
@@ -245,26 +772,39 @@ func getBalance(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
+	liens, err := activeLienTotal(r.Context(), db, id)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
 	w.Header().Set("Content-Type", "application/json")
 	json.NewEncoder(w).Encode(map[string]interface{}{
 		"account_id": id,
 		"balance": balance,
+		"available_balance": balance - liens,
+		"lien_amount": liens,
 		"currency_code": currencyCode,
 	})
 }
 
 func depositFunds(w http.ResponseWriter, r *http.Request) {
+	// Cash is taken at the counter; customers fund accounts with transfers
+	if !requireRole(w, r, tellerRoles...) {
+		return
+	}
+
 	params := mux.Vars(r)
 	id := params["id"]
 
 	// Parse request body
 	var requestBody struct {
-		Amount float64 `json:"amount"`
+		Amount Money `json:"amount"`
 	}
 	
 	err := json.NewDecoder(r.Body).Decode(&requestBody)
 	if err != nil {
-		http.Error(w, err.Error(), http.StatusBadRequest)
+		http.Error(w, "Invalid request body", http.StatusBadRequest)
 		return
 	}
 
@@ -275,20 +815,17 @@ func depositFunds(w http.ResponseWriter, r *http.Request) {
 	}
 
 	// Begin transaction
-	tx, err := db.Begin()
+	tx, err := db.BeginTx(r.Context(), nil)
 	if err != nil {
 		http.Error(w, err.Error(), http.StatusInternalServerError)
 		return
 	}
 	defer tx.Rollback()
 
-	// Update balance
-	query := `UPDATE accounts SET balance = balance + $1, updated_at = NOW() 
-			  WHERE id = $2 RETURNING balance, currency_code`
-	
-	var newBalance float64
-	var currencyCode string
-	err = tx.QueryRow(query, requestBody.Amount, id).Scan(&newBalance, &currencyCode)
+	// Only active accounts take deposits: frozen estate and KYC-restricted
+	// accounts move funds through their supervised workflows
+	var status string
+	err = tx.QueryRowContext(r.Context(), "SELECT status FROM accounts WHERE id = $1 FOR UPDATE", id).Scan(&status)
 	if err != nil {
 		if err == sql.ErrNoRows {
 			http.Error(w, "Account not found", http.StatusNotFound)
@@ -297,6 +834,46 @@ func depositFunds(w http.ResponseWriter, r *http.Request) {
 		}
 		return
 	}
+	if status != "active" {
+		http.Error(w, ErrTransferAccountInactive.Error(), http.StatusConflict)
+		return
+	}
+
+	// Update balance
+	query := `UPDATE accounts SET balance = balance + $1, updated_at = NOW() 
+			  WHERE id = $2 RETURNING balance, currency_code`
+	
+	var newBalance Money
+	var currencyCode string
+	err = tx.QueryRowContext(r.Context(), query, requestBody.Amount, id).Scan(&newBalance, &currencyCode)
+	if err != nil {
+		writeDBError(w, err)
+		return
+	}
+
+	// Queue the posting for the core banking system
+	accountID, _ := strconv.Atoi(id)
+	err = queueCorePosting(r.Context(), tx, CorePosting{AccountID: accountID, Amount: requestBody.Amount,
+		Currency: currencyCode, Description: "Deposit"})
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	posting := ledgerChange(accountID, requestBody.Amount, currencyCode, "Deposit")
+	posting.Type = "deposit"
+	err = recordInLedger(r.Context(), tx, posting)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadGateway)
+		return
+	}
+
+	err = enqueueEvent(r.Context(), tx, "funds.deposited", "account:"+id, map[string]interface{}{
+		"account_id": accountID, "amount": requestBody.Amount, "currency_code": currencyCode, "balance": newBalance,
+	})
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
 
 	// Commit transaction
 	err = tx.Commit()
@@ -305,28 +882,34 @@ func depositFunds(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
+	publishAccountEvent(AccountEvent{AccountID: accountID, Type: "deposit", Amount: requestBody.Amount})
+
 	// Return updated balance
 	w.Header().Set("Content-Type", "application/json")
 	json.NewEncoder(w).Encode(map[string]interface{}{
 		"account_id": id,
 		"balance": newBalance,
 		"currency_code": currencyCode,
-		"message": fmt.Sprintf("Successfully deposited %.2f", requestBody.Amount),
+		"message": fmt.Sprintf("Successfully deposited %s", requestBody.Amount),
 	})
 }
 
 func withdrawFunds(w http.ResponseWriter, r *http.Request) {
+	if !requireRole(w, r, fundsMovementRoles...) {
+		return
+	}
+
 	params := mux.Vars(r)
 	id := params["id"]
 
 	// Parse request body
 	var requestBody struct {
-		Amount float64 `json:"amount"`
+		Amount Money `json:"amount"`
 	}
 	
 	err := json.NewDecoder(r.Body).Decode(&requestBody)
 	if err != nil {
-		http.Error(w, err.Error(), http.StatusBadRequest)
+		http.Error(w, "Invalid request body", http.StatusBadRequest)
 		return
 	}
 
@@ -337,16 +920,20 @@ func withdrawFunds(w http.ResponseWriter, r *http.Request) {
 	}
 
 	// Begin transaction
-	tx, err := db.Begin()
+	tx, err := db.BeginTx(r.Context(), nil)
 	if err != nil {
 		http.Error(w, err.Error(), http.StatusInternalServerError)
 		return
 	}
 	defer tx.Rollback()
 
-	// Check if account has sufficient funds
-	var currentBalance float64
-	err = tx.QueryRow("SELECT balance FROM accounts WHERE id = $1", id).Scan(&currentBalance)
+	// Check if account has sufficient funds, counting its overdraft. The row
+	// stays locked until the transaction ends, so a concurrent withdrawal or
+	// transfer waits for this one and checks the balance it leaves.
+	var currentBalance, overdraftLimit Money
+	var status string
+	err = tx.QueryRowContext(r.Context(), "SELECT balance, overdraft_limit, status FROM accounts WHERE id = $1 FOR UPDATE",
+		id).Scan(&currentBalance, &overdraftLimit, &status)
 	if err != nil {
 		if err == sql.ErrNoRows {
 			http.Error(w, "Account not found", http.StatusNotFound)
@@ -355,9 +942,22 @@ func withdrawFunds(w http.ResponseWriter, r *http.Request) {
 		}
 		return
 	}
+	// Funds leave frozen estate and KYC-restricted accounts only through
+	// supervised transfers
+	if status != "active" {
+		http.Error(w, ErrTransferAccountInactive.Error(), http.StatusConflict)
+		return
+	}
 
-	if currentBalance < requestBody.Amount {
-		http.Error(w, "Insufficient funds", http.StatusBadRequest)
+	// Funds held by liens are not available for withdrawal
+	liens, err := activeLienTotal(r.Context(), tx, id)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	if err := checkFunds(currentBalance-liens, overdraftLimit, requestBody.Amount); err != nil {
+		writeFundsError(w, err)
 		return
 	}
 
@@ -365,9 +965,33 @@ func withdrawFunds(w http.ResponseWriter, r *http.Request) {
 	query := `UPDATE accounts SET balance = balance - $1, updated_at = NOW() 
 			  WHERE id = $2 RETURNING balance, currency_code`
 	
-	var newBalance float64
+	var newBalance Money
 	var currencyCode string
-	err = tx.QueryRow(query, requestBody.Amount, id).Scan(&newBalance, &currencyCode)
+	err = tx.QueryRowContext(r.Context(), query, requestBody.Amount, id).Scan(&newBalance, &currencyCode)
+	if err != nil {
+		writeFundsError(w, balanceUpdateError(err))
+		return
+	}
+
+	// Queue the posting for the core banking system
+	accountID, _ := strconv.Atoi(id)
+	err = queueCorePosting(r.Context(), tx, CorePosting{AccountID: accountID, Amount: -requestBody.Amount,
+		Currency: currencyCode, Description: "Withdrawal"})
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	posting := ledgerChange(accountID, -requestBody.Amount, currencyCode, "Withdrawal")
+	posting.Type = "withdrawal"
+	err = recordInLedger(r.Context(), tx, posting)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadGateway)
+		return
+	}
+
+	err = enqueueEvent(r.Context(), tx, "funds.withdrawn", "account:"+id, map[string]interface{}{
+		"account_id": accountID, "amount": requestBody.Amount, "currency_code": currencyCode, "balance": newBalance,
+	})
 	if err != nil {
 		http.Error(w, err.Error(), http.StatusInternalServerError)
 		return
@@ -380,13 +1004,15 @@ func withdrawFunds(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
+	publishAccountEvent(AccountEvent{AccountID: accountID, Type: "withdrawal", Amount: requestBody.Amount})
+
 	// Return updated balance
 	w.Header().Set("Content-Type", "application/json")
 	json.NewEncoder(w).Encode(map[string]interface{}{
 		"account_id": id,
 		"balance": newBalance,
 		"currency_code": currencyCode,
-		"message": fmt.Sprintf("Successfully withdrew %.2f", requestBody.Amount),
+		"message": fmt.Sprintf("Successfully withdrew %s", requestBody.Amount),
 	})
 }
 
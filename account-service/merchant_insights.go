@@ -0,0 +1,220 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"math"
+	"net/http"
+	"sort"
+	"strconv"
+	"time"
+
+	"bank/servicekit"
+
+	"github.com/gorilla/mux"
+)
+
+// MerchantInsight compares an account's spend at one merchant with the previous month
+type MerchantInsight struct {
+	Merchant      string   `json:"merchant"`
+	Total         Money    `json:"total"`
+	Count         int      `json:"count"`
+	AverageAmount Money    `json:"average_amount"`
+	PreviousTotal Money    `json:"previous_total"`
+	Delta         Money    `json:"delta"`
+	DeltaPercent  *float64 `json:"delta_percent"` // null when there was no spend last month
+}
+
+// merchant_spend is a projection of approved card spend per account, month and
+// merchant, folded in incrementally from the authorization log
+const merchantInsightTablesSQL = `
+	CREATE TABLE IF NOT EXISTS merchant_spend (
+		account_id INTEGER NOT NULL REFERENCES accounts(id),
+		month DATE NOT NULL,
+		merchant VARCHAR(100) NOT NULL,
+		total_amount DECIMAL(15,2) NOT NULL DEFAULT 0,
+		transaction_count INTEGER NOT NULL DEFAULT 0,
+		PRIMARY KEY (account_id, month, merchant)
+	);
+	CREATE TABLE IF NOT EXISTS projection_checkpoints (
+		name VARCHAR(50) PRIMARY KEY,
+		last_id INTEGER NOT NULL DEFAULT 0,
+		updated_at TIMESTAMP NOT NULL DEFAULT NOW()
+	);
+	INSERT INTO projection_checkpoints (name) VALUES ('merchant_spend') ON CONFLICT (name) DO NOTHING;`
+
+// startMerchantProjection keeps the merchant spend projection close to real time
+func startMerchantProjection() {
+	go func() {
+		defer servicekit.ReportJobPanic("Merchant spend projection")
+		for {
+			if err := projectMerchantSpend(serviceContext); err != nil {
+				servicekit.ReportJobError("Merchant spend projection", err)
+			}
+			time.Sleep(time.Minute)
+		}
+	}()
+}
+
+// projectMerchantSpend folds authorization log entries past the checkpoint
+// into merchant_spend. Entries younger than a minute are left for the next run
+// so transactions that commit out of ID order are not skipped.
+func projectMerchantSpend(ctx context.Context) error {
+	tx, err := db.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	var lastID, upTo int
+	err = tx.QueryRowContext(ctx, `SELECT last_id FROM projection_checkpoints WHERE name = 'merchant_spend' FOR UPDATE`).Scan(&lastID)
+	if err != nil {
+		return err
+	}
+	err = tx.QueryRowContext(ctx, `SELECT COALESCE(MAX(id), $1) FROM authorization_log
+								   WHERE id > $1 AND created_at < NOW() - INTERVAL '1 minute'`, lastID).Scan(&upTo)
+	if err != nil {
+		return err
+	}
+	if upTo == lastID {
+		return nil
+	}
+
+	_, err = tx.ExecContext(ctx, `INSERT INTO merchant_spend (account_id, month, merchant, total_amount, transaction_count)
+								  SELECT account_id, date_trunc('month', created_at)::date,
+									  LOWER(COALESCE(NULLIF(merchant_name, ''), merchant_id)), SUM(amount), COUNT(*)
+								  FROM authorization_log
+								  WHERE id > $1 AND id <= $2 AND approved AND channel = 'card'
+								  AND (merchant_name <> '' OR merchant_id <> '')
+								  GROUP BY 1, 2, 3
+								  ON CONFLICT (account_id, month, merchant) DO UPDATE SET
+									  total_amount = merchant_spend.total_amount + EXCLUDED.total_amount,
+									  transaction_count = merchant_spend.transaction_count + EXCLUDED.transaction_count`,
+		lastID, upTo)
+	if err != nil {
+		return err
+	}
+
+	_, err = tx.ExecContext(ctx, `UPDATE projection_checkpoints SET last_id = $1, updated_at = NOW()
+								  WHERE name = 'merchant_spend'`, upTo)
+	if err != nil {
+		return err
+	}
+	return tx.Commit()
+}
+
+// getMerchantInsights returns the top merchants of a month (?month=YYYY-MM,
+// default the current month) with month-over-month deltas
+func getMerchantInsights(w http.ResponseWriter, r *http.Request) {
+	accountID, err := strconv.Atoi(mux.Vars(r)["id"])
+	if err != nil {
+		http.Error(w, "Invalid account ID", http.StatusBadRequest)
+		return
+	}
+
+	now := time.Now().UTC()
+	month := time.Date(now.Year(), now.Month(), 1, 0, 0, 0, 0, time.UTC)
+	if value := r.URL.Query().Get("month"); value != "" {
+		month, err = time.Parse("2006-01", value)
+		if err != nil {
+			http.Error(w, "month must be YYYY-MM", http.StatusBadRequest)
+			return
+		}
+	}
+	limit := 10
+	if value := r.URL.Query().Get("limit"); value != "" {
+		limit, err = strconv.Atoi(value)
+		if err != nil || limit < 1 || limit > 100 {
+			http.Error(w, "limit must be between 1 and 100", http.StatusBadRequest)
+			return
+		}
+	}
+	previous := month.AddDate(0, -1, 0)
+
+	rows, err := db.QueryContext(r.Context(), `SELECT merchant, month = $2, total_amount, transaction_count
+											   FROM merchant_spend WHERE account_id = $1 AND month IN ($2, $3)`,
+		accountID, month, previous)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	defer rows.Close()
+
+	byMerchant := map[string]*MerchantInsight{}
+	var monthTotal, previousTotal Money
+	var monthCount int
+	for rows.Next() {
+		var merchant string
+		var current bool
+		var total Money
+		var count int
+		if err := rows.Scan(&merchant, &current, &total, &count); err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		insight, ok := byMerchant[merchant]
+		if !ok {
+			insight = &MerchantInsight{Merchant: merchant}
+			byMerchant[merchant] = insight
+		}
+		if current {
+			insight.Total, insight.Count = total, count
+			monthTotal += total
+			monthCount += count
+		} else {
+			insight.PreviousTotal = total
+			previousTotal += total
+		}
+	}
+	if err := rows.Err(); err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	merchants := []MerchantInsight{}
+	for _, insight := range byMerchant {
+		if insight.Count == 0 {
+			continue
+		}
+		insight.AverageAmount = insight.Total / Money(insight.Count)
+		insight.Delta = insight.Total - insight.PreviousTotal
+		insight.DeltaPercent = percentChange(insight.PreviousTotal, insight.Total)
+		merchants = append(merchants, *insight)
+	}
+	sort.Slice(merchants, func(i, j int) bool {
+		if merchants[i].Total != merchants[j].Total {
+			return merchants[i].Total > merchants[j].Total
+		}
+		return merchants[i].Merchant < merchants[j].Merchant
+	})
+	if len(merchants) > limit {
+		merchants = merchants[:limit]
+	}
+
+	var average Money
+	if monthCount > 0 {
+		average = monthTotal / Money(monthCount)
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"account_id":           accountID,
+		"month":                month.Format("2006-01"),
+		"total":                monthTotal,
+		"previous_month_total": previousTotal,
+		"delta":                monthTotal - previousTotal,
+		"delta_percent":        percentChange(previousTotal, monthTotal),
+		"average_amount":       average,
+		"transaction_count":    monthCount,
+		"merchants":            merchants,
+	})
+}
+
+// percentChange is the change from before to after in percent, or nil when before is zero
+func percentChange(before, after Money) *float64 {
+	if before == 0 {
+		return nil
+	}
+	p := math.Round(float64(after-before)/float64(before)*1000) / 10
+	return &p
+}
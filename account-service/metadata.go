@@ -0,0 +1,122 @@
+package main
+
+import (
+	"database/sql"
+	"database/sql/driver"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"regexp"
+	"strings"
+	"unicode/utf8"
+
+	"github.com/gorilla/mux"
+)
+
+// AccountMetadata holds customer-chosen display settings for an account
+type AccountMetadata struct {
+	Nickname string   `json:"nickname,omitempty"`
+	Color    string   `json:"color,omitempty"` // #RRGGBB
+	Icon     string   `json:"icon,omitempty"`
+	Tags     []string `json:"tags,omitempty"`
+}
+
+const metadataTablesSQL = `
+	ALTER TABLE accounts ADD COLUMN IF NOT EXISTS metadata JSONB NOT NULL DEFAULT '{}';`
+
+// Metadata limits
+const (
+	maxNicknameLength = 40
+	maxTags           = 10
+	maxTagLength      = 30
+)
+
+var (
+	colorPattern = regexp.MustCompile(`^#[0-9A-Fa-f]{6}$`)
+	iconPattern  = regexp.MustCompile(`^[a-z0-9-]{1,30}$`)
+	tagPattern   = regexp.MustCompile(`^[\p{L}\p{N} _-]+$`)
+)
+
+// Scan implements sql.Scanner for the JSONB metadata column
+func (m *AccountMetadata) Scan(src interface{}) error {
+	switch v := src.(type) {
+	case nil:
+		*m = AccountMetadata{}
+		return nil
+	case []byte:
+		return json.Unmarshal(v, m)
+	case string:
+		return json.Unmarshal([]byte(v), m)
+	}
+	return fmt.Errorf("unsupported metadata type %T", src)
+}
+
+// Value implements driver.Valuer for the JSONB metadata column
+func (m AccountMetadata) Value() (driver.Value, error) {
+	raw, err := json.Marshal(m)
+	return string(raw), err
+}
+
+// validate trims the fields and enforces the metadata limits
+func (m *AccountMetadata) validate() error {
+	m.Nickname = strings.TrimSpace(m.Nickname)
+	if utf8.RuneCountInString(m.Nickname) > maxNicknameLength {
+		return fmt.Errorf("nickname must be at most %d characters", maxNicknameLength)
+	}
+	if m.Color != "" && !colorPattern.MatchString(m.Color) {
+		return fmt.Errorf("color must be a hex color such as #1A73E8")
+	}
+	m.Color = strings.ToUpper(m.Color)
+	if m.Icon != "" && !iconPattern.MatchString(m.Icon) {
+		return fmt.Errorf("icon must be a lowercase icon name of at most 30 characters")
+	}
+
+	if len(m.Tags) > maxTags {
+		return fmt.Errorf("at most %d tags are allowed", maxTags)
+	}
+	seen := map[string]bool{}
+	tags := []string{}
+	for _, tag := range m.Tags {
+		tag = strings.TrimSpace(tag)
+		if tag == "" || seen[strings.ToLower(tag)] {
+			continue
+		}
+		if utf8.RuneCountInString(tag) > maxTagLength || !tagPattern.MatchString(tag) {
+			return fmt.Errorf("tags must be at most %d letters, digits, spaces, dashes or underscores", maxTagLength)
+		}
+		seen[strings.ToLower(tag)] = true
+		tags = append(tags, tag)
+	}
+	m.Tags = tags
+	return nil
+}
+
+// updateAccountMetadata replaces the account's nickname, color, icon and tags
+func updateAccountMetadata(w http.ResponseWriter, r *http.Request) {
+	params := mux.Vars(r)
+
+	var metadata AccountMetadata
+	err := json.NewDecoder(r.Body).Decode(&metadata)
+	if err != nil {
+		http.Error(w, "Invalid request body", http.StatusBadRequest)
+		return
+	}
+	if err := metadata.validate(); err != nil {
+		http.Error(w, "Invalid account metadata", http.StatusBadRequest)
+		return
+	}
+
+	err = db.QueryRowContext(r.Context(), `UPDATE accounts SET metadata = $1, updated_at = NOW() WHERE id = $2 RETURNING metadata`,
+		metadata, params["id"]).Scan(&metadata)
+	if err != nil {
+		if err == sql.ErrNoRows {
+			http.Error(w, "Account not found", http.StatusNotFound)
+		} else {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+		}
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(metadata)
+}
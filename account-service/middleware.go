@@ -0,0 +1,226 @@
+package main
+
+import (
+	"net/http"
+	"strconv"
+	"strings"
+)
+
+// corsConfig holds the browser origins allowed to call the service
+type corsConfig struct {
+	AllowedOrigins   map[string]bool
+	TenantOrigins    map[string]map[string]bool // keyed by request host
+	AllowCredentials bool
+	MaxAge           int
+}
+
+var corsAllowedMethods = "GET, POST, PUT, PATCH, DELETE, OPTIONS"
+var corsAllowedHeaders = "Authorization, Content-Type, X-Request-ID, X-Tenant-ID, Idempotency-Key"
+
+// loadCORSConfig builds the CORS configuration from environment variables.
+//
+// CORS_ALLOWED_ORIGINS is a comma separated list of origins for the current
+// environment. CORS_TENANT_ORIGINS adds origins per tenant host, in the form
+// "api.tenant-a.com=https://app.tenant-a.com|https://admin.tenant-a.com;api.tenant-b.com=...".
+func loadCORSConfig() corsConfig {
+	defaultOrigins := ""
+	if getEnv("APP_ENV", "development") == "development" {
+		defaultOrigins = "http://localhost:3000"
+	}
+
+	cfg := corsConfig{
+		AllowedOrigins:   parseOriginList(getEnv("CORS_ALLOWED_ORIGINS", defaultOrigins), ","),
+		TenantOrigins:    map[string]map[string]bool{},
+		AllowCredentials: getEnv("CORS_ALLOW_CREDENTIALS", "false") == "true",
+		MaxAge:           600,
+	}
+
+	if maxAge, err := strconv.Atoi(getEnv("CORS_MAX_AGE", "600")); err == nil && maxAge >= 0 {
+		cfg.MaxAge = maxAge
+	}
+
+	for _, entry := range strings.Split(getEnv("CORS_TENANT_ORIGINS", ""), ";") {
+		parts := strings.SplitN(entry, "=", 2)
+		if len(parts) != 2 {
+			continue
+		}
+		host := strings.ToLower(strings.TrimSpace(parts[0]))
+		cfg.TenantOrigins[host] = parseOriginList(parts[1], "|")
+	}
+
+	return cfg
+}
+
+func parseOriginList(value, sep string) map[string]bool {
+	origins := map[string]bool{}
+	for _, origin := range strings.Split(value, sep) {
+		origin = strings.TrimRight(strings.TrimSpace(origin), "/")
+		if origin != "" {
+			origins[origin] = true
+		}
+	}
+	return origins
+}
+
+// originAllowed reports whether the origin may call the service on the given host
+func (c corsConfig) originAllowed(origin, host string) bool {
+	if c.AllowedOrigins[origin] {
+		return true
+	}
+	// A wildcard can never be combined with credentials
+	if c.AllowedOrigins["*"] && !c.AllowCredentials {
+		return true
+	}
+	if tenant, ok := c.TenantOrigins[strings.ToLower(host)]; ok {
+		return tenant[origin]
+	}
+	return false
+}
+
+// corsMiddleware answers preflight requests and sets CORS headers for allowed origins.
+// It wraps the whole router so that OPTIONS requests are handled before route matching.
+func corsMiddleware(cfg corsConfig) func(http.Handler) http.Handler {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			origin := r.Header.Get("Origin")
+			if origin == "" {
+				next.ServeHTTP(w, r)
+				return
+			}
+
+			w.Header().Add("Vary", "Origin")
+			allowed := cfg.originAllowed(origin, r.Host)
+			preflight := r.Method == http.MethodOptions && r.Header.Get("Access-Control-Request-Method") != ""
+
+			if !allowed {
+				if preflight {
+					http.Error(w, "Origin not allowed", http.StatusForbidden)
+					return
+				}
+				next.ServeHTTP(w, r)
+				return
+			}
+
+			w.Header().Set("Access-Control-Allow-Origin", origin)
+			if cfg.AllowCredentials {
+				w.Header().Set("Access-Control-Allow-Credentials", "true")
+			}
+
+			if preflight {
+				w.Header().Set("Access-Control-Allow-Methods", corsAllowedMethods)
+				w.Header().Set("Access-Control-Allow-Headers", corsAllowedHeaders)
+				w.Header().Set("Access-Control-Max-Age", strconv.Itoa(cfg.MaxAge))
+				w.WriteHeader(http.StatusNoContent)
+				return
+			}
+
+			next.ServeHTTP(w, r)
+		})
+	}
+}
+
+// securityHeaders describes the security response headers for a group of routes
+type securityHeaders struct {
+	HSTS          string
+	FrameOptions  string
+	ContentPolicy string
+}
+
+// loadSecurityHeaders reads the header values for a route group. The group name
+// is used as an environment prefix, e.g. SECURITY_HTML_CSP for the "html" group.
+func loadSecurityHeaders(group string, defaults securityHeaders) securityHeaders {
+	prefix := "SECURITY_" + strings.ToUpper(group) + "_"
+	return securityHeaders{
+		HSTS:          getEnv(prefix+"HSTS", defaults.HSTS),
+		FrameOptions:  getEnv(prefix+"FRAME_OPTIONS", defaults.FrameOptions),
+		ContentPolicy: getEnv(prefix+"CSP", defaults.ContentPolicy),
+	}
+}
+
+// apiSecurityHeaders applies to JSON endpoints, which never render in a browser
+var apiSecurityHeaders = securityHeaders{
+	HSTS:          "max-age=63072000; includeSubDomains",
+	FrameOptions:  "DENY",
+	ContentPolicy: "default-src 'none'; frame-ancestors 'none'",
+}
+
+// htmlSecurityHeaders applies to HTML-serving routes such as the Swagger UI
+// and pay-by-link pages
+var htmlSecurityHeaders = securityHeaders{
+	HSTS:          "max-age=63072000; includeSubDomains",
+	FrameOptions:  "DENY",
+	ContentPolicy: "default-src 'self'; script-src 'self'; style-src 'self'; img-src 'self' data:; object-src 'none'; base-uri 'none'; form-action 'self'; frame-ancestors 'none'",
+}
+
+// securityHeadersMiddleware sets the given headers on every response of the route group
+func securityHeadersMiddleware(h securityHeaders) func(http.Handler) http.Handler {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			w.Header().Set("X-Content-Type-Options", "nosniff")
+			w.Header().Set("Referrer-Policy", "no-referrer")
+			if h.HSTS != "" {
+				w.Header().Set("Strict-Transport-Security", h.HSTS)
+			}
+			if h.FrameOptions != "" {
+				w.Header().Set("X-Frame-Options", h.FrameOptions)
+			}
+			if h.ContentPolicy != "" {
+				w.Header().Set("Content-Security-Policy", h.ContentPolicy)
+			}
+			next.ServeHTTP(w, r)
+		})
+	}
+}
+
+// requestActor identifies the caller in audit records
+func requestActor(r *http.Request) string {
+	if id := r.Header.Get("X-User-ID"); id != "" {
+		return "user:" + id
+	}
+	return "anonymous"
+}
+
+// requestRole is the caller's role as forwarded by the API gateway
+func requestRole(r *http.Request) string {
+	return r.Header.Get("X-User-Role")
+}
+
+// hasRole reports whether the caller has one of roles
+func hasRole(r *http.Request, roles ...string) bool {
+	role := requestRole(r)
+	for _, allowed := range roles {
+		if role == allowed {
+			return true
+		}
+	}
+	return false
+}
+
+// requireRole writes a 403 and returns false unless the caller has one of roles
+func requireRole(w http.ResponseWriter, r *http.Request, roles ...string) bool {
+	if hasRole(r, roles...) {
+		return true
+	}
+	http.Error(w, "Insufficient permissions", http.StatusForbidden)
+	return false
+}
+
+// hasPrivilege reports whether the caller holds the elevated privilege
+func hasPrivilege(r *http.Request, privilege string) bool {
+	for _, held := range strings.Split(r.Header.Get("X-User-Privileges"), ",") {
+		if held == privilege {
+			return true
+		}
+	}
+	return false
+}
+
+// requirePrivilege writes a 403 and returns false unless the caller holds the
+// elevated privilege
+func requirePrivilege(w http.ResponseWriter, r *http.Request, privilege string) bool {
+	if hasPrivilege(r, privilege) {
+		return true
+	}
+	http.Error(w, "The "+privilege+" privilege is required", http.StatusForbidden)
+	return false
+}
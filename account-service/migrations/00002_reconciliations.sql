@@ -0,0 +1,21 @@
+-- +goose Up
+CREATE TABLE reconciliation_jobs (
+    id SERIAL PRIMARY KEY,
+    account_id INTEGER NOT NULL REFERENCES accounts(id),
+    status VARCHAR(20) NOT NULL DEFAULT 'pending',
+    error TEXT NOT NULL DEFAULT '',
+    extract_key VARCHAR(255) NOT NULL,
+    item_count INTEGER NOT NULL,
+    period_from DATE NOT NULL,
+    period_to DATE NOT NULL,
+    date_tolerance_days INTEGER NOT NULL,
+    requested_by VARCHAR(100) NOT NULL,
+    report JSONB,
+    created_at TIMESTAMP NOT NULL DEFAULT NOW(),
+    completed_at TIMESTAMP
+);
+CREATE INDEX idx_reconciliation_jobs_account ON reconciliation_jobs(account_id, created_at DESC);
+CREATE INDEX idx_reconciliation_jobs_pending ON reconciliation_jobs(id) WHERE status = 'pending';
+
+-- +goose Down
+DROP TABLE reconciliation_jobs;
@@ -0,0 +1,35 @@
+-- Constraints on accounts are added NOT VALID: they hold for every write from
+-- now on, while rows written before them are left for a data fix, after which
+-- they can be validated with ALTER TABLE accounts VALIDATE CONSTRAINT.
+-- accounts.customer_id references the auth service's users, which it must
+-- have created.
+
+-- +goose Up
+ALTER TABLE accounts ADD CONSTRAINT accounts_balance_non_negative
+    CHECK (balance >= 0) NOT VALID;
+ALTER TABLE accounts ADD CONSTRAINT accounts_currency_code_valid
+    CHECK (currency_code ~ '^[A-Z]{3}$') NOT VALID;
+ALTER TABLE accounts ADD CONSTRAINT accounts_status_valid
+    CHECK (status IN ('active', 'frozen', 'restricted', 'closed')) NOT VALID;
+ALTER TABLE accounts ADD CONSTRAINT accounts_customer_id_fkey
+    FOREIGN KEY (customer_id) REFERENCES users(id) NOT VALID;
+
+-- A repeated block adds nothing, so the later copies are dropped
+DELETE FROM spending_blocks b USING spending_blocks first
+    WHERE b.lifts_at IS NULL AND first.lifts_at IS NULL AND b.account_id = first.account_id
+    AND b.block_type = first.block_type AND lower(b.value) = lower(first.value) AND b.id > first.id;
+CREATE UNIQUE INDEX idx_spending_blocks_unique ON spending_blocks(account_id, block_type, lower(value))
+    WHERE lifts_at IS NULL;
+
+UPDATE matching_rules r SET name = left(r.name, 80) || ' (' || r.id || ')'
+    WHERE EXISTS (SELECT 1 FROM matching_rules first WHERE first.master_account_id = r.master_account_id
+                  AND first.name = r.name AND first.id < r.id);
+CREATE UNIQUE INDEX idx_matching_rules_name ON matching_rules(master_account_id, name);
+
+-- +goose Down
+DROP INDEX idx_matching_rules_name;
+DROP INDEX idx_spending_blocks_unique;
+ALTER TABLE accounts DROP CONSTRAINT accounts_customer_id_fkey;
+ALTER TABLE accounts DROP CONSTRAINT accounts_status_valid;
+ALTER TABLE accounts DROP CONSTRAINT accounts_currency_code_valid;
+ALTER TABLE accounts DROP CONSTRAINT accounts_balance_non_negative;
@@ -0,0 +1,15 @@
+-- An account may go overdrawn down to its overdraft limit, which replaces
+-- the rule that balances stay at or above zero.
+
+-- +goose Up
+ALTER TABLE accounts ADD COLUMN overdraft_limit DECIMAL(15,2) NOT NULL DEFAULT 0
+    CONSTRAINT accounts_overdraft_limit_non_negative CHECK (overdraft_limit >= 0);
+ALTER TABLE accounts DROP CONSTRAINT accounts_balance_non_negative;
+ALTER TABLE accounts ADD CONSTRAINT accounts_balance_within_overdraft
+    CHECK (balance >= -overdraft_limit) NOT VALID;
+
+-- +goose Down
+ALTER TABLE accounts DROP CONSTRAINT accounts_balance_within_overdraft;
+ALTER TABLE accounts ADD CONSTRAINT accounts_balance_non_negative
+    CHECK (balance >= 0) NOT VALID;
+ALTER TABLE accounts DROP COLUMN overdraft_limit;
@@ -0,0 +1,34 @@
+-- Manual adjustments post a credit or debit to an account against a GL
+-- contra account once a second person approves them, which the seeded
+-- maker-checker rule enforces.
+
+-- +goose Up
+CREATE TABLE ledger_adjustments (
+    id SERIAL PRIMARY KEY,
+    account_id INTEGER NOT NULL REFERENCES accounts(id),
+    direction VARCHAR(6) NOT NULL CHECK (direction IN ('credit', 'debit')),
+    amount DECIMAL(15,2) NOT NULL CHECK (amount > 0),
+    currency_code VARCHAR(3) NOT NULL,
+    gl_account VARCHAR(30) NOT NULL,
+    reason_code VARCHAR(30) NOT NULL,
+    note TEXT NOT NULL,
+    reference VARCHAR(100) NOT NULL DEFAULT '',
+    status VARCHAR(20) NOT NULL DEFAULT 'pending',
+    requested_by VARCHAR(100) NOT NULL,
+    reviewed_by VARCHAR(100),
+    review_note TEXT NOT NULL DEFAULT '',
+    created_at TIMESTAMP NOT NULL DEFAULT NOW(),
+    resolved_at TIMESTAMP
+);
+CREATE INDEX idx_ledger_adjustments_status ON ledger_adjustments(status, created_at);
+CREATE INDEX idx_ledger_adjustments_account ON ledger_adjustments(account_id, created_at);
+
+INSERT INTO sod_rules (name, kind, first_duty, second_duty, description) VALUES
+    ('ledger-adjustment-maker-checker', 'maker_checker', 'ledger_adjustment.request', 'ledger_adjustment.review',
+        'The user who requests a ledger adjustment cannot review it')
+    ON CONFLICT (name) DO NOTHING;
+
+-- +goose Down
+DELETE FROM sod_violations WHERE rule_id IN (SELECT id FROM sod_rules WHERE name = 'ledger-adjustment-maker-checker');
+DELETE FROM sod_rules WHERE name = 'ledger-adjustment-maker-checker';
+DROP TABLE ledger_adjustments;
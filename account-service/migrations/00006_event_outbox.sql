@@ -0,0 +1,21 @@
+-- Events waiting to be published to the message broker. Handlers write them
+-- in the transaction that makes the change; the relay marks them published.
+
+-- +goose Up
+CREATE TABLE account_service_outbox (
+    id BIGSERIAL PRIMARY KEY,
+    event_id VARCHAR(36) NOT NULL UNIQUE,
+    event_type VARCHAR(50) NOT NULL,
+    event_key VARCHAR(100) NOT NULL,
+    payload JSONB NOT NULL,
+    attempts INTEGER NOT NULL DEFAULT 0,
+    last_error TEXT NOT NULL DEFAULT '',
+    next_attempt_at TIMESTAMP NOT NULL DEFAULT NOW(),
+    published_at TIMESTAMP,
+    created_at TIMESTAMP NOT NULL DEFAULT NOW()
+);
+CREATE INDEX idx_account_service_outbox_due ON account_service_outbox(next_attempt_at) WHERE published_at IS NULL;
+CREATE INDEX idx_account_service_outbox_published ON account_service_outbox(published_at) WHERE published_at IS NOT NULL;
+
+-- +goose Down
+DROP TABLE account_service_outbox;
@@ -0,0 +1,29 @@
+-- Accounts belong to a branch, accrued interest is posted to the GL once its
+-- month is over, and fees charged to accounts are recorded for the fee income
+-- they post.
+
+-- +goose Up
+ALTER TABLE accounts ADD COLUMN branch_code VARCHAR(10) NOT NULL DEFAULT 'HQ';
+CREATE INDEX idx_accounts_branch ON accounts(branch_code);
+
+ALTER TABLE interest_accruals ADD COLUMN posted_at TIMESTAMP;
+CREATE INDEX idx_interest_accruals_unposted ON interest_accruals(accrual_date) WHERE posted_at IS NULL;
+
+CREATE TABLE account_fees (
+    id SERIAL PRIMARY KEY,
+    account_id INTEGER NOT NULL REFERENCES accounts(id),
+    fee_type VARCHAR(30) NOT NULL,
+    amount DECIMAL(15,2) NOT NULL CHECK (amount > 0),
+    currency_code VARCHAR(3) NOT NULL,
+    description TEXT NOT NULL DEFAULT '',
+    charged_by VARCHAR(100) NOT NULL,
+    created_at TIMESTAMP NOT NULL DEFAULT NOW()
+);
+CREATE INDEX idx_account_fees_account ON account_fees(account_id, created_at);
+
+-- +goose Down
+DROP TABLE account_fees;
+DROP INDEX idx_interest_accruals_unposted;
+ALTER TABLE interest_accruals DROP COLUMN posted_at;
+DROP INDEX idx_accounts_branch;
+ALTER TABLE accounts DROP COLUMN branch_code;
@@ -0,0 +1,44 @@
+-- ATM cards are linked to the account they draw on, and each ATM withdrawal
+-- is tracked from authorization, while a lien reserves its cash, until it is
+-- dispensed or reversed.
+
+-- +goose Up
+CREATE TABLE atm_cards (
+    id SERIAL PRIMARY KEY,
+    account_id INTEGER NOT NULL REFERENCES accounts(id),
+    pan_lookup VARCHAR(64) NOT NULL,
+    last_four VARCHAR(4) NOT NULL,
+    status VARCHAR(20) NOT NULL DEFAULT 'active' CHECK (status IN ('active', 'blocked', 'pin_locked')),
+    daily_limit DECIMAL(15,2) NOT NULL CHECK (daily_limit > 0),
+    pin_failures INTEGER NOT NULL DEFAULT 0,
+    issued_by VARCHAR(100) NOT NULL,
+    created_at TIMESTAMP NOT NULL DEFAULT NOW(),
+    updated_at TIMESTAMP NOT NULL DEFAULT NOW()
+);
+CREATE UNIQUE INDEX idx_atm_cards_pan ON atm_cards(pan_lookup);
+CREATE INDEX idx_atm_cards_account ON atm_cards(account_id);
+
+CREATE TABLE atm_withdrawals (
+    id SERIAL PRIMARY KEY,
+    reference VARCHAR(40) NOT NULL UNIQUE,
+    card_id INTEGER NOT NULL REFERENCES atm_cards(id),
+    account_id INTEGER NOT NULL REFERENCES accounts(id),
+    terminal_id VARCHAR(40) NOT NULL,
+    amount DECIMAL(15,2) NOT NULL CHECK (amount > 0),
+    dispensed_amount DECIMAL(15,2),
+    currency_code VARCHAR(3) NOT NULL,
+    status VARCHAR(20) NOT NULL DEFAULT 'reserved'
+        CHECK (status IN ('reserved', 'completed', 'reversed', 'expired')),
+    lien_id INTEGER NOT NULL REFERENCES liens(id),
+    reversal_reason VARCHAR(200) NOT NULL DEFAULT '',
+    expires_at TIMESTAMP NOT NULL,
+    created_at TIMESTAMP NOT NULL DEFAULT NOW(),
+    updated_at TIMESTAMP NOT NULL DEFAULT NOW()
+);
+CREATE INDEX idx_atm_withdrawals_card ON atm_withdrawals(card_id, created_at);
+CREATE INDEX idx_atm_withdrawals_account ON atm_withdrawals(account_id, created_at);
+CREATE INDEX idx_atm_withdrawals_reserved ON atm_withdrawals(expires_at) WHERE status = 'reserved';
+
+-- +goose Down
+DROP TABLE atm_withdrawals;
+DROP TABLE atm_cards;
@@ -0,0 +1,10 @@
+-- Accounts get an account number, internal or an IBAN, unique across the
+-- bank. Accounts opened before it are numbered by the service at startup.
+
+-- +goose Up
+ALTER TABLE accounts ADD COLUMN account_number VARCHAR(34);
+CREATE UNIQUE INDEX idx_accounts_account_number ON accounts(account_number);
+
+-- +goose Down
+DROP INDEX idx_accounts_account_number;
+ALTER TABLE accounts DROP COLUMN account_number;
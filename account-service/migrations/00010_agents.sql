@@ -0,0 +1,41 @@
+-- Banking agents take cash deposits for the bank against a float account they
+-- hold with it, and earn a commission on each deposit.
+
+-- +goose Up
+CREATE TABLE agents (
+    id SERIAL PRIMARY KEY,
+    agent_code VARCHAR(20) NOT NULL UNIQUE,
+    name VARCHAR(100) NOT NULL,
+    user_id INTEGER NOT NULL,
+    float_account_id INTEGER NOT NULL REFERENCES accounts(id),
+    status VARCHAR(20) NOT NULL DEFAULT 'active' CHECK (status IN ('active', 'suspended')),
+    commission_rate DECIMAL(7,4) NOT NULL CHECK (commission_rate >= 0 AND commission_rate <= 100),
+    commission_min DECIMAL(15,2) NOT NULL DEFAULT 0 CHECK (commission_min >= 0),
+    commission_max DECIMAL(15,2) CHECK (commission_max >= commission_min),
+    created_by VARCHAR(100) NOT NULL,
+    created_at TIMESTAMP NOT NULL DEFAULT NOW(),
+    updated_at TIMESTAMP NOT NULL DEFAULT NOW()
+);
+CREATE UNIQUE INDEX idx_agents_user ON agents(user_id);
+CREATE UNIQUE INDEX idx_agents_float_account ON agents(float_account_id);
+
+CREATE TABLE agent_deposits (
+    id SERIAL PRIMARY KEY,
+    reference VARCHAR(40) NOT NULL UNIQUE,
+    agent_id INTEGER NOT NULL REFERENCES agents(id),
+    account_id INTEGER NOT NULL REFERENCES accounts(id),
+    amount DECIMAL(15,2) NOT NULL CHECK (amount > 0),
+    commission DECIMAL(15,2) NOT NULL CHECK (commission >= 0),
+    currency_code VARCHAR(3) NOT NULL,
+    depositor_name VARCHAR(100) NOT NULL DEFAULT '',
+    status VARCHAR(20) NOT NULL DEFAULT 'completed' CHECK (status IN ('completed', 'reversed')),
+    reversal_reason VARCHAR(200) NOT NULL DEFAULT '',
+    created_at TIMESTAMP NOT NULL DEFAULT NOW(),
+    updated_at TIMESTAMP NOT NULL DEFAULT NOW()
+);
+CREATE INDEX idx_agent_deposits_agent ON agent_deposits(agent_id, created_at);
+CREATE INDEX idx_agent_deposits_account ON agent_deposits(account_id, created_at);
+
+-- +goose Down
+DROP TABLE agent_deposits;
+DROP TABLE agents;
@@ -0,0 +1,17 @@
+-- Agent commission rates are whole basis points, so commission is computed
+-- in integer cents. Rates set in finer fractions of a percent are rounded to
+-- the nearest basis point.
+
+-- +goose Up
+ALTER TABLE agents ADD COLUMN commission_rate_bps INTEGER;
+UPDATE agents SET commission_rate_bps = ROUND(commission_rate * 100);
+ALTER TABLE agents ALTER COLUMN commission_rate_bps SET NOT NULL,
+    ADD CONSTRAINT agents_commission_rate_bps_check CHECK (commission_rate_bps >= 0 AND commission_rate_bps <= 10000),
+    DROP COLUMN commission_rate;
+
+-- +goose Down
+ALTER TABLE agents ADD COLUMN commission_rate DECIMAL(7,4);
+UPDATE agents SET commission_rate = commission_rate_bps / 100.0;
+ALTER TABLE agents ALTER COLUMN commission_rate SET NOT NULL,
+    ADD CONSTRAINT agents_commission_rate_check CHECK (commission_rate >= 0 AND commission_rate <= 100),
+    DROP COLUMN commission_rate_bps;
@@ -0,0 +1,121 @@
+package main
+
+import (
+	"database/sql/driver"
+	"errors"
+	"fmt"
+	"math"
+	"strconv"
+	"strings"
+)
+
+// Money is an amount in minor units (cents). Amounts are exact: they are
+// parsed from and written as decimal text in JSON and SQL, never through a
+// float64. Money columns are DECIMAL(15,2), so every currency uses two
+// decimal places.
+type Money int64
+
+var ErrInvalidAmount = errors.New("Amount must be a number with at most two decimal places")
+
+// String formats the amount with two decimals, e.g. "-12.30"
+func (m Money) String() string {
+	sign, cents := "", int64(m)
+	if cents < 0 {
+		sign, cents = "-", -cents
+	}
+	return fmt.Sprintf("%s%d.%02d", sign, cents/100, cents%100)
+}
+
+// parseMoney parses a decimal amount such as "12", "12.3" or "-12.30".
+// Digits beyond the second decimal place must be zeros, as in the values
+// Postgres returns for sums and casts.
+func parseMoney(value string) (Money, error) {
+	value = strings.TrimSpace(value)
+	negative := strings.HasPrefix(value, "-")
+	whole, fraction, _ := strings.Cut(strings.TrimPrefix(value, "-"), ".")
+	if whole == "" || len(whole) > 16 || strings.Trim(whole, "0123456789") != "" ||
+		strings.Trim(fraction, "0123456789") != "" {
+		return 0, ErrInvalidAmount
+	}
+	if len(fraction) > 2 {
+		if strings.Trim(fraction[2:], "0") != "" {
+			return 0, ErrInvalidAmount
+		}
+		fraction = fraction[:2]
+	}
+	fraction += strings.Repeat("0", 2-len(fraction))
+
+	units, _ := strconv.ParseInt(whole, 10, 64)
+	cents, _ := strconv.ParseInt(fraction, 10, 64)
+	m := Money(units*100 + cents)
+	if negative {
+		m = -m
+	}
+	return m, nil
+}
+
+// Times multiplies the amount by factor, such as a rate, rounding to the
+// nearest cent
+func (m Money) Times(factor float64) Money {
+	return Money(math.Round(float64(m) * factor))
+}
+
+// Abs is the amount without its sign
+func (m Money) Abs() Money {
+	if m < 0 {
+		return -m
+	}
+	return m
+}
+
+// MarshalJSON writes the amount as a JSON number with two decimals
+func (m Money) MarshalJSON() ([]byte, error) {
+	return []byte(m.String()), nil
+}
+
+// OpenAPISchema describes the JSON form of an amount in API documentation
+func (Money) OpenAPISchema() map[string]interface{} {
+	return map[string]interface{}{"type": "number", "multipleOf": 0.01, "example": 12.30}
+}
+
+// UnmarshalJSON accepts a JSON number or a numeric string. Exponents are
+// rejected rather than rounded.
+func (m *Money) UnmarshalJSON(data []byte) error {
+	value := strings.Trim(string(data), `"`)
+	if value == "null" {
+		return nil
+	}
+	parsed, err := parseMoney(value)
+	if err != nil {
+		return err
+	}
+	*m = parsed
+	return nil
+}
+
+// Scan reads a DECIMAL column
+func (m *Money) Scan(src interface{}) error {
+	switch v := src.(type) {
+	case nil:
+		*m = 0
+		return nil
+	case []byte:
+		parsed, err := parseMoney(string(v))
+		*m = parsed
+		return err
+	case string:
+		parsed, err := parseMoney(v)
+		*m = parsed
+		return err
+	case int64:
+		*m = Money(v * 100)
+		return nil
+	}
+	return fmt.Errorf("cannot scan %T into Money", src)
+}
+
+// Value writes the amount as decimal text, which Postgres casts to the
+// DECIMAL column type
+func (m Money) Value() (driver.Value, error) {
+	return m.String(), nil
+}
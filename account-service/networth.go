@@ -0,0 +1,165 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/gorilla/mux"
+)
+
+// liabilityAccountTypes hold money the customer owes; their balance is the
+// outstanding amount
+var liabilityAccountTypes = map[string]bool{"loan": true, "mortgage": true, "credit_card": true}
+
+// NetWorthLine is one account's contribution to a customer's net worth
+type NetWorthLine struct {
+	AccountID        int    `json:"account_id"`
+	AccountType      string `json:"account_type"`
+	Kind             string `json:"kind"` // asset or liability
+	Balance          Money  `json:"balance"`
+	CurrencyCode     string `json:"currency_code"`
+	ConvertedBalance Money  `json:"converted_balance"`
+}
+
+// NetWorthPoint is the month-end net worth for trend charts
+type NetWorthPoint struct {
+	Month       string `json:"month"`
+	Assets      Money  `json:"assets"`
+	Liabilities Money  `json:"liabilities"`
+	NetWorth    Money  `json:"net_worth"`
+}
+
+// getNetWorth aggregates a customer's accounts into assets, liabilities and
+// net worth in one currency (?currency=, default FX_BASE_CURRENCY), with a
+// 12 month history from the balance snapshots. History uses current rates.
+func getNetWorth(w http.ResponseWriter, r *http.Request) {
+	customerID, err := strconv.Atoi(mux.Vars(r)["id"])
+	if err != nil {
+		http.Error(w, "Invalid customer ID", http.StatusBadRequest)
+		return
+	}
+	currency := strings.ToUpper(r.URL.Query().Get("currency"))
+	if currency == "" {
+		currency = fxBaseCurrency
+	}
+	if _, ok := fxRates[currency]; !ok {
+		http.Error(w, "No exchange rate for "+currency, http.StatusBadRequest)
+		return
+	}
+
+	rows, err := db.QueryContext(r.Context(), `SELECT id, account_type, balance, currency_code FROM accounts
+											   WHERE customer_id = $1 AND status <> 'closed' ORDER BY id`, customerID)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	defer rows.Close()
+
+	lines := []NetWorthLine{}
+	accountTypes := map[int]string{}
+	accountCurrencies := map[int]string{}
+	unconverted := map[string]bool{}
+	var assets, liabilities Money
+	for rows.Next() {
+		var l NetWorthLine
+		if err := rows.Scan(&l.AccountID, &l.AccountType, &l.Balance, &l.CurrencyCode); err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		accountTypes[l.AccountID] = l.AccountType
+		accountCurrencies[l.AccountID] = l.CurrencyCode
+
+		l.Kind = "asset"
+		if liabilityAccountTypes[l.AccountType] {
+			l.Kind = "liability"
+		}
+		converted, err := convertCurrency(l.Balance, l.CurrencyCode, currency)
+		if err != nil {
+			unconverted[l.CurrencyCode] = true
+			continue
+		}
+		l.ConvertedBalance = converted
+		if l.Kind == "liability" {
+			liabilities += converted
+		} else {
+			assets += converted
+		}
+		lines = append(lines, l)
+	}
+	if err := rows.Err(); err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	// Month-end snapshots of the same accounts for the trend
+	snapshots, err := db.QueryContext(r.Context(), `SELECT DISTINCT ON (s.account_id, date_trunc('month', s.snapshot_date))
+													s.account_id, to_char(s.snapshot_date, 'YYYY-MM'), s.balance
+													FROM balance_snapshots s JOIN accounts a ON a.id = s.account_id
+													WHERE a.customer_id = $1 AND a.status <> 'closed'
+													AND s.snapshot_date >= date_trunc('month', CURRENT_DATE) - INTERVAL '11 months'
+													ORDER BY s.account_id, date_trunc('month', s.snapshot_date), s.snapshot_date DESC`,
+		customerID)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	defer snapshots.Close()
+
+	type totals struct{ assets, liabilities Money }
+	months := map[string]*totals{}
+	for snapshots.Next() {
+		var accountID int
+		var month string
+		var balance Money
+		if err := snapshots.Scan(&accountID, &month, &balance); err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		converted, err := convertCurrency(balance, accountCurrencies[accountID], currency)
+		if err != nil {
+			continue
+		}
+		t, ok := months[month]
+		if !ok {
+			t = &totals{}
+			months[month] = t
+		}
+		if liabilityAccountTypes[accountTypes[accountID]] {
+			t.liabilities += converted
+		} else {
+			t.assets += converted
+		}
+	}
+
+	history := make([]NetWorthPoint, 0, len(months))
+	for month, t := range months {
+		history = append(history, NetWorthPoint{
+			Month:       month,
+			Assets:      t.assets,
+			Liabilities: t.liabilities,
+			NetWorth:    t.assets - t.liabilities,
+		})
+	}
+	sort.Slice(history, func(i, j int) bool { return history[i].Month < history[j].Month })
+
+	missing := make([]string, 0, len(unconverted))
+	for c := range unconverted {
+		missing = append(missing, c)
+	}
+	sort.Strings(missing)
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"customer_id":            customerID,
+		"currency_code":          currency,
+		"assets":                 assets,
+		"liabilities":            liabilities,
+		"net_worth":              assets - liabilities,
+		"accounts":               lines,
+		"unconverted_currencies": missing,
+		"history":                history,
+	})
+}
@@ -0,0 +1,67 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+)
+
+// Notification is a message dispatched through the notification service.
+// When Recipient is empty the notification service resolves the address from
+// the customer's channel preferences.
+type Notification struct {
+	CustomerID int                    `json:"customer_id,omitempty"`
+	Channel    string                 `json:"channel"`
+	Recipient  string                 `json:"recipient,omitempty"`
+	Category   string                 `json:"category,omitempty"` // operational (default) or marketing
+	Template   string                 `json:"template"`
+	Data       map[string]interface{} `json:"data"`
+}
+
+// NotificationEvent is something that happened to a customer. The
+// notification service delivers it on the channels the customer enabled for
+// its type: deposit, withdrawal, login_new_device or password_changed.
+type NotificationEvent struct {
+	ID         string                 `json:"id,omitempty"` // notified once per ID
+	Type       string                 `json:"type"`
+	CustomerID int                    `json:"customer_id"`
+	Data       map[string]interface{} `json:"data"`
+	Recipients map[string]string      `json:"recipients,omitempty"` // used where the customer registered no address
+}
+
+// sendNotification hands a notification to the notification service
+func sendNotification(ctx context.Context, n Notification) error {
+	return postToNotificationService(ctx, "/v1/notifications", n)
+}
+
+// publishNotificationEvent hands an event to the notification service
+func publishNotificationEvent(ctx context.Context, e NotificationEvent) error {
+	return postToNotificationService(ctx, "/v1/events", e)
+}
+
+func postToNotificationService(ctx context.Context, path string, body interface{}) error {
+	payload, err := json.Marshal(body)
+	if err != nil {
+		return err
+	}
+
+	url := getEnv("NOTIFICATION_SERVICE_URL", "http://localhost:8083") + path
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, url, bytes.NewReader(payload))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+
+	resp, err := serviceClient.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode >= 300 {
+		return fmt.Errorf("notification service returned status %d", resp.StatusCode)
+	}
+	return nil
+}
@@ -0,0 +1,122 @@
+package main
+
+import (
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"net/http"
+
+	"bank/servicekit"
+
+	"github.com/gorilla/mux"
+	"go.uber.org/zap"
+)
+
+// checkFunds returns nil when amount may be debited from an account with
+// available funds (its balance less liens) and an overdraft of
+// overdraftLimit, and otherwise the error refusing the debit
+func checkFunds(available, overdraftLimit, amount Money) error {
+	switch {
+	case available-amount >= 0:
+		return nil
+	case overdraftLimit == 0:
+		return ErrInsufficientFunds
+	case available-amount < -overdraftLimit:
+		return ErrOverdraftLimitExceeded
+	}
+	return nil
+}
+
+// writeFundsError answers a failed debit. Funds errors get a 400 with a JSON
+// body whose code tells them apart; other errors are written as usual.
+func writeFundsError(w http.ResponseWriter, err error) {
+	code := ""
+	switch {
+	case errors.Is(err, ErrInsufficientFunds):
+		code = "insufficient_funds"
+	case errors.Is(err, ErrOverdraftLimitExceeded):
+		code = "overdraft_limit_exceeded"
+	default:
+		writeDBError(w, err)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusBadRequest)
+	json.NewEncoder(w).Encode(map[string]string{"error": transferErrorMessage(err), "code": code})
+}
+
+type overdraftLimitRequest struct {
+	OverdraftLimit *Money `json:"overdraft_limit"`
+}
+
+// setOverdraftLimit grants, changes or, with 0, removes an account's
+// overdraft. A limit below what the account is already overdrawn by is
+// refused.
+func setOverdraftLimit(w http.ResponseWriter, r *http.Request) {
+	if !requireRole(w, r, creditOfficerRoles...) {
+		return
+	}
+	var req overdraftLimitRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, "Invalid request body", http.StatusBadRequest)
+		return
+	}
+	if req.OverdraftLimit == nil || *req.OverdraftLimit < 0 {
+		http.Error(w, "overdraft_limit is required and must not be negative", http.StatusBadRequest)
+		return
+	}
+	limit := *req.OverdraftLimit
+
+	tx, err := db.BeginTx(r.Context(), nil)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	defer tx.Rollback()
+
+	var account Account
+	var previous Money
+	err = tx.QueryRowContext(r.Context(), `SELECT account_type, status, balance, overdraft_limit FROM accounts
+										   WHERE id = $1 FOR UPDATE`, mux.Vars(r)["id"]).Scan(&account.AccountType,
+		&account.Status, &account.Balance, &previous)
+	if err == sql.ErrNoRows {
+		http.Error(w, "Account not found", http.StatusNotFound)
+		return
+	}
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	switch {
+	case limit > 0 && (liabilityAccountTypes[account.AccountType] || account.AccountType == "prepaid"):
+		http.Error(w, "Overdrafts are not available on "+account.AccountType+" accounts", http.StatusConflict)
+		return
+	case limit > 0 && account.Status == "closed":
+		http.Error(w, "Account is closed", http.StatusConflict)
+		return
+	case account.Balance < -limit:
+		http.Error(w, "The account is overdrawn by more than overdraft_limit", http.StatusConflict)
+		return
+	}
+
+	err = tx.QueryRowContext(r.Context(), `UPDATE accounts SET overdraft_limit = $2, updated_at = NOW() WHERE id = $1
+										   RETURNING id, customer_id, account_type, balance, currency_code, status,
+										   overdraft_limit, created_at, updated_at, metadata, branch_code,
+										   COALESCE(account_number, '')`, mux.Vars(r)["id"],
+		limit).Scan(&account.ID, &account.CustomerID, &account.AccountType, &account.Balance, &account.CurrencyCode,
+		&account.Status, &account.OverdraftLimit, &account.CreatedAt, &account.UpdatedAt, &account.Metadata, &account.BranchCode,
+		&account.AccountNumber)
+	if err == nil {
+		err = tx.Commit()
+	}
+	if err != nil {
+		writeDBError(w, err)
+		return
+	}
+	servicekit.RequestLogger(r.Context()).Info("overdraft limit set", zap.Int("account_id", account.ID),
+		zap.String("previous", previous.String()), zap.String("limit", limit.String()),
+		zap.String("actor", requestActor(r)))
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(account)
+}
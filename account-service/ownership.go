@@ -0,0 +1,326 @@
+package main
+
+import (
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+
+	"github.com/gorilla/mux"
+)
+
+// OwnershipTransfer moves an account to another customer, for example from a
+// sole trader to their new company. Both customers confirm, compliance
+// completes KYC on the new owner, and only then does the account change hands.
+type OwnershipTransfer struct {
+	ID                    int    `json:"id"`
+	AccountID             int    `json:"account_id"`
+	FromCustomerID        int    `json:"from_customer_id"`
+	ToCustomerID          int    `json:"to_customer_id"`
+	Reason                string `json:"reason"`
+	StatementEmail        string `json:"statement_email"`
+	MailingAddress        string `json:"mailing_address,omitempty"`
+	Status                string `json:"status"` // pending_confirmation, pending_kyc, completed, rejected or cancelled
+	CurrentOwnerConfirmed bool   `json:"current_owner_confirmed"`
+	NewOwnerConfirmed     bool   `json:"new_owner_confirmed"`
+	KYCReference          string `json:"kyc_reference,omitempty"`
+	KYCReviewedBy         string `json:"kyc_reviewed_by,omitempty"`
+	RequestedBy           string `json:"requested_by"`
+	CreatedAt             string `json:"created_at"`
+	CompletedAt           string `json:"completed_at,omitempty"`
+}
+
+// AccountOwner is a period during which a customer owned the account
+type AccountOwner struct {
+	CustomerID int    `json:"customer_id"`
+	OwnedFrom  string `json:"owned_from"`
+	OwnedUntil string `json:"owned_until,omitempty"`
+	TransferID int    `json:"transfer_id,omitempty"`
+	MergeID    int    `json:"merge_id,omitempty"` // set when the owner was merged into a duplicate record
+}
+
+const ownershipTablesSQL = `
+	CREATE TABLE IF NOT EXISTS ownership_transfers (
+		id SERIAL PRIMARY KEY,
+		account_id INTEGER NOT NULL REFERENCES accounts(id),
+		from_customer_id INTEGER NOT NULL,
+		to_customer_id INTEGER NOT NULL,
+		reason VARCHAR(255) NOT NULL DEFAULT '',
+		statement_email VARCHAR(100) NOT NULL,
+		mailing_address VARCHAR(500) NOT NULL DEFAULT '',
+		status VARCHAR(30) NOT NULL DEFAULT 'pending_confirmation',
+		current_owner_confirmed BOOLEAN NOT NULL DEFAULT FALSE,
+		new_owner_confirmed BOOLEAN NOT NULL DEFAULT FALSE,
+		kyc_reference VARCHAR(100) NOT NULL DEFAULT '',
+		kyc_reviewed_by VARCHAR(100) NOT NULL DEFAULT '',
+		requested_by VARCHAR(100) NOT NULL,
+		created_at TIMESTAMP NOT NULL DEFAULT NOW(),
+		completed_at TIMESTAMP
+	);
+	CREATE UNIQUE INDEX IF NOT EXISTS idx_ownership_transfers_open ON ownership_transfers(account_id)
+		WHERE status IN ('pending_confirmation', 'pending_kyc');
+	CREATE TABLE IF NOT EXISTS account_owner_history (
+		account_id INTEGER NOT NULL REFERENCES accounts(id),
+		customer_id INTEGER NOT NULL,
+		owned_from TIMESTAMP NOT NULL,
+		owned_until TIMESTAMP NOT NULL,
+		transfer_id INTEGER NOT NULL REFERENCES ownership_transfers(id)
+	);
+	ALTER TABLE statement_subscriptions ADD COLUMN IF NOT EXISTS mailing_address VARCHAR(500) NOT NULL DEFAULT '';`
+
+// ownershipStaffRoles may confirm on a customer's behalf and run the KYC review
+var ownershipStaffRoles = []string{"compliance", "admin"}
+
+const ownershipColumns = `id, account_id, from_customer_id, to_customer_id, reason, statement_email, mailing_address,
+	status, current_owner_confirmed, new_owner_confirmed, kyc_reference, kyc_reviewed_by, requested_by, created_at,
+	COALESCE(completed_at::text, '')`
+
+func scanOwnershipTransfer(row interface{ Scan(...interface{}) error }, t *OwnershipTransfer) error {
+	return row.Scan(&t.ID, &t.AccountID, &t.FromCustomerID, &t.ToCustomerID, &t.Reason, &t.StatementEmail,
+		&t.MailingAddress, &t.Status, &t.CurrentOwnerConfirmed, &t.NewOwnerConfirmed, &t.KYCReference,
+		&t.KYCReviewedBy, &t.RequestedBy, &t.CreatedAt, &t.CompletedAt)
+}
+
+// requestOwnershipTransfer opens a transfer of the account to to_customer_id
+func requestOwnershipTransfer(w http.ResponseWriter, r *http.Request) {
+	var t OwnershipTransfer
+	err := json.NewDecoder(r.Body).Decode(&t)
+	if err != nil {
+		http.Error(w, "Invalid request body", http.StatusBadRequest)
+		return
+	}
+
+	t.StatementEmail = strings.TrimSpace(t.StatementEmail)
+	if t.ToCustomerID <= 0 {
+		http.Error(w, "to_customer_id is required", http.StatusBadRequest)
+		return
+	}
+	if !strings.Contains(t.StatementEmail, "@") {
+		http.Error(w, "A valid statement_email is required", http.StatusBadRequest)
+		return
+	}
+
+	err = scanOwnershipTransfer(db.QueryRowContext(r.Context(), `INSERT INTO ownership_transfers (account_id,
+								  from_customer_id, to_customer_id, reason, statement_email, mailing_address, requested_by)
+								  SELECT id, customer_id, $2, $3, $4, $5, $6 FROM accounts
+								  WHERE id = $1 AND status = 'active' AND customer_id <> $2
+								  RETURNING `+ownershipColumns, mux.Vars(r)["id"], t.ToCustomerID, strings.TrimSpace(t.Reason),
+		t.StatementEmail, strings.TrimSpace(t.MailingAddress), requestActor(r)), &t)
+	if err != nil {
+		if err == sql.ErrNoRows {
+			http.Error(w, "The account must be active and owned by a different customer", http.StatusConflict)
+		} else if strings.Contains(err.Error(), "idx_ownership_transfers_open") {
+			http.Error(w, "An ownership transfer is already in progress for this account", http.StatusConflict)
+		} else {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+		}
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusCreated)
+	json.NewEncoder(w).Encode(t)
+}
+
+func getOwnershipTransfer(w http.ResponseWriter, r *http.Request) {
+	var t OwnershipTransfer
+	err := scanOwnershipTransfer(db.QueryRowContext(r.Context(), `SELECT `+ownershipColumns+`
+								  FROM ownership_transfers WHERE id = $1`, mux.Vars(r)["id"]), &t)
+	if err != nil {
+		if err == sql.ErrNoRows {
+			http.Error(w, "Ownership transfer not found", http.StatusNotFound)
+		} else {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+		}
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(t)
+}
+
+// confirmOwnershipTransfer records the confirmation of the current or new
+// owner. Customers can only confirm for themselves.
+func confirmOwnershipTransfer(w http.ResponseWriter, r *http.Request) {
+	var requestBody struct {
+		Party string `json:"party"` // current_owner or new_owner
+	}
+	err := json.NewDecoder(r.Body).Decode(&requestBody)
+	if err != nil {
+		http.Error(w, "Invalid request body", http.StatusBadRequest)
+		return
+	}
+
+	var column, customerColumn string
+	switch requestBody.Party {
+	case "current_owner":
+		column, customerColumn = "current_owner_confirmed", "from_customer_id"
+	case "new_owner":
+		column, customerColumn = "new_owner_confirmed", "to_customer_id"
+	default:
+		http.Error(w, "party must be current_owner or new_owner", http.StatusBadRequest)
+		return
+	}
+
+	// Staff may confirm on a customer's behalf, e.g. after a branch visit
+	caller, _ := strconv.Atoi(r.Header.Get("X-User-ID"))
+	staff := hasRole(r, ownershipStaffRoles...)
+
+	var t OwnershipTransfer
+	err = scanOwnershipTransfer(db.QueryRowContext(r.Context(), `UPDATE ownership_transfers SET `+column+` = TRUE,
+								  status = CASE WHEN current_owner_confirmed OR new_owner_confirmed THEN 'pending_kyc' ELSE status END
+								  WHERE id = $1 AND status = 'pending_confirmation' AND NOT `+column+`
+								  AND ($2 OR `+customerColumn+` = $3)
+								  RETURNING `+ownershipColumns, mux.Vars(r)["id"], staff, caller), &t)
+	if err == sql.ErrNoRows {
+		http.Error(w, "No pending confirmation for this party and caller", http.StatusConflict)
+		return
+	}
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(t)
+}
+
+// reviewOwnershipKYC records the KYC outcome for the new owner; a pass moves
+// the account, archives the previous owner in the history and readdresses
+// statements to the new owner
+func reviewOwnershipKYC(w http.ResponseWriter, r *http.Request) {
+	if !requireRole(w, r, ownershipStaffRoles...) {
+		return
+	}
+
+	var requestBody struct {
+		Passed    bool   `json:"passed"`
+		Reference string `json:"reference"`
+	}
+	err := json.NewDecoder(r.Body).Decode(&requestBody)
+	if err != nil {
+		http.Error(w, "Invalid request body", http.StatusBadRequest)
+		return
+	}
+	requestBody.Reference = strings.TrimSpace(requestBody.Reference)
+	if requestBody.Reference == "" {
+		http.Error(w, "reference is required", http.StatusBadRequest)
+		return
+	}
+
+	tx, err := db.BeginTx(r.Context(), nil)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	defer tx.Rollback()
+
+	status := "rejected"
+	if requestBody.Passed {
+		status = "completed"
+	}
+
+	var t OwnershipTransfer
+	err = scanOwnershipTransfer(tx.QueryRowContext(r.Context(), `UPDATE ownership_transfers SET status = $2,
+								  kyc_reference = $3, kyc_reviewed_by = $4, completed_at = NOW()
+								  WHERE id = $1 AND status = 'pending_kyc'
+								  RETURNING `+ownershipColumns, mux.Vars(r)["id"], status, requestBody.Reference,
+		requestActor(r)), &t)
+	if err == sql.ErrNoRows {
+		http.Error(w, "No ownership transfer awaiting KYC review", http.StatusConflict)
+		return
+	}
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	if requestBody.Passed {
+		result, err := tx.ExecContext(r.Context(), `UPDATE accounts SET customer_id = $2, updated_at = NOW()
+													WHERE id = $1 AND customer_id = $3`, t.AccountID, t.ToCustomerID, t.FromCustomerID)
+		if err == nil {
+			if n, _ := result.RowsAffected(); n == 0 {
+				err = fmt.Errorf("account %d is no longer owned by customer %d", t.AccountID, t.FromCustomerID)
+			}
+		}
+		// The previous owner's period starts at the last transfer, or at account opening
+		if err == nil {
+			_, err = tx.ExecContext(r.Context(), `INSERT INTO account_owner_history (account_id, customer_id, owned_from,
+												  owned_until, transfer_id)
+												  SELECT a.id, $2, COALESCE((SELECT MAX(owned_until) FROM account_owner_history
+													  WHERE account_id = a.id), a.created_at), NOW(), $3
+												  FROM accounts a WHERE a.id = $1`, t.AccountID, t.FromCustomerID, t.ID)
+		}
+		if err == nil {
+			_, err = tx.ExecContext(r.Context(), `UPDATE statement_subscriptions SET email = $2, mailing_address = $3,
+												  updated_at = NOW() WHERE account_id = $1`, t.AccountID, t.StatementEmail,
+				t.MailingAddress)
+		}
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+	}
+
+	err = tx.Commit()
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(t)
+}
+
+func cancelOwnershipTransfer(w http.ResponseWriter, r *http.Request) {
+	var t OwnershipTransfer
+	err := scanOwnershipTransfer(db.QueryRowContext(r.Context(), `UPDATE ownership_transfers SET status = 'cancelled'
+								  WHERE id = $1 AND status IN ('pending_confirmation', 'pending_kyc')
+								  RETURNING `+ownershipColumns, mux.Vars(r)["id"]), &t)
+	if err == sql.ErrNoRows {
+		http.Error(w, "No open ownership transfer found", http.StatusNotFound)
+		return
+	}
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(t)
+}
+
+// getOwnershipHistory lists past owners followed by the current one
+func getOwnershipHistory(w http.ResponseWriter, r *http.Request) {
+	rows, err := db.QueryContext(r.Context(), `SELECT customer_id, owned_from::text, owned_until::text,
+											   COALESCE(transfer_id, 0), COALESCE(merge_id, 0) FROM account_owner_history WHERE account_id = $1
+											   UNION ALL
+											   SELECT a.customer_id, COALESCE((SELECT MAX(owned_until) FROM account_owner_history
+												   WHERE account_id = a.id), a.created_at)::text, '', 0, 0
+											   FROM accounts a WHERE a.id = $1
+											   ORDER BY 2`, mux.Vars(r)["id"])
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	defer rows.Close()
+
+	owners := []AccountOwner{}
+	for rows.Next() {
+		var o AccountOwner
+		if err := rows.Scan(&o.CustomerID, &o.OwnedFrom, &o.OwnedUntil, &o.TransferID, &o.MergeID); err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		owners = append(owners, o)
+	}
+	if len(owners) == 0 {
+		http.Error(w, "Account not found", http.StatusNotFound)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(owners)
+}
@@ -0,0 +1,456 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"regexp"
+	"strconv"
+	"strings"
+
+	"bank/servicekit"
+
+	"github.com/gorilla/mux"
+	"go.uber.org/zap"
+)
+
+// MatchingRule associates incoming credits on a master account with a
+// virtual account, loan or invoice by their payment reference
+type MatchingRule struct {
+	ID              int    `json:"id"`
+	MasterAccountID int    `json:"master_account_id"`
+	Name            string `json:"name"`
+	MatchType       string `json:"match_type"` // regex or fuzzy
+	Pattern         string `json:"pattern"`
+	MaxDistance     int    `json:"max_distance"` // fuzzy only
+	TargetType      string `json:"target_type"`  // virtual_account, loan or invoice
+	TargetID        string `json:"target_id,omitempty"`
+	Priority        int    `json:"priority"`
+	Enabled         bool   `json:"enabled"`
+	CreatedAt       string `json:"created_at"`
+}
+
+const paymentMatchingTablesSQL = `
+	CREATE TABLE IF NOT EXISTS matching_rules (
+		id SERIAL PRIMARY KEY,
+		master_account_id INTEGER NOT NULL REFERENCES accounts(id),
+		name VARCHAR(100) NOT NULL,
+		match_type VARCHAR(10) NOT NULL,
+		pattern VARCHAR(255) NOT NULL,
+		max_distance INTEGER NOT NULL DEFAULT 0,
+		target_type VARCHAR(20) NOT NULL,
+		target_id VARCHAR(50) NOT NULL DEFAULT '',
+		priority INTEGER NOT NULL DEFAULT 100,
+		enabled BOOLEAN NOT NULL DEFAULT TRUE,
+		created_at TIMESTAMP NOT NULL DEFAULT NOW()
+	);
+	ALTER TABLE incoming_payments ADD COLUMN IF NOT EXISTS match_status VARCHAR(20) NOT NULL DEFAULT 'unmatched';
+	ALTER TABLE incoming_payments ADD COLUMN IF NOT EXISTS matched_type VARCHAR(20) NOT NULL DEFAULT '';
+	ALTER TABLE incoming_payments ADD COLUMN IF NOT EXISTS matched_id VARCHAR(50) NOT NULL DEFAULT '';
+	ALTER TABLE incoming_payments ADD COLUMN IF NOT EXISTS matched_rule_id INTEGER REFERENCES matching_rules(id) ON DELETE SET NULL;
+	ALTER TABLE incoming_payments ADD COLUMN IF NOT EXISTS matched_by VARCHAR(100) NOT NULL DEFAULT '';
+	ALTER TABLE incoming_payments ADD COLUMN IF NOT EXISTS matched_at TIMESTAMP;
+	CREATE INDEX IF NOT EXISTS idx_incoming_payments_unmatched ON incoming_payments(master_account_id) WHERE match_status = 'unmatched';`
+
+// paymentOpsRoles may manage matching rules and match payments by hand
+var paymentOpsRoles = []string{"payments_ops", "admin"}
+
+var matchTargetTypes = map[string]bool{"virtual_account": true, "loan": true, "invoice": true}
+
+// maxFuzzyDistance bounds the edits a fuzzy rule tolerates
+const maxFuzzyDistance = 3
+
+var ErrMatchTargetNotFound = errors.New("match target not found")
+
+const matchingRuleColumns = `id, master_account_id, name, match_type, pattern, max_distance, target_type, target_id,
+	priority, enabled, created_at`
+
+func scanMatchingRule(row interface{ Scan(...interface{}) error }, m *MatchingRule) error {
+	return row.Scan(&m.ID, &m.MasterAccountID, &m.Name, &m.MatchType, &m.Pattern, &m.MaxDistance, &m.TargetType,
+		&m.TargetID, &m.Priority, &m.Enabled, &m.CreatedAt)
+}
+
+// validate checks the rule and fills defaults. Regex rules without a fixed
+// target_id take it from the named group "target", or else the first group.
+func (m *MatchingRule) validate() error {
+	if strings.TrimSpace(m.Name) == "" {
+		return fmt.Errorf("name is required")
+	}
+	if !matchTargetTypes[m.TargetType] {
+		return fmt.Errorf("target_type must be virtual_account, loan or invoice")
+	}
+	if m.Priority == 0 {
+		m.Priority = 100
+	}
+	switch m.MatchType {
+	case "regex":
+		re, err := regexp.Compile("(?i)" + m.Pattern)
+		if err != nil {
+			return fmt.Errorf("invalid pattern: %v", err)
+		}
+		if m.TargetID == "" && re.NumSubexp() == 0 {
+			return fmt.Errorf("regex rules need a target_id or a capture group")
+		}
+		m.MaxDistance = 0
+	case "fuzzy":
+		if len(normalizeReference(m.Pattern)) < 4 {
+			return fmt.Errorf("fuzzy patterns need at least 4 letters or digits")
+		}
+		if m.TargetID == "" {
+			return fmt.Errorf("fuzzy rules need a target_id")
+		}
+		if m.MaxDistance < 0 || m.MaxDistance > maxFuzzyDistance {
+			return fmt.Errorf("max_distance must be between 0 and %d", maxFuzzyDistance)
+		}
+		if m.MaxDistance == 0 {
+			m.MaxDistance = 1
+		}
+	default:
+		return fmt.Errorf("match_type must be regex or fuzzy")
+	}
+	return nil
+}
+
+// match reports whether the reference satisfies the rule and the target it names
+func (m *MatchingRule) match(reference string) (string, bool) {
+	if m.MatchType == "fuzzy" {
+		if fuzzyDistance(normalizeReference(reference), normalizeReference(m.Pattern)) > m.MaxDistance {
+			return "", false
+		}
+		return m.TargetID, true
+	}
+
+	re, err := regexp.Compile("(?i)" + m.Pattern)
+	if err != nil {
+		return "", false
+	}
+	groups := re.FindStringSubmatch(reference)
+	if groups == nil {
+		return "", false
+	}
+	if m.TargetID != "" {
+		return m.TargetID, true
+	}
+	if i := re.SubexpIndex("target"); i > 0 {
+		return groups[i], groups[i] != ""
+	}
+	return groups[1], groups[1] != ""
+}
+
+// fuzzyDistance is the fewest edits that turn pattern into some substring of text
+func fuzzyDistance(text, pattern string) int {
+	prev := make([]int, len(text)+1)
+	cur := make([]int, len(text)+1)
+	for i := 1; i <= len(pattern); i++ {
+		cur[0] = i
+		for j := 1; j <= len(text); j++ {
+			cost := 1
+			if pattern[i-1] == text[j-1] {
+				cost = 0
+			}
+			cur[j] = prev[j-1] + cost
+			if prev[j]+1 < cur[j] {
+				cur[j] = prev[j] + 1
+			}
+			if cur[j-1]+1 < cur[j] {
+				cur[j] = cur[j-1] + 1
+			}
+		}
+		prev, cur = cur, prev
+	}
+
+	best := len(pattern)
+	for _, d := range prev {
+		if d < best {
+			best = d
+		}
+	}
+	return best
+}
+
+func createMatchingRule(w http.ResponseWriter, r *http.Request) {
+	if !requireRole(w, r, paymentOpsRoles...) {
+		return
+	}
+
+	var m MatchingRule
+	err := json.NewDecoder(r.Body).Decode(&m)
+	if err != nil {
+		http.Error(w, "Invalid request body", http.StatusBadRequest)
+		return
+	}
+	if err := m.validate(); err != nil {
+		http.Error(w, "Invalid matching rule", http.StatusBadRequest)
+		return
+	}
+
+	err = scanMatchingRule(db.QueryRowContext(r.Context(), `INSERT INTO matching_rules (master_account_id, name, match_type,
+									  pattern, max_distance, target_type, target_id, priority)
+									  SELECT id, $2, $3, $4, $5, $6, $7, $8 FROM accounts WHERE id = $1
+									  RETURNING `+matchingRuleColumns, mux.Vars(r)["id"], m.Name, m.MatchType, m.Pattern,
+		m.MaxDistance, m.TargetType, m.TargetID, m.Priority), &m)
+	if err != nil {
+		if err == sql.ErrNoRows {
+			http.Error(w, "Account not found", http.StatusNotFound)
+		} else {
+			writeDBError(w, err)
+		}
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusCreated)
+	json.NewEncoder(w).Encode(m)
+}
+
+func listMatchingRules(w http.ResponseWriter, r *http.Request) {
+	rows, err := db.QueryContext(r.Context(), `SELECT `+matchingRuleColumns+` FROM matching_rules
+											   WHERE master_account_id = $1 ORDER BY priority, id`, mux.Vars(r)["id"])
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	defer rows.Close()
+
+	rules := []MatchingRule{}
+	for rows.Next() {
+		var m MatchingRule
+		if err := scanMatchingRule(rows, &m); err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		rules = append(rules, m)
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(rules)
+}
+
+func deleteMatchingRule(w http.ResponseWriter, r *http.Request) {
+	if !requireRole(w, r, paymentOpsRoles...) {
+		return
+	}
+
+	result, err := db.ExecContext(r.Context(), `DELETE FROM matching_rules WHERE id = $1`, mux.Vars(r)["id"])
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	if n, _ := result.RowsAffected(); n == 0 {
+		http.Error(w, "Matching rule not found", http.StatusNotFound)
+		return
+	}
+
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// listIncomingPayments returns the master's incoming payments; by default
+// only the unmatched queue (?status=unmatched|matched|all)
+func listIncomingPayments(w http.ResponseWriter, r *http.Request) {
+	status := r.URL.Query().Get("status")
+	if status == "" {
+		status = "unmatched"
+	}
+	if status != "unmatched" && status != "matched" && status != "all" {
+		http.Error(w, "status must be unmatched, matched or all", http.StatusBadRequest)
+		return
+	}
+
+	rows, err := db.QueryContext(r.Context(), `SELECT `+incomingPaymentColumns+` FROM incoming_payments
+											   WHERE master_account_id = $1 AND ($2 = 'all' OR match_status = $2)
+											   ORDER BY created_at, id LIMIT 500`, mux.Vars(r)["id"], status)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	defer rows.Close()
+
+	payments := []IncomingPayment{}
+	for rows.Next() {
+		var p IncomingPayment
+		if err := scanIncomingPayment(rows, &p); err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		payments = append(payments, p)
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(payments)
+}
+
+// matchIncomingPaymentManually settles an unmatched payment against the target chosen by an operator
+func matchIncomingPaymentManually(w http.ResponseWriter, r *http.Request) {
+	if !requireRole(w, r, paymentOpsRoles...) {
+		return
+	}
+
+	var requestBody struct {
+		TargetType string `json:"target_type"`
+		TargetID   string `json:"target_id"`
+	}
+	err := json.NewDecoder(r.Body).Decode(&requestBody)
+	if err != nil {
+		http.Error(w, "Invalid request body", http.StatusBadRequest)
+		return
+	}
+	if !matchTargetTypes[requestBody.TargetType] || requestBody.TargetID == "" {
+		http.Error(w, "target_type must be virtual_account, loan or invoice and target_id is required", http.StatusBadRequest)
+		return
+	}
+
+	tx, err := db.BeginTx(r.Context(), nil)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	defer tx.Rollback()
+
+	var p IncomingPayment
+	err = scanIncomingPayment(tx.QueryRowContext(r.Context(), `SELECT `+incomingPaymentColumns+` FROM incoming_payments
+									  WHERE id = $1 FOR UPDATE`, mux.Vars(r)["id"]), &p)
+	if err != nil {
+		if err == sql.ErrNoRows {
+			http.Error(w, "Incoming payment not found", http.StatusNotFound)
+		} else {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+		}
+		return
+	}
+	if p.MatchStatus != "unmatched" {
+		http.Error(w, "Incoming payment is already matched", http.StatusConflict)
+		return
+	}
+
+	err = applyPaymentMatch(r.Context(), tx, &p, requestBody.TargetType, requestBody.TargetID, nil, requestActor(r))
+	if err != nil {
+		if err == ErrMatchTargetNotFound {
+			http.Error(w, "Match target not found", http.StatusUnprocessableEntity)
+		} else {
+			writeTransferError(w, err)
+		}
+		return
+	}
+
+	if err := tx.Commit(); err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(p)
+}
+
+// matchIncomingPayment routes a new credit by an exact virtual account
+// reference first, then through the master's rules in priority order. A rule
+// whose target cannot take the payment is skipped; every attempt runs in a
+// savepoint so a failed one leaves nothing behind.
+func matchIncomingPayment(ctx context.Context, tx *sql.Tx, p *IncomingPayment) error {
+	virtualID, err := routeIncomingPayment(ctx, tx, p.MasterAccountID, p.Reference)
+	if err != nil {
+		return err
+	}
+	if virtualID > 0 {
+		return applyPaymentMatch(ctx, tx, p, "virtual_account", strconv.Itoa(virtualID), nil, "reference")
+	}
+
+	rows, err := tx.QueryContext(ctx, `SELECT `+matchingRuleColumns+` FROM matching_rules
+									   WHERE master_account_id = $1 AND enabled ORDER BY priority, id`, p.MasterAccountID)
+	if err != nil {
+		return err
+	}
+	var rules []MatchingRule
+	for rows.Next() {
+		var m MatchingRule
+		if err := scanMatchingRule(rows, &m); err != nil {
+			rows.Close()
+			return err
+		}
+		rules = append(rules, m)
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return err
+	}
+
+	for _, rule := range rules {
+		target, ok := rule.match(p.Reference)
+		if !ok {
+			continue
+		}
+		if _, err := tx.ExecContext(ctx, `SAVEPOINT payment_match`); err != nil {
+			return err
+		}
+		ruleID := rule.ID
+		err := applyPaymentMatch(ctx, tx, p, rule.TargetType, target, &ruleID, "rule:"+strconv.Itoa(rule.ID))
+		if err == nil {
+			_, err = tx.ExecContext(ctx, `RELEASE SAVEPOINT payment_match`)
+			return err
+		}
+		servicekit.RequestLogger(ctx).Warn("matching rule could not apply payment", zap.Int("rule_id", rule.ID), zap.Int("payment_id", p.ID),
+			zap.String("target_type", rule.TargetType), zap.String("target", target), zap.Error(err))
+		if _, err := tx.ExecContext(ctx, `ROLLBACK TO SAVEPOINT payment_match`); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// applyPaymentMatch settles the payment against its target: virtual accounts
+// are credited, loans are repaid out of the master and invoices are recorded
+// for the invoicing system to reconcile
+func applyPaymentMatch(ctx context.Context, tx *sql.Tx, p *IncomingPayment, targetType, target string, ruleID *int, actor string) error {
+	var matchedID string
+	switch targetType {
+	case "virtual_account":
+		var virtualID int
+		err := tx.QueryRowContext(ctx, `SELECT id FROM virtual_accounts
+										WHERE master_account_id = $1 AND status = 'active' AND (id::text = $2 OR reference = $3)`,
+			p.MasterAccountID, target, normalizeReference(target)).Scan(&virtualID)
+		if err == sql.ErrNoRows {
+			return ErrMatchTargetNotFound
+		}
+		if err != nil {
+			return err
+		}
+		if err := allocateIncomingPayment(ctx, tx, p, virtualID); err != nil {
+			return err
+		}
+		matchedID = strconv.Itoa(virtualID)
+	case "loan":
+		var loanID int
+		err := tx.QueryRowContext(ctx, `SELECT l.id FROM accounts l JOIN accounts m ON m.id = $2
+										WHERE l.id::text = $1 AND l.account_type = 'loan' AND l.currency_code = m.currency_code`,
+			target, p.MasterAccountID).Scan(&loanID)
+		if err == sql.ErrNoRows {
+			return ErrMatchTargetNotFound
+		}
+		if err != nil {
+			return err
+		}
+		// The loan balance is the amount outstanding, so a repayment lowers both
+		description := fmt.Sprintf("Loan repayment %d", p.ID)
+		if err := postBalanceChange(ctx, tx, p.MasterAccountID, -p.Amount, description); err != nil {
+			return err
+		}
+		if err := postBalanceChange(ctx, tx, loanID, -p.Amount, description); err != nil {
+			return err
+		}
+		matchedID = strconv.Itoa(loanID)
+	case "invoice":
+		matchedID = normalizeReference(target)
+		if matchedID == "" {
+			return ErrMatchTargetNotFound
+		}
+	default:
+		return ErrMatchTargetNotFound
+	}
+
+	return scanIncomingPayment(tx.QueryRowContext(ctx, `UPDATE incoming_payments SET match_status = 'matched', matched_type = $2,
+									   matched_id = $3, matched_rule_id = $4, matched_by = $5, matched_at = NOW()
+									   WHERE id = $1 RETURNING `+incomingPaymentColumns,
+		p.ID, targetType, matchedID, ruleID, actor), p)
+}
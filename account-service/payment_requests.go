@@ -0,0 +1,384 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strings"
+	"time"
+
+	"bank/servicekit"
+
+	"github.com/gorilla/mux"
+	"go.uber.org/zap"
+)
+
+// PaymentRequest asks another customer to pay an amount into the requester's account
+type PaymentRequest struct {
+	ID                 int    `json:"id"`
+	RequesterAccountID int    `json:"requester_account_id"`
+	PayerAccountID     int    `json:"payer_account_id"`
+	Amount             Money  `json:"amount"`
+	CurrencyCode       string `json:"currency_code"`
+	Reference          string `json:"reference"`
+	Status             string `json:"status"` // pending, paid, declined, cancelled or expired
+	ExpiresAt          string `json:"expires_at"`
+	ExpiresInHours     int    `json:"expires_in_hours,omitempty"`
+	RemindedAt         string `json:"reminded_at,omitempty"`
+	ResolvedAt         string `json:"resolved_at,omitempty"`
+	CreatedAt          string `json:"created_at"`
+}
+
+const paymentRequestTablesSQL = `
+	CREATE TABLE IF NOT EXISTS payment_requests (
+		id SERIAL PRIMARY KEY,
+		requester_account_id INTEGER NOT NULL REFERENCES accounts(id),
+		payer_account_id INTEGER NOT NULL REFERENCES accounts(id),
+		amount DECIMAL(15,2) NOT NULL,
+		currency_code VARCHAR(3) NOT NULL,
+		reference VARCHAR(140) NOT NULL DEFAULT '',
+		status VARCHAR(20) NOT NULL DEFAULT 'pending',
+		expires_at TIMESTAMP NOT NULL,
+		reminded_at TIMESTAMP,
+		resolved_at TIMESTAMP,
+		created_at TIMESTAMP NOT NULL DEFAULT NOW()
+	);
+	CREATE INDEX IF NOT EXISTS idx_payment_requests_payer ON payment_requests (payer_account_id, status);
+	CREATE INDEX IF NOT EXISTS idx_payment_requests_requester ON payment_requests (requester_account_id, status);`
+
+// Payment request limits
+const (
+	defaultPaymentRequestExpiry = 7 * 24
+	maxPaymentRequestExpiry     = 30 * 24
+	paymentReminderInterval     = 24 * time.Hour
+)
+
+const paymentRequestColumns = `id, requester_account_id, payer_account_id, amount, currency_code, reference, status,
+	expires_at, COALESCE(reminded_at::text, ''), COALESCE(resolved_at::text, ''), created_at`
+
+func scanPaymentRequest(row interface{ Scan(...interface{}) error }, p *PaymentRequest) error {
+	return row.Scan(&p.ID, &p.RequesterAccountID, &p.PayerAccountID, &p.Amount, &p.CurrencyCode, &p.Reference,
+		&p.Status, &p.ExpiresAt, &p.RemindedAt, &p.ResolvedAt, &p.CreatedAt)
+}
+
+func createPaymentRequest(w http.ResponseWriter, r *http.Request) {
+	var p PaymentRequest
+	err := json.NewDecoder(r.Body).Decode(&p)
+	if err != nil {
+		http.Error(w, "Invalid request body", http.StatusBadRequest)
+		return
+	}
+
+	if p.Amount <= 0 {
+		http.Error(w, "Amount must be positive", http.StatusBadRequest)
+		return
+	}
+	if p.RequesterAccountID == p.PayerAccountID {
+		http.Error(w, "Cannot request money from the same account", http.StatusBadRequest)
+		return
+	}
+	if !requireOwnAccount(w, r, p.RequesterAccountID) {
+		return
+	}
+	p.Reference = strings.TrimSpace(p.Reference)
+	if len(p.Reference) > 140 {
+		http.Error(w, "reference must be at most 140 characters", http.StatusBadRequest)
+		return
+	}
+	if p.ExpiresInHours == 0 {
+		p.ExpiresInHours = defaultPaymentRequestExpiry
+	}
+	if p.ExpiresInHours < 1 || p.ExpiresInHours > maxPaymentRequestExpiry {
+		http.Error(w, "expires_in_hours must be between 1 and 720", http.StatusBadRequest)
+		return
+	}
+
+	// Both accounts must exist, be active and share a currency
+	query := `INSERT INTO payment_requests (requester_account_id, payer_account_id, amount, currency_code, reference, expires_at)
+			  SELECT req.id, payer.id, $3, req.currency_code, $4, NOW() + $5 * INTERVAL '1 hour'
+			  FROM accounts req, accounts payer
+			  WHERE req.id = $1 AND payer.id = $2 AND req.status = 'active' AND payer.status = 'active'
+				  AND req.currency_code = payer.currency_code
+			  RETURNING ` + paymentRequestColumns
+
+	err = scanPaymentRequest(db.QueryRowContext(r.Context(), query, p.RequesterAccountID, p.PayerAccountID, p.Amount, p.Reference,
+		p.ExpiresInHours), &p)
+	if err != nil {
+		if err == sql.ErrNoRows {
+			http.Error(w, "Both accounts must be active and use the same currency", http.StatusBadRequest)
+		} else {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+		}
+		return
+	}
+
+	notifyPaymentRequest(r.Context(), p, p.PayerAccountID, "payment_request_received")
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusCreated)
+	json.NewEncoder(w).Encode(p)
+}
+
+// listPaymentRequests lists requests the account must pay (incoming, default)
+// or has sent (outgoing), optionally filtered by status
+func listPaymentRequests(w http.ResponseWriter, r *http.Request) {
+	params := mux.Vars(r)
+	query := r.URL.Query()
+
+	column := "payer_account_id"
+	switch query.Get("direction") {
+	case "", "incoming":
+	case "outgoing":
+		column = "requester_account_id"
+	default:
+		http.Error(w, "direction must be incoming or outgoing", http.StatusBadRequest)
+		return
+	}
+	status := query.Get("status")
+	if status == "" {
+		status = "pending"
+	}
+
+	rows, err := db.QueryContext(r.Context(), `SELECT `+paymentRequestColumns+` FROM payment_requests
+						   WHERE `+column+` = $1 AND ($2 = 'all' OR status = $2) ORDER BY created_at DESC`,
+		params["id"], status)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	defer rows.Close()
+
+	requests := []PaymentRequest{}
+	for rows.Next() {
+		var p PaymentRequest
+		if err := scanPaymentRequest(rows, &p); err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		requests = append(requests, p)
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(requests)
+}
+
+// approvePaymentRequest pays a pending request with an internal transfer.
+// High-value payments need a device signature.
+func approvePaymentRequest(w http.ResponseWriter, r *http.Request) {
+	tx, err := db.BeginTx(r.Context(), nil)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	defer tx.Rollback()
+
+	p, ok := lockPendingPaymentRequest(w, r, tx, mux.Vars(r)["id"])
+	if !ok {
+		return
+	}
+	if !requireTransferSignature(w, r, p.PayerAccountID, p.RequesterAccountID, p.Amount, p.CurrencyCode) {
+		return
+	}
+
+	description := "Payment request"
+	if p.Reference != "" {
+		description += ": " + p.Reference
+	}
+	err = internalTransfer(r.Context(), tx, p.PayerAccountID, p.RequesterAccountID, p.Amount, description)
+	if err != nil {
+		writeTransferError(w, err)
+		return
+	}
+
+	err = scanPaymentRequest(tx.QueryRowContext(r.Context(), `UPDATE payment_requests SET status = 'paid', resolved_at = NOW()
+										  WHERE id = $1 RETURNING `+paymentRequestColumns, p.ID), &p)
+	if err == nil {
+		err = tx.Commit()
+	}
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	notifyPaymentRequest(r.Context(), p, p.RequesterAccountID, "payment_request_paid")
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(p)
+}
+
+// declinePaymentRequest is used by the payer to refuse a request
+func declinePaymentRequest(w http.ResponseWriter, r *http.Request) {
+	resolvePaymentRequest(w, r, "declined", "payment_request_declined")
+}
+
+// cancelPaymentRequest is used by the requester to withdraw a request
+func cancelPaymentRequest(w http.ResponseWriter, r *http.Request) {
+	resolvePaymentRequest(w, r, "cancelled", "payment_request_cancelled")
+}
+
+func resolvePaymentRequest(w http.ResponseWriter, r *http.Request, status, template string) {
+	tx, err := db.BeginTx(r.Context(), nil)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	defer tx.Rollback()
+
+	p, ok := lockPendingPaymentRequest(w, r, tx, mux.Vars(r)["id"])
+	if !ok {
+		return
+	}
+
+	err = scanPaymentRequest(tx.QueryRowContext(r.Context(), `UPDATE payment_requests SET status = $2, resolved_at = NOW()
+										  WHERE id = $1 RETURNING `+paymentRequestColumns, p.ID, status), &p)
+	if err == nil {
+		err = tx.Commit()
+	}
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	// Tell the other party
+	recipient := p.RequesterAccountID
+	if status == "cancelled" {
+		recipient = p.PayerAccountID
+	}
+	notifyPaymentRequest(r.Context(), p, recipient, template)
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(p)
+}
+
+// lockPendingPaymentRequest loads a request for update and writes an error
+// response unless it is still pending and unexpired
+func lockPendingPaymentRequest(w http.ResponseWriter, r *http.Request, tx *sql.Tx, id string) (PaymentRequest, bool) {
+	var p PaymentRequest
+	var expired bool
+	err := tx.QueryRowContext(r.Context(), `SELECT `+paymentRequestColumns+`, expires_at <= NOW() FROM payment_requests
+						WHERE id = $1 FOR UPDATE`, id).Scan(&p.ID, &p.RequesterAccountID, &p.PayerAccountID, &p.Amount,
+		&p.CurrencyCode, &p.Reference, &p.Status, &p.ExpiresAt, &p.RemindedAt, &p.ResolvedAt, &p.CreatedAt, &expired)
+	if err != nil {
+		if err == sql.ErrNoRows {
+			http.Error(w, "Payment request not found", http.StatusNotFound)
+		} else {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+		}
+		return p, false
+	}
+	if p.Status != "pending" {
+		http.Error(w, fmt.Sprintf("Payment request is %s", p.Status), http.StatusConflict)
+		return p, false
+	}
+	if expired {
+		http.Error(w, "Payment request has expired", http.StatusConflict)
+		return p, false
+	}
+	return p, true
+}
+
+// remindPaymentRequest nudges the payer, at most once per reminder interval
+func remindPaymentRequest(w http.ResponseWriter, r *http.Request) {
+	var p PaymentRequest
+	err := scanPaymentRequest(db.QueryRowContext(r.Context(), `UPDATE payment_requests SET reminded_at = NOW()
+										   WHERE id = $1 AND status = 'pending' AND expires_at > NOW()
+										   AND (reminded_at IS NULL OR reminded_at < NOW() - $2 * INTERVAL '1 second')
+										   RETURNING `+paymentRequestColumns, mux.Vars(r)["id"],
+		int(paymentReminderInterval/time.Second)), &p)
+	if err != nil {
+		if err == sql.ErrNoRows {
+			http.Error(w, "Request is not pending or was reminded recently", http.StatusConflict)
+		} else {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+		}
+		return
+	}
+
+	notifyPaymentRequest(r.Context(), p, p.PayerAccountID, "payment_request_reminder")
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(p)
+}
+
+// startPaymentRequestJobs expires overdue requests and reminds payers of
+// requests expiring within a day
+func startPaymentRequestJobs() {
+	go func() {
+		defer servicekit.ReportJobPanic("Payment request job")
+		for {
+			if err := runPaymentRequestJobs(serviceContext); err != nil {
+				servicekit.ReportJobError("Payment request job", err)
+			}
+			time.Sleep(time.Hour)
+		}
+	}()
+}
+
+func runPaymentRequestJobs(ctx context.Context) error {
+	rows, err := db.QueryContext(ctx, `UPDATE payment_requests SET status = 'expired', resolved_at = NOW()
+									   WHERE status = 'pending' AND expires_at <= NOW()
+									   RETURNING `+paymentRequestColumns)
+	if err != nil {
+		return err
+	}
+	expired, err := collectPaymentRequests(rows)
+	if err != nil {
+		return err
+	}
+	for _, p := range expired {
+		notifyPaymentRequest(ctx, p, p.RequesterAccountID, "payment_request_expired")
+	}
+
+	rows, err = db.QueryContext(ctx, `UPDATE payment_requests SET reminded_at = NOW()
+									  WHERE status = 'pending' AND expires_at <= NOW() + INTERVAL '1 day'
+									  AND (reminded_at IS NULL OR reminded_at < NOW() - INTERVAL '1 day')
+									  RETURNING `+paymentRequestColumns)
+	if err != nil {
+		return err
+	}
+	due, err := collectPaymentRequests(rows)
+	if err != nil {
+		return err
+	}
+	for _, p := range due {
+		notifyPaymentRequest(ctx, p, p.PayerAccountID, "payment_request_reminder")
+	}
+	return nil
+}
+
+func collectPaymentRequests(rows *sql.Rows) ([]PaymentRequest, error) {
+	defer rows.Close()
+	requests := []PaymentRequest{}
+	for rows.Next() {
+		var p PaymentRequest
+		if err := scanPaymentRequest(rows, &p); err != nil {
+			return nil, err
+		}
+		requests = append(requests, p)
+	}
+	return requests, rows.Err()
+}
+
+func notifyPaymentRequest(ctx context.Context, p PaymentRequest, accountID int, template string) {
+	var customerID int
+	err := db.QueryRowContext(ctx, "SELECT customer_id FROM accounts WHERE id = $1", accountID).Scan(&customerID)
+	if err == nil {
+		err = sendNotification(ctx, Notification{
+			CustomerID: customerID,
+			Channel:    "push",
+			Template:   template,
+			Data: map[string]interface{}{
+				"payment_request_id": p.ID,
+				"amount":             p.Amount,
+				"currency_code":      p.CurrencyCode,
+				"reference":          p.Reference,
+				"expires_at":         p.ExpiresAt,
+			},
+		})
+	}
+	if err != nil {
+		servicekit.RequestLogger(ctx).Error("failed to send notification", zap.String("template", template), zap.Error(err))
+	}
+}
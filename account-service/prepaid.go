@@ -0,0 +1,355 @@
+package main
+
+import (
+	"context"
+	"crypto/rand"
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"math/big"
+	"net/http"
+	"strings"
+	"time"
+
+	"bank/servicekit"
+
+	"github.com/gorilla/mux"
+	"go.uber.org/zap"
+)
+
+// PrepaidAccount is a limited-purpose virtual account, such as a gift card,
+// funded from a customer's main account. Whatever is left at expiry is
+// refunded to the funding account.
+type PrepaidAccount struct {
+	AccountID         int      `json:"account_id"`
+	FundingAccountID  int      `json:"funding_account_id"`
+	Name              string   `json:"name"`
+	InitialAmount     Money    `json:"initial_amount"`
+	Balance           Money    `json:"balance"`
+	CurrencyCode      string   `json:"currency_code"`
+	AllowedCategories []string `json:"allowed_categories"`
+	PayInReference    string   `json:"pay_in_reference"`
+	PayInURL          string   `json:"pay_in_url"`
+	Status            string   `json:"status"` // active, expired or closed
+	ExpiresAt         string   `json:"expires_at"`
+	ExpiresInDays     int      `json:"expires_in_days,omitempty"`
+	RefundedAmount    Money    `json:"refunded_amount"`
+	CreatedAt         string   `json:"created_at"`
+}
+
+const prepaidTablesSQL = `
+	CREATE TABLE IF NOT EXISTS prepaid_accounts (
+		account_id INTEGER PRIMARY KEY REFERENCES accounts(id),
+		funding_account_id INTEGER NOT NULL REFERENCES accounts(id),
+		name VARCHAR(100) NOT NULL,
+		initial_amount DECIMAL(15,2) NOT NULL,
+		allowed_categories VARCHAR(500) NOT NULL DEFAULT '',
+		pay_in_reference VARCHAR(20) NOT NULL UNIQUE,
+		status VARCHAR(20) NOT NULL DEFAULT 'active',
+		expires_at TIMESTAMP NOT NULL,
+		refunded_amount DECIMAL(15,2) NOT NULL DEFAULT 0,
+		created_at TIMESTAMP NOT NULL DEFAULT NOW()
+	);`
+
+// maxPrepaidDays bounds how long a prepaid account may stay open
+const maxPrepaidDays = 366
+
+const prepaidColumns = `p.account_id, p.funding_account_id, p.name, p.initial_amount, a.balance, a.currency_code,
+	p.allowed_categories, p.pay_in_reference, p.status, p.expires_at, p.refunded_amount, p.created_at`
+
+func scanPrepaidAccount(row interface{ Scan(...interface{}) error }, p *PrepaidAccount) error {
+	var categories string
+	err := row.Scan(&p.AccountID, &p.FundingAccountID, &p.Name, &p.InitialAmount, &p.Balance, &p.CurrencyCode,
+		&categories, &p.PayInReference, &p.Status, &p.ExpiresAt, &p.RefundedAmount, &p.CreatedAt)
+	p.PayInURL = getEnv("PUBLIC_BASE_URL", "http://localhost:8080") + "/v1/pay-in/" + p.PayInReference
+	p.AllowedCategories = []string{}
+	if categories != "" {
+		p.AllowedCategories = strings.Split(categories, ",")
+	}
+	return err
+}
+
+// newPayInReference returns a short code that payers quote when topping up
+func newPayInReference() string {
+	const alphabet = "ABCDEFGHJKLMNPQRSTUVWXYZ23456789"
+	code := make([]byte, 10)
+	for i := range code {
+		n, _ := rand.Int(rand.Reader, big.NewInt(int64(len(alphabet))))
+		code[i] = alphabet[n.Int64()]
+	}
+	return "PP" + string(code)
+}
+
+// createPrepaidAccount opens a prepaid account and funds it from the main account
+func createPrepaidAccount(w http.ResponseWriter, r *http.Request) {
+	params := mux.Vars(r)
+
+	var p PrepaidAccount
+	err := json.NewDecoder(r.Body).Decode(&p)
+	if err != nil {
+		http.Error(w, "Invalid request body", http.StatusBadRequest)
+		return
+	}
+
+	p.Name = strings.TrimSpace(p.Name)
+	if p.Name == "" || len(p.Name) > 100 {
+		http.Error(w, "name is required (at most 100 characters)", http.StatusBadRequest)
+		return
+	}
+	if p.InitialAmount <= 0 {
+		http.Error(w, "initial_amount must be positive", http.StatusBadRequest)
+		return
+	}
+	if p.ExpiresInDays < 1 || p.ExpiresInDays > maxPrepaidDays {
+		http.Error(w, fmt.Sprintf("expires_in_days must be between 1 and %d", maxPrepaidDays), http.StatusBadRequest)
+		return
+	}
+	for i, c := range p.AllowedCategories {
+		p.AllowedCategories[i] = strings.ToLower(strings.TrimSpace(c))
+	}
+
+	tx, err := db.BeginTx(r.Context(), nil)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	defer tx.Rollback()
+
+	var customerID int
+	var currency string
+	err = tx.QueryRowContext(r.Context(), `SELECT id, customer_id, currency_code FROM accounts WHERE id = $1`, params["id"]).Scan(
+		&p.FundingAccountID, &customerID, &currency)
+	if err != nil {
+		if err == sql.ErrNoRows {
+			http.Error(w, "Account not found", http.StatusNotFound)
+		} else {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+		}
+		return
+	}
+
+	metadata := AccountMetadata{Nickname: p.Name, Tags: []string{"prepaid"}}
+	number, err := newAccountNumber(r.Context(), tx)
+	if err == nil {
+		err = tx.QueryRowContext(r.Context(), `INSERT INTO accounts (customer_id, account_type, balance, currency_code,
+						   status, metadata, account_number) VALUES ($1, 'prepaid', 0, $2, 'active', $3, $4) RETURNING id`,
+			customerID, currency, metadata, number).Scan(&p.AccountID)
+	}
+	if err == nil {
+		err = enqueueEvent(r.Context(), tx, "account.created", fmt.Sprintf("account:%d", p.AccountID),
+			map[string]interface{}{"account_id": p.AccountID, "customer_id": customerID, "account_type": "prepaid",
+				"currency_code": currency, "status": "active", "account_number": number})
+	}
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	_, err = tx.ExecContext(r.Context(), `INSERT INTO prepaid_accounts (account_id, funding_account_id, name, initial_amount,
+					  allowed_categories, pay_in_reference, expires_at)
+					  VALUES ($1, $2, $3, $4, $5, $6, NOW() + $7 * INTERVAL '1 day')`, p.AccountID, p.FundingAccountID,
+		p.Name, p.InitialAmount, strings.Join(p.AllowedCategories, ","), newPayInReference(), p.ExpiresInDays)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	err = internalTransfer(r.Context(), tx, p.FundingAccountID, p.AccountID, p.InitialAmount,
+		"Prepaid account funding: "+p.Name)
+	if err != nil {
+		writeTransferError(w, err)
+		return
+	}
+
+	err = scanPrepaidAccount(tx.QueryRowContext(r.Context(), `SELECT `+prepaidColumns+` FROM prepaid_accounts p
+										  JOIN accounts a ON a.id = p.account_id WHERE p.account_id = $1`, p.AccountID), &p)
+	if err == nil {
+		err = tx.Commit()
+	}
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusCreated)
+	json.NewEncoder(w).Encode(p)
+}
+
+// listPrepaidAccounts lists the prepaid accounts funded from an account
+func listPrepaidAccounts(w http.ResponseWriter, r *http.Request) {
+	rows, err := db.QueryContext(r.Context(), `SELECT `+prepaidColumns+` FROM prepaid_accounts p JOIN accounts a ON a.id = p.account_id
+						   WHERE p.funding_account_id = $1 ORDER BY p.created_at DESC`, mux.Vars(r)["id"])
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	defer rows.Close()
+
+	accounts := []PrepaidAccount{}
+	for rows.Next() {
+		var p PrepaidAccount
+		if err := scanPrepaidAccount(rows, &p); err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		accounts = append(accounts, p)
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(accounts)
+}
+
+// closePrepaidAccount refunds the remaining balance and closes the account early
+func closePrepaidAccount(w http.ResponseWriter, r *http.Request) {
+	var p PrepaidAccount
+	err := refundPrepaidAccount(r.Context(), mux.Vars(r)["prepaidId"], "closed", &p)
+	if err != nil {
+		if err == sql.ErrNoRows {
+			http.Error(w, "Active prepaid account not found", http.StatusNotFound)
+		} else {
+			writeTransferError(w, err)
+		}
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(p)
+}
+
+// getPayInDetails returns what a third party needs to top up a prepaid
+// account. It is keyed by the pay-in reference so it can be shared publicly.
+func getPayInDetails(w http.ResponseWriter, r *http.Request) {
+	var p PrepaidAccount
+	err := scanPrepaidAccount(db.QueryRowContext(r.Context(), `SELECT `+prepaidColumns+` FROM prepaid_accounts p
+										   JOIN accounts a ON a.id = p.account_id
+										   WHERE p.pay_in_reference = $1 AND p.status = 'active'`,
+		strings.ToUpper(mux.Vars(r)["reference"])), &p)
+	if err != nil {
+		if err == sql.ErrNoRows {
+			http.Error(w, "Pay-in reference not found", http.StatusNotFound)
+		} else {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+		}
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"name":          p.Name,
+		"account_id":    p.AccountID,
+		"currency_code": p.CurrencyCode,
+		"reference":     p.PayInReference,
+		"expires_at":    p.ExpiresAt,
+	})
+}
+
+// refundPrepaidAccount moves the remaining balance back to the funding account
+// and sets the final status
+func refundPrepaidAccount(ctx context.Context, accountID interface{}, status string, p *PrepaidAccount) error {
+	tx, err := db.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	err = scanPrepaidAccount(tx.QueryRowContext(ctx, `SELECT `+prepaidColumns+` FROM prepaid_accounts p
+													  JOIN accounts a ON a.id = p.account_id
+													  WHERE p.account_id = $1 AND p.status = 'active'
+													  FOR UPDATE OF p`, accountID), p)
+	if err != nil {
+		return err
+	}
+
+	if p.Balance > 0 {
+		err = internalTransfer(ctx, tx, p.AccountID, p.FundingAccountID, p.Balance, "Prepaid account refund: "+p.Name)
+		if err != nil {
+			return err
+		}
+	}
+	_, err = tx.ExecContext(ctx, `UPDATE prepaid_accounts SET status = $2, refunded_amount = $3 WHERE account_id = $1`,
+		p.AccountID, status, p.Balance)
+	if err == nil {
+		_, err = tx.ExecContext(ctx, `UPDATE accounts SET status = 'closed', updated_at = NOW() WHERE id = $1`, p.AccountID)
+	}
+	if err != nil {
+		return err
+	}
+
+	p.Status = status
+	p.RefundedAmount = p.Balance
+	p.Balance = 0
+	return tx.Commit()
+}
+
+// startPrepaidExpiry refunds and closes prepaid accounts past their expiry
+func startPrepaidExpiry() {
+	go func() {
+		defer servicekit.ReportJobPanic("Prepaid account expiry")
+		for {
+			if err := expirePrepaidAccounts(serviceContext); err != nil {
+				servicekit.ReportJobError("Prepaid account expiry", err)
+			}
+			time.Sleep(time.Hour)
+		}
+	}()
+}
+
+func expirePrepaidAccounts(ctx context.Context) error {
+	rows, err := db.QueryContext(ctx, `SELECT account_id FROM prepaid_accounts WHERE status = 'active' AND expires_at <= NOW()`)
+	if err != nil {
+		return err
+	}
+	var ids []int
+	for rows.Next() {
+		var id int
+		if err := rows.Scan(&id); err != nil {
+			rows.Close()
+			return err
+		}
+		ids = append(ids, id)
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return err
+	}
+
+	for _, id := range ids {
+		var p PrepaidAccount
+		if err := refundPrepaidAccount(ctx, id, "expired", &p); err != nil && err != sql.ErrNoRows {
+			servicekit.RequestLogger(ctx).Error("failed to expire prepaid account", zap.Int("prepaid_id", id), zap.Error(err))
+		}
+	}
+	return nil
+}
+
+// checkPrepaidRestrictions limits prepaid accounts to card spending in their
+// allowed merchant categories
+func checkPrepaidRestrictions(ctx context.Context, req *AuthorizationRequest) (*AuthorizationDecision, error) {
+	var categories string
+	var expired bool
+	err := db.QueryRowContext(ctx, `SELECT allowed_categories, expires_at <= NOW() FROM prepaid_accounts
+									WHERE account_id = $1`, req.AccountID).Scan(&categories, &expired)
+	if err == sql.ErrNoRows {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	if expired {
+		return decline("prepaid_expired", "Prepaid account has expired"), nil
+	}
+	if req.Channel != "card" {
+		return decline("prepaid_channel", "Prepaid accounts can only be used for card payments"), nil
+	}
+	if categories == "" {
+		return nil, nil
+	}
+	for _, c := range strings.Split(categories, ",") {
+		if c == req.MerchantCategory {
+			return nil, nil
+		}
+	}
+	return decline("prepaid_category", "Prepaid account cannot be used at this merchant"), nil
+}
@@ -0,0 +1,123 @@
+package main
+
+import (
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"regexp"
+	"strings"
+
+	"bank/servicekit"
+
+	"github.com/gorilla/mux"
+	"go.uber.org/zap"
+)
+
+// Every account belongs to a branch, HQ unless it was opened elsewhere. The
+// GL accounts interest and fees post to are reported per product (account
+// type), branch and month by the transaction service, which keeps the GL.
+
+// defaultBranchCode is the branch of accounts opened without one
+const defaultBranchCode = "HQ"
+
+// branchAdminRoles may move an account to another branch; profitabilityRoles
+// read the profitability report
+var (
+	branchAdminRoles   = []string{"operations_supervisor", "admin"}
+	profitabilityRoles = []string{"finance", "treasury", "admin"}
+)
+
+var branchCodePattern = regexp.MustCompile(`^[A-Z0-9]{2,10}$`)
+
+// normalizeBranchCode upper-cases a branch code, defaulting an empty one
+func normalizeBranchCode(code string) (string, error) {
+	code = strings.ToUpper(strings.TrimSpace(code))
+	if code == "" {
+		return defaultBranchCode, nil
+	}
+	if !branchCodePattern.MatchString(code) {
+		return "", fmt.Errorf("branch_code must be 2 to 10 letters or digits")
+	}
+	return code, nil
+}
+
+// updateAccountBranch moves an account to another branch. The report groups
+// by an account's current branch, so its past income and expense move too.
+func updateAccountBranch(w http.ResponseWriter, r *http.Request) {
+	if !requireRole(w, r, branchAdminRoles...) {
+		return
+	}
+
+	var req struct {
+		BranchCode string `json:"branch_code"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, "Invalid request body", http.StatusBadRequest)
+		return
+	}
+	if strings.TrimSpace(req.BranchCode) == "" {
+		http.Error(w, "branch_code is required", http.StatusBadRequest)
+		return
+	}
+	code, err := normalizeBranchCode(req.BranchCode)
+	if err != nil {
+		http.Error(w, "branch_code must be 2 to 10 letters or digits", http.StatusBadRequest)
+		return
+	}
+
+	var account Account
+	err = db.QueryRowContext(r.Context(), `UPDATE accounts SET branch_code = $2, updated_at = NOW() WHERE id = $1
+										   RETURNING id, customer_id, account_type, balance, currency_code, status,
+										   overdraft_limit, created_at, updated_at, metadata, branch_code,
+										   COALESCE(account_number, '')`, mux.Vars(r)["id"],
+		code).Scan(&account.ID, &account.CustomerID, &account.AccountType, &account.Balance, &account.CurrencyCode,
+		&account.Status, &account.OverdraftLimit, &account.CreatedAt, &account.UpdatedAt, &account.Metadata,
+		&account.BranchCode, &account.AccountNumber)
+	if err != nil {
+		if err == sql.ErrNoRows {
+			http.Error(w, "Account not found", http.StatusNotFound)
+		} else {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+		}
+		return
+	}
+
+	servicekit.RequestLogger(r.Context()).Info("account branch changed", zap.Int("account_id", account.ID),
+		zap.String("branch_code", account.BranchCode), zap.String("actor", requestActor(r)))
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(account)
+}
+
+// getProfitabilityReport relays the profitability report from the
+// transaction service with the caller's query (?from=&to= months,
+// ?group_by=, ?product_code=, ?branch_code=)
+func getProfitabilityReport(w http.ResponseWriter, r *http.Request) {
+	if !requireRole(w, r, profitabilityRoles...) {
+		return
+	}
+
+	url := getEnv("TRANSACTION_SERVICE_URL", "http://localhost:8081") + "/v1/reports/profitability?" + r.URL.RawQuery
+	req, err := http.NewRequestWithContext(r.Context(), http.MethodGet, url, nil)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	resp, err := serviceClient.Do(req)
+	if err != nil {
+		servicekit.RequestLogger(r.Context()).Error("could not fetch profitability report", zap.Error(err))
+		http.Error(w, "Report unavailable", http.StatusBadGateway)
+		return
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK && resp.StatusCode != http.StatusBadRequest {
+		servicekit.RequestLogger(r.Context()).Error("could not fetch profitability report", zap.Int("status", resp.StatusCode))
+		http.Error(w, "Report unavailable", http.StatusBadGateway)
+		return
+	}
+
+	w.Header().Set("Content-Type", resp.Header.Get("Content-Type"))
+	w.WriteHeader(resp.StatusCode)
+	io.Copy(w, resp.Body)
+}
@@ -0,0 +1,463 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math"
+	"net/http"
+	"strings"
+	"time"
+
+	"bank/servicekit"
+
+	"github.com/gorilla/mux"
+	"go.uber.org/zap"
+)
+
+// InterestRate is a product's annual rate in percent from EffectiveFrom until
+// the day before the next rate of the same product takes effect
+type InterestRate struct {
+	ID            int     `json:"id"`
+	ProductCode   string  `json:"product_code"`
+	Rate          float64 `json:"rate"`
+	EffectiveFrom string  `json:"effective_from"`
+	EffectiveTo   string  `json:"effective_to,omitempty"` // empty while open-ended
+	CreatedBy     string  `json:"created_by"`
+	CreatedAt     string  `json:"created_at"`
+}
+
+// InterestAccrual is one day's interest on an account's end-of-day balance
+type InterestAccrual struct {
+	Date    string  `json:"date"`
+	Balance Money   `json:"balance"`
+	Rate    float64 `json:"rate"`
+	Amount  float64 `json:"amount"` // unrounded, in fractions of a cent
+}
+
+const rateTablesSQL = `
+	CREATE TABLE IF NOT EXISTS interest_rates (
+		id SERIAL PRIMARY KEY,
+		product_code VARCHAR(20) NOT NULL,
+		rate DECIMAL(7,4) NOT NULL,
+		effective_from DATE NOT NULL,
+		created_by VARCHAR(100) NOT NULL,
+		created_at TIMESTAMP NOT NULL DEFAULT NOW(),
+		UNIQUE (product_code, effective_from)
+	);
+	CREATE TABLE IF NOT EXISTS interest_accruals (
+		account_id INTEGER NOT NULL REFERENCES accounts(id),
+		accrual_date DATE NOT NULL,
+		balance DECIMAL(15,2) NOT NULL,
+		rate DECIMAL(7,4) NOT NULL,
+		amount DECIMAL(15,6) NOT NULL,
+		created_at TIMESTAMP NOT NULL DEFAULT NOW(),
+		PRIMARY KEY (account_id, accrual_date)
+	);`
+
+// rateAdminRoles may publish product rates
+var rateAdminRoles = []string{"treasury", "admin"}
+
+// accrualLookbackDays is how far back the accrual job fills days it missed
+const accrualLookbackDays = 7
+
+// rateRangeSQL lists rates with the end of their effective range
+const rateRangeSQL = `SELECT id, product_code, rate, effective_from::text AS effective_from,
+	COALESCE((LEAD(effective_from) OVER (PARTITION BY product_code ORDER BY effective_from) - 1)::text, '') AS effective_to,
+	created_by, created_at FROM interest_rates`
+
+func scanInterestRate(row interface{ Scan(...interface{}) error }, ir *InterestRate) error {
+	return row.Scan(&ir.ID, &ir.ProductCode, &ir.Rate, &ir.EffectiveFrom, &ir.EffectiveTo, &ir.CreatedBy, &ir.CreatedAt)
+}
+
+// rateTable is one product's rates ordered by effective date
+type rateTable []InterestRate
+
+func loadRateTable(ctx context.Context, q interface {
+	QueryContext(context.Context, string, ...interface{}) (*sql.Rows, error)
+}, productCode string) (rateTable, error) {
+	rows, err := q.QueryContext(ctx, rateRangeSQL+` WHERE product_code = $1 ORDER BY effective_from`, productCode)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var table rateTable
+	for rows.Next() {
+		var ir InterestRate
+		if err := scanInterestRate(rows, &ir); err != nil {
+			return nil, err
+		}
+		table = append(table, ir)
+	}
+	return table, rows.Err()
+}
+
+// on returns the annual rate effective on the given date
+func (t rateTable) on(date time.Time) (float64, error) {
+	day := date.Format("2006-01-02")
+	for i := len(t) - 1; i >= 0; i-- {
+		if t[i].EffectiveFrom <= day {
+			return t[i].Rate, nil
+		}
+	}
+	return 0, fmt.Errorf("no interest rate effective on %s", day)
+}
+
+// publishRate adds a rate for a product from a future or current date. A rate
+// already published for the same date is replaced. Loan schedules of the
+// product are regenerated from that date and affected customers are notified.
+func publishRate(w http.ResponseWriter, r *http.Request) {
+	if !requireRole(w, r, rateAdminRoles...) {
+		return
+	}
+
+	var ir InterestRate
+	err := json.NewDecoder(r.Body).Decode(&ir)
+	if err != nil {
+		http.Error(w, "Invalid request body", http.StatusBadRequest)
+		return
+	}
+
+	ir.ProductCode = strings.ToLower(strings.TrimSpace(ir.ProductCode))
+	if _, ok := productCatalog[ir.ProductCode]; !ok {
+		http.Error(w, "Unknown product_code", http.StatusBadRequest)
+		return
+	}
+	if ir.Rate < 0 || ir.Rate >= 100 {
+		http.Error(w, "rate must be between 0 and 100", http.StatusBadRequest)
+		return
+	}
+	effective, err := time.Parse("2006-01-02", ir.EffectiveFrom)
+	if err != nil {
+		http.Error(w, "effective_from must be YYYY-MM-DD", http.StatusBadRequest)
+		return
+	}
+	// Days up to yesterday may already be accrued, so rates cannot be backdated
+	now := time.Now().UTC()
+	if effective.Before(time.Date(now.Year(), now.Month(), now.Day(), 0, 0, 0, 0, time.UTC)) {
+		http.Error(w, "effective_from must not be in the past", http.StatusBadRequest)
+		return
+	}
+
+	tx, err := db.BeginTx(r.Context(), nil)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	defer tx.Rollback()
+
+	// Serialize rate changes per product so schedules see a consistent table
+	_, err = tx.ExecContext(r.Context(), `SELECT pg_advisory_xact_lock(hashtext('interest_rates:' || $1))`, ir.ProductCode)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	previous, err := loadRateTable(r.Context(), tx, ir.ProductCode)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	oldRate, oldErr := previous.on(effective)
+
+	_, err = tx.ExecContext(r.Context(), `INSERT INTO interest_rates (product_code, rate, effective_from, created_by)
+										  VALUES ($1, $2, $3, $4)
+										  ON CONFLICT (product_code, effective_from) DO UPDATE SET
+											  rate = EXCLUDED.rate, created_by = EXCLUDED.created_by, created_at = NOW()`,
+		ir.ProductCode, ir.Rate, ir.EffectiveFrom, requestActor(r))
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	err = scanInterestRate(tx.QueryRowContext(r.Context(), `SELECT * FROM (`+rateRangeSQL+` WHERE product_code = $1) ranges
+															 WHERE effective_from = $2`, ir.ProductCode, ir.EffectiveFrom), &ir)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	rescheduled, err := regenerateProductSchedules(r.Context(), tx, ir.ProductCode, effective)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	if err := tx.Commit(); err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	// Rates are stored to four decimal places
+	if oldErr != nil || math.Round(oldRate*10000) != math.Round(ir.Rate*10000) {
+		go notifyRateChange(serviceContext, ir, oldRate)
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusCreated)
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"rate":              ir,
+		"loans_rescheduled": rescheduled,
+	})
+}
+
+// listRates returns every rate with its effective range (?product_code= filters)
+func listRates(w http.ResponseWriter, r *http.Request) {
+	product := strings.ToLower(r.URL.Query().Get("product_code"))
+	rows, err := db.QueryContext(r.Context(), `SELECT * FROM (`+rateRangeSQL+`) ranges
+											   WHERE $1 = '' OR product_code = $1
+											   ORDER BY product_code, effective_from`, product)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	defer rows.Close()
+
+	rates := []InterestRate{}
+	for rows.Next() {
+		var ir InterestRate
+		if err := scanInterestRate(rows, &ir); err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		rates = append(rates, ir)
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(rates)
+}
+
+// getEffectiveRate returns the rate of ?product_code= effective on ?date= (default today)
+func getEffectiveRate(w http.ResponseWriter, r *http.Request) {
+	date := time.Now().UTC()
+	if value := r.URL.Query().Get("date"); value != "" {
+		var err error
+		date, err = time.Parse("2006-01-02", value)
+		if err != nil {
+			http.Error(w, "date must be YYYY-MM-DD", http.StatusBadRequest)
+			return
+		}
+	}
+
+	var ir InterestRate
+	err := scanInterestRate(db.QueryRowContext(r.Context(), `SELECT * FROM (`+rateRangeSQL+` WHERE product_code = $1) ranges
+															  WHERE effective_from <= $2 ORDER BY effective_from DESC LIMIT 1`,
+		strings.ToLower(r.URL.Query().Get("product_code")), date.Format("2006-01-02")), &ir)
+	if err != nil {
+		if err == sql.ErrNoRows {
+			http.Error(w, "No rate effective on that date", http.StatusNotFound)
+		} else {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+		}
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(ir)
+}
+
+// notifyRateChange tells every customer holding the product about the new rate
+func notifyRateChange(ctx context.Context, ir InterestRate, oldRate float64) {
+	rows, err := db.QueryContext(ctx, `SELECT DISTINCT customer_id FROM accounts
+									   WHERE account_type = $1 AND status <> 'closed'`, ir.ProductCode)
+	if err != nil {
+		servicekit.RequestLogger(ctx).Error("failed to list customers for rate change", zap.Error(err))
+		return
+	}
+	var customers []int
+	for rows.Next() {
+		var id int
+		if err := rows.Scan(&id); err == nil {
+			customers = append(customers, id)
+		}
+	}
+	rows.Close()
+
+	for _, customerID := range customers {
+		err := sendNotification(ctx, Notification{
+			CustomerID: customerID,
+			Channel:    "email",
+			Template:   "interest_rate_change",
+			Data: map[string]interface{}{
+				"product_code":   ir.ProductCode,
+				"old_rate":       oldRate,
+				"new_rate":       ir.Rate,
+				"effective_from": ir.EffectiveFrom,
+			},
+		})
+		if err != nil {
+			servicekit.RequestLogger(ctx).Error("failed to send notification", zap.String("template", "interest_rate_change"), zap.Error(err))
+		}
+	}
+}
+
+// startInterestAccrual accrues daily interest once the end-of-day snapshot
+// of each account is available, and posts each month's accruals once the
+// month is over
+func startInterestAccrual() {
+	go func() {
+		defer servicekit.ReportJobPanic("Interest accrual")
+		for {
+			if err := accrueInterest(serviceContext); err != nil {
+				servicekit.ReportJobError("Interest accrual", err)
+			}
+			if err := postInterest(serviceContext); err != nil {
+				servicekit.ReportJobError("Interest posting", err)
+			}
+			time.Sleep(time.Hour)
+		}
+	}()
+}
+
+// accrueInterest accrues every snapshotted day of the lookback window that has
+// not been accrued yet, at the product rate effective on that day (actual/365)
+func accrueInterest(ctx context.Context) error {
+	_, err := db.ExecContext(ctx, `INSERT INTO interest_accruals (account_id, accrual_date, balance, rate, amount)
+								   SELECT s.account_id, s.snapshot_date, s.balance, r.rate, s.balance * r.rate / 100 / 365
+								   FROM balance_snapshots s
+								   JOIN accounts a ON a.id = s.account_id
+								   JOIN LATERAL (SELECT rate FROM interest_rates
+										WHERE product_code = a.account_type AND effective_from <= s.snapshot_date
+										ORDER BY effective_from DESC LIMIT 1) r ON TRUE
+								   WHERE s.snapshot_date >= CURRENT_DATE - $1::int AND s.snapshot_date < CURRENT_DATE
+								   AND s.balance > 0
+								   ON CONFLICT (account_id, accrual_date) DO NOTHING`, accrualLookbackDays)
+	return err
+}
+
+// postInterest posts the accruals of every month before the current one.
+// Deposits are paid their interest against interest_expense; loans and other
+// liability accounts are charged theirs, raising the amount owed, against
+// interest_income. An account that is not active keeps its accruals until it
+// is again.
+func postInterest(ctx context.Context) error {
+	rows, err := db.QueryContext(ctx, `SELECT account_id, to_char(accrual_date, 'YYYY-MM') AS month
+									   FROM interest_accruals
+									   WHERE posted_at IS NULL AND accrual_date < date_trunc('month', CURRENT_DATE)
+									   GROUP BY account_id, month ORDER BY month, account_id`)
+	if err != nil {
+		return err
+	}
+	type due struct {
+		accountID int
+		month     string
+	}
+	var pending []due
+	for rows.Next() {
+		var d due
+		if err := rows.Scan(&d.accountID, &d.month); err != nil {
+			rows.Close()
+			return err
+		}
+		pending = append(pending, d)
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return err
+	}
+
+	for _, d := range pending {
+		err := postAccountInterest(ctx, d.accountID, d.month)
+		if err != nil && !errors.Is(err, ErrTransferAccountInactive) {
+			servicekit.RequestLogger(ctx).Error("failed to post interest", zap.Int("account_id", d.accountID),
+				zap.String("month", d.month), zap.Error(err))
+		}
+	}
+	return nil
+}
+
+// postAccountInterest posts one account's accruals for month (YYYY-MM),
+// rounded to the cent. Marking them posted locks them, so a replica running
+// the job at the same time finds nothing left to post.
+func postAccountInterest(ctx context.Context, accountID int, month string) error {
+	tx, err := db.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	// Accruals carry fractions of a cent, so they are summed before rounding
+	var amount Money
+	err = tx.QueryRowContext(ctx, `WITH posted AS (
+									   UPDATE interest_accruals SET posted_at = NOW()
+									   WHERE account_id = $1 AND to_char(accrual_date, 'YYYY-MM') = $2
+									   AND posted_at IS NULL RETURNING amount)
+								   SELECT COALESCE(ROUND(SUM(amount), 2), 0) FROM posted`, accountID, month).Scan(&amount)
+	if err != nil {
+		return err
+	}
+
+	if amount > 0 {
+		var accountType string
+		err := tx.QueryRowContext(ctx, `SELECT account_type FROM accounts WHERE id = $1`, accountID).Scan(&accountType)
+		if err != nil {
+			return err
+		}
+		description := fmt.Sprintf("Interest for %s", month)
+		currency, err := applyBalanceChange(ctx, tx, accountID, amount, description)
+		if err != nil {
+			return err
+		}
+		// A loan is the bank's asset, so the charge debits it and credits income
+		posting := LedgerPosting{Type: "interest", Amount: amount, CurrencyCode: currency, Description: description,
+			DestinationAccountID: &accountID, GLAccount: glInterestExpense}
+		if liabilityAccountTypes[accountType] {
+			posting.DestinationAccountID, posting.SourceAccountID, posting.GLAccount = nil, &accountID, glInterestIncome
+		}
+		if err := recordInLedger(ctx, tx, posting); err != nil {
+			return err
+		}
+	}
+	return tx.Commit()
+}
+
+// getInterestAccruals returns an account's daily accruals (?from=&to=, default
+// the current month) and their total
+func getInterestAccruals(w http.ResponseWriter, r *http.Request) {
+	now := time.Now().UTC()
+	from := time.Date(now.Year(), now.Month(), 1, 0, 0, 0, 0, time.UTC)
+	to := now
+	for name, target := range map[string]*time.Time{"from": &from, "to": &to} {
+		if value := r.URL.Query().Get(name); value != "" {
+			parsed, err := time.Parse("2006-01-02", value)
+			if err != nil {
+				http.Error(w, name+" must be YYYY-MM-DD", http.StatusBadRequest)
+				return
+			}
+			*target = parsed
+		}
+	}
+
+	rows, err := db.QueryContext(r.Context(), `SELECT accrual_date::text, balance, rate, amount FROM interest_accruals
+											   WHERE account_id = $1 AND accrual_date BETWEEN $2 AND $3
+											   ORDER BY accrual_date`, mux.Vars(r)["id"], from.Format("2006-01-02"), to.Format("2006-01-02"))
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	defer rows.Close()
+
+	accruals := []InterestAccrual{}
+	total := 0.0
+	for rows.Next() {
+		var a InterestAccrual
+		if err := rows.Scan(&a.Date, &a.Balance, &a.Rate, &a.Amount); err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		total += a.Amount
+		accruals = append(accruals, a)
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"account_id": mux.Vars(r)["id"],
+		"from":       from.Format("2006-01-02"),
+		"to":         to.Format("2006-01-02"),
+		"total":      Money(math.Round(total * 100)),
+		"accruals":   accruals,
+	})
+}
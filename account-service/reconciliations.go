@@ -0,0 +1,540 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"database/sql"
+	"encoding/csv"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"bank/servicekit"
+
+	"github.com/gorilla/mux"
+	"go.uber.org/zap"
+)
+
+// Business customers reconcile their own books against the bank: they upload
+// the entries of their ledger for the account as CSV and a worker matches them
+// against the account's transactions. An entry matches a transaction of the
+// same signed amount, money received positive, posted within the date
+// tolerance; entries whose reference the transaction carries are matched
+// first, then the rest by the closest date. Each transaction matches at most
+// one entry.
+
+const (
+	maxReconciliationBytes      = 5 << 20
+	maxReconciliationItems      = 20000
+	maxReconciliationPeriodDays = 366
+	defaultDateToleranceDays    = 3
+	maxDateToleranceDays        = 10
+)
+
+// ReconciliationItem is one entry of the customer's ledger extract
+type ReconciliationItem struct {
+	Line        int    `json:"line"`
+	Date        string `json:"date"`
+	Amount      Money  `json:"amount"`
+	Reference   string `json:"reference,omitempty"`
+	Description string `json:"description,omitempty"`
+}
+
+// BankTransaction is a transaction on the account as the bank recorded it
+type BankTransaction struct {
+	ID          int    `json:"transaction_id"`
+	Date        string `json:"date"`
+	Amount      Money  `json:"amount"`
+	Reference   string `json:"reference,omitempty"`
+	Description string `json:"description,omitempty"`
+}
+
+// ReconciliationMatch pairs an extract entry with the transaction it matched
+type ReconciliationMatch struct {
+	Item        ReconciliationItem `json:"item"`
+	Transaction BankTransaction    `json:"transaction"`
+	MatchedBy   string             `json:"matched_by"` // reference or amount_date
+	DaysApart   int                `json:"days_apart"`
+}
+
+// ReconciliationSummary totals a reconciliation. Difference is the
+// extract's total less the bank's over the period.
+type ReconciliationSummary struct {
+	ExtractItems     int   `json:"extract_items"`
+	BankTransactions int   `json:"bank_transactions"`
+	Matched          int   `json:"matched"`
+	UnmatchedExtract int   `json:"unmatched_extract"`
+	UnmatchedBank    int   `json:"unmatched_bank"`
+	ExtractTotal     Money `json:"extract_total"`
+	BankTotal        Money `json:"bank_total"`
+	Difference       Money `json:"difference"`
+}
+
+// ReconciliationReport lists the matched and unmatched items. Unmatched bank
+// transactions are those posted within the extract's period.
+type ReconciliationReport struct {
+	Summary          ReconciliationSummary `json:"summary"`
+	Matched          []ReconciliationMatch `json:"matched"`
+	UnmatchedExtract []ReconciliationItem  `json:"unmatched_extract"`
+	UnmatchedBank    []BankTransaction     `json:"unmatched_bank"`
+}
+
+// ReconciliationJob is a submitted extract and, once completed, its report
+type ReconciliationJob struct {
+	ID                int                   `json:"id"`
+	AccountID         int                   `json:"account_id"`
+	Status            string                `json:"status"`
+	Error             string                `json:"error,omitempty"`
+	ItemCount         int                   `json:"item_count"`
+	PeriodFrom        string                `json:"period_from"`
+	PeriodTo          string                `json:"period_to"`
+	DateToleranceDays int                   `json:"date_tolerance_days"`
+	RequestedBy       string                `json:"requested_by"`
+	Report            *ReconciliationReport `json:"report,omitempty"`
+	CreatedAt         string                `json:"created_at"`
+	CompletedAt       string                `json:"completed_at,omitempty"`
+	extractKey        string
+}
+
+var reconciliationQueue = make(chan int, 100)
+
+// parseLedgerExtract reads the CSV extract: a header row naming at least the
+// date (YYYY-MM-DD) and amount columns, optionally reference and description
+func parseLedgerExtract(data []byte) ([]ReconciliationItem, error) {
+	reader := csv.NewReader(bytes.NewReader(bytes.TrimPrefix(data, []byte("\xef\xbb\xbf"))))
+	reader.FieldsPerRecord = -1
+	reader.TrimLeadingSpace = true
+
+	header, err := reader.Read()
+	if err == io.EOF {
+		return nil, errors.New("the extract is empty")
+	}
+	if err != nil {
+		return nil, err
+	}
+	columns := map[string]int{}
+	for i, name := range header {
+		columns[strings.ToLower(strings.TrimSpace(name))] = i
+	}
+	for _, required := range []string{"date", "amount"} {
+		if _, ok := columns[required]; !ok {
+			return nil, fmt.Errorf("the header must name a %s column", required)
+		}
+	}
+	field := func(record []string, name string) string {
+		if i, ok := columns[name]; ok && i < len(record) {
+			return strings.TrimSpace(record[i])
+		}
+		return ""
+	}
+
+	var items []ReconciliationItem
+	for {
+		record, err := reader.Read()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return nil, err
+		}
+		line, _ := reader.FieldPos(0)
+		if len(record) == 1 && strings.TrimSpace(record[0]) == "" {
+			continue
+		}
+		if len(items) == maxReconciliationItems {
+			return nil, fmt.Errorf("the extract is limited to %d entries", maxReconciliationItems)
+		}
+		item := ReconciliationItem{
+			Line:        line,
+			Date:        field(record, "date"),
+			Reference:   field(record, "reference"),
+			Description: field(record, "description"),
+		}
+		if _, err := time.Parse("2006-01-02", item.Date); err != nil {
+			return nil, fmt.Errorf("line %d: date must be YYYY-MM-DD", line)
+		}
+		// Thousands separators are accepted, as spreadsheets write them
+		item.Amount, err = parseMoney(strings.ReplaceAll(field(record, "amount"), ",", ""))
+		if err != nil || item.Amount == 0 {
+			return nil, fmt.Errorf("line %d: amount must be a non-zero decimal, negative for money paid out", line)
+		}
+		items = append(items, item)
+	}
+	if len(items) == 0 {
+		return nil, errors.New("the extract has no entries")
+	}
+	return items, nil
+}
+
+// requestReconciliation accepts a ledger extract for a business account and
+// queues its reconciliation
+func requestReconciliation(w http.ResponseWriter, r *http.Request) {
+	if !requireAccountReader(w, r) {
+		return
+	}
+	accountID, err := strconv.Atoi(mux.Vars(r)["id"])
+	if err != nil {
+		http.Error(w, "Invalid account ID", http.StatusBadRequest)
+		return
+	}
+	tolerance := defaultDateToleranceDays
+	if value := r.URL.Query().Get("date_tolerance_days"); value != "" {
+		tolerance, err = strconv.Atoi(value)
+		if err != nil || tolerance < 0 || tolerance > maxDateToleranceDays {
+			http.Error(w, fmt.Sprintf("date_tolerance_days must be 0 to %d", maxDateToleranceDays), http.StatusBadRequest)
+			return
+		}
+	}
+
+	var accountType string
+	err = db.QueryRowContext(r.Context(), `SELECT account_type FROM accounts WHERE id = $1`, accountID).Scan(&accountType)
+	if err == sql.ErrNoRows {
+		http.Error(w, "Account not found", http.StatusNotFound)
+		return
+	}
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	if accountType != "business" {
+		http.Error(w, "Reconciliation is available for business accounts", http.StatusConflict)
+		return
+	}
+
+	data, err := io.ReadAll(io.LimitReader(r.Body, maxReconciliationBytes+1))
+	if err != nil {
+		http.Error(w, "Invalid request body", http.StatusBadRequest)
+		return
+	}
+	if len(data) > maxReconciliationBytes {
+		http.Error(w, "Extracts are limited to 5 MB", http.StatusRequestEntityTooLarge)
+		return
+	}
+	items, err := parseLedgerExtract(data)
+	if err != nil {
+		http.Error(w, "Invalid extract", http.StatusBadRequest)
+		return
+	}
+	from, to := items[0].Date, items[0].Date
+	for _, item := range items {
+		if item.Date < from {
+			from = item.Date
+		}
+		if item.Date > to {
+			to = item.Date
+		}
+	}
+	start, _ := time.Parse("2006-01-02", from)
+	end, _ := time.Parse("2006-01-02", to)
+	if end.Sub(start) > maxReconciliationPeriodDays*24*time.Hour {
+		http.Error(w, fmt.Sprintf("An extract may span at most %d days", maxReconciliationPeriodDays), http.StatusBadRequest)
+		return
+	}
+
+	job := ReconciliationJob{AccountID: accountID, Status: "pending", ItemCount: len(items), PeriodFrom: from,
+		PeriodTo: to, DateToleranceDays: tolerance, RequestedBy: requestActor(r)}
+	job.extractKey = fmt.Sprintf("reconciliations/%d/%d.csv", accountID, time.Now().UnixNano())
+	if err := objectStore.Put(r.Context(), job.extractKey, data); err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	err = db.QueryRowContext(r.Context(), `INSERT INTO reconciliation_jobs (account_id, extract_key, item_count,
+										   period_from, period_to, date_tolerance_days, requested_by)
+										   VALUES ($1, $2, $3, $4, $5, $6, $7) RETURNING id, created_at`,
+		job.AccountID, job.extractKey, job.ItemCount, job.PeriodFrom, job.PeriodTo, job.DateToleranceDays,
+		job.RequestedBy).Scan(&job.ID, &job.CreatedAt)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	// The worker also polls for pending jobs, so a full queue only delays it
+	select {
+	case reconciliationQueue <- job.ID:
+	default:
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Location", fmt.Sprintf("/v1/accounts/%d/reconciliations/%d", accountID, job.ID))
+	w.WriteHeader(http.StatusAccepted)
+	json.NewEncoder(w).Encode(job)
+}
+
+// listReconciliations lists an account's reconciliations without their reports
+func listReconciliations(w http.ResponseWriter, r *http.Request) {
+	if !requireAccountReader(w, r) {
+		return
+	}
+	rows, err := db.QueryContext(r.Context(), `SELECT `+reconciliationColumns+`, NULL FROM reconciliation_jobs
+											   WHERE account_id = $1 ORDER BY created_at DESC LIMIT 100`, mux.Vars(r)["id"])
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	defer rows.Close()
+
+	jobs := []ReconciliationJob{}
+	for rows.Next() {
+		job, err := scanReconciliation(rows)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		jobs = append(jobs, job)
+	}
+	if err := rows.Err(); err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(jobs)
+}
+
+// getReconciliation returns a reconciliation's status and, once completed,
+// its report
+func getReconciliation(w http.ResponseWriter, r *http.Request) {
+	if !requireAccountReader(w, r) {
+		return
+	}
+	params := mux.Vars(r)
+	job, err := scanReconciliation(db.QueryRowContext(r.Context(), `SELECT `+reconciliationColumns+`, report
+																   FROM reconciliation_jobs WHERE id = $1 AND account_id = $2`,
+		params["reconciliationId"], params["id"]))
+	if err == sql.ErrNoRows {
+		http.Error(w, "Reconciliation not found", http.StatusNotFound)
+		return
+	}
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(job)
+}
+
+const reconciliationColumns = `id, account_id, status, error, item_count, period_from::text, period_to::text,
+	date_tolerance_days, requested_by, created_at, COALESCE(completed_at::text, '')`
+
+// scanReconciliation reads reconciliationColumns followed by the report
+func scanReconciliation(row interface{ Scan(...interface{}) error }) (ReconciliationJob, error) {
+	var job ReconciliationJob
+	var report []byte
+	err := row.Scan(&job.ID, &job.AccountID, &job.Status, &job.Error, &job.ItemCount, &job.PeriodFrom, &job.PeriodTo,
+		&job.DateToleranceDays, &job.RequestedBy, &job.CreatedAt, &job.CompletedAt, &report)
+	if err == nil && report != nil {
+		job.Report = &ReconciliationReport{}
+		err = json.Unmarshal(report, job.Report)
+	}
+	return job, err
+}
+
+// startReconciliationWorker reconciles queued extracts, polling for pending
+// jobs left behind by restarts or other replicas
+func startReconciliationWorker() {
+	go func() {
+		defer servicekit.ReportJobPanic("Reconciliation worker")
+		ticker := time.NewTicker(30 * time.Second)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-reconciliationQueue:
+			case <-ticker.C:
+			}
+			for processNextReconciliation(serviceContext) {
+			}
+		}
+	}()
+}
+
+// processNextReconciliation claims one pending job and runs it. It reports
+// whether a job was found so the caller can drain the backlog.
+func processNextReconciliation(ctx context.Context) bool {
+	var job ReconciliationJob
+	err := db.QueryRowContext(ctx, `UPDATE reconciliation_jobs SET status = 'running'
+								   WHERE id = (SELECT id FROM reconciliation_jobs WHERE status = 'pending'
+											   ORDER BY id LIMIT 1 FOR UPDATE SKIP LOCKED)
+								   RETURNING id, account_id, extract_key, period_from::text, period_to::text,
+								   date_tolerance_days`).Scan(&job.ID, &job.AccountID, &job.extractKey, &job.PeriodFrom,
+		&job.PeriodTo, &job.DateToleranceDays)
+	if err != nil {
+		if err != sql.ErrNoRows {
+			servicekit.RequestLogger(ctx).Error("failed to claim reconciliation job", zap.Error(err))
+		}
+		return false
+	}
+
+	var report []byte
+	data, err := objectStore.Get(ctx, job.extractKey)
+	if err == nil {
+		var r ReconciliationReport
+		r, err = reconcileExtract(ctx, job, data)
+		if err == nil {
+			report, err = json.Marshal(r)
+		}
+	}
+	if err != nil {
+		// The cause stays in the log; whoever polls the job only learns it failed
+		servicekit.RequestLogger(ctx).Error("reconciliation job failed", zap.Int("reconciliation_id", job.ID), zap.Error(err))
+		db.ExecContext(ctx, `UPDATE reconciliation_jobs SET status = 'failed', error = $1, completed_at = NOW()
+							 WHERE id = $2`, "The report could not be generated", job.ID)
+		return true
+	}
+
+	_, err = db.ExecContext(ctx, `UPDATE reconciliation_jobs SET status = 'completed', report = $1, completed_at = NOW()
+								  WHERE id = $2`, report, job.ID)
+	if err != nil {
+		servicekit.RequestLogger(ctx).Error("failed to complete reconciliation job", zap.Int("reconciliation_id", job.ID), zap.Error(err))
+	}
+	return true
+}
+
+// reconcileExtract matches the job's extract against the account's
+// transactions from the period, widened by the date tolerance
+func reconcileExtract(ctx context.Context, job ReconciliationJob, extract []byte) (ReconciliationReport, error) {
+	items, err := parseLedgerExtract(extract)
+	if err != nil {
+		return ReconciliationReport{}, err
+	}
+	start, _ := time.Parse("2006-01-02", job.PeriodFrom)
+	end, _ := time.Parse("2006-01-02", job.PeriodTo)
+	transactions, err := fetchBankTransactions(ctx, job.AccountID, start.AddDate(0, 0, -job.DateToleranceDays),
+		end.AddDate(0, 0, job.DateToleranceDays))
+	if err != nil {
+		return ReconciliationReport{}, err
+	}
+	return matchLedgerExtract(items, transactions, job.PeriodFrom, job.PeriodTo, job.DateToleranceDays), nil
+}
+
+// fetchBankTransactions pages through the transaction service for the
+// account's transactions posted from from to to, both inclusive
+func fetchBankTransactions(ctx context.Context, accountID int, from, to time.Time) ([]BankTransaction, error) {
+	req, _ := http.NewRequestWithContext(ctx, http.MethodGet, "/", nil)
+	base := getEnv("TRANSACTION_SERVICE_URL", "http://localhost:8081")
+	var all []BankTransaction
+	for offset := 0; ; offset += 500 {
+		var page []struct {
+			ID          int    `json:"id"`
+			Amount      Money  `json:"amount"`
+			Reference   string `json:"reference"`
+			Description string `json:"description"`
+			CreatedAt   string `json:"created_at"`
+		}
+		url := fmt.Sprintf("%s/v1/accounts/%d/transactions?from=%s&to=%s&limit=500&offset=%d", base, accountID,
+			from.Format("2006-01-02"), to.Format("2006-01-02"), offset)
+		if err := fetchJSON(req, url, &page); err != nil {
+			return nil, err
+		}
+		for _, t := range page {
+			if len(t.CreatedAt) < 10 {
+				return nil, fmt.Errorf("transaction %d has no posting date", t.ID)
+			}
+			all = append(all, BankTransaction{ID: t.ID, Date: t.CreatedAt[:10], Amount: t.Amount,
+				Reference: t.Reference, Description: t.Description})
+		}
+		if len(page) < 500 {
+			return all, nil
+		}
+	}
+}
+
+// matchLedgerExtract pairs extract entries with transactions and reports
+// what is left on either side
+func matchLedgerExtract(items []ReconciliationItem, transactions []BankTransaction, from, to string,
+	tolerance int) ReconciliationReport {
+	sort.SliceStable(items, func(i, j int) bool { return items[i].Date < items[j].Date })
+	sort.SliceStable(transactions, func(i, j int) bool {
+		if transactions[i].Date != transactions[j].Date {
+			return transactions[i].Date < transactions[j].Date
+		}
+		return transactions[i].ID < transactions[j].ID
+	})
+	byAmount := map[Money][]int{}
+	for i, t := range transactions {
+		byAmount[t.Amount] = append(byAmount[t.Amount], i)
+	}
+
+	report := ReconciliationReport{Matched: []ReconciliationMatch{}, UnmatchedExtract: []ReconciliationItem{},
+		UnmatchedBank: []BankTransaction{}}
+	taken := make([]bool, len(transactions))
+	matched := make([]bool, len(items))
+	match := func(i int, byReference bool) {
+		best, bestDays := -1, tolerance+1
+		for _, j := range byAmount[items[i].Amount] {
+			if taken[j] || (byReference && !referenceMatches(items[i].Reference, transactions[j])) {
+				continue
+			}
+			if days := daysBetween(items[i].Date, transactions[j].Date); days < bestDays {
+				best, bestDays = j, days
+			}
+		}
+		if best < 0 {
+			return
+		}
+		taken[best], matched[i] = true, true
+		by := "amount_date"
+		if byReference {
+			by = "reference"
+		}
+		report.Matched = append(report.Matched, ReconciliationMatch{Item: items[i], Transaction: transactions[best],
+			MatchedBy: by, DaysApart: bestDays})
+	}
+	for i := range items {
+		if items[i].Reference != "" {
+			match(i, true)
+		}
+	}
+	for i := range items {
+		if !matched[i] {
+			match(i, false)
+		}
+	}
+	sort.Slice(report.Matched, func(i, j int) bool { return report.Matched[i].Item.Line < report.Matched[j].Item.Line })
+
+	s := &report.Summary
+	s.ExtractItems, s.Matched = len(items), len(report.Matched)
+	for i, item := range items {
+		s.ExtractTotal += item.Amount
+		if !matched[i] {
+			report.UnmatchedExtract = append(report.UnmatchedExtract, item)
+		}
+	}
+	for j, t := range transactions {
+		inPeriod := t.Date >= from && t.Date <= to
+		if inPeriod {
+			s.BankTransactions++
+			s.BankTotal += t.Amount
+		}
+		if inPeriod && !taken[j] {
+			report.UnmatchedBank = append(report.UnmatchedBank, t)
+		}
+	}
+	s.UnmatchedExtract, s.UnmatchedBank = len(report.UnmatchedExtract), len(report.UnmatchedBank)
+	s.Difference = s.ExtractTotal - s.BankTotal
+	return report
+}
+
+// referenceMatches reports whether the transaction carries the entry's
+// reference, as its reference or in its description
+func referenceMatches(reference string, t BankTransaction) bool {
+	reference = strings.ToLower(reference)
+	return strings.EqualFold(t.Reference, reference) ||
+		(len(reference) >= 4 && strings.Contains(strings.ToLower(t.Description), reference))
+}
+
+func daysBetween(a, b string) int {
+	x, _ := time.Parse("2006-01-02", a)
+	y, _ := time.Parse("2006-01-02", b)
+	days := int(x.Sub(y).Hours() / 24)
+	if days < 0 {
+		days = -days
+	}
+	return days
+}
@@ -0,0 +1,269 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"math"
+	"net/http"
+	"sort"
+	"strings"
+	"time"
+
+	"bank/servicekit"
+
+	"github.com/gorilla/mux"
+	"go.uber.org/zap"
+)
+
+// RecurringCharge is a merchant detected as charging the account on a schedule
+type RecurringCharge struct {
+	Merchant      string `json:"merchant"`
+	Frequency     string `json:"frequency"` // weekly, monthly or yearly
+	AverageAmount Money  `json:"average_amount"`
+	ChargeCount   int    `json:"charge_count"`
+	LastChargedAt string `json:"last_charged_at"`
+	NextExpected  string `json:"next_expected_at"`
+	AlertEnabled  bool   `json:"alert_enabled"`
+	Blocked       bool   `json:"blocked"`
+}
+
+const recurringTablesSQL = `
+	CREATE TABLE IF NOT EXISTS recurring_charge_preferences (
+		account_id INTEGER NOT NULL REFERENCES accounts(id),
+		merchant VARCHAR(100) NOT NULL,
+		alert_enabled BOOLEAN NOT NULL DEFAULT FALSE,
+		updated_at TIMESTAMP NOT NULL DEFAULT NOW(),
+		PRIMARY KEY (account_id, merchant)
+	);`
+
+// recurringFrequencies maps a frequency to its expected interval in days and
+// the tolerance allowed around it
+var recurringFrequencies = []struct {
+	Name      string
+	Days      float64
+	Tolerance float64
+	MinCount  int
+}{
+	{"weekly", 7, 1.5, 3},
+	{"monthly", 30.4, 4, 3},
+	{"yearly", 365, 15, 2},
+}
+
+type merchantCharge struct {
+	Amount Money
+	At     time.Time
+}
+
+// detectRecurringCharges groups approved card charges of the last 13 months by
+// merchant and keeps those with regular intervals and stable amounts
+func detectRecurringCharges(ctx context.Context, accountID string) ([]RecurringCharge, error) {
+	rows, err := db.QueryContext(ctx, `SELECT COALESCE(NULLIF(merchant_name, ''), merchant_id), amount, created_at
+									   FROM authorization_log
+									   WHERE account_id = $1 AND approved AND channel = 'card'
+									   AND created_at > NOW() - INTERVAL '13 months'
+									   AND (merchant_name <> '' OR merchant_id <> '')
+									   ORDER BY created_at`, accountID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	charges := map[string][]merchantCharge{}
+	for rows.Next() {
+		var merchant string
+		var c merchantCharge
+		if err := rows.Scan(&merchant, &c.Amount, &c.At); err != nil {
+			return nil, err
+		}
+		merchant = strings.ToLower(merchant)
+		charges[merchant] = append(charges[merchant], c)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+
+	result := []RecurringCharge{}
+	for merchant, list := range charges {
+		if rc, ok := classifyRecurring(merchant, list); ok {
+			result = append(result, rc)
+		}
+	}
+	sort.Slice(result, func(i, j int) bool { return result[i].Merchant < result[j].Merchant })
+	return result, nil
+}
+
+func classifyRecurring(merchant string, list []merchantCharge) (RecurringCharge, bool) {
+	if len(list) < 2 {
+		return RecurringCharge{}, false
+	}
+
+	var total Money
+	for _, c := range list {
+		total += c.Amount
+	}
+	// In cents, unrounded
+	average := float64(total) / float64(len(list))
+
+	// Subscriptions charge (almost) the same amount each time
+	for _, c := range list {
+		if math.Abs(float64(c.Amount)-average) > average*0.2 {
+			return RecurringCharge{}, false
+		}
+	}
+
+	var intervals []float64
+	for i := 1; i < len(list); i++ {
+		intervals = append(intervals, list[i].At.Sub(list[i-1].At).Hours()/24)
+	}
+	sort.Float64s(intervals)
+	median := intervals[len(intervals)/2]
+
+	for _, f := range recurringFrequencies {
+		if len(list) < f.MinCount || math.Abs(median-f.Days) > f.Tolerance {
+			continue
+		}
+		last := list[len(list)-1].At
+		return RecurringCharge{
+			Merchant:      merchant,
+			Frequency:     f.Name,
+			AverageAmount: Money(math.Round(average)),
+			ChargeCount:   len(list),
+			LastChargedAt: last.Format(time.RFC3339),
+			NextExpected:  last.Add(time.Duration(f.Days*24) * time.Hour).Format(time.RFC3339),
+		}, true
+	}
+	return RecurringCharge{}, false
+}
+
+func listRecurringCharges(w http.ResponseWriter, r *http.Request) {
+	params := mux.Vars(r)
+	id := params["id"]
+
+	charges, err := detectRecurringCharges(r.Context(), id)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	alerts := map[string]bool{}
+	rows, err := db.QueryContext(r.Context(), `SELECT merchant FROM recurring_charge_preferences
+						   WHERE account_id = $1 AND alert_enabled`, id)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	for rows.Next() {
+		var merchant string
+		rows.Scan(&merchant)
+		alerts[merchant] = true
+	}
+	rows.Close()
+
+	blocked := map[string]bool{}
+	rows, err = db.QueryContext(r.Context(), `SELECT LOWER(value) FROM spending_blocks
+						  WHERE account_id = $1 AND block_type = 'merchant' AND `+activeBlockCondition, id)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	for rows.Next() {
+		var merchant string
+		rows.Scan(&merchant)
+		blocked[merchant] = true
+	}
+	rows.Close()
+
+	for i := range charges {
+		charges[i].AlertEnabled = alerts[charges[i].Merchant]
+		charges[i].Blocked = blocked[charges[i].Merchant]
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(charges)
+}
+
+// setRecurringChargeAlert toggles a notification on every charge from the merchant
+func setRecurringChargeAlert(w http.ResponseWriter, r *http.Request) {
+	params := mux.Vars(r)
+
+	var requestBody struct {
+		Enabled bool `json:"enabled"`
+	}
+	err := json.NewDecoder(r.Body).Decode(&requestBody)
+	if err != nil {
+		http.Error(w, "Invalid request body", http.StatusBadRequest)
+		return
+	}
+
+	merchant := strings.ToLower(params["merchant"])
+	_, err = db.ExecContext(r.Context(), `INSERT INTO recurring_charge_preferences (account_id, merchant, alert_enabled)
+					  VALUES ($1, $2, $3)
+					  ON CONFLICT (account_id, merchant) DO UPDATE SET alert_enabled = EXCLUDED.alert_enabled, updated_at = NOW()`,
+		params["id"], merchant, requestBody.Enabled)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"merchant":      merchant,
+		"alert_enabled": requestBody.Enabled,
+	})
+}
+
+// blockRecurringCharge places a card-level merchant block for the recurring merchant
+func blockRecurringCharge(w http.ResponseWriter, r *http.Request) {
+	params := mux.Vars(r)
+	merchant := strings.ToLower(params["merchant"])
+
+	var block SpendingBlock
+	err := db.QueryRowContext(r.Context(), `INSERT INTO spending_blocks (account_id, block_type, value)
+						SELECT id, 'merchant', $2 FROM accounts WHERE id = $1
+						RETURNING id, account_id, block_type, value, created_at`, params["id"], merchant).Scan(&block.ID,
+		&block.AccountID, &block.BlockType, &block.Value, &block.CreatedAt)
+	if err != nil {
+		if err == sql.ErrNoRows {
+			http.Error(w, "Account not found", http.StatusNotFound)
+		} else {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+		}
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusCreated)
+	json.NewEncoder(w).Encode(block)
+}
+
+// notifyRecurringCharge alerts the customer when a merchant they watch charges the account
+func notifyRecurringCharge(ctx context.Context, req *AuthorizationRequest) {
+	merchant := strings.ToLower(req.MerchantName)
+	if merchant == "" {
+		merchant = strings.ToLower(req.MerchantID)
+	}
+
+	var customerID int
+	err := db.QueryRowContext(ctx, `SELECT a.customer_id FROM recurring_charge_preferences p
+									JOIN accounts a ON a.id = p.account_id
+									WHERE p.account_id = $1 AND p.merchant = $2 AND p.alert_enabled`,
+		req.AccountID, merchant).Scan(&customerID)
+	if err != nil {
+		return
+	}
+
+	err = sendNotification(ctx, Notification{
+		CustomerID: customerID,
+		Channel:    "push",
+		Template:   "recurring_charge",
+		Data: map[string]interface{}{
+			"account_id": req.AccountID,
+			"merchant":   req.MerchantName,
+			"amount":     req.Amount,
+		},
+	})
+	if err != nil {
+		servicekit.RequestLogger(ctx).Error("failed to send recurring charge alert", zap.Error(err))
+	}
+}
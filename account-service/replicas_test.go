@@ -0,0 +1,72 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+// This test runs two replicas side by side against the same Postgres
+// (TEST_DATABASE_URL), as in docker-compose, and is skipped without it. Each
+// replica has its own connection pool; db is pointed at one at a time.
+
+// TestReplicasShareIdempotencyKeys checks a retry reaching another replica is
+// answered with the first response instead of moving money twice
+func TestReplicasShareIdempotencyKeys(t *testing.T) {
+	dsn := getEnv("TEST_DATABASE_URL", "")
+	if dsn == "" {
+		t.Skip("TEST_DATABASE_URL is not set")
+	}
+	replicas := make([]*sql.DB, 2)
+	for i := range replicas {
+		conn, err := sql.Open("postgres", dsn)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := conn.Ping(); err != nil {
+			t.Fatal(err)
+		}
+		defer conn.Close()
+		replicas[i] = conn
+	}
+	previous := db
+	defer func() { db = previous }()
+	if _, err := replicas[0].ExecContext(context.Background(), idempotencyTablesSQL); err != nil {
+		t.Fatal(err)
+	}
+
+	runs := 0
+	handler := idempotent(func(w http.ResponseWriter, r *http.Request) {
+		runs++
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusCreated)
+		fmt.Fprintf(w, `{"run": %d}`, runs)
+	})
+	key := fmt.Sprintf("test-replicas-%d", time.Now().UnixNano())
+	send := func(replica *sql.DB, body string) *httptest.ResponseRecorder {
+		db = replica
+		r := httptest.NewRequest("POST", "/v1/accounts/transfer", strings.NewReader(body))
+		r.Header.Set("X-User-ID", "7")
+		r.Header.Set("Idempotency-Key", key)
+		w := httptest.NewRecorder()
+		handler(w, r)
+		return w
+	}
+
+	first := send(replicas[0], `{"amount": 100}`)
+	retry := send(replicas[1], `{"amount": 100}`)
+	if first.Code != http.StatusCreated || retry.Code != http.StatusCreated {
+		t.Fatalf("statuses %d and %d, want 201 twice", first.Code, retry.Code)
+	}
+	if runs != 1 || retry.Header().Get("Idempotent-Replayed") != "true" || retry.Body.String() != first.Body.String() {
+		t.Fatalf("retry on the other replica ran the request again: %d runs, response %s", runs, retry.Body)
+	}
+	if reused := send(replicas[1], `{"amount": 500}`); reused.Code != http.StatusUnprocessableEntity {
+		t.Fatalf("key reused for another request on the other replica: status %d, want 422", reused.Code)
+	}
+}
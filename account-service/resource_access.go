@@ -0,0 +1,147 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"strconv"
+	"strings"
+
+	"github.com/gorilla/mux"
+	"github.com/lib/pq"
+)
+
+// Customers and agents, the roles outside the bank, may only reach what they
+// own; the staff roles are limited by the roles each handler requires
+// instead. authMiddleware checks the resource a route names in its path,
+// handlers the accounts a request names in its body (requireOwnAccount).
+
+// ownerScopedRoles reach only the resources of the user they sign in as
+var ownerScopedRoles = []string{"customer", agentRole}
+
+// ownerScoped reports whether role is limited to the resources it owns
+func ownerScoped(role string) bool {
+	for _, scoped := range ownerScopedRoles {
+		if role == scoped {
+			return true
+		}
+	}
+	return false
+}
+
+// ownedResource tells how to find whether a customer owns a resource of one
+// collection
+type ownedResource struct {
+	name string // in the 404 for resources the customer does not own
+	// query returns whether customer $2 owns resource $1. Empty means the
+	// path names the customer itself.
+	query string
+}
+
+// ownedResources are keyed by the first path segment of the routes. The
+// resource is the first path variable, e.g. {id} in /accounts/{id}/balance.
+// Customers cannot reach routes naming a resource of another collection.
+var ownedResources = map[string]ownedResource{
+	"accounts":  {"Account", `SELECT EXISTS (SELECT 1 FROM accounts WHERE id = $1 AND customer_id = $2)`},
+	"prepaid":   {"Account", `SELECT EXISTS (SELECT 1 FROM accounts WHERE id = $1 AND customer_id = $2)`},
+	"customers": {"Customer", ""},
+	"transfers": {"Transfer", `SELECT EXISTS (SELECT 1 FROM transfers t JOIN accounts a ON a.id IN (t.from_account_id, t.to_account_id)
+											  WHERE t.reference = $1 AND a.customer_id = $2)`},
+	"exports": {"Export", `SELECT EXISTS (SELECT 1 FROM export_jobs e JOIN accounts a ON a.id = e.account_id
+										  WHERE e.id = $1 AND a.customer_id = $2)`},
+	"liens": {"Lien", `SELECT EXISTS (SELECT 1 FROM liens l JOIN accounts a ON a.id = l.account_id
+									  WHERE l.id = $1 AND a.customer_id = $2)`},
+	"delinquencies": {"Delinquency", `SELECT EXISTS (SELECT 1 FROM delinquencies d JOIN accounts a ON a.id = d.account_id
+													 WHERE d.id = $1 AND a.customer_id = $2)`},
+	"virtual-accounts": {"Virtual account", `SELECT EXISTS (SELECT 1 FROM virtual_accounts v JOIN accounts a ON a.id = v.master_account_id
+															WHERE v.id = $1 AND a.customer_id = $2)`},
+	"incoming-payments": {"Incoming payment", `SELECT EXISTS (SELECT 1 FROM incoming_payments p JOIN accounts a ON a.id = p.master_account_id
+															  WHERE p.id = $1 AND a.customer_id = $2)`},
+	"matching-rules": {"Matching rule", `SELECT EXISTS (SELECT 1 FROM matching_rules m JOIN accounts a ON a.id = m.master_account_id
+														WHERE m.id = $1 AND a.customer_id = $2)`},
+	"escrows": {"Escrow", `SELECT EXISTS (SELECT 1 FROM escrows e JOIN accounts a ON a.id IN (e.payer_account_id, e.beneficiary_account_id)
+										  WHERE e.id = $1 AND a.customer_id = $2)`},
+	"payment-requests": {"Payment request", `SELECT EXISTS (SELECT 1 FROM payment_requests p
+															JOIN accounts a ON a.id IN (p.requester_account_id, p.payer_account_id)
+															WHERE p.id = $1 AND a.customer_id = $2)`},
+	"groups": {"Group", `SELECT EXISTS (SELECT 1 FROM expense_group_members m JOIN accounts a ON a.id = m.account_id
+										WHERE m.group_id = $1 AND a.customer_id = $2)`},
+	"ownership-transfers": {"Ownership transfer", `SELECT EXISTS (SELECT 1 FROM ownership_transfers
+																  WHERE id = $1 AND $2 IN (from_customer_id, to_customer_id))`},
+	"signature-envelopes": {"Signature envelope", `SELECT EXISTS (SELECT 1 FROM signature_envelopes WHERE id = $1 AND customer_id = $2)`},
+}
+
+// routeResource returns the collection and the value of the resource the
+// route template names, such as "accounts" and the {id} of
+// /v1/accounts/{id}/balance, or false when it names none
+func routeResource(r *http.Request, template string) (string, string, bool) {
+	for _, prefix := range []string{"/v1", "/v2"} {
+		template = strings.TrimPrefix(template, prefix)
+	}
+	segments := strings.Split(strings.Trim(template, "/"), "/")
+	for _, segment := range segments[1:] {
+		if strings.HasPrefix(segment, "{") && strings.HasSuffix(segment, "}") {
+			name := strings.SplitN(strings.Trim(segment, "{}"), ":", 2)[0]
+			return segments[0], mux.Vars(r)[name], true
+		}
+	}
+	return "", "", false
+}
+
+// requireResourceOwner writes an error and returns false when customer
+// customerID may not reach the resource the route names. Resources of other
+// customers are indistinguishable from missing ones.
+func requireResourceOwner(w http.ResponseWriter, r *http.Request, template string, customerID int) bool {
+	collection, id, ok := routeResource(r, template)
+	if !ok {
+		return true
+	}
+	resource, ok := ownedResources[collection]
+	if !ok {
+		http.Error(w, "Insufficient permissions", http.StatusForbidden)
+		return false
+	}
+	owned := id == strconv.Itoa(customerID)
+	if resource.query != "" {
+		err := db.QueryRowContext(r.Context(), resource.query, id, customerID).Scan(&owned)
+		// An ID the column cannot hold names no resource
+		if _, invalid := constraintViolation(err); invalid {
+			owned, err = false, nil
+		}
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return false
+		}
+	}
+	if !owned {
+		http.Error(w, resource.name+" not found", http.StatusNotFound)
+		return false
+	}
+	return true
+}
+
+// ownsAccount returns whether customerID owns one of accountIDs
+func ownsAccount(ctx context.Context, customerID int, accountIDs ...int) (bool, error) {
+	var owned bool
+	err := db.QueryRowContext(ctx, `SELECT EXISTS (SELECT 1 FROM accounts WHERE id = ANY($1) AND customer_id = $2)`,
+		pq.Array(accountIDs), customerID).Scan(&owned)
+	return owned, err
+}
+
+// requireOwnAccount writes a 404 and returns false when the caller is a
+// customer or agent owning none of accountIDs, the accounts a request acts for
+func requireOwnAccount(w http.ResponseWriter, r *http.Request, accountIDs ...int) bool {
+	if !ownerScoped(requestRole(r)) {
+		return true
+	}
+	customerID, _ := strconv.Atoi(r.Header.Get("X-User-ID"))
+	owned, err := ownsAccount(r.Context(), customerID, accountIDs...)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return false
+	}
+	if !owned {
+		http.Error(w, "Account not found", http.StatusNotFound)
+		return false
+	}
+	return true
+}
@@ -0,0 +1,226 @@
+package main
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"regexp"
+	"strings"
+	"testing"
+	"time"
+
+	"bank/servicekit"
+
+	"github.com/gorilla/mux"
+)
+
+const testGatewayKey = "test-gateway-identity-key"
+
+// signedRequest returns a request carrying a gateway identity for userID in role
+func signedRequest(t *testing.T, method, path, body string, userID int, role string) *http.Request {
+	t.Helper()
+	return privilegedRequest(t, method, path, body, userID, role, nil)
+}
+
+// privilegedRequest is signedRequest for a caller holding privileges, by
+// name to Unix expiry
+func privilegedRequest(t *testing.T, method, path, body string, userID int, role string,
+	privileges map[string]int64) *http.Request {
+	t.Helper()
+	r := httptest.NewRequest(method, path, strings.NewReader(body))
+	payload, err := json.Marshal(GatewayIdentityClaims{
+		Issuer:     "api-gateway",
+		Audience:   serviceName,
+		UserID:     userID,
+		Username:   role,
+		Role:       role,
+		Method:     method,
+		Path:       r.URL.Path,
+		Expires:    time.Now().Add(time.Minute).Unix(),
+		Privileges: privileges,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	encoded := base64.RawURLEncoding.EncodeToString(payload)
+	mac := hmac.New(sha256.New, []byte(testGatewayKey))
+	mac.Write([]byte(encoded))
+	r.Header.Set(gatewayIdentityHeader, encoded+"."+base64.RawURLEncoding.EncodeToString(mac.Sum(nil)))
+	return r
+}
+
+// apiRouter returns the versioned API routes behind authMiddleware
+func apiRouter() *mux.Router {
+	router := mux.NewRouter()
+	router.Use(authMiddleware("session"))
+	servicekit.MountAPIVersions(router,
+		servicekit.APIVersion{Prefix: "/v1", Register: registerV1Routes},
+		servicekit.APIVersion{Prefix: "/v2", Register: registerV2Routes})
+	return router
+}
+
+var pathVariable = regexp.MustCompile(`\{[^}]+\}`)
+
+// TestResourceOwnershipByRoute walks every route naming a resource in its path
+// and checks that customers and agents reach their own resources only, while
+// staff are left to the roles each handler requires
+func TestResourceOwnershipByRoute(t *testing.T) {
+	t.Setenv("GATEWAY_IDENTITY_KEY", testGatewayKey)
+	useOwnershipDB()
+
+	routes := 0
+	err := apiRouter().Walk(func(route *mux.Route, _ *mux.Router, _ []*mux.Route) error {
+		template, err := route.GetPathTemplate()
+		if err != nil || !pathVariable.MatchString(template) || publicRoute(template) {
+			return nil
+		}
+		methods, err := route.GetMethods()
+		if err != nil {
+			return nil
+		}
+		collection := strings.Split(strings.Trim(strings.TrimPrefix(strings.TrimPrefix(template, "/v1"), "/v2"), "/"), "/")[0]
+		resource, known := ownedResources[collection]
+		own, other := "70", "80"
+		if known && resource.query == "" {
+			own, other = "7", "8"
+		}
+
+		// Only the access checks are under test, so the route answers 200 once
+		// past authMiddleware
+		single := mux.NewRouter()
+		single.Use(authMiddleware("session"))
+		single.HandleFunc(template, func(w http.ResponseWriter, r *http.Request) {}).Methods(methods...)
+
+		for _, method := range methods {
+			routes++
+			cases := []struct {
+				name   string
+				value  string
+				role   string
+				status int
+			}{
+				{"customer, own resource", own, "customer", http.StatusOK},
+				{"customer, another customer's resource", other, "customer", http.StatusNotFound},
+				{"agent, own resource", own, "agent", http.StatusOK},
+				{"agent, another user's resource", other, "agent", http.StatusNotFound},
+				{"teller", other, "teller", http.StatusOK},
+				{"admin", other, "admin", http.StatusOK},
+			}
+			if !known {
+				// Customers cannot reach resources of collections they own none of
+				for i := range cases[:4] {
+					cases[i].status = http.StatusForbidden
+				}
+			}
+			for _, c := range cases {
+				path := pathVariable.ReplaceAllString(template, c.value)
+				w := httptest.NewRecorder()
+				single.ServeHTTP(w, signedRequest(t, method, path, "", ownerID, c.role))
+				if w.Code != c.status {
+					t.Errorf("%s %s (%s): status %d, want %d: %s", method, template, c.name, w.Code, c.status, w.Body)
+				}
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if routes == 0 {
+		t.Fatal("no routes naming a resource")
+	}
+}
+
+// TestAccountRouteAccess covers the checks handlers make beyond the path: the
+// accounts a body names and the roles a route requires
+func TestAccountRouteAccess(t *testing.T) {
+	t.Setenv("GATEWAY_IDENTITY_KEY", testGatewayKey)
+	useOwnershipDB()
+	router := apiRouter()
+
+	cases := []struct {
+		name   string
+		method string
+		path   string
+		body   string
+		role   string
+		status int
+	}{
+		{"read another customer's account", "GET", "/v1/accounts/80", "", "customer", http.StatusNotFound},
+		{"read another customer's account, v2", "GET", "/v2/accounts/80", "", "customer", http.StatusNotFound},
+		{"read another customer's balance", "GET", "/v1/accounts/80/balance", "", "customer", http.StatusNotFound},
+		{"open an account for another customer", "POST", "/v1/accounts", `{"customer_id": 8, "account_type": "savings"}`, "customer", http.StatusForbidden},
+		{"open an account with a balance", "POST", "/v1/accounts", `{"account_type": "savings", "balance": 1000}`, "customer", http.StatusBadRequest},
+		{"open an account as an auditor", "POST", "/v1/accounts", `{"customer_id": 8, "account_type": "savings"}`, "auditor", http.StatusForbidden},
+		{"update own account", "PUT", "/v1/accounts/70", `{"status": "closed"}`, "customer", http.StatusForbidden},
+		{"update another customer's account", "PUT", "/v1/accounts/80", `{"status": "closed"}`, "customer", http.StatusNotFound},
+		{"deposit to own account", "POST", "/v1/accounts/70/deposit", `{"amount": 100}`, "customer", http.StatusForbidden},
+		{"deposit to another customer's account", "POST", "/v1/accounts/80/deposit", `{"amount": 100}`, "customer", http.StatusNotFound},
+		{"withdraw from another customer's account", "POST", "/v1/accounts/80/withdraw", `{"amount": 100}`, "customer", http.StatusNotFound},
+		{"transfer from another customer's account", "POST", "/v1/accounts/transfer",
+			`{"from_account_id": 80, "to_account_id": 70, "amount": 100, "currency_code": "USD"}`, "customer", http.StatusNotFound},
+		{"read another customer's transfer", "GET", "/v1/transfers/TRF-80", "", "customer", http.StatusNotFound},
+		{"read another customer's profile", "GET", "/v1/customers/8/net-worth", "", "customer", http.StatusNotFound},
+		{"withdraw as an agent", "POST", "/v1/accounts/80/withdraw", `{"amount": 100}`, "agent", http.StatusNotFound},
+		{"withdraw from an agent's own account", "POST", "/v1/accounts/70/withdraw", `{"amount": 100}`, "agent", http.StatusForbidden},
+		{"withdraw as an auditor", "POST", "/v1/accounts/80/withdraw", `{"amount": 100}`, "auditor", http.StatusForbidden},
+		{"withdraw as a fraud analyst", "POST", "/v1/accounts/80/withdraw", `{"amount": 100}`, "fraud_analyst", http.StatusForbidden},
+		{"transfer as an agent", "POST", "/v1/accounts/transfer",
+			`{"from_account_id": 80, "to_account_id": 70, "amount": 100, "currency_code": "USD"}`, "agent", http.StatusForbidden},
+		{"transfer as compliance", "POST", "/v1/accounts/transfer",
+			`{"from_account_id": 80, "to_account_id": 70, "amount": 100, "currency_code": "USD"}`, "compliance", http.StatusForbidden},
+		{"read another customer's account as an agent", "GET", "/v1/accounts/80", "", "agent", http.StatusNotFound},
+		{"credit an incoming payment to own account", "POST", "/v1/accounts/70/incoming-payments",
+			`{"amount": 1000000, "reference": "INV-1"}`, "customer", http.StatusForbidden},
+		{"credit an incoming payment as a teller", "POST", "/v1/accounts/80/incoming-payments",
+			`{"amount": 1000000, "reference": "INV-1"}`, "teller", http.StatusForbidden},
+		{"set the terms of a loan on own account", "POST", "/v1/accounts/70/loan",
+			`{"principal": 1000000, "term_months": 12}`, "customer", http.StatusForbidden},
+		{"set the terms of a loan as a teller", "POST", "/v1/accounts/80/loan",
+			`{"principal": 1000000, "term_months": 12}`, "teller", http.StatusForbidden},
+		{"set own credit profile", "PUT", "/v1/customers/7/credit-profile", `{"annual_income": 10000000}`, "customer", http.StatusForbidden},
+		{"set a credit profile as a teller", "PUT", "/v1/customers/8/credit-profile", `{"annual_income": 10000000}`, "teller", http.StatusForbidden},
+		{"create a fraud ruleset as a customer", "POST", "/v1/fraud/rulesets", `{"name": "x"}`, "customer", http.StatusForbidden},
+		{"create a fraud ruleset as a teller", "POST", "/v1/fraud/rulesets", `{"name": "x"}`, "teller", http.StatusForbidden},
+		{"list fraud rulesets as a teller", "GET", "/v1/fraud/rulesets", "", "teller", http.StatusForbidden},
+		{"roll out a fraud ruleset as a teller", "POST", "/v1/fraud/rulesets/1/rollout", `{}`, "teller", http.StatusForbidden},
+	}
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			w := httptest.NewRecorder()
+			router.ServeHTTP(w, signedRequest(t, c.method, c.path, c.body, ownerID, c.role))
+			if w.Code != c.status {
+				t.Errorf("%s %s as %s: status %d, want %d: %s", c.method, c.path, c.role, w.Code, c.status, w.Body)
+			}
+		})
+	}
+}
+
+// TestGatewayIdentityBinding checks a gateway identity is only honoured for
+// the request it was signed for
+func TestGatewayIdentityBinding(t *testing.T) {
+	t.Setenv("GATEWAY_IDENTITY_KEY", testGatewayKey)
+	useOwnershipDB()
+	router := apiRouter()
+
+	replayed := signedRequest(t, "GET", "/v1/accounts/70", "", ownerID, "admin")
+	r := httptest.NewRequest("GET", "/v1/accounts/80", nil)
+	r.Header.Set(gatewayIdentityHeader, replayed.Header.Get(gatewayIdentityHeader))
+	w := httptest.NewRecorder()
+	router.ServeHTTP(w, r)
+	if w.Code != http.StatusUnauthorized {
+		t.Errorf("identity replayed on another path: status %d, want 401", w.Code)
+	}
+
+	// Identity headers sent by the client are dropped, not trusted
+	r = signedRequest(t, "GET", "/v1/accounts/80", "", ownerID, "customer")
+	r.Header.Set("X-User-Role", "admin")
+	w = httptest.NewRecorder()
+	router.ServeHTTP(w, r)
+	if w.Code != http.StatusNotFound {
+		t.Errorf("forged X-User-Role: status %d, want 404", w.Code)
+	}
+}
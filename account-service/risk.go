@@ -0,0 +1,178 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strconv"
+	"time"
+
+	"bank/servicekit"
+
+	"go.uber.org/zap"
+)
+
+// RiskFeatures are the inputs sent to the risk model and logged for training
+type RiskFeatures struct {
+	Amount           Money   `json:"amount"`
+	Channel          string  `json:"channel"`
+	MerchantCategory string  `json:"merchant_category"`
+	Country          string  `json:"country"`
+	HourOfDay        int     `json:"hour_of_day"`
+	Count24h         int     `json:"count_24h"`
+	Declines24h      int     `json:"declines_24h"`
+	AverageAmount30d float64 `json:"average_amount_30d"`
+	RuleDeclineCode  string  `json:"rule_decline_code"`
+}
+
+// RiskScore is a model's estimate that a transaction is fraudulent, from 0 to 1
+type RiskScore struct {
+	Score        float64 `json:"score"`
+	ModelVersion string  `json:"model_version"`
+}
+
+// RiskScorer scores transactions. The HTTP scorer calls a model-serving
+// endpoint; an in-process model (e.g. ONNX) can implement the same interface.
+type RiskScorer interface {
+	Score(ctx context.Context, features RiskFeatures) (RiskScore, error)
+}
+
+const riskTablesSQL = `
+	CREATE TABLE IF NOT EXISTS risk_feature_log (
+		id SERIAL PRIMARY KEY,
+		account_id INTEGER NOT NULL,
+		features JSONB NOT NULL,
+		score DECIMAL(6,5),
+		model_version VARCHAR(50) NOT NULL DEFAULT '',
+		mode VARCHAR(10) NOT NULL,
+		approved BOOLEAN NOT NULL,
+		decline_code VARCHAR(50) NOT NULL DEFAULT '',
+		created_at TIMESTAMP NOT NULL DEFAULT NOW()
+	);`
+
+var riskScorer RiskScorer
+
+// riskScoringMode is off, shadow (score and log only) or enforce
+var riskScoringMode = "off"
+
+// httpRiskScorer posts features to a model-serving endpoint that replies with
+// {"score": 0.12, "model_version": "..."}
+type httpRiskScorer struct {
+	url    string
+	client *http.Client
+}
+
+func newRiskScorer() RiskScorer {
+	riskScoringMode = getEnv("RISK_SCORING_MODE", "off")
+	url := getEnv("RISK_MODEL_URL", "")
+	if riskScoringMode == "off" || url == "" {
+		riskScoringMode = "off"
+		return nil
+	}
+
+	timeout, err := time.ParseDuration(getEnv("RISK_MODEL_TIMEOUT", "150ms"))
+	if err != nil {
+		timeout = 150 * time.Millisecond
+	}
+	return &httpRiskScorer{url: url, client: &http.Client{Timeout: timeout}}
+}
+
+func (s *httpRiskScorer) Score(ctx context.Context, features RiskFeatures) (RiskScore, error) {
+	payload, err := json.Marshal(features)
+	if err != nil {
+		return RiskScore{}, err
+	}
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, s.url, bytes.NewReader(payload))
+	if err != nil {
+		return RiskScore{}, err
+	}
+	req.Header.Set("Content-Type", "application/json")
+
+	resp, err := s.client.Do(req)
+	if err != nil {
+		return RiskScore{}, err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return RiskScore{}, fmt.Errorf("risk model returned status %d", resp.StatusCode)
+	}
+
+	var score RiskScore
+	err = json.NewDecoder(resp.Body).Decode(&score)
+	return score, err
+}
+
+func riskThreshold() float64 {
+	threshold, err := strconv.ParseFloat(getEnv("RISK_DECLINE_THRESHOLD", "0.9"), 64)
+	if err != nil {
+		return 0.9
+	}
+	return threshold
+}
+
+// buildRiskFeatures gathers request attributes and recent account behaviour
+func buildRiskFeatures(ctx context.Context, req *AuthorizationRequest, ruleDecision AuthorizationDecision) (RiskFeatures, error) {
+	f := RiskFeatures{
+		Amount:           req.Amount,
+		Channel:          req.Channel,
+		MerchantCategory: req.MerchantCategory,
+		Country:          req.Country,
+		HourOfDay:        time.Now().UTC().Hour(),
+		RuleDeclineCode:  ruleDecision.Code,
+	}
+
+	err := db.QueryRowContext(ctx, `SELECT
+									COUNT(*) FILTER (WHERE created_at > NOW() - INTERVAL '24 hours'),
+									COUNT(*) FILTER (WHERE created_at > NOW() - INTERVAL '24 hours' AND NOT approved),
+									COALESCE(AVG(amount) FILTER (WHERE approved), 0)
+									FROM authorization_log
+									WHERE account_id = $1 AND created_at > NOW() - INTERVAL '30 days'`,
+		req.AccountID).Scan(&f.Count24h, &f.Declines24h, &f.AverageAmount30d)
+	return f, err
+}
+
+// applyRiskScore combines the model score with the rule outcome. Rule declines
+// always stand; in enforce mode a score above the threshold declines as well.
+// Features are logged in every mode so the model can be retrained and shadow
+// models evaluated against real decisions.
+func applyRiskScore(ctx context.Context, req *AuthorizationRequest, decision AuthorizationDecision) AuthorizationDecision {
+	if riskScorer == nil {
+		return decision
+	}
+
+	features, err := buildRiskFeatures(ctx, req, decision)
+	if err != nil {
+		servicekit.RequestLogger(ctx).Error("failed to build risk features", zap.Error(err))
+		return decision
+	}
+
+	score, err := riskScorer.Score(ctx, features)
+	scored := err == nil
+	if err != nil {
+		// The model is advisory; an outage must not stop payments
+		servicekit.RequestLogger(ctx).Warn("risk scoring failed", zap.Error(err))
+	}
+
+	final := decision
+	if scored && decision.Approved && riskScoringMode == "enforce" && score.Score >= riskThreshold() {
+		final = *decline("risk_score", "Transaction declined by risk assessment")
+	}
+
+	featureJSON, _ := json.Marshal(features)
+	var scoreValue interface{}
+	if scored {
+		scoreValue = score.Score
+	}
+	_, err = db.ExecContext(ctx, `INSERT INTO risk_feature_log (account_id, features, score, model_version, mode, approved, decline_code)
+								  VALUES ($1, $2, $3, $4, $5, $6, $7)`,
+		req.AccountID, string(featureJSON), scoreValue, score.ModelVersion, riskScoringMode, final.Approved, final.Code)
+	if err != nil {
+		servicekit.RequestLogger(ctx).Error("failed to log risk features", zap.Error(err))
+	}
+
+	return final
+}
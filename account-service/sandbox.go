@@ -0,0 +1,89 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"io"
+	"net/http"
+	"time"
+
+	"github.com/gorilla/mux"
+)
+
+// sandboxScenario is a deterministic outcome triggered by a magic value
+type sandboxScenario struct {
+	Name    string
+	Status  int
+	Message string
+	Delay   time.Duration
+}
+
+var (
+	sandboxDecline = sandboxScenario{Name: "decline", Status: http.StatusPaymentRequired, Message: "Transaction declined"}
+	sandboxTimeout = sandboxScenario{Name: "timeout", Status: http.StatusGatewayTimeout, Message: "Upstream timeout", Delay: 30 * time.Second}
+	sandboxFraud   = sandboxScenario{Name: "fraud", Status: http.StatusForbidden, Message: "Transaction flagged for fraud review"}
+)
+
+// Magic amounts and account IDs. Any other value behaves normally.
+var sandboxAmounts = map[Money]sandboxScenario{
+	13_13:  sandboxDecline,
+	408_08: sandboxTimeout,
+	666_66: sandboxFraud,
+}
+
+var sandboxAccounts = map[string]sandboxScenario{
+	"999999001": sandboxDecline,
+	"999999002": sandboxTimeout,
+	"999999003": sandboxFraud,
+}
+
+func sandboxEnabled() bool {
+	return getEnv("SANDBOX_MODE", "false") == "true"
+}
+
+// sandboxed wraps a money-movement handler so magic values short-circuit it
+// with the matching scenario. Outside sandbox mode the handler is returned as is.
+func sandboxed(next http.HandlerFunc) http.HandlerFunc {
+	if !sandboxEnabled() {
+		return next
+	}
+
+	timeout := sandboxTimeout.Delay
+	if d, err := time.ParseDuration(getEnv("SANDBOX_TIMEOUT_DELAY", "")); err == nil {
+		timeout = d
+	}
+
+	return func(w http.ResponseWriter, r *http.Request) {
+		body, err := io.ReadAll(r.Body)
+		if err != nil {
+			http.Error(w, "Invalid request body", http.StatusBadRequest)
+			return
+		}
+		r.Body = io.NopCloser(bytes.NewReader(body))
+
+		var requestBody struct {
+			Amount Money `json:"amount"`
+		}
+		json.Unmarshal(body, &requestBody)
+
+		scenario, ok := sandboxAccounts[mux.Vars(r)["id"]]
+		if !ok {
+			scenario, ok = sandboxAmounts[requestBody.Amount]
+		}
+		if !ok {
+			next(w, r)
+			return
+		}
+
+		if scenario.Delay > 0 {
+			select {
+			case <-time.After(timeout):
+			case <-r.Context().Done():
+				return
+			}
+		}
+
+		w.Header().Set("X-Sandbox-Scenario", scenario.Name)
+		http.Error(w, scenario.Message, scenario.Status)
+	}
+}
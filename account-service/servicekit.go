@@ -0,0 +1,25 @@
+package main
+
+import (
+	"database/sql"
+	"embed"
+
+	"bank/servicekit"
+)
+
+// Logging, metrics, SLO tracking, load shedding, error reporting and schema
+// migrations are the same in every service and live in bank/servicekit.
+
+// migrationFiles are the numbered SQL migrations after the baseline
+//
+//go:embed migrations
+var migrationFiles embed.FS
+
+// logger is the service logger. LOG_LEVEL (debug, info, warn or error,
+// default info) sets the minimum level.
+var logger = servicekit.Configure(servicekit.Service{
+	Name:       serviceName,
+	DB:         func() *sql.DB { return db },
+	Context:    serviceContext,
+	Migrations: migrationFiles,
+})
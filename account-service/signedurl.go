@@ -0,0 +1,38 @@
+package main
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"net/http"
+	"strconv"
+	"time"
+)
+
+// signDownloadPath returns path with expires and signature query parameters so
+// it can be shared in emails without requiring a login
+func signDownloadPath(path string, ttl time.Duration) string {
+	expires := strconv.FormatInt(time.Now().Add(ttl).Unix(), 10)
+	return fmt.Sprintf("%s%s?expires=%s&signature=%s",
+		getEnv("PUBLIC_BASE_URL", "http://localhost:8080"), path, expires, downloadSignature(path, expires))
+}
+
+// verifyDownloadSignature checks the signature and expiry of a signed download request
+func verifyDownloadSignature(r *http.Request) bool {
+	expires := r.URL.Query().Get("expires")
+	signature := r.URL.Query().Get("signature")
+
+	unix, err := strconv.ParseInt(expires, 10, 64)
+	if err != nil || time.Now().Unix() > unix {
+		return false
+	}
+	expected := downloadSignature(r.URL.Path, expires)
+	return hmac.Equal([]byte(expected), []byte(signature))
+}
+
+func downloadSignature(path, expires string) string {
+	mac := hmac.New(sha256.New, []byte(getEnv("DOWNLOAD_LINK_SECRET", "change-me-in-production")))
+	mac.Write([]byte(path + "|" + expires))
+	return hex.EncodeToString(mac.Sum(nil))
+}
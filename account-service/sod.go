@@ -0,0 +1,351 @@
+package main
+
+import (
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+
+	"bank/servicekit"
+
+	"github.com/gorilla/mux"
+	"go.uber.org/zap"
+)
+
+// SoDRule is a separation-of-duties rule. A maker_checker rule stops whoever
+// performed the first action on a record from performing the second; a
+// role_conflict rule stops anyone who has acted on an account in one role from
+// acting on the same account in the other.
+type SoDRule struct {
+	ID          int    `json:"id"`
+	Name        string `json:"name"`
+	Kind        string `json:"kind"`   // maker_checker or role_conflict
+	First       string `json:"first"`  // action or role
+	Second      string `json:"second"` // action or role
+	Description string `json:"description"`
+	Enabled     bool   `json:"enabled"`
+	UpdatedBy   string `json:"updated_by"`
+	UpdatedAt   string `json:"updated_at"`
+}
+
+// SoDViolation is an attempt blocked by a rule
+type SoDViolation struct {
+	ID        int    `json:"id"`
+	RuleName  string `json:"rule_name"`
+	Actor     string `json:"actor"`
+	Action    string `json:"action"`
+	Resource  string `json:"resource"`
+	AccountID int    `json:"account_id,omitempty"`
+	CreatedAt string `json:"created_at"`
+}
+
+const sodTablesSQL = `
+	CREATE TABLE IF NOT EXISTS sod_rules (
+		id SERIAL PRIMARY KEY,
+		name VARCHAR(50) NOT NULL UNIQUE,
+		kind VARCHAR(20) NOT NULL,
+		first_duty VARCHAR(50) NOT NULL,
+		second_duty VARCHAR(50) NOT NULL,
+		description TEXT NOT NULL DEFAULT '',
+		enabled BOOLEAN NOT NULL DEFAULT TRUE,
+		updated_by VARCHAR(100) NOT NULL DEFAULT 'system',
+		updated_at TIMESTAMP NOT NULL DEFAULT NOW()
+	);
+	INSERT INTO sod_rules (name, kind, first_duty, second_duty, description) VALUES
+		('payment-maker-checker', 'maker_checker', 'estate_transfer.request', 'estate_transfer.review',
+			'The user who creates a payment cannot approve it'),
+		('credit-limit-maker-checker', 'maker_checker', 'credit_limit.request', 'credit_limit.review',
+			'The user who requests a credit limit change cannot review it'),
+		('income-verification-maker-checker', 'maker_checker', 'income_verification.submit', 'income_verification.review',
+			'The user who submits an income document cannot review it'),
+		('fraud-analyst-teller', 'role_conflict', 'fraud_analyst', 'teller',
+			'Fraud analysts cannot also act as tellers on the same account')
+		ON CONFLICT (name) DO NOTHING;
+	CREATE TABLE IF NOT EXISTS sod_account_activity (
+		actor VARCHAR(100) NOT NULL,
+		role VARCHAR(50) NOT NULL,
+		account_id INTEGER NOT NULL REFERENCES accounts(id),
+		first_at TIMESTAMP NOT NULL DEFAULT NOW(),
+		last_at TIMESTAMP NOT NULL DEFAULT NOW(),
+		PRIMARY KEY (actor, role, account_id)
+	);
+	CREATE INDEX IF NOT EXISTS idx_sod_account_activity_account ON sod_account_activity(account_id);
+	CREATE TABLE IF NOT EXISTS sod_violations (
+		id SERIAL PRIMARY KEY,
+		rule_id INTEGER NOT NULL REFERENCES sod_rules(id),
+		actor VARCHAR(100) NOT NULL,
+		action VARCHAR(50) NOT NULL,
+		resource VARCHAR(100) NOT NULL DEFAULT '',
+		account_id INTEGER,
+		created_at TIMESTAMP NOT NULL DEFAULT NOW()
+	);
+	CREATE INDEX IF NOT EXISTS idx_sod_violations_created ON sod_violations(created_at);`
+
+var sodAdminRoles = []string{"compliance", "admin"}
+
+var sodRuleKinds = map[string]bool{"maker_checker": true, "role_conflict": true}
+
+const sodRuleColumns = `id, name, kind, first_duty, second_duty, description, enabled, updated_by, updated_at`
+
+func scanSoDRule(row interface{ Scan(...interface{}) error }, s *SoDRule) error {
+	return row.Scan(&s.ID, &s.Name, &s.Kind, &s.First, &s.Second, &s.Description, &s.Enabled, &s.UpdatedBy, &s.UpdatedAt)
+}
+
+// recordSoDViolation logs a blocked attempt for the compliance report. It
+// writes outside the caller's transaction so the record survives the rollback.
+func recordSoDViolation(r *http.Request, ruleID int, action, resource string, accountID int) {
+	var account interface{}
+	if accountID != 0 {
+		account = accountID
+	}
+	_, err := db.ExecContext(r.Context(), `INSERT INTO sod_violations (rule_id, actor, action, resource, account_id)
+										   VALUES ($1, $2, $3, $4, $5)`, ruleID, requestActor(r), action, resource, account)
+	if err != nil {
+		servicekit.RequestLogger(r.Context()).Error("failed to record SoD violation", zap.Error(err))
+	}
+}
+
+// enforceMakerChecker writes a 403 and returns false if an enabled
+// maker_checker rule forbids the caller from performing action on resource.
+// priorActors maps the actions already performed on the record to who did them.
+func enforceMakerChecker(w http.ResponseWriter, r *http.Request, action, resource string, accountID int,
+	priorActors map[string]string) bool {
+	rows, err := db.QueryContext(r.Context(), `SELECT id, name, first_duty, description FROM sod_rules
+											   WHERE kind = 'maker_checker' AND enabled AND second_duty = $1`, action)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return false
+	}
+	defer rows.Close()
+
+	actor := requestActor(r)
+	for rows.Next() {
+		var id int
+		var name, first, description string
+		if err := rows.Scan(&id, &name, &first, &description); err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return false
+		}
+		if prior, ok := priorActors[first]; ok && prior == actor {
+			rows.Close()
+			recordSoDViolation(r, id, action, resource, accountID)
+			http.Error(w, fmt.Sprintf("Separation of duties (%s): %s", name, description), http.StatusForbidden)
+			return false
+		}
+	}
+	if err := rows.Err(); err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return false
+	}
+	return true
+}
+
+// sodMiddleware enforces role_conflict rules on state-changing staff requests
+// to /accounts/{id} routes and records the role the caller acted in
+func sodMiddleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		role := requestRole(r)
+		if role == "" || role == "customer" || r.Method == http.MethodGet || r.Method == http.MethodHead {
+			next.ServeHTTP(w, r)
+			return
+		}
+		route := mux.CurrentRoute(r)
+		if route == nil {
+			next.ServeHTTP(w, r)
+			return
+		}
+		template, _ := route.GetPathTemplate()
+		accountID, err := strconv.Atoi(mux.Vars(r)["id"])
+		if err != nil || !strings.Contains(template, "/accounts/{id}") {
+			next.ServeHTTP(w, r)
+			return
+		}
+
+		actor := requestActor(r)
+		var ruleID int
+		var name, description string
+		err = db.QueryRowContext(r.Context(), `SELECT s.id, s.name, s.description FROM sod_rules s
+											   JOIN sod_account_activity a ON a.actor = $1 AND a.account_id = $3
+											   AND a.role = CASE WHEN s.first_duty = $2 THEN s.second_duty ELSE s.first_duty END
+											   WHERE s.kind = 'role_conflict' AND s.enabled AND $2 IN (s.first_duty, s.second_duty)
+											   LIMIT 1`, actor, role, accountID).Scan(&ruleID, &name, &description)
+		if err == nil {
+			recordSoDViolation(r, ruleID, role, template, accountID)
+			http.Error(w, fmt.Sprintf("Separation of duties (%s): %s", name, description), http.StatusForbidden)
+			return
+		}
+		if err != sql.ErrNoRows {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+
+		_, err = db.ExecContext(r.Context(), `INSERT INTO sod_account_activity (actor, role, account_id)
+											  SELECT $1, $2, id FROM accounts WHERE id = $3
+											  ON CONFLICT (actor, role, account_id) DO UPDATE SET last_at = NOW()`,
+			actor, role, accountID)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+func listSoDRules(w http.ResponseWriter, r *http.Request) {
+	if !requireRole(w, r, sodAdminRoles...) {
+		return
+	}
+
+	rows, err := db.QueryContext(r.Context(), `SELECT `+sodRuleColumns+` FROM sod_rules ORDER BY name`)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	defer rows.Close()
+
+	rules := []SoDRule{}
+	for rows.Next() {
+		var s SoDRule
+		if err := scanSoDRule(rows, &s); err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		rules = append(rules, s)
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(rules)
+}
+
+// putSoDRule creates or replaces the named rule
+func putSoDRule(w http.ResponseWriter, r *http.Request) {
+	if !requireRole(w, r, sodAdminRoles...) {
+		return
+	}
+
+	var s SoDRule
+	err := json.NewDecoder(r.Body).Decode(&s)
+	if err != nil {
+		http.Error(w, "Invalid request body", http.StatusBadRequest)
+		return
+	}
+	s.Name = mux.Vars(r)["name"]
+	if !sodRuleKinds[s.Kind] {
+		http.Error(w, "kind must be maker_checker or role_conflict", http.StatusBadRequest)
+		return
+	}
+	if s.First == "" || s.Second == "" || s.First == s.Second {
+		http.Error(w, "first and second must be different and non-empty", http.StatusBadRequest)
+		return
+	}
+
+	err = scanSoDRule(db.QueryRowContext(r.Context(), `INSERT INTO sod_rules (name, kind, first_duty, second_duty, description,
+									  enabled, updated_by) VALUES ($1, $2, $3, $4, $5, $6, $7)
+									  ON CONFLICT (name) DO UPDATE SET kind = EXCLUDED.kind, first_duty = EXCLUDED.first_duty,
+										  second_duty = EXCLUDED.second_duty, description = EXCLUDED.description,
+										  enabled = EXCLUDED.enabled, updated_by = EXCLUDED.updated_by, updated_at = NOW()
+									  RETURNING `+sodRuleColumns,
+		s.Name, s.Kind, s.First, s.Second, s.Description, s.Enabled, requestActor(r)), &s)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	servicekit.RequestLogger(r.Context()).Info("SoD rule set", zap.String("rule", s.Name), zap.String("updated_by", s.UpdatedBy), zap.Bool("enabled", s.Enabled))
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(s)
+}
+
+// getSoDReport summarises blocked attempts per rule since ?since= (default
+// 30 days) and lists staff who already hold both roles of a role_conflict
+// rule on an account, e.g. from before the rule was enabled
+func getSoDReport(w http.ResponseWriter, r *http.Request) {
+	if !requireRole(w, r, sodAdminRoles...) {
+		return
+	}
+	since := r.URL.Query().Get("since")
+
+	type ruleSummary struct {
+		RuleName   string `json:"rule_name"`
+		Enabled    bool   `json:"enabled"`
+		Violations int    `json:"violations"`
+	}
+	type conflict struct {
+		RuleName  string `json:"rule_name"`
+		Actor     string `json:"actor"`
+		AccountID int    `json:"account_id"`
+	}
+	report := struct {
+		Since      string         `json:"since"`
+		Rules      []ruleSummary  `json:"rules"`
+		Violations []SoDViolation `json:"violations"`
+		Conflicts  []conflict     `json:"conflicts"`
+	}{Rules: []ruleSummary{}, Violations: []SoDViolation{}, Conflicts: []conflict{}}
+
+	err := db.QueryRowContext(r.Context(), `SELECT (COALESCE(NULLIF($1, '')::date, CURRENT_DATE - 30))::text`,
+		since).Scan(&report.Since)
+	if err != nil {
+		http.Error(w, "since must be a date (YYYY-MM-DD)", http.StatusBadRequest)
+		return
+	}
+
+	rows, err := db.QueryContext(r.Context(), `SELECT s.name, s.enabled, COUNT(v.id) FROM sod_rules s
+											   LEFT JOIN sod_violations v ON v.rule_id = s.id AND v.created_at >= $1::date
+											   GROUP BY s.id ORDER BY s.name`, report.Since)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	for rows.Next() {
+		var s ruleSummary
+		if err := rows.Scan(&s.RuleName, &s.Enabled, &s.Violations); err != nil {
+			rows.Close()
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		report.Rules = append(report.Rules, s)
+	}
+	rows.Close()
+
+	rows, err = db.QueryContext(r.Context(), `SELECT v.id, s.name, v.actor, v.action, v.resource, COALESCE(v.account_id, 0),
+											  v.created_at FROM sod_violations v JOIN sod_rules s ON s.id = v.rule_id
+											  WHERE v.created_at >= $1::date ORDER BY v.created_at DESC LIMIT 500`, report.Since)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	for rows.Next() {
+		var v SoDViolation
+		if err := rows.Scan(&v.ID, &v.RuleName, &v.Actor, &v.Action, &v.Resource, &v.AccountID, &v.CreatedAt); err != nil {
+			rows.Close()
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		report.Violations = append(report.Violations, v)
+	}
+	rows.Close()
+
+	rows, err = db.QueryContext(r.Context(), `SELECT s.name, a.actor, a.account_id FROM sod_rules s
+											  JOIN sod_account_activity a ON a.role = s.first_duty
+											  JOIN sod_account_activity b ON b.actor = a.actor AND b.account_id = a.account_id
+												  AND b.role = s.second_duty
+											  WHERE s.kind = 'role_conflict' AND s.enabled ORDER BY s.name, a.account_id`)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var c conflict
+		if err := rows.Scan(&c.RuleName, &c.Actor, &c.AccountID); err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		report.Conflicts = append(report.Conflicts, c)
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(report)
+}
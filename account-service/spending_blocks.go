@@ -0,0 +1,169 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/gorilla/mux"
+)
+
+// SpendingBlock stops card and bill-pay spending in a merchant category or at a merchant
+type SpendingBlock struct {
+	ID              int    `json:"id"`
+	AccountID       int    `json:"account_id"`
+	BlockType       string `json:"block_type"` // category or merchant
+	Value           string `json:"value"`
+	CreatedAt       string `json:"created_at"`
+	LiftRequestedAt string `json:"lift_requested_at,omitempty"`
+	LiftsAt         string `json:"lifts_at,omitempty"`
+}
+
+const spendingBlockTablesSQL = `
+	CREATE TABLE IF NOT EXISTS spending_blocks (
+		id SERIAL PRIMARY KEY,
+		account_id INTEGER NOT NULL REFERENCES accounts(id),
+		block_type VARCHAR(20) NOT NULL,
+		value VARCHAR(100) NOT NULL,
+		created_at TIMESTAMP NOT NULL DEFAULT NOW(),
+		lift_requested_at TIMESTAMP,
+		lifts_at TIMESTAMP
+	);
+	CREATE INDEX IF NOT EXISTS idx_spending_blocks_account ON spending_blocks(account_id);`
+
+// activeBlockCondition matches blocks that have not yet passed their cool-off
+const activeBlockCondition = "(lifts_at IS NULL OR lifts_at > NOW())"
+
+// spendingBlockCoolOff is how long a block stays in force after a lift is requested
+func spendingBlockCoolOff() time.Duration {
+	d, err := time.ParseDuration(getEnv("SPENDING_BLOCK_COOLOFF", "48h"))
+	if err != nil {
+		return 48 * time.Hour
+	}
+	return d
+}
+
+func createSpendingBlock(w http.ResponseWriter, r *http.Request) {
+	params := mux.Vars(r)
+	id := params["id"]
+
+	var block SpendingBlock
+	err := json.NewDecoder(r.Body).Decode(&block)
+	if err != nil {
+		http.Error(w, "Invalid request body", http.StatusBadRequest)
+		return
+	}
+
+	block.Value = strings.TrimSpace(block.Value)
+	if block.BlockType == "category" {
+		block.Value = strings.ToLower(block.Value)
+	}
+	if block.BlockType != "category" && block.BlockType != "merchant" {
+		http.Error(w, "block_type must be category or merchant", http.StatusBadRequest)
+		return
+	}
+	if block.Value == "" || len(block.Value) > 100 {
+		http.Error(w, "value is required and must be at most 100 characters", http.StatusBadRequest)
+		return
+	}
+
+	query := `INSERT INTO spending_blocks (account_id, block_type, value)
+			  SELECT id, $2, $3 FROM accounts WHERE id = $1
+			  RETURNING id, account_id, created_at`
+
+	err = db.QueryRowContext(r.Context(), query, id, block.BlockType, block.Value).Scan(&block.ID, &block.AccountID, &block.CreatedAt)
+	if err != nil {
+		if err == sql.ErrNoRows {
+			http.Error(w, "Account not found", http.StatusNotFound)
+		} else {
+			writeDBError(w, err)
+		}
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusCreated)
+	json.NewEncoder(w).Encode(block)
+}
+
+func listSpendingBlocks(w http.ResponseWriter, r *http.Request) {
+	params := mux.Vars(r)
+	id := params["id"]
+
+	rows, err := db.QueryContext(r.Context(), `SELECT id, account_id, block_type, value, created_at,
+						   COALESCE(lift_requested_at::text, ''), COALESCE(lifts_at::text, '')
+						   FROM spending_blocks WHERE account_id = $1 AND `+activeBlockCondition+`
+						   ORDER BY id`, id)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	defer rows.Close()
+
+	blocks := []SpendingBlock{}
+	for rows.Next() {
+		var b SpendingBlock
+		err := rows.Scan(&b.ID, &b.AccountID, &b.BlockType, &b.Value, &b.CreatedAt, &b.LiftRequestedAt, &b.LiftsAt)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		blocks = append(blocks, b)
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(blocks)
+}
+
+// liftSpendingBlock schedules the block to end after the cool-off period. The
+// block keeps being enforced until then; repeated requests keep the first date.
+func liftSpendingBlock(w http.ResponseWriter, r *http.Request) {
+	params := mux.Vars(r)
+
+	query := `UPDATE spending_blocks
+			  SET lift_requested_at = COALESCE(lift_requested_at, NOW()),
+				  lifts_at = COALESCE(lifts_at, NOW() + $3 * INTERVAL '1 second')
+			  WHERE id = $1 AND account_id = $2
+			  RETURNING id, account_id, block_type, value, created_at, lift_requested_at, lifts_at`
+
+	var b SpendingBlock
+	err := db.QueryRowContext(r.Context(), query, params["blockId"], params["id"], spendingBlockCoolOff().Seconds()).Scan(&b.ID,
+		&b.AccountID, &b.BlockType, &b.Value, &b.CreatedAt, &b.LiftRequestedAt, &b.LiftsAt)
+	if err != nil {
+		if err == sql.ErrNoRows {
+			http.Error(w, "Spending block not found", http.StatusNotFound)
+		} else {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+		}
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusAccepted)
+	json.NewEncoder(w).Encode(b)
+}
+
+// checkSpendingBlocks declines authorizations matching an active block
+func checkSpendingBlocks(ctx context.Context, req *AuthorizationRequest) (*AuthorizationDecision, error) {
+	var blockType string
+	err := db.QueryRowContext(ctx, `SELECT block_type FROM spending_blocks
+									WHERE account_id = $1 AND `+activeBlockCondition+`
+									AND ((block_type = 'category' AND value = $2)
+										 OR (block_type = 'merchant' AND (value = $3 OR LOWER(value) = LOWER($4))))
+									LIMIT 1`,
+		req.AccountID, req.MerchantCategory, req.MerchantID, req.MerchantName).Scan(&blockType)
+	if err == sql.ErrNoRows {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	if blockType == "category" {
+		return decline("category_blocked", "Spending in this category is blocked"), nil
+	}
+	return decline("merchant_blocked", "Spending at this merchant is blocked"), nil
+}
@@ -0,0 +1,306 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gorilla/mux"
+)
+
+// SplitPart assigns part of a transaction to a budgeting category or pot.
+// Splits are for display and reporting only; the ledger is not changed.
+type SplitPart struct {
+	Category string `json:"category"`
+	Pot      string `json:"pot,omitempty"`
+	Amount   Money  `json:"amount"`
+}
+
+// TransactionSplit is the full set of parts for one transaction
+type TransactionSplit struct {
+	AccountID     int         `json:"account_id"`
+	TransactionID int         `json:"transaction_id"`
+	Parts         []SplitPart `json:"parts"`
+}
+
+// SpendingReportLine is the total spent in one category or pot
+type SpendingReportLine struct {
+	Key    string `json:"key"`
+	Amount Money  `json:"amount"`
+	Count  int    `json:"count"`
+}
+
+const splitTablesSQL = `
+	CREATE TABLE IF NOT EXISTS transaction_splits (
+		account_id INTEGER NOT NULL REFERENCES accounts(id),
+		transaction_id INTEGER NOT NULL,
+		position INTEGER NOT NULL,
+		category VARCHAR(50) NOT NULL,
+		pot VARCHAR(50) NOT NULL DEFAULT '',
+		amount DECIMAL(15,2) NOT NULL,
+		PRIMARY KEY (account_id, transaction_id, position)
+	);`
+
+// creditTransactionTypes are left out of spending reports
+var creditTransactionTypes = map[string]bool{
+	"deposit":  true,
+	"interest": true,
+	"refund":   true,
+}
+
+// maxSplitParts bounds how finely a transaction can be split
+const maxSplitParts = 20
+
+func getTransactionSplit(w http.ResponseWriter, r *http.Request) {
+	accountID, transactionID, err := transactionParams(r)
+	if err != nil {
+		http.Error(w, "Invalid account or transaction ID", http.StatusBadRequest)
+		return
+	}
+
+	splits, err := loadSplits(r.Context(), accountID)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	parts, ok := splits[transactionID]
+	if !ok {
+		http.Error(w, "Split not found", http.StatusNotFound)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(TransactionSplit{AccountID: accountID, TransactionID: transactionID, Parts: parts})
+}
+
+// setTransactionSplit replaces the split of a transaction. The parts must add
+// up to the transaction amount reported by the transaction service.
+func setTransactionSplit(w http.ResponseWriter, r *http.Request) {
+	accountID, transactionID, err := transactionParams(r)
+	if err != nil {
+		http.Error(w, "Invalid account or transaction ID", http.StatusBadRequest)
+		return
+	}
+
+	var split TransactionSplit
+	err = json.NewDecoder(r.Body).Decode(&split)
+	if err != nil {
+		http.Error(w, "Invalid request body", http.StatusBadRequest)
+		return
+	}
+	if len(split.Parts) < 2 || len(split.Parts) > maxSplitParts {
+		http.Error(w, fmt.Sprintf("A split needs between 2 and %d parts", maxSplitParts), http.StatusBadRequest)
+		return
+	}
+
+	var total Money
+	for i := range split.Parts {
+		p := &split.Parts[i]
+		p.Category = strings.ToLower(strings.TrimSpace(p.Category))
+		p.Pot = strings.TrimSpace(p.Pot)
+		if p.Category == "" || len(p.Category) > 50 || len(p.Pot) > 50 {
+			http.Error(w, "Each part needs a category of at most 50 characters", http.StatusBadRequest)
+			return
+		}
+		if p.Amount <= 0 {
+			http.Error(w, "Part amounts must be positive", http.StatusBadRequest)
+			return
+		}
+		total += p.Amount
+	}
+
+	var txn TransactionSummary
+	url := fmt.Sprintf("%s/v1/transactions/%d", getEnv("TRANSACTION_SERVICE_URL", "http://localhost:8081"), transactionID)
+	if err := fetchJSON(r, url, &txn); err != nil {
+		http.Error(w, "Transaction service unavailable", http.StatusBadGateway)
+		return
+	}
+	if txn.AccountID != 0 && txn.AccountID != accountID {
+		http.Error(w, "Transaction not found", http.StatusNotFound)
+		return
+	}
+	if total != txn.Amount.Abs() {
+		http.Error(w, fmt.Sprintf("Parts must add up to the transaction amount of %s", txn.Amount.Abs()),
+			http.StatusBadRequest)
+		return
+	}
+
+	tx, err := db.BeginTx(r.Context(), nil)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	defer tx.Rollback()
+
+	_, err = tx.ExecContext(r.Context(), `DELETE FROM transaction_splits WHERE account_id = $1 AND transaction_id = $2`,
+		accountID, transactionID)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	for i, p := range split.Parts {
+		_, err = tx.ExecContext(r.Context(), `INSERT INTO transaction_splits (account_id, transaction_id, position, category, pot, amount)
+						  VALUES ($1, $2, $3, $4, $5, $6)`, accountID, transactionID, i, p.Category, p.Pot, p.Amount)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+	}
+
+	err = tx.Commit()
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	split.AccountID = accountID
+	split.TransactionID = transactionID
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(split)
+}
+
+func deleteTransactionSplit(w http.ResponseWriter, r *http.Request) {
+	accountID, transactionID, err := transactionParams(r)
+	if err != nil {
+		http.Error(w, "Invalid account or transaction ID", http.StatusBadRequest)
+		return
+	}
+
+	result, err := db.ExecContext(r.Context(), `DELETE FROM transaction_splits WHERE account_id = $1 AND transaction_id = $2`,
+		accountID, transactionID)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	if n, _ := result.RowsAffected(); n == 0 {
+		http.Error(w, "Split not found", http.StatusNotFound)
+		return
+	}
+
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// loadSplits returns the account's split parts keyed by transaction ID
+func loadSplits(ctx context.Context, accountID int) (map[int][]SplitPart, error) {
+	rows, err := db.QueryContext(ctx, `SELECT transaction_id, category, pot, amount FROM transaction_splits
+						   WHERE account_id = $1 ORDER BY transaction_id, position`, accountID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	splits := map[int][]SplitPart{}
+	for rows.Next() {
+		var id int
+		var p SplitPart
+		if err := rows.Scan(&id, &p.Category, &p.Pot, &p.Amount); err != nil {
+			return nil, err
+		}
+		splits[id] = append(splits[id], p)
+	}
+	return splits, rows.Err()
+}
+
+// getSpendingReport totals the account's debits between from and to by
+// category or pot, counting each split part in place of its transaction
+func getSpendingReport(w http.ResponseWriter, r *http.Request) {
+	params := mux.Vars(r)
+	accountID, err := strconv.Atoi(params["id"])
+	if err != nil {
+		http.Error(w, "Invalid account ID", http.StatusBadRequest)
+		return
+	}
+
+	query := r.URL.Query()
+	groupBy := query.Get("group_by")
+	if groupBy == "" {
+		groupBy = "category"
+	}
+	if groupBy != "category" && groupBy != "pot" {
+		http.Error(w, "group_by must be category or pot", http.StatusBadRequest)
+		return
+	}
+
+	now := time.Now().UTC()
+	from, to := now.AddDate(0, -1, 0).Format("2006-01-02"), now.Format("2006-01-02")
+	if v := query.Get("from"); v != "" {
+		from = v
+	}
+	if v := query.Get("to"); v != "" {
+		to = v
+	}
+	if _, err := time.Parse("2006-01-02", from); err != nil {
+		http.Error(w, "from must be a date (YYYY-MM-DD)", http.StatusBadRequest)
+		return
+	}
+	if _, err := time.Parse("2006-01-02", to); err != nil {
+		http.Error(w, "to must be a date (YYYY-MM-DD)", http.StatusBadRequest)
+		return
+	}
+
+	transactions, err := fetchAllTransactions(r, accountID)
+	if err != nil {
+		http.Error(w, "Transaction service unavailable", http.StatusBadGateway)
+		return
+	}
+	splits, err := loadSplits(r.Context(), accountID)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	totals := map[string]*SpendingReportLine{}
+	add := func(key string, amount Money) {
+		if key == "" {
+			key = "uncategorized"
+		}
+		line, ok := totals[key]
+		if !ok {
+			line = &SpendingReportLine{Key: key}
+			totals[key] = line
+		}
+		line.Amount += amount
+		line.Count++
+	}
+
+	for _, t := range transactions {
+		if len(t.CreatedAt) < 10 || t.CreatedAt[:10] < from || t.CreatedAt[:10] > to {
+			continue
+		}
+		if creditTransactionTypes[t.Type] {
+			continue
+		}
+		parts, ok := splits[t.ID]
+		if !ok {
+			add("", t.Amount.Abs())
+			continue
+		}
+		for _, p := range parts {
+			if groupBy == "pot" {
+				add(p.Pot, p.Amount)
+			} else {
+				add(p.Category, p.Amount)
+			}
+		}
+	}
+
+	lines := make([]SpendingReportLine, 0, len(totals))
+	for _, line := range totals {
+		lines = append(lines, *line)
+	}
+	sort.Slice(lines, func(i, j int) bool { return lines[i].Amount > lines[j].Amount })
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"account_id": accountID,
+		"from":       from,
+		"to":         to,
+		"group_by":   groupBy,
+		"lines":      lines,
+	})
+}
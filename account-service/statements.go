@@ -0,0 +1,295 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strings"
+	"time"
+
+	"bank/servicekit"
+
+	"github.com/gorilla/mux"
+	"go.uber.org/zap"
+)
+
+// StatementSubscription is a customer's opt-in to monthly statement emails
+type StatementSubscription struct {
+	AccountID      int    `json:"account_id"`
+	Email          string `json:"email"`
+	MailingAddress string `json:"mailing_address,omitempty"`
+	Active         bool   `json:"active"`
+	CreatedAt      string `json:"created_at"`
+	UpdatedAt      string `json:"updated_at"`
+}
+
+// Statement is a generated monthly statement document
+type Statement struct {
+	ID          int    `json:"id"`
+	AccountID   int    `json:"account_id"`
+	PeriodStart string `json:"period_start"`
+	PeriodEnd   string `json:"period_end"`
+	ObjectKey   string `json:"-"`
+	EmailedAt   string `json:"emailed_at,omitempty"`
+	CreatedAt   string `json:"created_at"`
+}
+
+const statementTablesSQL = `
+	CREATE TABLE IF NOT EXISTS statement_subscriptions (
+		account_id INTEGER PRIMARY KEY REFERENCES accounts(id),
+		email VARCHAR(100) NOT NULL,
+		active BOOLEAN NOT NULL DEFAULT TRUE,
+		created_at TIMESTAMP NOT NULL DEFAULT NOW(),
+		updated_at TIMESTAMP NOT NULL DEFAULT NOW()
+	);
+
+	CREATE TABLE IF NOT EXISTS statements (
+		id SERIAL PRIMARY KEY,
+		account_id INTEGER NOT NULL REFERENCES accounts(id),
+		period_start DATE NOT NULL,
+		period_end DATE NOT NULL,
+		object_key VARCHAR(255) NOT NULL DEFAULT '',
+		emailed_at TIMESTAMP,
+		created_at TIMESTAMP NOT NULL DEFAULT NOW(),
+		UNIQUE (account_id, period_start)
+	);`
+
+// statementLinkTTL is how long an emailed download link stays valid
+const statementLinkTTL = 7 * 24 * time.Hour
+
+func subscribeStatements(w http.ResponseWriter, r *http.Request) {
+	params := mux.Vars(r)
+	id := params["id"]
+
+	var requestBody struct {
+		Email string `json:"email"`
+	}
+
+	err := json.NewDecoder(r.Body).Decode(&requestBody)
+	if err != nil {
+		http.Error(w, "Invalid request body", http.StatusBadRequest)
+		return
+	}
+
+	if !strings.Contains(requestBody.Email, "@") {
+		http.Error(w, "A valid email is required", http.StatusBadRequest)
+		return
+	}
+
+	query := `INSERT INTO statement_subscriptions (account_id, email, active)
+			  SELECT id, $2, TRUE FROM accounts WHERE id = $1
+			  ON CONFLICT (account_id) DO UPDATE SET email = EXCLUDED.email, active = TRUE, updated_at = NOW()
+			  RETURNING account_id, email, active, created_at, updated_at`
+
+	var sub StatementSubscription
+	err = db.QueryRowContext(r.Context(), query, id, requestBody.Email).Scan(&sub.AccountID, &sub.Email, &sub.Active,
+		&sub.CreatedAt, &sub.UpdatedAt)
+	if err != nil {
+		if err == sql.ErrNoRows {
+			http.Error(w, "Account not found", http.StatusNotFound)
+		} else {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+		}
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(sub)
+}
+
+func unsubscribeStatements(w http.ResponseWriter, r *http.Request) {
+	params := mux.Vars(r)
+	id := params["id"]
+
+	result, err := db.ExecContext(r.Context(), `UPDATE statement_subscriptions SET active = FALSE, updated_at = NOW()
+							WHERE account_id = $1`, id)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	if n, _ := result.RowsAffected(); n == 0 {
+		http.Error(w, "Subscription not found", http.StatusNotFound)
+		return
+	}
+
+	w.WriteHeader(http.StatusNoContent)
+}
+
+func listStatements(w http.ResponseWriter, r *http.Request) {
+	params := mux.Vars(r)
+	id := params["id"]
+
+	rows, err := db.QueryContext(r.Context(), `SELECT id, account_id, period_start, period_end, COALESCE(emailed_at::text, ''), created_at
+						   FROM statements WHERE account_id = $1 ORDER BY period_start DESC`, id)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	defer rows.Close()
+
+	statements := []map[string]interface{}{}
+	for rows.Next() {
+		var s Statement
+		err := rows.Scan(&s.ID, &s.AccountID, &s.PeriodStart, &s.PeriodEnd, &s.EmailedAt, &s.CreatedAt)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		statements = append(statements, map[string]interface{}{
+			"statement":    s,
+			"download_url": signDownloadPath(fmt.Sprintf("/v1/statements/%d/download", s.ID), statementLinkTTL),
+		})
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(statements)
+}
+
+// downloadStatement serves a statement PDF to holders of a valid signed link
+func downloadStatement(w http.ResponseWriter, r *http.Request) {
+	if !verifyDownloadSignature(r) {
+		http.Error(w, "Invalid or expired link", http.StatusForbidden)
+		return
+	}
+
+	params := mux.Vars(r)
+	id := params["id"]
+
+	var key string
+	err := db.QueryRowContext(r.Context(), "SELECT object_key FROM statements WHERE id = $1", id).Scan(&key)
+	if err != nil {
+		if err == sql.ErrNoRows {
+			http.Error(w, "Statement not found", http.StatusNotFound)
+		} else {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+		}
+		return
+	}
+
+	data, err := objectStore.Get(r.Context(), key)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/pdf")
+	w.Header().Set("Content-Disposition", fmt.Sprintf("attachment; filename=\"statement-%s.pdf\"", id))
+	w.Write(data)
+}
+
+// startStatementScheduler periodically generates last month's statements for
+// every active subscription
+func startStatementScheduler() {
+	interval, err := time.ParseDuration(getEnv("STATEMENT_JOB_INTERVAL", "1h"))
+	if err != nil {
+		interval = time.Hour
+	}
+
+	go func() {
+		defer servicekit.ReportJobPanic("Statement job")
+		for {
+			if err := runStatementJob(serviceContext, time.Now()); err != nil {
+				servicekit.ReportJobError("Statement job", err)
+			}
+			time.Sleep(interval)
+		}
+	}()
+}
+
+// runStatementJob generates and emails statements for the month before now.
+// Statements are claimed with a unique row per account and period, so running
+// the job on several replicas or several times a day is safe.
+func runStatementJob(ctx context.Context, now time.Time) error {
+	periodEnd := time.Date(now.Year(), now.Month(), 1, 0, 0, 0, 0, time.UTC)
+	periodStart := periodEnd.AddDate(0, -1, 0)
+
+	rows, err := db.QueryContext(ctx, `SELECT s.account_id, s.email, s.mailing_address FROM statement_subscriptions s
+									   WHERE s.active AND NOT EXISTS (
+										   SELECT 1 FROM statements st
+										   WHERE st.account_id = s.account_id AND st.period_start = $1)`, periodStart)
+	if err != nil {
+		return err
+	}
+
+	var subs []StatementSubscription
+	for rows.Next() {
+		var sub StatementSubscription
+		if err := rows.Scan(&sub.AccountID, &sub.Email, &sub.MailingAddress); err != nil {
+			rows.Close()
+			return err
+		}
+		subs = append(subs, sub)
+	}
+	rows.Close()
+
+	for _, sub := range subs {
+		if err := generateStatement(ctx, sub, periodStart, periodEnd); err != nil {
+			servicekit.RequestLogger(ctx).Error("failed to generate statement", zap.Int("account_id", sub.AccountID), zap.Error(err))
+		}
+	}
+	return nil
+}
+
+func generateStatement(ctx context.Context, sub StatementSubscription, periodStart, periodEnd time.Time) error {
+	// Claim the statement so concurrent runs skip it
+	var statementID int
+	err := db.QueryRowContext(ctx, `INSERT INTO statements (account_id, period_start, period_end)
+									VALUES ($1, $2, $3) ON CONFLICT (account_id, period_start) DO NOTHING
+									RETURNING id`, sub.AccountID, periodStart, periodEnd.AddDate(0, 0, -1)).Scan(&statementID)
+	if err == sql.ErrNoRows {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+
+	var account Account
+	err = db.QueryRowContext(ctx, `SELECT id, customer_id, account_type, balance, currency_code,
+								   COALESCE(account_number, '') FROM accounts WHERE id = $1`, sub.AccountID).Scan(&account.ID,
+		&account.CustomerID, &account.AccountType, &account.Balance, &account.CurrencyCode, &account.AccountNumber)
+	if err != nil {
+		return err
+	}
+
+	// Statements are addressed to whoever owns the account when they are generated
+	lines := []string{fmt.Sprintf("Customer: %d", account.CustomerID)}
+	if sub.MailingAddress != "" {
+		lines = append(lines, strings.Split(sub.MailingAddress, "\n")...)
+	}
+	lines = append(lines,
+		fmt.Sprintf("Account: %s (%s)", account.AccountNumber, account.AccountType),
+		fmt.Sprintf("Period: %s to %s", periodStart.Format("2006-01-02"), periodEnd.AddDate(0, 0, -1).Format("2006-01-02")),
+		fmt.Sprintf("Closing balance: %s %s", account.Balance, account.CurrencyCode),
+	)
+	pdf := renderTextPDF("Monthly Account Statement", lines)
+
+	key := fmt.Sprintf("statements/%d/%s.pdf", account.ID, periodStart.Format("2006-01"))
+	if err := objectStore.Put(ctx, key, pdf); err != nil {
+		return err
+	}
+
+	_, err = db.ExecContext(ctx, "UPDATE statements SET object_key = $1 WHERE id = $2", key, statementID)
+	if err != nil {
+		return err
+	}
+
+	err = sendNotification(ctx, Notification{
+		Channel:   "email",
+		Recipient: sub.Email,
+		Template:  "monthly_statement",
+		Data: map[string]interface{}{
+			"account_id":   account.ID,
+			"period":       periodStart.Format("January 2006"),
+			"download_url": signDownloadPath(fmt.Sprintf("/v1/statements/%d/download", statementID), statementLinkTTL),
+		},
+	})
+	if err != nil {
+		return err
+	}
+
+	_, err = db.ExecContext(ctx, "UPDATE statements SET emailed_at = NOW() WHERE id = $1", statementID)
+	return err
+}
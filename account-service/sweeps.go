@@ -0,0 +1,305 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"net/http"
+	"time"
+
+	"bank/servicekit"
+
+	"github.com/gorilla/mux"
+	"go.uber.org/zap"
+)
+
+// SweepConfig keeps a business operating account at its target balance by
+// moving the excess into an interest-bearing account overnight, and pulling
+// funds back when the operating balance ends the day below target
+type SweepConfig struct {
+	AccountID       int    `json:"account_id"`
+	TargetAccountID int    `json:"target_account_id"`
+	TargetBalance   Money  `json:"target_balance"`
+	MinimumTransfer Money  `json:"minimum_transfer"`
+	ReturnWhenBelow bool   `json:"return_when_below"`
+	Enabled         bool   `json:"enabled"`
+	LastRunDate     string `json:"last_run_date,omitempty"`
+	CreatedAt       string `json:"created_at"`
+	UpdatedAt       string `json:"updated_at"`
+}
+
+// SweepRun is the outcome of one nightly sweep
+type SweepRun struct {
+	ID        int    `json:"id"`
+	RunDate   string `json:"run_date"`
+	Direction string `json:"direction"` // out (to the target account), in (back) or none
+	Amount    Money  `json:"amount"`
+	Status    string `json:"status"` // completed, skipped or failed
+	Reason    string `json:"reason,omitempty"`
+	CreatedAt string `json:"created_at"`
+}
+
+const sweepTablesSQL = `
+	CREATE TABLE IF NOT EXISTS sweep_configs (
+		account_id INTEGER PRIMARY KEY REFERENCES accounts(id),
+		target_account_id INTEGER NOT NULL REFERENCES accounts(id),
+		target_balance DECIMAL(15,2) NOT NULL,
+		minimum_transfer DECIMAL(15,2) NOT NULL DEFAULT 0,
+		return_when_below BOOLEAN NOT NULL DEFAULT TRUE,
+		enabled BOOLEAN NOT NULL DEFAULT TRUE,
+		created_at TIMESTAMP NOT NULL DEFAULT NOW(),
+		updated_at TIMESTAMP NOT NULL DEFAULT NOW()
+	);
+	CREATE TABLE IF NOT EXISTS sweep_runs (
+		id SERIAL PRIMARY KEY,
+		account_id INTEGER NOT NULL REFERENCES accounts(id),
+		run_date DATE NOT NULL,
+		direction VARCHAR(4) NOT NULL DEFAULT 'none',
+		amount DECIMAL(15,2) NOT NULL DEFAULT 0,
+		status VARCHAR(20) NOT NULL,
+		reason VARCHAR(255) NOT NULL DEFAULT '',
+		created_at TIMESTAMP NOT NULL DEFAULT NOW(),
+		UNIQUE (account_id, run_date)
+	);`
+
+const sweepConfigColumns = `c.account_id, c.target_account_id, c.target_balance, c.minimum_transfer, c.return_when_below,
+	c.enabled, COALESCE((SELECT MAX(run_date)::text FROM sweep_runs WHERE account_id = c.account_id), ''),
+	c.created_at, c.updated_at`
+
+func scanSweepConfig(row interface{ Scan(...interface{}) error }, c *SweepConfig) error {
+	return row.Scan(&c.AccountID, &c.TargetAccountID, &c.TargetBalance, &c.MinimumTransfer, &c.ReturnWhenBelow,
+		&c.Enabled, &c.LastRunDate, &c.CreatedAt, &c.UpdatedAt)
+}
+
+// setSweepConfig creates or replaces the sweep of a business account. The
+// target must be a savings account of the same customer in the same currency.
+func setSweepConfig(w http.ResponseWriter, r *http.Request) {
+	var c SweepConfig
+	err := json.NewDecoder(r.Body).Decode(&c)
+	if err != nil {
+		http.Error(w, "Invalid request body", http.StatusBadRequest)
+		return
+	}
+
+	if c.TargetBalance < 0 || c.MinimumTransfer < 0 {
+		http.Error(w, "target_balance and minimum_transfer must not be negative", http.StatusBadRequest)
+		return
+	}
+
+	// The last run date is not part of the row, so read the config back after writing it
+	err = db.QueryRowContext(r.Context(), `INSERT INTO sweep_configs (account_id, target_account_id, target_balance,
+										  minimum_transfer, return_when_below, enabled)
+									  SELECT a.id, t.id, $3, $4, $5, $6 FROM accounts a JOIN accounts t
+									  ON t.id = $2 AND t.account_type = 'savings' AND t.customer_id = a.customer_id
+									  AND t.currency_code = a.currency_code
+									  WHERE a.id = $1 AND a.account_type = 'business'
+									  ON CONFLICT (account_id) DO UPDATE SET target_account_id = EXCLUDED.target_account_id,
+										  target_balance = EXCLUDED.target_balance, minimum_transfer = EXCLUDED.minimum_transfer,
+										  return_when_below = EXCLUDED.return_when_below, enabled = EXCLUDED.enabled,
+										  updated_at = NOW()
+									  RETURNING account_id`,
+		mux.Vars(r)["id"], c.TargetAccountID, c.TargetBalance, c.MinimumTransfer, c.ReturnWhenBelow, c.Enabled).Scan(&c.AccountID)
+	if err != nil {
+		if err == sql.ErrNoRows {
+			http.Error(w, "Sweeps need a business account and a savings target_account_id of the same customer in the same currency", http.StatusBadRequest)
+		} else {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+		}
+		return
+	}
+
+	err = scanSweepConfig(db.QueryRowContext(r.Context(), `SELECT `+sweepConfigColumns+` FROM sweep_configs c
+															 WHERE c.account_id = $1`, c.AccountID), &c)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(c)
+}
+
+func getSweepConfig(w http.ResponseWriter, r *http.Request) {
+	var c SweepConfig
+	err := scanSweepConfig(db.QueryRowContext(r.Context(), `SELECT `+sweepConfigColumns+` FROM sweep_configs c
+															 WHERE c.account_id = $1`, mux.Vars(r)["id"]), &c)
+	if err != nil {
+		if err == sql.ErrNoRows {
+			http.Error(w, "Sweep not configured", http.StatusNotFound)
+		} else {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+		}
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(c)
+}
+
+func deleteSweepConfig(w http.ResponseWriter, r *http.Request) {
+	result, err := db.ExecContext(r.Context(), `DELETE FROM sweep_configs WHERE account_id = $1`, mux.Vars(r)["id"])
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	if n, _ := result.RowsAffected(); n == 0 {
+		http.Error(w, "Sweep not configured", http.StatusNotFound)
+		return
+	}
+
+	w.WriteHeader(http.StatusNoContent)
+}
+
+func listSweepRuns(w http.ResponseWriter, r *http.Request) {
+	rows, err := db.QueryContext(r.Context(), `SELECT id, run_date::text, direction, amount, status, reason, created_at
+											   FROM sweep_runs WHERE account_id = $1
+											   ORDER BY run_date DESC LIMIT 100`, mux.Vars(r)["id"])
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	defer rows.Close()
+
+	runs := []SweepRun{}
+	for rows.Next() {
+		var s SweepRun
+		if err := rows.Scan(&s.ID, &s.RunDate, &s.Direction, &s.Amount, &s.Status, &s.Reason, &s.CreatedAt); err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		runs = append(runs, s)
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(runs)
+}
+
+// startSweeps runs every enabled sweep once per business day, after the day
+// has closed, alongside the end-of-day balance snapshots
+func startSweeps() {
+	go func() {
+		defer servicekit.ReportJobPanic("Sweep job")
+		for {
+			if err := runSweeps(serviceContext); err != nil {
+				servicekit.ReportJobError("Sweep job", err)
+			}
+			time.Sleep(time.Hour)
+		}
+	}()
+}
+
+func runSweeps(ctx context.Context) error {
+	rows, err := db.QueryContext(ctx, `SELECT c.account_id FROM sweep_configs c WHERE c.enabled AND NOT EXISTS (
+										   SELECT 1 FROM sweep_runs s WHERE s.account_id = c.account_id
+										   AND s.run_date = CURRENT_DATE - 1)`)
+	if err != nil {
+		return err
+	}
+	var ids []int
+	for rows.Next() {
+		var id int
+		if err := rows.Scan(&id); err != nil {
+			rows.Close()
+			return err
+		}
+		ids = append(ids, id)
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return err
+	}
+
+	// Use the database's calendar so the run date matches the NOT EXISTS check
+	var runDate string
+	if err := db.QueryRowContext(ctx, `SELECT (CURRENT_DATE - 1)::text`).Scan(&runDate); err != nil {
+		return err
+	}
+	for _, id := range ids {
+		if err := runSweep(ctx, id, runDate); err != nil {
+			servicekit.RequestLogger(ctx).Error("sweep failed", zap.Int("account_id", id), zap.Error(err))
+		}
+	}
+	return nil
+}
+
+// runSweep moves the operating account's available balance above target into
+// the target account, or back up to target when below. Each business day is
+// claimed in sweep_runs so a sweep never runs twice for the same date; a failed
+// sweep is recorded and not retried until the next night.
+func runSweep(ctx context.Context, accountID int, runDate string) error {
+	tx, err := db.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	var runID int
+	err = tx.QueryRowContext(ctx, `INSERT INTO sweep_runs (account_id, run_date, status) VALUES ($1, $2, 'skipped')
+								   ON CONFLICT (account_id, run_date) DO NOTHING RETURNING id`, accountID, runDate).Scan(&runID)
+	if err == sql.ErrNoRows {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+
+	var c SweepConfig
+	err = tx.QueryRowContext(ctx, `SELECT target_account_id, target_balance, minimum_transfer, return_when_below
+								   FROM sweep_configs WHERE account_id = $1 AND enabled`, accountID).Scan(
+		&c.TargetAccountID, &c.TargetBalance, &c.MinimumTransfer, &c.ReturnWhenBelow)
+	if err == sql.ErrNoRows {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+
+	available := map[int]Money{}
+	first, second := accountID, c.TargetAccountID
+	if second < first {
+		first, second = second, first
+	}
+	for _, id := range []int{first, second} {
+		var balance Money
+		if err := tx.QueryRowContext(ctx, `SELECT balance FROM accounts WHERE id = $1 FOR UPDATE`, id).Scan(&balance); err != nil {
+			return err
+		}
+		liens, err := activeLienTotal(ctx, tx, id)
+		if err != nil {
+			return err
+		}
+		available[id] = balance - liens
+	}
+
+	direction, amount := "none", available[accountID]-c.TargetBalance
+	if amount > 0 {
+		direction = "out"
+	} else if amount < 0 && c.ReturnWhenBelow {
+		direction, amount = "in", -amount
+		if amount > available[c.TargetAccountID] {
+			amount = available[c.TargetAccountID]
+		}
+	}
+	if direction == "none" || amount <= 0 || amount < c.MinimumTransfer {
+		return tx.Commit()
+	}
+
+	fromID, toID := accountID, c.TargetAccountID
+	if direction == "in" {
+		fromID, toID = toID, fromID
+	}
+	if err := internalTransfer(ctx, tx, fromID, toID, amount, "Sweep "+runDate); err != nil {
+		tx.Rollback()
+		_, logErr := db.ExecContext(ctx, `INSERT INTO sweep_runs (account_id, run_date, direction, amount, status, reason)
+										  VALUES ($1, $2, $3, $4, 'failed', $5) ON CONFLICT (account_id, run_date) DO NOTHING`,
+			accountID, runDate, direction, amount, err.Error())
+		return logErr
+	}
+
+	_, err = tx.ExecContext(ctx, `UPDATE sweep_runs SET direction = $2, amount = $3, status = 'completed' WHERE id = $1`,
+		runID, direction, amount)
+	if err != nil {
+		return err
+	}
+	return tx.Commit()
+}
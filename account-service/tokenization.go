@@ -0,0 +1,418 @@
+package main
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"database/sql"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math/big"
+	"net/http"
+	"strings"
+	"time"
+	"unicode"
+
+	"bank/servicekit"
+
+	"go.uber.org/zap"
+)
+
+// Tokens replace sensitive values such as card PANs and account numbers
+// shared with partners. A token keeps the value's length, character classes,
+// separators and last four characters, so it fits existing fields and screens,
+// but carries nothing else of the value. The value itself is stored encrypted
+// and only roles granted the token's scope may detokenize it.
+
+// SensitiveToken is a token as returned to callers; the value is only included
+// on detokenization
+type SensitiveToken struct {
+	Token     string `json:"token"`
+	TokenType string `json:"token_type"`
+	Scope     string `json:"scope"`
+	Value     string `json:"value,omitempty"`
+	CreatedAt string `json:"created_at"`
+}
+
+// TokenAccess is an audit record of a tokenization or detokenization
+type TokenAccess struct {
+	ID        int    `json:"id"`
+	Token     string `json:"token"`
+	Operation string `json:"operation"` // tokenize or detokenize
+	Scope     string `json:"scope"`
+	Actor     string `json:"actor"`
+	Role      string `json:"role"`
+	Purpose   string `json:"purpose,omitempty"`
+	Outcome   string `json:"outcome"` // granted, denied or not_found
+	CreatedAt string `json:"created_at"`
+}
+
+const tokenizationTablesSQL = `
+	CREATE TABLE IF NOT EXISTS sensitive_tokens (
+		token VARCHAR(64) PRIMARY KEY,
+		token_type VARCHAR(20) NOT NULL,
+		scope VARCHAR(50) NOT NULL,
+		value_lookup VARCHAR(64) NOT NULL,
+		value_encrypted TEXT NOT NULL,
+		created_by VARCHAR(100) NOT NULL,
+		created_at TIMESTAMP NOT NULL DEFAULT NOW(),
+		UNIQUE (token_type, scope, value_lookup)
+	);
+	CREATE TABLE IF NOT EXISTS token_access_log (
+		id SERIAL PRIMARY KEY,
+		token VARCHAR(64) NOT NULL,
+		operation VARCHAR(20) NOT NULL,
+		scope VARCHAR(50) NOT NULL DEFAULT '',
+		actor VARCHAR(100) NOT NULL,
+		role VARCHAR(30) NOT NULL DEFAULT '',
+		purpose VARCHAR(200) NOT NULL DEFAULT '',
+		outcome VARCHAR(20) NOT NULL,
+		created_at TIMESTAMP NOT NULL DEFAULT NOW()
+	);
+	CREATE INDEX IF NOT EXISTS idx_token_access_log_token ON token_access_log(token, created_at);`
+
+// Token types and the length of the values they accept
+var tokenTypes = map[string]struct{ min, max int }{
+	"pan":            {13, 19},
+	"account_number": {6, 34},
+}
+
+// tokenAuditRoles may read the token access log
+var tokenAuditRoles = []string{"compliance", "admin"}
+
+// tokenScopeRoles returns the roles allowed to tokenize and detokenize values
+// in each scope, from TOKENIZATION_SCOPES, e.g.
+// "card-processing=payments|admin,partner-sharing=partner_ops|admin"
+func tokenScopeRoles() map[string][]string {
+	scopes := map[string][]string{}
+	for _, entry := range strings.Split(getEnv("TOKENIZATION_SCOPES",
+		"card-processing=payments|admin,partner-sharing=partner_ops|admin"), ",") {
+		scope, roles, ok := strings.Cut(strings.TrimSpace(entry), "=")
+		if !ok || scope == "" {
+			continue
+		}
+		scopes[scope] = strings.Split(roles, "|")
+	}
+	return scopes
+}
+
+// tokenizationKeys derives the encryption key and the lookup key from
+// TOKENIZATION_SECRET. The lookup key lets the same value map to the same
+// token without storing a plain hash of it.
+func tokenizationKeys() (encryption, lookup []byte) {
+	secret := getEnv("TOKENIZATION_SECRET", "change-me-in-production")
+	e := sha256.Sum256([]byte("encryption:" + secret))
+	l := sha256.Sum256([]byte("lookup:" + secret))
+	return e[:], l[:]
+}
+
+func tokenValueLookup(tokenType, value string) string {
+	_, key := tokenizationKeys()
+	mac := hmac.New(sha256.New, key)
+	mac.Write([]byte(tokenType + ":" + value))
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+// sealTokenValue encrypts value with AES-256-GCM, bound to the token so a
+// ciphertext cannot be moved to another row
+func sealTokenValue(token, value string) (string, error) {
+	key, _ := tokenizationKeys()
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return "", err
+	}
+	gcm, err := cipher.NewGCM(block)
+	if err != nil {
+		return "", err
+	}
+	nonce := make([]byte, gcm.NonceSize())
+	if _, err := rand.Read(nonce); err != nil {
+		return "", err
+	}
+	return base64.StdEncoding.EncodeToString(gcm.Seal(nonce, nonce, []byte(value), []byte(token))), nil
+}
+
+func openTokenValue(token, sealed string) (string, error) {
+	key, _ := tokenizationKeys()
+	raw, err := base64.StdEncoding.DecodeString(sealed)
+	if err != nil {
+		return "", err
+	}
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return "", err
+	}
+	gcm, err := cipher.NewGCM(block)
+	if err != nil {
+		return "", err
+	}
+	if len(raw) < gcm.NonceSize() {
+		return "", errors.New("sealed value is too short")
+	}
+	plain, err := gcm.Open(nil, raw[:gcm.NonceSize()], raw[gcm.NonceSize():], []byte(token))
+	return string(plain), err
+}
+
+func randomBelow(n int64) int64 {
+	v, _ := rand.Int(rand.Reader, big.NewInt(n))
+	return v.Int64()
+}
+
+// formatPreservingToken replaces every letter and digit but the last four
+// with a random one of the same class. PAN tokens are made to fail the Luhn
+// check so a token can never be mistaken for a real card number.
+func formatPreservingToken(tokenType, value string) string {
+	out := []rune(value)
+	var positions []int
+	for i, c := range out {
+		if unicode.IsDigit(c) || unicode.IsLetter(c) {
+			positions = append(positions, i)
+		}
+	}
+	for _, i := range positions[:len(positions)-4] {
+		switch c := out[i]; {
+		case unicode.IsDigit(c):
+			out[i] = rune('0' + randomBelow(10))
+		case unicode.IsUpper(c):
+			out[i] = rune('A' + randomBelow(26))
+		default:
+			out[i] = rune('a' + randomBelow(26))
+		}
+	}
+	if tokenType == "pan" && luhnValid(string(out)) {
+		// Bump the first digit; a single-digit change always breaks Luhn
+		first := positions[0]
+		out[first] = '0' + (out[first]-'0'+1)%10
+	}
+	return string(out)
+}
+
+func luhnValid(number string) bool {
+	sum, double := 0, false
+	for i := len(number) - 1; i >= 0; i-- {
+		if number[i] < '0' || number[i] > '9' {
+			continue
+		}
+		d := int(number[i] - '0')
+		if double {
+			d *= 2
+			if d > 9 {
+				d -= 9
+			}
+		}
+		sum += d
+		double = !double
+	}
+	return sum%10 == 0
+}
+
+// normalizeTokenValue checks a value for its token type and strips spaces
+// and dashes from PANs
+func normalizeTokenValue(tokenType, value string) (string, error) {
+	limits, ok := tokenTypes[tokenType]
+	if !ok {
+		return "", fmt.Errorf("token_type must be pan or account_number")
+	}
+	value = strings.TrimSpace(value)
+	if tokenType == "pan" {
+		value = strings.NewReplacer(" ", "", "-", "").Replace(value)
+		if strings.Trim(value, "0123456789") != "" || !luhnValid(value) {
+			return "", fmt.Errorf("value is not a valid card number")
+		}
+	}
+	significant := 0
+	for _, c := range value {
+		if unicode.IsDigit(c) || unicode.IsLetter(c) {
+			significant++
+		}
+	}
+	if significant < limits.min || len(value) > limits.max {
+		return "", fmt.Errorf("value must have %d to %d characters", limits.min, limits.max)
+	}
+	return value, nil
+}
+
+// requireTokenScope writes an error and returns false unless the caller's
+// role is granted scope
+func requireTokenScope(w http.ResponseWriter, r *http.Request, scope string) bool {
+	roles, ok := tokenScopeRoles()[scope]
+	if !ok {
+		http.Error(w, "Unknown token scope", http.StatusBadRequest)
+		return false
+	}
+	return requireRole(w, r, roles...)
+}
+
+func logTokenAccess(r *http.Request, token, operation, scope, purpose, outcome string) {
+	_, err := db.ExecContext(r.Context(), `INSERT INTO token_access_log (token, operation, scope, actor, role, purpose, outcome)
+										   VALUES ($1, $2, $3, $4, $5, $6, $7)`,
+		token, operation, scope, requestActor(r), requestRole(r), purpose, outcome)
+	if err != nil {
+		servicekit.RequestLogger(r.Context()).Error("failed to audit token access", zap.String("operation", operation), zap.String("token", token), zap.Error(err))
+	}
+}
+
+// tokenizeValue returns the token for a sensitive value, creating it on first
+// use. The same value, type and scope always give the same token.
+func tokenizeValue(w http.ResponseWriter, r *http.Request) {
+	var requestBody struct {
+		TokenType string `json:"token_type"`
+		Value     string `json:"value"`
+		Scope     string `json:"scope"`
+	}
+	err := json.NewDecoder(r.Body).Decode(&requestBody)
+	if err != nil {
+		http.Error(w, "Invalid request body", http.StatusBadRequest)
+		return
+	}
+	if !requireTokenScope(w, r, requestBody.Scope) {
+		return
+	}
+	value, err := normalizeTokenValue(requestBody.TokenType, requestBody.Value)
+	if err != nil {
+		http.Error(w, "Invalid value for the token_type", http.StatusBadRequest)
+		return
+	}
+
+	t := SensitiveToken{TokenType: requestBody.TokenType, Scope: requestBody.Scope}
+	lookup := tokenValueLookup(t.TokenType, value)
+	status := http.StatusOK
+	for attempt := 0; ; attempt++ {
+		err = db.QueryRowContext(r.Context(), `SELECT token, created_at FROM sensitive_tokens
+						   WHERE token_type = $1 AND scope = $2 AND value_lookup = $3`,
+			t.TokenType, t.Scope, lookup).Scan(&t.Token, &t.CreatedAt)
+		if err != sql.ErrNoRows {
+			break
+		}
+		if attempt == 5 {
+			err = errors.New("Could not allocate a unique token")
+			break
+		}
+
+		t.Token = formatPreservingToken(t.TokenType, value)
+		var sealed string
+		sealed, err = sealTokenValue(t.Token, value)
+		if err != nil {
+			break
+		}
+		// Conflicts on either the token or the value fall through to the
+		// lookup above: a concurrent request may have tokenized the same value
+		var result sql.Result
+		result, err = db.ExecContext(r.Context(), `INSERT INTO sensitive_tokens (token, token_type, scope, value_lookup, value_encrypted, created_by)
+							   VALUES ($1, $2, $3, $4, $5, $6) ON CONFLICT DO NOTHING`,
+			t.Token, t.TokenType, t.Scope, lookup, sealed, requestActor(r))
+		if err != nil {
+			break
+		}
+		if n, _ := result.RowsAffected(); n == 1 {
+			t.CreatedAt = time.Now().UTC().Format(time.RFC3339)
+			status = http.StatusCreated
+			break
+		}
+	}
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	if status == http.StatusCreated {
+		logTokenAccess(r, t.Token, "tokenize", t.Scope, "", "granted")
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(t)
+}
+
+// detokenizeValue returns the value behind a token to a role granted the
+// token's scope. Every attempt is audited with the stated purpose, including
+// refusals.
+func detokenizeValue(w http.ResponseWriter, r *http.Request) {
+	var requestBody struct {
+		Token   string `json:"token"`
+		Purpose string `json:"purpose"`
+	}
+	err := json.NewDecoder(r.Body).Decode(&requestBody)
+	if err != nil {
+		http.Error(w, "Invalid request body", http.StatusBadRequest)
+		return
+	}
+	requestBody.Purpose = strings.TrimSpace(requestBody.Purpose)
+	if requestBody.Token == "" || requestBody.Purpose == "" || len(requestBody.Purpose) > 200 {
+		http.Error(w, "token and a purpose of at most 200 characters are required", http.StatusBadRequest)
+		return
+	}
+
+	var t SensitiveToken
+	var sealed string
+	err = db.QueryRowContext(r.Context(), `SELECT token, token_type, scope, value_encrypted, created_at FROM sensitive_tokens WHERE token = $1`,
+		requestBody.Token).Scan(&t.Token, &t.TokenType, &t.Scope, &sealed, &t.CreatedAt)
+	if err == sql.ErrNoRows {
+		logTokenAccess(r, requestBody.Token, "detokenize", "", requestBody.Purpose, "not_found")
+		http.Error(w, "Token not found", http.StatusNotFound)
+		return
+	}
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	if !hasRole(r, tokenScopeRoles()[t.Scope]...) {
+		logTokenAccess(r, t.Token, "detokenize", t.Scope, requestBody.Purpose, "denied")
+		http.Error(w, "Insufficient permissions", http.StatusForbidden)
+		return
+	}
+
+	t.Value, err = openTokenValue(t.Token, sealed)
+	if err != nil {
+		http.Error(w, "Token value could not be decrypted", http.StatusInternalServerError)
+		return
+	}
+	logTokenAccess(r, t.Token, "detokenize", t.Scope, requestBody.Purpose, "granted")
+
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Cache-Control", "no-store")
+	json.NewEncoder(w).Encode(t)
+}
+
+// getTokenAccessLog lists token audit records, newest first, optionally for
+// one token (?token=) and since a date (?since=YYYY-MM-DD)
+func getTokenAccessLog(w http.ResponseWriter, r *http.Request) {
+	if !requireRole(w, r, tokenAuditRoles...) {
+		return
+	}
+	since := r.URL.Query().Get("since")
+	if since == "" {
+		since = time.Now().AddDate(0, 0, -30).Format("2006-01-02")
+	}
+	if _, err := time.Parse("2006-01-02", since); err != nil {
+		http.Error(w, "since must be YYYY-MM-DD", http.StatusBadRequest)
+		return
+	}
+
+	rows, err := db.QueryContext(r.Context(), `SELECT id, token, operation, scope, actor, role, purpose, outcome, created_at
+						   FROM token_access_log WHERE created_at >= $1 AND ($2 = '' OR token = $2)
+						   ORDER BY created_at DESC, id DESC LIMIT 1000`, since, r.URL.Query().Get("token"))
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	defer rows.Close()
+
+	entries := []TokenAccess{}
+	for rows.Next() {
+		var a TokenAccess
+		err := rows.Scan(&a.ID, &a.Token, &a.Operation, &a.Scope, &a.Actor, &a.Role, &a.Purpose, &a.Outcome, &a.CreatedAt)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		entries = append(entries, a)
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(entries)
+}
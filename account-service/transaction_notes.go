@@ -0,0 +1,380 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+	"unicode/utf8"
+
+	"github.com/gorilla/mux"
+	"github.com/lib/pq"
+)
+
+// TransactionAnnotation is the customer's private note and receipts for a
+// transaction. Annotations never change the transaction itself.
+type TransactionAnnotation struct {
+	AccountID     int          `json:"account_id"`
+	TransactionID int          `json:"transaction_id"`
+	Note          string       `json:"note"`
+	Attachments   []Attachment `json:"attachments"`
+	UpdatedAt     string       `json:"updated_at,omitempty"`
+}
+
+// Attachment is a receipt or document uploaded against a transaction
+type Attachment struct {
+	ID            int    `json:"id"`
+	TransactionID int    `json:"transaction_id"`
+	Filename      string `json:"filename"`
+	ContentType   string `json:"content_type"`
+	SizeBytes     int    `json:"size_bytes"`
+	CreatedAt     string `json:"created_at"`
+	DownloadURL   string `json:"download_url,omitempty"`
+	objectKey     string
+}
+
+const transactionNoteTablesSQL = `
+	CREATE TABLE IF NOT EXISTS transaction_notes (
+		account_id INTEGER NOT NULL REFERENCES accounts(id),
+		transaction_id INTEGER NOT NULL,
+		note TEXT NOT NULL,
+		updated_at TIMESTAMP NOT NULL DEFAULT NOW(),
+		PRIMARY KEY (account_id, transaction_id)
+	);
+	CREATE TABLE IF NOT EXISTS transaction_attachments (
+		id SERIAL PRIMARY KEY,
+		account_id INTEGER NOT NULL REFERENCES accounts(id),
+		transaction_id INTEGER NOT NULL,
+		filename VARCHAR(255) NOT NULL,
+		content_type VARCHAR(100) NOT NULL,
+		size_bytes INTEGER NOT NULL,
+		object_key VARCHAR(255) NOT NULL,
+		created_at TIMESTAMP NOT NULL DEFAULT NOW()
+	);
+	CREATE INDEX IF NOT EXISTS idx_transaction_attachments_txn ON transaction_attachments (account_id, transaction_id);`
+
+// Annotation limits
+const (
+	maxNoteLength      = 1000
+	maxAttachmentBytes = 10 << 20
+	attachmentLinkTTL  = time.Hour
+)
+
+var attachmentContentTypes = map[string]bool{
+	"application/pdf": true,
+	"image/jpeg":      true,
+	"image/png":       true,
+	"image/heic":      true,
+}
+
+// transactionParams reads and validates the account and transaction IDs
+func transactionParams(r *http.Request) (int, int, error) {
+	params := mux.Vars(r)
+	accountID, err := strconv.Atoi(params["id"])
+	if err != nil {
+		return 0, 0, fmt.Errorf("Invalid account ID")
+	}
+	transactionID, err := strconv.Atoi(params["txnId"])
+	if err != nil {
+		return 0, 0, fmt.Errorf("Invalid transaction ID")
+	}
+	return accountID, transactionID, nil
+}
+
+func getTransactionAnnotation(w http.ResponseWriter, r *http.Request) {
+	accountID, transactionID, err := transactionParams(r)
+	if err != nil {
+		http.Error(w, "Invalid account or transaction ID", http.StatusBadRequest)
+		return
+	}
+
+	annotations, err := loadAnnotations(r.Context(), accountID, []int{transactionID})
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(annotations[0])
+}
+
+// setTransactionNote replaces the note on a transaction; an empty note removes it
+func setTransactionNote(w http.ResponseWriter, r *http.Request) {
+	accountID, transactionID, err := transactionParams(r)
+	if err != nil {
+		http.Error(w, "Invalid account or transaction ID", http.StatusBadRequest)
+		return
+	}
+
+	var req struct {
+		Note string `json:"note"`
+	}
+	err = json.NewDecoder(r.Body).Decode(&req)
+	if err != nil {
+		http.Error(w, "Invalid request body", http.StatusBadRequest)
+		return
+	}
+
+	req.Note = strings.TrimSpace(req.Note)
+	if utf8.RuneCountInString(req.Note) > maxNoteLength {
+		http.Error(w, fmt.Sprintf("note must be at most %d characters", maxNoteLength), http.StatusBadRequest)
+		return
+	}
+
+	if req.Note == "" {
+		_, err = db.ExecContext(r.Context(), `DELETE FROM transaction_notes WHERE account_id = $1 AND transaction_id = $2`,
+			accountID, transactionID)
+	} else {
+		var inserted string
+		err = db.QueryRowContext(r.Context(), `INSERT INTO transaction_notes (account_id, transaction_id, note)
+						   SELECT id, $2, $3 FROM accounts WHERE id = $1
+						   ON CONFLICT (account_id, transaction_id) DO UPDATE SET note = EXCLUDED.note, updated_at = NOW()
+						   RETURNING updated_at`, accountID, transactionID, req.Note).Scan(&inserted)
+	}
+	if err != nil {
+		if err == sql.ErrNoRows {
+			http.Error(w, "Account not found", http.StatusNotFound)
+		} else {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+		}
+		return
+	}
+
+	getTransactionAnnotation(w, r)
+}
+
+// uploadTransactionAttachment stores a receipt sent as the "file" field of a
+// multipart form
+func uploadTransactionAttachment(w http.ResponseWriter, r *http.Request) {
+	accountID, transactionID, err := transactionParams(r)
+	if err != nil {
+		http.Error(w, "Invalid account or transaction ID", http.StatusBadRequest)
+		return
+	}
+
+	r.Body = http.MaxBytesReader(w, r.Body, maxAttachmentBytes+1<<20)
+	file, header, err := r.FormFile("file")
+	if err != nil {
+		http.Error(w, "A file upload is required", http.StatusBadRequest)
+		return
+	}
+	defer file.Close()
+
+	data, err := io.ReadAll(io.LimitReader(file, maxAttachmentBytes+1))
+	if err != nil {
+		http.Error(w, "The uploaded file could not be read", http.StatusBadRequest)
+		return
+	}
+	if len(data) > maxAttachmentBytes {
+		http.Error(w, "Attachments are limited to 10 MB", http.StatusRequestEntityTooLarge)
+		return
+	}
+
+	contentType := http.DetectContentType(data)
+	if header.Header.Get("Content-Type") == "image/heic" {
+		contentType = "image/heic"
+	}
+	if !attachmentContentTypes[contentType] {
+		http.Error(w, "Attachments must be PDF, JPEG, PNG or HEIC", http.StatusUnsupportedMediaType)
+		return
+	}
+
+	a := Attachment{
+		TransactionID: transactionID,
+		Filename:      filepath.Base(header.Filename),
+		ContentType:   contentType,
+		SizeBytes:     len(data),
+	}
+	a.objectKey = fmt.Sprintf("attachments/%d/%d/%d", accountID, transactionID, time.Now().UnixNano())
+
+	err = objectStore.Put(r.Context(), a.objectKey, data)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	err = db.QueryRowContext(r.Context(), `INSERT INTO transaction_attachments (account_id, transaction_id, filename, content_type, size_bytes, object_key)
+					   SELECT id, $2, $3, $4, $5, $6 FROM accounts WHERE id = $1
+					   RETURNING id, created_at`, accountID, transactionID, a.Filename, a.ContentType, a.SizeBytes,
+		a.objectKey).Scan(&a.ID, &a.CreatedAt)
+	if err != nil {
+		objectStore.Delete(r.Context(), a.objectKey)
+		if err == sql.ErrNoRows {
+			http.Error(w, "Account not found", http.StatusNotFound)
+		} else {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+		}
+		return
+	}
+	a.DownloadURL = signDownloadPath(fmt.Sprintf("/v1/attachments/%d/download", a.ID), attachmentLinkTTL)
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusCreated)
+	json.NewEncoder(w).Encode(a)
+}
+
+func deleteTransactionAttachment(w http.ResponseWriter, r *http.Request) {
+	accountID, transactionID, err := transactionParams(r)
+	if err != nil {
+		http.Error(w, "Invalid account or transaction ID", http.StatusBadRequest)
+		return
+	}
+
+	var key string
+	err = db.QueryRowContext(r.Context(), `DELETE FROM transaction_attachments WHERE id = $1 AND account_id = $2 AND transaction_id = $3
+					   RETURNING object_key`, mux.Vars(r)["attachmentId"], accountID, transactionID).Scan(&key)
+	if err != nil {
+		if err == sql.ErrNoRows {
+			http.Error(w, "Attachment not found", http.StatusNotFound)
+		} else {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+		}
+		return
+	}
+
+	err = objectStore.Delete(r.Context(), key)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// downloadAttachment serves an attachment to holders of a valid signed link
+func downloadAttachment(w http.ResponseWriter, r *http.Request) {
+	if !verifyDownloadSignature(r) {
+		http.Error(w, "Invalid or expired link", http.StatusForbidden)
+		return
+	}
+
+	var a Attachment
+	err := db.QueryRowContext(r.Context(), `SELECT filename, content_type, object_key FROM transaction_attachments WHERE id = $1`,
+		mux.Vars(r)["id"]).Scan(&a.Filename, &a.ContentType, &a.objectKey)
+	if err != nil {
+		if err == sql.ErrNoRows {
+			http.Error(w, "Attachment not found", http.StatusNotFound)
+		} else {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+		}
+		return
+	}
+
+	data, err := objectStore.Get(r.Context(), a.objectKey)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", a.ContentType)
+	w.Header().Set("Content-Disposition", fmt.Sprintf("attachment; filename=%q", a.Filename))
+	w.Write(data)
+}
+
+// searchTransactionAnnotations finds the account's transactions whose note or
+// attachment filenames contain q
+func searchTransactionAnnotations(w http.ResponseWriter, r *http.Request) {
+	params := mux.Vars(r)
+	accountID, err := strconv.Atoi(params["id"])
+	if err != nil {
+		http.Error(w, "Invalid account ID", http.StatusBadRequest)
+		return
+	}
+
+	q := strings.TrimSpace(r.URL.Query().Get("q"))
+	if q == "" {
+		http.Error(w, "q is required", http.StatusBadRequest)
+		return
+	}
+	limit, err := strconv.Atoi(r.URL.Query().Get("limit"))
+	if err != nil || limit <= 0 || limit > 100 {
+		limit = 20
+	}
+
+	// Escape LIKE wildcards so the query is matched literally
+	pattern := "%" + strings.NewReplacer(`\`, `\\`, "%", `\%`, "_", `\_`).Replace(q) + "%"
+	rows, err := db.QueryContext(r.Context(), `SELECT transaction_id FROM transaction_notes WHERE account_id = $1 AND note ILIKE $2
+						   UNION
+						   SELECT transaction_id FROM transaction_attachments WHERE account_id = $1 AND filename ILIKE $2
+						   ORDER BY transaction_id DESC LIMIT $3`, accountID, pattern, limit)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	defer rows.Close()
+
+	ids := []int{}
+	for rows.Next() {
+		var id int
+		if err := rows.Scan(&id); err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		ids = append(ids, id)
+	}
+
+	annotations, err := loadAnnotations(r.Context(), accountID, ids)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(annotations)
+}
+
+// loadAnnotations returns one annotation per transaction ID, in the given order
+func loadAnnotations(ctx context.Context, accountID int, transactionIDs []int) ([]TransactionAnnotation, error) {
+	annotations := make([]TransactionAnnotation, len(transactionIDs))
+	index := map[int]*TransactionAnnotation{}
+	for i, id := range transactionIDs {
+		annotations[i] = TransactionAnnotation{AccountID: accountID, TransactionID: id, Attachments: []Attachment{}}
+		index[id] = &annotations[i]
+	}
+	if len(transactionIDs) == 0 {
+		return annotations, nil
+	}
+
+	rows, err := db.QueryContext(ctx, `SELECT transaction_id, note, updated_at FROM transaction_notes
+						   WHERE account_id = $1 AND transaction_id = ANY($2)`, accountID, pq.Array(transactionIDs))
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var id int
+		var note, updatedAt string
+		if err := rows.Scan(&id, &note, &updatedAt); err != nil {
+			return nil, err
+		}
+		index[id].Note = note
+		index[id].UpdatedAt = updatedAt
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+
+	rows, err = db.QueryContext(ctx, `SELECT id, transaction_id, filename, content_type, size_bytes, created_at
+						  FROM transaction_attachments WHERE account_id = $1 AND transaction_id = ANY($2)
+						  ORDER BY created_at`, accountID, pq.Array(transactionIDs))
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var a Attachment
+		err := rows.Scan(&a.ID, &a.TransactionID, &a.Filename, &a.ContentType, &a.SizeBytes, &a.CreatedAt)
+		if err != nil {
+			return nil, err
+		}
+		a.DownloadURL = signDownloadPath(fmt.Sprintf("/v1/attachments/%d/download", a.ID), attachmentLinkTTL)
+		index[a.TransactionID].Attachments = append(index[a.TransactionID].Attachments, a)
+	}
+	return annotations, rows.Err()
+}
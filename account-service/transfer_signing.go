@@ -0,0 +1,87 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strconv"
+
+	"bank/servicekit"
+
+	"go.uber.org/zap"
+)
+
+// highValueTransferThreshold is the amount from which a transfer must be
+// confirmed with a signature from the customer's registered device key
+func highValueTransferThreshold() Money {
+	threshold, err := parseMoney(getEnv("HIGH_VALUE_TRANSFER_THRESHOLD", "10000"))
+	if err != nil {
+		return 1000000
+	}
+	return threshold
+}
+
+// transferSigningPayload is the canonical text the device signs. It names
+// every detail of the transfer so a signature cannot be reused for another.
+func transferSigningPayload(fromID, toID int, amount Money, currency, nonce string, timestamp int64) string {
+	return fmt.Sprintf("transfer:v1\nfrom=%d\nto=%d\namount=%s\ncurrency=%s\nnonce=%s\ntimestamp=%d",
+		fromID, toID, amount, currency, nonce, timestamp)
+}
+
+// requireTransferSignature writes an error and returns false unless a
+// high-value transfer carries a valid device signature in the
+// X-Signature-Key-ID, X-Signature, X-Signature-Nonce and X-Signature-Timestamp
+// headers. auth-service checks the key belongs to the caller and that the
+// nonce has not been used before.
+func requireTransferSignature(w http.ResponseWriter, r *http.Request, fromID, toID int, amount Money,
+	currency string) bool {
+	if amount < highValueTransferThreshold() {
+		return true
+	}
+
+	keyID, keyErr := strconv.Atoi(r.Header.Get("X-Signature-Key-ID"))
+	timestamp, tsErr := strconv.ParseInt(r.Header.Get("X-Signature-Timestamp"), 10, 64)
+	nonce, signature := r.Header.Get("X-Signature-Nonce"), r.Header.Get("X-Signature")
+	if keyErr != nil || tsErr != nil || nonce == "" || signature == "" {
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusPreconditionRequired)
+		json.NewEncoder(w).Encode(map[string]interface{}{
+			"error":   "Transfers of this amount must be confirmed with a device signature",
+			"payload": transferSigningPayload(fromID, toID, amount, currency, "{nonce}", 0),
+		})
+		return false
+	}
+
+	payload, _ := json.Marshal(map[string]interface{}{
+		"key_id":    keyID,
+		"payload":   transferSigningPayload(fromID, toID, amount, currency, nonce, timestamp),
+		"signature": signature,
+		"nonce":     nonce,
+		"timestamp": timestamp,
+	})
+	url := getEnv("AUTH_SERVICE_URL", "http://localhost:8082") + "/v1/device-keys/verify"
+	req, err := http.NewRequestWithContext(r.Context(), http.MethodPost, url, bytes.NewReader(payload))
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return false
+	}
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("Authorization", r.Header.Get("Authorization"))
+	if forwarded := r.Header.Get("X-Forwarded-For"); forwarded != "" {
+		req.Header.Set("X-Forwarded-For", forwarded)
+	}
+
+	resp, err := serviceClient.Do(req)
+	if err != nil {
+		servicekit.RequestLogger(r.Context()).Error("transfer signature check failed", zap.Error(err))
+		http.Error(w, "Signature verification unavailable", http.StatusBadGateway)
+		return false
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		http.Error(w, "Invalid transfer signature", http.StatusUnauthorized)
+		return false
+	}
+	return true
+}
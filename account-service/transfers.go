@@ -0,0 +1,358 @@
+package main
+
+import (
+	"context"
+	"crypto/rand"
+	"database/sql"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"strings"
+
+	"github.com/gorilla/mux"
+)
+
+// Transfer is a customer-initiated movement between two accounts
+type Transfer struct {
+	ID            int    `json:"id"`
+	Reference     string `json:"reference"`
+	FromAccountID int    `json:"from_account_id"`
+	ToAccountID   int    `json:"to_account_id"`
+	Amount        Money  `json:"amount"`
+	CurrencyCode  string `json:"currency_code"`
+	Description   string `json:"description,omitempty"`
+	Status        string `json:"status"`
+	CreatedBy     string `json:"created_by"`
+	CreatedAt     string `json:"created_at"`
+}
+
+const transferTablesSQL = `
+	CREATE TABLE IF NOT EXISTS transfers (
+		id SERIAL PRIMARY KEY,
+		reference VARCHAR(30) NOT NULL UNIQUE,
+		from_account_id INTEGER NOT NULL REFERENCES accounts(id),
+		to_account_id INTEGER NOT NULL REFERENCES accounts(id),
+		amount DECIMAL(15,2) NOT NULL CHECK (amount > 0),
+		currency_code VARCHAR(3) NOT NULL,
+		description VARCHAR(140) NOT NULL DEFAULT '',
+		status VARCHAR(20) NOT NULL DEFAULT 'completed',
+		created_by VARCHAR(100) NOT NULL,
+		created_at TIMESTAMP NOT NULL DEFAULT NOW()
+	);
+	CREATE INDEX IF NOT EXISTS idx_transfers_from ON transfers(from_account_id);
+	CREATE INDEX IF NOT EXISTS idx_transfers_to ON transfers(to_account_id);`
+
+const transferColumns = `id, reference, from_account_id, to_account_id, amount, currency_code, description, status,
+	created_by, created_at`
+
+func scanTransfer(row interface{ Scan(...interface{}) error }, t *Transfer) error {
+	return row.Scan(&t.ID, &t.Reference, &t.FromAccountID, &t.ToAccountID, &t.Amount, &t.CurrencyCode,
+		&t.Description, &t.Status, &t.CreatedBy, &t.CreatedAt)
+}
+
+func newTransferReference() string {
+	raw := make([]byte, 8)
+	rand.Read(raw)
+	return "TRF-" + strings.ToUpper(hex.EncodeToString(raw))
+}
+
+// Errors returned by internalTransfer
+var (
+	ErrTransferAccountNotFound = errors.New("Account not found")
+	ErrTransferAccountInactive = errors.New("Account is not active")
+	ErrTransferCurrency        = errors.New("Accounts use different currencies")
+	ErrInsufficientFunds       = errors.New("Insufficient funds")
+	ErrOverdraftLimitExceeded  = errors.New("Overdraft limit exceeded")
+)
+
+// internalTransfer moves funds between two accounts inside tx and queues both
+// legs for the core and the transfer for the ledger. Rows are locked in ID order so concurrent transfers
+// between the same accounts cannot deadlock.
+func internalTransfer(ctx context.Context, tx *sql.Tx, fromID, toID int, amount Money, description string) error {
+	return transferFunds(ctx, tx, fromID, toID, amount, description, "active")
+}
+
+// transferFunds is internalTransfer for a source account in sourceStatus,
+// used by supervised workflows that move funds out of frozen accounts
+func transferFunds(ctx context.Context, tx *sql.Tx, fromID, toID int, amount Money, description, sourceStatus string) error {
+	first, second := fromID, toID
+	if second < first {
+		first, second = second, first
+	}
+
+	type lockedAccount struct {
+		available Money // balance less active liens
+		overdraft Money
+		currency  string
+		status    string
+	}
+	locked := map[int]lockedAccount{}
+	for _, id := range []int{first, second} {
+		var a lockedAccount
+		err := tx.QueryRowContext(ctx, `SELECT balance, overdraft_limit, currency_code, status FROM accounts
+										WHERE id = $1 FOR UPDATE`, id).Scan(&a.available, &a.overdraft, &a.currency, &a.status)
+		if err == sql.ErrNoRows {
+			return ErrTransferAccountNotFound
+		}
+		if err != nil {
+			return err
+		}
+		if (id == fromID && a.status != sourceStatus) || (id == toID && a.status != "active") {
+			return ErrTransferAccountInactive
+		}
+		liens, err := activeLienTotal(ctx, tx, id)
+		if err != nil {
+			return err
+		}
+		a.available -= liens
+		locked[id] = a
+	}
+
+	from, to := locked[fromID], locked[toID]
+	if from.currency != to.currency {
+		return ErrTransferCurrency
+	}
+	if err := checkFunds(from.available, from.overdraft, amount); err != nil {
+		return err
+	}
+
+	_, err := tx.ExecContext(ctx, `UPDATE accounts SET balance = balance - $1, updated_at = NOW() WHERE id = $2`,
+		amount, fromID)
+	if err != nil {
+		return balanceUpdateError(err)
+	}
+	_, err = tx.ExecContext(ctx, `UPDATE accounts SET balance = balance + $1, updated_at = NOW() WHERE id = $2`,
+		amount, toID)
+	if err != nil {
+		return err
+	}
+
+	err = queueCorePosting(ctx, tx, CorePosting{AccountID: fromID, Amount: -amount, Currency: from.currency,
+		Description: description})
+	if err == nil {
+		err = queueCorePosting(ctx, tx, CorePosting{AccountID: toID, Amount: amount, Currency: to.currency,
+			Description: description})
+	}
+	if err != nil {
+		return err
+	}
+	return recordInLedger(ctx, tx, LedgerPosting{Type: "transfer", Amount: amount, CurrencyCode: from.currency,
+		SourceAccountID: &fromID, DestinationAccountID: &toID, Description: description})
+}
+
+// transferErrorStatus maps an internalTransfer error to an HTTP status
+func transferErrorStatus(err error) int {
+	switch {
+	case errors.Is(err, ErrTransferAccountNotFound):
+		return http.StatusNotFound
+	case errors.Is(err, ErrTransferAccountInactive), errors.Is(err, ErrTransferCurrency):
+		return http.StatusConflict
+	case errors.Is(err, ErrInsufficientFunds), errors.Is(err, ErrOverdraftLimitExceeded):
+		return http.StatusBadRequest
+	case errors.Is(err, ErrLedgerPosting):
+		return http.StatusBadGateway
+	}
+	return http.StatusInternalServerError
+}
+
+// transferErrorMessage is what a client is told about an internalTransfer
+// error: the fixed text of a known error, never the detail wrapped into it.
+// Any other error is internal and answered with its own text, which
+// ErrorReportingMiddleware logs and masks.
+func transferErrorMessage(err error) string {
+	for _, known := range []error{ErrTransferAccountNotFound, ErrTransferAccountInactive, ErrTransferCurrency,
+		ErrInsufficientFunds, ErrOverdraftLimitExceeded, ErrLedgerPosting} {
+		if errors.Is(err, known) {
+			return known.Error()
+		}
+	}
+	return err.Error()
+}
+
+// writeTransferError answers an internalTransfer error
+func writeTransferError(w http.ResponseWriter, err error) {
+	http.Error(w, transferErrorMessage(err), transferErrorStatus(err))
+}
+
+// postBalanceChange credits (positive amount) or debits (negative amount) a
+// single account inside tx and queues the change for the core and the ledger
+func postBalanceChange(ctx context.Context, tx *sql.Tx, accountID int, amount Money, description string) error {
+	currency, err := applyBalanceChange(ctx, tx, accountID, amount, description)
+	if err != nil {
+		return err
+	}
+	return recordInLedger(ctx, tx, ledgerChange(accountID, amount, currency, description))
+}
+
+// applyBalanceChange is postBalanceChange without the ledger posting, for
+// callers that post the bank's side somewhere other than the default GL
+// account. It returns the account's currency.
+func applyBalanceChange(ctx context.Context, tx *sql.Tx, accountID int, amount Money, description string) (string, error) {
+	var balance, overdraft Money
+	var currency, status string
+	err := tx.QueryRowContext(ctx, `SELECT balance, overdraft_limit, currency_code, status FROM accounts
+									WHERE id = $1 FOR UPDATE`, accountID).Scan(&balance, &overdraft, &currency, &status)
+	if err == sql.ErrNoRows {
+		return "", ErrTransferAccountNotFound
+	}
+	if err != nil {
+		return "", err
+	}
+	if status != "active" {
+		return "", ErrTransferAccountInactive
+	}
+	if amount < 0 {
+		liens, err := activeLienTotal(ctx, tx, accountID)
+		if err != nil {
+			return "", err
+		}
+		if err := checkFunds(balance-liens, overdraft, -amount); err != nil {
+			return "", err
+		}
+	}
+
+	_, err = tx.ExecContext(ctx, `UPDATE accounts SET balance = balance + $1, updated_at = NOW() WHERE id = $2`,
+		amount, accountID)
+	if err != nil {
+		return "", balanceUpdateError(err)
+	}
+
+	err = queueCorePosting(ctx, tx, CorePosting{AccountID: accountID, Amount: amount, Currency: currency,
+		Description: description})
+	if err != nil {
+		return "", err
+	}
+	return currency, nil
+}
+
+// createTransfer moves funds between two accounts, named by ID or by
+// from_account_number and to_account_number. The balance updates, the
+// transfer record and the core and ledger postings, queued in the outbox,
+// share one database transaction, so either all of them happen or none do.
+func createTransfer(w http.ResponseWriter, r *http.Request) {
+	if !requireRole(w, r, fundsMovementRoles...) {
+		return
+	}
+
+	var req struct {
+		Transfer
+		FromAccountNumber string `json:"from_account_number"`
+		ToAccountNumber   string `json:"to_account_number"`
+	}
+	err := json.NewDecoder(r.Body).Decode(&req)
+	if err != nil {
+		http.Error(w, "Invalid request body", http.StatusBadRequest)
+		return
+	}
+	t := req.Transfer
+	for number, id := range map[string]*int{req.FromAccountNumber: &t.FromAccountID, req.ToAccountNumber: &t.ToAccountID} {
+		if number == "" {
+			continue
+		}
+		if *id, err = accountIDByNumber(r.Context(), number); err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		if *id == 0 {
+			http.Error(w, ErrTransferAccountNotFound.Error(), http.StatusNotFound)
+			return
+		}
+	}
+	t.CurrencyCode = strings.ToUpper(strings.TrimSpace(t.CurrencyCode))
+	t.Description = strings.TrimSpace(t.Description)
+	if t.FromAccountID == 0 || t.ToAccountID == 0 || t.FromAccountID == t.ToAccountID {
+		http.Error(w, "from_account_id and to_account_id must be two different accounts", http.StatusBadRequest)
+		return
+	}
+	if t.Amount <= 0 {
+		http.Error(w, "Amount must be positive", http.StatusBadRequest)
+		return
+	}
+	if len(t.CurrencyCode) != 3 {
+		http.Error(w, "currency_code is required", http.StatusBadRequest)
+		return
+	}
+	if len(t.Description) > 140 {
+		http.Error(w, "description must be at most 140 characters", http.StatusBadRequest)
+		return
+	}
+	if !requireOwnAccount(w, r, t.FromAccountID) {
+		return
+	}
+
+	tx, err := db.BeginTx(r.Context(), nil)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	defer tx.Rollback()
+
+	// The requested currency must be the one both accounts hold; internalTransfer
+	// rejects accounts in different currencies
+	var currency string
+	err = tx.QueryRowContext(r.Context(), `SELECT currency_code FROM accounts WHERE id = $1`, t.FromAccountID).Scan(&currency)
+	if err == sql.ErrNoRows {
+		http.Error(w, ErrTransferAccountNotFound.Error(), http.StatusNotFound)
+		return
+	}
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	if currency != t.CurrencyCode {
+		http.Error(w, ErrTransferCurrency.Error(), http.StatusConflict)
+		return
+	}
+	if !requireTransferSignature(w, r, t.FromAccountID, t.ToAccountID, t.Amount, t.CurrencyCode) {
+		return
+	}
+
+	t.Reference = newTransferReference()
+	description := "Transfer " + t.Reference
+	if t.Description != "" {
+		description += ": " + t.Description
+	}
+	err = internalTransfer(r.Context(), tx, t.FromAccountID, t.ToAccountID, t.Amount, description)
+	if errors.Is(err, ErrInsufficientFunds) || errors.Is(err, ErrOverdraftLimitExceeded) {
+		writeFundsError(w, err)
+		return
+	}
+	if err != nil {
+		writeTransferError(w, err)
+		return
+	}
+
+	err = scanTransfer(tx.QueryRowContext(r.Context(), `INSERT INTO transfers (reference, from_account_id, to_account_id, amount,
+									currency_code, description, created_by)
+									VALUES ($1, $2, $3, $4, $5, $6, $7) RETURNING `+transferColumns,
+		t.Reference, t.FromAccountID, t.ToAccountID, t.Amount, t.CurrencyCode, t.Description, requestActor(r)), &t)
+	if err == nil {
+		err = tx.Commit()
+	}
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusCreated)
+	json.NewEncoder(w).Encode(t)
+}
+
+func getTransfer(w http.ResponseWriter, r *http.Request) {
+	var t Transfer
+	err := scanTransfer(db.QueryRowContext(r.Context(), `SELECT `+transferColumns+` FROM transfers WHERE reference = $1`,
+		mux.Vars(r)["reference"]), &t)
+	if err == sql.ErrNoRows {
+		http.Error(w, "Transfer not found", http.StatusNotFound)
+		return
+	}
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(t)
+}
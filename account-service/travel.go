@@ -0,0 +1,237 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"net/http"
+	"regexp"
+	"strings"
+	"time"
+
+	"bank/servicekit"
+
+	"github.com/gorilla/mux"
+)
+
+// TravelNotice tells fraud rules that the customer is abroad in the listed countries
+type TravelNotice struct {
+	ID          int      `json:"id"`
+	AccountID   int      `json:"account_id"`
+	Countries   []string `json:"countries"`
+	StartDate   string   `json:"start_date"`
+	EndDate     string   `json:"end_date"`
+	Status      string   `json:"status"` // active, cancelled or expired
+	CreatedAt   string   `json:"created_at"`
+	CancelledAt string   `json:"cancelled_at,omitempty"`
+}
+
+const travelTablesSQL = `
+	CREATE TABLE IF NOT EXISTS travel_notices (
+		id SERIAL PRIMARY KEY,
+		account_id INTEGER NOT NULL REFERENCES accounts(id),
+		countries VARCHAR(255) NOT NULL,
+		start_date DATE NOT NULL,
+		end_date DATE NOT NULL,
+		status VARCHAR(20) NOT NULL DEFAULT 'active',
+		created_at TIMESTAMP NOT NULL DEFAULT NOW(),
+		cancelled_at TIMESTAMP
+	);
+
+	CREATE TABLE IF NOT EXISTS travel_notice_audit (
+		id SERIAL PRIMARY KEY,
+		notice_id INTEGER NOT NULL REFERENCES travel_notices(id),
+		action VARCHAR(20) NOT NULL,
+		actor VARCHAR(100) NOT NULL,
+		created_at TIMESTAMP NOT NULL DEFAULT NOW()
+	);`
+
+// maxTravelNoticeDays bounds how long fraud rules may be relaxed for
+const maxTravelNoticeDays = 90
+
+var countryCodePattern = regexp.MustCompile(`^[A-Z]{2}$`)
+
+func createTravelNotice(w http.ResponseWriter, r *http.Request) {
+	params := mux.Vars(r)
+	id := params["id"]
+
+	var notice TravelNotice
+	err := json.NewDecoder(r.Body).Decode(&notice)
+	if err != nil {
+		http.Error(w, "Invalid request body", http.StatusBadRequest)
+		return
+	}
+
+	if len(notice.Countries) == 0 {
+		http.Error(w, "At least one country is required", http.StatusBadRequest)
+		return
+	}
+	for i, c := range notice.Countries {
+		notice.Countries[i] = strings.ToUpper(strings.TrimSpace(c))
+		if !countryCodePattern.MatchString(notice.Countries[i]) {
+			http.Error(w, "Countries must be ISO 3166-1 alpha-2 codes", http.StatusBadRequest)
+			return
+		}
+	}
+
+	start, err1 := time.Parse("2006-01-02", notice.StartDate)
+	end, err2 := time.Parse("2006-01-02", notice.EndDate)
+	if err1 != nil || err2 != nil {
+		http.Error(w, "start_date and end_date must be YYYY-MM-DD", http.StatusBadRequest)
+		return
+	}
+	today := time.Now().UTC().Truncate(24 * time.Hour)
+	if end.Before(start) || end.Before(today) {
+		http.Error(w, "end_date must be after start_date and not in the past", http.StatusBadRequest)
+		return
+	}
+	if end.Sub(start) > maxTravelNoticeDays*24*time.Hour {
+		http.Error(w, "Travel notices can cover at most 90 days", http.StatusBadRequest)
+		return
+	}
+
+	tx, err := db.BeginTx(r.Context(), nil)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	defer tx.Rollback()
+
+	query := `INSERT INTO travel_notices (account_id, countries, start_date, end_date)
+			  SELECT id, $2, $3, $4 FROM accounts WHERE id = $1
+			  RETURNING id, account_id, status, created_at`
+
+	err = tx.QueryRowContext(r.Context(), query, id, strings.Join(notice.Countries, ","), notice.StartDate, notice.EndDate).Scan(&notice.ID,
+		&notice.AccountID, &notice.Status, &notice.CreatedAt)
+	if err != nil {
+		if err == sql.ErrNoRows {
+			http.Error(w, "Account not found", http.StatusNotFound)
+		} else {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+		}
+		return
+	}
+
+	err = auditTravelNotice(r.Context(), tx, notice.ID, "created", requestActor(r))
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	err = tx.Commit()
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusCreated)
+	json.NewEncoder(w).Encode(notice)
+}
+
+func listTravelNotices(w http.ResponseWriter, r *http.Request) {
+	params := mux.Vars(r)
+
+	rows, err := db.QueryContext(r.Context(), `SELECT id, account_id, countries, start_date::text, end_date::text, status,
+						   created_at, COALESCE(cancelled_at::text, '')
+						   FROM travel_notices WHERE account_id = $1 ORDER BY start_date DESC`, params["id"])
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	defer rows.Close()
+
+	notices := []TravelNotice{}
+	for rows.Next() {
+		var n TravelNotice
+		var countries string
+		err := rows.Scan(&n.ID, &n.AccountID, &countries, &n.StartDate, &n.EndDate, &n.Status,
+			&n.CreatedAt, &n.CancelledAt)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		n.Countries = strings.Split(countries, ",")
+		notices = append(notices, n)
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(notices)
+}
+
+func cancelTravelNotice(w http.ResponseWriter, r *http.Request) {
+	params := mux.Vars(r)
+
+	tx, err := db.BeginTx(r.Context(), nil)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	defer tx.Rollback()
+
+	var noticeID int
+	err = tx.QueryRowContext(r.Context(), `UPDATE travel_notices SET status = 'cancelled', cancelled_at = NOW()
+					   WHERE id = $1 AND account_id = $2 AND status = 'active' RETURNING id`,
+		params["noticeId"], params["id"]).Scan(&noticeID)
+	if err != nil {
+		if err == sql.ErrNoRows {
+			http.Error(w, "Active travel notice not found", http.StatusNotFound)
+		} else {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+		}
+		return
+	}
+
+	err = auditTravelNotice(r.Context(), tx, noticeID, "cancelled", requestActor(r))
+	if err == nil {
+		err = tx.Commit()
+	}
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	w.WriteHeader(http.StatusNoContent)
+}
+
+func auditTravelNotice(ctx context.Context, tx *sql.Tx, noticeID int, action, actor string) error {
+	_, err := tx.ExecContext(ctx, `INSERT INTO travel_notice_audit (notice_id, action, actor)
+								   VALUES ($1, $2, $3)`, noticeID, action, actor)
+	return err
+}
+
+// travelNoticeCovers reports whether an active travel notice includes the
+// country today. Geo-based fraud rules use it to relax their checks.
+func travelNoticeCovers(ctx context.Context, accountID int, country string) (bool, error) {
+	var exists bool
+	err := db.QueryRowContext(ctx, `SELECT EXISTS(SELECT 1 FROM travel_notices
+									WHERE account_id = $1 AND status = 'active'
+									AND CURRENT_DATE BETWEEN start_date AND end_date
+									AND $2 = ANY(string_to_array(countries, ',')))`,
+		accountID, strings.ToUpper(country)).Scan(&exists)
+	return exists, err
+}
+
+// startTravelNoticeExpiry marks notices past their end date as expired and
+// records the expiry in the audit trail
+func startTravelNoticeExpiry() {
+	go func() {
+		defer servicekit.ReportJobPanic("Travel notice expiry")
+		for {
+			if err := expireTravelNotices(serviceContext); err != nil {
+				servicekit.ReportJobError("Travel notice expiry", err)
+			}
+			time.Sleep(time.Hour)
+		}
+	}()
+}
+
+func expireTravelNotices(ctx context.Context) error {
+	_, err := db.ExecContext(ctx, `WITH expired AS (
+									   UPDATE travel_notices SET status = 'expired'
+									   WHERE status = 'active' AND end_date < CURRENT_DATE
+									   RETURNING id)
+								   INSERT INTO travel_notice_audit (notice_id, action, actor)
+								   SELECT id, 'expired', 'system' FROM expired`)
+	return err
+}
@@ -0,0 +1,471 @@
+package main
+
+import (
+	"context"
+	"crypto/rand"
+	"database/sql"
+	"encoding/hex"
+	"encoding/json"
+	"net/http"
+	"strconv"
+	"strings"
+
+	"github.com/gorilla/mux"
+)
+
+// VirtualAccount is a ledger-only sub-account of a physical master account,
+// such as one per client or per property. Funds are held in the master; the
+// virtual balance tracks how much of it belongs to the sub-account.
+type VirtualAccount struct {
+	ID              int    `json:"id"`
+	MasterAccountID int    `json:"master_account_id"`
+	Reference       string `json:"reference"`
+	Name            string `json:"name"`
+	Balance         Money  `json:"balance"`
+	Status          string `json:"status"`
+	CreatedAt       string `json:"created_at"`
+	UpdatedAt       string `json:"updated_at"`
+}
+
+// IncomingPayment is a credit to a master account and where it was routed
+type IncomingPayment struct {
+	ID               int    `json:"id"`
+	MasterAccountID  int    `json:"master_account_id"`
+	Amount           Money  `json:"amount"`
+	Reference        string `json:"reference"`
+	Description      string `json:"description,omitempty"`
+	VirtualAccountID *int   `json:"virtual_account_id"` // null while unallocated
+	MatchStatus      string `json:"match_status"`       // matched or unmatched
+	MatchedType      string `json:"matched_type,omitempty"`
+	MatchedID        string `json:"matched_id,omitempty"`
+	MatchedRuleID    *int   `json:"matched_rule_id,omitempty"`
+	MatchedBy        string `json:"matched_by,omitempty"`
+	MatchedAt        string `json:"matched_at,omitempty"`
+	CreatedAt        string `json:"created_at"`
+}
+
+// VirtualAccountEntry is one movement of a virtual balance
+type VirtualAccountEntry struct {
+	ID                int    `json:"id"`
+	Amount            Money  `json:"amount"`
+	Description       string `json:"description"`
+	IncomingPaymentID *int   `json:"incoming_payment_id,omitempty"`
+	CreatedAt         string `json:"created_at"`
+}
+
+const virtualAccountTablesSQL = `
+	CREATE TABLE IF NOT EXISTS virtual_accounts (
+		id SERIAL PRIMARY KEY,
+		master_account_id INTEGER NOT NULL REFERENCES accounts(id),
+		reference VARCHAR(35) NOT NULL,
+		name VARCHAR(100) NOT NULL,
+		balance DECIMAL(15,2) NOT NULL DEFAULT 0,
+		status VARCHAR(20) NOT NULL DEFAULT 'active',
+		created_at TIMESTAMP NOT NULL DEFAULT NOW(),
+		updated_at TIMESTAMP NOT NULL DEFAULT NOW(),
+		UNIQUE (master_account_id, reference)
+	);
+	CREATE TABLE IF NOT EXISTS incoming_payments (
+		id SERIAL PRIMARY KEY,
+		master_account_id INTEGER NOT NULL REFERENCES accounts(id),
+		amount DECIMAL(15,2) NOT NULL,
+		reference VARCHAR(140) NOT NULL DEFAULT '',
+		description VARCHAR(255) NOT NULL DEFAULT '',
+		virtual_account_id INTEGER REFERENCES virtual_accounts(id),
+		created_at TIMESTAMP NOT NULL DEFAULT NOW()
+	);
+	CREATE INDEX IF NOT EXISTS idx_incoming_payments_master ON incoming_payments(master_account_id, created_at);
+	CREATE TABLE IF NOT EXISTS virtual_account_entries (
+		id SERIAL PRIMARY KEY,
+		virtual_account_id INTEGER NOT NULL REFERENCES virtual_accounts(id),
+		amount DECIMAL(15,2) NOT NULL,
+		description VARCHAR(255) NOT NULL,
+		incoming_payment_id INTEGER REFERENCES incoming_payments(id),
+		created_at TIMESTAMP NOT NULL DEFAULT NOW()
+	);`
+
+const virtualAccountColumns = `id, master_account_id, reference, name, balance, status, created_at, updated_at`
+
+const incomingPaymentColumns = `id, master_account_id, amount, reference, description, virtual_account_id,
+	match_status, matched_type, matched_id, matched_rule_id, matched_by, COALESCE(matched_at::text, ''), created_at`
+
+func scanVirtualAccount(row interface{ Scan(...interface{}) error }, v *VirtualAccount) error {
+	return row.Scan(&v.ID, &v.MasterAccountID, &v.Reference, &v.Name, &v.Balance, &v.Status, &v.CreatedAt, &v.UpdatedAt)
+}
+
+func scanIncomingPayment(row interface{ Scan(...interface{}) error }, p *IncomingPayment) error {
+	var virtualID, ruleID sql.NullInt64
+	err := row.Scan(&p.ID, &p.MasterAccountID, &p.Amount, &p.Reference, &p.Description, &virtualID,
+		&p.MatchStatus, &p.MatchedType, &p.MatchedID, &ruleID, &p.MatchedBy, &p.MatchedAt, &p.CreatedAt)
+	if virtualID.Valid {
+		id := int(virtualID.Int64)
+		p.VirtualAccountID = &id
+	}
+	if ruleID.Valid {
+		id := int(ruleID.Int64)
+		p.MatchedRuleID = &id
+	}
+	return err
+}
+
+// normalizeReference strips everything but letters and digits so references
+// match regardless of spacing, punctuation and case
+func normalizeReference(reference string) string {
+	var b strings.Builder
+	for _, c := range strings.ToUpper(reference) {
+		if (c >= 'A' && c <= 'Z') || (c >= '0' && c <= '9') {
+			b.WriteRune(c)
+		}
+	}
+	return b.String()
+}
+
+func createVirtualAccount(w http.ResponseWriter, r *http.Request) {
+	var v VirtualAccount
+	err := json.NewDecoder(r.Body).Decode(&v)
+	if err != nil {
+		http.Error(w, "Invalid request body", http.StatusBadRequest)
+		return
+	}
+
+	if strings.TrimSpace(v.Name) == "" {
+		http.Error(w, "name is required", http.StatusBadRequest)
+		return
+	}
+	v.Reference = normalizeReference(v.Reference)
+	if v.Reference == "" {
+		buf := make([]byte, 5)
+		rand.Read(buf)
+		v.Reference = "VA" + strings.ToUpper(hex.EncodeToString(buf))
+	}
+	if len(v.Reference) < 4 || len(v.Reference) > 35 {
+		http.Error(w, "reference must be 4 to 35 letters or digits", http.StatusBadRequest)
+		return
+	}
+
+	err = scanVirtualAccount(db.QueryRowContext(r.Context(), `INSERT INTO virtual_accounts (master_account_id, reference, name)
+									  SELECT id, $2, $3 FROM accounts WHERE id = $1 AND status = 'active'
+									  ON CONFLICT (master_account_id, reference) DO NOTHING
+									  RETURNING `+virtualAccountColumns, mux.Vars(r)["id"], v.Reference, v.Name), &v)
+	if err != nil {
+		if err == sql.ErrNoRows {
+			http.Error(w, "Master account not found or reference already in use", http.StatusConflict)
+		} else {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+		}
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusCreated)
+	json.NewEncoder(w).Encode(v)
+}
+
+// listVirtualAccounts reports every virtual balance of a master account and
+// the part of the master balance not allocated to any of them
+func listVirtualAccounts(w http.ResponseWriter, r *http.Request) {
+	masterID, err := strconv.Atoi(mux.Vars(r)["id"])
+	if err != nil {
+		http.Error(w, "Invalid account ID", http.StatusBadRequest)
+		return
+	}
+
+	var masterBalance Money
+	var currency string
+	err = db.QueryRowContext(r.Context(), `SELECT balance, currency_code FROM accounts WHERE id = $1`,
+		masterID).Scan(&masterBalance, &currency)
+	if err != nil {
+		if err == sql.ErrNoRows {
+			http.Error(w, "Account not found", http.StatusNotFound)
+		} else {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+		}
+		return
+	}
+
+	rows, err := db.QueryContext(r.Context(), `SELECT `+virtualAccountColumns+` FROM virtual_accounts
+											   WHERE master_account_id = $1 ORDER BY id`, masterID)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	defer rows.Close()
+
+	accounts := []VirtualAccount{}
+	var allocated Money
+	for rows.Next() {
+		var v VirtualAccount
+		if err := scanVirtualAccount(rows, &v); err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		allocated += v.Balance
+		accounts = append(accounts, v)
+	}
+	if err := rows.Err(); err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"master_account_id": masterID,
+		"currency_code":     currency,
+		"master_balance":    masterBalance,
+		"allocated":         allocated,
+		"unallocated":       masterBalance - allocated,
+		"virtual_accounts":  accounts,
+	})
+}
+
+func getVirtualAccount(w http.ResponseWriter, r *http.Request) {
+	var v VirtualAccount
+	err := scanVirtualAccount(db.QueryRowContext(r.Context(), `SELECT `+virtualAccountColumns+` FROM virtual_accounts WHERE id = $1`,
+		mux.Vars(r)["id"]), &v)
+	if err != nil {
+		if err == sql.ErrNoRows {
+			http.Error(w, "Virtual account not found", http.StatusNotFound)
+		} else {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+		}
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(v)
+}
+
+func listVirtualAccountEntries(w http.ResponseWriter, r *http.Request) {
+	rows, err := db.QueryContext(r.Context(), `SELECT id, amount, description, incoming_payment_id, created_at
+											   FROM virtual_account_entries WHERE virtual_account_id = $1
+											   ORDER BY created_at DESC, id DESC LIMIT 200`, mux.Vars(r)["id"])
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	defer rows.Close()
+
+	entries := []VirtualAccountEntry{}
+	for rows.Next() {
+		var e VirtualAccountEntry
+		var paymentID sql.NullInt64
+		if err := rows.Scan(&e.ID, &e.Amount, &e.Description, &paymentID, &e.CreatedAt); err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		if paymentID.Valid {
+			id := int(paymentID.Int64)
+			e.IncomingPaymentID = &id
+		}
+		entries = append(entries, e)
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(entries)
+}
+
+// receiveIncomingPayment credits the master account and runs the credit
+// through the matching engine; unmatched credits stay unallocated on the
+// master and wait in the unmatched queue. Only payment operations record
+// credits, as the body's amount is taken as received.
+func receiveIncomingPayment(w http.ResponseWriter, r *http.Request) {
+	if !requireRole(w, r, paymentOpsRoles...) {
+		return
+	}
+
+	masterID, err := strconv.Atoi(mux.Vars(r)["id"])
+	if err != nil {
+		http.Error(w, "Invalid account ID", http.StatusBadRequest)
+		return
+	}
+
+	var p IncomingPayment
+	err = json.NewDecoder(r.Body).Decode(&p)
+	if err != nil {
+		http.Error(w, "Invalid request body", http.StatusBadRequest)
+		return
+	}
+	if p.Amount <= 0 {
+		http.Error(w, "Amount must be positive", http.StatusBadRequest)
+		return
+	}
+
+	tx, err := db.BeginTx(r.Context(), nil)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	defer tx.Rollback()
+
+	err = postBalanceChange(r.Context(), tx, masterID, p.Amount, "Incoming payment "+p.Reference)
+	if err != nil {
+		writeTransferError(w, err)
+		return
+	}
+
+	err = scanIncomingPayment(tx.QueryRowContext(r.Context(), `INSERT INTO incoming_payments (master_account_id, amount, reference, description)
+									  VALUES ($1, $2, $3, $4) RETURNING `+incomingPaymentColumns,
+		masterID, p.Amount, p.Reference, p.Description), &p)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	if err := matchIncomingPayment(r.Context(), tx, &p); err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	if err := tx.Commit(); err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	publishAccountEvent(AccountEvent{AccountID: masterID, Type: "deposit", Amount: p.Amount})
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusCreated)
+	json.NewEncoder(w).Encode(p)
+}
+
+// routeIncomingPayment finds the active virtual account of the master whose
+// reference equals, or failing that appears in, the payment reference. The
+// longest contained reference wins so VA12 does not capture VA123.
+func routeIncomingPayment(ctx context.Context, tx *sql.Tx, masterID int, reference string) (int, error) {
+	normalized := normalizeReference(reference)
+	if normalized == "" {
+		return 0, nil
+	}
+
+	var id int
+	err := tx.QueryRowContext(ctx, `SELECT id FROM virtual_accounts
+									WHERE master_account_id = $1 AND status = 'active' AND STRPOS($2, reference) > 0
+									ORDER BY reference = $2 DESC, LENGTH(reference) DESC LIMIT 1`,
+		masterID, normalized).Scan(&id)
+	if err == sql.ErrNoRows {
+		return 0, nil
+	}
+	return id, err
+}
+
+// allocateIncomingPayment assigns an unallocated payment to a virtual account
+// of the same master and credits its virtual balance
+func allocateIncomingPayment(ctx context.Context, tx *sql.Tx, p *IncomingPayment, virtualID int) error {
+	result, err := tx.ExecContext(ctx, `UPDATE virtual_accounts SET balance = balance + $3, updated_at = NOW()
+										WHERE id = $1 AND master_account_id = $2 AND status = 'active'`,
+		virtualID, p.MasterAccountID, p.Amount)
+	if err != nil {
+		return err
+	}
+	if n, _ := result.RowsAffected(); n == 0 {
+		return ErrTransferAccountNotFound
+	}
+
+	_, err = tx.ExecContext(ctx, `UPDATE incoming_payments SET virtual_account_id = $2 WHERE id = $1`, p.ID, virtualID)
+	if err != nil {
+		return err
+	}
+	_, err = tx.ExecContext(ctx, `INSERT INTO virtual_account_entries (virtual_account_id, amount, description, incoming_payment_id)
+								  VALUES ($1, $2, $3, $4)`, virtualID, p.Amount, "Incoming payment "+p.Reference, p.ID)
+	if err != nil {
+		return err
+	}
+	p.VirtualAccountID = &virtualID
+	return nil
+}
+
+// payOutVirtualAccount debits the master account for a payment made on
+// behalf of one virtual account, limited to that account's virtual balance
+func payOutVirtualAccount(w http.ResponseWriter, r *http.Request) {
+	var requestBody struct {
+		Amount      Money  `json:"amount"`
+		Description string `json:"description"`
+	}
+	err := json.NewDecoder(r.Body).Decode(&requestBody)
+	if err != nil {
+		http.Error(w, "Invalid request body", http.StatusBadRequest)
+		return
+	}
+	if requestBody.Amount <= 0 {
+		http.Error(w, "Amount must be positive", http.StatusBadRequest)
+		return
+	}
+	if requestBody.Description == "" {
+		requestBody.Description = "Virtual account payout"
+	}
+
+	tx, err := db.BeginTx(r.Context(), nil)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	defer tx.Rollback()
+
+	var v VirtualAccount
+	err = scanVirtualAccount(tx.QueryRowContext(r.Context(), `SELECT `+virtualAccountColumns+` FROM virtual_accounts
+									  WHERE id = $1 FOR UPDATE`, mux.Vars(r)["id"]), &v)
+	if err != nil {
+		if err == sql.ErrNoRows {
+			http.Error(w, "Virtual account not found", http.StatusNotFound)
+		} else {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+		}
+		return
+	}
+	if v.Status != "active" {
+		http.Error(w, "Virtual account is not active", http.StatusConflict)
+		return
+	}
+	if v.Balance < requestBody.Amount {
+		http.Error(w, "Insufficient virtual account balance", http.StatusUnprocessableEntity)
+		return
+	}
+
+	err = postBalanceChange(r.Context(), tx, v.MasterAccountID, -requestBody.Amount, requestBody.Description)
+	if err != nil {
+		writeTransferError(w, err)
+		return
+	}
+	err = scanVirtualAccount(tx.QueryRowContext(r.Context(), `UPDATE virtual_accounts SET balance = balance - $2, updated_at = NOW()
+									  WHERE id = $1 RETURNING `+virtualAccountColumns, v.ID, requestBody.Amount), &v)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	_, err = tx.ExecContext(r.Context(), `INSERT INTO virtual_account_entries (virtual_account_id, amount, description)
+										  VALUES ($1, $2, $3)`, v.ID, -requestBody.Amount, requestBody.Description)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	if err := tx.Commit(); err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	publishAccountEvent(AccountEvent{AccountID: v.MasterAccountID, Type: "withdrawal", Amount: requestBody.Amount})
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(v)
+}
+
+// closeVirtualAccount closes a virtual account with a zero balance; its
+// reference stays reserved so later payments carrying it remain unallocated
+func closeVirtualAccount(w http.ResponseWriter, r *http.Request) {
+	var v VirtualAccount
+	err := scanVirtualAccount(db.QueryRowContext(r.Context(), `UPDATE virtual_accounts SET status = 'closed', updated_at = NOW()
+									  WHERE id = $1 AND status = 'active' AND balance = 0
+									  RETURNING `+virtualAccountColumns, mux.Vars(r)["id"]), &v)
+	if err != nil {
+		if err == sql.ErrNoRows {
+			http.Error(w, "Virtual account not found, already closed or balance is not zero", http.StatusConflict)
+		} else {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+		}
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(v)
+}
@@ -0,0 +1,206 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"encoding/pem"
+	"fmt"
+	"net/http"
+	"net/url"
+	"sort"
+	"strconv"
+	"time"
+
+	"bank/servicekit"
+
+	"go.uber.org/zap"
+)
+
+// WebhookEvent is the envelope delivered to partner webhook endpoints
+type WebhookEvent struct {
+	ID        string                 `json:"id"`
+	Type      string                 `json:"type"`
+	CreatedAt string                 `json:"created_at"`
+	Data      map[string]interface{} `json:"data"`
+}
+
+var webhookClient = &http.Client{Timeout: 10 * time.Second}
+
+// webhookSigner signs partner events. It is nil when the local backend has no
+// WEBHOOK_SIGNING_SECRET.
+var webhookSigner servicekit.Signer
+
+// initWebhookSigner selects the webhook signing backend. With the vault
+// backend the key named by WEBHOOK_SIGNING_KEY stays in the KMS and partners
+// verify with its published public key.
+func initWebhookSigner() {
+	secret := getEnv("WEBHOOK_SIGNING_SECRET", "")
+	if getEnv("SIGNING_BACKEND", "local") == "local" && secret == "" {
+		return
+	}
+	signer, err := servicekit.NewSigner(getEnv("WEBHOOK_SIGNING_KEY", "webhooks"), []byte(secret))
+	if err != nil {
+		logger.Fatal("failed to load webhook signing key", zap.Error(err))
+	}
+	webhookSigner = servicekit.MeteredSigner{Signer: signer, Purpose: "webhook"}
+}
+
+// signWebhook returns the X-Bank-Signature header value for payload. HMAC
+// signatures are sent as v1 (hex); asymmetric ones as v2 (base64url) with the
+// kid of the key version. Both are verified by the partner package in
+// webhook-sdk.
+func signWebhook(ctx context.Context, payload []byte, signer servicekit.Signer, t time.Time) (string, error) {
+	ts := strconv.FormatInt(t.Unix(), 10)
+	signature, err := signer.Sign(ctx, append([]byte(ts+"."), payload...))
+	if err != nil {
+		return "", err
+	}
+	if signer.PublicKeys() == nil {
+		return fmt.Sprintf("t=%s,v1=%s", ts, hex.EncodeToString(signature)), nil
+	}
+	return fmt.Sprintf("t=%s,kid=%s,v2=%s", ts, signer.KeyID(), base64.RawURLEncoding.EncodeToString(signature)), nil
+}
+
+// deliverWebhook signs and POSTs an event, returning the partner's status code
+func deliverWebhook(ctx context.Context, target string, event WebhookEvent, signer servicekit.Signer) (int, error) {
+	payload, err := json.Marshal(event)
+	if err != nil {
+		return 0, err
+	}
+	signature, err := signWebhook(ctx, payload, signer, time.Now())
+	if err != nil {
+		return 0, err
+	}
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, target, bytes.NewReader(payload))
+	if err != nil {
+		return 0, err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("X-Bank-Signature", signature)
+	req.Header.Set("X-Bank-Event-ID", event.ID)
+
+	resp, err := webhookClient.Do(req)
+	if err != nil {
+		return 0, err
+	}
+	defer resp.Body.Close()
+	return resp.StatusCode, nil
+}
+
+func newEventID() string {
+	raw := make([]byte, 12)
+	rand.Read(raw)
+	return "evt_" + hex.EncodeToString(raw)
+}
+
+// sendTestWebhook sends a signed test event to a partner URL so partners can
+// check their signature verification
+func sendTestWebhook(w http.ResponseWriter, r *http.Request) {
+	var requestBody struct {
+		URL       string `json:"url"`
+		EventType string `json:"event_type"`
+	}
+
+	err := json.NewDecoder(r.Body).Decode(&requestBody)
+	if err != nil {
+		http.Error(w, "Invalid request body", http.StatusBadRequest)
+		return
+	}
+
+	target, err := url.Parse(requestBody.URL)
+	if err != nil || target.Host == "" {
+		http.Error(w, "A valid url is required", http.StatusBadRequest)
+		return
+	}
+	// Outside development only HTTPS endpoints may receive events
+	if target.Scheme != "https" && !(getEnv("APP_ENV", "development") == "development" && target.Scheme == "http") {
+		http.Error(w, "Webhook url must use https", http.StatusBadRequest)
+		return
+	}
+
+	if webhookSigner == nil {
+		http.Error(w, "Webhook signing is not configured", http.StatusServiceUnavailable)
+		return
+	}
+
+	if requestBody.EventType == "" {
+		requestBody.EventType = "webhook.test"
+	}
+
+	event := WebhookEvent{
+		ID:        newEventID(),
+		Type:      requestBody.EventType,
+		CreatedAt: time.Now().UTC().Format(time.RFC3339),
+		Data: map[string]interface{}{
+			"test":    true,
+			"message": "This is a test event",
+		},
+	}
+
+	status, err := deliverWebhook(r.Context(), target.String(), event, webhookSigner)
+	if err != nil {
+		http.Error(w, fmt.Sprintf("Delivery failed: %v", err), http.StatusBadGateway)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"event":         event,
+		"response_code": status,
+		"delivered":     status >= 200 && status < 300,
+	})
+}
+
+// WebhookSigningKey is a public key partners use to verify v2 signatures
+type WebhookSigningKey struct {
+	KeyID     string `json:"kid"`
+	Algorithm string `json:"algorithm"`
+	PublicKey string `json:"public_key"` // PEM SubjectPublicKeyInfo
+}
+
+// listWebhookSigningKeys publishes the public key of every webhook key
+// version, so partners can keep verifying across a rotation
+func listWebhookSigningKeys(w http.ResponseWriter, r *http.Request) {
+	keys := []WebhookSigningKey{}
+	if webhookSigner != nil {
+		for kid, public := range webhookSigner.PublicKeys() {
+			der, err := x509.MarshalPKIXPublicKey(public)
+			if err != nil {
+				http.Error(w, err.Error(), http.StatusInternalServerError)
+				return
+			}
+			keys = append(keys, WebhookSigningKey{KeyID: kid, Algorithm: webhookSigner.Algorithm(),
+				PublicKey: string(pem.EncodeToMemory(&pem.Block{Type: "PUBLIC KEY", Bytes: der}))})
+		}
+	}
+	sort.Slice(keys, func(i, j int) bool { return keys[i].KeyID < keys[j].KeyID })
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(keys)
+}
+
+// getSigningKeyUsage reports how often each signing key has been used across
+// the service's replicas
+func getSigningKeyUsage(w http.ResponseWriter, r *http.Request) {
+	if !requireRole(w, r, "admin") {
+		return
+	}
+
+	keys, err := servicekit.SigningKeyUsageReport(r.Context())
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"backend": getEnv("SIGNING_BACKEND", "local"),
+		"keys":    keys,
+	})
+}
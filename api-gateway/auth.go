@@ -0,0 +1,208 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"go.uber.org/zap"
+)
+
+// Tokens are validated here, once, with the auth service and for the
+// audience of the service the request is routed to. The caller's identity is
+// passed on in X-Gateway-Identity, signed with GATEWAY_IDENTITY_KEY, for the
+// one method and path it was issued for; services sharing the key trust it
+// instead of validating the token again. X-User-ID, X-Username and
+// X-User-Role carry the same identity unsigned for logging.
+
+const identityHeader = "X-Gateway-Identity"
+
+// identityTTL bounds how long after the gateway signed it a service accepts
+// an identity, to cover the time a request takes to reach it
+const identityTTL = 30 * time.Second
+
+var identitySigningKey []byte
+
+// IdentityClaims are the claims of a signed identity
+type IdentityClaims struct {
+	Issuer   string `json:"iss"`
+	Audience string `json:"aud"`
+	UserID   int    `json:"sub"`
+	Username string `json:"name"`
+	Role     string `json:"role"`
+	Method   string `json:"htm"`
+	Path     string `json:"htu"`
+	Expires  int64  `json:"exp"`
+	// Privileges are the caller's elevated privileges and their Unix expiry
+	Privileges map[string]int64 `json:"priv,omitempty"`
+}
+
+// Identity is the authenticated caller of a request
+type Identity struct {
+	UserID     int              `json:"user_id"`
+	Username   string           `json:"username"`
+	Role       string           `json:"role"`
+	Privileges map[string]int64 `json:"privileges,omitempty"` // elevated privileges and their Unix expiry
+}
+
+type identityKey struct{}
+
+// requestIdentity returns the caller edgeAuth authenticated, if any
+func requestIdentity(ctx context.Context) (Identity, bool) {
+	identity, ok := ctx.Value(identityKey{}).(Identity)
+	return identity, ok
+}
+
+// publicRoutes are reachable without a token, written as in gatewayRoute
+// patterns. Downloads are authorized by their signed link instead.
+var publicRoutes = []string{
+	"/auth/csrf",
+	"/auth/register",
+	"/auth/login",
+	"/auth/mfa/verify",
+	"/auth/validate",
+	"/auth/refresh",
+	"/auth/forgot-password",
+	"/auth/reset-password",
+	"/auth/jwks",
+	"/pay-in/*",
+	"/webhooks/signing-keys",
+	"/esignature/webhook",
+}
+
+func publicPath(path string) bool {
+	if strings.HasSuffix(path, "/download") {
+		return true
+	}
+	segments := pathSegments(path)
+	for _, pattern := range publicRoutes {
+		route := gatewayRoute{segments: pathSegments(pattern)}
+		if len(route.segments) == len(segments) && route.matches(segments) {
+			return true
+		}
+	}
+	return false
+}
+
+var authClient = &http.Client{Timeout: 3 * time.Second, Transport: requestIDTransport{base: http.DefaultTransport}}
+
+// validateToken asks the auth service whether token is valid for audience.
+// A rejection is returned as the auth service's status and body, so callers
+// learn e.g. which terms they must accept.
+func validateToken(ctx context.Context, token, audience string) (Identity, *http.Response, error) {
+	payload, _ := json.Marshal(map[string]string{"token": token, "audience": audience})
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost,
+		serviceURLs["auth-service"]+"/v1/auth/validate", bytes.NewReader(payload))
+	if err != nil {
+		return Identity{}, nil, err
+	}
+	req.Header.Set("Content-Type", "application/json")
+
+	resp, err := authClient.Do(req)
+	if err != nil {
+		return Identity{}, nil, err
+	}
+	switch {
+	case resp.StatusCode == http.StatusUnauthorized || resp.StatusCode == http.StatusForbidden:
+		return Identity{}, resp, nil
+	case resp.StatusCode != http.StatusOK:
+		resp.Body.Close()
+		return Identity{}, nil, fmt.Errorf("auth service returned status %d", resp.StatusCode)
+	}
+	defer resp.Body.Close()
+	var identity Identity
+	err = json.NewDecoder(resp.Body).Decode(&identity)
+	return identity, nil, err
+}
+
+// bearerToken returns the token from the Authorization header or, for
+// browser sessions, the session cookie
+func bearerToken(r *http.Request) string {
+	if token := strings.TrimPrefix(r.Header.Get("Authorization"), "Bearer "); token != r.Header.Get("Authorization") {
+		return strings.TrimSpace(token)
+	}
+	if cookie, err := r.Cookie(getEnv("SESSION_COOKIE_NAME", "bank_session")); err == nil {
+		return cookie.Value
+	}
+	return ""
+}
+
+// signIdentity returns the X-Gateway-Identity value for identity on a
+// request to service
+func signIdentity(identity Identity, service, method, path string) string {
+	claims, _ := json.Marshal(IdentityClaims{
+		Issuer:     serviceName,
+		Audience:   service,
+		UserID:     identity.UserID,
+		Username:   identity.Username,
+		Role:       identity.Role,
+		Method:     method,
+		Path:       path,
+		Expires:    time.Now().Add(identityTTL).Unix(),
+		Privileges: identity.Privileges,
+	})
+	payload := base64.RawURLEncoding.EncodeToString(claims)
+	mac := hmac.New(sha256.New, identitySigningKey)
+	mac.Write([]byte(payload))
+	return payload + "." + base64.RawURLEncoding.EncodeToString(mac.Sum(nil))
+}
+
+// edgeAuth routes the request, authenticates its caller unless the route is
+// public and replaces any identity headers the client sent with the
+// verified identity
+func edgeAuth(routes []gatewayRoute, next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		// Identity headers are only ever set from a verified token
+		r.Header.Del(identityHeader)
+		r.Header.Del("X-User-ID")
+		r.Header.Del("X-User-Role")
+		r.Header.Del("X-Username")
+
+		f, ok := resolveForward(routes, r.URL.Path)
+		if !ok {
+			http.Error(w, "Not found", http.StatusNotFound)
+			return
+		}
+		ctx := context.WithValue(r.Context(), forwardKey{}, f)
+
+		if publicPath(f.Path) {
+			next.ServeHTTP(w, r.WithContext(ctx))
+			return
+		}
+		token := bearerToken(r)
+		if token == "" {
+			http.Error(w, "Authentication required", http.StatusUnauthorized)
+			return
+		}
+		identity, rejection, err := validateToken(ctx, token, f.Route.Service)
+		if err != nil {
+			requestLogger(ctx).Error("token validation failed", zap.Error(err))
+			http.Error(w, "Token validation unavailable", http.StatusBadGateway)
+			return
+		}
+		if rejection != nil {
+			defer rejection.Body.Close()
+			w.Header().Set("Content-Type", rejection.Header.Get("Content-Type"))
+			w.WriteHeader(rejection.StatusCode)
+			io.Copy(w, rejection.Body)
+			return
+		}
+
+		r.Header.Set("X-User-ID", strconv.Itoa(identity.UserID))
+		r.Header.Set("X-User-Role", identity.Role)
+		r.Header.Set("X-Username", identity.Username)
+		if len(identitySigningKey) > 0 {
+			r.Header.Set(identityHeader, signIdentity(identity, f.Route.Service, r.Method, f.UpstreamPath))
+		}
+		next.ServeHTTP(w, r.WithContext(context.WithValue(ctx, identityKey{}, identity)))
+	})
+}
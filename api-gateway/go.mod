@@ -2,10 +2,9 @@ module bank/api-gateway
 
 go 1.19
 
+require go.uber.org/zap v1.24.0
+
 require (
-	github.com/gorilla/mux v1.8.0
-	github.com/dgrijalva/jwt-go v3.2.0+incompatible
-	github.com/joho/godotenv v1.4.0
-	github.com/go-resty/resty/v2 v2.7.0
-	github.com/sirupsen/logrus v1.9.0
-)
\ No newline at end of file
+	go.uber.org/atomic v1.7.0 // indirect
+	go.uber.org/multierr v1.6.0 // indirect
+)
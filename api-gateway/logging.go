@@ -0,0 +1,152 @@
+package main
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"net/http"
+	"strings"
+	"time"
+
+	"go.uber.org/zap"
+	"go.uber.org/zap/zapcore"
+)
+
+// Logs are written as JSON lines to stderr, like the services'. The gateway
+// assigns each request its ID, unless the client sent a reasonable
+// X-Request-ID, and passes it on, so one request can be followed across the
+// services it touches.
+
+// logger is the service logger. LOG_LEVEL (debug, info, warn or error,
+// default info) sets the minimum level.
+var logger = newLogger()
+
+func newLogger() *zap.Logger {
+	config := zap.NewProductionConfig()
+	config.Sampling = nil
+	config.EncoderConfig.TimeKey = "time"
+	config.EncoderConfig.EncodeTime = zapcore.ISO8601TimeEncoder
+	config.InitialFields = map[string]interface{}{"service": serviceName}
+	if level, err := zapcore.ParseLevel(getEnv("LOG_LEVEL", "info")); err == nil {
+		config.Level = zap.NewAtomicLevelAt(level)
+	}
+	l, err := config.Build()
+	if err != nil {
+		panic(err)
+	}
+	return l
+}
+
+func init() {
+	zap.RedirectStdLog(logger)
+}
+
+type requestIDKey struct{}
+
+// requestID returns the ID of the request ctx belongs to, or ""
+func requestID(ctx context.Context) string {
+	id, _ := ctx.Value(requestIDKey{}).(string)
+	return id
+}
+
+// requestLogger returns the logger for work done on behalf of the request
+// ctx belongs to
+func requestLogger(ctx context.Context) *zap.Logger {
+	if id := requestID(ctx); id != "" {
+		return logger.With(zap.String("request_id", id))
+	}
+	return logger
+}
+
+// newCorrelationID returns a random UUID
+func newCorrelationID() string {
+	b := make([]byte, 16)
+	rand.Read(b)
+	b[6] = b[6]&0x0f | 0x40
+	b[8] = b[8]&0x3f | 0x80
+	h := hex.EncodeToString(b)
+	return h[0:8] + "-" + h[8:12] + "-" + h[12:16] + "-" + h[16:20] + "-" + h[20:]
+}
+
+func incomingRequestID(r *http.Request) string {
+	id := r.Header.Get("X-Request-ID")
+	if id == "" || len(id) > 128 || strings.IndexFunc(id, func(c rune) bool { return c <= ' ' || c > '~' }) >= 0 {
+		return newCorrelationID()
+	}
+	return id
+}
+
+type statusRecorder struct {
+	http.ResponseWriter
+	status int
+}
+
+func (s *statusRecorder) WriteHeader(status int) {
+	if s.status == 0 {
+		s.status = status
+	}
+	s.ResponseWriter.WriteHeader(status)
+}
+
+func (s *statusRecorder) Write(b []byte) (int, error) {
+	if s.status == 0 {
+		s.status = http.StatusOK
+	}
+	return s.ResponseWriter.Write(b)
+}
+
+// Flush lets streamed responses through the proxy as they are written
+func (s *statusRecorder) Flush() {
+	if f, ok := s.ResponseWriter.(http.Flusher); ok {
+		f.Flush()
+	}
+}
+
+// requestIDMiddleware gives every request an ID, returned as X-Request-ID and
+// sent on to the service, and logs each request when it completes
+func requestIDMiddleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		id := incomingRequestID(r)
+		r.Header.Set("X-Request-ID", id)
+		w.Header().Set("X-Request-ID", id)
+		r = r.WithContext(context.WithValue(r.Context(), requestIDKey{}, id))
+
+		start := time.Now()
+		rec := &statusRecorder{ResponseWriter: w}
+		defer func() {
+			if r.URL.Path == "/health" {
+				return
+			}
+			status := rec.status
+			if status == 0 {
+				status = http.StatusOK
+			}
+			level := zapcore.InfoLevel
+			if status >= 500 {
+				level = zapcore.ErrorLevel
+			}
+			requestLogger(r.Context()).Check(level, "request completed").Write(
+				zap.String("method", r.Method),
+				zap.String("path", r.URL.Path),
+				zap.Int("status", status),
+				zap.Duration("duration", time.Since(start)),
+				zap.String("remote_addr", r.RemoteAddr),
+			)
+		}()
+		next.ServeHTTP(rec, r)
+	})
+}
+
+// requestIDTransport passes the request ID of an outgoing request's context
+// on to the service
+type requestIDTransport struct {
+	base http.RoundTripper
+}
+
+func (t requestIDTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	if id := requestID(req.Context()); id != "" && req.Header.Get("X-Request-ID") == "" {
+		req = req.Clone(req.Context())
+		req.Header.Set("X-Request-ID", id)
+	}
+	return t.base.RoundTrip(req)
+}
@@ -0,0 +1,92 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"os"
+	"os/signal"
+	"syscall"
+	"time"
+
+	"go.uber.org/zap"
+)
+
+// The gateway is the single entry point for clients. It routes each request
+// to the service that serves it, adding the API version to unversioned paths,
+// authenticates the caller once and forwards their identity to the service in
+// signed headers, and limits request rates per client and per user.
+
+// serviceName identifies this service in logs and service tokens
+const serviceName = "api-gateway"
+
+func main() {
+	port := getEnv("PORT", "8000")
+	routes, err := loadGatewayRoutes(defaultGatewayRoutes)
+	if err != nil {
+		logger.Fatal("failed to load routes", zap.Error(err))
+	}
+	identitySigningKey = []byte(getEnv("GATEWAY_IDENTITY_KEY", ""))
+	if len(identitySigningKey) == 0 {
+		logger.Warn("GATEWAY_IDENTITY_KEY is not set; services will validate tokens themselves")
+	}
+
+	limiter := newRateLimiter(rateLimit("RATE_LIMIT_PER_IP", 600), rateLimit("RATE_LIMIT_PER_USER", 300), time.Minute)
+	go limiter.expire(serviceContext)
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("/health", healthCheck)
+	mux.Handle("/", limiter.perIP(edgeAuth(routes, limiter.perUser(proxyHandler(routes)))))
+
+	server := &http.Server{
+		Addr:              ":" + port,
+		Handler:           requestIDMiddleware(mux),
+		ReadHeaderTimeout: 10 * time.Second,
+		IdleTimeout:       2 * time.Minute,
+	}
+	go func() {
+		signals := make(chan os.Signal, 1)
+		signal.Notify(signals, syscall.SIGTERM, syscall.SIGINT)
+		sig := <-signals
+		logger.Info("draining in-flight requests", zap.String("signal", sig.String()))
+		ctx, cancel := context.WithTimeout(context.Background(), shutdownTimeout())
+		defer cancel()
+		if err := server.Shutdown(ctx); err != nil {
+			logger.Error("shutdown failed", zap.Error(err))
+		}
+		stopService()
+	}()
+
+	logger.Info("api gateway starting", zap.String("port", port))
+	if err := server.ListenAndServe(); err != http.ErrServerClosed {
+		logger.Fatal("server failed", zap.Error(err))
+	}
+	<-serviceContext.Done()
+	logger.Info("shut down cleanly")
+}
+
+// serviceContext is canceled once the server has drained on shutdown
+var serviceContext, stopService = context.WithCancel(context.Background())
+
+// shutdownTimeout is how long in-flight requests may take to finish after
+// SIGTERM, SHUTDOWN_TIMEOUT
+func shutdownTimeout() time.Duration {
+	timeout, err := time.ParseDuration(getEnv("SHUTDOWN_TIMEOUT", "20s"))
+	if err != nil || timeout <= 0 {
+		return 20 * time.Second
+	}
+	return timeout
+}
+
+func healthCheck(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]string{"status": "healthy", "service": serviceName})
+}
+
+func getEnv(key, defaultValue string) string {
+	value := os.Getenv(key)
+	if value == "" {
+		return defaultValue
+	}
+	return value
+}
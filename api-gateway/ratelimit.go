@@ -0,0 +1,120 @@
+package main
+
+import (
+	"context"
+	"net"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+
+	"go.uber.org/zap"
+)
+
+// rateLimiter counts requests per client IP and per authenticated user in
+// fixed windows. Counts are held per gateway replica, so with N replicas a
+// caller may make up to N times the limit.
+type rateLimiter struct {
+	mu        sync.Mutex
+	ipLimit   int
+	userLimit int
+	window    time.Duration
+	counts    map[string]*rateWindow
+}
+
+type rateWindow struct {
+	start time.Time
+	count int
+}
+
+func newRateLimiter(ipLimit, userLimit int, window time.Duration) *rateLimiter {
+	return &rateLimiter{ipLimit: ipLimit, userLimit: userLimit, window: window, counts: map[string]*rateWindow{}}
+}
+
+// rateLimit reads a requests-per-window limit from key; 0 disables the limit
+func rateLimit(key string, defaultValue int) int {
+	limit, err := strconv.Atoi(getEnv(key, strconv.Itoa(defaultValue)))
+	if err != nil || limit < 0 {
+		return defaultValue
+	}
+	return limit
+}
+
+// allow counts a request against key and reports whether it is within limit,
+// or else how long until the window resets
+func (l *rateLimiter) allow(key string, limit int) (bool, time.Duration) {
+	if limit == 0 {
+		return true, 0
+	}
+	now := time.Now()
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	w := l.counts[key]
+	if w == nil || now.Sub(w.start) >= l.window {
+		w = &rateWindow{start: now}
+		l.counts[key] = w
+	}
+	if w.count >= limit {
+		return false, w.start.Add(l.window).Sub(now)
+	}
+	w.count++
+	return true, 0
+}
+
+// expire drops ended windows until ctx is done
+func (l *rateLimiter) expire(ctx context.Context) {
+	ticker := time.NewTicker(l.window)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case now := <-ticker.C:
+			l.mu.Lock()
+			for key, w := range l.counts {
+				if now.Sub(w.start) >= l.window {
+					delete(l.counts, key)
+				}
+			}
+			l.mu.Unlock()
+		}
+	}
+}
+
+func rejectRateLimited(w http.ResponseWriter, r *http.Request, retryAfter time.Duration, key string) {
+	requestLogger(r.Context()).Warn("rate limit exceeded", zap.String("key", key))
+	w.Header().Set("Retry-After", strconv.Itoa(int(retryAfter.Seconds())+1))
+	http.Error(w, "Too many requests", http.StatusTooManyRequests)
+}
+
+// perIP limits requests by the client's address, before authentication, so
+// it also bounds login attempts and invalid tokens
+func (l *rateLimiter) perIP(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		ip, _, err := net.SplitHostPort(r.RemoteAddr)
+		if err != nil {
+			ip = r.RemoteAddr
+		}
+		key := "ip:" + ip
+		if ok, retryAfter := l.allow(key, l.ipLimit); !ok {
+			rejectRateLimited(w, r, retryAfter, key)
+			return
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+// perUser limits the requests of each authenticated user across the
+// addresses they use
+func (l *rateLimiter) perUser(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if identity, ok := requestIdentity(r.Context()); ok {
+			key := "user:" + strconv.Itoa(identity.UserID)
+			if ok, retryAfter := l.allow(key, l.userLimit); !ok {
+				rejectRateLimited(w, r, retryAfter, key)
+				return
+			}
+		}
+		next.ServeHTTP(w, r)
+	})
+}
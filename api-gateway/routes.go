@@ -0,0 +1,170 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"net/http/httputil"
+	"net/url"
+	"regexp"
+	"strings"
+
+	"go.uber.org/zap"
+)
+
+// gatewayRoute sends the paths matching Pattern to Service. A "*" segment
+// matches any one segment and a pattern also matches every path below it.
+type gatewayRoute struct {
+	Pattern  string
+	Service  string
+	segments []string
+}
+
+// defaultGatewayRoutes are tried in order, so the auth and customer services'
+// routes below /customers and /compliance come before the account service's
+// catch-all
+var defaultGatewayRoutes = []gatewayRoute{
+	{Pattern: "/auth", Service: "auth-service"},
+	{Pattern: "/users", Service: "auth-service"},
+	{Pattern: "/legal", Service: "auth-service"},
+	{Pattern: "/marketing", Service: "auth-service"},
+	{Pattern: "/break-glass", Service: "auth-service"},
+	{Pattern: "/device-keys", Service: "auth-service"},
+	{Pattern: "/privilege-requests", Service: "auth-service"},
+	{Pattern: "/customers/duplicates", Service: "auth-service"},
+	{Pattern: "/customers/*/merge", Service: "auth-service"},
+	{Pattern: "/customers/*/merges", Service: "auth-service"},
+	{Pattern: "/compliance/screening-queue", Service: "auth-service"},
+	{Pattern: "/compliance/screenings", Service: "auth-service"},
+	{Pattern: "/compliance/watchlist", Service: "auth-service"},
+	{Pattern: "/customers/*/profile", Service: "customer-service"},
+	{Pattern: "/customers/*/identity-documents", Service: "customer-service"},
+	{Pattern: "/customers/*/kyc", Service: "customer-service"},
+	{Pattern: "/customer-profiles", Service: "customer-service"},
+	{Pattern: "/", Service: "account-service"},
+}
+
+// internalPaths are served by every service for operators and are not
+// exposed through the gateway
+var internalPaths = map[string]bool{"/health": true, "/startup": true, "/metrics": true, "/slo": true}
+
+// serviceURLs are the upstreams routes may name
+var serviceURLs = map[string]string{
+	"auth-service":     getEnv("AUTH_SERVICE_URL", "http://localhost:8082"),
+	"account-service":  getEnv("ACCOUNT_SERVICE_URL", "http://localhost:8080"),
+	"customer-service": getEnv("CUSTOMER_SERVICE_URL", "http://localhost:8084"),
+}
+
+var versionSegment = regexp.MustCompile(`^v[0-9]+$`)
+
+// loadGatewayRoutes returns the routes from GATEWAY_ROUTES
+// ("/auth=auth-service;/=account-service") or defaults
+func loadGatewayRoutes(defaults []gatewayRoute) ([]gatewayRoute, error) {
+	routes := defaults
+	if value := getEnv("GATEWAY_ROUTES", ""); value != "" {
+		routes = nil
+		for _, entry := range strings.Split(value, ";") {
+			pattern, service, ok := strings.Cut(strings.TrimSpace(entry), "=")
+			if !ok {
+				return nil, fmt.Errorf("invalid route %q", entry)
+			}
+			routes = append(routes, gatewayRoute{Pattern: pattern, Service: service})
+		}
+	}
+	loaded := make([]gatewayRoute, 0, len(routes))
+	for _, route := range routes {
+		if _, known := serviceURLs[route.Service]; !known {
+			return nil, fmt.Errorf("route %s names unknown service %q", route.Pattern, route.Service)
+		}
+		route.segments = pathSegments(route.Pattern)
+		loaded = append(loaded, route)
+	}
+	return loaded, nil
+}
+
+func pathSegments(path string) []string {
+	if path = strings.Trim(path, "/"); path == "" {
+		return nil
+	}
+	return strings.Split(path, "/")
+}
+
+func (route gatewayRoute) matches(segments []string) bool {
+	if len(segments) < len(route.segments) {
+		return false
+	}
+	for i, segment := range route.segments {
+		if segment != "*" && segment != segments[i] {
+			return false
+		}
+	}
+	return true
+}
+
+// forward is where a request goes: the service and the path it is served
+// at there, with the API version the client asked for or v1
+type forward struct {
+	Route gatewayRoute
+	// Path is the path without the version, as routes are written
+	Path         string
+	UpstreamPath string
+}
+
+type forwardKey struct{}
+
+// resolveForward finds the route for a client path, reporting false for
+// paths no service serves
+func resolveForward(routes []gatewayRoute, path string) (forward, bool) {
+	segments := pathSegments(path)
+	version := "v1"
+	if len(segments) > 0 && versionSegment.MatchString(segments[0]) {
+		version, segments = segments[0], segments[1:]
+	}
+	rest := "/" + strings.Join(segments, "/")
+	if internalPaths[rest] || len(segments) == 0 {
+		return forward{}, false
+	}
+	for _, route := range routes {
+		if route.matches(segments) {
+			return forward{Route: route, Path: rest, UpstreamPath: "/" + version + rest}, true
+		}
+	}
+	return forward{}, false
+}
+
+// requestForward returns the forward edgeAuth resolved for the request
+func requestForward(ctx context.Context) forward {
+	f, _ := ctx.Value(forwardKey{}).(forward)
+	return f
+}
+
+// proxyHandler passes each request on to its service at the rewritten path
+func proxyHandler(routes []gatewayRoute) http.Handler {
+	proxies := map[string]*httputil.ReverseProxy{}
+	for _, route := range routes {
+		if proxies[route.Service] != nil {
+			continue
+		}
+		target, err := url.Parse(serviceURLs[route.Service])
+		if err != nil {
+			logger.Fatal("invalid service URL", zap.String("service", route.Service), zap.Error(err))
+		}
+		proxies[route.Service] = &httputil.ReverseProxy{
+			Director: func(req *http.Request) {
+				req.URL.Scheme = target.Scheme
+				req.URL.Host = target.Host
+				req.URL.Path = requestForward(req.Context()).UpstreamPath
+				req.URL.RawPath = ""
+				req.Host = target.Host
+			},
+			ErrorHandler: func(w http.ResponseWriter, r *http.Request, err error) {
+				requestLogger(r.Context()).Error("upstream request failed",
+					zap.String("upstream", requestForward(r.Context()).Route.Service), zap.Error(err))
+				http.Error(w, "Service unavailable", http.StatusBadGateway)
+			},
+		}
+	}
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		proxies[requestForward(r.Context()).Route.Service].ServeHTTP(w, r)
+	})
+}
@@ -0,0 +1,431 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+	"os"
+	"regexp"
+	"strings"
+	"sync"
+	"time"
+
+	"bank/servicekit"
+
+	"go.uber.org/zap"
+)
+
+// Address is a postal address as entered by the customer
+type Address struct {
+	Line1      string `json:"line1"`
+	Line2      string `json:"line2,omitempty"`
+	City       string `json:"city"`
+	Region     string `json:"region,omitempty"` // state, province or county
+	PostalCode string `json:"postal_code"`
+	Country    string `json:"country"` // ISO 3166-1 alpha-2
+}
+
+// AddressResult is a provider's verdict on an address
+type AddressResult struct {
+	Status       string   `json:"status"` // verified, partial or unverified
+	Standardized Address  `json:"standardized"`
+	Latitude     *float64 `json:"latitude,omitempty"`
+	Longitude    *float64 `json:"longitude,omitempty"`
+	Provider     string   `json:"provider"`
+}
+
+// StandardizedAddress is the stored result of validating a customer's address
+type StandardizedAddress struct {
+	AddressResult
+	ValidatedAt string `json:"validated_at"`
+}
+
+// AddressValidator validates and standardizes addresses through an external
+// service (Loqate, USPS, Google) so providers can be swapped by configuration
+type AddressValidator interface {
+	Validate(ctx context.Context, a Address) (AddressResult, error)
+}
+
+// ErrAddressUndeliverable is returned when the provider is sure the address
+// does not exist
+var ErrAddressUndeliverable = errors.New("address could not be found")
+
+const addressTablesSQL = `
+	CREATE TABLE IF NOT EXISTS user_addresses (
+		user_id INTEGER PRIMARY KEY REFERENCES users(id),
+		raw JSONB NOT NULL,
+		standardized JSONB,
+		status VARCHAR(20) NOT NULL,
+		latitude DOUBLE PRECISION,
+		longitude DOUBLE PRECISION,
+		provider VARCHAR(20) NOT NULL,
+		validated_at TIMESTAMP NOT NULL DEFAULT NOW()
+	);`
+
+var addressValidator AddressValidator
+
+// newAddressValidator returns the validator selected by ADDRESS_PROVIDER:
+// "basic" (the default, local formatting only), "loqate", "usps" or "google"
+func newAddressValidator(name string) AddressValidator {
+	client := &http.Client{Timeout: 5 * time.Second}
+	switch name {
+	case "", "basic":
+		return basicAddressValidator{}
+	case "loqate":
+		return &loqateValidator{client: client, key: os.Getenv("LOQATE_API_KEY")}
+	case "usps":
+		return &uspsValidator{client: client, clientID: os.Getenv("USPS_CLIENT_ID"), secret: os.Getenv("USPS_CLIENT_SECRET")}
+	case "google":
+		return &googleValidator{client: client, key: os.Getenv("GOOGLE_MAPS_API_KEY")}
+	default:
+		logger.Fatal("unsupported address provider", zap.String("provider", name))
+		return nil
+	}
+}
+
+var addressSpaces = regexp.MustCompile(`\s+`)
+
+// basicStandardize trims and uppercases an address the way postal
+// standards print it
+func basicStandardize(a Address) Address {
+	clean := func(s string) string {
+		return strings.ToUpper(addressSpaces.ReplaceAllString(strings.TrimSpace(s), " "))
+	}
+	return Address{
+		Line1:      clean(a.Line1),
+		Line2:      clean(a.Line2),
+		City:       clean(a.City),
+		Region:     clean(a.Region),
+		PostalCode: clean(a.PostalCode),
+		Country:    clean(a.Country),
+	}
+}
+
+// checkAddress rejects addresses missing the parts every provider needs
+func checkAddress(a Address) error {
+	if strings.TrimSpace(a.Line1) == "" || strings.TrimSpace(a.City) == "" {
+		return fmt.Errorf("address line1 and city are required")
+	}
+	if len(strings.TrimSpace(a.Country)) != 2 {
+		return fmt.Errorf("address country must be an ISO 3166-1 alpha-2 code")
+	}
+	return nil
+}
+
+// basicAddressValidator formats the address without an external lookup
+type basicAddressValidator struct{}
+
+func (basicAddressValidator) Validate(ctx context.Context, a Address) (AddressResult, error) {
+	return AddressResult{Status: "unverified", Standardized: basicStandardize(a), Provider: "basic"}, nil
+}
+
+// loqateValidator uses the Loqate international cleansing API
+type loqateValidator struct {
+	client *http.Client
+	key    string
+}
+
+func (l *loqateValidator) Validate(ctx context.Context, a Address) (AddressResult, error) {
+	body, _ := json.Marshal(map[string]interface{}{
+		"Key":     l.key,
+		"Geocode": true,
+		"Addresses": []map[string]string{{
+			"Address1": a.Line1, "Address2": a.Line2, "Locality": a.City,
+			"AdministrativeArea": a.Region, "PostalCode": a.PostalCode, "Country": a.Country,
+		}},
+	})
+	var resp []struct {
+		Matches []struct {
+			AVC                string
+			Address1           string
+			Address2           string
+			Locality           string
+			AdministrativeArea string
+			PostalCode         string
+			CountryISO2        string `json:"ISO3166-2"`
+			Latitude           string
+			Longitude          string
+		}
+	}
+	err := postJSON(ctx, l.client, "https://api.addressy.com/Cleansing/International/Batch/v1.00/json4.ws", body, &resp)
+	if err != nil {
+		return AddressResult{}, err
+	}
+	if len(resp) == 0 || len(resp[0].Matches) == 0 {
+		return AddressResult{}, ErrAddressUndeliverable
+	}
+
+	m := resp[0].Matches[0]
+	// The Address Verification Code starts with V (verified), P (partially
+	// verified), A (ambiguous), U (unverified) or R (reverted to input)
+	result := AddressResult{Provider: "loqate", Status: "unverified", Standardized: Address{
+		Line1: m.Address1, Line2: m.Address2, City: m.Locality, Region: m.AdministrativeArea,
+		PostalCode: m.PostalCode, Country: m.CountryISO2,
+	}}
+	switch {
+	case strings.HasPrefix(m.AVC, "V"):
+		result.Status = "verified"
+	case strings.HasPrefix(m.AVC, "P"), strings.HasPrefix(m.AVC, "A"):
+		result.Status = "partial"
+	}
+	var lat, lng float64
+	if _, err := fmt.Sscan(m.Latitude, &lat); err == nil {
+		if _, err := fmt.Sscan(m.Longitude, &lng); err == nil {
+			result.Latitude, result.Longitude = &lat, &lng
+		}
+	}
+	return result, nil
+}
+
+// uspsValidator uses the USPS Addresses API, which covers US addresses only
+// and returns no geocode
+type uspsValidator struct {
+	client   *http.Client
+	clientID string
+	secret   string
+
+	mu      sync.Mutex
+	token   string
+	expires time.Time
+}
+
+// accessToken returns a cached OAuth client-credentials token
+func (u *uspsValidator) accessToken(ctx context.Context) (string, error) {
+	u.mu.Lock()
+	defer u.mu.Unlock()
+	if u.token != "" && time.Now().Before(u.expires) {
+		return u.token, nil
+	}
+
+	body, _ := json.Marshal(map[string]string{
+		"grant_type": "client_credentials", "client_id": u.clientID, "client_secret": u.secret,
+	})
+	var resp struct {
+		AccessToken string `json:"access_token"`
+		ExpiresIn   int    `json:"expires_in"`
+	}
+	if err := postJSON(ctx, u.client, "https://apis.usps.com/oauth2/v3/token", body, &resp); err != nil {
+		return "", err
+	}
+	u.token = resp.AccessToken
+	u.expires = time.Now().Add(time.Duration(resp.ExpiresIn)*time.Second - time.Minute)
+	return u.token, nil
+}
+
+func (u *uspsValidator) Validate(ctx context.Context, a Address) (AddressResult, error) {
+	if !strings.EqualFold(a.Country, "US") {
+		return basicAddressValidator{}.Validate(ctx, a)
+	}
+	token, err := u.accessToken(ctx)
+	if err != nil {
+		return AddressResult{}, err
+	}
+
+	q := url.Values{}
+	q.Set("streetAddress", a.Line1)
+	q.Set("secondaryAddress", a.Line2)
+	q.Set("city", a.City)
+	q.Set("state", a.Region)
+	q.Set("ZIPCode", a.PostalCode)
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, "https://apis.usps.com/addresses/v3/address?"+q.Encode(), nil)
+	if err != nil {
+		return AddressResult{}, err
+	}
+	req.Header.Set("Authorization", "Bearer "+token)
+	resp, err := u.client.Do(req)
+	if err != nil {
+		return AddressResult{}, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode == http.StatusNotFound || resp.StatusCode == http.StatusBadRequest {
+		return AddressResult{}, ErrAddressUndeliverable
+	}
+	if resp.StatusCode >= 300 {
+		return AddressResult{}, fmt.Errorf("USPS returned status %d", resp.StatusCode)
+	}
+
+	var body struct {
+		Address struct {
+			StreetAddress    string `json:"streetAddress"`
+			SecondaryAddress string `json:"secondaryAddress"`
+			City             string `json:"city"`
+			State            string `json:"state"`
+			ZIPCode          string `json:"ZIPCode"`
+			ZIPPlus4         string `json:"ZIPPlus4"`
+		} `json:"address"`
+		AdditionalInfo struct {
+			DPVConfirmation string `json:"DPVConfirmation"`
+		} `json:"additionalInfo"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&body); err != nil {
+		return AddressResult{}, err
+	}
+
+	zip := body.Address.ZIPCode
+	if body.Address.ZIPPlus4 != "" {
+		zip += "-" + body.Address.ZIPPlus4
+	}
+	// Delivery point validation: Y confirmed, S or D missing secondary details
+	status := "partial"
+	if body.AdditionalInfo.DPVConfirmation == "Y" {
+		status = "verified"
+	}
+	return AddressResult{Provider: "usps", Status: status, Standardized: Address{
+		Line1: body.Address.StreetAddress, Line2: body.Address.SecondaryAddress, City: body.Address.City,
+		Region: body.Address.State, PostalCode: zip, Country: "US",
+	}}, nil
+}
+
+// googleValidator uses the Google Maps Platform Address Validation API
+type googleValidator struct {
+	client *http.Client
+	key    string
+}
+
+func (g *googleValidator) Validate(ctx context.Context, a Address) (AddressResult, error) {
+	lines := []string{a.Line1}
+	if a.Line2 != "" {
+		lines = append(lines, a.Line2)
+	}
+	body, _ := json.Marshal(map[string]interface{}{"address": map[string]interface{}{
+		"regionCode": a.Country, "addressLines": lines, "locality": a.City,
+		"administrativeArea": a.Region, "postalCode": a.PostalCode,
+	}})
+	var resp struct {
+		Result struct {
+			Verdict struct {
+				ValidationGranularity string `json:"validationGranularity"`
+				AddressComplete       bool   `json:"addressComplete"`
+				HasUnconfirmed        bool   `json:"hasUnconfirmedComponents"`
+			} `json:"verdict"`
+			Address struct {
+				PostalAddress struct {
+					RegionCode         string   `json:"regionCode"`
+					PostalCode         string   `json:"postalCode"`
+					AdministrativeArea string   `json:"administrativeArea"`
+					Locality           string   `json:"locality"`
+					AddressLines       []string `json:"addressLines"`
+				} `json:"postalAddress"`
+			} `json:"address"`
+			Geocode struct {
+				Location *struct {
+					Latitude  float64 `json:"latitude"`
+					Longitude float64 `json:"longitude"`
+				} `json:"location"`
+			} `json:"geocode"`
+		} `json:"result"`
+	}
+	endpoint := "https://addressvalidation.googleapis.com/v1:validateAddress?key=" + url.QueryEscape(g.key)
+	if err := postJSON(ctx, g.client, endpoint, body, &resp); err != nil {
+		return AddressResult{}, err
+	}
+
+	v := resp.Result.Verdict
+	if v.ValidationGranularity == "" || v.ValidationGranularity == "OTHER" {
+		return AddressResult{}, ErrAddressUndeliverable
+	}
+	p := resp.Result.Address.PostalAddress
+	result := AddressResult{Provider: "google", Status: "partial", Standardized: Address{
+		City: p.Locality, Region: p.AdministrativeArea, PostalCode: p.PostalCode, Country: p.RegionCode,
+	}}
+	if len(p.AddressLines) > 0 {
+		result.Standardized.Line1 = p.AddressLines[0]
+	}
+	if len(p.AddressLines) > 1 {
+		result.Standardized.Line2 = strings.Join(p.AddressLines[1:], ", ")
+	}
+	if v.AddressComplete && !v.HasUnconfirmed {
+		result.Status = "verified"
+	}
+	if loc := resp.Result.Geocode.Location; loc != nil {
+		result.Latitude, result.Longitude = &loc.Latitude, &loc.Longitude
+	}
+	return result, nil
+}
+
+// postJSON posts a JSON body and decodes the JSON response into out
+func postJSON(ctx context.Context, client *http.Client, endpoint string, body []byte, out interface{}) error {
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, endpoint, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	resp, err := client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode >= 300 {
+		return fmt.Errorf("%s returned status %d", req.URL.Host, resp.StatusCode)
+	}
+	return json.NewDecoder(resp.Body).Decode(out)
+}
+
+// validateAddress runs the configured validator. An address the provider
+// cannot find is an error for the caller; an unreachable provider is not, and
+// the address is kept unverified with local formatting so onboarding goes on.
+func validateAddress(ctx context.Context, a Address) (AddressResult, error) {
+	if err := checkAddress(a); err != nil {
+		return AddressResult{}, err
+	}
+	result, err := addressValidator.Validate(ctx, a)
+	if err == ErrAddressUndeliverable {
+		return AddressResult{}, err
+	}
+	if err != nil {
+		servicekit.RequestLogger(ctx).Warn("address validation unavailable, storing unverified", zap.Error(err))
+		result, _ = basicAddressValidator{}.Validate(ctx, a)
+	}
+	result.Standardized = basicStandardize(result.Standardized)
+	return result, nil
+}
+
+// saveAddress stores the raw and standardized address of a user
+func saveAddress(ctx context.Context, q interface {
+	QueryRowContext(ctx context.Context, query string, args ...interface{}) *sql.Row
+}, userID int, raw Address, result AddressResult) (StandardizedAddress, error) {
+	rawJSON, _ := json.Marshal(raw)
+	standardizedJSON, _ := json.Marshal(result.Standardized)
+	s := StandardizedAddress{AddressResult: result}
+	err := q.QueryRowContext(ctx, `INSERT INTO user_addresses (user_id, raw, standardized, status, latitude, longitude, provider)
+						VALUES ($1, $2, $3, $4, $5, $6, $7)
+						ON CONFLICT (user_id) DO UPDATE SET raw = EXCLUDED.raw, standardized = EXCLUDED.standardized,
+							status = EXCLUDED.status, latitude = EXCLUDED.latitude, longitude = EXCLUDED.longitude,
+							provider = EXCLUDED.provider, validated_at = NOW()
+						RETURNING validated_at::text`,
+		userID, rawJSON, standardizedJSON, result.Status, result.Latitude, result.Longitude, result.Provider).Scan(&s.ValidatedAt)
+	return s, err
+}
+
+// loadAddress reads a user's stored address; both are nil when none is stored
+func loadAddress(ctx context.Context, userID int) (*Address, *StandardizedAddress, error) {
+	var rawJSON, standardizedJSON []byte
+	var lat, lng sql.NullFloat64
+	s := StandardizedAddress{}
+	err := db.QueryRowContext(ctx, `SELECT raw, COALESCE(standardized, '{}'), status, latitude, longitude, provider, validated_at::text
+						FROM user_addresses WHERE user_id = $1`, userID).Scan(&rawJSON, &standardizedJSON, &s.Status,
+		&lat, &lng, &s.Provider, &s.ValidatedAt)
+	if err == sql.ErrNoRows {
+		return nil, nil, nil
+	}
+	if err != nil {
+		return nil, nil, err
+	}
+
+	var raw Address
+	if err := json.Unmarshal(rawJSON, &raw); err != nil {
+		return nil, nil, err
+	}
+	if err := json.Unmarshal(standardizedJSON, &s.Standardized); err != nil {
+		return nil, nil, err
+	}
+	if lat.Valid && lng.Valid {
+		s.Latitude, s.Longitude = &lat.Float64, &lng.Float64
+	}
+	return &raw, &s, nil
+}
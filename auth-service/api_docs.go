@@ -0,0 +1,167 @@
+package main
+
+import "bank/servicekit"
+
+// apiDocs annotates the routes in the OpenAPI document served at
+// /openapi.json. Routes without an entry are still listed, with their path
+// parameters and a tag from their first path segment; add an entry when a
+// route is added or its request or response changes.
+var apiDocs = map[string]servicekit.APIOperation{
+	"GET /auth/csrf": {
+		Summary: "Issue a CSRF token for cookie sessions",
+		Tags:    []string{"auth"},
+		Public:  true,
+	},
+	"POST /auth/register": {
+		Summary:  "Register a user",
+		Tags:     []string{"auth"},
+		Request:  registerRequest{},
+		Response: User{},
+		Status:   201,
+		Public:   true,
+	},
+	"POST /auth/login": {
+		Summary:     "Log in",
+		Description: "Returns an access token and a refresh token or, with two-factor authentication on, an MFAChallenge to answer at /auth/mfa/verify. The access token is valid only at audience, one service, by default JWT_DEFAULT_AUDIENCE. Repeated failures lock the account.",
+		Tags:        []string{"auth"},
+		Request:     LoginRequest{},
+		Response:    TokenResponse{},
+		Public:      true,
+	},
+	"POST /auth/mfa/enroll": {
+		Summary:     "Enroll a TOTP authenticator",
+		Description: "Returns the secret, an otpauth:// provisioning URI to show as a QR code and 10 single-use backup codes, once. The factor is enabled by /auth/mfa/confirm.",
+		Tags:        []string{"mfa"},
+		Response:    MFAEnrollment{},
+		Status:      201,
+	},
+	"POST /auth/mfa/confirm": {
+		Summary: "Enable two-factor authentication with a first code",
+		Tags:    []string{"mfa"},
+		Request: mfaCodeRequest{},
+	},
+	"POST /auth/mfa/disable": {
+		Summary:     "Disable two-factor authentication",
+		Description: "Takes a current TOTP or backup code.",
+		Tags:        []string{"mfa"},
+		Request:     mfaCodeRequest{},
+	},
+	"POST /auth/mfa/verify": {
+		Summary:     "Complete a login with a two-factor code",
+		Description: "Exchanges the challenge_token from /auth/login and a TOTP or backup code for the tokens, the access token for audience as at /auth/login. Wrong codes count as failed logins.",
+		Tags:        []string{"mfa"},
+		Request:     mfaVerifyRequest{},
+		Response:    TokenResponse{},
+		Public:      true,
+	},
+	"POST /auth/validate": {
+		Summary:     "Validate an access token",
+		Description: "Used by the other services; audience defaults to this service's.",
+		Tags:        []string{"auth"},
+		Request:     validateRequest{},
+		Response:    validateResponse{},
+		Public:      true,
+	},
+	"POST /auth/refresh": {
+		Summary:     "Exchange a refresh token for new tokens",
+		Description: "Refresh tokens rotate; reusing one revokes its whole family. The access token is for audience as at /auth/login.",
+		Tags:        []string{"auth"},
+		Request:     refreshTokenRequest{},
+		Response:    TokenResponse{},
+		Public:      true,
+	},
+	"POST /auth/token": {
+		Summary:     "Exchange an access token for one at another service",
+		Description: "The bearer token must be valid at auth-service; the new token is for audience, in the same session.",
+		Tags:        []string{"auth"},
+		Request:     exchangeTokenRequest{},
+		Response:    TokenResponse{},
+	},
+	"POST /auth/logout": {
+		Summary: "Revoke the session and refresh token",
+		Tags:    []string{"auth"},
+		Request: refreshRequest{},
+	},
+	"POST /auth/forgot-password": {
+		Summary: "Send a password reset link",
+		Tags:    []string{"auth"},
+		Public:  true,
+	},
+	"POST /auth/reset-password": {
+		Summary: "Set a new password with a reset token",
+		Tags:    []string{"auth"},
+		Public:  true,
+	},
+	"GET /auth/token-info": {
+		Summary: "Describe the session of the bearer token",
+		Tags:    []string{"auth"},
+	},
+	"GET /auth/jwks": {
+		Summary:  "Token verification keys",
+		Tags:     []string{"auth"},
+		Response: jwksResponse{},
+		Public:   true,
+	},
+	"GET /users/{id}": {
+		Summary:  "Get a user",
+		Tags:     []string{"users"},
+		Response: User{},
+	},
+	"PUT /users/{id}": {
+		Summary:  "Update a user's profile",
+		Tags:     []string{"users"},
+		Request:  User{},
+		Response: User{},
+	},
+	"POST /users/{id}/change-password": {
+		Summary: "Change a user's password",
+		Tags:    []string{"users"},
+	},
+}
+
+// Request and response bodies without a named type are described here
+
+type registerRequest struct {
+	Username    string   `json:"username"`
+	Email       string   `json:"email"`
+	Password    string   `json:"password"`
+	Role        string   `json:"role,omitempty"`
+	FullName    string   `json:"full_name,omitempty"`
+	Phone       string   `json:"phone,omitempty"`
+	DateOfBirth string   `json:"date_of_birth,omitempty"`
+	Address     *Address `json:"address,omitempty"`
+}
+
+type validateRequest struct {
+	Token    string `json:"token"`
+	Audience string `json:"audience,omitempty"`
+}
+
+type validateResponse struct {
+	Valid                 bool             `json:"valid"`
+	UserID                int              `json:"user_id"`
+	Username              string           `json:"username"`
+	Role                  string           `json:"role"`
+	ExpiresAt             int64            `json:"expires_at"`
+	SessionID             string           `json:"session_id"`
+	IdleExpiresAt         int64            `json:"idle_expires_at"`
+	PendingLegalDocuments []LegalDocument  `json:"pending_legal_documents"`
+	Privileges            map[string]int64 `json:"privileges"`
+}
+
+type refreshRequest struct {
+	RefreshToken string `json:"refresh_token"`
+}
+
+type exchangeTokenRequest struct {
+	Audience string `json:"audience"`
+}
+
+type refreshTokenRequest struct {
+	RefreshToken string `json:"refresh_token"`
+	Audience     string `json:"audience,omitempty"`
+}
+
+type jwksResponse struct {
+	Keys []JSONWebKey `json:"keys"`
+}
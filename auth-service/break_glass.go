@@ -0,0 +1,487 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"bank/servicekit"
+
+	"github.com/gorilla/mux"
+	"github.com/lib/pq"
+	"go.uber.org/zap"
+)
+
+// BreakGlassGrant is a short-lived emergency elevation of a designated admin.
+// While it is active the admin may bypass the restrictions named by its
+// scopes; every activation, use and revocation is written to a dedicated
+// audit trail and raised as a security alert.
+type BreakGlassGrant struct {
+	ID                int                    `json:"id"`
+	UserID            int                    `json:"user_id"`
+	Username          string                 `json:"username"`
+	Scopes            []string               `json:"scopes"`
+	Justification     string                 `json:"justification"`
+	IncidentReference string                 `json:"incident_reference,omitempty"`
+	Status            string                 `json:"status"` // active, expired or revoked
+	ExpiresAt         string                 `json:"expires_at"`
+	RevokedAt         string                 `json:"revoked_at,omitempty"`
+	RevokedBy         string                 `json:"revoked_by,omitempty"`
+	SourceIP          string                 `json:"source_ip"`
+	CreatedAt         string                 `json:"created_at"`
+	Audit             []BreakGlassAuditEntry `json:"audit,omitempty"`
+}
+
+// BreakGlassAuditEntry is one action taken under a break-glass grant
+type BreakGlassAuditEntry struct {
+	ID        int    `json:"id"`
+	GrantID   int    `json:"grant_id"`
+	Action    string `json:"action"` // activated, used or revoked
+	Scope     string `json:"scope,omitempty"`
+	Service   string `json:"service"`
+	Target    string `json:"target,omitempty"`
+	SourceIP  string `json:"source_ip"`
+	CreatedAt string `json:"created_at"`
+}
+
+const breakGlassTablesSQL = `
+	ALTER TABLE users ADD COLUMN IF NOT EXISTS break_glass_eligible BOOLEAN NOT NULL DEFAULT FALSE;
+	CREATE TABLE IF NOT EXISTS break_glass_grants (
+		id SERIAL PRIMARY KEY,
+		user_id INTEGER NOT NULL REFERENCES users(id),
+		scopes TEXT[] NOT NULL,
+		justification TEXT NOT NULL,
+		incident_reference VARCHAR(100) NOT NULL DEFAULT '',
+		expires_at TIMESTAMP NOT NULL,
+		revoked_at TIMESTAMP,
+		revoked_by VARCHAR(100) NOT NULL DEFAULT '',
+		source_ip VARCHAR(45) NOT NULL DEFAULT '',
+		created_at TIMESTAMP NOT NULL DEFAULT NOW()
+	);
+	CREATE INDEX IF NOT EXISTS idx_break_glass_grants_user ON break_glass_grants(user_id, expires_at);
+	CREATE TABLE IF NOT EXISTS break_glass_audit (
+		id SERIAL PRIMARY KEY,
+		grant_id INTEGER NOT NULL REFERENCES break_glass_grants(id),
+		action VARCHAR(20) NOT NULL,
+		scope VARCHAR(30) NOT NULL DEFAULT '',
+		service VARCHAR(50) NOT NULL,
+		target VARCHAR(255) NOT NULL DEFAULT '',
+		source_ip VARCHAR(45) NOT NULL DEFAULT '',
+		created_at TIMESTAMP NOT NULL DEFAULT NOW()
+	);`
+
+// Break-glass scopes
+const (
+	scopeViewMaskedData = "view_masked_data"
+	scopeExceedLimits   = "exceed_limits"
+)
+
+var breakGlassScopes = map[string]bool{scopeViewMaskedData: true, scopeExceedLimits: true}
+
+const (
+	defaultBreakGlassDuration = 15 * time.Minute
+	maxBreakGlassDuration     = time.Hour
+	minJustificationLength    = 20
+)
+
+const breakGlassGrantColumns = `g.id, g.user_id, u.username, g.scopes, g.justification, g.incident_reference,
+	CASE WHEN g.revoked_at IS NOT NULL THEN 'revoked' WHEN g.expires_at <= NOW() THEN 'expired' ELSE 'active' END,
+	g.expires_at, COALESCE(g.revoked_at::text, ''), g.revoked_by, g.source_ip, g.created_at`
+
+func scanBreakGlassGrant(row interface{ Scan(...interface{}) error }, g *BreakGlassGrant) error {
+	return row.Scan(&g.ID, &g.UserID, &g.Username, pq.Array(&g.Scopes), &g.Justification, &g.IncidentReference,
+		&g.Status, &g.ExpiresAt, &g.RevokedAt, &g.RevokedBy, &g.SourceIP, &g.CreatedAt)
+}
+
+// alertBreakGlass raises a real-time security alert: a SIEM event and, for
+// activations, an email to SECURITY_ALERT_EMAIL
+func alertBreakGlass(r *http.Request, g BreakGlassGrant, action, scope, target string) {
+	severity := 8
+	if action == "activated" {
+		severity = 9
+	}
+	emitSecurityEvent(r, SecurityEvent{Type: eventBreakGlass, Severity: severity, Outcome: "success",
+		UserID: strconv.Itoa(g.UserID), Username: g.Username, Message: "Break-glass access " + action,
+		Details: map[string]string{"grant_id": strconv.Itoa(g.ID), "action": action, "scope": scope, "target": target,
+			"justification": g.Justification}})
+
+	recipient := getEnv("SECURITY_ALERT_EMAIL", "")
+	if action != "activated" || recipient == "" {
+		return
+	}
+	err := sendNotification(r.Context(), Notification{
+		Channel:   "email",
+		Recipient: recipient,
+		Template:  "break_glass_activated",
+		Data: map[string]interface{}{
+			"grant_id":           g.ID,
+			"username":           g.Username,
+			"scopes":             g.Scopes,
+			"justification":      g.Justification,
+			"incident_reference": g.IncidentReference,
+			"expires_at":         g.ExpiresAt,
+		},
+	})
+	if err != nil {
+		servicekit.RequestLogger(r.Context()).Error("failed to send break-glass alert", zap.Error(err))
+	}
+}
+
+// recordBreakGlassAction appends to the break-glass audit trail
+func recordBreakGlassAction(q execer, r *http.Request, grantID int, action, scope, service, target string) error {
+	_, err := q.ExecContext(r.Context(), `INSERT INTO break_glass_audit (grant_id, action, scope, service, target, source_ip)
+					  VALUES ($1, $2, $3, $4, $5, $6)`, grantID, action, scope, service, target, clientIP(r))
+	return err
+}
+
+// loadActiveBreakGlass returns the caller's active grant covering scope
+func loadActiveBreakGlass(ctx context.Context, userID int, scope string) (BreakGlassGrant, error) {
+	var g BreakGlassGrant
+	err := scanBreakGlassGrant(db.QueryRowContext(ctx, `SELECT `+breakGlassGrantColumns+` FROM break_glass_grants g
+											JOIN users u ON u.id = g.user_id
+											WHERE g.user_id = $1 AND $2 = ANY(g.scopes)
+											AND g.revoked_at IS NULL AND g.expires_at > NOW()
+											ORDER BY g.id DESC LIMIT 1`, userID, scope), &g)
+	return g, err
+}
+
+// useBreakGlass reports whether the caller holds an active grant for scope,
+// recording and alerting on the use when they do
+func useBreakGlass(r *http.Request, scope, target string) bool {
+	claims, err := bearerClaims(r)
+	if err != nil || claims.Role != "admin" {
+		return false
+	}
+	g, err := loadActiveBreakGlass(r.Context(), claims.UserID, scope)
+	if err != nil {
+		if err != sql.ErrNoRows {
+			servicekit.RequestLogger(r.Context()).Error("failed to load break-glass grant", zap.Error(err))
+		}
+		return false
+	}
+	if err := recordBreakGlassAction(db, r, g.ID, "used", scope, serviceName, target); err != nil {
+		// An unaudited use is not allowed
+		servicekit.RequestLogger(r.Context()).Error("failed to audit break-glass use", zap.Error(err))
+		return false
+	}
+	alertBreakGlass(r, g, "used", scope, target)
+	return true
+}
+
+// setBreakGlassEligibility designates whether an admin may activate break-glass
+// access; withdrawing it revokes any active grant. Admins cannot designate
+// themselves.
+func setBreakGlassEligibility(w http.ResponseWriter, r *http.Request) {
+	claims, ok := requireStaffRole(w, r, "admin")
+	if !ok {
+		return
+	}
+	userID, err := strconv.Atoi(mux.Vars(r)["id"])
+	if err != nil {
+		http.Error(w, "Invalid user ID", http.StatusBadRequest)
+		return
+	}
+	if claims.UserID == userID {
+		http.Error(w, "Admins cannot change their own break-glass eligibility", http.StatusForbidden)
+		return
+	}
+
+	var requestBody struct {
+		Eligible bool `json:"eligible"`
+	}
+	err = json.NewDecoder(r.Body).Decode(&requestBody)
+	if err != nil {
+		http.Error(w, "Invalid request body", http.StatusBadRequest)
+		return
+	}
+
+	var username string
+	err = db.QueryRowContext(r.Context(), `UPDATE users SET break_glass_eligible = $2, updated_at = NOW()
+					   WHERE id = $1 AND (role = 'admin' OR NOT $2) RETURNING username`, userID, requestBody.Eligible).Scan(&username)
+	if err == sql.ErrNoRows {
+		http.Error(w, "Admin user not found", http.StatusNotFound)
+		return
+	}
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	if !requestBody.Eligible {
+		_, err = db.ExecContext(r.Context(), `UPDATE break_glass_grants SET revoked_at = NOW(), revoked_by = $2
+						  WHERE user_id = $1 AND revoked_at IS NULL AND expires_at > NOW()`,
+			userID, claims.Username)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+	}
+
+	emitSecurityEvent(r, SecurityEvent{Type: eventRoleChanged, Severity: 7, Outcome: "success",
+		UserID: strconv.Itoa(userID), Username: username, Message: "Break-glass eligibility changed",
+		Details: map[string]string{"eligible": strconv.FormatBool(requestBody.Eligible),
+			"changed_by": claims.Username}})
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]interface{}{"user_id": userID, "break_glass_eligible": requestBody.Eligible})
+}
+
+// activateBreakGlass opens a grant for the calling admin. A justification is
+// mandatory and the grant expires after at most an hour; one grant may be
+// active at a time.
+func activateBreakGlass(w http.ResponseWriter, r *http.Request) {
+	claims, ok := requireStaffRole(w, r, "admin")
+	if !ok {
+		return
+	}
+	userID := claims.UserID
+
+	var requestBody struct {
+		Scopes            []string `json:"scopes"`
+		Justification     string   `json:"justification"`
+		IncidentReference string   `json:"incident_reference"`
+		DurationMinutes   int      `json:"duration_minutes"`
+	}
+	err := json.NewDecoder(r.Body).Decode(&requestBody)
+	if err != nil {
+		http.Error(w, "Invalid request body", http.StatusBadRequest)
+		return
+	}
+	requestBody.Justification = strings.TrimSpace(requestBody.Justification)
+	if len(requestBody.Justification) < minJustificationLength {
+		http.Error(w, fmt.Sprintf("justification of at least %d characters is required", minJustificationLength),
+			http.StatusBadRequest)
+		return
+	}
+	if len(requestBody.Scopes) == 0 {
+		http.Error(w, "At least one scope is required", http.StatusBadRequest)
+		return
+	}
+	for _, scope := range requestBody.Scopes {
+		if !breakGlassScopes[scope] {
+			http.Error(w, "scopes must be view_masked_data or exceed_limits", http.StatusBadRequest)
+			return
+		}
+	}
+	duration := defaultBreakGlassDuration
+	if requestBody.DurationMinutes != 0 {
+		duration = time.Duration(requestBody.DurationMinutes) * time.Minute
+		if duration < time.Minute || duration > maxBreakGlassDuration {
+			http.Error(w, "duration_minutes must be between 1 and 60", http.StatusBadRequest)
+			return
+		}
+	}
+
+	tx, err := db.BeginTx(r.Context(), nil)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	defer tx.Rollback()
+
+	// Lock the user so concurrent activations cannot both succeed
+	var eligible, active bool
+	err = tx.QueryRowContext(r.Context(), `SELECT break_glass_eligible, EXISTS (SELECT 1 FROM break_glass_grants WHERE user_id = u.id
+					   AND revoked_at IS NULL AND expires_at > NOW())
+					   FROM users u WHERE id = $1 FOR UPDATE`, userID).Scan(&eligible, &active)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	if !eligible {
+		emitSecurityEvent(r, SecurityEvent{Type: eventPermissionDenied, Severity: 8, Outcome: "failure",
+			UserID: strconv.Itoa(userID), Username: claims.Username,
+			Message: "Break-glass activation by an ineligible admin"})
+		http.Error(w, "You are not designated for break-glass access", http.StatusForbidden)
+		return
+	}
+	if active {
+		http.Error(w, "A break-glass grant is already active", http.StatusConflict)
+		return
+	}
+
+	var id int
+	err = tx.QueryRowContext(r.Context(), `INSERT INTO break_glass_grants (user_id, scopes, justification, incident_reference, expires_at,
+					   source_ip) VALUES ($1, $2, $3, $4, NOW() + make_interval(secs => $5), $6) RETURNING id`,
+		userID, pq.Array(requestBody.Scopes), requestBody.Justification, requestBody.IncidentReference,
+		duration.Seconds(), clientIP(r)).Scan(&id)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	if err := recordBreakGlassAction(tx, r, id, "activated", strings.Join(requestBody.Scopes, ","), serviceName, ""); err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	var g BreakGlassGrant
+	err = scanBreakGlassGrant(tx.QueryRowContext(r.Context(), `SELECT `+breakGlassGrantColumns+` FROM break_glass_grants g
+										   JOIN users u ON u.id = g.user_id WHERE g.id = $1`, id), &g)
+	if err == nil {
+		err = tx.Commit()
+	}
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	alertBreakGlass(r, g, "activated", strings.Join(g.Scopes, ","), "")
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusCreated)
+	json.NewEncoder(w).Encode(g)
+}
+
+// revokeBreakGlass ends a grant early; the holder or another admin may revoke it
+func revokeBreakGlass(w http.ResponseWriter, r *http.Request) {
+	claims, ok := requireStaffRole(w, r, "admin")
+	if !ok {
+		return
+	}
+	id, err := strconv.Atoi(mux.Vars(r)["id"])
+	if err != nil {
+		http.Error(w, "Invalid grant ID", http.StatusBadRequest)
+		return
+	}
+
+	tx, err := db.BeginTx(r.Context(), nil)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	defer tx.Rollback()
+
+	result, err := tx.ExecContext(r.Context(), `UPDATE break_glass_grants SET revoked_at = NOW(), revoked_by = $2
+							WHERE id = $1 AND revoked_at IS NULL AND expires_at > NOW()`, id, claims.Username)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	if n, _ := result.RowsAffected(); n == 0 {
+		http.Error(w, "No active break-glass grant found", http.StatusNotFound)
+		return
+	}
+	if err := recordBreakGlassAction(tx, r, id, "revoked", "", serviceName, ""); err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	var g BreakGlassGrant
+	err = scanBreakGlassGrant(tx.QueryRowContext(r.Context(), `SELECT `+breakGlassGrantColumns+` FROM break_glass_grants g
+										   JOIN users u ON u.id = g.user_id WHERE g.id = $1`, id), &g)
+	if err == nil {
+		err = tx.Commit()
+	}
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	alertBreakGlass(r, g, "revoked", "", "")
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(g)
+}
+
+// recordBreakGlassUse lets another service check the caller's grant before
+// bypassing a restriction. It returns 201 when the use is allowed and
+// audited, and 403 when the caller holds no active grant for the scope.
+func recordBreakGlassUse(w http.ResponseWriter, r *http.Request) {
+	claims, ok := requireStaffRole(w, r, "admin")
+	if !ok {
+		return
+	}
+	var requestBody struct {
+		Scope   string `json:"scope"`
+		Service string `json:"service"`
+		Target  string `json:"target"`
+	}
+	err := json.NewDecoder(r.Body).Decode(&requestBody)
+	if err != nil {
+		http.Error(w, "Invalid request body", http.StatusBadRequest)
+		return
+	}
+	if !breakGlassScopes[requestBody.Scope] || requestBody.Service == "" {
+		http.Error(w, "A valid scope and service are required", http.StatusBadRequest)
+		return
+	}
+
+	g, err := loadActiveBreakGlass(r.Context(), claims.UserID, requestBody.Scope)
+	if err == sql.ErrNoRows {
+		http.Error(w, "No active break-glass grant for this scope", http.StatusForbidden)
+		return
+	}
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	err = recordBreakGlassAction(db, r, g.ID, "used", requestBody.Scope, requestBody.Service, requestBody.Target)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	alertBreakGlass(r, g, "used", requestBody.Scope, requestBody.Service+":"+requestBody.Target)
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusCreated)
+	json.NewEncoder(w).Encode(g)
+}
+
+// listBreakGlassGrants returns grants newest first with their audit trail
+// (?active=true for active grants only); for compliance and admin review
+func listBreakGlassGrants(w http.ResponseWriter, r *http.Request) {
+	if _, ok := requireStaffRole(w, r, complianceRoles...); !ok {
+		return
+	}
+
+	rows, err := db.QueryContext(r.Context(), `SELECT `+breakGlassGrantColumns+` FROM break_glass_grants g JOIN users u ON u.id = g.user_id
+						   WHERE NOT $1 OR (g.revoked_at IS NULL AND g.expires_at > NOW())
+						   ORDER BY g.id DESC LIMIT 200`, r.URL.Query().Get("active") == "true")
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	grants := []BreakGlassGrant{}
+	index := map[int]int{}
+	ids := []int64{}
+	for rows.Next() {
+		var g BreakGlassGrant
+		if err := scanBreakGlassGrant(rows, &g); err != nil {
+			rows.Close()
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		g.Audit = []BreakGlassAuditEntry{}
+		index[g.ID] = len(grants)
+		ids = append(ids, int64(g.ID))
+		grants = append(grants, g)
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	rows, err = db.QueryContext(r.Context(), `SELECT id, grant_id, action, scope, service, target, source_ip, created_at
+						  FROM break_glass_audit WHERE grant_id = ANY($1) ORDER BY id`, pq.Array(ids))
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var a BreakGlassAuditEntry
+		if err := rows.Scan(&a.ID, &a.GrantID, &a.Action, &a.Scope, &a.Service, &a.Target, &a.SourceIP,
+			&a.CreatedAt); err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		g := &grants[index[a.GrantID]]
+		g.Audit = append(g.Audit, a)
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(grants)
+}
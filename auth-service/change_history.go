@@ -0,0 +1,224 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+
+	"github.com/gorilla/mux"
+)
+
+// ProfileChange is one field change in the profile audit log
+type ProfileChange struct {
+	ID        int    `json:"id"`
+	Field     string `json:"field"`
+	OldValue  string `json:"old_value,omitempty"`
+	NewValue  string `json:"new_value,omitempty"`
+	Channel   string `json:"channel"`    // web, mobile, branch, contact_centre, api or merge
+	ChangedBy string `json:"changed_by"` // customer, bank or system
+	ActorID   int    `json:"actor_id,omitempty"`
+	SourceIP  string `json:"source_ip,omitempty"`
+	ChangedAt string `json:"changed_at"`
+}
+
+const changeHistoryTablesSQL = `
+	CREATE TABLE IF NOT EXISTS profile_audit_log (
+		id SERIAL PRIMARY KEY,
+		user_id INTEGER NOT NULL REFERENCES users(id),
+		field VARCHAR(30) NOT NULL,
+		old_value TEXT NOT NULL DEFAULT '',
+		new_value TEXT NOT NULL DEFAULT '',
+		channel VARCHAR(20) NOT NULL,
+		actor_id INTEGER,
+		source_ip VARCHAR(45) NOT NULL DEFAULT '',
+		changed_at TIMESTAMP NOT NULL DEFAULT NOW()
+	);
+	CREATE INDEX IF NOT EXISTS idx_profile_audit_log_user ON profile_audit_log(user_id, changed_at);`
+
+// profileChannels are the X-Channel values set by the gateway and branch
+// tools; anything else is recorded as api
+var profileChannels = map[string]bool{"web": true, "mobile": true, "branch": true, "contact_centre": true}
+
+// customerVisibleFields are shown to the customer. Role and status changes
+// stay internal because they can reflect fraud or compliance reviews.
+var customerVisibleFields = map[string]bool{
+	"email": true, "full_name": true, "phone": true, "date_of_birth": true, "address": true, "password": true,
+}
+
+// profileSnapshotSQL reads the audited profile fields of a user. The
+// password is never audited by value; changes to it are recorded directly.
+const profileSnapshotSQL = `SELECT u.email, u.full_name, u.phone, COALESCE(u.date_of_birth::text, ''), u.role, u.status,
+	COALESCE((SELECT concat_ws(', ', a.raw->>'line1', NULLIF(a.raw->>'line2', ''), a.raw->>'city',
+		NULLIF(a.raw->>'region', ''), a.raw->>'postal_code', a.raw->>'country')
+		FROM user_addresses a WHERE a.user_id = u.id), '')
+	FROM users u WHERE u.id = $1`
+
+type queryRower interface {
+	QueryRowContext(ctx context.Context, query string, args ...interface{}) *sql.Row
+}
+
+type execer interface {
+	ExecContext(ctx context.Context, query string, args ...interface{}) (sql.Result, error)
+}
+
+// profileSnapshot returns the audited fields of a user keyed by field name
+func profileSnapshot(ctx context.Context, q queryRower, userID int) (map[string]string, error) {
+	var email, name, phone, dob, role, status, address string
+	err := q.QueryRowContext(ctx, profileSnapshotSQL, userID).Scan(&email, &name, &phone, &dob, &role, &status, &address)
+	if err != nil {
+		return nil, err
+	}
+	return map[string]string{
+		"email": email, "full_name": name, "phone": phone, "date_of_birth": dob,
+		"role": role, "status": status, "address": address,
+	}, nil
+}
+
+// profileChannel returns the channel a request came through
+func profileChannel(r *http.Request) string {
+	if channel := r.Header.Get("X-Channel"); profileChannels[channel] {
+		return channel
+	}
+	return "api"
+}
+
+// profileActor returns the authenticated caller's user ID, or nil when the
+// request carries no valid bearer token
+func profileActor(r *http.Request) interface{} {
+	claims, err := bearerClaims(r)
+	if err != nil {
+		return nil
+	}
+	return claims.UserID
+}
+
+// recordProfileChanges writes one audit entry per field that differs between
+// the before and after snapshots
+func recordProfileChanges(q execer, r *http.Request, userID int, channel string, before, after map[string]string) error {
+	actor := profileActor(r)
+	for field, newValue := range after {
+		if before[field] == newValue {
+			continue
+		}
+		_, err := q.ExecContext(r.Context(), `INSERT INTO profile_audit_log (user_id, field, old_value, new_value, channel, actor_id, source_ip)
+						  VALUES ($1, $2, $3, $4, $5, $6, $7)`,
+			userID, field, before[field], newValue, channel, actor, clientIP(r))
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// recordPasswordChange audits a password change without any value
+func recordPasswordChange(q execer, r *http.Request, userID int) error {
+	_, err := q.ExecContext(r.Context(), `INSERT INTO profile_audit_log (user_id, field, channel, actor_id, source_ip)
+					  VALUES ($1, 'password', $2, $3, $4)`, userID, profileChannel(r), profileActor(r), clientIP(r))
+	return err
+}
+
+// maskProfileValue hides PII in values shown back to the customer: emails
+// and phone numbers are partly masked and dates of birth and addresses are
+// reported as changed without their values
+func maskProfileValue(field, value string) string {
+	if value == "" {
+		return ""
+	}
+	switch field {
+	case "email":
+		local, domain, ok := strings.Cut(value, "@")
+		if !ok || local == "" {
+			return "***"
+		}
+		return local[:1] + "***@" + domain
+	case "phone":
+		digits := strings.Map(func(r rune) rune {
+			if r >= '0' && r <= '9' {
+				return r
+			}
+			return -1
+		}, value)
+		if len(digits) <= 4 {
+			return "***"
+		}
+		return "***" + digits[len(digits)-4:]
+	case "full_name", "role", "status":
+		return value
+	default:
+		return ""
+	}
+}
+
+// getChangeHistory returns the profile changes of a user, newest first. The
+// customer sees their own changes with internal fields removed and staff
+// identities withheld. Compliance and admin staff see every field and actor;
+// PII stays masked for everyone unless the caller holds a view_masked_data
+// break-glass grant.
+func getChangeHistory(w http.ResponseWriter, r *http.Request) {
+	userID, err := strconv.Atoi(mux.Vars(r)["id"])
+	if err != nil {
+		http.Error(w, "Invalid user ID", http.StatusBadRequest)
+		return
+	}
+	claims, err := bearerClaims(r)
+	if err != nil {
+		http.Error(w, "Authentication required", http.StatusUnauthorized)
+		return
+	}
+	self := claims.UserID == userID
+	if !self {
+		if _, ok := requireStaffRole(w, r, complianceRoles...); !ok {
+			return
+		}
+	}
+	unmasked := !self && useBreakGlass(r, scopeViewMaskedData, fmt.Sprintf("user:%d/change-history", userID))
+
+	rows, err := db.QueryContext(r.Context(), `SELECT id, field, old_value, new_value, channel, COALESCE(actor_id, 0), source_ip, changed_at
+						   FROM profile_audit_log WHERE user_id = $1 ORDER BY changed_at DESC, id DESC LIMIT 500`, userID)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	defer rows.Close()
+
+	changes := []ProfileChange{}
+	for rows.Next() {
+		var c ProfileChange
+		if err := rows.Scan(&c.ID, &c.Field, &c.OldValue, &c.NewValue, &c.Channel, &c.ActorID, &c.SourceIP,
+			&c.ChangedAt); err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		switch c.ActorID {
+		case 0:
+			c.ChangedBy = "system"
+		case userID:
+			c.ChangedBy = "customer"
+		default:
+			c.ChangedBy = "bank"
+		}
+		if self {
+			if !customerVisibleFields[c.Field] {
+				continue
+			}
+			c.ActorID = 0
+			c.SourceIP = ""
+		}
+		if !unmasked {
+			c.OldValue = maskProfileValue(c.Field, c.OldValue)
+			c.NewValue = maskProfileValue(c.Field, c.NewValue)
+		}
+		changes = append(changes, c)
+	}
+	if err := rows.Err(); err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(changes)
+}
@@ -0,0 +1,106 @@
+package main
+
+import (
+	"crypto/rand"
+	"crypto/subtle"
+	"encoding/base64"
+	"encoding/json"
+	"net/http"
+	"strings"
+)
+
+// csrfConfig controls the double-submit cookie used to protect cookie sessions
+type csrfConfig struct {
+	SessionCookie string
+	CookieName    string
+	HeaderName    string
+	SameSite      http.SameSite
+	Secure        bool
+	Domain        string
+}
+
+func loadCSRFConfig() csrfConfig {
+	cfg := csrfConfig{
+		SessionCookie: getEnv("SESSION_COOKIE_NAME", "bank_session"),
+		CookieName:    getEnv("CSRF_COOKIE_NAME", "csrf_token"),
+		HeaderName:    "X-CSRF-Token",
+		SameSite:      http.SameSiteStrictMode,
+		Secure:        getEnv("CSRF_COOKIE_SECURE", "true") == "true",
+		Domain:        getEnv("CSRF_COOKIE_DOMAIN", ""),
+	}
+
+	switch strings.ToLower(getEnv("CSRF_COOKIE_SAMESITE", "strict")) {
+	case "lax":
+		cfg.SameSite = http.SameSiteLaxMode
+	case "none":
+		// Browsers reject SameSite=None cookies that are not Secure
+		cfg.SameSite = http.SameSiteNoneMode
+		cfg.Secure = true
+	}
+
+	return cfg
+}
+
+// csrfMiddleware validates the CSRF token on state-changing requests made with a
+// session cookie. Requests authenticated with a bearer token are exempt because
+// browsers never attach the Authorization header automatically.
+func csrfMiddleware(cfg csrfConfig) func(http.Handler) http.Handler {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			switch r.Method {
+			case http.MethodGet, http.MethodHead, http.MethodOptions:
+				next.ServeHTTP(w, r)
+				return
+			}
+
+			if strings.HasPrefix(r.Header.Get("Authorization"), "Bearer ") {
+				next.ServeHTTP(w, r)
+				return
+			}
+
+			if _, err := r.Cookie(cfg.SessionCookie); err != nil {
+				next.ServeHTTP(w, r)
+				return
+			}
+
+			cookie, err := r.Cookie(cfg.CookieName)
+			header := r.Header.Get(cfg.HeaderName)
+			if err != nil || cookie.Value == "" || header == "" ||
+				subtle.ConstantTimeCompare([]byte(cookie.Value), []byte(header)) != 1 {
+				http.Error(w, "Invalid CSRF token", http.StatusForbidden)
+				return
+			}
+
+			next.ServeHTTP(w, r)
+		})
+	}
+}
+
+// issueCSRFToken sets a fresh CSRF cookie and returns the token so the web app
+// can echo it back in the X-CSRF-Token header
+func issueCSRFToken(cfg csrfConfig) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		raw := make([]byte, 32)
+		if _, err := rand.Read(raw); err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		token := base64.RawURLEncoding.EncodeToString(raw)
+
+		http.SetCookie(w, &http.Cookie{
+			Name:     cfg.CookieName,
+			Value:    token,
+			Path:     "/",
+			Domain:   cfg.Domain,
+			Secure:   cfg.Secure,
+			SameSite: cfg.SameSite,
+			// The web app must read the cookie value to send it back in the header
+			HttpOnly: false,
+		})
+
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(map[string]string{
+			"csrf_token": token,
+		})
+	}
+}
@@ -0,0 +1,489 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+	"unicode"
+
+	"bank/servicekit"
+
+	"github.com/gorilla/mux"
+)
+
+// DuplicateCandidate is a pair of customer records that likely belong to the
+// same person
+type DuplicateCandidate struct {
+	CustomerID  int      `json:"customer_id"`
+	DuplicateID int      `json:"duplicate_id"`
+	Reasons     []string `json:"reasons"` // email, phone and/or name_dob
+	Score       float64  `json:"score"`
+}
+
+// CustomerMerge is the audit record of folding a duplicate customer into the
+// surviving one
+type CustomerMerge struct {
+	ID            int             `json:"id"`
+	SurvivingID   int             `json:"surviving_id"`
+	MergedID      int             `json:"merged_id"`
+	Reason        string          `json:"reason"`
+	Status        string          `json:"status"` // pending, completed or failed
+	MergedProfile json.RawMessage `json:"merged_profile"`
+	AccountsMoved int             `json:"accounts_moved"`
+	Error         string          `json:"error,omitempty"`
+	MergedBy      string          `json:"merged_by"`
+	CreatedAt     string          `json:"created_at"`
+	CompletedAt   string          `json:"completed_at,omitempty"`
+}
+
+const customerMergeTablesSQL = `
+	ALTER TABLE users ADD COLUMN IF NOT EXISTS full_name VARCHAR(100) NOT NULL DEFAULT '';
+	ALTER TABLE users ADD COLUMN IF NOT EXISTS phone VARCHAR(30) NOT NULL DEFAULT '';
+	ALTER TABLE users ADD COLUMN IF NOT EXISTS date_of_birth DATE;
+	ALTER TABLE users ADD COLUMN IF NOT EXISTS merged_into INTEGER REFERENCES users(id);
+	CREATE TABLE IF NOT EXISTS customer_merges (
+		id SERIAL PRIMARY KEY,
+		surviving_id INTEGER NOT NULL REFERENCES users(id),
+		merged_id INTEGER NOT NULL REFERENCES users(id),
+		reason VARCHAR(255) NOT NULL,
+		status VARCHAR(20) NOT NULL DEFAULT 'pending',
+		merged_profile JSONB NOT NULL,
+		accounts_moved INTEGER NOT NULL DEFAULT 0,
+		error VARCHAR(500) NOT NULL DEFAULT '',
+		merged_by VARCHAR(100) NOT NULL,
+		created_at TIMESTAMP NOT NULL DEFAULT NOW(),
+		completed_at TIMESTAMP
+	);
+	CREATE UNIQUE INDEX IF NOT EXISTS idx_customer_merges_open ON customer_merges(merged_id) WHERE status <> 'failed';`
+
+// Duplicate match weights; a pair matching on several attributes scores the
+// strongest match plus duplicateExtraMatch for each further one
+const (
+	duplicateEmailScore   = 0.9
+	duplicatePhoneScore   = 0.8
+	duplicateNameDOBScore = 0.7
+	duplicateExtraMatch   = 0.05
+	// maxNameDistance is the edit distance between normalized names that
+	// still counts as the same name
+	maxNameDistance = 2
+)
+
+const customerMergeColumns = `id, surviving_id, merged_id, reason, status, merged_profile, accounts_moved, error,
+	merged_by, created_at, COALESCE(completed_at::text, '')`
+
+func scanCustomerMerge(row interface{ Scan(...interface{}) error }, m *CustomerMerge) error {
+	var profile []byte
+	err := row.Scan(&m.ID, &m.SurvivingID, &m.MergedID, &m.Reason, &m.Status, &profile, &m.AccountsMoved, &m.Error,
+		&m.MergedBy, &m.CreatedAt, &m.CompletedAt)
+	m.MergedProfile = profile
+	return err
+}
+
+// requireStaffRole returns the caller's claims, or writes 401/403 and returns
+// false unless the bearer token carries one of roles
+func requireStaffRole(w http.ResponseWriter, r *http.Request, roles ...string) (*servicekit.AccessClaims, bool) {
+	claims, err := bearerClaims(r)
+	if err != nil {
+		http.Error(w, "Authentication required", http.StatusUnauthorized)
+		return nil, false
+	}
+	role := claims.Role
+	for _, allowed := range roles {
+		if role == allowed {
+			return claims, true
+		}
+	}
+	emitSecurityEvent(r, SecurityEvent{Type: eventPermissionDenied, Severity: 6, Outcome: "failure",
+		UserID: strconv.Itoa(claims.UserID), Username: claims.Username,
+		Message: "Staff role required", Details: map[string]string{"path": r.URL.Path}})
+	http.Error(w, "Insufficient permissions", http.StatusForbidden)
+	return nil, false
+}
+
+// normalizeEmail folds addresses that deliver to the same mailbox: case, a
+// "+tag" suffix and dots in the local part
+func normalizeEmail(email string) string {
+	local, domain, ok := strings.Cut(strings.ToLower(strings.TrimSpace(email)), "@")
+	if !ok {
+		return local
+	}
+	if i := strings.Index(local, "+"); i >= 0 {
+		local = local[:i]
+	}
+	return strings.ReplaceAll(local, ".", "") + "@" + domain
+}
+
+// normalizePhone keeps the last 10 digits so national and international
+// formats of one number compare equal
+func normalizePhone(phone string) string {
+	digits := strings.Map(func(c rune) rune {
+		if unicode.IsDigit(c) {
+			return c
+		}
+		return -1
+	}, phone)
+	if len(digits) > 10 {
+		digits = digits[len(digits)-10:]
+	}
+	if len(digits) < 7 {
+		return ""
+	}
+	return digits
+}
+
+// normalizeName lowercases a name and sorts its words, so "Smith, John" and
+// "John Smith" compare equal
+func normalizeName(name string) string {
+	words := strings.FieldsFunc(strings.ToLower(name), func(c rune) bool { return !unicode.IsLetter(c) })
+	sort.Strings(words)
+	return strings.Join(words, " ")
+}
+
+// editDistance is the Levenshtein distance between a and b
+func editDistance(a, b string) int {
+	ra, rb := []rune(a), []rune(b)
+	prev := make([]int, len(rb)+1)
+	for j := range prev {
+		prev[j] = j
+	}
+	for i := 1; i <= len(ra); i++ {
+		cur := make([]int, len(rb)+1)
+		cur[0] = i
+		for j := 1; j <= len(rb); j++ {
+			cost := 1
+			if ra[i-1] == rb[j-1] {
+				cost = 0
+			}
+			cur[j] = min3(prev[j]+1, cur[j-1]+1, prev[j-1]+cost)
+		}
+		prev = cur
+	}
+	return prev[len(rb)]
+}
+
+func min3(a, b, c int) int {
+	if b < a {
+		a = b
+	}
+	if c < a {
+		a = c
+	}
+	return a
+}
+
+type customerRecord struct {
+	ID    int
+	Email string
+	Phone string
+	Name  string
+	DOB   string
+}
+
+// findDuplicateCustomers compares active customer records, blocking on
+// normalized email, normalized phone and date of birth so only records
+// sharing one of them are compared
+func findDuplicateCustomers(ctx context.Context) ([]DuplicateCandidate, error) {
+	rows, err := db.QueryContext(ctx, `SELECT id, email, phone, full_name, COALESCE(date_of_birth::text, '')
+						   FROM users WHERE role = 'customer' AND status <> 'merged' ORDER BY id`)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	byEmail := map[string][]customerRecord{}
+	byPhone := map[string][]customerRecord{}
+	byDOB := map[string][]customerRecord{}
+	for rows.Next() {
+		var c customerRecord
+		if err := rows.Scan(&c.ID, &c.Email, &c.Phone, &c.Name, &c.DOB); err != nil {
+			return nil, err
+		}
+		c.Email, c.Phone, c.Name = normalizeEmail(c.Email), normalizePhone(c.Phone), normalizeName(c.Name)
+		byEmail[c.Email] = append(byEmail[c.Email], c)
+		if c.Phone != "" {
+			byPhone[c.Phone] = append(byPhone[c.Phone], c)
+		}
+		if c.DOB != "" && c.Name != "" {
+			byDOB[c.DOB] = append(byDOB[c.DOB], c)
+		}
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+
+	type pair struct{ a, b int }
+	reasons := map[pair][]string{}
+	collect := func(groups map[string][]customerRecord, reason string, match func(a, b customerRecord) bool) {
+		for _, group := range groups {
+			for i := 0; i < len(group); i++ {
+				for j := i + 1; j < len(group); j++ {
+					if match(group[i], group[j]) {
+						p := pair{group[i].ID, group[j].ID}
+						reasons[p] = append(reasons[p], reason)
+					}
+				}
+			}
+		}
+	}
+	always := func(a, b customerRecord) bool { return true }
+	collect(byEmail, "email", always)
+	collect(byPhone, "phone", always)
+	collect(byDOB, "name_dob", func(a, b customerRecord) bool {
+		return editDistance(a.Name, b.Name) <= maxNameDistance
+	})
+
+	weights := map[string]float64{"email": duplicateEmailScore, "phone": duplicatePhoneScore, "name_dob": duplicateNameDOBScore}
+	candidates := []DuplicateCandidate{}
+	for p, rs := range reasons {
+		score := 0.0
+		for _, reason := range rs {
+			if weights[reason] > score {
+				score = weights[reason]
+			}
+		}
+		score += duplicateExtraMatch * float64(len(rs)-1)
+		candidates = append(candidates, DuplicateCandidate{CustomerID: p.a, DuplicateID: p.b, Reasons: rs,
+			Score: float64(int(score*100+0.5)) / 100})
+	}
+	sort.Slice(candidates, func(i, j int) bool {
+		if candidates[i].Score != candidates[j].Score {
+			return candidates[i].Score > candidates[j].Score
+		}
+		return candidates[i].CustomerID < candidates[j].CustomerID
+	})
+	return candidates, nil
+}
+
+// listDuplicateCustomers returns likely duplicate pairs, strongest first.
+// ?min_score= filters weaker matches (default 0).
+func listDuplicateCustomers(w http.ResponseWriter, r *http.Request) {
+	if _, ok := requireStaffRole(w, r, "admin"); !ok {
+		return
+	}
+	minScore := 0.0
+	if v := r.URL.Query().Get("min_score"); v != "" {
+		var err error
+		minScore, err = strconv.ParseFloat(v, 64)
+		if err != nil {
+			http.Error(w, "Invalid min_score", http.StatusBadRequest)
+			return
+		}
+	}
+
+	candidates, err := findDuplicateCustomers(r.Context())
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	filtered := []DuplicateCandidate{}
+	for _, c := range candidates {
+		if c.Score >= minScore {
+			filtered = append(filtered, c)
+		}
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(filtered)
+}
+
+var accountServiceClient = &http.Client{Timeout: 10 * time.Second}
+
+// reparentAccounts asks account-service to move the duplicate's accounts and
+// history to the surviving customer and returns how many accounts moved
+func reparentAccounts(r *http.Request, m CustomerMerge) (int, error) {
+	payload, _ := json.Marshal(map[string]int{"to_customer_id": m.SurvivingID, "merge_id": m.ID})
+	url := fmt.Sprintf("%s/v1/customers/%d/reparent", getEnv("ACCOUNT_SERVICE_URL", "http://localhost:8080"), m.MergedID)
+	req, err := http.NewRequestWithContext(r.Context(), http.MethodPost, url, bytes.NewReader(payload))
+	if err != nil {
+		return 0, err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("Authorization", r.Header.Get("Authorization"))
+
+	resp, err := accountServiceClient.Do(req)
+	if err != nil {
+		return 0, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode >= 300 {
+		body, _ := io.ReadAll(io.LimitReader(resp.Body, 200))
+		return 0, fmt.Errorf("account service returned status %d: %s", resp.StatusCode, strings.TrimSpace(string(body)))
+	}
+
+	var result struct {
+		AccountIDs []int `json:"account_ids"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&result); err != nil {
+		return 0, err
+	}
+	return len(result.AccountIDs), nil
+}
+
+// mergeCustomer folds duplicate_id into the customer in the path. The
+// duplicate's accounts and history move to the survivor in account-service,
+// then the duplicate is marked merged, its sessions are revoked and any
+// profile fields the survivor lacks are copied over. A snapshot of the
+// duplicate's profile is kept on the merge record.
+func mergeCustomer(w http.ResponseWriter, r *http.Request) {
+	claims, ok := requireStaffRole(w, r, "admin")
+	if !ok {
+		return
+	}
+	survivingID, err := strconv.Atoi(mux.Vars(r)["id"])
+	if err != nil {
+		http.Error(w, "Invalid customer ID", http.StatusBadRequest)
+		return
+	}
+
+	var requestBody struct {
+		DuplicateID int    `json:"duplicate_id"`
+		Reason      string `json:"reason"`
+	}
+	err = json.NewDecoder(r.Body).Decode(&requestBody)
+	if err != nil {
+		http.Error(w, "Invalid request body", http.StatusBadRequest)
+		return
+	}
+	requestBody.Reason = strings.TrimSpace(requestBody.Reason)
+	if requestBody.DuplicateID == 0 || requestBody.DuplicateID == survivingID || requestBody.Reason == "" {
+		http.Error(w, "A different duplicate_id and a reason are required", http.StatusBadRequest)
+		return
+	}
+	if len(requestBody.Reason) > 255 {
+		http.Error(w, "reason is limited to 255 characters", http.StatusBadRequest)
+		return
+	}
+
+	var activeCustomers int
+	err = db.QueryRowContext(r.Context(), `SELECT COUNT(*) FROM users WHERE id IN ($1, $2) AND role = 'customer' AND status <> 'merged'`,
+		survivingID, requestBody.DuplicateID).Scan(&activeCustomers)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	if activeCustomers != 2 {
+		http.Error(w, "Both records must be unmerged customers", http.StatusNotFound)
+		return
+	}
+
+	actor := fmt.Sprintf("user:%d", claims.UserID)
+	var m CustomerMerge
+	err = scanCustomerMerge(db.QueryRowContext(r.Context(), `INSERT INTO customer_merges (surviving_id, merged_id, reason, merged_profile, merged_by)
+										 SELECT $1, u.id, $3, json_build_object('username', u.username, 'email', u.email,
+											 'full_name', u.full_name, 'phone', u.phone, 'date_of_birth', u.date_of_birth,
+											 'status', u.status, 'created_at', u.created_at), $4
+										 FROM users u WHERE u.id = $2
+										 ON CONFLICT (merged_id) WHERE status <> 'failed' DO NOTHING
+										 RETURNING `+customerMergeColumns,
+		survivingID, requestBody.DuplicateID, requestBody.Reason, actor), &m)
+	if err == sql.ErrNoRows {
+		// Resume a merge of the same pair left pending by an earlier attempt
+		err = scanCustomerMerge(db.QueryRowContext(r.Context(), `SELECT `+customerMergeColumns+` FROM customer_merges
+											 WHERE merged_id = $1 AND surviving_id = $2 AND status = 'pending'`,
+			requestBody.DuplicateID, survivingID), &m)
+		if err == sql.ErrNoRows {
+			http.Error(w, "A merge of this customer into another record is already in progress", http.StatusConflict)
+			return
+		}
+	}
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	moved, err := reparentAccounts(r, m)
+	if err != nil {
+		db.ExecContext(r.Context(), `UPDATE customer_merges SET status = 'failed', error = LEFT($2, 500), completed_at = NOW() WHERE id = $1`,
+			m.ID, err.Error())
+		http.Error(w, "Re-parenting accounts failed: "+err.Error(), http.StatusBadGateway)
+		return
+	}
+
+	tx, err := db.BeginTx(r.Context(), nil)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	defer tx.Rollback()
+
+	before, err := profileSnapshot(r.Context(), tx, survivingID)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	_, err = tx.ExecContext(r.Context(), `UPDATE users s SET full_name = CASE WHEN s.full_name = '' THEN d.full_name ELSE s.full_name END,
+					  phone = CASE WHEN s.phone = '' THEN d.phone ELSE s.phone END,
+					  date_of_birth = COALESCE(s.date_of_birth, d.date_of_birth), updated_at = NOW()
+					  FROM users d WHERE s.id = $1 AND d.id = $2`, survivingID, requestBody.DuplicateID)
+	if err == nil {
+		var after map[string]string
+		after, err = profileSnapshot(r.Context(), tx, survivingID)
+		if err == nil {
+			err = recordProfileChanges(tx, r, survivingID, "merge", before, after)
+		}
+	}
+	if err == nil {
+		_, err = tx.ExecContext(r.Context(), `UPDATE users SET status = 'merged', merged_into = $2, updated_at = NOW() WHERE id = $1`,
+			requestBody.DuplicateID, survivingID)
+	}
+	if err == nil {
+		_, err = tx.ExecContext(r.Context(), `UPDATE user_sessions SET revoked_at = NOW() WHERE user_id = $1 AND revoked_at IS NULL`,
+			requestBody.DuplicateID)
+	}
+	if err == nil {
+		err = scanCustomerMerge(tx.QueryRowContext(r.Context(), `UPDATE customer_merges SET status = 'completed', accounts_moved = $2,
+											 completed_at = NOW() WHERE id = $1 RETURNING `+customerMergeColumns, m.ID, moved), &m)
+	}
+	if err == nil {
+		err = tx.Commit()
+	}
+	if err != nil {
+		// Accounts already moved; the record stays pending and a retry
+		// resumes it, which account-service treats as a repeat
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	emitSecurityEvent(r, SecurityEvent{Type: eventCustomerMerged, Severity: 6, Outcome: "success",
+		UserID: strconv.Itoa(claims.UserID), Username: claims.Username, Message: "Customer records merged",
+		Details: map[string]string{"surviving_id": strconv.Itoa(survivingID), "merged_id": strconv.Itoa(requestBody.DuplicateID)}})
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(m)
+}
+
+// listCustomerMerges returns the merge audit trail involving the customer
+func listCustomerMerges(w http.ResponseWriter, r *http.Request) {
+	if _, ok := requireStaffRole(w, r, "admin"); !ok {
+		return
+	}
+
+	rows, err := db.QueryContext(r.Context(), `SELECT `+customerMergeColumns+` FROM customer_merges
+						   WHERE surviving_id = $1 OR merged_id = $1 ORDER BY id DESC`, mux.Vars(r)["id"])
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	defer rows.Close()
+
+	merges := []CustomerMerge{}
+	for rows.Next() {
+		var m CustomerMerge
+		if err := scanCustomerMerge(rows, &m); err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		merges = append(merges, m)
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(merges)
+}
@@ -0,0 +1,275 @@
+package main
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/sha256"
+	"crypto/x509"
+	"database/sql"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"bank/servicekit"
+
+	"github.com/gorilla/mux"
+	"go.uber.org/zap"
+)
+
+// DeviceKey is a public key held in a customer's mobile device keystore. The
+// private key never leaves the device; it signs confirmations of high-value
+// transfers which other services verify here.
+type DeviceKey struct {
+	ID         int    `json:"id"`
+	UserID     int    `json:"user_id"`
+	DeviceName string `json:"device_name"`
+	PublicKey  string `json:"public_key"` // base64 DER SubjectPublicKeyInfo, ECDSA P-256
+	Status     string `json:"status"`     // active or revoked
+	CreatedAt  string `json:"created_at"`
+	LastUsedAt string `json:"last_used_at,omitempty"`
+	RevokedAt  string `json:"revoked_at,omitempty"`
+}
+
+const deviceKeyTablesSQL = `
+	CREATE TABLE IF NOT EXISTS device_keys (
+		id SERIAL PRIMARY KEY,
+		user_id INTEGER NOT NULL REFERENCES users(id),
+		device_name VARCHAR(100) NOT NULL,
+		public_key TEXT NOT NULL,
+		status VARCHAR(10) NOT NULL DEFAULT 'active',
+		created_at TIMESTAMP NOT NULL DEFAULT NOW(),
+		last_used_at TIMESTAMP,
+		revoked_at TIMESTAMP
+	);
+	CREATE INDEX IF NOT EXISTS idx_device_keys_user ON device_keys(user_id);
+	CREATE TABLE IF NOT EXISTS device_signature_nonces (
+		key_id INTEGER NOT NULL REFERENCES device_keys(id),
+		nonce VARCHAR(64) NOT NULL,
+		used_at TIMESTAMP NOT NULL DEFAULT NOW(),
+		PRIMARY KEY (key_id, nonce)
+	);`
+
+// Device key limits
+const (
+	maxDeviceKeys         = 5
+	signatureMaxClockSkew = 5 * time.Minute
+)
+
+const deviceKeyColumns = `id, user_id, device_name, public_key, status, created_at, COALESCE(last_used_at::text, ''),
+	COALESCE(revoked_at::text, '')`
+
+func scanDeviceKey(row interface{ Scan(...interface{}) error }, k *DeviceKey) error {
+	return row.Scan(&k.ID, &k.UserID, &k.DeviceName, &k.PublicKey, &k.Status, &k.CreatedAt, &k.LastUsedAt, &k.RevokedAt)
+}
+
+// parseDevicePublicKey decodes a base64 DER P-256 public key
+func parseDevicePublicKey(encoded string) (*ecdsa.PublicKey, error) {
+	der, err := base64.StdEncoding.DecodeString(encoded)
+	if err != nil {
+		return nil, fmt.Errorf("public_key must be base64 encoded")
+	}
+	key, err := x509.ParsePKIXPublicKey(der)
+	if err != nil {
+		return nil, fmt.Errorf("public_key is not a valid public key")
+	}
+	ec, ok := key.(*ecdsa.PublicKey)
+	if !ok || ec.Curve != elliptic.P256() {
+		return nil, fmt.Errorf("public_key must be an ECDSA P-256 key")
+	}
+	return ec, nil
+}
+
+// registerDeviceKey registers a public key for the caller's device. The
+// customer is emailed so an unexpected registration can be reported.
+func registerDeviceKey(w http.ResponseWriter, r *http.Request) {
+	claims, err := bearerClaims(r)
+	if err != nil {
+		http.Error(w, "Authentication required", http.StatusUnauthorized)
+		return
+	}
+	userID := claims.UserID
+
+	var k DeviceKey
+	err = json.NewDecoder(r.Body).Decode(&k)
+	if err != nil {
+		http.Error(w, "Invalid request body", http.StatusBadRequest)
+		return
+	}
+	k.DeviceName = strings.TrimSpace(k.DeviceName)
+	if k.DeviceName == "" || len(k.DeviceName) > 100 {
+		http.Error(w, "device_name is required (at most 100 characters)", http.StatusBadRequest)
+		return
+	}
+	if _, err := parseDevicePublicKey(k.PublicKey); err != nil {
+		http.Error(w, "public_key must be a base64 encoded ECDSA P-256 public key", http.StatusBadRequest)
+		return
+	}
+
+	err = scanDeviceKey(db.QueryRowContext(r.Context(), `INSERT INTO device_keys (user_id, device_name, public_key)
+									 SELECT $1, $2, $3 WHERE (SELECT COUNT(*) FROM device_keys
+										 WHERE user_id = $1 AND status = 'active') < $4
+									 RETURNING `+deviceKeyColumns, userID, k.DeviceName, k.PublicKey, maxDeviceKeys), &k)
+	if err == sql.ErrNoRows {
+		http.Error(w, fmt.Sprintf("At most %d device keys may be active; revoke one first", maxDeviceKeys),
+			http.StatusConflict)
+		return
+	}
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	err = sendNotification(r.Context(), Notification{
+		CustomerID: userID,
+		Channel:    "email",
+		Template:   "device_key_registered",
+		Data:       map[string]interface{}{"device_name": k.DeviceName, "registered_at": k.CreatedAt},
+	})
+	if err != nil {
+		servicekit.RequestLogger(r.Context()).Error("failed to send device key notification", zap.Error(err))
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusCreated)
+	json.NewEncoder(w).Encode(k)
+}
+
+func listDeviceKeys(w http.ResponseWriter, r *http.Request) {
+	claims, err := bearerClaims(r)
+	if err != nil {
+		http.Error(w, "Authentication required", http.StatusUnauthorized)
+		return
+	}
+
+	rows, err := db.QueryContext(r.Context(), `SELECT `+deviceKeyColumns+` FROM device_keys WHERE user_id = $1 ORDER BY id`,
+		claims.UserID)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	defer rows.Close()
+
+	keys := []DeviceKey{}
+	for rows.Next() {
+		var k DeviceKey
+		if err := scanDeviceKey(rows, &k); err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		keys = append(keys, k)
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(keys)
+}
+
+func revokeDeviceKey(w http.ResponseWriter, r *http.Request) {
+	claims, err := bearerClaims(r)
+	if err != nil {
+		http.Error(w, "Authentication required", http.StatusUnauthorized)
+		return
+	}
+
+	var k DeviceKey
+	err = scanDeviceKey(db.QueryRowContext(r.Context(), `UPDATE device_keys SET status = 'revoked', revoked_at = NOW()
+									 WHERE id = $1 AND user_id = $2 AND status = 'active' RETURNING `+deviceKeyColumns,
+		mux.Vars(r)["id"], claims.UserID), &k)
+	if err == sql.ErrNoRows {
+		http.Error(w, "Active device key not found", http.StatusNotFound)
+		return
+	}
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(k)
+}
+
+// verifyDeviceSignature checks a signature made by one of the caller's active
+// device keys. Other services build the payload from the operation they are
+// about to execute, so a signature only confirms that exact operation. The
+// nonce may be used once per key and the timestamp must be recent.
+func verifyDeviceSignature(w http.ResponseWriter, r *http.Request) {
+	claims, err := bearerClaims(r)
+	if err != nil {
+		http.Error(w, "Authentication required", http.StatusUnauthorized)
+		return
+	}
+	userID := claims.UserID
+
+	var requestBody struct {
+		KeyID     int    `json:"key_id"`
+		Payload   string `json:"payload"`
+		Signature string `json:"signature"` // base64 ASN.1 DER ECDSA signature of SHA-256(payload)
+		Nonce     string `json:"nonce"`
+		Timestamp int64  `json:"timestamp"`
+	}
+	err = json.NewDecoder(r.Body).Decode(&requestBody)
+	if err != nil {
+		http.Error(w, "Invalid request body", http.StatusBadRequest)
+		return
+	}
+	if requestBody.Nonce == "" || len(requestBody.Nonce) > 64 || requestBody.Payload == "" {
+		http.Error(w, "payload and a nonce of at most 64 characters are required", http.StatusBadRequest)
+		return
+	}
+	skew := time.Since(time.Unix(requestBody.Timestamp, 0))
+	if skew > signatureMaxClockSkew || skew < -signatureMaxClockSkew {
+		http.Error(w, "Signature timestamp is too old or in the future", http.StatusUnauthorized)
+		return
+	}
+
+	reject := func(message string) {
+		emitSecurityEvent(r, SecurityEvent{Type: eventSignatureInvalid, Severity: 6, Outcome: "failure",
+			UserID: strconv.Itoa(userID), Username: claims.Username, Message: message,
+			Details: map[string]string{"key_id": strconv.Itoa(requestBody.KeyID)}})
+		http.Error(w, "Invalid signature", http.StatusUnauthorized)
+	}
+
+	var encoded string
+	err = db.QueryRowContext(r.Context(), `SELECT public_key FROM device_keys WHERE id = $1 AND user_id = $2 AND status = 'active'`,
+		requestBody.KeyID, userID).Scan(&encoded)
+	if err == sql.ErrNoRows {
+		reject("Signature with unknown or revoked device key")
+		return
+	}
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	key, err := parseDevicePublicKey(encoded)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	signature, err := base64.StdEncoding.DecodeString(requestBody.Signature)
+	digest := sha256.Sum256([]byte(requestBody.Payload))
+	if err != nil || !ecdsa.VerifyASN1(key, digest[:], signature) {
+		reject("Device signature verification failed")
+		return
+	}
+
+	result, err := db.ExecContext(r.Context(), `INSERT INTO device_signature_nonces (key_id, nonce) VALUES ($1, $2)
+							ON CONFLICT DO NOTHING`, requestBody.KeyID, requestBody.Nonce)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	if n, _ := result.RowsAffected(); n == 0 {
+		reject("Device signature replayed")
+		return
+	}
+	_, err = db.ExecContext(r.Context(), `UPDATE device_keys SET last_used_at = NOW() WHERE id = $1`, requestBody.KeyID)
+	if err != nil {
+		servicekit.RequestLogger(r.Context()).Error("failed to update device key", zap.Int("device_key_id", requestBody.KeyID), zap.Error(err))
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]interface{}{"valid": true, "key_id": requestBody.KeyID})
+}
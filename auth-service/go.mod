@@ -3,10 +3,32 @@ module bank/auth-service
 go 1.19
 
 require (
+	github.com/golang-jwt/jwt/v5 v5.2.2
 	github.com/gorilla/mux v1.8.0
-	github.com/lib/pq v1.10.7
-	github.com/dgrijalva/jwt-go v3.2.0+incompatible
-	golang.org/x/crypto v0.0.0-20220829220503-c86fa9a7ed90
-	github.com/joho/godotenv v1.4.0
-	github.com/sirupsen/logrus v1.9.0
-)
\ No newline at end of file
+	github.com/lib/pq v1.10.9
+	go.uber.org/zap v1.24.0
+	golang.org/x/crypto v0.8.0
+	google.golang.org/grpc v1.56.3
+)
+
+require (
+	github.com/golang/protobuf v1.5.3 // indirect
+	github.com/pressly/goose/v3 v3.11.2 // indirect
+	github.com/swaggo/files/v2 v2.0.0 // indirect
+	golang.org/x/net v0.9.0 // indirect
+	golang.org/x/sys v0.8.0 // indirect
+	golang.org/x/text v0.9.0 // indirect
+	google.golang.org/genproto v0.0.0-20230410155749-daa745c078e1 // indirect
+	google.golang.org/protobuf v1.31.0 // indirect
+)
+
+require (
+	bank/authrpc v0.0.0
+	bank/servicekit v0.0.0
+	go.uber.org/atomic v1.7.0 // indirect
+	go.uber.org/multierr v1.6.0 // indirect
+)
+
+replace bank/authrpc => ../authrpc
+
+replace bank/servicekit => ../servicekit
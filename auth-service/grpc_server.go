@@ -0,0 +1,235 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"net"
+	"runtime/debug"
+	"strings"
+	"time"
+
+	"bank/authrpc"
+	"bank/servicekit"
+
+	"go.uber.org/zap"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/credentials"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/peer"
+	"google.golang.org/grpc/status"
+)
+
+// The gRPC server answers token validation and user lookups, which other
+// services make on every request, without the JSON encoding and routing of
+// the REST endpoints. Peers authenticate as they do over HTTP, with their
+// SVID or a service token in x-service-token, and are held to the same grants.
+
+// grpcRoutes maps each RPC to the REST route whose grants in peerPermissions
+// and SPIFFE_PERMISSIONS also cover it
+var grpcRoutes = map[string]string{
+	authrpc.AuthService_ValidateToken_FullMethodName: "POST /auth/validate",
+	authrpc.AuthService_GetUser_FullMethodName:       "GET /users/{id}",
+}
+
+var (
+	grpcRequestsTotal = servicekit.NewCounterVec("grpc_requests_total",
+		"gRPC requests by method and status code.", "method", "code")
+	grpcRequestDuration = servicekit.NewHistogramVec("grpc_request_duration_seconds",
+		"gRPC request latency by method.", servicekit.DefaultLatencyBuckets, "method")
+)
+
+type authGRPCServer struct {
+	authrpc.UnimplementedAuthServiceServer
+}
+
+func (authGRPCServer) ValidateToken(ctx context.Context, req *authrpc.ValidateTokenRequest) (*authrpc.ValidateTokenResponse, error) {
+	v, err := checkAccessToken(ctx, req.Token, req.Audience, func(e SecurityEvent) {
+		e.SourceIP = grpcPeerIP(ctx)
+		emitSecurityEvent(nil, e)
+	})
+	switch err {
+	case nil:
+	case errInvalidToken, errSessionEnded:
+		return nil, status.Error(codes.Unauthenticated, err.Error())
+	case errTermsRequired:
+		return nil, status.Error(codes.PermissionDenied, err.Error())
+	default:
+		return nil, err
+	}
+
+	resp := &authrpc.ValidateTokenResponse{
+		UserId:        int64(v.Claims.UserID),
+		Username:      v.Claims.Username,
+		Role:          v.Claims.Role,
+		ExpiresAt:     v.Claims.ExpiresAt.Unix(),
+		SessionId:     v.Session.ID,
+		IdleExpiresAt: v.Session.IdleExpiresAt().Unix(),
+		Privileges:    v.Privileges,
+	}
+	for _, d := range v.PendingDocs {
+		resp.PendingLegalDocuments = append(resp.PendingLegalDocuments, &authrpc.LegalDocument{
+			Id:          int64(d.ID),
+			DocType:     d.DocType,
+			Version:     d.Version,
+			Title:       d.Title,
+			Url:         d.URL,
+			EffectiveAt: d.EffectiveAt.Unix(),
+			EnforcedAt:  d.EnforcedAt.Unix(),
+		})
+	}
+	return resp, nil
+}
+
+func (authGRPCServer) GetUser(ctx context.Context, req *authrpc.GetUserRequest) (*authrpc.User, error) {
+	user, err := loadUser(ctx, int(req.Id))
+	if err == sql.ErrNoRows {
+		return nil, status.Error(codes.NotFound, "User not found")
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	resp := &authrpc.User{
+		Id:          int64(user.ID),
+		Username:    user.Username,
+		Email:       user.Email,
+		Role:        user.Role,
+		Status:      user.Status,
+		FullName:    user.FullName,
+		Phone:       user.Phone,
+		DateOfBirth: user.DateOfBirth,
+		MergedInto:  int64(user.MergedInto),
+		CreatedAt:   user.CreatedAt,
+		UpdatedAt:   user.UpdatedAt,
+	}
+	if a := user.Address; a != nil {
+		resp.Address = &authrpc.Address{Line1: a.Line1, Line2: a.Line2, City: a.City, Region: a.Region,
+			PostalCode: a.PostalCode, Country: a.Country}
+	}
+	return resp, nil
+}
+
+// grpcPeerIP returns the address of the caller
+func grpcPeerIP(ctx context.Context) string {
+	p, ok := peer.FromContext(ctx)
+	if !ok {
+		return ""
+	}
+	host, _, err := net.SplitHostPort(p.Addr.String())
+	if err != nil {
+		return p.Addr.String()
+	}
+	return host
+}
+
+// grpcPeerService returns the service of the caller's SVID, or ""
+func grpcPeerService(ctx context.Context) string {
+	p, ok := peer.FromContext(ctx)
+	if servicekit.WorkloadIdentity == nil || !ok {
+		return ""
+	}
+	tlsInfo, ok := p.AuthInfo.(credentials.TLSInfo)
+	if !ok || len(tlsInfo.State.PeerCertificates) == 0 {
+		return ""
+	}
+	id, err := servicekit.WorkloadIdentity.SPIFFEID(tlsInfo.State.PeerCertificates[0])
+	if err != nil {
+		return ""
+	}
+	return id[strings.LastIndex(id, "/")+1:]
+}
+
+// grpcInterceptor does for RPCs what the HTTP middleware does for requests:
+// it assigns the request ID, authorizes peer services, recovers panics and
+// records metrics and the access log
+func grpcInterceptor(permissions map[string]map[string]bool) grpc.UnaryServerInterceptor {
+	return func(ctx context.Context, req interface{}, info *grpc.UnaryServerInfo, handler grpc.UnaryHandler) (resp interface{}, err error) {
+		md, _ := metadata.FromIncomingContext(ctx)
+		id := ""
+		if ids := md.Get("x-request-id"); len(ids) > 0 && len(ids[0]) <= 128 {
+			id = ids[0]
+		}
+		if id == "" {
+			id = servicekit.NewCorrelationID()
+		}
+		ctx = servicekit.WithRequestID(ctx, id)
+		grpc.SetHeader(ctx, metadata.Pairs("x-request-id", id))
+
+		start := time.Now()
+		defer func() {
+			if recovered := recover(); recovered != nil {
+				report := servicekit.ErrorReport{
+					ID:      id,
+					Kind:    "panic",
+					Level:   "fatal",
+					Message: fmt.Sprint(recovered),
+					Stack:   string(debug.Stack()),
+					Method:  "POST",
+					Path:    info.FullMethod,
+				}
+				servicekit.RequestLogger(ctx).Error("panic serving RPC", zap.String("method", info.FullMethod), zap.String("panic", report.Message))
+				servicekit.ReportError(report)
+				err = status.Error(codes.Internal, "Internal server error (request "+id+")")
+			}
+			// Errors without a status are internal; their text stays in the log
+			if _, ok := status.FromError(err); !ok {
+				servicekit.RequestLogger(ctx).Error("internal error serving RPC", zap.String("method", info.FullMethod), zap.Error(err))
+				err = status.Error(codes.Internal, "Internal server error (request "+id+")")
+			}
+			code := status.Code(err)
+			grpcRequestsTotal.Inc(info.FullMethod, code.String())
+			grpcRequestDuration.Observe(time.Since(start).Seconds(), info.FullMethod)
+			servicekit.RequestLogger(ctx).Info("RPC completed", zap.String("method", info.FullMethod),
+				zap.String("code", code.String()), zap.Duration("duration", time.Since(start)),
+				zap.String("remote_addr", grpcPeerIP(ctx)))
+		}()
+
+		if servicekit.PeerIdentityEnabled() {
+			route := grpcRoutes[info.FullMethod]
+			service := grpcPeerService(ctx)
+			if tokens := md.Get(strings.ToLower(servicekit.ServiceTokenHeader)); service == "" && len(tokens) > 0 && servicekit.ServiceTokensAccepted() {
+				service, err = servicekit.VerifyServiceTokenFor(ctx, tokens[0], "POST", info.FullMethod)
+				if err == servicekit.ErrInvalidServiceToken {
+					return nil, status.Error(codes.Unauthenticated, err.Error())
+				}
+				if err != nil {
+					return nil, err
+				}
+			}
+			if service == "" && serviceOnlyRoutes[route] {
+				return nil, status.Error(codes.Unauthenticated, "Service identity required")
+			}
+			if granted := permissions[service]; service != "" && !granted["*"] && !granted[route] {
+				servicekit.RequestLogger(ctx).Warn("denied peer service", zap.String("route", route), zap.String("peer", service))
+				return nil, status.Error(codes.PermissionDenied, "Service not permitted")
+			}
+		}
+		return handler(ctx, req)
+	}
+}
+
+// startGRPCServer serves the gRPC interface on addr, over mTLS with the
+// workload SVID when SPIFFE is enabled. The returned function stops it once
+// in-flight RPCs have finished.
+func startGRPCServer(addr string) (func(), error) {
+	listener, err := net.Listen("tcp", addr)
+	if err != nil {
+		return nil, err
+	}
+	opts := []grpc.ServerOption{grpc.UnaryInterceptor(grpcInterceptor(servicekit.LoadServicePermissions(peerPermissions)))}
+	if servicekit.WorkloadIdentity != nil {
+		opts = append(opts, grpc.Creds(credentials.NewTLS(servicekit.WorkloadIdentity.ServerTLSConfig())))
+	}
+	server := grpc.NewServer(opts...)
+	authrpc.RegisterAuthServiceServer(server, authGRPCServer{})
+
+	go func() {
+		if err := server.Serve(listener); err != nil {
+			logger.Error("gRPC server failed", zap.Error(err))
+		}
+	}()
+	logger.Info("gRPC server listening", zap.String("addr", addr))
+	return server.GracefulStop, nil
+}
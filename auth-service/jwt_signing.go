@@ -0,0 +1,194 @@
+package main
+
+import (
+	"context"
+	"crypto/ecdsa"
+	"crypto/rsa"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"math/big"
+	"net/http"
+	"sort"
+	"strings"
+
+	"bank/servicekit"
+
+	"github.com/golang-jwt/jwt/v5"
+)
+
+// serviceSecretTablesSQL holds secrets generated at first start, shared by
+// every replica
+const serviceSecretTablesSQL = `
+	CREATE TABLE IF NOT EXISTS service_secrets (
+		name VARCHAR(50) PRIMARY KEY,
+		value VARCHAR(255) NOT NULL,
+		created_at TIMESTAMP NOT NULL DEFAULT NOW()
+	);`
+
+// loadJWTSecret returns JWT_SECRET or, when it is unset, a secret generated
+// by the first replica to start and kept in service_secrets. Each replica
+// generating its own would reject the tokens the others issue.
+func loadJWTSecret(ctx context.Context) ([]byte, error) {
+	if secret := getEnv("JWT_SECRET", ""); secret != "" {
+		return []byte(secret), nil
+	}
+	secret, err := sharedSecret(ctx, "jwt_secret")
+	if err != nil {
+		return nil, err
+	}
+	logger.Warn("JWT_SECRET is not set; using the generated secret shared through the database")
+	return []byte(secret), nil
+}
+
+// sharedSecret returns the secret kept in service_secrets under name,
+// generating it if no replica has yet
+func sharedSecret(ctx context.Context, name string) (string, error) {
+	_, err := db.ExecContext(ctx, `INSERT INTO service_secrets (name, value) VALUES ($1, $2)
+								   ON CONFLICT (name) DO NOTHING`, name, generateRandomKey())
+	if err != nil {
+		return "", err
+	}
+	var secret string
+	err = db.QueryRowContext(ctx, `SELECT value FROM service_secrets WHERE name = $1`, name).Scan(&secret)
+	return secret, err
+}
+
+// jwtSigner signs access tokens. With a remote backend the private key stays
+// in the KMS; tokens carry the key version in the kid header.
+var jwtSigner servicekit.Signer
+
+// signJWT builds and signs a token with jwtSigner
+func signJWT(ctx context.Context, claims jwt.Claims) (string, error) {
+	token := jwt.NewWithClaims(jwt.GetSigningMethod(jwtSigner.Algorithm()), claims)
+	if jwtSigner.PublicKeys() != nil {
+		token.Header["kid"] = jwtSigner.KeyID()
+	}
+	signingString, err := token.SigningString()
+	if err != nil {
+		return "", err
+	}
+	signature, err := jwtSigner.Sign(ctx, []byte(signingString))
+	if err != nil {
+		return "", err
+	}
+	return signingString + "." + base64.RawURLEncoding.EncodeToString(signature), nil
+}
+
+// jwtIssuableAudiences are the services access tokens may be issued for,
+// JWT_AUDIENCES ("account-service,transaction-service,auth-service,notification-service,customer-service")
+func jwtIssuableAudiences() []string {
+	var audiences []string
+	for _, audience := range strings.Split(getEnv("JWT_AUDIENCES", "account-service,transaction-service,auth-service,notification-service,customer-service"), ",") {
+		if audience = strings.TrimSpace(audience); audience != "" {
+			audiences = append(audiences, audience)
+		}
+	}
+	return audiences
+}
+
+// jwtDefaultAudience is the audience of a token issued without one being
+// requested, JWT_DEFAULT_AUDIENCE
+func jwtDefaultAudience() string {
+	return getEnv("JWT_DEFAULT_AUDIENCE", "account-service")
+}
+
+// tokenAudience returns the one service a token is issued for: requested,
+// which must be one of jwtIssuableAudiences, or jwtDefaultAudience. A token
+// names no other service, so it cannot be replayed against one. ok is false
+// for a service tokens are not issued for.
+func tokenAudience(requested string) (audience string, ok bool) {
+	requested = strings.TrimSpace(requested)
+	if requested == "" {
+		return jwtDefaultAudience(), true
+	}
+	for _, audience := range jwtIssuableAudiences() {
+		if audience == requested {
+			return audience, true
+		}
+	}
+	return "", false
+}
+
+// jwtVerificationKey is the jwt.Keyfunc for tokens issued by signJWT. Only the
+// configured algorithm is accepted, so an HMAC token cannot be forged with a
+// public key once a KMS backend is in use.
+func jwtVerificationKey(token *jwt.Token) (interface{}, error) {
+	if token.Method.Alg() != jwtSigner.Algorithm() {
+		return nil, fmt.Errorf("unexpected signing method: %v", token.Header["alg"])
+	}
+	keys := jwtSigner.PublicKeys()
+	if keys == nil {
+		return jwtSecret, nil
+	}
+	kid, _ := token.Header["kid"].(string)
+	key, ok := keys[kid]
+	if !ok {
+		return nil, fmt.Errorf("unknown signing key: %s", kid)
+	}
+	return key, nil
+}
+
+// JSONWebKey is a public key in JWK form (RFC 7517)
+type JSONWebKey struct {
+	KeyType   string `json:"kty"`
+	KeyID     string `json:"kid"`
+	Use       string `json:"use"`
+	Algorithm string `json:"alg"`
+	Curve     string `json:"crv,omitempty"`
+	X         string `json:"x,omitempty"`
+	Y         string `json:"y,omitempty"`
+	N         string `json:"n,omitempty"`
+	E         string `json:"e,omitempty"`
+}
+
+func fixedLengthSegment(n *big.Int, size int) string {
+	return base64.RawURLEncoding.EncodeToString(n.FillBytes(make([]byte, size)))
+}
+
+// getJWKS publishes the token verification keys so other services can check
+// tokens without calling /auth/validate. It is empty for the local backend,
+// whose HMAC secret is never published.
+func getJWKS(w http.ResponseWriter, r *http.Request) {
+	keys := []JSONWebKey{}
+	for kid, public := range jwtSigner.PublicKeys() {
+		jwk := JSONWebKey{KeyID: kid, Use: "sig", Algorithm: jwtSigner.Algorithm()}
+		switch k := public.(type) {
+		case *ecdsa.PublicKey:
+			jwk.KeyType, jwk.Curve = "EC", k.Curve.Params().Name
+			jwk.X, jwk.Y = fixedLengthSegment(k.X, 32), fixedLengthSegment(k.Y, 32)
+		case *rsa.PublicKey:
+			jwk.KeyType = "RSA"
+			jwk.N = base64.RawURLEncoding.EncodeToString(k.N.Bytes())
+			jwk.E = base64.RawURLEncoding.EncodeToString(big.NewInt(int64(k.E)).Bytes())
+		default:
+			continue
+		}
+		keys = append(keys, jwk)
+	}
+	sort.Slice(keys, func(i, j int) bool { return strings.Compare(keys[i].KeyID, keys[j].KeyID) < 0 })
+
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Cache-Control", "public, max-age=300")
+	json.NewEncoder(w).Encode(map[string]interface{}{"keys": keys})
+}
+
+// getSigningKeyUsage reports how often each signing key has been used across
+// the service's replicas
+func getSigningKeyUsage(w http.ResponseWriter, r *http.Request) {
+	if _, ok := requireStaffRole(w, r, "admin"); !ok {
+		return
+	}
+
+	keys, err := servicekit.SigningKeyUsageReport(r.Context())
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"backend": getEnv("SIGNING_BACKEND", "local"),
+		"keys":    keys,
+	})
+}
@@ -0,0 +1,78 @@
+package main
+
+import (
+	"testing"
+	"time"
+
+	"bank/servicekit"
+
+	"github.com/golang-jwt/jwt/v5"
+)
+
+var testJWTSecret = []byte("test-jwt-secret")
+
+// testAccessClaims returns valid claims of an access token for audience
+func testAccessClaims(audience ...string) servicekit.AccessClaims {
+	now := time.Now()
+	return servicekit.AccessClaims{
+		UserID:   7,
+		Username: "alice",
+		Role:     "customer",
+		RegisteredClaims: jwt.RegisteredClaims{
+			Issuer:    servicekit.JWTIssuer(),
+			Audience:  audience,
+			IssuedAt:  jwt.NewNumericDate(now),
+			NotBefore: jwt.NewNumericDate(now),
+			ExpiresAt: jwt.NewNumericDate(now.Add(15 * time.Minute)),
+		},
+	}
+}
+
+func signTestToken(t *testing.T, method jwt.SigningMethod, key interface{}, claims servicekit.AccessClaims) string {
+	t.Helper()
+	token, err := jwt.NewWithClaims(method, claims).SignedString(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return token
+}
+
+// TestGenerateJWTAudience checks an issued token names only the service it
+// was requested for and is refused by every other
+func TestGenerateJWTAudience(t *testing.T) {
+	useTestSigner(t)
+	user := User{ID: 7, Username: "alice", Role: "customer"}
+	session := Session{ID: "session-1", ExpiresAt: time.Now().Add(time.Hour)}
+
+	for _, requested := range []string{"", "transaction-service"} {
+		audience, ok := tokenAudience(requested)
+		if !ok {
+			t.Fatalf("audience %q refused", requested)
+		}
+		token, _, err := generateJWT(user, session, audience)
+		if err != nil {
+			t.Fatal(err)
+		}
+		claims, err := parseTokenFor(token, audience)
+		if err != nil {
+			t.Fatalf("token for %s rejected: %v", audience, err)
+		}
+		if len(claims.Audience) != 1 || claims.Audience[0] != audience {
+			t.Fatalf("token for %q names %v", requested, claims.Audience)
+		}
+		for _, other := range jwtIssuableAudiences() {
+			if other == audience {
+				continue
+			}
+			if _, err := parseTokenFor(token, other); err == nil {
+				t.Errorf("token for %s accepted by %s", audience, other)
+			}
+		}
+	}
+	if jwtDefaultAudience() != "account-service" {
+		t.Errorf("default audience %s, want account-service", jwtDefaultAudience())
+	}
+	if _, ok := tokenAudience("payments-partner"); ok {
+		t.Error("token issued for a service outside JWT_AUDIENCES")
+	}
+}
@@ -0,0 +1,236 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"net/http"
+	"time"
+)
+
+// LegalDocument is a published version of the terms of service or privacy policy
+type LegalDocument struct {
+	ID              int       `json:"id"`
+	DocType         string    `json:"doc_type"` // terms or privacy
+	Version         string    `json:"version"`
+	Title           string    `json:"title"`
+	URL             string    `json:"url"`
+	Body            string    `json:"body,omitempty"`
+	EffectiveAt     time.Time `json:"effective_at"`
+	GracePeriodDays int       `json:"grace_period_days"`
+	EnforcedAt      time.Time `json:"enforced_at"`
+}
+
+// Acceptance records a user agreeing to a document version
+type Acceptance struct {
+	UserID     int       `json:"user_id"`
+	DocType    string    `json:"doc_type"`
+	Version    string    `json:"version"`
+	SourceIP   string    `json:"source_ip"`
+	AcceptedAt time.Time `json:"accepted_at"`
+}
+
+const legalTablesSQL = `
+	CREATE TABLE IF NOT EXISTS legal_documents (
+		id SERIAL PRIMARY KEY,
+		doc_type VARCHAR(20) NOT NULL,
+		version VARCHAR(20) NOT NULL,
+		title VARCHAR(200) NOT NULL,
+		url VARCHAR(500) NOT NULL DEFAULT '',
+		body TEXT NOT NULL DEFAULT '',
+		effective_at TIMESTAMP NOT NULL DEFAULT NOW(),
+		grace_period_days INTEGER NOT NULL DEFAULT 0,
+		created_at TIMESTAMP NOT NULL DEFAULT NOW(),
+		UNIQUE (doc_type, version)
+	);
+	CREATE TABLE IF NOT EXISTS legal_acceptances (
+		id SERIAL PRIMARY KEY,
+		user_id INTEGER NOT NULL REFERENCES users(id),
+		doc_type VARCHAR(20) NOT NULL,
+		version VARCHAR(20) NOT NULL,
+		source_ip VARCHAR(45) NOT NULL DEFAULT '',
+		accepted_at TIMESTAMP NOT NULL DEFAULT NOW(),
+		UNIQUE (user_id, doc_type, version)
+	);`
+
+var legalDocTypes = map[string]bool{
+	"terms":   true,
+	"privacy": true,
+}
+
+// currentLegalDocumentsSQL selects the latest effective version of each document type
+const currentLegalDocumentsSQL = `
+	SELECT DISTINCT ON (doc_type) id, doc_type, version, title, url, body, effective_at, grace_period_days,
+		effective_at + grace_period_days * INTERVAL '1 day'
+	FROM legal_documents WHERE effective_at <= NOW()
+	ORDER BY doc_type, effective_at DESC`
+
+func getCurrentLegalDocuments(w http.ResponseWriter, r *http.Request) {
+	rows, err := db.QueryContext(r.Context(), currentLegalDocumentsSQL)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	defer rows.Close()
+
+	docs := []LegalDocument{}
+	for rows.Next() {
+		var d LegalDocument
+		err := rows.Scan(&d.ID, &d.DocType, &d.Version, &d.Title, &d.URL, &d.Body, &d.EffectiveAt,
+			&d.GracePeriodDays, &d.EnforcedAt)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		docs = append(docs, d)
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(docs)
+}
+
+// publishLegalDocument adds a new document version. It becomes current at
+// effective_at and blocks users who have not accepted it once the grace period ends.
+func publishLegalDocument(w http.ResponseWriter, r *http.Request) {
+	var d LegalDocument
+	err := json.NewDecoder(r.Body).Decode(&d)
+	if err != nil {
+		http.Error(w, "Invalid request body", http.StatusBadRequest)
+		return
+	}
+
+	if !legalDocTypes[d.DocType] {
+		http.Error(w, "doc_type must be terms or privacy", http.StatusBadRequest)
+		return
+	}
+	if d.Version == "" || d.Title == "" {
+		http.Error(w, "version and title are required", http.StatusBadRequest)
+		return
+	}
+	if d.GracePeriodDays < 0 {
+		http.Error(w, "grace_period_days cannot be negative", http.StatusBadRequest)
+		return
+	}
+	if d.EffectiveAt.IsZero() {
+		d.EffectiveAt = time.Now().UTC()
+	}
+
+	query := `INSERT INTO legal_documents (doc_type, version, title, url, body, effective_at, grace_period_days)
+			  VALUES ($1, $2, $3, $4, $5, $6, $7)
+			  ON CONFLICT (doc_type, version) DO NOTHING
+			  RETURNING id, effective_at + grace_period_days * INTERVAL '1 day'`
+
+	err = db.QueryRowContext(r.Context(), query, d.DocType, d.Version, d.Title, d.URL, d.Body, d.EffectiveAt,
+		d.GracePeriodDays).Scan(&d.ID, &d.EnforcedAt)
+	if err != nil {
+		if err == sql.ErrNoRows {
+			http.Error(w, "Document version already exists", http.StatusConflict)
+		} else {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+		}
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusCreated)
+	json.NewEncoder(w).Encode(d)
+}
+
+// acceptLegalDocument records the caller's acceptance of a document version
+func acceptLegalDocument(w http.ResponseWriter, r *http.Request) {
+	claims, err := bearerClaims(r)
+	if err != nil {
+		http.Error(w, "Authentication required", http.StatusUnauthorized)
+		return
+	}
+	userID := claims.UserID
+
+	var a Acceptance
+	err = json.NewDecoder(r.Body).Decode(&a)
+	if err != nil {
+		http.Error(w, "Invalid request body", http.StatusBadRequest)
+		return
+	}
+
+	a.UserID = userID
+	a.SourceIP = clientIP(r)
+	query := `INSERT INTO legal_acceptances (user_id, doc_type, version, source_ip)
+			  SELECT $1, doc_type, version, $4 FROM legal_documents WHERE doc_type = $2 AND version = $3
+			  ON CONFLICT (user_id, doc_type, version) DO UPDATE SET user_id = EXCLUDED.user_id
+			  RETURNING accepted_at`
+
+	err = db.QueryRowContext(r.Context(), query, a.UserID, a.DocType, a.Version, a.SourceIP).Scan(&a.AcceptedAt)
+	if err != nil {
+		if err == sql.ErrNoRows {
+			http.Error(w, "Document not found", http.StatusNotFound)
+		} else {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+		}
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusCreated)
+	json.NewEncoder(w).Encode(a)
+}
+
+// getLegalAcceptances lists the caller's acceptance history
+func getLegalAcceptances(w http.ResponseWriter, r *http.Request) {
+	claims, err := bearerClaims(r)
+	if err != nil {
+		http.Error(w, "Authentication required", http.StatusUnauthorized)
+		return
+	}
+
+	rows, err := db.QueryContext(r.Context(), `SELECT user_id, doc_type, version, source_ip, accepted_at FROM legal_acceptances
+						   WHERE user_id = $1 ORDER BY accepted_at DESC`, claims.UserID)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	defer rows.Close()
+
+	acceptances := []Acceptance{}
+	for rows.Next() {
+		var a Acceptance
+		err := rows.Scan(&a.UserID, &a.DocType, &a.Version, &a.SourceIP, &a.AcceptedAt)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		acceptances = append(acceptances, a)
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(acceptances)
+}
+
+// pendingLegalDocuments returns the current documents the user has not
+// accepted, and whether any of them is past its grace period
+func pendingLegalDocuments(ctx context.Context, userID int) ([]LegalDocument, bool, error) {
+	rows, err := db.QueryContext(ctx, `SELECT d.id, d.doc_type, d.version, d.title, d.url, d.effective_at, d.grace_period_days,
+						   d.enforced_at, d.enforced_at <= NOW()
+						   FROM (`+currentLegalDocumentsSQL+`) AS d (id, doc_type, version, title, url, body,
+							   effective_at, grace_period_days, enforced_at)
+						   WHERE NOT EXISTS (SELECT 1 FROM legal_acceptances a
+							   WHERE a.user_id = $1 AND a.doc_type = d.doc_type AND a.version = d.version)`, userID)
+	if err != nil {
+		return nil, false, err
+	}
+	defer rows.Close()
+
+	pending := []LegalDocument{}
+	blocked := false
+	for rows.Next() {
+		var d LegalDocument
+		var enforced bool
+		err := rows.Scan(&d.ID, &d.DocType, &d.Version, &d.Title, &d.URL, &d.EffectiveAt, &d.GracePeriodDays,
+			&d.EnforcedAt, &enforced)
+		if err != nil {
+			return nil, false, err
+		}
+		pending = append(pending, d)
+		blocked = blocked || enforced
+	}
+	return pending, blocked, rows.Err()
+}
@@ -0,0 +1,169 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"net/http"
+	"strconv"
+	"time"
+
+	"bank/servicekit"
+
+	"github.com/gorilla/mux"
+	"go.uber.org/zap"
+)
+
+// LoginAttempt is one recorded login attempt
+type LoginAttempt struct {
+	ID        int    `json:"id"`
+	UserID    *int   `json:"user_id,omitempty"`
+	Username  string `json:"username"`
+	Success   bool   `json:"success"`
+	Reason    string `json:"reason,omitempty"` // unknown_user, wrong_password or locked
+	SourceIP  string `json:"source_ip"`
+	CreatedAt string `json:"created_at"`
+}
+
+const lockoutTablesSQL = `
+	ALTER TABLE users ADD COLUMN IF NOT EXISTS failed_login_count INTEGER NOT NULL DEFAULT 0;
+	ALTER TABLE users ADD COLUMN IF NOT EXISTS locked_until TIMESTAMP;
+	CREATE TABLE IF NOT EXISTS login_attempts (
+		id SERIAL PRIMARY KEY,
+		user_id INTEGER REFERENCES users(id),
+		username VARCHAR(100) NOT NULL,
+		success BOOLEAN NOT NULL,
+		reason VARCHAR(30) NOT NULL DEFAULT '',
+		source_ip VARCHAR(64) NOT NULL DEFAULT '',
+		created_at TIMESTAMP NOT NULL DEFAULT NOW()
+	);
+	ALTER TABLE login_attempts ADD COLUMN IF NOT EXISTS user_agent VARCHAR(255) NOT NULL DEFAULT '';
+	CREATE INDEX IF NOT EXISTS idx_login_attempts_user ON login_attempts(user_id, created_at);
+	CREATE INDEX IF NOT EXISTS idx_login_attempts_username ON login_attempts(username, created_at);`
+
+// maxFailedLogins is the number of consecutive wrong passwords that locks an
+// account, LOGIN_MAX_FAILURES
+func maxFailedLogins() int {
+	max, err := strconv.Atoi(getEnv("LOGIN_MAX_FAILURES", "5"))
+	if err != nil || max <= 0 {
+		return 5
+	}
+	return max
+}
+
+// lockoutDuration is how long a locked account stays locked, LOGIN_LOCKOUT_DURATION
+func lockoutDuration() time.Duration {
+	return envDuration("LOGIN_LOCKOUT_DURATION", 15*time.Minute)
+}
+
+var loginsTotal = servicekit.NewCounterVec("bank_logins_total",
+	"Login attempts by outcome: success, unknown_user, wrong_password, wrong_mfa_code or locked.", "outcome")
+
+// recordLoginAttempt stores an attempt; failures to store it are logged
+// rather than failing the login
+func recordLoginAttempt(r *http.Request, userID *int, username string, success bool, reason string) {
+	if success {
+		loginsTotal.Inc("success")
+	} else {
+		loginsTotal.Inc(reason)
+	}
+	_, err := db.ExecContext(r.Context(), `INSERT INTO login_attempts (user_id, username, success, reason, source_ip, user_agent)
+										   VALUES ($1, $2, $3, $4, $5, $6)`, userID, username, success, reason, clientIP(r), loginUserAgent(r))
+	if err != nil {
+		servicekit.RequestLogger(r.Context()).Error("failed to record login attempt", zap.String("username", username), zap.Error(err))
+	}
+}
+
+// lockedUntil returns when the user's lockout ends, or a zero time if the
+// account is not locked
+func lockedUntil(ctx context.Context, userID int) (time.Time, error) {
+	var until sql.NullTime
+	err := db.QueryRowContext(ctx, `SELECT locked_until FROM users WHERE id = $1 AND locked_until > NOW()`,
+		userID).Scan(&until)
+	if err == sql.ErrNoRows {
+		return time.Time{}, nil
+	}
+	return until.Time, err
+}
+
+// registerFailedLogin counts a wrong password and locks the account once
+// maxFailedLogins is reached. The counter restarts after the lockout.
+func registerFailedLogin(r *http.Request, user User) (locked bool, err error) {
+	var until sql.NullTime
+	err = db.QueryRowContext(r.Context(), `UPDATE users SET
+		failed_login_count = CASE WHEN failed_login_count + 1 >= $2 THEN 0 ELSE failed_login_count + 1 END,
+		locked_until = CASE WHEN failed_login_count + 1 >= $2 THEN NOW() + $3 * INTERVAL '1 second' ELSE locked_until END
+		WHERE id = $1 RETURNING locked_until`,
+		user.ID, maxFailedLogins(), int(lockoutDuration()/time.Second)).Scan(&until)
+	if err != nil || !until.Valid || !until.Time.After(time.Now()) {
+		return false, err
+	}
+	emitSecurityEvent(r, SecurityEvent{Type: eventAccountLocked, Severity: 7, Outcome: "success",
+		UserID: strconv.Itoa(user.ID), Username: user.Username, Message: "Account locked after repeated failed logins",
+		Details: map[string]string{"locked_until": until.Time.UTC().Format(time.RFC3339)}})
+	return true, nil
+}
+
+// writeAccountLocked rejects a login to a locked account
+func writeAccountLocked(w http.ResponseWriter, until time.Time) {
+	w.Header().Set("Retry-After", strconv.Itoa(int(time.Until(until).Seconds())+1))
+	http.Error(w, "Account is temporarily locked after too many failed logins", http.StatusLocked)
+}
+
+// getLoginAttempts lists a user's recent login attempts (admin only)
+func getLoginAttempts(w http.ResponseWriter, r *http.Request) {
+	if _, ok := requireStaffRole(w, r, "admin"); !ok {
+		return
+	}
+
+	rows, err := db.QueryContext(r.Context(), `SELECT id, user_id, username, success, reason, source_ip, created_at
+											   FROM login_attempts WHERE user_id = $1 ORDER BY created_at DESC, id DESC LIMIT 100`,
+		mux.Vars(r)["id"])
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	defer rows.Close()
+
+	attempts := []LoginAttempt{}
+	for rows.Next() {
+		var a LoginAttempt
+		if err := rows.Scan(&a.ID, &a.UserID, &a.Username, &a.Success, &a.Reason, &a.SourceIP, &a.CreatedAt); err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		attempts = append(attempts, a)
+	}
+	if err := rows.Err(); err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(attempts)
+}
+
+// unlockUser lifts a lockout and resets the failure count (admin only)
+func unlockUser(w http.ResponseWriter, r *http.Request) {
+	claims, ok := requireStaffRole(w, r, "admin")
+	if !ok {
+		return
+	}
+
+	var username string
+	err := db.QueryRowContext(r.Context(), `UPDATE users SET failed_login_count = 0, locked_until = NULL, updated_at = NOW()
+											WHERE id = $1 RETURNING username`, mux.Vars(r)["id"]).Scan(&username)
+	if err != nil {
+		if err == sql.ErrNoRows {
+			http.Error(w, "User not found", http.StatusNotFound)
+		} else {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+		}
+		return
+	}
+
+	emitSecurityEvent(r, SecurityEvent{Type: eventAccountLocked, Severity: 4, Outcome: "success",
+		UserID: mux.Vars(r)["id"], Username: username, Message: "Account unlocked by administrator",
+		Details: map[string]string{"unlocked_by": claims.Username}})
+	w.WriteHeader(http.StatusNoContent)
+}
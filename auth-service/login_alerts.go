@@ -0,0 +1,52 @@
+package main
+
+import (
+	"net/http"
+	"time"
+
+	"go.uber.org/zap"
+)
+
+// loginUserAgent is the User-Agent recorded with a login attempt
+func loginUserAgent(r *http.Request) string {
+	userAgent := r.UserAgent()
+	if len(userAgent) > 255 {
+		userAgent = userAgent[:255]
+	}
+	return userAgent
+}
+
+// isNewLoginDevice reports whether a successful login comes from a source IP
+// and User-Agent the user has not logged in from before. A user's first
+// login is not reported.
+func isNewLoginDevice(r *http.Request, userID int) (bool, error) {
+	var seenBefore, knownDevice bool
+	err := db.QueryRowContext(r.Context(), `SELECT
+			EXISTS (SELECT 1 FROM login_attempts WHERE user_id = $1 AND success),
+			EXISTS (SELECT 1 FROM login_attempts WHERE user_id = $1 AND success AND source_ip = $2 AND user_agent = $3)`,
+		userID, clientIP(r), loginUserAgent(r)).Scan(&seenBefore, &knownDevice)
+	return seenBefore && !knownDevice, err
+}
+
+// notifyUserEvent publishes a security event about a user to the
+// notification service in the background. The login email is sent along as
+// the fallback email address.
+func notifyUserEvent(eventType string, userID int, data map[string]interface{}) {
+	go func() {
+		var username, email string
+		err := db.QueryRowContext(serviceContext, `SELECT username, email FROM users WHERE id = $1`, userID).Scan(&username, &email)
+		if err == nil {
+			data["username"] = username
+			data["time"] = time.Now().UTC().Format(time.RFC1123)
+			err = publishNotificationEvent(serviceContext, NotificationEvent{
+				Type:       eventType,
+				CustomerID: userID,
+				Data:       data,
+				Recipients: map[string]string{"email": email},
+			})
+		}
+		if err != nil {
+			logger.Error("failed to notify user event", zap.String("event", eventType), zap.Int("user_id", userID), zap.Error(err))
+		}
+	}()
+}
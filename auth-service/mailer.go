@@ -0,0 +1,95 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"net/smtp"
+	"strings"
+	"time"
+
+	"go.uber.org/zap"
+)
+
+// Email is a transactional message to a single recipient. Template and Data
+// are used by mailers that render on their side; Subject and Body are the
+// rendered plain text.
+type Email struct {
+	To       string
+	Subject  string
+	Body     string
+	Template string
+	Data     map[string]interface{}
+}
+
+// Mailer delivers transactional email
+type Mailer interface {
+	Send(ctx context.Context, e Email) error
+}
+
+var mailer Mailer
+
+// newMailer returns the mailer selected by MAILER: "notification" (default,
+// the notification service renders Template) or "smtp"
+func newMailer(name string) Mailer {
+	switch name {
+	case "smtp":
+		return smtpMailer{
+			addr:     net.JoinHostPort(getEnv("SMTP_HOST", "localhost"), getEnv("SMTP_PORT", "587")),
+			username: getEnv("SMTP_USERNAME", ""),
+			password: getEnv("SMTP_PASSWORD", ""),
+			from:     getEnv("MAIL_FROM", "no-reply@bank.local"),
+		}
+	case "notification":
+		return notificationMailer{}
+	}
+	logger.Fatal("unknown MAILER", zap.String("mailer", name))
+	return nil
+}
+
+// notificationMailer hands email to the notification service
+type notificationMailer struct{}
+
+func (notificationMailer) Send(ctx context.Context, e Email) error {
+	return sendNotification(ctx, Notification{Channel: "email", Recipient: e.To, Template: e.Template, Data: e.Data})
+}
+
+// smtpMailer sends plain-text email through an SMTP relay, with STARTTLS when
+// the server offers it and PLAIN auth when SMTP_USERNAME is set
+type smtpMailer struct {
+	addr     string
+	username string
+	password string
+	from     string
+}
+
+func (m smtpMailer) Send(ctx context.Context, e Email) error {
+	if strings.ContainsAny(e.To, "\r\n") || strings.ContainsAny(e.Subject, "\r\n") {
+		return fmt.Errorf("invalid email header")
+	}
+	var auth smtp.Auth
+	if m.username != "" {
+		host, _, _ := net.SplitHostPort(m.addr)
+		auth = smtp.PlainAuth("", m.username, m.password, host)
+	}
+	message := strings.Join([]string{
+		"From: " + m.from,
+		"To: " + e.To,
+		"Subject: " + e.Subject,
+		"Date: " + time.Now().Format(time.RFC1123Z),
+		"MIME-Version: 1.0",
+		"Content-Type: text/plain; charset=UTF-8",
+		"",
+		e.Body,
+	}, "\r\n")
+
+	// net/smtp has no context support; bound the send by the context instead
+	done := make(chan error, 1)
+	go func() { done <- smtp.SendMail(m.addr, auth, m.from, []string{e.To}, []byte(message)) }()
+	select {
+	case err := <-done:
+		return err
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
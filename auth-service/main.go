@@ -1,81 +1,269 @@
 package main
 
 import (
+	"context"
 	"database/sql"
 	"encoding/json"
+	"errors"
 	"fmt"
-	"log"
 	"net/http"
 	"os"
+	"strconv"
 	"time"
-	"strings"
 	"crypto/rand"
 	"crypto/sha256"
 	"encoding/base64"
 
-	"github.com/dgrijalva/jwt-go"
+	"bank/servicekit"
+
+	"github.com/golang-jwt/jwt/v5"
 	"github.com/gorilla/mux"
 	_ "github.com/lib/pq"
+	"go.uber.org/zap"
 	"golang.org/x/crypto/bcrypt"
 )
 
 // User represents a bank customer or employee
 type User struct {
-	ID        int    `json:"id"`
-	Username  string `json:"username"`
-	Email     string `json:"email"`
-	Password  string `json:"-"` // Never expose password in JSON
-	Role      string `json:"role"`
-	Status    string `json:"status"`
-	CreatedAt string `json:"created_at"`
-	UpdatedAt string `json:"updated_at"`
+	ID           int                  `json:"id"`
+	Username     string               `json:"username"`
+	Email        string               `json:"email"`
+	Password     string               `json:"-"`                       // Never expose password in JSON
+	Role         string               `json:"role"`
+	Status       string               `json:"status"`
+	FullName     string               `json:"full_name,omitempty"`
+	Phone        string               `json:"phone,omitempty"`
+	DateOfBirth  string               `json:"date_of_birth,omitempty"` // YYYY-MM-DD
+	MergedInto   int                  `json:"merged_into,omitempty"`   // surviving record once merged as a duplicate
+	Address      *Address             `json:"address,omitempty"`       // as entered
+	Standardized *StandardizedAddress `json:"standardized_address,omitempty"`
+	CreatedAt    string               `json:"created_at"`
+	UpdatedAt    string               `json:"updated_at"`
 }
 
 // LoginRequest represents login credentials
 type LoginRequest struct {
 	Username string `json:"username"`
 	Password string `json:"password"`
+	Audience string `json:"audience,omitempty"` // the service the access token is for
 }
 
 // TokenResponse represents JWT token response
 type TokenResponse struct {
-	Token     string `json:"token"`
-	ExpiresAt int64  `json:"expires_at"`
-	UserID    int    `json:"user_id"`
-	Username  string `json:"username"`
-	Role      string `json:"role"`
+	Token                 string `json:"token"`
+	ExpiresAt             int64  `json:"expires_at"`
+	RefreshToken          string `json:"refresh_token,omitempty"`
+	RefreshTokenExpiresAt int64  `json:"refresh_token_expires_at,omitempty"`
+	UserID                int    `json:"user_id"`
+	Username              string `json:"username"`
+	Role                  string `json:"role"`
 }
 
+// serviceName identifies this service in logs and alerts
+const serviceName = "auth-service"
+
 var db *sql.DB
+
+// peerPermissions are the routes other services may call with their SPIFFE
+// identity or a service token; serviceOnlyRoutes reject callers without one
+var (
+	peerPermissions = map[string][]string{
+		"account-service": {"POST /auth/validate", "POST /break-glass/uses", "POST /device-keys/verify", "GET /users/{id}"},
+		"notification-service": {"POST /auth/validate", "GET /marketing/eligibility"},
+		"customer-service": {"POST /auth/validate"},
+		"api-gateway":     {"*"},
+	}
+	serviceOnlyRoutes = map[string]bool{"POST /break-glass/uses": true, "POST /device-keys/verify": true}
+)
+
+// routePriorities decide what is shed first under overload: token
+// validation, which every other service depends on, last
+var routePriorities = map[string]string{
+	"POST /auth/validate":             "critical",
+	"GET /auth/jwks":                  "critical",
+	"POST /auth/refresh":              "high",
+	"POST /auth/login":                "high",
+	"POST /auth/mfa/verify":           "high",
+	"POST /device-keys/verify":        "high",
+	"GET /customers/duplicates":       "low",
+	"GET /users/{id}/change-history":  "low",
+	"GET /users/{id}/login-attempts":  "low",
+	"GET /marketing/history":          "low",
+	"GET /compliance/screening-queue": "low",
+}
+// routeRateLimits bound attempts per client IP on the routes that take
+// credentials, on top of RATE_LIMIT_PER_IP
+var routeRateLimits = map[string]string{
+	"POST /auth/login":           "10/1m",
+	"POST /auth/register":        "5/1m",
+	"POST /auth/mfa/verify":      "10/1m",
+	"POST /auth/forgot-password": "5/1m",
+	"POST /auth/reset-password":  "10/1m",
+	"POST /auth/refresh":         "30/1m",
+}
 var jwtSecret []byte
+var csrfCfg csrfConfig
 
 func main() {
-	// Initialize JWT secret
-	jwtSecret = []byte(getEnv("JWT_SECRET", generateRandomKey()))
+	servicekit.InitErrorReporting()
+	servicekit.InitSPIFFE()
+	servicekit.InitServiceTokens()
+	servicekit.UseWorkloadIdentity(accountServiceClient, notificationClient)
+
+	loadSessionPolicies()
+	mailer = newMailer(getEnv("MAILER", "notification"))
+	addressValidator = newAddressValidator(getEnv("ADDRESS_PROVIDER", "basic"))
+	screeningProvider = newScreeningProvider(getEnv("SCREENING_PROVIDER", "watchlist"))
 	
+	// "auth-service migrate ..." runs the migrate subcommand and exits
+	servicekit.MigrateCommand(connectDB, baselineSchema)
+
+	// Answer probes while the database is migrated
+	port := getEnv("PORT", "8082")
+	if err := startServer(":" + port); err != nil {
+		logger.Fatal("server failed", zap.Error(err))
+	}
+
 	// Initialize database connection
 	initDB()
 	defer db.Close()
 
+	// Initialize JWT secret; a generated one is shared through the database
+	var err error
+	jwtSecret, err = loadJWTSecret(serviceContext)
+	if err != nil {
+		logger.Fatal("failed to load JWT secret", zap.Error(err))
+	}
+	signer, err := servicekit.NewSigner(getEnv("JWT_SIGNING_KEY", "jwt"), jwtSecret)
+	if err != nil {
+		logger.Fatal("failed to load JWT signing key", zap.Error(err))
+	}
+	jwtSigner = servicekit.MeteredSigner{Signer: signer, Purpose: "jwt"}
+	mfaKey, err = loadMFAKey(serviceContext)
+	if err != nil {
+		logger.Fatal("failed to load MFA key", zap.Error(err))
+	}
+	initEventPublisher()
+
 	// Create router
 	router := mux.NewRouter()
+	router.Use(servicekit.MetricsMiddleware)
+	router.Use(servicekit.LoadSheddingMiddleware(servicekit.LoadRoutePriorities(routePriorities)))
+	router.Use(servicekit.ErrorReportingMiddleware)
+	router.Use(securityHeadersMiddleware(loadSecurityHeaders("api", apiSecurityHeaders)))
+	csrfCfg = loadCSRFConfig()
+	router.Use(servicekit.ServiceIdentityMiddleware(servicekit.LoadServicePermissions(peerPermissions), serviceOnlyRoutes))
+	limiter := servicekit.NewRateLimiter("300/1m", "300/1m", routeRateLimits)
+	router.Use(limiter.IPMiddleware)
+	router.Use(limiter.UserMiddleware(bearerUserID))
+	router.Use(csrfMiddleware(csrfCfg))
 
 	// Define routes
-	router.HandleFunc("/health", healthCheck).Methods("GET")
-	router.HandleFunc("/auth/register", registerUser).Methods("POST")
-	router.HandleFunc("/auth/login", loginUser).Methods("POST")
-	router.HandleFunc("/auth/validate", validateToken).Methods("POST")
-	router.HandleFunc("/users/{id}", getUser).Methods("GET")
-	router.HandleFunc("/users/{id}", updateUser).Methods("PUT")
-	router.HandleFunc("/users/{id}/change-password", changePassword).Methods("POST")
+	router.HandleFunc("/health", servicekit.HealthCheck).Methods("GET")
+	router.HandleFunc("/startup", servicekit.StartupProbe).Methods("GET")
+	router.HandleFunc("/metrics", servicekit.MetricsHandler).Methods("GET")
+	router.HandleFunc("/slo", servicekit.SLOHandler).Methods("GET")
+	v1 := servicekit.APIVersion{Prefix: "/v1", Register: registerV1Routes}
+	servicekit.MountAPIVersions(router, v1)
+	servicekit.MountLegacyRoutes(router, v1)
+	router.HandleFunc("/openapi.json", servicekit.OpenAPIHandler(router, apiDocs, "Auth Service API")).Methods("GET")
+	router.PathPrefix("/docs/").Handler(securityHeadersMiddleware(loadSecurityHeaders("html", htmlSecurityHeaders))(servicekit.SwaggerUIHandler())).Methods("GET")
 
 	// Start server
-	port := getEnv("PORT", "8082")
-	log.Printf("Authentication service starting on port %s...", port)
-	log.Fatal(http.ListenAndServe(":"+port, router))
+	logger.Info("authentication service starting", zap.String("port", port))
+	router.Use(servicekit.ServerErrorMiddleware)
+	servicekit.StartAnomalyDetection()
+	startSecurityEventExporter()
+	startPeriodicScreening()
+	startPrivilegeExpiry()
+	startOutboxRelay()
+	servicekit.StartServiceTokenNonceExpiry()
+	servicekit.StartSLOTracking()
+	servicekit.StartSigningKeyUsageFlush()
+
+	// Serve token validation and user lookups over gRPC as well
+	stopGRPC, err := startGRPCServer(":" + getEnv("GRPC_PORT", "9082"))
+	if err != nil {
+		logger.Fatal("failed to start gRPC server", zap.Error(err))
+	}
+	defer stopGRPC()
+
+	handler := servicekit.RecoveryMiddleware(corsMiddleware(loadCORSConfig())(router))
+	if err := listenAndServe(":"+port, handler); err != nil {
+		logger.Fatal("server failed", zap.Error(err))
+	}
+}
+
+// registerV1Routes defines the v1 authentication API
+func registerV1Routes(r *mux.Router) {
+	r.HandleFunc("/auth/csrf", issueCSRFToken(csrfCfg)).Methods("GET")
+	r.HandleFunc("/auth/register", registerUser).Methods("POST")
+	r.HandleFunc("/auth/login", loginUser).Methods("POST")
+	r.HandleFunc("/auth/mfa/enroll", enrollMFA).Methods("POST")
+	r.HandleFunc("/auth/mfa/confirm", confirmMFA).Methods("POST")
+	r.HandleFunc("/auth/mfa/disable", disableMFA).Methods("POST")
+	r.HandleFunc("/auth/mfa/verify", verifyMFA).Methods("POST")
+	r.HandleFunc("/auth/validate", validateToken).Methods("POST")
+	r.HandleFunc("/auth/refresh", refreshToken).Methods("POST")
+	r.HandleFunc("/auth/token", exchangeToken).Methods("POST")
+	r.HandleFunc("/auth/forgot-password", forgotPassword).Methods("POST")
+	r.HandleFunc("/auth/reset-password", resetPassword).Methods("POST")
+	r.HandleFunc("/auth/logout", logout).Methods("POST")
+	r.HandleFunc("/auth/token-info", getTokenInfo).Methods("GET")
+	r.HandleFunc("/auth/jwks", getJWKS).Methods("GET")
+	r.HandleFunc("/legal/documents", getCurrentLegalDocuments).Methods("GET")
+	r.HandleFunc("/legal/documents", publishLegalDocument).Methods("POST")
+	r.HandleFunc("/legal/acceptances", getLegalAcceptances).Methods("GET")
+	r.HandleFunc("/legal/acceptances", acceptLegalDocument).Methods("POST")
+	r.HandleFunc("/marketing/preferences", getMarketingPreferences).Methods("GET")
+	r.HandleFunc("/marketing/preferences/{channel}", setMarketingPreference).Methods("PUT")
+	r.HandleFunc("/marketing/confirm", confirmMarketingOptIn).Methods("GET")
+	r.HandleFunc("/marketing/history", getConsentHistory).Methods("GET")
+	r.HandleFunc("/marketing/suppressions", addSuppression).Methods("POST")
+	r.HandleFunc("/marketing/suppressions/{channel}/{recipient}", removeSuppression).Methods("DELETE")
+	r.HandleFunc("/marketing/eligibility", checkMarketingEligibility).Methods("GET")
+	r.HandleFunc("/customers/duplicates", listDuplicateCustomers).Methods("GET")
+	r.HandleFunc("/customers/{id}/merge", mergeCustomer).Methods("POST")
+	r.HandleFunc("/customers/{id}/merges", listCustomerMerges).Methods("GET")
+	r.HandleFunc("/compliance/screening-queue", getScreeningQueue).Methods("GET")
+	r.HandleFunc("/compliance/screenings/{id}/review", reviewScreening).Methods("POST")
+	r.HandleFunc("/compliance/watchlist", addWatchlistEntry).Methods("POST")
+	r.HandleFunc("/compliance/watchlist/{id}", deleteWatchlistEntry).Methods("DELETE")
+	r.HandleFunc("/users/{id}/screenings", getUserScreenings).Methods("GET")
+	r.HandleFunc("/users/{id}/screenings", screenUserNow).Methods("POST")
+	r.HandleFunc("/users/{id}/change-history", getChangeHistory).Methods("GET")
+	r.HandleFunc("/users/{id}/break-glass-eligibility", setBreakGlassEligibility).Methods("PUT")
+	r.HandleFunc("/break-glass", activateBreakGlass).Methods("POST")
+	r.HandleFunc("/break-glass", listBreakGlassGrants).Methods("GET")
+	r.HandleFunc("/break-glass/{id}/revoke", revokeBreakGlass).Methods("POST")
+	r.HandleFunc("/break-glass/uses", recordBreakGlassUse).Methods("POST")
+	r.HandleFunc("/users/{id}/manager", setUserManager).Methods("PUT")
+	r.HandleFunc("/privilege-requests", requestPrivilege).Methods("POST")
+	r.HandleFunc("/privilege-requests", listPrivilegeRequests).Methods("GET")
+	r.HandleFunc("/privilege-requests/{id}/approve", approvePrivilegeRequest).Methods("POST")
+	r.HandleFunc("/privilege-requests/{id}/reject", rejectPrivilegeRequest).Methods("POST")
+	r.HandleFunc("/privilege-requests/{id}/revoke", revokePrivilegeRequest).Methods("POST")
+	r.HandleFunc("/device-keys", registerDeviceKey).Methods("POST")
+	r.HandleFunc("/device-keys", listDeviceKeys).Methods("GET")
+	r.HandleFunc("/device-keys/verify", verifyDeviceSignature).Methods("POST")
+	r.HandleFunc("/device-keys/{id}", revokeDeviceKey).Methods("DELETE")
+	r.HandleFunc("/signing-keys/usage", getSigningKeyUsage).Methods("GET")
+	r.HandleFunc("/users/{id}/login-attempts", getLoginAttempts).Methods("GET")
+	r.HandleFunc("/users/{id}/unlock", unlockUser).Methods("POST")
+	r.HandleFunc("/users/{id}", getUser).Methods("GET")
+	r.HandleFunc("/users/{id}", updateUser).Methods("PUT")
+	r.HandleFunc("/users/{id}/change-password", changePassword).Methods("POST")
 }
 
 func initDB() {
+	connectDB()
+	servicekit.SetStartupPhase(servicekit.PhaseMigrating)
+	if err := servicekit.RunMigrations(serviceContext, baselineSchema()); err != nil {
+		logger.Fatal("failed to migrate database", zap.Error(err))
+	}
+}
+
+func connectDB() {
 	// Get database connection parameters from environment variables
 	host := getEnv("DB_HOST", "localhost")
 	port := getEnv("DB_PORT", "5432")
@@ -91,17 +279,21 @@ func initDB() {
 	var err error
 	db, err = sql.Open("postgres", connStr)
 	if err != nil {
-		log.Fatalf("Failed to connect to database: %v", err)
+		logger.Fatal("failed to connect to database", zap.Error(err))
 	}
 
 	// Check connection
-	err = db.Ping()
+	err = db.PingContext(serviceContext)
 	if err != nil {
-		log.Fatalf("Failed to ping database: %v", err)
+		logger.Fatal("failed to ping database", zap.Error(err))
 	}
 
-	log.Println("Successfully connected to database")
+	logger.Info("connected to database")
+}
 
+// baselineSchema is the schema before it was versioned, applied as version 1.
+// It is frozen: change the schema with a new file in migrations/.
+func baselineSchema() []string {
 	// Create users table if it doesn't exist
 	createTableSQL := `
 	CREATE TABLE IF NOT EXISTS users (
@@ -115,23 +307,42 @@ func initDB() {
 		updated_at TIMESTAMP NOT NULL DEFAULT NOW()
 	);`
 
-	_, err = db.Exec(createTableSQL)
-	if err != nil {
-		log.Fatalf("Failed to create users table: %v", err)
+	// The users table first, then the tables owned by the feature modules
+	return []string{
+		createTableSQL,
+		sessionTablesSQL,
+		refreshTokenTablesSQL,
+		legalTablesSQL,
+		marketingTablesSQL,
+		customerMergeTablesSQL,
+		addressTablesSQL,
+		screeningTablesSQL,
+		changeHistoryTablesSQL,
+		breakGlassTablesSQL,
+		privilegeTablesSQL,
+		deviceKeyTablesSQL,
+		lockoutTablesSQL,
+		passwordResetTablesSQL,
+		servicekit.ServiceTokenTablesSQL,
+		servicekit.SLOTablesSQL,
+		servicekit.AnomalyTablesSQL,
+		servicekit.SigningUsageTablesSQL,
+		serviceSecretTablesSQL,
 	}
 }
 
-func healthCheck(w http.ResponseWriter, r *http.Request) {
-	json.NewEncoder(w).Encode(map[string]bool{"status": true})
-}
+var registrationsTotal = servicekit.NewCounterVec("bank_registrations_total", "Users registered, by role.", "role")
 
 func registerUser(w http.ResponseWriter, r *http.Request) {
-	var user User
-	err := json.NewDecoder(r.Body).Decode(&user)
+	// User never reads a password from JSON, so the body is decoded apart
+	var req registerRequest
+	err := json.NewDecoder(r.Body).Decode(&req)
 	if err != nil {
-		http.Error(w, err.Error(), http.StatusBadRequest)
+		http.Error(w, "Invalid request body", http.StatusBadRequest)
 		return
 	}
+	user := User{Username: req.Username, Email: req.Email, Password: req.Password, Role: req.Role,
+		FullName: req.FullName, Phone: req.Phone, DateOfBirth: req.DateOfBirth, Address: req.Address}
 
 	// Validate required fields
 	if user.Username == "" || user.Email == "" || user.Password == "" {
@@ -139,9 +350,20 @@ func registerUser(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
+	// Anyone may register as a customer; every other role is assigned by an
+	// authenticated admin
+	if user.Role == "" {
+		user.Role = "customer"
+	}
+	if user.Role != "customer" {
+		if _, ok := requireStaffRole(w, r, "admin"); !ok {
+			return
+		}
+	}
+
 	// Check if username or email already exists
 	var exists bool
-	err = db.QueryRow("SELECT EXISTS(SELECT 1 FROM users WHERE username = $1 OR email = $2)", 
+	err = db.QueryRowContext(r.Context(), "SELECT EXISTS(SELECT 1 FROM users WHERE username = $1 OR email = $2)", 
 					 user.Username, user.Email).Scan(&exists)
 	if err != nil {
 		http.Error(w, err.Error(), http.StatusInternalServerError)
@@ -160,22 +382,78 @@ func registerUser(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	// Set default role if not provided
-	if user.Role == "" {
-		user.Role = "customer"
+	// Validate the address before creating anything
+	var address AddressResult
+	if user.Address != nil {
+		address, err = validateAddress(r.Context(), *user.Address)
+		if err == ErrAddressUndeliverable {
+			http.Error(w, "Address could not be found", http.StatusUnprocessableEntity)
+			return
+		}
+		if err != nil {
+			http.Error(w, "Address needs line1, city and an ISO 3166-1 alpha-2 country", http.StatusUnprocessableEntity)
+			return
+		}
 	}
 
+	tx, err := db.BeginTx(r.Context(), nil)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	defer tx.Rollback()
+
 	// Insert new user
-	query := `INSERT INTO users (username, email, password, role, status) 
-			  VALUES ($1, $2, $3, $4, 'active') 
+	query := `INSERT INTO users (username, email, password, role, status, full_name, phone, date_of_birth) 
+			  VALUES ($1, $2, $3, $4, 'active', $5, $6, NULLIF($7, '')::date) 
 			  RETURNING id, created_at, updated_at`
 	
-	err = db.QueryRow(query, user.Username, user.Email, string(hashedPassword), user.Role).Scan(&user.ID, &user.CreatedAt, &user.UpdatedAt)
+	err = tx.QueryRowContext(r.Context(), query, user.Username, user.Email, string(hashedPassword), user.Role,
+		user.FullName, user.Phone, user.DateOfBirth).Scan(&user.ID, &user.CreatedAt, &user.UpdatedAt)
 	if err != nil {
 		http.Error(w, err.Error(), http.StatusInternalServerError)
 		return
 	}
 
+	if user.Address != nil {
+		standardized, err := saveAddress(r.Context(), tx, user.ID, *user.Address, address)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		user.Standardized = &standardized
+	}
+
+	err = enqueueEvent(r.Context(), tx, "user.registered", fmt.Sprintf("user:%d", user.ID), map[string]interface{}{
+		"user_id": user.ID, "username": user.Username, "role": user.Role,
+	})
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	err = tx.Commit()
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	// Customers and agents, who are outside the bank, are screened against
+	// sanctions and PEP lists before they can log in. If screening is
+	// unavailable they are held until it succeeds.
+	if user.Role == "customer" || user.Role == "agent" {
+		screening, err := screenUser(r.Context(), user.ID, "registration")
+		if err != nil {
+			servicekit.RequestLogger(r.Context()).Error("screening at registration failed", zap.Int("user_id", user.ID), zap.Error(err))
+			db.ExecContext(r.Context(), "UPDATE users SET status = 'pending_review', updated_at = NOW() WHERE id = $1", user.ID)
+			user.Status = "pending_review"
+		} else if screening.Status == "hit" {
+			user.Status = "pending_review"
+		}
+	}
+
+	registrationsTotal.Inc(user.Role)
+
 	// Don't return password
 	user.Password = ""
 
@@ -188,7 +466,7 @@ func loginUser(w http.ResponseWriter, r *http.Request) {
 	var loginReq LoginRequest
 	err := json.NewDecoder(r.Body).Decode(&loginReq)
 	if err != nil {
-		http.Error(w, err.Error(), http.StatusBadRequest)
+		http.Error(w, "Invalid request body", http.StatusBadRequest)
 		return
 	}
 
@@ -197,14 +475,23 @@ func loginUser(w http.ResponseWriter, r *http.Request) {
 		http.Error(w, "Username and password are required", http.StatusBadRequest)
 		return
 	}
+	audience, ok := tokenAudience(loginReq.Audience)
+	if !ok {
+		http.Error(w, "Unknown audience", http.StatusBadRequest)
+		return
+	}
 
 	// Get user from database
 	var user User
 	query := `SELECT id, username, password, email, role, status FROM users WHERE username = $1`
 	
-	err = db.QueryRow(query, loginReq.Username).Scan(&user.ID, &user.Username, &user.Password, &user.Email, &user.Role, &user.Status)
+	err = db.QueryRowContext(r.Context(), query, loginReq.Username).Scan(&user.ID, &user.Username, &user.Password, &user.Email, &user.Role, &user.Status)
 	if err != nil {
 		if err == sql.ErrNoRows {
+			servicekit.RecordOpsEvent(servicekit.MetricFailedLogins)
+			recordLoginAttempt(r, nil, loginReq.Username, false, "unknown_user")
+			emitSecurityEvent(r, SecurityEvent{Type: eventAuthFailure, Severity: 5, Outcome: "failure",
+				Username: loginReq.Username, Message: "Login for unknown user"})
 			http.Error(w, "Invalid credentials", http.StatusUnauthorized)
 		} else {
 			http.Error(w, err.Error(), http.StatusInternalServerError)
@@ -214,19 +501,90 @@ func loginUser(w http.ResponseWriter, r *http.Request) {
 
 	// Check if user is active
 	if user.Status != "active" {
+		emitSecurityEvent(r, SecurityEvent{Type: eventLoginDenied, Severity: 5, Outcome: "failure",
+			UserID: fmt.Sprint(user.ID), Username: user.Username, Message: "Login to inactive account"})
 		http.Error(w, "Account is not active", http.StatusForbidden)
 		return
 	}
 
+	// Locked accounts are refused before the password is checked
+	until, err := lockedUntil(r.Context(), user.ID)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	if !until.IsZero() {
+		recordLoginAttempt(r, &user.ID, user.Username, false, "locked")
+		emitSecurityEvent(r, SecurityEvent{Type: eventLoginDenied, Severity: 5, Outcome: "failure",
+			UserID: fmt.Sprint(user.ID), Username: user.Username, Message: "Login to locked account"})
+		writeAccountLocked(w, until)
+		return
+	}
+
 	// Verify password
 	err = bcrypt.CompareHashAndPassword([]byte(user.Password), []byte(loginReq.Password))
 	if err != nil {
+		servicekit.RecordOpsEvent(servicekit.MetricFailedLogins)
+		recordLoginAttempt(r, &user.ID, user.Username, false, "wrong_password")
+		emitSecurityEvent(r, SecurityEvent{Type: eventAuthFailure, Severity: 5, Outcome: "failure",
+			UserID: fmt.Sprint(user.ID), Username: user.Username, Message: "Login with wrong password"})
+		locked, err := registerFailedLogin(r, user)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		if locked {
+			http.Error(w, "Account is temporarily locked after too many failed logins", http.StatusLocked)
+			return
+		}
 		http.Error(w, "Invalid credentials", http.StatusUnauthorized)
 		return
 	}
+	_, err = db.ExecContext(r.Context(), `UPDATE users SET failed_login_count = 0 WHERE id = $1 AND failed_login_count > 0`, user.ID)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	// With two-factor authentication on, the password only earns a challenge
+	mfa, err := mfaEnabled(r.Context(), user.ID)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	if mfa {
+		writeMFAChallenge(w, r, user)
+		return
+	}
+	completeLogin(w, r, user, audience)
+}
+
+// completeLogin starts a session for the authenticated user and answers with
+// its refresh token and an access token for audience
+func completeLogin(w http.ResponseWriter, r *http.Request, user User, audience string) {
+	if newDevice, err := isNewLoginDevice(r, user.ID); err != nil {
+		servicekit.RequestLogger(r.Context()).Error("failed to check login device", zap.Int("user_id", user.ID), zap.Error(err))
+	} else if newDevice {
+		notifyUserEvent("login_new_device", user.ID, map[string]interface{}{
+			"source_ip":  clientIP(r),
+			"user_agent": loginUserAgent(r),
+		})
+	}
+	recordLoginAttempt(r, &user.ID, user.Username, true, "")
 
-	// Generate JWT token
-	token, expiresAt, err := generateJWT(user)
+	// Start a session and generate JWT token
+	session, err := startSession(r.Context(), user)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	token, expiresAt, err := generateJWT(user, session, audience)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	refresh, refreshExpiresAt, err := issueRefreshToken(r.Context(), db, session, "",
+		time.Now().Add(policyForRole(user.Role).RefreshLifetime))
 	if err != nil {
 		http.Error(w, err.Error(), http.StatusInternalServerError)
 		return
@@ -234,8 +592,10 @@ func loginUser(w http.ResponseWriter, r *http.Request) {
 
 	// Return token response
 	tokenResponse := TokenResponse{
-		Token:     token,
-		ExpiresAt: expiresAt,
+		Token:                 token,
+		ExpiresAt:             expiresAt,
+		RefreshToken:          refresh,
+		RefreshTokenExpiresAt: refreshExpiresAt.Unix(),
 		UserID:    user.ID,
 		Username:  user.Username,
 		Role:      user.Role,
@@ -245,59 +605,146 @@ func loginUser(w http.ResponseWriter, r *http.Request) {
 	json.NewEncoder(w).Encode(tokenResponse)
 }
 
+// Token validation failures, answered 401, 401 and 403
+var (
+	errInvalidToken  = errors.New("Invalid token")
+	errSessionEnded  = errors.New("Session expired")
+	errTermsRequired = errors.New("Acceptance of the current terms is required")
+)
+
+// tokenValidation is what a valid token tells the calling service
+type tokenValidation struct {
+	Claims      *servicekit.AccessClaims
+	Session     Session
+	PendingDocs []LegalDocument
+	Privileges  map[string]int64
+}
+
+// checkAccessToken validates token for audience, for the HTTP and gRPC
+// interfaces alike. Rejected tokens are passed to report as security events.
+func checkAccessToken(ctx context.Context, token, audience string, report func(SecurityEvent)) (tokenValidation, error) {
+	if audience == "" {
+		audience = servicekit.JWTAudience()
+	}
+	claims, err := parseTokenFor(token, audience)
+	if err != nil {
+		report(SecurityEvent{Type: eventTokenInvalid, Severity: 4, Outcome: "failure",
+			Message: "Token validation failed"})
+		return tokenValidation{}, errInvalidToken
+	}
+
+	// Validation counts as activity and slides the session's idle window
+	session, err := touchSession(ctx, claims.SessionID)
+	if err == sql.ErrNoRows {
+		report(SecurityEvent{Type: eventTokenInvalid, Severity: 4, Outcome: "failure",
+			Username: claims.Username, Message: "Session expired or revoked"})
+		return tokenValidation{}, errSessionEnded
+	}
+	if err != nil {
+		return tokenValidation{}, err
+	}
+
+	// Users must accept the current terms once their grace period ends
+	pendingDocs, blocked, err := pendingLegalDocuments(ctx, claims.UserID)
+	if err != nil {
+		return tokenValidation{}, err
+	}
+	if blocked {
+		return tokenValidation{}, errTermsRequired
+	}
+
+	// Elevated privileges are read live so revocation and expiry apply at once
+	privileges, err := activePrivileges(ctx, claims.UserID)
+	if err != nil {
+		return tokenValidation{}, err
+	}
+	return tokenValidation{Claims: claims, Session: session, PendingDocs: pendingDocs, Privileges: privileges}, nil
+}
+
 func validateToken(w http.ResponseWriter, r *http.Request) {
 	// Get token from request
 	var requestBody struct {
-		Token string `json:"token"`
+		Token    string `json:"token"`
+		Audience string `json:"audience"`
 	}
 	
 	err := json.NewDecoder(r.Body).Decode(&requestBody)
 	if err != nil {
-		http.Error(w, err.Error(), http.StatusBadRequest)
+		http.Error(w, "Invalid request body", http.StatusBadRequest)
 		return
 	}
 
-	// Validate token
-	token, err := jwt.Parse(requestBody.Token, func(token *jwt.Token) (interface{}, error) {
-		// Validate signing method
-		if _, ok := token.Method.(*jwt.SigningMethodHMAC); !ok {
-			return nil, fmt.Errorf("unexpected signing method: %v", token.Header["alg"])
-		}
-		return jwtSecret, nil
-	})
-
-	// Check for validation errors
-	if err != nil {
-		http.Error(w, "Invalid token", http.StatusUnauthorized)
+	// Validate token for the calling service's audience
+	v, err := checkAccessToken(r.Context(), requestBody.Token, requestBody.Audience,
+		func(e SecurityEvent) { emitSecurityEvent(r, e) })
+	switch err {
+	case nil:
+	case errInvalidToken:
+		http.Error(w, errInvalidToken.Error(), http.StatusUnauthorized)
+		return
+	case errSessionEnded:
+		http.Error(w, errSessionEnded.Error(), http.StatusUnauthorized)
+		return
+	case errTermsRequired:
+		http.Error(w, errTermsRequired.Error(), http.StatusForbidden)
+		return
+	default:
+		http.Error(w, err.Error(), http.StatusInternalServerError)
 		return
 	}
 
-	// Check if token is valid
-	if claims, ok := token.Claims.(jwt.MapClaims); ok && token.Valid {
-		// Return user info from token
-		w.Header().Set("Content-Type", "application/json")
-		json.NewEncoder(w).Encode(map[string]interface{}{
-			"valid": true,
-			"user_id": int(claims["user_id"].(float64)),
-			"username": claims["username"].(string),
-			"role": claims["role"].(string),
-			"expires_at": int64(claims["exp"].(float64)),
-		})
-	} else {
-		http.Error(w, "Invalid token", http.StatusUnauthorized)
+	// Return user info from token
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"valid": true,
+		"user_id": v.Claims.UserID,
+		"username": v.Claims.Username,
+		"role": v.Claims.Role,
+		"expires_at": v.Claims.ExpiresAt.Unix(),
+		"session_id": v.Session.ID,
+		"idle_expires_at": v.Session.IdleExpiresAt().Unix(),
+		"pending_legal_documents": v.PendingDocs,
+		"privileges": v.Privileges,
+	})
+}
+
+// loadUser reads a user's profile and address
+func loadUser(ctx context.Context, id int) (User, error) {
+	var user User
+	err := db.QueryRowContext(ctx, `SELECT id, username, email, role, status, full_name, phone,
+									COALESCE(date_of_birth::text, ''), COALESCE(merged_into, 0), created_at, updated_at
+									FROM users WHERE id = $1`, id).Scan(&user.ID, &user.Username, &user.Email,
+		&user.Role, &user.Status, &user.FullName, &user.Phone, &user.DateOfBirth,
+		&user.MergedInto, &user.CreatedAt, &user.UpdatedAt)
+	if err != nil {
+		return User{}, err
 	}
+	user.Address, user.Standardized, err = loadAddress(ctx, user.ID)
+	return user, err
 }
 
+// userReaderRoles may read any user's profile; everyone else only their own
+var userReaderRoles = []string{"teller", "compliance", "admin"}
+
 func getUser(w http.ResponseWriter, r *http.Request) {
 	params := mux.Vars(r)
-	id := params["id"]
+	id, err := strconv.Atoi(params["id"])
+	if err != nil {
+		http.Error(w, "User not found", http.StatusNotFound)
+		return
+	}
+	claims, err := bearerClaims(r)
+	if err != nil {
+		http.Error(w, "Authentication required", http.StatusUnauthorized)
+		return
+	}
+	if claims.UserID != id {
+		if _, ok := requireStaffRole(w, r, userReaderRoles...); !ok {
+			return
+		}
+	}
 
-	var user User
-	query := `SELECT id, username, email, role, status, created_at, updated_at 
-			  FROM users WHERE id = $1`
-	
-	err := db.QueryRow(query, id).Scan(&user.ID, &user.Username, &user.Email, 
-									  &user.Role, &user.Status, &user.CreatedAt, &user.UpdatedAt)
+	user, err := loadUser(r.Context(), id)
 	if err != nil {
 		if err == sql.ErrNoRows {
 			http.Error(w, "User not found", http.StatusNotFound)
@@ -311,24 +758,98 @@ func getUser(w http.ResponseWriter, r *http.Request) {
 	json.NewEncoder(w).Encode(user)
 }
 
+// updateUser changes a user's profile. Users edit their own; only admins edit
+// other users or change a role or status, which keep their value when unset.
 func updateUser(w http.ResponseWriter, r *http.Request) {
 	params := mux.Vars(r)
 	id := params["id"]
+	userID, err := strconv.Atoi(id)
+	if err != nil {
+		http.Error(w, "User not found", http.StatusNotFound)
+		return
+	}
+	claims, err := bearerClaims(r)
+	if err != nil {
+		http.Error(w, "Authentication required", http.StatusUnauthorized)
+		return
+	}
+	if claims.UserID != userID {
+		if _, ok := requireStaffRole(w, r, "admin"); !ok {
+			return
+		}
+	}
 
 	var user User
-	err := json.NewDecoder(r.Body).Decode(&user)
+	err = json.NewDecoder(r.Body).Decode(&user)
+	if err != nil {
+		http.Error(w, "Invalid request body", http.StatusBadRequest)
+		return
+	}
+
+	// Remember the current role so role changes can be reported, and the
+	// name and date of birth so changes to them are screened
+	var previousRole, previousStatus, previousName, previousDOB string
+	err = db.QueryRowContext(r.Context(), "SELECT role, status, full_name, COALESCE(date_of_birth::text, '') FROM users WHERE id = $1",
+		id).Scan(&previousRole, &previousStatus, &previousName, &previousDOB)
 	if err != nil {
-		http.Error(w, err.Error(), http.StatusBadRequest)
+		if err == sql.ErrNoRows {
+			http.Error(w, "User not found", http.StatusNotFound)
+		} else {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+		}
+		return
+	}
+	if user.Role == "" {
+		user.Role = previousRole
+	}
+	if user.Status == "" {
+		user.Status = previousStatus
+	}
+	if user.Role != previousRole || user.Status != previousStatus {
+		if _, ok := requireStaffRole(w, r, "admin"); !ok {
+			return
+		}
+	}
+
+	// An address in the update is validated before anything changes; without
+	// one the stored address is kept
+	var address AddressResult
+	if user.Address != nil {
+		address, err = validateAddress(r.Context(), *user.Address)
+		if err == ErrAddressUndeliverable {
+			http.Error(w, "Address could not be found", http.StatusUnprocessableEntity)
+			return
+		}
+		if err != nil {
+			http.Error(w, "Address needs line1, city and an ISO 3166-1 alpha-2 country", http.StatusUnprocessableEntity)
+			return
+		}
+	}
+
+	tx, err := db.BeginTx(r.Context(), nil)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	defer tx.Rollback()
+
+	before, err := profileSnapshot(r.Context(), tx, userID)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
 		return
 	}
 
 	// Update user
-	query := `UPDATE users SET email = $1, role = $2, status = $3, updated_at = NOW() 
+	query := `UPDATE users SET email = $1, role = $2, status = $3, full_name = $5, phone = $6,
+			  date_of_birth = NULLIF($7, '')::date, updated_at = NOW() 
 			  WHERE id = $4 
-			  RETURNING id, username, email, role, status, created_at, updated_at`
+			  RETURNING id, username, email, role, status, full_name, phone, COALESCE(date_of_birth::text, ''),
+			  created_at, updated_at`
 	
-	err = db.QueryRow(query, user.Email, user.Role, user.Status, id).Scan(&user.ID, &user.Username, 
+	err = tx.QueryRowContext(r.Context(), query, user.Email, user.Role, user.Status, id, user.FullName, user.Phone,
+		user.DateOfBirth).Scan(&user.ID, &user.Username, 
 																		&user.Email, &user.Role, &user.Status, 
+																		&user.FullName, &user.Phone, &user.DateOfBirth,
 																		&user.CreatedAt, &user.UpdatedAt)
 	if err != nil {
 		if err == sql.ErrNoRows {
@@ -339,6 +860,42 @@ func updateUser(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
+	if user.Address != nil {
+		standardized, err := saveAddress(r.Context(), tx, user.ID, *user.Address, address)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		user.Standardized = &standardized
+	}
+
+	after, err := profileSnapshot(r.Context(), tx, user.ID)
+	if err == nil {
+		err = recordProfileChanges(tx, r, user.ID, profileChannel(r), before, after)
+	}
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	err = tx.Commit()
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	if user.Role == "customer" && (user.FullName != previousName || user.DateOfBirth != previousDOB) {
+		if _, err := screenUser(r.Context(), user.ID, "profile_change"); err != nil {
+			servicekit.RequestLogger(r.Context()).Error("screening after a profile change failed", zap.Int("user_id", user.ID), zap.Error(err))
+		}
+	}
+
+	if user.Role != previousRole {
+		emitSecurityEvent(r, SecurityEvent{Type: eventRoleChanged, Severity: 7, Outcome: "success",
+			UserID: id, Username: user.Username, Message: "User role changed",
+			Details: map[string]string{"old_role": previousRole, "new_role": user.Role}})
+	}
+
 	w.Header().Set("Content-Type", "application/json")
 	json.NewEncoder(w).Encode(user)
 }
@@ -355,7 +912,7 @@ func changePassword(w http.ResponseWriter, r *http.Request) {
 	
 	err := json.NewDecoder(r.Body).Decode(&requestBody)
 	if err != nil {
-		http.Error(w, err.Error(), http.StatusBadRequest)
+		http.Error(w, "Invalid request body", http.StatusBadRequest)
 		return
 	}
 
@@ -366,8 +923,9 @@ func changePassword(w http.ResponseWriter, r *http.Request) {
 	}
 
 	// Get current password from database
+	var userID int
 	var currentHashedPassword string
-	err = db.QueryRow("SELECT password FROM users WHERE id = $1", id).Scan(&currentHashedPassword)
+	err = db.QueryRowContext(r.Context(), "SELECT id, password FROM users WHERE id = $1", id).Scan(&userID, &currentHashedPassword)
 	if err != nil {
 		if err == sql.ErrNoRows {
 			http.Error(w, "User not found", http.StatusNotFound)
@@ -392,12 +950,16 @@ func changePassword(w http.ResponseWriter, r *http.Request) {
 	}
 
 	// Update password
-	_, err = db.Exec("UPDATE users SET password = $1, updated_at = NOW() WHERE id = $2", 
+	_, err = db.ExecContext(r.Context(), "UPDATE users SET password = $1, updated_at = NOW() WHERE id = $2", 
 					string(hashedPassword), id)
 	if err != nil {
 		http.Error(w, err.Error(), http.StatusInternalServerError)
 		return
 	}
+	if err := recordPasswordChange(db, r, userID); err != nil {
+		servicekit.RequestLogger(r.Context()).Error("failed to audit password change", zap.Int("user_id", userID), zap.Error(err))
+	}
+	notifyUserEvent("password_changed", userID, map[string]interface{}{"source_ip": clientIP(r)})
 
 	w.Header().Set("Content-Type", "application/json")
 	json.NewEncoder(w).Encode(map[string]string{
@@ -405,25 +967,29 @@ func changePassword(w http.ResponseWriter, r *http.Request) {
 	})
 }
 
-// Helper function to generate JWT token
-func generateJWT(user User) (string, int64, error) {
-	// Set expiration time (24 hours)
-	expirationTime := time.Now().Add(24 * time.Hour)
-	expiresAt := expirationTime.Unix()
+// generateJWT issues an access token for session, valid only at audience
+func generateJWT(user User, session Session, audience string) (string, int64, error) {
+	// Expire with the session's absolute lifetime
+	expiresAt := session.ExpiresAt.Unix()
+	now := jwt.NewNumericDate(time.Now())
 
 	// Create claims
-	claims := jwt.MapClaims{
-		"user_id":  user.ID,
-		"username": user.Username,
-		"role":     user.Role,
-		"exp":      expiresAt,
-	}
-
-	// Create token
-	token := jwt.NewWithClaims(jwt.SigningMethodHS256, claims)
-
-	// Sign token
-	tokenString, err := token.SignedString(jwtSecret)
+	claims := servicekit.AccessClaims{
+		UserID:    user.ID,
+		Username:  user.Username,
+		Role:      user.Role,
+		SessionID: session.ID,
+		RegisteredClaims: jwt.RegisteredClaims{
+			Issuer:    servicekit.JWTIssuer(),
+			Audience:  jwt.ClaimStrings{audience},
+			IssuedAt:  now,
+			NotBefore: now,
+			ExpiresAt: jwt.NewNumericDate(session.ExpiresAt),
+		},
+	}
+
+	// Sign token with the configured signing backend
+	tokenString, err := signJWT(context.Background(), claims)
 	if err != nil {
 		return "", 0, err
 	}
@@ -445,7 +1011,7 @@ func generateRandomKey() string {
 	key := make([]byte, 32)
 	_, err := rand.Read(key)
 	if err != nil {
-		log.Fatalf("Failed to generate random key: %v", err)
+		logger.Fatal("failed to generate random key", zap.Error(err))
 	}
 	
 	// Hash the random bytes for better security
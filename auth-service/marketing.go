@@ -0,0 +1,389 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"net/http"
+	"strings"
+	"time"
+
+	"bank/servicekit"
+
+	"github.com/gorilla/mux"
+	"go.uber.org/zap"
+)
+
+// MarketingPreference is a user's marketing consent for one channel.
+// Operational notifications (statements, alerts, security) are not affected.
+type MarketingPreference struct {
+	Channel   string `json:"channel"`
+	Status    string `json:"status"` // opted_out, pending_confirmation or opted_in
+	UpdatedAt string `json:"updated_at"`
+}
+
+// ConsentChange is one entry in a user's marketing consent history
+type ConsentChange struct {
+	Channel   string `json:"channel"`
+	OldStatus string `json:"old_status"`
+	NewStatus string `json:"new_status"`
+	Source    string `json:"source"`
+	SourceIP  string `json:"source_ip"`
+	CreatedAt string `json:"created_at"`
+}
+
+// Suppression blocks marketing to a recipient regardless of consent, e.g.
+// after a hard bounce, complaint or regulator do-not-contact request
+type Suppression struct {
+	Channel   string `json:"channel"`
+	Recipient string `json:"recipient"`
+	Reason    string `json:"reason"`
+	CreatedAt string `json:"created_at"`
+}
+
+const marketingTablesSQL = `
+	CREATE TABLE IF NOT EXISTS marketing_preferences (
+		user_id INTEGER NOT NULL REFERENCES users(id),
+		channel VARCHAR(10) NOT NULL,
+		status VARCHAR(25) NOT NULL DEFAULT 'opted_out',
+		updated_at TIMESTAMP NOT NULL DEFAULT NOW(),
+		PRIMARY KEY (user_id, channel)
+	);
+	CREATE TABLE IF NOT EXISTS marketing_optin_tokens (
+		token VARCHAR(64) PRIMARY KEY,
+		user_id INTEGER NOT NULL REFERENCES users(id),
+		channel VARCHAR(10) NOT NULL,
+		expires_at TIMESTAMP NOT NULL
+	);
+	CREATE TABLE IF NOT EXISTS marketing_consent_history (
+		id SERIAL PRIMARY KEY,
+		user_id INTEGER NOT NULL REFERENCES users(id),
+		channel VARCHAR(10) NOT NULL,
+		old_status VARCHAR(25) NOT NULL,
+		new_status VARCHAR(25) NOT NULL,
+		source VARCHAR(50) NOT NULL,
+		source_ip VARCHAR(45) NOT NULL DEFAULT '',
+		created_at TIMESTAMP NOT NULL DEFAULT NOW()
+	);
+	CREATE TABLE IF NOT EXISTS marketing_suppressions (
+		channel VARCHAR(10) NOT NULL,
+		recipient VARCHAR(255) NOT NULL,
+		reason VARCHAR(100) NOT NULL,
+		created_at TIMESTAMP NOT NULL DEFAULT NOW(),
+		PRIMARY KEY (channel, recipient)
+	);`
+
+var marketingChannels = map[string]bool{
+	"email": true,
+	"sms":   true,
+	"push":  true,
+}
+
+// optInConfirmationTTL is how long a double opt-in email link stays valid
+const optInConfirmationTTL = 72 * time.Hour
+
+func getMarketingPreferences(w http.ResponseWriter, r *http.Request) {
+	claims, err := bearerClaims(r)
+	if err != nil {
+		http.Error(w, "Authentication required", http.StatusUnauthorized)
+		return
+	}
+
+	rows, err := db.QueryContext(r.Context(), `SELECT channel, status, updated_at FROM marketing_preferences WHERE user_id = $1`,
+		claims.UserID)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	defer rows.Close()
+
+	// Channels without a stored preference are opted out
+	prefs := map[string]MarketingPreference{}
+	for channel := range marketingChannels {
+		prefs[channel] = MarketingPreference{Channel: channel, Status: "opted_out"}
+	}
+	for rows.Next() {
+		var p MarketingPreference
+		err := rows.Scan(&p.Channel, &p.Status, &p.UpdatedAt)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		prefs[p.Channel] = p
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(prefs)
+}
+
+// setMarketingPreference opts the caller in or out of a channel. Email opt-ins
+// stay pending until the link sent to the address on file is followed.
+func setMarketingPreference(w http.ResponseWriter, r *http.Request) {
+	claims, err := bearerClaims(r)
+	if err != nil {
+		http.Error(w, "Authentication required", http.StatusUnauthorized)
+		return
+	}
+	userID := claims.UserID
+
+	channel := mux.Vars(r)["channel"]
+	if !marketingChannels[channel] {
+		http.Error(w, "channel must be email, sms or push", http.StatusBadRequest)
+		return
+	}
+
+	var req struct {
+		OptIn bool `json:"opt_in"`
+	}
+	err = json.NewDecoder(r.Body).Decode(&req)
+	if err != nil {
+		http.Error(w, "Invalid request body", http.StatusBadRequest)
+		return
+	}
+
+	status := "opted_out"
+	if req.OptIn {
+		status = "opted_in"
+		if channel == "email" {
+			status = "pending_confirmation"
+		}
+	}
+
+	tx, err := db.BeginTx(r.Context(), nil)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	defer tx.Rollback()
+
+	pref, err := recordConsentChange(r.Context(), tx, userID, channel, status, "preference_center", clientIP(r))
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	var token, email string
+	if status == "pending_confirmation" {
+		token = strings.TrimRight(strings.NewReplacer("+", "-", "/", "_").Replace(generateRandomKey()), "=")
+		_, err = tx.ExecContext(r.Context(), `INSERT INTO marketing_optin_tokens (token, user_id, channel, expires_at)
+						  VALUES ($1, $2, $3, $4)`, token, userID, channel, time.Now().Add(optInConfirmationTTL))
+		if err == nil {
+			err = tx.QueryRowContext(r.Context(), "SELECT email FROM users WHERE id = $1", userID).Scan(&email)
+		}
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+	}
+
+	err = tx.Commit()
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	if token != "" {
+		err = sendNotification(r.Context(), Notification{
+			CustomerID: userID,
+			Channel:    "email",
+			Recipient:  email,
+			Template:   "marketing_optin_confirmation",
+			Data: map[string]interface{}{
+				"confirm_url": getEnv("PUBLIC_BASE_URL", "http://localhost:8082") + "/v1/marketing/confirm?token=" + token,
+				"expires_at":  time.Now().Add(optInConfirmationTTL).UTC().Format(time.RFC3339),
+			},
+		})
+		if err != nil {
+			servicekit.RequestLogger(r.Context()).Error("failed to send marketing opt-in confirmation", zap.Int("user_id", userID), zap.Error(err))
+		}
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(pref)
+}
+
+// confirmMarketingOptIn completes a double opt-in from the emailed link
+func confirmMarketingOptIn(w http.ResponseWriter, r *http.Request) {
+	token := r.URL.Query().Get("token")
+
+	tx, err := db.BeginTx(r.Context(), nil)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	defer tx.Rollback()
+
+	var userID int
+	var channel string
+	err = tx.QueryRowContext(r.Context(), `DELETE FROM marketing_optin_tokens WHERE token = $1 AND expires_at > NOW()
+					   RETURNING user_id, channel`, token).Scan(&userID, &channel)
+	if err != nil {
+		if err == sql.ErrNoRows {
+			http.Error(w, "Confirmation link is invalid or expired", http.StatusNotFound)
+		} else {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+		}
+		return
+	}
+
+	pref, err := recordConsentChange(r.Context(), tx, userID, channel, "opted_in", "double_opt_in", clientIP(r))
+	if err == nil {
+		err = tx.Commit()
+	}
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(pref)
+}
+
+// recordConsentChange stores the new status and appends to the consent history
+func recordConsentChange(ctx context.Context, tx *sql.Tx, userID int, channel, status, source, sourceIP string) (MarketingPreference, error) {
+	pref := MarketingPreference{Channel: channel, Status: status}
+
+	oldStatus := "opted_out"
+	err := tx.QueryRowContext(ctx, `SELECT status FROM marketing_preferences WHERE user_id = $1 AND channel = $2 FOR UPDATE`,
+		userID, channel).Scan(&oldStatus)
+	if err != nil && err != sql.ErrNoRows {
+		return pref, err
+	}
+
+	err = tx.QueryRowContext(ctx, `INSERT INTO marketing_preferences (user_id, channel, status) VALUES ($1, $2, $3)
+					   ON CONFLICT (user_id, channel) DO UPDATE SET status = EXCLUDED.status, updated_at = NOW()
+					   RETURNING updated_at`, userID, channel, status).Scan(&pref.UpdatedAt)
+	if err != nil {
+		return pref, err
+	}
+
+	if oldStatus != status {
+		_, err = tx.ExecContext(ctx, `INSERT INTO marketing_consent_history (user_id, channel, old_status, new_status, source, source_ip)
+						  VALUES ($1, $2, $3, $4, $5, $6)`, userID, channel, oldStatus, status, source, sourceIP)
+	}
+	return pref, err
+}
+
+func getConsentHistory(w http.ResponseWriter, r *http.Request) {
+	claims, err := bearerClaims(r)
+	if err != nil {
+		http.Error(w, "Authentication required", http.StatusUnauthorized)
+		return
+	}
+
+	rows, err := db.QueryContext(r.Context(), `SELECT channel, old_status, new_status, source, source_ip, created_at
+						   FROM marketing_consent_history WHERE user_id = $1 ORDER BY created_at DESC`,
+		claims.UserID)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	defer rows.Close()
+
+	history := []ConsentChange{}
+	for rows.Next() {
+		var c ConsentChange
+		err := rows.Scan(&c.Channel, &c.OldStatus, &c.NewStatus, &c.Source, &c.SourceIP, &c.CreatedAt)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		history = append(history, c)
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(history)
+}
+
+// addSuppression adds a recipient to the marketing suppression list
+func addSuppression(w http.ResponseWriter, r *http.Request) {
+	var s Suppression
+	err := json.NewDecoder(r.Body).Decode(&s)
+	if err != nil {
+		http.Error(w, "Invalid request body", http.StatusBadRequest)
+		return
+	}
+
+	s.Recipient = strings.ToLower(strings.TrimSpace(s.Recipient))
+	if !marketingChannels[s.Channel] || s.Recipient == "" || s.Reason == "" {
+		http.Error(w, "channel, recipient and reason are required", http.StatusBadRequest)
+		return
+	}
+
+	query := `INSERT INTO marketing_suppressions (channel, recipient, reason) VALUES ($1, $2, $3)
+			  ON CONFLICT (channel, recipient) DO UPDATE SET reason = EXCLUDED.reason
+			  RETURNING created_at`
+
+	err = db.QueryRowContext(r.Context(), query, s.Channel, s.Recipient, s.Reason).Scan(&s.CreatedAt)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusCreated)
+	json.NewEncoder(w).Encode(s)
+}
+
+func removeSuppression(w http.ResponseWriter, r *http.Request) {
+	params := mux.Vars(r)
+
+	result, err := db.ExecContext(r.Context(), `DELETE FROM marketing_suppressions WHERE channel = $1 AND recipient = $2`,
+		params["channel"], strings.ToLower(params["recipient"]))
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	if n, _ := result.RowsAffected(); n == 0 {
+		http.Error(w, "Suppression not found", http.StatusNotFound)
+		return
+	}
+
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// checkMarketingEligibility lets the notification service decide whether a
+// marketing message may be sent: the user must be opted in on the channel and
+// the recipient must not be suppressed
+func checkMarketingEligibility(w http.ResponseWriter, r *http.Request) {
+	query := r.URL.Query()
+	channel := query.Get("channel")
+	recipient := strings.ToLower(strings.TrimSpace(query.Get("recipient")))
+
+	allowed, reason, err := marketingAllowed(r.Context(), query.Get("user_id"), channel, recipient)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"allowed": allowed,
+		"reason":  reason,
+	})
+}
+
+func marketingAllowed(ctx context.Context, userID, channel, recipient string) (bool, string, error) {
+	if recipient != "" {
+		var suppressed bool
+		err := db.QueryRowContext(ctx, `SELECT EXISTS(SELECT 1 FROM marketing_suppressions
+										WHERE channel = $1 AND recipient = $2)`, channel, recipient).Scan(&suppressed)
+		if err != nil {
+			return false, "", err
+		}
+		if suppressed {
+			return false, "suppressed", nil
+		}
+	}
+
+	status := "opted_out"
+	err := db.QueryRowContext(ctx, `SELECT status FROM marketing_preferences WHERE user_id = $1 AND channel = $2`,
+		userID, channel).Scan(&status)
+	if err != nil && err != sql.ErrNoRows {
+		return false, "", err
+	}
+	if status != "opted_in" {
+		return false, status, nil
+	}
+	return true, "", nil
+}
@@ -0,0 +1,536 @@
+package main
+
+import (
+	"context"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha1"
+	"crypto/sha256"
+	"database/sql"
+	"encoding/base32"
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+
+	"bank/servicekit"
+
+	"go.uber.org/zap"
+)
+
+// Two-factor authentication is optional per user. Codes are TOTP (RFC 6238:
+// HMAC-SHA1, 6 digits, 30 second steps), which every authenticator app
+// supports; backup codes stand in for a lost device, once each.
+
+const (
+	totpDigits = 6
+	totpPeriod = 30
+	// totpSkew is how many steps either side of now are accepted, for clocks
+	// that drift
+	totpSkew = 1
+
+	backupCodeCount = 10
+	// maxMFAAttempts is how many wrong codes void a login challenge
+	maxMFAAttempts = 5
+)
+
+// mfaChallengeTTL is how long a login challenge may be answered,
+// MFA_CHALLENGE_TTL
+func mfaChallengeTTL() time.Duration {
+	return envDuration("MFA_CHALLENGE_TTL", 5*time.Minute)
+}
+
+// MFAEnrollment is what the authenticator app and the user need to set up a
+// factor. It is only ever shown once.
+type MFAEnrollment struct {
+	Secret          string   `json:"secret"`
+	ProvisioningURI string   `json:"provisioning_uri"` // otpauth:// URI, rendered as a QR code for the app to scan
+	BackupCodes     []string `json:"backup_codes"`
+}
+
+// MFAChallenge answers a correct password when two-factor authentication is
+// on; the token and a code are exchanged for the tokens at /auth/mfa/verify
+type MFAChallenge struct {
+	MFARequired    bool   `json:"mfa_required"`
+	ChallengeToken string `json:"challenge_token"`
+	ExpiresAt      int64  `json:"expires_at"`
+}
+
+type mfaCodeRequest struct {
+	Code string `json:"code"`
+}
+
+type mfaVerifyRequest struct {
+	ChallengeToken string `json:"challenge_token"`
+	Code           string `json:"code"`
+	Audience       string `json:"audience,omitempty"` // the service the access token is for
+}
+
+// mfaKey is the AES-256 key TOTP secrets are sealed with
+var mfaKey []byte
+
+// loadMFAKey returns MFA_ENCRYPTION_KEY (32 bytes, base64) or, when it is
+// unset, a key generated by the first replica and kept in service_secrets
+func loadMFAKey(ctx context.Context) ([]byte, error) {
+	encoded := getEnv("MFA_ENCRYPTION_KEY", "")
+	if encoded == "" {
+		var err error
+		if encoded, err = sharedSecret(ctx, "mfa_key"); err != nil {
+			return nil, err
+		}
+		logger.Warn("MFA_ENCRYPTION_KEY is not set; using the generated key shared through the database")
+	}
+	key, err := base64.StdEncoding.DecodeString(encoded)
+	if err != nil || len(key) != 32 {
+		return nil, errors.New("MFA_ENCRYPTION_KEY must be 32 bytes, base64 encoded")
+	}
+	return key, nil
+}
+
+func mfaCipher() (cipher.AEAD, error) {
+	block, err := aes.NewCipher(mfaKey)
+	if err != nil {
+		return nil, err
+	}
+	return cipher.NewGCM(block)
+}
+
+func sealMFASecret(secret []byte) (string, error) {
+	aead, err := mfaCipher()
+	if err != nil {
+		return "", err
+	}
+	nonce := make([]byte, aead.NonceSize())
+	if _, err := rand.Read(nonce); err != nil {
+		return "", err
+	}
+	return base64.StdEncoding.EncodeToString(aead.Seal(nonce, nonce, secret, nil)), nil
+}
+
+func openMFASecret(sealed string) ([]byte, error) {
+	aead, err := mfaCipher()
+	if err != nil {
+		return nil, err
+	}
+	data, err := base64.StdEncoding.DecodeString(sealed)
+	if err != nil || len(data) < aead.NonceSize() {
+		return nil, errors.New("malformed MFA secret")
+	}
+	return aead.Open(nil, data[:aead.NonceSize()], data[aead.NonceSize():], nil)
+}
+
+// totpCode returns the code for secret at step (RFC 4226 truncation)
+func totpCode(secret []byte, step int64) string {
+	var msg [8]byte
+	binary.BigEndian.PutUint64(msg[:], uint64(step))
+	mac := hmac.New(sha1.New, secret)
+	mac.Write(msg[:])
+	sum := mac.Sum(nil)
+	offset := sum[len(sum)-1] & 0x0f
+	value := binary.BigEndian.Uint32(sum[offset:offset+4]) & 0x7fffffff
+	return fmt.Sprintf("%06d", value%1000000)
+}
+
+// matchTOTP returns the step code is valid for, within totpSkew steps of now
+// and after lastStep so a code cannot be replayed, or false
+func matchTOTP(secret []byte, code string, lastStep int64, now time.Time) (int64, bool) {
+	current := now.Unix() / totpPeriod
+	for step := current - totpSkew; step <= current+totpSkew; step++ {
+		if step > lastStep && hmac.Equal([]byte(totpCode(secret, step)), []byte(code)) {
+			return step, true
+		}
+	}
+	return 0, false
+}
+
+// totpProvisioningURI is the Key URI Format authenticator apps import
+func totpProvisioningURI(username, secret string) string {
+	issuer := getEnv("MFA_ISSUER", "Bank")
+	query := url.Values{
+		"secret":    {secret},
+		"issuer":    {issuer},
+		"algorithm": {"SHA1"},
+		"digits":    {strconv.Itoa(totpDigits)},
+		"period":    {strconv.Itoa(totpPeriod)},
+	}
+	return "otpauth://totp/" + url.PathEscape(issuer+":"+username) + "?" + query.Encode()
+}
+
+func hashMFAToken(token string) string {
+	sum := sha256.Sum256([]byte(token))
+	return hex.EncodeToString(sum[:])
+}
+
+// normalizeMFACode drops the spaces and dashes users type or paste along
+// with a code
+func normalizeMFACode(code string) string {
+	return strings.ToLower(strings.NewReplacer(" ", "", "-", "").Replace(code))
+}
+
+// newBackupCodes returns backup codes as shown to the user, e.g. k3j9a-7xq2m
+func newBackupCodes() ([]string, error) {
+	encoding := base32.StdEncoding.WithPadding(base32.NoPadding)
+	codes := make([]string, backupCodeCount)
+	for i := range codes {
+		b := make([]byte, 7)
+		if _, err := rand.Read(b); err != nil {
+			return nil, err
+		}
+		code := strings.ToLower(encoding.EncodeToString(b))[:10]
+		codes[i] = code[:5] + "-" + code[5:]
+	}
+	return codes, nil
+}
+
+// useMFACode checks code against the user's factor, locked in tx, and spends
+// it so it works once. An enabled factor takes a TOTP code or an unused
+// backup code; a factor being confirmed only a TOTP code.
+func useMFACode(ctx context.Context, tx *sql.Tx, userID int, code string, enabled bool) (bool, error) {
+	var sealed string
+	var lastStep int64
+	err := tx.QueryRowContext(ctx, `SELECT secret, last_used_step FROM mfa_factors
+									WHERE user_id = $1 AND (enabled_at IS NOT NULL) = $2 FOR UPDATE`,
+		userID, enabled).Scan(&sealed, &lastStep)
+	if err == sql.ErrNoRows {
+		return false, nil
+	}
+	if err != nil {
+		return false, err
+	}
+
+	code = normalizeMFACode(code)
+	if len(code) == totpDigits {
+		secret, err := openMFASecret(sealed)
+		if err != nil {
+			return false, err
+		}
+		step, ok := matchTOTP(secret, code, lastStep, time.Now())
+		if !ok {
+			return false, nil
+		}
+		_, err = tx.ExecContext(ctx, `UPDATE mfa_factors SET last_used_step = $2 WHERE user_id = $1`, userID, step)
+		return err == nil, err
+	}
+	if !enabled {
+		return false, nil
+	}
+	result, err := tx.ExecContext(ctx, `UPDATE mfa_backup_codes SET used_at = NOW()
+										WHERE user_id = $1 AND code_hash = $2 AND used_at IS NULL`, userID, hashMFAToken(code))
+	if err != nil {
+		return false, err
+	}
+	n, err := result.RowsAffected()
+	return n == 1, err
+}
+
+// mfaEnabled returns whether the user must answer a challenge at login
+func mfaEnabled(ctx context.Context, userID int) (bool, error) {
+	var enabled bool
+	err := db.QueryRowContext(ctx, `SELECT EXISTS (SELECT 1 FROM mfa_factors WHERE user_id = $1 AND enabled_at IS NOT NULL)`,
+		userID).Scan(&enabled)
+	return enabled, err
+}
+
+// enrollMFA creates a TOTP factor and backup codes for the caller. The
+// factor is enabled once confirmed with a first code; enrolling again before
+// that starts over, while an enabled factor must be disabled first.
+func enrollMFA(w http.ResponseWriter, r *http.Request) {
+	claims, err := bearerClaims(r)
+	if err != nil {
+		http.Error(w, "Authentication required", http.StatusUnauthorized)
+		return
+	}
+
+	secret := make([]byte, 20)
+	if _, err := rand.Read(secret); err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	sealed, err := sealMFASecret(secret)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	codes, err := newBackupCodes()
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	tx, err := db.BeginTx(r.Context(), nil)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	defer tx.Rollback()
+
+	result, err := tx.ExecContext(r.Context(), `INSERT INTO mfa_factors (user_id, secret) VALUES ($1, $2)
+												ON CONFLICT (user_id) DO UPDATE SET secret = EXCLUDED.secret,
+												last_used_step = 0, created_at = NOW() WHERE mfa_factors.enabled_at IS NULL`,
+		claims.UserID, sealed)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	if n, _ := result.RowsAffected(); n == 0 {
+		http.Error(w, "Two-factor authentication is already enabled", http.StatusConflict)
+		return
+	}
+	if _, err := tx.ExecContext(r.Context(), `DELETE FROM mfa_backup_codes WHERE user_id = $1`, claims.UserID); err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	for _, code := range codes {
+		_, err := tx.ExecContext(r.Context(), `INSERT INTO mfa_backup_codes (user_id, code_hash) VALUES ($1, $2)`,
+			claims.UserID, hashMFAToken(normalizeMFACode(code)))
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+	}
+	if err := tx.Commit(); err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	encoded := base32.StdEncoding.WithPadding(base32.NoPadding).EncodeToString(secret)
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Cache-Control", "no-store")
+	w.WriteHeader(http.StatusCreated)
+	json.NewEncoder(w).Encode(MFAEnrollment{
+		Secret:          encoded,
+		ProvisioningURI: totpProvisioningURI(claims.Username, encoded),
+		BackupCodes:     codes,
+	})
+}
+
+// confirmMFA enables the caller's enrolled factor with a first TOTP code,
+// which proves the authenticator app was set up
+func confirmMFA(w http.ResponseWriter, r *http.Request) {
+	claims, err := bearerClaims(r)
+	if err != nil {
+		http.Error(w, "Authentication required", http.StatusUnauthorized)
+		return
+	}
+	var req mfaCodeRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, "Invalid request body", http.StatusBadRequest)
+		return
+	}
+
+	tx, err := db.BeginTx(r.Context(), nil)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	defer tx.Rollback()
+
+	ok, err := useMFACode(r.Context(), tx, claims.UserID, req.Code, false)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	if !ok {
+		http.Error(w, "Invalid code, or no enrollment to confirm", http.StatusBadRequest)
+		return
+	}
+	_, err = tx.ExecContext(r.Context(), `UPDATE mfa_factors SET enabled_at = NOW() WHERE user_id = $1`, claims.UserID)
+	if err == nil {
+		err = tx.Commit()
+	}
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	servicekit.RequestLogger(r.Context()).Info("two-factor authentication enabled", zap.Int("user_id", claims.UserID))
+	notifyUserEvent("mfa_changed", claims.UserID, map[string]interface{}{"change": "enabled", "source_ip": clientIP(r)})
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]bool{"mfa_enabled": true})
+}
+
+// disableMFA removes the caller's factor and backup codes. It takes a current
+// code, so a stolen access token alone cannot turn two-factor off; wrong
+// codes count towards the login lockout.
+func disableMFA(w http.ResponseWriter, r *http.Request) {
+	claims, err := bearerClaims(r)
+	if err != nil {
+		http.Error(w, "Authentication required", http.StatusUnauthorized)
+		return
+	}
+	var req mfaCodeRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, "Invalid request body", http.StatusBadRequest)
+		return
+	}
+
+	tx, err := db.BeginTx(r.Context(), nil)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	defer tx.Rollback()
+
+	ok, err := useMFACode(r.Context(), tx, claims.UserID, req.Code, true)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	if !ok {
+		tx.Rollback()
+		if _, err := registerFailedLogin(r, User{ID: claims.UserID, Username: claims.Username}); err != nil {
+			servicekit.RequestLogger(r.Context()).Error("failed to count wrong two-factor code", zap.Error(err))
+		}
+		http.Error(w, "Invalid code, or two-factor authentication is not enabled", http.StatusForbidden)
+		return
+	}
+	_, err = tx.ExecContext(r.Context(), `DELETE FROM mfa_backup_codes WHERE user_id = $1`, claims.UserID)
+	if err == nil {
+		_, err = tx.ExecContext(r.Context(), `DELETE FROM mfa_factors WHERE user_id = $1`, claims.UserID)
+	}
+	if err == nil {
+		err = tx.Commit()
+	}
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	servicekit.RequestLogger(r.Context()).Info("two-factor authentication disabled", zap.Int("user_id", claims.UserID))
+	notifyUserEvent("mfa_changed", claims.UserID, map[string]interface{}{"change": "disabled", "source_ip": clientIP(r)})
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]bool{"mfa_enabled": false})
+}
+
+// writeMFAChallenge answers the correct password of a user with two-factor
+// authentication on. The challenge token is stored hashed, like reset tokens.
+func writeMFAChallenge(w http.ResponseWriter, r *http.Request, user User) {
+	token := strings.TrimRight(strings.NewReplacer("+", "-", "/", "_").Replace(generateRandomKey()), "=")
+	expiresAt := time.Now().Add(mfaChallengeTTL())
+	_, err := db.ExecContext(r.Context(), `INSERT INTO mfa_challenges (token_hash, user_id, expires_at) VALUES ($1, $2, $3)`,
+		hashMFAToken(token), user.ID, expiresAt)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Cache-Control", "no-store")
+	json.NewEncoder(w).Encode(MFAChallenge{MFARequired: true, ChallengeToken: token, ExpiresAt: expiresAt.Unix()})
+}
+
+// verifyMFA completes a login: a challenge token from /auth/login and a TOTP
+// or backup code are exchanged for the access and refresh tokens. A wrong
+// code counts as a failed login, and a challenge is void after
+// maxMFAAttempts of them.
+func verifyMFA(w http.ResponseWriter, r *http.Request) {
+	var req mfaVerifyRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, "Invalid request body", http.StatusBadRequest)
+		return
+	}
+	if req.ChallengeToken == "" || req.Code == "" {
+		http.Error(w, "challenge_token and code are required", http.StatusBadRequest)
+		return
+	}
+	audience, known := tokenAudience(req.Audience)
+	if !known {
+		http.Error(w, "Unknown audience", http.StatusBadRequest)
+		return
+	}
+
+	tx, err := db.BeginTx(r.Context(), nil)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	defer tx.Rollback()
+
+	var challengeID int
+	var user User
+	err = tx.QueryRowContext(r.Context(), `SELECT c.id, u.id, u.username, u.email, u.role, u.status
+										   FROM mfa_challenges c JOIN users u ON u.id = c.user_id
+										   WHERE c.token_hash = $1 AND c.used_at IS NULL AND c.expires_at > NOW()
+										   FOR UPDATE OF c`, hashMFAToken(req.ChallengeToken)).Scan(&challengeID,
+		&user.ID, &user.Username, &user.Email, &user.Role, &user.Status)
+	if err == sql.ErrNoRows {
+		http.Error(w, "Invalid or expired challenge", http.StatusUnauthorized)
+		return
+	}
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	// The user may have been deactivated or locked since the password check
+	if user.Status != "active" {
+		http.Error(w, "Account is not active", http.StatusForbidden)
+		return
+	}
+	until, err := lockedUntil(r.Context(), user.ID)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	if !until.IsZero() {
+		recordLoginAttempt(r, &user.ID, user.Username, false, "locked")
+		writeAccountLocked(w, until)
+		return
+	}
+
+	ok, err := useMFACode(r.Context(), tx, user.ID, req.Code, true)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	if !ok {
+		_, err = tx.ExecContext(r.Context(), `UPDATE mfa_challenges SET attempts = attempts + 1,
+											  used_at = CASE WHEN attempts + 1 >= $2 THEN NOW() END WHERE id = $1`,
+			challengeID, maxMFAAttempts)
+		if err == nil {
+			err = tx.Commit()
+		}
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		servicekit.RecordOpsEvent(servicekit.MetricFailedLogins)
+		recordLoginAttempt(r, &user.ID, user.Username, false, "wrong_mfa_code")
+		emitSecurityEvent(r, SecurityEvent{Type: eventAuthFailure, Severity: 5, Outcome: "failure",
+			UserID: fmt.Sprint(user.ID), Username: user.Username, Message: "Login with wrong two-factor code"})
+		locked, err := registerFailedLogin(r, user)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		if locked {
+			http.Error(w, "Account is temporarily locked after too many failed logins", http.StatusLocked)
+			return
+		}
+		http.Error(w, "Invalid code", http.StatusUnauthorized)
+		return
+	}
+
+	_, err = tx.ExecContext(r.Context(), `UPDATE mfa_challenges SET used_at = NOW() WHERE id = $1`, challengeID)
+	if err == nil {
+		_, err = tx.ExecContext(r.Context(), `UPDATE users SET failed_login_count = 0 WHERE id = $1 AND failed_login_count > 0`,
+			user.ID)
+	}
+	if err == nil {
+		err = tx.Commit()
+	}
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	completeLogin(w, r, user, audience)
+}
@@ -0,0 +1,35 @@
+-- Two-factor authentication: a user's TOTP factor, sealed with the MFA key
+-- and enabled once a first code confirms it, their single-use backup codes
+-- and the challenges a correct password earns at login.
+
+-- +goose Up
+CREATE TABLE mfa_factors (
+    user_id INTEGER PRIMARY KEY REFERENCES users(id),
+    secret TEXT NOT NULL,
+    enabled_at TIMESTAMP,
+    last_used_step BIGINT NOT NULL DEFAULT 0,
+    created_at TIMESTAMP NOT NULL DEFAULT NOW()
+);
+
+CREATE TABLE mfa_backup_codes (
+    id SERIAL PRIMARY KEY,
+    user_id INTEGER NOT NULL REFERENCES users(id),
+    code_hash VARCHAR(64) NOT NULL,
+    used_at TIMESTAMP
+);
+CREATE INDEX idx_mfa_backup_codes_user ON mfa_backup_codes(user_id, code_hash);
+
+CREATE TABLE mfa_challenges (
+    id SERIAL PRIMARY KEY,
+    token_hash VARCHAR(64) NOT NULL UNIQUE,
+    user_id INTEGER NOT NULL REFERENCES users(id),
+    attempts INTEGER NOT NULL DEFAULT 0,
+    expires_at TIMESTAMP NOT NULL,
+    used_at TIMESTAMP,
+    created_at TIMESTAMP NOT NULL DEFAULT NOW()
+);
+
+-- +goose Down
+DROP TABLE mfa_challenges;
+DROP TABLE mfa_backup_codes;
+DROP TABLE mfa_factors;
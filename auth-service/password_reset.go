@@ -0,0 +1,216 @@
+package main
+
+import (
+	"crypto/sha256"
+	"database/sql"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"bank/servicekit"
+
+	"go.uber.org/zap"
+	"golang.org/x/crypto/bcrypt"
+)
+
+const passwordResetTablesSQL = `
+	CREATE TABLE IF NOT EXISTS password_reset_tokens (
+		id SERIAL PRIMARY KEY,
+		token_hash VARCHAR(64) NOT NULL UNIQUE,
+		user_id INTEGER NOT NULL REFERENCES users(id),
+		requested_ip VARCHAR(64) NOT NULL DEFAULT '',
+		expires_at TIMESTAMP NOT NULL,
+		used_at TIMESTAMP,
+		created_at TIMESTAMP NOT NULL DEFAULT NOW()
+	);
+	CREATE INDEX IF NOT EXISTS idx_password_reset_tokens_user ON password_reset_tokens(user_id, created_at);`
+
+// passwordResetTTL is how long a reset link stays valid, PASSWORD_RESET_TTL
+func passwordResetTTL() time.Duration {
+	return envDuration("PASSWORD_RESET_TTL", 30*time.Minute)
+}
+
+// passwordResetInterval is the minimum time between reset emails to one user
+const passwordResetInterval = time.Minute
+
+func hashResetToken(token string) string {
+	sum := sha256.Sum256([]byte(token))
+	return hex.EncodeToString(sum[:])
+}
+
+// forgotPassword emails a single-use reset link to the active user with the
+// given email. The response is the same whether or not the address is known,
+// so it cannot be used to find out who banks here.
+func forgotPassword(w http.ResponseWriter, r *http.Request) {
+	var requestBody struct {
+		Email string `json:"email"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&requestBody); err != nil {
+		http.Error(w, "Invalid request body", http.StatusBadRequest)
+		return
+	}
+	email := strings.TrimSpace(requestBody.Email)
+	if email == "" {
+		http.Error(w, "Email is required", http.StatusBadRequest)
+		return
+	}
+	accepted := func() {
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusAccepted)
+		json.NewEncoder(w).Encode(map[string]string{
+			"message": "If the address belongs to an account, a reset link has been sent to it",
+		})
+	}
+
+	var userID int
+	var username, address string
+	var recent bool
+	err := db.QueryRowContext(r.Context(), `SELECT u.id, u.username, u.email, EXISTS (
+												SELECT 1 FROM password_reset_tokens t WHERE t.user_id = u.id
+												AND t.created_at > NOW() - $2 * INTERVAL '1 second')
+											FROM users u WHERE LOWER(u.email) = LOWER($1) AND u.status = 'active'`,
+		email, int(passwordResetInterval/time.Second)).Scan(&userID, &username, &address, &recent)
+	if err == sql.ErrNoRows || (err == nil && recent) {
+		accepted()
+		return
+	}
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	token := strings.TrimRight(strings.NewReplacer("+", "-", "/", "_").Replace(generateRandomKey()), "=")
+	expiresAt := time.Now().Add(passwordResetTTL())
+	tx, err := db.BeginTx(r.Context(), nil)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	defer tx.Rollback()
+
+	// Only the newest link works
+	_, err = tx.ExecContext(r.Context(), `UPDATE password_reset_tokens SET used_at = NOW()
+										  WHERE user_id = $1 AND used_at IS NULL`, userID)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	_, err = tx.ExecContext(r.Context(), `INSERT INTO password_reset_tokens (token_hash, user_id, requested_ip, expires_at)
+										  VALUES ($1, $2, $3, $4)`, hashResetToken(token), userID, clientIP(r), expiresAt)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	if err := tx.Commit(); err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	// Send in the background so known and unknown addresses answer alike
+	resetURL := getEnv("PASSWORD_RESET_URL", "http://localhost:3000/reset-password") + "?token=" + token
+	go func() {
+		err := mailer.Send(serviceContext, Email{
+			To:      address,
+			Subject: "Reset your password",
+			Body: fmt.Sprintf("Hello %s,\n\nUse this link to choose a new password. It expires at %s and can be used once:\n\n%s\n\n"+
+				"If you did not ask to reset your password, ignore this email.\n",
+				username, expiresAt.UTC().Format(time.RFC1123), resetURL),
+			Template: "password_reset",
+			Data: map[string]interface{}{
+				"username":   username,
+				"reset_url":  resetURL,
+				"expires_at": expiresAt.UTC().Format(time.RFC3339),
+			},
+		})
+		if err != nil {
+			servicekit.RequestLogger(r.Context()).Error("failed to send password reset email", zap.Int("user_id", userID), zap.Error(err))
+		}
+	}()
+	accepted()
+}
+
+// resetPassword sets a new password with a reset token. The token is marked
+// used in the same transaction as the password change, so it works exactly
+// once. Every session and refresh token of the user is revoked and any login
+// lockout lifted.
+func resetPassword(w http.ResponseWriter, r *http.Request) {
+	var requestBody struct {
+		Token       string `json:"token"`
+		NewPassword string `json:"new_password"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&requestBody); err != nil {
+		http.Error(w, "Invalid request body", http.StatusBadRequest)
+		return
+	}
+	if requestBody.Token == "" || requestBody.NewPassword == "" {
+		http.Error(w, "Token and new password are required", http.StatusBadRequest)
+		return
+	}
+
+	hashedPassword, err := bcrypt.GenerateFromPassword([]byte(requestBody.NewPassword), bcrypt.DefaultCost)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	tx, err := db.BeginTx(r.Context(), nil)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	defer tx.Rollback()
+
+	var userID int
+	err = tx.QueryRowContext(r.Context(), `UPDATE password_reset_tokens SET used_at = NOW()
+										   WHERE token_hash = $1 AND used_at IS NULL AND expires_at > NOW()
+										   RETURNING user_id`, hashResetToken(requestBody.Token)).Scan(&userID)
+	if err == sql.ErrNoRows {
+		emitSecurityEvent(r, SecurityEvent{Type: eventTokenInvalid, Severity: 4, Outcome: "failure",
+			Message: "Password reset with invalid, used or expired token"})
+		http.Error(w, "Invalid or expired reset token", http.StatusBadRequest)
+		return
+	}
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	var username string
+	err = tx.QueryRowContext(r.Context(), `UPDATE users SET password = $2, failed_login_count = 0, locked_until = NULL,
+										   updated_at = NOW() WHERE id = $1 AND status = 'active' RETURNING username`,
+		userID, string(hashedPassword)).Scan(&username)
+	if err == sql.ErrNoRows {
+		http.Error(w, "Invalid or expired reset token", http.StatusBadRequest)
+		return
+	}
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	for _, stmt := range []string{
+		`UPDATE user_sessions SET revoked_at = NOW() WHERE user_id = $1 AND revoked_at IS NULL`,
+		`UPDATE refresh_tokens SET revoked_at = NOW() WHERE user_id = $1 AND revoked_at IS NULL`,
+	} {
+		if _, err := tx.ExecContext(r.Context(), stmt, userID); err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+	}
+	if err := recordPasswordChange(tx, r, userID); err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	if err := tx.Commit(); err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	emitSecurityEvent(r, SecurityEvent{Type: eventPasswordReset, Severity: 5, Outcome: "success",
+		UserID: strconv.Itoa(userID), Username: username, Message: "Password reset with emailed token"})
+	notifyUserEvent("password_changed", userID, map[string]interface{}{"source_ip": clientIP(r)})
+	w.WriteHeader(http.StatusNoContent)
+}
@@ -0,0 +1,380 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"bank/servicekit"
+
+	"github.com/gorilla/mux"
+)
+
+// PrivilegeRequest is a staff member's request for a time-boxed elevated
+// permission. Once their manager approves it, token validation returns the
+// privilege with the staff member's identity until it expires or is revoked.
+type PrivilegeRequest struct {
+	ID              int    `json:"id"`
+	UserID          int    `json:"user_id"`
+	Username        string `json:"username"`
+	Privilege       string `json:"privilege"`
+	Justification   string `json:"justification"`
+	DurationMinutes int    `json:"duration_minutes"`
+	Status          string `json:"status"` // pending, approved, rejected, expired, revoked or cancelled
+	DecidedBy       string `json:"decided_by,omitempty"`
+	DecisionNote    string `json:"decision_note,omitempty"`
+	DecidedAt       string `json:"decided_at,omitempty"`
+	ExpiresAt       string `json:"expires_at,omitempty"`
+	CreatedAt       string `json:"created_at"`
+}
+
+const privilegeTablesSQL = `
+	ALTER TABLE users ADD COLUMN IF NOT EXISTS manager_id INTEGER REFERENCES users(id);
+	CREATE TABLE IF NOT EXISTS privilege_requests (
+		id SERIAL PRIMARY KEY,
+		user_id INTEGER NOT NULL REFERENCES users(id),
+		privilege VARCHAR(50) NOT NULL,
+		justification TEXT NOT NULL,
+		duration_minutes INTEGER NOT NULL,
+		status VARCHAR(20) NOT NULL DEFAULT 'pending',
+		decided_by VARCHAR(100) NOT NULL DEFAULT '',
+		decision_note TEXT NOT NULL DEFAULT '',
+		decided_at TIMESTAMP,
+		expires_at TIMESTAMP,
+		created_at TIMESTAMP NOT NULL DEFAULT NOW()
+	);
+	CREATE UNIQUE INDEX IF NOT EXISTS idx_privilege_requests_open ON privilege_requests(user_id, privilege)
+		WHERE status IN ('pending', 'approved');`
+
+// privilegeCatalog lists the privileges that can be requested and the
+// longest time each may be held
+var privilegeCatalog = map[string]time.Duration{
+	"approve-wires":   2 * time.Hour,
+	"override-limits": 2 * time.Hour,
+	"manage-users":    4 * time.Hour,
+	"view-pii":        time.Hour,
+}
+
+const privilegeRequestColumns = `p.id, p.user_id, u.username, p.privilege, p.justification, p.duration_minutes, p.status,
+	p.decided_by, p.decision_note, COALESCE(p.decided_at::text, ''), COALESCE(p.expires_at::text, ''), p.created_at`
+
+func scanPrivilegeRequest(row interface{ Scan(...interface{}) error }, p *PrivilegeRequest) error {
+	return row.Scan(&p.ID, &p.UserID, &p.Username, &p.Privilege, &p.Justification, &p.DurationMinutes, &p.Status,
+		&p.DecidedBy, &p.DecisionNote, &p.DecidedAt, &p.ExpiresAt, &p.CreatedAt)
+}
+
+// activePrivileges returns the user's approved, unexpired privileges with
+// their expiry as Unix time
+func activePrivileges(ctx context.Context, userID int) (map[string]int64, error) {
+	rows, err := db.QueryContext(ctx, `SELECT privilege, EXTRACT(EPOCH FROM expires_at)::bigint FROM privilege_requests
+						   WHERE user_id = $1 AND status = 'approved' AND expires_at > NOW()`, userID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	privileges := map[string]int64{}
+	for rows.Next() {
+		var name string
+		var expires int64
+		if err := rows.Scan(&name, &expires); err != nil {
+			return nil, err
+		}
+		privileges[name] = expires
+	}
+	return privileges, rows.Err()
+}
+
+// startPrivilegeExpiry revokes expired privileges every minute
+func startPrivilegeExpiry() {
+	go func() {
+		defer servicekit.ReportJobPanic("Privilege expiry")
+		for {
+			if err := expirePrivileges(serviceContext); err != nil {
+				servicekit.ReportJobError("Privilege expiry", err)
+			}
+			time.Sleep(time.Minute)
+		}
+	}()
+}
+
+func expirePrivileges(ctx context.Context) error {
+	rows, err := db.QueryContext(ctx, `UPDATE privilege_requests p SET status = 'expired'
+									   FROM users u WHERE u.id = p.user_id AND p.status = 'approved'
+									   AND p.expires_at <= NOW() RETURNING p.id, p.user_id, u.username, p.privilege`)
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var id, userID int
+		var username, privilege string
+		if err := rows.Scan(&id, &userID, &username, &privilege); err != nil {
+			return err
+		}
+		emitSecurityEvent(nil, SecurityEvent{Type: eventPrivilegeRevoked, Severity: 3, Outcome: "success",
+			UserID: strconv.Itoa(userID), Username: username, Message: "Elevated privilege expired",
+			Details: map[string]string{"request_id": strconv.Itoa(id), "privilege": privilege}})
+	}
+	return rows.Err()
+}
+
+// requestPrivilege asks for an elevated privilege for duration_minutes (up to
+// the privilege's maximum) with a justification
+func requestPrivilege(w http.ResponseWriter, r *http.Request) {
+	claims, err := bearerClaims(r)
+	if err != nil {
+		http.Error(w, "Authentication required", http.StatusUnauthorized)
+		return
+	}
+	if claims.Role == "customer" {
+		http.Error(w, "Only staff may request elevated privileges", http.StatusForbidden)
+		return
+	}
+	userID := claims.UserID
+
+	var requestBody struct {
+		Privilege       string `json:"privilege"`
+		Justification   string `json:"justification"`
+		DurationMinutes int    `json:"duration_minutes"`
+	}
+	err = json.NewDecoder(r.Body).Decode(&requestBody)
+	if err != nil {
+		http.Error(w, "Invalid request body", http.StatusBadRequest)
+		return
+	}
+	maxDuration, ok := privilegeCatalog[requestBody.Privilege]
+	if !ok {
+		http.Error(w, "Unknown privilege", http.StatusBadRequest)
+		return
+	}
+	if strings.TrimSpace(requestBody.Justification) == "" {
+		http.Error(w, "justification is required", http.StatusBadRequest)
+		return
+	}
+	duration := time.Duration(requestBody.DurationMinutes) * time.Minute
+	if duration < time.Minute || duration > maxDuration {
+		http.Error(w, fmt.Sprintf("duration_minutes must be between 1 and %d for %s",
+			int(maxDuration/time.Minute), requestBody.Privilege), http.StatusBadRequest)
+		return
+	}
+
+	var p PrivilegeRequest
+	err = scanPrivilegeRequest(db.QueryRowContext(r.Context(), `WITH p AS (
+												INSERT INTO privilege_requests (user_id, privilege, justification, duration_minutes)
+												VALUES ($1, $2, $3, $4) ON CONFLICT DO NOTHING RETURNING *)
+											SELECT `+privilegeRequestColumns+` FROM p JOIN users u ON u.id = p.user_id`,
+		userID, requestBody.Privilege, strings.TrimSpace(requestBody.Justification), requestBody.DurationMinutes), &p)
+	if err == sql.ErrNoRows {
+		http.Error(w, "A request for this privilege is already pending or active", http.StatusConflict)
+		return
+	}
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusCreated)
+	json.NewEncoder(w).Encode(p)
+}
+
+// listPrivilegeRequests returns the caller's own requests and those awaiting
+// the caller's approval (all requests for admins), newest first (?status= filters)
+func listPrivilegeRequests(w http.ResponseWriter, r *http.Request) {
+	claims, err := bearerClaims(r)
+	if err != nil {
+		http.Error(w, "Authentication required", http.StatusUnauthorized)
+		return
+	}
+	userID := claims.UserID
+
+	rows, err := db.QueryContext(r.Context(), `SELECT `+privilegeRequestColumns+` FROM privilege_requests p JOIN users u ON u.id = p.user_id
+						   WHERE (p.user_id = $1 OR u.manager_id = $1 OR $2) AND ($3 = '' OR p.status = $3)
+						   ORDER BY p.id DESC LIMIT 200`, userID, claims.Role == "admin", r.URL.Query().Get("status"))
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	defer rows.Close()
+
+	requests := []PrivilegeRequest{}
+	for rows.Next() {
+		var p PrivilegeRequest
+		if err := scanPrivilegeRequest(rows, &p); err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		requests = append(requests, p)
+	}
+	if err := rows.Err(); err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(requests)
+}
+
+func approvePrivilegeRequest(w http.ResponseWriter, r *http.Request) {
+	decidePrivilegeRequest(w, r, "approved")
+}
+
+func rejectPrivilegeRequest(w http.ResponseWriter, r *http.Request) {
+	decidePrivilegeRequest(w, r, "rejected")
+}
+
+// decidePrivilegeRequest lets the requester's manager, or an admin when no
+// manager is set, decide a pending request. The privilege starts at approval.
+func decidePrivilegeRequest(w http.ResponseWriter, r *http.Request, status string) {
+	claims, err := bearerClaims(r)
+	if err != nil {
+		http.Error(w, "Authentication required", http.StatusUnauthorized)
+		return
+	}
+	approverID := claims.UserID
+	approver := claims.Username
+
+	var requestBody struct {
+		Note string `json:"note"`
+	}
+	if r.ContentLength != 0 {
+		if err := json.NewDecoder(r.Body).Decode(&requestBody); err != nil {
+			http.Error(w, "Invalid request body", http.StatusBadRequest)
+			return
+		}
+	}
+
+	var requesterID int
+	var managerID sql.NullInt64
+	err = db.QueryRowContext(r.Context(), `SELECT p.user_id, u.manager_id FROM privilege_requests p JOIN users u ON u.id = p.user_id
+					   WHERE p.id = $1`, mux.Vars(r)["id"]).Scan(&requesterID, &managerID)
+	if err == sql.ErrNoRows {
+		http.Error(w, "Privilege request not found", http.StatusNotFound)
+		return
+	}
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	allowed := managerID.Valid && int(managerID.Int64) == approverID ||
+		!managerID.Valid && claims.Role == "admin"
+	if requesterID == approverID || !allowed {
+		emitSecurityEvent(r, SecurityEvent{Type: eventPermissionDenied, Severity: 6, Outcome: "failure",
+			UserID: strconv.Itoa(approverID), Username: approver, Message: "Privilege request decision not allowed",
+			Details: map[string]string{"request_id": mux.Vars(r)["id"]}})
+		http.Error(w, "Only the requester's manager may decide this request", http.StatusForbidden)
+		return
+	}
+
+	var p PrivilegeRequest
+	err = scanPrivilegeRequest(db.QueryRowContext(r.Context(), `WITH p AS (
+												UPDATE privilege_requests SET status = $2, decided_by = $3, decision_note = $4,
+												decided_at = NOW(), expires_at = CASE WHEN $2 = 'approved'
+													THEN NOW() + duration_minutes * INTERVAL '1 minute' END
+												WHERE id = $1 AND status = 'pending' RETURNING *)
+											SELECT `+privilegeRequestColumns+` FROM p JOIN users u ON u.id = p.user_id`,
+		mux.Vars(r)["id"], status, approver, requestBody.Note), &p)
+	if err == sql.ErrNoRows {
+		http.Error(w, "Privilege request is not pending", http.StatusConflict)
+		return
+	}
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	if status == "approved" {
+		emitSecurityEvent(r, SecurityEvent{Type: eventPrivilegeGranted, Severity: 6, Outcome: "success",
+			UserID: strconv.Itoa(p.UserID), Username: p.Username, Message: "Elevated privilege granted",
+			Details: map[string]string{"request_id": strconv.Itoa(p.ID), "privilege": p.Privilege,
+				"approved_by": approver, "expires_at": p.ExpiresAt}})
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(p)
+}
+
+// revokePrivilegeRequest ends an active privilege or withdraws a pending
+// request. The requester, their manager or an admin may do so.
+func revokePrivilegeRequest(w http.ResponseWriter, r *http.Request) {
+	claims, err := bearerClaims(r)
+	if err != nil {
+		http.Error(w, "Authentication required", http.StatusUnauthorized)
+		return
+	}
+	callerID := claims.UserID
+
+	var p PrivilegeRequest
+	err = scanPrivilegeRequest(db.QueryRowContext(r.Context(), `WITH p AS (
+												UPDATE privilege_requests p SET decided_by = $3, decided_at = NOW(),
+												status = CASE WHEN p.status = 'pending' THEN 'cancelled' ELSE 'revoked' END
+												FROM users u WHERE u.id = p.user_id AND p.id = $1
+												AND (p.status = 'pending' OR p.status = 'approved' AND p.expires_at > NOW())
+												AND (p.user_id = $2 OR u.manager_id = $2 OR $4) RETURNING p.*)
+											SELECT `+privilegeRequestColumns+` FROM p JOIN users u ON u.id = p.user_id`,
+		mux.Vars(r)["id"], callerID, claims.Username, claims.Role == "admin"), &p)
+	if err == sql.ErrNoRows {
+		http.Error(w, "No pending or active privilege request found", http.StatusNotFound)
+		return
+	}
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	if p.Status == "revoked" {
+		emitSecurityEvent(r, SecurityEvent{Type: eventPrivilegeRevoked, Severity: 4, Outcome: "success",
+			UserID: strconv.Itoa(p.UserID), Username: p.Username, Message: "Elevated privilege revoked",
+			Details: map[string]string{"request_id": strconv.Itoa(p.ID), "privilege": p.Privilege,
+				"revoked_by": p.DecidedBy}})
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(p)
+}
+
+// setUserManager sets the manager who approves the user's privilege requests
+func setUserManager(w http.ResponseWriter, r *http.Request) {
+	if _, ok := requireStaffRole(w, r, "admin"); !ok {
+		return
+	}
+	userID, err := strconv.Atoi(mux.Vars(r)["id"])
+	if err != nil {
+		http.Error(w, "Invalid user ID", http.StatusBadRequest)
+		return
+	}
+
+	var requestBody struct {
+		ManagerID *int `json:"manager_id"`
+	}
+	err = json.NewDecoder(r.Body).Decode(&requestBody)
+	if err != nil {
+		http.Error(w, "Invalid request body", http.StatusBadRequest)
+		return
+	}
+	if requestBody.ManagerID != nil && *requestBody.ManagerID == userID {
+		http.Error(w, "A user cannot be their own manager", http.StatusBadRequest)
+		return
+	}
+
+	result, err := db.ExecContext(r.Context(), `UPDATE users SET manager_id = $2, updated_at = NOW() WHERE id = $1
+							AND ($2::int IS NULL OR EXISTS (SELECT 1 FROM users WHERE id = $2 AND role <> 'customer'))`,
+		userID, requestBody.ManagerID)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	if n, _ := result.RowsAffected(); n == 0 {
+		http.Error(w, "User or staff manager not found", http.StatusNotFound)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]interface{}{"user_id": userID, "manager_id": requestBody.ManagerID})
+}
@@ -0,0 +1,303 @@
+package main
+
+import (
+	"context"
+	"crypto/sha256"
+	"database/sql"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strings"
+	"time"
+
+	"bank/servicekit"
+)
+
+const refreshTokenTablesSQL = `
+	CREATE TABLE IF NOT EXISTS refresh_tokens (
+		id SERIAL PRIMARY KEY,
+		token_hash VARCHAR(64) NOT NULL UNIQUE,
+		family_id VARCHAR(64) NOT NULL,
+		user_id INTEGER NOT NULL REFERENCES users(id),
+		session_id VARCHAR(64) NOT NULL REFERENCES user_sessions(id),
+		expires_at TIMESTAMP NOT NULL,
+		created_at TIMESTAMP NOT NULL DEFAULT NOW(),
+		used_at TIMESTAMP,
+		revoked_at TIMESTAMP
+	);
+	CREATE INDEX IF NOT EXISTS idx_refresh_tokens_family ON refresh_tokens(family_id);
+	CREATE INDEX IF NOT EXISTS idx_refresh_tokens_session ON refresh_tokens(session_id);`
+
+// hashRefreshToken returns the stored form of a refresh token; the token
+// itself is only ever returned to the client
+func hashRefreshToken(token string) string {
+	sum := sha256.Sum256([]byte(token))
+	return hex.EncodeToString(sum[:])
+}
+
+// issueRefreshToken creates a refresh token for the session. Tokens rotated
+// from one login share its family (an empty familyID starts one) and all
+// expire together when the refresh lifetime from that login runs out.
+func issueRefreshToken(ctx context.Context, q queryRower, session Session, familyID string, familyExpiresAt time.Time) (string, time.Time, error) {
+	token := strings.TrimRight(strings.NewReplacer("+", "-", "/", "_").Replace(generateRandomKey()), "=")
+	if familyID == "" {
+		familyID = hashRefreshToken(session.ID)
+	}
+
+	var expiresAt time.Time
+	err := q.QueryRowContext(ctx, `INSERT INTO refresh_tokens (token_hash, family_id, user_id, session_id, expires_at)
+					   VALUES ($1, $2, $3, $4, $5) RETURNING expires_at`,
+		hashRefreshToken(token), familyID, session.UserID, session.ID, familyExpiresAt).Scan(&expiresAt)
+	return token, expiresAt, err
+}
+
+// revokeRefreshFamily revokes every refresh token in a family along with the
+// sessions they were issued for
+func revokeRefreshFamily(ctx context.Context, q execer, familyID string) error {
+	_, err := q.ExecContext(ctx, `UPDATE user_sessions SET revoked_at = NOW() WHERE revoked_at IS NULL
+					  AND id IN (SELECT session_id FROM refresh_tokens WHERE family_id = $1)`, familyID)
+	if err != nil {
+		return err
+	}
+	_, err = q.ExecContext(ctx, `UPDATE refresh_tokens SET revoked_at = NOW() WHERE family_id = $1 AND revoked_at IS NULL`, familyID)
+	return err
+}
+
+// refreshToken exchanges a refresh token for a new access token and a new
+// refresh token. Each refresh token works once; presenting a used one again
+// revokes its whole family, since it means the token has been copied.
+func refreshToken(w http.ResponseWriter, r *http.Request) {
+	var requestBody struct {
+		RefreshToken string `json:"refresh_token"`
+		Audience     string `json:"audience,omitempty"` // the service the new access token is for
+	}
+	err := json.NewDecoder(r.Body).Decode(&requestBody)
+	if err != nil {
+		http.Error(w, "Invalid request body", http.StatusBadRequest)
+		return
+	}
+	if requestBody.RefreshToken == "" {
+		http.Error(w, "refresh_token is required", http.StatusBadRequest)
+		return
+	}
+	audience, ok := tokenAudience(requestBody.Audience)
+	if !ok {
+		http.Error(w, "Unknown audience", http.StatusBadRequest)
+		return
+	}
+
+	tx, err := db.BeginTx(r.Context(), nil)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	defer tx.Rollback()
+
+	var familyID, sessionID string
+	var familyExpiresAt time.Time
+	var used, revoked, expired, idle bool
+	var user User
+	err = tx.QueryRowContext(r.Context(), `SELECT t.family_id, t.session_id, t.expires_at, t.used_at IS NOT NULL, t.revoked_at IS NOT NULL,
+					   t.expires_at <= NOW(), s.revoked_at IS NOT NULL OR (s.idle_timeout_seconds > 0
+					   AND s.last_seen_at <= NOW() - s.idle_timeout_seconds * INTERVAL '1 second'),
+					   u.id, u.username, u.email, u.role, u.status
+					   FROM refresh_tokens t JOIN users u ON u.id = t.user_id JOIN user_sessions s ON s.id = t.session_id
+					   WHERE t.token_hash = $1 FOR UPDATE OF t`, hashRefreshToken(requestBody.RefreshToken)).Scan(
+		&familyID, &sessionID, &familyExpiresAt, &used, &revoked, &expired, &idle,
+		&user.ID, &user.Username, &user.Email, &user.Role, &user.Status)
+	if err == sql.ErrNoRows {
+		emitSecurityEvent(r, SecurityEvent{Type: eventTokenInvalid, Severity: 4, Outcome: "failure",
+			Message: "Unknown refresh token"})
+		http.Error(w, "Invalid refresh token", http.StatusUnauthorized)
+		return
+	}
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	if used && !revoked {
+		if err := revokeRefreshFamily(r.Context(), tx, familyID); err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		if err := tx.Commit(); err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		emitSecurityEvent(r, SecurityEvent{Type: eventTokenInvalid, Severity: 7, Outcome: "failure",
+			UserID: fmt.Sprint(user.ID), Username: user.Username, Message: "Refresh token reused; sessions revoked",
+			Details: map[string]string{"session_id": sessionID}})
+		http.Error(w, "Invalid refresh token", http.StatusUnauthorized)
+		return
+	}
+	if used || revoked || expired || idle {
+		http.Error(w, "Refresh token expired or revoked", http.StatusUnauthorized)
+		return
+	}
+	if user.Status != "active" {
+		emitSecurityEvent(r, SecurityEvent{Type: eventLoginDenied, Severity: 5, Outcome: "failure",
+			UserID: fmt.Sprint(user.ID), Username: user.Username, Message: "Token refresh for inactive account"})
+		http.Error(w, "Account is not active", http.StatusForbidden)
+		return
+	}
+
+	// The old session ends and a new one starts under the user's current role
+	_, err = tx.ExecContext(r.Context(), `UPDATE refresh_tokens SET used_at = NOW() WHERE token_hash = $1`,
+		hashRefreshToken(requestBody.RefreshToken))
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	_, err = tx.ExecContext(r.Context(), `UPDATE user_sessions SET revoked_at = NOW() WHERE id = $1 AND revoked_at IS NULL`, sessionID)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	if err := tx.Commit(); err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	session, err := startSession(r.Context(), user)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	token, expiresAt, err := generateJWT(user, session, audience)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	refresh, refreshExpiresAt, err := issueRefreshToken(r.Context(), db, session, familyID, familyExpiresAt)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(TokenResponse{
+		Token:                 token,
+		ExpiresAt:             expiresAt,
+		RefreshToken:          refresh,
+		RefreshTokenExpiresAt: refreshExpiresAt.Unix(),
+		UserID:                user.ID,
+		Username:              user.Username,
+		Role:                  user.Role,
+	})
+}
+
+// exchangeToken issues an access token for another audience in the session
+// of the bearer token, which must be valid at this service. A client calling
+// several services logs in for auth-service and exchanges that token for one
+// per service; refreshing would end the session the other tokens belong to.
+func exchangeToken(w http.ResponseWriter, r *http.Request) {
+	var requestBody struct {
+		Audience string `json:"audience"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&requestBody); err != nil {
+		http.Error(w, "Invalid request body", http.StatusBadRequest)
+		return
+	}
+	if strings.TrimSpace(requestBody.Audience) == "" {
+		http.Error(w, "audience is required", http.StatusBadRequest)
+		return
+	}
+	audience, ok := tokenAudience(requestBody.Audience)
+	if !ok {
+		http.Error(w, "Unknown audience", http.StatusBadRequest)
+		return
+	}
+
+	token := strings.TrimPrefix(r.Header.Get("Authorization"), "Bearer ")
+	v, err := checkAccessToken(r.Context(), token, servicekit.JWTAudience(), func(e SecurityEvent) { emitSecurityEvent(r, e) })
+	switch err {
+	case nil:
+	case errInvalidToken:
+		http.Error(w, errInvalidToken.Error(), http.StatusUnauthorized)
+		return
+	case errSessionEnded:
+		http.Error(w, errSessionEnded.Error(), http.StatusUnauthorized)
+		return
+	case errTermsRequired:
+		http.Error(w, errTermsRequired.Error(), http.StatusForbidden)
+		return
+	default:
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	user := User{ID: v.Claims.UserID, Username: v.Claims.Username, Role: v.Claims.Role}
+	exchanged, expiresAt, err := generateJWT(user, v.Session, audience)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(TokenResponse{
+		Token:     exchanged,
+		ExpiresAt: expiresAt,
+		UserID:    user.ID,
+		Username:  user.Username,
+		Role:      user.Role,
+	})
+}
+
+// logout ends the bearer token's session and revokes its refresh tokens. A
+// refresh_token in the body is revoked too, so clients holding only that can
+// still sign out.
+func logout(w http.ResponseWriter, r *http.Request) {
+	var requestBody struct {
+		RefreshToken string `json:"refresh_token"`
+	}
+	if r.ContentLength != 0 {
+		if err := json.NewDecoder(r.Body).Decode(&requestBody); err != nil {
+			http.Error(w, "Invalid request body", http.StatusBadRequest)
+			return
+		}
+	}
+
+	var families []string
+	if claims, err := bearerClaims(r); err == nil {
+		sid := claims.SessionID
+		_, err := db.ExecContext(r.Context(), `UPDATE user_sessions SET revoked_at = NOW() WHERE id = $1 AND revoked_at IS NULL`, sid)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		var familyID string
+		err = db.QueryRowContext(r.Context(), `SELECT family_id FROM refresh_tokens WHERE session_id = $1 LIMIT 1`, sid).Scan(&familyID)
+		if err != nil && err != sql.ErrNoRows {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		if familyID != "" {
+			families = append(families, familyID)
+		}
+	} else if requestBody.RefreshToken == "" {
+		http.Error(w, "Authentication required", http.StatusUnauthorized)
+		return
+	}
+	if requestBody.RefreshToken != "" {
+		var familyID string
+		err := db.QueryRowContext(r.Context(), `SELECT family_id FROM refresh_tokens WHERE token_hash = $1`,
+			hashRefreshToken(requestBody.RefreshToken)).Scan(&familyID)
+		if err != nil && err != sql.ErrNoRows {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		if familyID != "" {
+			families = append(families, familyID)
+		}
+	}
+
+	for _, familyID := range families {
+		if err := revokeRefreshFamily(r.Context(), db, familyID); err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
@@ -0,0 +1,65 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"bank/servicekit"
+
+	"github.com/golang-jwt/jwt/v5"
+)
+
+// useTestSigner signs and verifies access tokens with testJWTSecret
+func useTestSigner(t *testing.T) {
+	t.Helper()
+	previousSecret, previousSigner := jwtSecret, jwtSigner
+	t.Cleanup(func() { jwtSecret, jwtSigner = previousSecret, previousSigner })
+	jwtSecret = testJWTSecret
+	signer, err := servicekit.NewSigner("jwt", testJWTSecret)
+	if err != nil {
+		t.Fatal(err)
+	}
+	jwtSigner = signer
+}
+
+// testBearer returns an Authorization header for a user with role
+func testBearer(t *testing.T, role string) string {
+	claims := testAccessClaims(serviceName)
+	claims.Role = role
+	return "Bearer " + signTestToken(t, jwt.SigningMethodHS256, testJWTSecret, claims)
+}
+
+// TestRegisterUserRoles checks only an admin can register a user with a role
+// other than customer
+func TestRegisterUserRoles(t *testing.T) {
+	useTestSigner(t)
+	cases := []struct {
+		name          string
+		role          string
+		authorization string
+		status        int
+	}{
+		{"anonymous admin", "admin", "", http.StatusUnauthorized},
+		{"anonymous teller", "teller", "", http.StatusUnauthorized},
+		{"anonymous agent", "agent", "", http.StatusUnauthorized},
+		{"customer registering an admin", "admin", testBearer(t, "customer"), http.StatusForbidden},
+		{"teller registering a teller", "teller", testBearer(t, "teller"), http.StatusForbidden},
+		{"forged admin token", "admin", "Bearer forged", http.StatusUnauthorized},
+	}
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			body := `{"username": "mallory", "email": "mallory@example.com", "password": "Secret-123", "role": "` + c.role + `"}`
+			r := httptest.NewRequest("POST", "/v1/auth/register", strings.NewReader(body))
+			if c.authorization != "" {
+				r.Header.Set("Authorization", c.authorization)
+			}
+			w := httptest.NewRecorder()
+			registerUser(w, r)
+			if w.Code != c.status {
+				t.Fatalf("status %d, want %d: %s", w.Code, c.status, w.Body)
+			}
+		})
+	}
+}
@@ -0,0 +1,60 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"testing"
+)
+
+// These tests run two replicas side by side against the same Postgres
+// (TEST_DATABASE_URL), as in docker-compose, and are skipped without it.
+// Each replica has its own connection pool; db is pointed at one at a time.
+
+// testReplicaDBs opens two connection pools to TEST_DATABASE_URL and restores
+// db when the test ends
+func testReplicaDBs(t *testing.T) (*sql.DB, *sql.DB) {
+	t.Helper()
+	dsn := getEnv("TEST_DATABASE_URL", "")
+	if dsn == "" {
+		t.Skip("TEST_DATABASE_URL is not set")
+	}
+	replicas := make([]*sql.DB, 2)
+	for i := range replicas {
+		conn, err := sql.Open("postgres", dsn)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := conn.Ping(); err != nil {
+			t.Fatal(err)
+		}
+		t.Cleanup(func() { conn.Close() })
+		replicas[i] = conn
+	}
+	previous := db
+	t.Cleanup(func() { db = previous })
+	return replicas[0], replicas[1]
+}
+
+// TestReplicasShareGeneratedJWTSecret checks replicas started without
+// JWT_SECRET accept each other's tokens
+func TestReplicasShareGeneratedJWTSecret(t *testing.T) {
+	a, b := testReplicaDBs(t)
+	t.Setenv("JWT_SECRET", "")
+	ctx := context.Background()
+	if _, err := a.ExecContext(ctx, serviceSecretTablesSQL); err != nil {
+		t.Fatal(err)
+	}
+
+	secrets := make([][]byte, 2)
+	for i, replica := range []*sql.DB{a, b} {
+		db = replica
+		secret, err := loadJWTSecret(ctx)
+		if err != nil {
+			t.Fatal(err)
+		}
+		secrets[i] = secret
+	}
+	if len(secrets[0]) == 0 || string(secrets[0]) != string(secrets[1]) {
+		t.Fatal("replicas generated different JWT secrets")
+	}
+}
@@ -0,0 +1,581 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"bank/servicekit"
+
+	"github.com/gorilla/mux"
+	"go.uber.org/zap"
+)
+
+// ScreeningSubject is the personal data a customer is screened on
+type ScreeningSubject struct {
+	UserID      int
+	FullName    string
+	DateOfBirth string // YYYY-MM-DD, optional
+}
+
+// ScreeningHit is a possible match of a customer against a watchlist entry
+type ScreeningHit struct {
+	ID          int     `json:"id"`
+	EntryID     int     `json:"entry_id"`
+	ListType    string  `json:"list_type"` // sanctions or pep
+	Source      string  `json:"source"`
+	MatchedName string  `json:"matched_name"`
+	Score       float64 `json:"score"`
+	Decision    string  `json:"decision"` // pending, true_match or false_positive
+}
+
+// Screening is one run of a customer against the watchlists
+type Screening struct {
+	ID         int            `json:"id"`
+	UserID     int            `json:"user_id"`
+	Trigger    string         `json:"trigger"` // registration, profile_change, periodic or manual
+	Status     string         `json:"status"`  // clear, hit, skipped, cleared or confirmed
+	Provider   string         `json:"provider"`
+	Hits       []ScreeningHit `json:"hits"`
+	ReviewedBy string         `json:"reviewed_by,omitempty"`
+	ReviewNote string         `json:"review_note,omitempty"`
+	CreatedAt  string         `json:"created_at"`
+	ReviewedAt string         `json:"reviewed_at,omitempty"`
+}
+
+// WatchlistEntry is a sanctioned or politically exposed person
+type WatchlistEntry struct {
+	ID          int    `json:"id"`
+	ListType    string `json:"list_type"`
+	Source      string `json:"source"` // e.g. OFAC SDN, UN, EU, national PEP register
+	FullName    string `json:"full_name"`
+	DateOfBirth string `json:"date_of_birth,omitempty"`
+	Country     string `json:"country,omitempty"`
+	CreatedAt   string `json:"created_at"`
+}
+
+// ScreeningProvider matches a subject against sanctions and PEP lists, so a
+// commercial screening service can replace the local watchlist
+type ScreeningProvider interface {
+	Name() string
+	Screen(ctx context.Context, subject ScreeningSubject) ([]ScreeningHit, error)
+}
+
+const screeningTablesSQL = `
+	CREATE TABLE IF NOT EXISTS watchlist_entries (
+		id SERIAL PRIMARY KEY,
+		list_type VARCHAR(20) NOT NULL,
+		source VARCHAR(50) NOT NULL,
+		full_name VARCHAR(200) NOT NULL,
+		date_of_birth DATE,
+		country VARCHAR(2) NOT NULL DEFAULT '',
+		created_at TIMESTAMP NOT NULL DEFAULT NOW()
+	);
+	CREATE TABLE IF NOT EXISTS screenings (
+		id SERIAL PRIMARY KEY,
+		user_id INTEGER NOT NULL REFERENCES users(id),
+		trigger VARCHAR(20) NOT NULL,
+		status VARCHAR(20) NOT NULL,
+		provider VARCHAR(30) NOT NULL,
+		reviewed_by VARCHAR(100) NOT NULL DEFAULT '',
+		review_note VARCHAR(500) NOT NULL DEFAULT '',
+		created_at TIMESTAMP NOT NULL DEFAULT NOW(),
+		reviewed_at TIMESTAMP
+	);
+	CREATE INDEX IF NOT EXISTS idx_screenings_user ON screenings(user_id, created_at);
+	CREATE TABLE IF NOT EXISTS screening_hits (
+		id SERIAL PRIMARY KEY,
+		screening_id INTEGER NOT NULL REFERENCES screenings(id),
+		entry_id INTEGER NOT NULL,
+		list_type VARCHAR(20) NOT NULL,
+		source VARCHAR(50) NOT NULL,
+		matched_name VARCHAR(200) NOT NULL,
+		score DECIMAL(4,2) NOT NULL,
+		decision VARCHAR(20) NOT NULL DEFAULT 'pending'
+	);`
+
+// complianceRoles review screening hits and maintain the watchlist
+var complianceRoles = []string{"compliance", "admin"}
+
+var watchlistTypes = map[string]bool{"sanctions": true, "pep": true}
+
+// minScreeningScore is the name similarity (0-1) reported as a hit
+const minScreeningScore = 0.85
+
+var screeningProvider ScreeningProvider
+
+// newScreeningProvider returns the provider selected by SCREENING_PROVIDER.
+// "watchlist" (the default) screens against the locally loaded lists.
+func newScreeningProvider(name string) ScreeningProvider {
+	switch name {
+	case "", "watchlist":
+		return watchlistProvider{}
+	default:
+		logger.Fatal("unsupported screening provider", zap.String("provider", name))
+		return nil
+	}
+}
+
+// nameSimilarity is 1 minus the edit distance between the normalized names
+// relative to the longer one, so word order and punctuation do not matter
+func nameSimilarity(a, b string) float64 {
+	a, b = normalizeName(a), normalizeName(b)
+	longest := len([]rune(a))
+	if n := len([]rune(b)); n > longest {
+		longest = n
+	}
+	if longest == 0 {
+		return 0
+	}
+	return 1 - float64(editDistance(a, b))/float64(longest)
+}
+
+// watchlistProvider screens against watchlist_entries. A differing date of
+// birth rules an entry out; a matching one raises the score.
+type watchlistProvider struct{}
+
+func (watchlistProvider) Name() string { return "watchlist" }
+
+func (watchlistProvider) Screen(ctx context.Context, subject ScreeningSubject) ([]ScreeningHit, error) {
+	rows, err := db.QueryContext(ctx, `SELECT id, list_type, source, full_name, COALESCE(date_of_birth::text, '')
+									   FROM watchlist_entries
+									   WHERE $1 = '' OR date_of_birth IS NULL OR date_of_birth = NULLIF($1, '')::date`,
+		subject.DateOfBirth)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var hits []ScreeningHit
+	for rows.Next() {
+		var h ScreeningHit
+		var dob string
+		if err := rows.Scan(&h.EntryID, &h.ListType, &h.Source, &h.MatchedName, &dob); err != nil {
+			return nil, err
+		}
+		score := nameSimilarity(subject.FullName, h.MatchedName)
+		if score < minScreeningScore {
+			continue
+		}
+		if dob != "" && dob == subject.DateOfBirth {
+			score += 0.1
+		}
+		if score > 1 {
+			score = 1
+		}
+		h.Score = float64(int(score*100+0.5)) / 100
+		hits = append(hits, h)
+	}
+	return hits, rows.Err()
+}
+
+// screenUser screens a customer and records the result. Entries a previous
+// review found to be false positives for this customer are not raised again.
+// At registration a hit holds the customer in pending_review until compliance
+// decides; later screenings raise hits for review without blocking the login.
+func screenUser(ctx context.Context, userID int, trigger string) (Screening, error) {
+	s := Screening{UserID: userID, Trigger: trigger, Provider: screeningProvider.Name(), Hits: []ScreeningHit{}}
+	var subject ScreeningSubject
+	err := db.QueryRowContext(ctx, `SELECT id, full_name, COALESCE(date_of_birth::text, '') FROM users WHERE id = $1`,
+		userID).Scan(&subject.UserID, &subject.FullName, &subject.DateOfBirth)
+	if err != nil {
+		return s, err
+	}
+
+	var hits []ScreeningHit
+	s.Status = "skipped"
+	if strings.TrimSpace(subject.FullName) != "" {
+		hits, err = screeningProvider.Screen(ctx, subject)
+		if err != nil {
+			return s, err
+		}
+		cleared := map[int]bool{}
+		rows, err := db.QueryContext(ctx, `SELECT h.entry_id FROM screening_hits h JOIN screenings s ON s.id = h.screening_id
+										   WHERE s.user_id = $1 AND h.decision = 'false_positive'`, userID)
+		if err != nil {
+			return s, err
+		}
+		for rows.Next() {
+			var id int
+			if err := rows.Scan(&id); err != nil {
+				rows.Close()
+				return s, err
+			}
+			cleared[id] = true
+		}
+		rows.Close()
+		if err := rows.Err(); err != nil {
+			return s, err
+		}
+
+		s.Status = "clear"
+		for _, h := range hits {
+			if !cleared[h.EntryID] {
+				s.Hits = append(s.Hits, h)
+			}
+		}
+		if len(s.Hits) > 0 {
+			s.Status = "hit"
+		}
+	}
+
+	tx, err := db.BeginTx(ctx, nil)
+	if err != nil {
+		return s, err
+	}
+	defer tx.Rollback()
+
+	err = tx.QueryRowContext(ctx, `INSERT INTO screenings (user_id, trigger, status, provider) VALUES ($1, $2, $3, $4)
+								   RETURNING id, created_at::text`, userID, trigger, s.Status, s.Provider).Scan(&s.ID, &s.CreatedAt)
+	if err != nil {
+		return s, err
+	}
+	for i := range s.Hits {
+		h := &s.Hits[i]
+		h.Decision = "pending"
+		err = tx.QueryRowContext(ctx, `INSERT INTO screening_hits (screening_id, entry_id, list_type, source, matched_name, score)
+									   VALUES ($1, $2, $3, $4, $5, $6) RETURNING id`,
+			s.ID, h.EntryID, h.ListType, h.Source, h.MatchedName, h.Score).Scan(&h.ID)
+		if err != nil {
+			return s, err
+		}
+	}
+	if trigger == "registration" {
+		if s.Status == "hit" {
+			_, err = tx.ExecContext(ctx, `UPDATE users SET status = 'pending_review', updated_at = NOW()
+										  WHERE id = $1 AND status = 'active'`, userID)
+		} else {
+			// A customer held because screening at registration failed is
+			// released by a clear retry
+			_, err = tx.ExecContext(ctx, `UPDATE users SET status = 'active', updated_at = NOW()
+										  WHERE id = $1 AND status = 'pending_review'
+										  AND NOT EXISTS (SELECT 1 FROM screenings WHERE user_id = $1 AND status = 'hit')`, userID)
+		}
+		if err != nil {
+			return s, err
+		}
+	}
+	if err := tx.Commit(); err != nil {
+		return s, err
+	}
+
+	if s.Status == "hit" {
+		emitSecurityEvent(nil, SecurityEvent{Type: eventScreeningHit, Severity: 7, Outcome: "failure",
+			UserID: strconv.Itoa(userID), Message: "Sanctions or PEP screening hit",
+			Details: map[string]string{"screening_id": strconv.Itoa(s.ID), "trigger": trigger}})
+	}
+	return s, nil
+}
+
+// startPeriodicScreening re-screens customers whose last screening is older
+// than SCREENING_INTERVAL (default 30 days), so list updates reach existing
+// customers. Customers never screened, because screening was unavailable when
+// they registered, are screened as registrations.
+func startPeriodicScreening() {
+	interval, err := time.ParseDuration(getEnv("SCREENING_INTERVAL", "720h"))
+	if err != nil {
+		interval = 720 * time.Hour
+	}
+
+	go func() {
+		defer servicekit.ReportJobPanic("Periodic screening")
+		for {
+			if err := rescreenCustomers(serviceContext, interval); err != nil {
+				servicekit.ReportJobError("Periodic screening", err)
+			}
+			time.Sleep(time.Hour)
+		}
+	}()
+}
+
+func rescreenCustomers(ctx context.Context, interval time.Duration) error {
+	rows, err := db.QueryContext(ctx, `SELECT u.id, NOT EXISTS (SELECT 1 FROM screenings WHERE user_id = u.id)
+									   FROM users u WHERE u.role = 'customer' AND u.status NOT IN ('merged', 'blocked')
+									   AND COALESCE((SELECT MAX(created_at) FROM screenings WHERE user_id = u.id), 'epoch')
+										   < NOW() - $1 * INTERVAL '1 second'
+									   ORDER BY u.id LIMIT 500`, int(interval/time.Second))
+	if err != nil {
+		return err
+	}
+	triggers := map[int]string{}
+	var ids []int
+	for rows.Next() {
+		var id int
+		var never bool
+		if err := rows.Scan(&id, &never); err != nil {
+			rows.Close()
+			return err
+		}
+		ids = append(ids, id)
+		triggers[id] = "periodic"
+		if never {
+			triggers[id] = "registration"
+		}
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return err
+	}
+
+	for _, id := range ids {
+		if _, err := screenUser(ctx, id, triggers[id]); err != nil {
+			servicekit.RequestLogger(ctx).Error("screening failed", zap.Int("user_id", id), zap.Error(err))
+		}
+	}
+	return nil
+}
+
+const screeningColumns = `id, user_id, trigger, status, provider, reviewed_by, review_note, created_at::text,
+	COALESCE(reviewed_at::text, '')`
+
+func scanScreening(row interface{ Scan(...interface{}) error }, s *Screening) error {
+	return row.Scan(&s.ID, &s.UserID, &s.Trigger, &s.Status, &s.Provider, &s.ReviewedBy, &s.ReviewNote, &s.CreatedAt,
+		&s.ReviewedAt)
+}
+
+// loadScreeningHits fills in the hits of each screening
+func loadScreeningHits(ctx context.Context, screenings []Screening) error {
+	for i := range screenings {
+		rows, err := db.QueryContext(ctx, `SELECT id, entry_id, list_type, source, matched_name, score, decision
+							   FROM screening_hits WHERE screening_id = $1 ORDER BY score DESC, id`, screenings[i].ID)
+		if err != nil {
+			return err
+		}
+		screenings[i].Hits = []ScreeningHit{}
+		for rows.Next() {
+			var h ScreeningHit
+			if err := rows.Scan(&h.ID, &h.EntryID, &h.ListType, &h.Source, &h.MatchedName, &h.Score, &h.Decision); err != nil {
+				rows.Close()
+				return err
+			}
+			screenings[i].Hits = append(screenings[i].Hits, h)
+		}
+		rows.Close()
+		if err := rows.Err(); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func queryScreenings(ctx context.Context, query string, args ...interface{}) ([]Screening, error) {
+	rows, err := db.QueryContext(ctx, query, args...)
+	if err != nil {
+		return nil, err
+	}
+	screenings := []Screening{}
+	for rows.Next() {
+		var s Screening
+		if err := scanScreening(rows, &s); err != nil {
+			rows.Close()
+			return nil, err
+		}
+		screenings = append(screenings, s)
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+	return screenings, loadScreeningHits(ctx, screenings)
+}
+
+// getScreeningQueue lists screenings with hits awaiting a compliance decision,
+// oldest first
+func getScreeningQueue(w http.ResponseWriter, r *http.Request) {
+	if _, ok := requireStaffRole(w, r, complianceRoles...); !ok {
+		return
+	}
+
+	screenings, err := queryScreenings(r.Context(), `SELECT `+screeningColumns+` FROM screenings WHERE status = 'hit'
+										ORDER BY created_at, id`)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(screenings)
+}
+
+// getUserScreenings returns the customer's screening history, newest first
+func getUserScreenings(w http.ResponseWriter, r *http.Request) {
+	if _, ok := requireStaffRole(w, r, complianceRoles...); !ok {
+		return
+	}
+
+	screenings, err := queryScreenings(r.Context(), `SELECT `+screeningColumns+` FROM screenings WHERE user_id = $1
+										ORDER BY created_at DESC, id DESC`, mux.Vars(r)["id"])
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(screenings)
+}
+
+// screenUserNow runs a manual screening of the customer
+func screenUserNow(w http.ResponseWriter, r *http.Request) {
+	if _, ok := requireStaffRole(w, r, complianceRoles...); !ok {
+		return
+	}
+	userID, err := strconv.Atoi(mux.Vars(r)["id"])
+	if err != nil {
+		http.Error(w, "Invalid user ID", http.StatusBadRequest)
+		return
+	}
+
+	s, err := screenUser(r.Context(), userID, "manual")
+	if err != nil {
+		if err == sql.ErrNoRows {
+			http.Error(w, "User not found", http.StatusNotFound)
+		} else {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+		}
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusCreated)
+	json.NewEncoder(w).Encode(s)
+}
+
+// reviewScreening decides a screening with hits. "cleared" marks every hit a
+// false positive and releases a customer held at onboarding; "confirmed"
+// marks them true matches and blocks the customer.
+func reviewScreening(w http.ResponseWriter, r *http.Request) {
+	claims, ok := requireStaffRole(w, r, complianceRoles...)
+	if !ok {
+		return
+	}
+
+	var requestBody struct {
+		Decision string `json:"decision"`
+		Note     string `json:"note"`
+	}
+	err := json.NewDecoder(r.Body).Decode(&requestBody)
+	if err != nil {
+		http.Error(w, "Invalid request body", http.StatusBadRequest)
+		return
+	}
+	requestBody.Note = strings.TrimSpace(requestBody.Note)
+	hitDecision := map[string]string{"cleared": "false_positive", "confirmed": "true_match"}[requestBody.Decision]
+	if hitDecision == "" || requestBody.Note == "" {
+		http.Error(w, "decision (cleared or confirmed) and a note are required", http.StatusBadRequest)
+		return
+	}
+	if len(requestBody.Note) > 500 {
+		http.Error(w, "note is limited to 500 characters", http.StatusBadRequest)
+		return
+	}
+
+	tx, err := db.BeginTx(r.Context(), nil)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	defer tx.Rollback()
+
+	var s Screening
+	err = scanScreening(tx.QueryRowContext(r.Context(), `UPDATE screenings SET status = $2, reviewed_by = $3, review_note = $4, reviewed_at = NOW()
+									 WHERE id = $1 AND status = 'hit' RETURNING `+screeningColumns,
+		mux.Vars(r)["id"], requestBody.Decision, fmt.Sprintf("user:%d", claims.UserID), requestBody.Note), &s)
+	if err != nil {
+		if err == sql.ErrNoRows {
+			http.Error(w, "No screening awaiting review found", http.StatusNotFound)
+		} else {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+		}
+		return
+	}
+
+	_, err = tx.ExecContext(r.Context(), `UPDATE screening_hits SET decision = $2 WHERE screening_id = $1`, s.ID, hitDecision)
+	if err == nil {
+		if requestBody.Decision == "confirmed" {
+			_, err = tx.ExecContext(r.Context(), `UPDATE users SET status = 'blocked', updated_at = NOW() WHERE id = $1`, s.UserID)
+			if err == nil {
+				_, err = tx.ExecContext(r.Context(), `UPDATE user_sessions SET revoked_at = NOW() WHERE user_id = $1 AND revoked_at IS NULL`, s.UserID)
+			}
+		} else {
+			// Release the customer once no other screening holds them
+			_, err = tx.ExecContext(r.Context(), `UPDATE users SET status = 'active', updated_at = NOW() WHERE id = $1 AND status = 'pending_review'
+							  AND NOT EXISTS (SELECT 1 FROM screenings WHERE user_id = $1 AND status = 'hit')`, s.UserID)
+		}
+	}
+	if err == nil {
+		err = tx.Commit()
+	}
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	screenings := []Screening{s}
+	if err := loadScreeningHits(r.Context(), screenings); err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(screenings[0])
+}
+
+// addWatchlistEntry loads a sanctioned or politically exposed person
+func addWatchlistEntry(w http.ResponseWriter, r *http.Request) {
+	if _, ok := requireStaffRole(w, r, complianceRoles...); !ok {
+		return
+	}
+
+	var e WatchlistEntry
+	err := json.NewDecoder(r.Body).Decode(&e)
+	if err != nil {
+		http.Error(w, "Invalid request body", http.StatusBadRequest)
+		return
+	}
+	e.FullName = strings.TrimSpace(e.FullName)
+	if !watchlistTypes[e.ListType] || e.Source == "" || e.FullName == "" {
+		http.Error(w, "list_type (sanctions or pep), source and full_name are required", http.StatusBadRequest)
+		return
+	}
+	if e.DateOfBirth != "" {
+		if _, err := time.Parse("2006-01-02", e.DateOfBirth); err != nil {
+			http.Error(w, "date_of_birth must be YYYY-MM-DD", http.StatusBadRequest)
+			return
+		}
+	}
+
+	err = db.QueryRowContext(r.Context(), `INSERT INTO watchlist_entries (list_type, source, full_name, date_of_birth, country)
+					   VALUES ($1, $2, $3, NULLIF($4, '')::date, UPPER($5)) RETURNING id, created_at::text`,
+		e.ListType, e.Source, e.FullName, e.DateOfBirth, e.Country).Scan(&e.ID, &e.CreatedAt)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusCreated)
+	json.NewEncoder(w).Encode(e)
+}
+
+func deleteWatchlistEntry(w http.ResponseWriter, r *http.Request) {
+	if _, ok := requireStaffRole(w, r, complianceRoles...); !ok {
+		return
+	}
+
+	result, err := db.ExecContext(r.Context(), `DELETE FROM watchlist_entries WHERE id = $1`, mux.Vars(r)["id"])
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	if n, _ := result.RowsAffected(); n == 0 {
+		http.Error(w, "Watchlist entry not found", http.StatusNotFound)
+		return
+	}
+
+	w.WriteHeader(http.StatusNoContent)
+}
@@ -0,0 +1,188 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"sort"
+	"strings"
+	"time"
+
+	"bank/servicekit"
+
+	"go.uber.org/zap"
+)
+
+// SecurityEvent is a security-relevant action exported to the bank's SIEM
+type SecurityEvent struct {
+	Time     time.Time         `json:"time"`
+	Service  string            `json:"service"`
+	Type     string            `json:"type"`
+	Severity int               `json:"severity"` // CEF severity, 0-10
+	Outcome  string            `json:"outcome"`  // success or failure
+	UserID   string            `json:"user_id,omitempty"`
+	Username string            `json:"username,omitempty"`
+	SourceIP string            `json:"source_ip,omitempty"`
+	Message  string            `json:"message"`
+	Details  map[string]string `json:"details,omitempty"`
+}
+
+// Security event types
+const (
+	eventAuthFailure      = "auth_failure"
+	eventLoginDenied      = "login_denied"
+	eventTokenInvalid     = "token_invalid"
+	eventRoleChanged      = "role_changed"
+	eventAccountLocked    = "account_locked"
+	eventPermissionDenied = "permission_denied"
+	eventCustomerMerged   = "customer_merged"
+	eventScreeningHit     = "screening_hit"
+	eventBreakGlass       = "break_glass"
+	eventPrivilegeGranted = "privilege_granted"
+	eventPrivilegeRevoked = "privilege_revoked"
+	eventSignatureInvalid = "signature_invalid"
+	eventPasswordReset    = "password_reset"
+)
+
+var securityEvents = make(chan SecurityEvent, 1000)
+
+// emitSecurityEvent queues an event for export. Events are dropped rather than
+// blocking the request when the sink falls behind.
+func emitSecurityEvent(r *http.Request, e SecurityEvent) {
+	e.Time = time.Now().UTC()
+	e.Service = serviceName
+	if r != nil && e.SourceIP == "" {
+		e.SourceIP = clientIP(r)
+	}
+
+	select {
+	case securityEvents <- e:
+	default:
+		log := logger
+		if r != nil {
+			log = servicekit.RequestLogger(r.Context())
+		}
+		log.Warn("security event queue full, dropped event", zap.String("event", e.Type))
+	}
+}
+
+// clientIP returns the originating client address, preferring the first
+// X-Forwarded-For entry set by the gateway
+func clientIP(r *http.Request) string {
+	if forwarded := r.Header.Get("X-Forwarded-For"); forwarded != "" {
+		return strings.TrimSpace(strings.Split(forwarded, ",")[0])
+	}
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		return r.RemoteAddr
+	}
+	return host
+}
+
+// startSecurityEventExporter ships queued events to SIEM_SINK, which is one of
+// "stdout" (default), "syslog+udp://host:514", "syslog+tcp://host:514" or an
+// http(s) URL. SIEM_FORMAT selects "cef" (default) or "json".
+func startSecurityEventExporter() {
+	sink := getEnv("SIEM_SINK", "stdout")
+	format := getEnv("SIEM_FORMAT", "cef")
+
+	go func() {
+		defer servicekit.ReportJobPanic("Security event export")
+		for e := range securityEvents {
+			line := formatCEF(e)
+			if format == "json" {
+				raw, _ := json.Marshal(e)
+				line = string(raw)
+			}
+			if err := shipSecurityEvent(sink, format, line); err != nil {
+				servicekit.ReportJobError("Security event export", err)
+			}
+		}
+	}()
+}
+
+var siemClient = &http.Client{Timeout: 5 * time.Second}
+
+func shipSecurityEvent(sink, format, line string) error {
+	if sink == "stdout" {
+		fmt.Fprintln(os.Stdout, line)
+		return nil
+	}
+
+	u, err := url.Parse(sink)
+	if err != nil {
+		return err
+	}
+
+	switch u.Scheme {
+	case "syslog+udp", "syslog+tcp":
+		conn, err := net.DialTimeout(strings.TrimPrefix(u.Scheme, "syslog+"), u.Host, 5*time.Second)
+		if err != nil {
+			return err
+		}
+		defer conn.Close()
+		hostname, _ := os.Hostname()
+		// RFC 5424 header with facility auth (4) and severity notice (5)
+		_, err = fmt.Fprintf(conn, "<37>1 %s %s %s - - - %s\n",
+			time.Now().UTC().Format(time.RFC3339), hostname, serviceName, line)
+		return err
+	case "http", "https":
+		contentType := "text/plain"
+		if format == "json" {
+			contentType = "application/json"
+		}
+		resp, err := siemClient.Post(sink, contentType, bytes.NewBufferString(line))
+		if err != nil {
+			return err
+		}
+		resp.Body.Close()
+		if resp.StatusCode >= 300 {
+			return fmt.Errorf("SIEM sink returned status %d", resp.StatusCode)
+		}
+		return nil
+	}
+	return fmt.Errorf("unsupported SIEM sink: %s", sink)
+}
+
+// formatCEF renders the event in ArcSight Common Event Format
+func formatCEF(e SecurityEvent) string {
+	header := strings.NewReplacer(`\`, `\\`, "|", `\|`)
+	ext := strings.NewReplacer(`\`, `\\`, "=", `\=`, "\n", `\n`)
+
+	fields := map[string]string{
+		"rt":      fmt.Sprintf("%d", e.Time.UnixNano()/int64(time.Millisecond)),
+		"outcome": e.Outcome,
+		"msg":     e.Message,
+	}
+	if e.SourceIP != "" {
+		fields["src"] = e.SourceIP
+	}
+	if e.Username != "" {
+		fields["suser"] = e.Username
+	}
+	if e.UserID != "" {
+		fields["suid"] = e.UserID
+	}
+	for k, v := range e.Details {
+		fields[k] = v
+	}
+
+	keys := make([]string, 0, len(fields))
+	for k := range fields {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+
+	parts := make([]string, 0, len(keys))
+	for _, k := range keys {
+		parts = append(parts, k+"="+ext.Replace(fields[k]))
+	}
+
+	return fmt.Sprintf("CEF:0|Bank|%s|1.0|%s|%s|%d|%s",
+		header.Replace(serviceName), header.Replace(e.Type), header.Replace(e.Message), e.Severity,
+		strings.Join(parts, " "))
+}
@@ -0,0 +1,202 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"bank/servicekit"
+)
+
+// Session tracks activity for an issued token so idle sessions can be expired
+type Session struct {
+	ID          string    `json:"session_id"`
+	UserID      int       `json:"user_id"`
+	Policy      string    `json:"policy"`
+	IdleTimeout int       `json:"idle_timeout_seconds"` // 0 disables the idle timeout
+	CreatedAt   time.Time `json:"issued_at"`
+	LastSeenAt  time.Time `json:"last_activity_at"`
+	ExpiresAt   time.Time `json:"expires_at"`
+}
+
+// sessionPolicy sets how long a token lives, how long it may sit idle and how
+// long its refresh token can keep renewing it
+type sessionPolicy struct {
+	Name            string
+	IdleTimeout     time.Duration
+	MaxLifetime     time.Duration
+	RefreshLifetime time.Duration
+}
+
+const sessionTablesSQL = `
+	CREATE TABLE IF NOT EXISTS user_sessions (
+		id VARCHAR(64) PRIMARY KEY,
+		user_id INTEGER NOT NULL REFERENCES users(id),
+		policy VARCHAR(20) NOT NULL,
+		idle_timeout_seconds INTEGER NOT NULL DEFAULT 0,
+		created_at TIMESTAMP NOT NULL DEFAULT NOW(),
+		last_seen_at TIMESTAMP NOT NULL DEFAULT NOW(),
+		expires_at TIMESTAMP NOT NULL,
+		revoked_at TIMESTAMP
+	);
+	CREATE INDEX IF NOT EXISTS idx_user_sessions_user ON user_sessions (user_id);`
+
+var staffPolicy, customerPolicy sessionPolicy
+
+// loadSessionPolicies reads token lifetimes. Staff sessions default to a short
+// idle timeout; customer sessions keep the 24 hour token with no idle timeout
+// and can be renewed with a refresh token for 30 days.
+func loadSessionPolicies() {
+	staffPolicy = sessionPolicy{
+		Name:            "staff",
+		IdleTimeout:     envDuration("STAFF_IDLE_TIMEOUT", 15*time.Minute),
+		MaxLifetime:     envDuration("STAFF_SESSION_TTL", 8*time.Hour),
+		RefreshLifetime: envDuration("STAFF_REFRESH_TOKEN_TTL", 12*time.Hour),
+	}
+	customerPolicy = sessionPolicy{
+		Name:            "customer",
+		IdleTimeout:     envDuration("CUSTOMER_IDLE_TIMEOUT", 0),
+		MaxLifetime:     envDuration("CUSTOMER_SESSION_TTL", 24*time.Hour),
+		RefreshLifetime: envDuration("CUSTOMER_REFRESH_TOKEN_TTL", 30*24*time.Hour),
+	}
+}
+
+func envDuration(key string, defaultValue time.Duration) time.Duration {
+	d, err := time.ParseDuration(getEnv(key, defaultValue.String()))
+	if err != nil {
+		return defaultValue
+	}
+	return d
+}
+
+// policyForRole treats every non-customer role as staff
+func policyForRole(role string) sessionPolicy {
+	if role == "customer" {
+		return customerPolicy
+	}
+	return staffPolicy
+}
+
+// startSession records a new session for the user under their role's policy
+func startSession(ctx context.Context, user User) (Session, error) {
+	policy := policyForRole(user.Role)
+	session := Session{
+		ID:          strings.TrimRight(strings.NewReplacer("+", "-", "/", "_").Replace(generateRandomKey()), "="),
+		UserID:      user.ID,
+		Policy:      policy.Name,
+		IdleTimeout: int(policy.IdleTimeout / time.Second),
+	}
+
+	err := db.QueryRowContext(ctx, `INSERT INTO user_sessions (id, user_id, policy, idle_timeout_seconds, expires_at)
+						VALUES ($1, $2, $3, $4, NOW() + $5 * INTERVAL '1 second')
+						RETURNING created_at, last_seen_at, expires_at`,
+		session.ID, session.UserID, session.Policy, session.IdleTimeout,
+		int(policy.MaxLifetime/time.Second)).Scan(&session.CreatedAt, &session.LastSeenAt, &session.ExpiresAt)
+	return session, err
+}
+
+// touchSession slides the idle window forward. It returns sql.ErrNoRows when
+// the session is unknown, revoked, past its lifetime or has been idle too long.
+func touchSession(ctx context.Context, id string) (Session, error) {
+	session := Session{ID: id}
+	err := db.QueryRowContext(ctx, `UPDATE user_sessions SET last_seen_at = NOW()
+						WHERE id = $1 AND revoked_at IS NULL AND expires_at > NOW()
+						AND (idle_timeout_seconds = 0 OR last_seen_at > NOW() - idle_timeout_seconds * INTERVAL '1 second')
+						RETURNING user_id, policy, idle_timeout_seconds, created_at, last_seen_at, expires_at`,
+		id).Scan(&session.UserID, &session.Policy, &session.IdleTimeout, &session.CreatedAt,
+		&session.LastSeenAt, &session.ExpiresAt)
+	return session, err
+}
+
+func loadSession(ctx context.Context, id string) (Session, error) {
+	session := Session{ID: id}
+	err := db.QueryRowContext(ctx, `SELECT user_id, policy, idle_timeout_seconds, created_at, last_seen_at, expires_at
+						FROM user_sessions WHERE id = $1 AND revoked_at IS NULL`,
+		id).Scan(&session.UserID, &session.Policy, &session.IdleTimeout, &session.CreatedAt,
+		&session.LastSeenAt, &session.ExpiresAt)
+	return session, err
+}
+
+// IdleExpiresAt is when the session lapses without further activity
+func (s Session) IdleExpiresAt() time.Time {
+	if s.IdleTimeout == 0 {
+		return s.ExpiresAt
+	}
+	idle := s.LastSeenAt.Add(time.Duration(s.IdleTimeout) * time.Second)
+	if idle.After(s.ExpiresAt) {
+		return s.ExpiresAt
+	}
+	return idle
+}
+
+// parseToken verifies a JWT issued for this service and returns its claims
+func parseToken(tokenString string) (*servicekit.AccessClaims, error) {
+	return parseTokenFor(tokenString, servicekit.JWTAudience())
+}
+
+// parseTokenFor verifies a token and its claims for audience
+func parseTokenFor(tokenString, audience string) (*servicekit.AccessClaims, error) {
+	return servicekit.ParseAccessToken(tokenString, jwtSigner.Algorithm(), audience, jwtVerificationKey)
+}
+
+// bearerClaims returns the verified claims of the request's bearer token
+func bearerClaims(r *http.Request) (*servicekit.AccessClaims, error) {
+	tokenString := strings.TrimPrefix(r.Header.Get("Authorization"), "Bearer ")
+	if tokenString == "" {
+		return nil, fmt.Errorf("Bearer token is required")
+	}
+
+	claims, err := parseToken(tokenString)
+	if err != nil {
+		return nil, fmt.Errorf("Invalid token")
+	}
+	return claims, nil
+}
+
+// bearerUserID identifies the caller by a valid bearer token, or returns "";
+// rate limiting uses it to give each user one bucket across addresses
+func bearerUserID(r *http.Request) string {
+	if !strings.HasPrefix(r.Header.Get("Authorization"), "Bearer ") {
+		return ""
+	}
+	claims, err := bearerClaims(r)
+	if err != nil {
+		return ""
+	}
+	return strconv.Itoa(claims.UserID)
+}
+
+// getTokenInfo describes the caller's bearer token and session without
+// counting as activity
+func getTokenInfo(w http.ResponseWriter, r *http.Request) {
+	claims, err := bearerClaims(r)
+	if err != nil {
+		http.Error(w, "Authentication required", http.StatusUnauthorized)
+		return
+	}
+
+	sid := claims.SessionID
+	session, err := loadSession(r.Context(), sid)
+	if err != nil {
+		if err == sql.ErrNoRows {
+			http.Error(w, "Session not found", http.StatusUnauthorized)
+		} else {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+		}
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"session":         session,
+		"username":        claims.Username,
+		"role":            claims.Role,
+		"idle_expires_at": session.IdleExpiresAt(),
+		"active":          time.Now().Before(session.IdleExpiresAt()),
+	})
+}
@@ -0,0 +1,266 @@
+package main
+
+import (
+	"database/sql"
+	"encoding/json"
+	"net/http"
+	"regexp"
+	"strings"
+	"time"
+
+	"bank/servicekit"
+
+	"github.com/gorilla/mux"
+	"go.uber.org/zap"
+)
+
+// Customer is the KYC profile of an auth user. UserID is the auth user ID,
+// which account-service also uses as an account's customer_id.
+type Customer struct {
+	UserID        int        `json:"user_id"`
+	FirstName     string     `json:"first_name"`
+	MiddleName    string     `json:"middle_name,omitempty"`
+	LastName      string     `json:"last_name"`
+	DateOfBirth   string     `json:"date_of_birth"` // YYYY-MM-DD
+	Phone         string     `json:"phone,omitempty"`
+	Address       Address    `json:"address"`
+	KYCStatus     string     `json:"kyc_status"` // pending, verified or rejected
+	KYCReason     string     `json:"kyc_reason,omitempty"`
+	KYCReviewedBy string     `json:"kyc_reviewed_by,omitempty"`
+	KYCReviewedAt *time.Time `json:"kyc_reviewed_at,omitempty"`
+	CreatedAt     time.Time  `json:"created_at"`
+	UpdatedAt     time.Time  `json:"updated_at"`
+}
+
+// Address is a customer's residential address, in the shape auth-service
+// uses for contact addresses
+type Address struct {
+	Line1      string `json:"line1"`
+	Line2      string `json:"line2,omitempty"`
+	City       string `json:"city"`
+	Region     string `json:"region,omitempty"` // state, province or county
+	PostalCode string `json:"postal_code,omitempty"`
+	Country    string `json:"country"` // ISO 3166-1 alpha-2
+}
+
+var (
+	countryPattern = regexp.MustCompile(`^[A-Z]{2}$`)
+	phonePattern   = regexp.MustCompile(`^\+?[0-9 ()-]{6,30}$`)
+)
+
+const customerColumns = `user_id, first_name, middle_name, last_name, date_of_birth::text, phone, address_line1,
+	address_line2, city, region, postal_code, country, kyc_status, kyc_reason, COALESCE(kyc_reviewed_by, ''),
+	kyc_reviewed_at, created_at, updated_at`
+
+func scanCustomer(row interface{ Scan(...interface{}) error }, c *Customer) error {
+	var reviewedAt sql.NullTime
+	err := row.Scan(&c.UserID, &c.FirstName, &c.MiddleName, &c.LastName, &c.DateOfBirth, &c.Phone, &c.Address.Line1,
+		&c.Address.Line2, &c.Address.City, &c.Address.Region, &c.Address.PostalCode, &c.Address.Country, &c.KYCStatus,
+		&c.KYCReason, &c.KYCReviewedBy, &reviewedAt, &c.CreatedAt, &c.UpdatedAt)
+	if reviewedAt.Valid {
+		c.KYCReviewedAt = &reviewedAt.Time
+	}
+	return err
+}
+
+// decodeProfile reads and validates the editable fields of a profile
+func decodeProfile(w http.ResponseWriter, r *http.Request) (Customer, bool) {
+	var c Customer
+	if err := json.NewDecoder(r.Body).Decode(&c); err != nil {
+		http.Error(w, "Invalid request body", http.StatusBadRequest)
+		return c, false
+	}
+	for _, field := range []*string{&c.FirstName, &c.MiddleName, &c.LastName, &c.DateOfBirth, &c.Phone,
+		&c.Address.Line1, &c.Address.Line2, &c.Address.City, &c.Address.Region, &c.Address.PostalCode} {
+		*field = strings.TrimSpace(*field)
+	}
+	c.Address.Country = strings.ToUpper(strings.TrimSpace(c.Address.Country))
+
+	if c.FirstName == "" || c.LastName == "" {
+		http.Error(w, "first_name and last_name are required", http.StatusBadRequest)
+		return c, false
+	}
+	if len(c.FirstName) > 100 || len(c.MiddleName) > 100 || len(c.LastName) > 100 {
+		http.Error(w, "Names must be at most 100 characters", http.StatusBadRequest)
+		return c, false
+	}
+	born, err := time.Parse("2006-01-02", c.DateOfBirth)
+	if err != nil || born.After(time.Now()) || born.Before(time.Now().AddDate(-130, 0, 0)) {
+		http.Error(w, "date_of_birth must be a past date in YYYY-MM-DD format", http.StatusBadRequest)
+		return c, false
+	}
+	if c.Phone != "" && !phonePattern.MatchString(c.Phone) {
+		http.Error(w, "Invalid phone number", http.StatusBadRequest)
+		return c, false
+	}
+	if c.Address.Line1 == "" || c.Address.City == "" || !countryPattern.MatchString(c.Address.Country) {
+		http.Error(w, "address requires line1, city and a 2 letter country code", http.StatusBadRequest)
+		return c, false
+	}
+	if len(c.Address.Line1) > 200 || len(c.Address.Line2) > 200 || len(c.Address.City) > 100 ||
+		len(c.Address.Region) > 100 || len(c.Address.PostalCode) > 20 {
+		http.Error(w, "An address field is too long", http.StatusBadRequest)
+		return c, false
+	}
+	return c, true
+}
+
+// createProfile records the profile of the /customers/{id} user. It starts
+// with KYC pending.
+func createProfile(w http.ResponseWriter, r *http.Request) {
+	customerID, ok := requireCustomerAccess(w, r)
+	if !ok {
+		return
+	}
+	c, ok := decodeProfile(w, r)
+	if !ok {
+		return
+	}
+
+	err := scanCustomer(db.QueryRowContext(r.Context(), `INSERT INTO customers (user_id, first_name, middle_name,
+										   last_name, date_of_birth, phone, address_line1, address_line2, city, region,
+										   postal_code, country)
+										   VALUES ($1, $2, $3, $4, $5, $6, $7, $8, $9, $10, $11, $12)
+										   ON CONFLICT (user_id) DO NOTHING RETURNING `+customerColumns,
+		customerID, c.FirstName, c.MiddleName, c.LastName, c.DateOfBirth, c.Phone, c.Address.Line1, c.Address.Line2,
+		c.Address.City, c.Address.Region, c.Address.PostalCode, c.Address.Country), &c)
+	if err != nil {
+		if err == sql.ErrNoRows {
+			http.Error(w, "The customer already has a profile", http.StatusConflict)
+		} else {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+		}
+		return
+	}
+
+	servicekit.RequestLogger(r.Context()).Info("customer profile created", zap.Int("customer_id", c.UserID),
+		zap.String("actor", requestActor(r)))
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusCreated)
+	json.NewEncoder(w).Encode(c)
+}
+
+func getProfile(w http.ResponseWriter, r *http.Request) {
+	customerID, ok := requireCustomerAccess(w, r)
+	if !ok {
+		return
+	}
+
+	var c Customer
+	err := scanCustomer(db.QueryRowContext(r.Context(), `SELECT `+customerColumns+` FROM customers WHERE user_id = $1`,
+		customerID), &c)
+	if err != nil {
+		if err == sql.ErrNoRows {
+			http.Error(w, "Customer profile not found", http.StatusNotFound)
+		} else {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+		}
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(c)
+}
+
+// updateProfile replaces the editable fields. A change to the name or date
+// of birth sends a decided KYC back to pending, as the decision was about
+// the previous identity; address and phone changes keep it.
+func updateProfile(w http.ResponseWriter, r *http.Request) {
+	customerID, ok := requireCustomerAccess(w, r)
+	if !ok {
+		return
+	}
+	c, ok := decodeProfile(w, r)
+	if !ok {
+		return
+	}
+
+	// The right-hand sides see the row before the update
+	err := scanCustomer(db.QueryRowContext(r.Context(), `UPDATE customers SET
+		kyc_status = CASE WHEN (first_name, middle_name, last_name, date_of_birth) IS DISTINCT FROM
+					 ($2, $3, $4, $5::date) THEN 'pending' ELSE kyc_status END,
+		kyc_reason = CASE WHEN (first_name, middle_name, last_name, date_of_birth) IS DISTINCT FROM
+					 ($2, $3, $4, $5::date) AND kyc_status <> 'pending' THEN 'Name or date of birth changed'
+					 ELSE kyc_reason END,
+		first_name = $2, middle_name = $3, last_name = $4, date_of_birth = $5, phone = $6, address_line1 = $7,
+		address_line2 = $8, city = $9, region = $10, postal_code = $11, country = $12, updated_at = NOW()
+		WHERE user_id = $1 RETURNING `+customerColumns,
+		customerID, c.FirstName, c.MiddleName, c.LastName, c.DateOfBirth, c.Phone, c.Address.Line1, c.Address.Line2,
+		c.Address.City, c.Address.Region, c.Address.PostalCode, c.Address.Country), &c)
+	if err != nil {
+		if err == sql.ErrNoRows {
+			http.Error(w, "Customer profile not found", http.StatusNotFound)
+		} else {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+		}
+		return
+	}
+
+	servicekit.RequestLogger(r.Context()).Info("customer profile updated", zap.Int("customer_id", c.UserID),
+		zap.String("kyc_status", c.KYCStatus), zap.String("actor", requestActor(r)))
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(c)
+}
+
+// deleteProfile removes a profile and its identity documents. Without a
+// profile the customer cannot open accounts until a new one is verified.
+func deleteProfile(w http.ResponseWriter, r *http.Request) {
+	if !requireRole(w, r, kycRoles...) {
+		return
+	}
+
+	result, err := db.ExecContext(r.Context(), `DELETE FROM customers WHERE user_id = $1`, mux.Vars(r)["id"])
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	if n, _ := result.RowsAffected(); n == 0 {
+		http.Error(w, "Customer profile not found", http.StatusNotFound)
+		return
+	}
+
+	servicekit.RequestLogger(r.Context()).Info("customer profile deleted", zap.String("customer_id", mux.Vars(r)["id"]),
+		zap.String("actor", requestActor(r)))
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// listProfiles is the staff view of profiles, oldest change first so the
+// pending KYC queue is worked in order
+func listProfiles(w http.ResponseWriter, r *http.Request) {
+	if !requireRole(w, r, staffRoles...) {
+		return
+	}
+	limit, err := queryInt(r, "limit", 50, 200)
+	if err != nil {
+		http.Error(w, "limit must be a non-negative integer", http.StatusBadRequest)
+		return
+	}
+	offset, err := queryInt(r, "offset", 0, 0)
+	if err != nil {
+		http.Error(w, "offset must be a non-negative integer", http.StatusBadRequest)
+		return
+	}
+
+	rows, err := db.QueryContext(r.Context(), `SELECT `+customerColumns+` FROM customers
+											   WHERE ($1 = '' OR kyc_status = $1)
+											   ORDER BY updated_at, user_id LIMIT $2 OFFSET $3`,
+		r.URL.Query().Get("kyc_status"), limit, offset)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	defer rows.Close()
+
+	customers := []Customer{}
+	for rows.Next() {
+		var c Customer
+		if err := scanCustomer(rows, &c); err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		customers = append(customers, c)
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(customers)
+}
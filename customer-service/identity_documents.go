@@ -0,0 +1,182 @@
+package main
+
+import (
+	"database/sql"
+	"encoding/json"
+	"net/http"
+	"regexp"
+	"strings"
+	"time"
+
+	"bank/servicekit"
+
+	"github.com/gorilla/mux"
+	"go.uber.org/zap"
+)
+
+// IdentityDocument is an identification document a KYC decision rests on.
+// Only kycRoles see the full number; everyone else sees its last 4
+// characters.
+type IdentityDocument struct {
+	ID             int       `json:"id"`
+	CustomerID     int       `json:"customer_id"`
+	DocumentType   string    `json:"document_type"`
+	DocumentNumber string    `json:"document_number"`
+	IssuingCountry string    `json:"issuing_country"`
+	ExpiresOn      string    `json:"expires_on,omitempty"` // YYYY-MM-DD
+	CreatedBy      string    `json:"created_by"`
+	CreatedAt      time.Time `json:"created_at"`
+}
+
+var identityDocumentTypes = map[string]bool{
+	"passport":         true,
+	"national_id":      true,
+	"drivers_license":  true,
+	"residence_permit": true,
+}
+
+var documentNumberPattern = regexp.MustCompile(`^[A-Z0-9-]{4,50}$`)
+
+const identityDocumentColumns = `id, customer_id, document_type, document_number, issuing_country,
+	COALESCE(expires_on::text, ''), created_by, created_at`
+
+func scanIdentityDocument(row interface{ Scan(...interface{}) error }, d *IdentityDocument) error {
+	return row.Scan(&d.ID, &d.CustomerID, &d.DocumentType, &d.DocumentNumber, &d.IssuingCountry, &d.ExpiresOn,
+		&d.CreatedBy, &d.CreatedAt)
+}
+
+// maskDocumentNumber hides all but the last 4 characters from callers who do
+// not review KYC
+func maskDocumentNumber(r *http.Request, d *IdentityDocument) {
+	if hasRole(r, kycRoles...) || len(d.DocumentNumber) <= 4 {
+		return
+	}
+	d.DocumentNumber = strings.Repeat("*", len(d.DocumentNumber)-4) + d.DocumentNumber[len(d.DocumentNumber)-4:]
+}
+
+// addIdentityDocument records a document against the customer's profile
+func addIdentityDocument(w http.ResponseWriter, r *http.Request) {
+	customerID, ok := requireCustomerAccess(w, r)
+	if !ok {
+		return
+	}
+
+	var d IdentityDocument
+	if err := json.NewDecoder(r.Body).Decode(&d); err != nil {
+		http.Error(w, "Invalid request body", http.StatusBadRequest)
+		return
+	}
+	d.DocumentType = strings.TrimSpace(d.DocumentType)
+	d.DocumentNumber = strings.ToUpper(strings.ReplaceAll(strings.TrimSpace(d.DocumentNumber), " ", ""))
+	d.IssuingCountry = strings.ToUpper(strings.TrimSpace(d.IssuingCountry))
+	d.ExpiresOn = strings.TrimSpace(d.ExpiresOn)
+	if !identityDocumentTypes[d.DocumentType] {
+		http.Error(w, "document_type must be passport, national_id, drivers_license or residence_permit",
+			http.StatusBadRequest)
+		return
+	}
+	if !documentNumberPattern.MatchString(d.DocumentNumber) {
+		http.Error(w, "Invalid document_number", http.StatusBadRequest)
+		return
+	}
+	if !countryPattern.MatchString(d.IssuingCountry) {
+		http.Error(w, "issuing_country must be a 2 letter country code", http.StatusBadRequest)
+		return
+	}
+	var expiresOn interface{}
+	if d.ExpiresOn != "" {
+		expires, err := time.Parse("2006-01-02", d.ExpiresOn)
+		if err != nil {
+			http.Error(w, "expires_on must be in YYYY-MM-DD format", http.StatusBadRequest)
+			return
+		}
+		if expires.Before(time.Now().Truncate(24 * time.Hour)) {
+			http.Error(w, "The document has expired", http.StatusBadRequest)
+			return
+		}
+		expiresOn = d.ExpiresOn
+	}
+
+	d.CreatedBy = requestActor(r)
+	err := scanIdentityDocument(db.QueryRowContext(r.Context(), `INSERT INTO identity_documents (customer_id,
+											document_type, document_number, issuing_country, expires_on, created_by)
+											SELECT user_id, $2, $3, $4, $5, $6 FROM customers WHERE user_id = $1
+											ON CONFLICT DO NOTHING RETURNING `+identityDocumentColumns,
+		customerID, d.DocumentType, d.DocumentNumber, d.IssuingCountry, expiresOn, d.CreatedBy), &d)
+	if err == sql.ErrNoRows {
+		// No profile, or the document is already recorded
+		var exists bool
+		err = db.QueryRowContext(r.Context(), `SELECT EXISTS (SELECT 1 FROM customers WHERE user_id = $1)`,
+			customerID).Scan(&exists)
+		if err == nil && !exists {
+			http.Error(w, "Customer profile not found", http.StatusNotFound)
+			return
+		}
+		if err == nil {
+			http.Error(w, "The document is already recorded", http.StatusConflict)
+			return
+		}
+	}
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	servicekit.RequestLogger(r.Context()).Info("identity document added", zap.Int("customer_id", customerID),
+		zap.Int("document_id", d.ID), zap.String("document_type", d.DocumentType), zap.String("actor", d.CreatedBy))
+	maskDocumentNumber(r, &d)
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusCreated)
+	json.NewEncoder(w).Encode(d)
+}
+
+func listIdentityDocuments(w http.ResponseWriter, r *http.Request) {
+	customerID, ok := requireCustomerAccess(w, r)
+	if !ok {
+		return
+	}
+
+	rows, err := db.QueryContext(r.Context(), `SELECT `+identityDocumentColumns+` FROM identity_documents
+											   WHERE customer_id = $1 ORDER BY created_at`, customerID)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	defer rows.Close()
+
+	documents := []IdentityDocument{}
+	for rows.Next() {
+		var d IdentityDocument
+		if err := scanIdentityDocument(rows, &d); err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		maskDocumentNumber(r, &d)
+		documents = append(documents, d)
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(documents)
+}
+
+func deleteIdentityDocument(w http.ResponseWriter, r *http.Request) {
+	customerID, ok := requireCustomerAccess(w, r)
+	if !ok {
+		return
+	}
+
+	result, err := db.ExecContext(r.Context(), `DELETE FROM identity_documents WHERE id = $1 AND customer_id = $2`,
+		mux.Vars(r)["documentId"], customerID)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	if n, _ := result.RowsAffected(); n == 0 {
+		http.Error(w, "Identity document not found", http.StatusNotFound)
+		return
+	}
+
+	servicekit.RequestLogger(r.Context()).Info("identity document deleted", zap.Int("customer_id", customerID),
+		zap.String("document_id", mux.Vars(r)["documentId"]), zap.String("actor", requestActor(r)))
+	w.WriteHeader(http.StatusNoContent)
+}
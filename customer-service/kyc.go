@@ -0,0 +1,114 @@
+package main
+
+import (
+	"database/sql"
+	"encoding/json"
+	"net/http"
+	"strconv"
+	"strings"
+
+	"bank/servicekit"
+
+	"github.com/gorilla/mux"
+	"go.uber.org/zap"
+)
+
+// KYCStatus is the answer account-service gets before opening an account
+type KYCStatus struct {
+	CustomerID int    `json:"customer_id"`
+	KYCStatus  string `json:"kyc_status"`
+}
+
+// getKYCStatus serves peer services only, so there is no caller to check. A
+// customer without a profile is 404, which callers treat like any customer
+// not yet verified.
+func getKYCStatus(w http.ResponseWriter, r *http.Request) {
+	customerID, err := strconv.Atoi(mux.Vars(r)["id"])
+	if err != nil || customerID <= 0 {
+		http.Error(w, "Invalid customer ID", http.StatusBadRequest)
+		return
+	}
+
+	status := KYCStatus{CustomerID: customerID}
+	err = db.QueryRowContext(r.Context(), `SELECT kyc_status FROM customers WHERE user_id = $1`,
+		customerID).Scan(&status.KYCStatus)
+	if err != nil {
+		if err == sql.ErrNoRows {
+			http.Error(w, "Customer profile not found", http.StatusNotFound)
+		} else {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+		}
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(status)
+}
+
+// reviewKYC records a KYC decision. Verifying needs an identity document
+// that has not expired; rejecting needs a reason. Nobody decides their own.
+func reviewKYC(w http.ResponseWriter, r *http.Request) {
+	if !requireRole(w, r, kycRoles...) {
+		return
+	}
+	customerID, ok := requireCustomerAccess(w, r)
+	if !ok {
+		return
+	}
+	if r.Header.Get("X-User-ID") == strconv.Itoa(customerID) {
+		http.Error(w, "You cannot review your own KYC", http.StatusForbidden)
+		return
+	}
+
+	var req struct {
+		Status string `json:"status"`
+		Reason string `json:"reason"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, "Invalid request body", http.StatusBadRequest)
+		return
+	}
+	req.Reason = strings.TrimSpace(req.Reason)
+	switch req.Status {
+	case "verified", "pending":
+	case "rejected":
+		if req.Reason == "" {
+			http.Error(w, "reason is required to reject", http.StatusBadRequest)
+			return
+		}
+	default:
+		http.Error(w, "status must be verified, rejected or pending", http.StatusBadRequest)
+		return
+	}
+
+	var c Customer
+	err := scanCustomer(db.QueryRowContext(r.Context(), `UPDATE customers SET kyc_status = $2, kyc_reason = $3,
+										   kyc_reviewed_by = $4, kyc_reviewed_at = NOW(), updated_at = NOW()
+										   WHERE user_id = $1 AND ($2 <> 'verified' OR EXISTS (
+											   SELECT 1 FROM identity_documents WHERE customer_id = $1
+											   AND (expires_on IS NULL OR expires_on >= CURRENT_DATE)))
+										   RETURNING `+customerColumns,
+		customerID, req.Status, req.Reason, requestActor(r)), &c)
+	if err == sql.ErrNoRows {
+		var exists bool
+		err = db.QueryRowContext(r.Context(), `SELECT EXISTS (SELECT 1 FROM customers WHERE user_id = $1)`,
+			customerID).Scan(&exists)
+		if err == nil && !exists {
+			http.Error(w, "Customer profile not found", http.StatusNotFound)
+			return
+		}
+		if err == nil {
+			http.Error(w, "Verification needs an identity document that has not expired", http.StatusConflict)
+			return
+		}
+	}
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	servicekit.RequestLogger(r.Context()).Info("kyc reviewed", zap.Int("customer_id", c.UserID),
+		zap.String("kyc_status", c.KYCStatus), zap.String("reviewed_by", c.KYCReviewedBy))
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(c)
+}
@@ -0,0 +1,164 @@
+package main
+
+import (
+	"database/sql"
+	"fmt"
+	"net/http"
+	"os"
+	"strconv"
+
+	"bank/servicekit"
+
+	"github.com/gorilla/mux"
+	_ "github.com/lib/pq"
+	"go.uber.org/zap"
+)
+
+// serviceName identifies this service to its peers
+const serviceName = "customer-service"
+
+var db *sql.DB
+
+// peerPermissions are the routes other services may call with their SPIFFE
+// identity or a service token; serviceOnlyRoutes reject callers without one
+var (
+	peerPermissions = map[string][]string{
+		"account-service": {"GET /customers/{id}/kyc-status"},
+		"api-gateway":     {"*"},
+	}
+	serviceOnlyRoutes = map[string]bool{"GET /customers/{id}/kyc-status": true}
+
+	// routePriorities decide what is shed first under overload: the KYC
+	// check account opening waits on last, the review queue first
+	routePriorities = map[string]string{
+		"GET /customers/{id}/kyc-status": "high",
+		"GET /customer-profiles":         "low",
+	}
+)
+
+func main() {
+	servicekit.InitErrorReporting()
+	servicekit.InitSPIFFE()
+	servicekit.InitServiceTokens()
+	servicekit.UseWorkloadIdentity(serviceClient)
+
+	// "customer-service migrate ..." runs the migrate subcommand and exits
+	servicekit.MigrateCommand(connectDB, baselineSchema)
+
+	// Answer probes while the database is migrated
+	port := getEnv("PORT", "8084")
+	if err := startServer(":" + port); err != nil {
+		logger.Fatal("server failed", zap.Error(err))
+	}
+
+	// Initialize database connection
+	initDB()
+	defer db.Close()
+	servicekit.StartServiceTokenNonceExpiry()
+	servicekit.StartSLOTracking()
+
+	// Create router
+	router := mux.NewRouter()
+	router.Use(servicekit.MetricsMiddleware)
+	router.Use(servicekit.LoadSheddingMiddleware(servicekit.LoadRoutePriorities(routePriorities)))
+	router.Use(servicekit.ErrorReportingMiddleware)
+	router.Use(servicekit.ServiceIdentityMiddleware(servicekit.LoadServicePermissions(peerPermissions), serviceOnlyRoutes))
+	router.Use(authMiddleware)
+
+	// Define routes
+	router.HandleFunc("/health", servicekit.HealthCheck).Methods("GET")
+	router.HandleFunc("/startup", servicekit.StartupProbe).Methods("GET")
+	router.HandleFunc("/metrics", servicekit.MetricsHandler).Methods("GET")
+	router.HandleFunc("/slo", servicekit.SLOHandler).Methods("GET")
+	v1 := servicekit.APIVersion{Prefix: "/v1", Register: registerV1Routes}
+	servicekit.MountAPIVersions(router, v1)
+	servicekit.MountLegacyRoutes(router, v1)
+
+	// Start server
+	logger.Info("customer service starting", zap.String("port", port))
+	if err := listenAndServe(":"+port, servicekit.RecoveryMiddleware(router)); err != nil {
+		logger.Fatal("server failed", zap.Error(err))
+	}
+}
+
+// registerV1Routes defines the v1 customer API
+func registerV1Routes(r *mux.Router) {
+	r.HandleFunc("/customers/{id}/profile", createProfile).Methods("POST")
+	r.HandleFunc("/customers/{id}/profile", getProfile).Methods("GET")
+	r.HandleFunc("/customers/{id}/profile", updateProfile).Methods("PUT")
+	r.HandleFunc("/customers/{id}/profile", deleteProfile).Methods("DELETE")
+	r.HandleFunc("/customers/{id}/identity-documents", addIdentityDocument).Methods("POST")
+	r.HandleFunc("/customers/{id}/identity-documents", listIdentityDocuments).Methods("GET")
+	r.HandleFunc("/customers/{id}/identity-documents/{documentId:[0-9]+}", deleteIdentityDocument).Methods("DELETE")
+	r.HandleFunc("/customers/{id}/kyc-status", getKYCStatus).Methods("GET")
+	r.HandleFunc("/customers/{id}/kyc", reviewKYC).Methods("PUT")
+	r.HandleFunc("/customer-profiles", listProfiles).Methods("GET")
+}
+
+func initDB() {
+	connectDB()
+	servicekit.SetStartupPhase(servicekit.PhaseMigrating)
+	if err := servicekit.RunMigrations(serviceContext, baselineSchema()); err != nil {
+		logger.Fatal("failed to migrate database", zap.Error(err))
+	}
+}
+
+func connectDB() {
+	// Get database connection parameters from environment variables
+	host := getEnv("DB_HOST", "localhost")
+	port := getEnv("DB_PORT", "5432")
+	user := getEnv("DB_USER", "postgres")
+	password := getEnv("DB_PASSWORD", "postgres")
+	dbname := getEnv("DB_NAME", "bankdb")
+
+	// Create connection string
+	connStr := fmt.Sprintf("host=%s port=%s user=%s password=%s dbname=%s sslmode=disable",
+		host, port, user, password, dbname)
+
+	// Open database connection
+	var err error
+	db, err = sql.Open("postgres", connStr)
+	if err != nil {
+		logger.Fatal("failed to connect to database", zap.Error(err))
+	}
+
+	// Check connection
+	err = db.PingContext(serviceContext)
+	if err != nil {
+		logger.Fatal("failed to ping database", zap.Error(err))
+	}
+
+	logger.Info("connected to database")
+}
+
+// baselineSchema is the schema the service shares with the others, applied
+// as version 1. It is frozen: change the schema with a new file in
+// migrations/.
+func baselineSchema() []string {
+	return []string{servicekit.ServiceTokenTablesSQL, servicekit.SLOTablesSQL}
+}
+
+// Helper function to get environment variable with default value
+func getEnv(key, defaultValue string) string {
+	value := os.Getenv(key)
+	if value == "" {
+		return defaultValue
+	}
+	return value
+}
+
+// queryInt reads a non-negative integer query parameter
+func queryInt(r *http.Request, key string, defaultValue, max int) (int, error) {
+	value := r.URL.Query().Get(key)
+	if value == "" {
+		return defaultValue, nil
+	}
+	n, err := strconv.Atoi(value)
+	if err != nil || n < 0 {
+		return 0, fmt.Errorf("%s must be a non-negative integer", key)
+	}
+	if max > 0 && n > max {
+		n = max
+	}
+	return n, nil
+}
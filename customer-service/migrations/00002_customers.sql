@@ -0,0 +1,42 @@
+-- Customer profiles, keyed by the auth user ID that accounts also use as
+-- their customer_id, with the KYC decision and the identification documents
+-- it rests on.
+
+-- +goose Up
+CREATE TABLE customers (
+    user_id INTEGER PRIMARY KEY,
+    first_name VARCHAR(100) NOT NULL,
+    middle_name VARCHAR(100) NOT NULL DEFAULT '',
+    last_name VARCHAR(100) NOT NULL,
+    date_of_birth DATE NOT NULL,
+    phone VARCHAR(30) NOT NULL DEFAULT '',
+    address_line1 VARCHAR(200) NOT NULL,
+    address_line2 VARCHAR(200) NOT NULL DEFAULT '',
+    city VARCHAR(100) NOT NULL,
+    region VARCHAR(100) NOT NULL DEFAULT '',
+    postal_code VARCHAR(20) NOT NULL DEFAULT '',
+    country VARCHAR(2) NOT NULL,
+    kyc_status VARCHAR(20) NOT NULL DEFAULT 'pending' CHECK (kyc_status IN ('pending', 'verified', 'rejected')),
+    kyc_reason TEXT NOT NULL DEFAULT '',
+    kyc_reviewed_by VARCHAR(100),
+    kyc_reviewed_at TIMESTAMP,
+    created_at TIMESTAMP NOT NULL DEFAULT NOW(),
+    updated_at TIMESTAMP NOT NULL DEFAULT NOW()
+);
+CREATE INDEX idx_customers_kyc_status ON customers(kyc_status, updated_at);
+
+CREATE TABLE identity_documents (
+    id SERIAL PRIMARY KEY,
+    customer_id INTEGER NOT NULL REFERENCES customers(user_id) ON DELETE CASCADE,
+    document_type VARCHAR(30) NOT NULL,
+    document_number VARCHAR(50) NOT NULL,
+    issuing_country VARCHAR(2) NOT NULL,
+    expires_on DATE,
+    created_by VARCHAR(100) NOT NULL,
+    created_at TIMESTAMP NOT NULL DEFAULT NOW(),
+    UNIQUE (customer_id, document_type, issuing_country, document_number)
+);
+
+-- +goose Down
+DROP TABLE identity_documents;
+DROP TABLE customers;
@@ -0,0 +1,151 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"bank/servicekit"
+
+	"github.com/golang-jwt/jwt/v5"
+	"github.com/gorilla/mux"
+)
+
+// Identity is the authenticated caller of a request
+type Identity struct {
+	UserID   int    `json:"user_id"`
+	Username string `json:"username"`
+	Role     string `json:"role"`
+}
+
+// staffRoles may read and manage the notifications of every customer
+var staffRoles = []string{"admin", "support"}
+
+var ErrInvalidToken = errors.New("Invalid or expired token")
+
+// serviceClient calls auth-service and presents this service's identity
+var serviceClient = &http.Client{Timeout: 5 * time.Second}
+
+// validateToken checks a bearer token was issued for this service's
+// audience. AUTH_VALIDATION_MODE "remote" (the default) asks auth-service;
+// "local" verifies the HS256 signature with the shared JWT_SECRET only.
+func validateToken(ctx context.Context, tokenString string) (Identity, error) {
+	if getEnv("AUTH_VALIDATION_MODE", "remote") == "local" {
+		secret := getEnv("JWT_SECRET", "")
+		if secret == "" {
+			return Identity{}, fmt.Errorf("JWT_SECRET is required for local token validation")
+		}
+		claims, err := servicekit.ParseAccessToken(tokenString, jwt.SigningMethodHS256.Alg(), servicekit.JWTAudience(),
+			func(*jwt.Token) (interface{}, error) { return []byte(secret), nil })
+		if err != nil {
+			return Identity{}, ErrInvalidToken
+		}
+		return Identity{UserID: claims.UserID, Username: claims.Username, Role: claims.Role}, nil
+	}
+
+	payload, _ := json.Marshal(map[string]string{"token": tokenString, "audience": servicekit.JWTAudience()})
+	url := getEnv("AUTH_SERVICE_URL", "http://localhost:8082") + "/v1/auth/validate"
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, url, bytes.NewReader(payload))
+	if err != nil {
+		return Identity{}, err
+	}
+	req.Header.Set("Content-Type", "application/json")
+
+	resp, err := serviceClient.Do(req)
+	if err != nil {
+		return Identity{}, err
+	}
+	defer resp.Body.Close()
+	switch {
+	case resp.StatusCode == http.StatusUnauthorized || resp.StatusCode == http.StatusForbidden:
+		return Identity{}, ErrInvalidToken
+	case resp.StatusCode != http.StatusOK:
+		return Identity{}, fmt.Errorf("auth service returned status %d", resp.StatusCode)
+	}
+
+	var identity Identity
+	err = json.NewDecoder(resp.Body).Decode(&identity)
+	return identity, err
+}
+
+// authMiddleware authenticates every request except probes, metrics,
+// SLO reports and the ingestion routes, which ServiceIdentityMiddleware
+// restricts to peer services, and sets the X-User-ID and X-User-Role headers
+// from the token
+func authMiddleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		// Identity headers are only ever set from a verified token
+		r.Header.Del("X-User-ID")
+		r.Header.Del("X-User-Role")
+
+		template := ""
+		if route := mux.CurrentRoute(r); route != nil {
+			template, _ = route.GetPathTemplate()
+		}
+		for _, prefix := range []string{"/v1", "/v2"} {
+			template = strings.TrimPrefix(template, prefix)
+		}
+		if template == "/health" || template == "/startup" || template == "/metrics" || template == "/slo" || serviceOnlyRoutes[r.Method+" "+template] {
+			next.ServeHTTP(w, r)
+			return
+		}
+
+		token := strings.TrimPrefix(r.Header.Get("Authorization"), "Bearer ")
+		if token == "" || token == r.Header.Get("Authorization") {
+			http.Error(w, "Authentication required", http.StatusUnauthorized)
+			return
+		}
+		identity, err := validateToken(r.Context(), strings.TrimSpace(token))
+		if errors.Is(err, ErrInvalidToken) {
+			http.Error(w, ErrInvalidToken.Error(), http.StatusUnauthorized)
+			return
+		}
+		if err != nil {
+			http.Error(w, "Token validation unavailable", http.StatusBadGateway)
+			return
+		}
+		r.Header.Set("X-User-ID", strconv.Itoa(identity.UserID))
+		r.Header.Set("X-User-Role", identity.Role)
+		next.ServeHTTP(w, r)
+	})
+}
+
+// hasRole reports whether the caller has one of roles
+func hasRole(r *http.Request, roles ...string) bool {
+	for _, role := range roles {
+		if r.Header.Get("X-User-Role") == role {
+			return true
+		}
+	}
+	return false
+}
+
+// requireRole writes a 403 and returns false unless the caller has one of roles
+func requireRole(w http.ResponseWriter, r *http.Request, roles ...string) bool {
+	if hasRole(r, roles...) {
+		return true
+	}
+	http.Error(w, "Insufficient permissions", http.StatusForbidden)
+	return false
+}
+
+// requireCustomerAccess returns the customer of a /customers/{id} route when
+// the caller is that customer or staff; other customers get a 404
+func requireCustomerAccess(w http.ResponseWriter, r *http.Request) (int, bool) {
+	customerID, err := strconv.Atoi(mux.Vars(r)["id"])
+	if err != nil || customerID <= 0 {
+		http.Error(w, "Invalid customer ID", http.StatusBadRequest)
+		return 0, false
+	}
+	if hasRole(r, staffRoles...) || r.Header.Get("X-User-ID") == strconv.Itoa(customerID) {
+		return customerID, true
+	}
+	http.Error(w, "Customer not found", http.StatusNotFound)
+	return 0, false
+}
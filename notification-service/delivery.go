@@ -0,0 +1,446 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"database/sql"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"net/smtp"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+
+	"bank/servicekit"
+
+	"go.uber.org/zap"
+)
+
+// Message is a rendered notification ready for a channel's provider
+type Message struct {
+	NotificationID int
+	Channel        string
+	Recipient      string
+	Subject        string
+	Body           string
+	EventType      string
+	Template       string
+	Data           map[string]interface{}
+	Secret         string // webhook signing secret
+}
+
+// Sender delivers messages on one channel and returns the provider's
+// message ID when it assigns one
+type Sender interface {
+	Send(ctx context.Context, m Message) (providerID string, err error)
+}
+
+// senders maps each channel to its provider
+var senders = map[string]Sender{}
+
+// providerClient calls email, SMS and push providers and customer webhooks.
+// It deliberately does not present the workload identity.
+var providerClient = &http.Client{Timeout: 10 * time.Second}
+
+// initSenders selects each channel's provider from EMAIL_PROVIDER (log or
+// smtp), SMS_PROVIDER (log or twilio) and PUSH_PROVIDER (log or http).
+// Webhooks are always posted directly.
+func initSenders() {
+	switch name := getEnv("EMAIL_PROVIDER", "log"); name {
+	case "log":
+		senders["email"] = logSender{}
+	case "smtp":
+		senders["email"] = smtpSender{
+			addr:     net.JoinHostPort(getEnv("SMTP_HOST", "localhost"), getEnv("SMTP_PORT", "587")),
+			username: getEnv("SMTP_USERNAME", ""),
+			password: getEnv("SMTP_PASSWORD", ""),
+			from:     getEnv("MAIL_FROM", "no-reply@bank.local"),
+		}
+	default:
+		logger.Fatal("unknown EMAIL_PROVIDER", zap.String("provider", name))
+	}
+
+	switch name := getEnv("SMS_PROVIDER", "log"); name {
+	case "log":
+		senders["sms"] = logSender{}
+	case "twilio":
+		s := twilioSender{
+			accountSID: getEnv("TWILIO_ACCOUNT_SID", ""),
+			authToken:  getEnv("TWILIO_AUTH_TOKEN", ""),
+			from:       getEnv("TWILIO_FROM_NUMBER", ""),
+		}
+		if s.accountSID == "" || s.authToken == "" || s.from == "" {
+			logger.Fatal("TWILIO_ACCOUNT_SID, TWILIO_AUTH_TOKEN and TWILIO_FROM_NUMBER are required for the twilio SMS provider")
+		}
+		senders["sms"] = s
+	default:
+		logger.Fatal("unknown SMS_PROVIDER", zap.String("provider", name))
+	}
+
+	switch name := getEnv("PUSH_PROVIDER", "log"); name {
+	case "log":
+		senders["push"] = logSender{}
+	case "http":
+		endpoint := getEnv("PUSH_PROVIDER_URL", "")
+		if endpoint == "" {
+			logger.Fatal("PUSH_PROVIDER_URL is required for the http push provider")
+		}
+		senders["push"] = httpPushSender{endpoint: endpoint, token: getEnv("PUSH_PROVIDER_TOKEN", "")}
+	default:
+		logger.Fatal("unknown PUSH_PROVIDER", zap.String("provider", name))
+	}
+
+	senders["webhook"] = webhookSender{}
+}
+
+// deliveryBatchSize is how many notifications the worker claims at a time
+const deliveryBatchSize = 20
+
+// deliveryLease is how long a claimed notification is hidden from other
+// workers; one whose worker died becomes due again afterwards
+const deliveryLease = 2 * time.Minute
+
+// maxDeliveryAttempts is how often a notification is tried before it is
+// marked failed, NOTIFICATION_MAX_ATTEMPTS
+func maxDeliveryAttempts() int {
+	max, err := strconv.Atoi(getEnv("NOTIFICATION_MAX_ATTEMPTS", "5"))
+	if err != nil || max <= 0 {
+		return 5
+	}
+	return max
+}
+
+// retryDelay backs off exponentially from 30 seconds, capped at an hour
+func retryDelay(attempts int) time.Duration {
+	delay := 30 * time.Second
+	for i := 1; i < attempts && delay < time.Hour; i++ {
+		delay *= 2
+	}
+	if delay > time.Hour {
+		delay = time.Hour
+	}
+	return delay
+}
+
+var notificationsDelivered = servicekit.NewCounterVec("notifications_delivered_total",
+	"Delivery attempts by channel and outcome (sent, suppressed, failed or retry).", "channel", "outcome")
+
+// startDeliveryWorker delivers queued notifications. Rows are claimed with
+// SKIP LOCKED, so several replicas can run the worker side by side.
+func startDeliveryWorker() {
+	go func() {
+		defer servicekit.ReportJobPanic("Notification delivery")
+		for {
+			delivered, err := deliverDue(serviceContext)
+			if err != nil {
+				servicekit.ReportJobError("Notification delivery", err)
+			}
+			if delivered < deliveryBatchSize {
+				time.Sleep(2 * time.Second)
+			}
+		}
+	}()
+}
+
+// deliverDue claims and delivers one batch of due notifications
+func deliverDue(ctx context.Context) (int, error) {
+	rows, err := db.QueryContext(ctx, `UPDATE notifications SET attempts = attempts + 1,
+										   next_attempt_at = NOW() + $2 * INTERVAL '1 second', updated_at = NOW()
+									   WHERE id IN (SELECT id FROM notifications WHERE status = 'queued' AND next_attempt_at <= NOW()
+													ORDER BY next_attempt_at LIMIT $1 FOR UPDATE SKIP LOCKED)
+									   RETURNING `+notificationColumns, deliveryBatchSize, int(deliveryLease/time.Second))
+	if err != nil {
+		return 0, err
+	}
+	var claimed []Notification
+	for rows.Next() {
+		n, err := scanNotification(rows)
+		if err != nil {
+			rows.Close()
+			return 0, err
+		}
+		claimed = append(claimed, n)
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return 0, err
+	}
+
+	for _, n := range claimed {
+		providerID, err := deliver(ctx, n)
+		var suppressed *suppressedError
+		switch {
+		case err == nil:
+			notificationsDelivered.Inc(n.Channel, "sent")
+			_, err = db.ExecContext(ctx, `UPDATE notifications SET status = 'sent', provider_id = $2, last_error = '',
+											 sent_at = NOW(), updated_at = NOW() WHERE id = $1`, n.ID, providerID)
+		case errors.As(err, &suppressed):
+			notificationsDelivered.Inc(n.Channel, "suppressed")
+			_, err = db.ExecContext(ctx, `UPDATE notifications SET status = 'suppressed', last_error = $2, updated_at = NOW()
+										  WHERE id = $1`, n.ID, suppressed.reason)
+		case n.Attempts >= maxDeliveryAttempts():
+			notificationsDelivered.Inc(n.Channel, "failed")
+			servicekit.RequestLogger(ctx).Error("notification failed", zap.Int("notification_id", n.ID), zap.Int("attempts", n.Attempts), zap.Error(err))
+			_, err = db.ExecContext(ctx, `UPDATE notifications SET status = 'failed', last_error = $2, updated_at = NOW()
+										  WHERE id = $1`, n.ID, err.Error())
+		default:
+			notificationsDelivered.Inc(n.Channel, "retry")
+			_, err = db.ExecContext(ctx, `UPDATE notifications SET last_error = $2,
+											 next_attempt_at = NOW() + $3 * INTERVAL '1 second', updated_at = NOW()
+										  WHERE id = $1`, n.ID, err.Error(), int(retryDelay(n.Attempts)/time.Second))
+		}
+		if err != nil {
+			return 0, err
+		}
+	}
+	return len(claimed), nil
+}
+
+// suppressedError stops a notification without retrying it
+type suppressedError struct {
+	reason string
+}
+
+func (e *suppressedError) Error() string { return e.reason }
+
+// deliver renders a notification and hands it to its channel's sender.
+// Marketing messages are only sent once auth-service confirms the customer's
+// consent for the channel.
+func deliver(ctx context.Context, n Notification) (string, error) {
+	sender, ok := senders[n.Channel]
+	if !ok {
+		return "", &suppressedError{reason: "no provider for channel " + n.Channel}
+	}
+	if n.Category == "marketing" {
+		allowed, reason, err := marketingAllowed(ctx, n)
+		if err != nil {
+			return "", err
+		}
+		if !allowed {
+			return "", &suppressedError{reason: "marketing not allowed: " + reason}
+		}
+	}
+
+	m := Message{NotificationID: n.ID, Channel: n.Channel, Recipient: n.Recipient, EventType: n.EventType,
+		Template: n.Template, Data: n.Data}
+	if n.Channel == "webhook" {
+		// Deliver to the endpoint registered now, with its current secret
+		address, secret, err := channelAddress(ctx, n.CustomerID, n.Channel)
+		if err == sql.ErrNoRows {
+			return "", &suppressedError{reason: "webhook endpoint removed"}
+		}
+		if err != nil {
+			return "", err
+		}
+		m.Recipient, m.Secret = address, secret
+	}
+	subject, body, err := renderNotification(ctx, n.Template, n.Channel, n.Data)
+	if err != nil {
+		return "", &suppressedError{reason: "template error: " + err.Error()}
+	}
+	m.Subject, m.Body = subject, body
+	return sender.Send(ctx, m)
+}
+
+// marketingAllowed asks auth-service whether the customer consented to
+// marketing on the notification's channel
+func marketingAllowed(ctx context.Context, n Notification) (bool, string, error) {
+	query := url.Values{"channel": {n.Channel}, "recipient": {n.Recipient}}
+	if n.CustomerID > 0 {
+		query.Set("user_id", strconv.Itoa(n.CustomerID))
+	}
+	endpoint := getEnv("AUTH_SERVICE_URL", "http://localhost:8082") + "/v1/marketing/eligibility?" + query.Encode()
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, endpoint, nil)
+	if err != nil {
+		return false, "", err
+	}
+	resp, err := serviceClient.Do(req)
+	if err != nil {
+		return false, "", err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return false, "", fmt.Errorf("marketing eligibility check returned status %d", resp.StatusCode)
+	}
+
+	var eligibility struct {
+		Allowed bool   `json:"allowed"`
+		Reason  string `json:"reason"`
+	}
+	err = json.NewDecoder(resp.Body).Decode(&eligibility)
+	return eligibility.Allowed, eligibility.Reason, err
+}
+
+// logSender writes messages to the service log, for development
+type logSender struct{}
+
+func (logSender) Send(_ context.Context, m Message) (string, error) {
+	logger.Info("notification", zap.Int("notification_id", m.NotificationID), zap.String("channel", m.Channel),
+		zap.String("recipient", m.Recipient), zap.String("subject", m.Subject), zap.String("body", m.Body))
+	return "", nil
+}
+
+// smtpSender sends plain-text email through an SMTP relay, with STARTTLS when
+// the server offers it and PLAIN auth when SMTP_USERNAME is set
+type smtpSender struct {
+	addr     string
+	username string
+	password string
+	from     string
+}
+
+func (s smtpSender) Send(ctx context.Context, m Message) (string, error) {
+	if strings.ContainsAny(m.Recipient, "\r\n") || strings.ContainsAny(m.Subject, "\r\n") {
+		return "", &suppressedError{reason: "invalid email header"}
+	}
+	var auth smtp.Auth
+	if s.username != "" {
+		host, _, _ := net.SplitHostPort(s.addr)
+		auth = smtp.PlainAuth("", s.username, s.password, host)
+	}
+	host, _, _ := net.SplitHostPort(s.addr)
+	messageID := fmt.Sprintf("<notification-%d.%d@%s>", m.NotificationID, time.Now().UnixNano(), host)
+	message := strings.Join([]string{
+		"From: " + s.from,
+		"To: " + m.Recipient,
+		"Subject: " + m.Subject,
+		"Date: " + time.Now().Format(time.RFC1123Z),
+		"Message-ID: " + messageID,
+		"MIME-Version: 1.0",
+		"Content-Type: text/plain; charset=UTF-8",
+		"",
+		m.Body,
+	}, "\r\n")
+
+	// net/smtp has no context support; bound the send by the context instead
+	done := make(chan error, 1)
+	go func() { done <- smtp.SendMail(s.addr, auth, s.from, []string{m.Recipient}, []byte(message)) }()
+	select {
+	case err := <-done:
+		return messageID, err
+	case <-ctx.Done():
+		return "", ctx.Err()
+	}
+}
+
+// twilioSender sends SMS through the Twilio Messages API
+type twilioSender struct {
+	accountSID string
+	authToken  string
+	from       string
+}
+
+func (s twilioSender) Send(ctx context.Context, m Message) (string, error) {
+	form := url.Values{"To": {m.Recipient}, "From": {s.from}, "Body": {m.Body}}
+	endpoint := "https://api.twilio.com/2010-04-01/Accounts/" + url.PathEscape(s.accountSID) + "/Messages.json"
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, endpoint, strings.NewReader(form.Encode()))
+	if err != nil {
+		return "", err
+	}
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	req.SetBasicAuth(s.accountSID, s.authToken)
+
+	resp, err := providerClient.Do(req)
+	if err != nil {
+		return "", err
+	}
+	defer resp.Body.Close()
+	var result struct {
+		SID     string `json:"sid"`
+		Message string `json:"message"`
+	}
+	json.NewDecoder(resp.Body).Decode(&result)
+	if resp.StatusCode >= 300 {
+		return "", fmt.Errorf("twilio returned status %d: %s", resp.StatusCode, result.Message)
+	}
+	return result.SID, nil
+}
+
+// httpPushSender posts push messages as JSON to a push gateway
+type httpPushSender struct {
+	endpoint string
+	token    string
+}
+
+func (s httpPushSender) Send(ctx context.Context, m Message) (string, error) {
+	payload, err := json.Marshal(map[string]interface{}{
+		"device_token": m.Recipient,
+		"title":        m.Subject,
+		"body":         m.Body,
+		"data":         m.Data,
+	})
+	if err != nil {
+		return "", err
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, s.endpoint, bytes.NewReader(payload))
+	if err != nil {
+		return "", err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	if s.token != "" {
+		req.Header.Set("Authorization", "Bearer "+s.token)
+	}
+
+	resp, err := providerClient.Do(req)
+	if err != nil {
+		return "", err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode >= 300 {
+		return "", fmt.Errorf("push provider returned status %d", resp.StatusCode)
+	}
+	var result struct {
+		ID string `json:"id"`
+	}
+	json.NewDecoder(resp.Body).Decode(&result)
+	return result.ID, nil
+}
+
+// webhookSender posts the notification to the customer's endpoint. The
+// X-Notification-Signature header is "t=<unix time>,v1=<hex HMAC-SHA256 of
+// "<unix time>.<body>">" under the secret returned when the endpoint was
+// registered.
+type webhookSender struct{}
+
+func (webhookSender) Send(ctx context.Context, m Message) (string, error) {
+	payload, err := json.Marshal(map[string]interface{}{
+		"id":         m.NotificationID,
+		"event_type": m.EventType,
+		"template":   m.Template,
+		"subject":    m.Subject,
+		"body":       m.Body,
+		"data":       m.Data,
+	})
+	if err != nil {
+		return "", err
+	}
+	timestamp := strconv.FormatInt(time.Now().Unix(), 10)
+	mac := hmac.New(sha256.New, []byte(m.Secret))
+	mac.Write([]byte(timestamp + "."))
+	mac.Write(payload)
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, m.Recipient, bytes.NewReader(payload))
+	if err != nil {
+		return "", err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("X-Notification-ID", strconv.Itoa(m.NotificationID))
+	req.Header.Set("X-Notification-Signature", "t="+timestamp+",v1="+hex.EncodeToString(mac.Sum(nil)))
+
+	resp, err := providerClient.Do(req)
+	if err != nil {
+		return "", err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode >= 300 {
+		return "", fmt.Errorf("webhook endpoint returned status %d", resp.StatusCode)
+	}
+	return "", nil
+}
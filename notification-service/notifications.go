@@ -0,0 +1,355 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gorilla/mux"
+)
+
+// Notification is one message to one recipient on one channel, with its
+// delivery status: queued, sent, failed (attempts exhausted) or suppressed
+// (not sent, for example for lack of an address or marketing consent)
+type Notification struct {
+	ID         int                    `json:"id"`
+	CustomerID int                    `json:"customer_id,omitempty"`
+	EventID    string                 `json:"event_id,omitempty"`
+	EventType  string                 `json:"event_type,omitempty"`
+	Channel    string                 `json:"channel"`
+	Recipient  string                 `json:"recipient,omitempty"`
+	Category   string                 `json:"category,omitempty"` // operational (default) or marketing
+	Template   string                 `json:"template"`
+	Data       map[string]interface{} `json:"data"`
+	Status     string                 `json:"status"`
+	Attempts   int                    `json:"attempts"`
+	LastError  string                 `json:"last_error,omitempty"`
+	ProviderID string                 `json:"provider_id,omitempty"` // message ID assigned by the email or SMS provider
+	SentAt     *time.Time             `json:"sent_at,omitempty"`
+	CreatedAt  time.Time              `json:"created_at"`
+	UpdatedAt  time.Time              `json:"updated_at"`
+}
+
+// Event is something that happened to a customer, published by another
+// service. It becomes a notification on each channel the customer has
+// enabled for its type.
+type Event struct {
+	ID         string                 `json:"id,omitempty"` // producer's ID; an event is notified once
+	Type       string                 `json:"type"`
+	CustomerID int                    `json:"customer_id"`
+	Data       map[string]interface{} `json:"data"`
+	// Recipients are addresses the producer knows, such as the login email,
+	// used on channels where the customer has not registered one
+	Recipients map[string]string `json:"recipients,omitempty"`
+}
+
+const notificationTablesSQL = `
+	CREATE TABLE IF NOT EXISTS notifications (
+		id SERIAL PRIMARY KEY,
+		customer_id INTEGER,
+		event_id VARCHAR(100) NOT NULL DEFAULT '',
+		event_type VARCHAR(50) NOT NULL DEFAULT '',
+		channel VARCHAR(20) NOT NULL,
+		recipient VARCHAR(500) NOT NULL DEFAULT '',
+		category VARCHAR(20) NOT NULL DEFAULT 'operational',
+		template VARCHAR(100) NOT NULL,
+		data JSONB NOT NULL DEFAULT '{}',
+		status VARCHAR(20) NOT NULL DEFAULT 'queued',
+		attempts INTEGER NOT NULL DEFAULT 0,
+		last_error TEXT NOT NULL DEFAULT '',
+		provider_id VARCHAR(200) NOT NULL DEFAULT '',
+		next_attempt_at TIMESTAMP NOT NULL DEFAULT NOW(),
+		sent_at TIMESTAMP,
+		created_at TIMESTAMP NOT NULL DEFAULT NOW(),
+		updated_at TIMESTAMP NOT NULL DEFAULT NOW()
+	);
+	CREATE UNIQUE INDEX IF NOT EXISTS idx_notifications_event ON notifications(event_id, channel) WHERE event_id <> '';
+	CREATE INDEX IF NOT EXISTS idx_notifications_queue ON notifications(next_attempt_at) WHERE status = 'queued';
+	CREATE INDEX IF NOT EXISTS idx_notifications_customer ON notifications(customer_id, created_at);`
+
+const notificationColumns = `id, COALESCE(customer_id, 0), event_id, event_type, channel, recipient, category, template,
+	data, status, attempts, last_error, provider_id, sent_at, created_at, updated_at`
+
+func scanNotification(row interface{ Scan(...interface{}) error }) (Notification, error) {
+	var n Notification
+	var data []byte
+	var sentAt sql.NullTime
+	err := row.Scan(&n.ID, &n.CustomerID, &n.EventID, &n.EventType, &n.Channel, &n.Recipient, &n.Category, &n.Template,
+		&data, &n.Status, &n.Attempts, &n.LastError, &n.ProviderID, &sentAt, &n.CreatedAt, &n.UpdatedAt)
+	if err != nil {
+		return n, err
+	}
+	if sentAt.Valid {
+		n.SentAt = &sentAt.Time
+	}
+	err = json.Unmarshal(data, &n.Data)
+	return n, err
+}
+
+// enqueueNotification stores a notification for the delivery worker. A
+// missing recipient is looked up in the customer's registered channels; when
+// there is none the notification is kept as suppressed so the gap shows in
+// the delivery status. A repeated event ID returns the existing notification.
+func enqueueNotification(ctx context.Context, n Notification) (Notification, error) {
+	if n.Category == "" {
+		n.Category = "operational"
+	}
+	if n.Data == nil {
+		n.Data = map[string]interface{}{}
+	}
+	n.Status = "queued"
+	// Webhooks only go to endpoints the customer registered, never to a URL
+	// chosen by the producer
+	var secret string
+	if n.Channel == "webhook" || n.Recipient == "" {
+		address, s, err := channelAddress(ctx, n.CustomerID, n.Channel)
+		if err != nil && err != sql.ErrNoRows {
+			return n, err
+		}
+		n.Recipient, secret = address, s
+	}
+	if n.Recipient == "" || (n.Channel == "webhook" && secret == "") {
+		n.Status, n.LastError = "suppressed", "no "+n.Channel+" address registered"
+	}
+
+	data, err := json.Marshal(n.Data)
+	if err != nil {
+		return n, err
+	}
+	var customerID interface{}
+	if n.CustomerID > 0 {
+		customerID = n.CustomerID
+	}
+	row := db.QueryRowContext(ctx, `INSERT INTO notifications (customer_id, event_id, event_type, channel, recipient,
+										category, template, data, status, last_error)
+									VALUES ($1, $2, $3, $4, $5, $6, $7, $8, $9, $10)
+									ON CONFLICT (event_id, channel) WHERE event_id <> '' DO NOTHING
+									RETURNING `+notificationColumns,
+		customerID, n.EventID, n.EventType, n.Channel, n.Recipient, n.Category, n.Template, data, n.Status, n.LastError)
+	stored, err := scanNotification(row)
+	if err == sql.ErrNoRows {
+		return scanNotification(db.QueryRowContext(ctx, `SELECT `+notificationColumns+` FROM notifications
+														 WHERE event_id = $1 AND channel = $2`, n.EventID, n.Channel))
+	}
+	return stored, err
+}
+
+// createNotification queues a notification on an explicit channel (peer
+// services only)
+func createNotification(w http.ResponseWriter, r *http.Request) {
+	var n Notification
+	if err := json.NewDecoder(r.Body).Decode(&n); err != nil {
+		http.Error(w, "Invalid request body", http.StatusBadRequest)
+		return
+	}
+	if !validChannel(n.Channel) {
+		http.Error(w, "Unknown channel", http.StatusBadRequest)
+		return
+	}
+	if strings.TrimSpace(n.Template) == "" {
+		http.Error(w, "Template is required", http.StatusBadRequest)
+		return
+	}
+	if n.Category != "" && n.Category != "operational" && n.Category != "marketing" {
+		http.Error(w, "Category must be operational or marketing", http.StatusBadRequest)
+		return
+	}
+	if n.Recipient == "" && n.CustomerID <= 0 {
+		http.Error(w, "Recipient or customer ID is required", http.StatusBadRequest)
+		return
+	}
+	n.EventID, n.EventType = "", ""
+
+	stored, err := enqueueNotification(r.Context(), n)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusAccepted)
+	json.NewEncoder(w).Encode(stored)
+}
+
+// ingestEvent turns an event into a notification on every channel the
+// customer has enabled for it (peer services only). The event type is the
+// template name.
+func ingestEvent(w http.ResponseWriter, r *http.Request) {
+	var event Event
+	if err := json.NewDecoder(r.Body).Decode(&event); err != nil {
+		http.Error(w, "Invalid request body", http.StatusBadRequest)
+		return
+	}
+	if _, known := eventTypes[event.Type]; !known {
+		http.Error(w, "Unknown event type", http.StatusBadRequest)
+		return
+	}
+	if event.CustomerID <= 0 {
+		http.Error(w, "Customer ID is required", http.StatusBadRequest)
+		return
+	}
+	if len(event.ID) > 100 {
+		http.Error(w, "Event ID is too long", http.StatusBadRequest)
+		return
+	}
+
+	enabled, err := enabledChannels(r.Context(), event.CustomerID, event.Type)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	notifications := []Notification{}
+	for _, channel := range enabled {
+		n, err := enqueueNotification(r.Context(), Notification{
+			CustomerID: event.CustomerID,
+			EventID:    event.ID,
+			EventType:  event.Type,
+			Channel:    channel,
+			Template:   event.Type,
+			Data:       event.Data,
+		})
+		if err == nil && n.Status == "suppressed" && event.Recipients[channel] != "" && validAddress(channel, event.Recipients[channel]) {
+			n, err = useFallbackRecipient(r.Context(), n, event.Recipients[channel])
+		}
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		notifications = append(notifications, n)
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusAccepted)
+	json.NewEncoder(w).Encode(notifications)
+}
+
+// useFallbackRecipient queues a notification suppressed for lack of a
+// registered address to the address the producer supplied
+func useFallbackRecipient(ctx context.Context, n Notification, recipient string) (Notification, error) {
+	if n.Channel == "webhook" {
+		return n, nil
+	}
+	return scanNotification(db.QueryRowContext(ctx, `UPDATE notifications SET recipient = $2, status = 'queued',
+														 last_error = '', updated_at = NOW()
+													 WHERE id = $1 AND status = 'suppressed' AND attempts = 0
+													 RETURNING `+notificationColumns, n.ID, recipient))
+}
+
+// canReadNotification reports whether the caller is staff or the customer
+// the notification belongs to
+func canReadNotification(r *http.Request, n Notification) bool {
+	return hasRole(r, staffRoles...) || (n.CustomerID > 0 && r.Header.Get("X-User-ID") == strconv.Itoa(n.CustomerID))
+}
+
+// getNotification returns a notification and its delivery status
+func getNotification(w http.ResponseWriter, r *http.Request) {
+	n, err := scanNotification(db.QueryRowContext(r.Context(), `SELECT `+notificationColumns+` FROM notifications WHERE id = $1`,
+		mux.Vars(r)["id"]))
+	if err == sql.ErrNoRows || (err == nil && !canReadNotification(r, n)) {
+		http.Error(w, "Notification not found", http.StatusNotFound)
+		return
+	}
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(n)
+}
+
+// listCustomerNotifications lists a customer's notifications, newest first,
+// optionally filtered by ?status= and ?event_type=
+func listCustomerNotifications(w http.ResponseWriter, r *http.Request) {
+	customerID, ok := requireCustomerAccess(w, r)
+	if !ok {
+		return
+	}
+	limit, err := queryInt(r, "limit", 50, 200)
+	if err != nil {
+		http.Error(w, "limit must be a non-negative integer", http.StatusBadRequest)
+		return
+	}
+	offset, err := queryInt(r, "offset", 0, 0)
+	if err != nil {
+		http.Error(w, "offset must be a non-negative integer", http.StatusBadRequest)
+		return
+	}
+
+	rows, err := db.QueryContext(r.Context(), `SELECT `+notificationColumns+` FROM notifications
+											   WHERE customer_id = $1 AND ($2 = '' OR status = $2) AND ($3 = '' OR event_type = $3)
+											   ORDER BY created_at DESC, id DESC LIMIT $4 OFFSET $5`,
+		customerID, r.URL.Query().Get("status"), r.URL.Query().Get("event_type"), limit, offset)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	defer rows.Close()
+
+	notifications := []Notification{}
+	for rows.Next() {
+		n, err := scanNotification(rows)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		notifications = append(notifications, n)
+	}
+	if err := rows.Err(); err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(notifications)
+}
+
+// retryNotification queues a failed or suppressed notification again (staff
+// only), for example after the customer registered an address
+func retryNotification(w http.ResponseWriter, r *http.Request) {
+	if !requireRole(w, r, staffRoles...) {
+		return
+	}
+
+	n, err := scanNotification(db.QueryRowContext(r.Context(), `SELECT `+notificationColumns+` FROM notifications WHERE id = $1`,
+		mux.Vars(r)["id"]))
+	if err != nil {
+		if err == sql.ErrNoRows {
+			http.Error(w, "Notification not found", http.StatusNotFound)
+		} else {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+		}
+		return
+	}
+	if n.Status != "failed" && n.Status != "suppressed" {
+		http.Error(w, "Only failed or suppressed notifications can be retried", http.StatusConflict)
+		return
+	}
+	if n.CustomerID > 0 && (n.Recipient == "" || n.Channel == "webhook") {
+		address, _, err := channelAddress(r.Context(), n.CustomerID, n.Channel)
+		if err != nil && err != sql.ErrNoRows {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		n.Recipient = address
+	}
+	if n.Recipient == "" {
+		http.Error(w, "No "+n.Channel+" address registered", http.StatusConflict)
+		return
+	}
+
+	n, err = scanNotification(db.QueryRowContext(r.Context(), `UPDATE notifications SET status = 'queued', recipient = $2,
+																   attempts = 0, last_error = '', next_attempt_at = NOW(), updated_at = NOW()
+															   WHERE id = $1 RETURNING `+notificationColumns, n.ID, n.Recipient))
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(n)
+}
@@ -0,0 +1,339 @@
+package main
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"net/http"
+	"net/url"
+	"regexp"
+	"sort"
+	"strings"
+
+	"github.com/gorilla/mux"
+)
+
+// Preference turns one event type on or off on one channel for a customer
+type Preference struct {
+	EventType string `json:"event_type"`
+	Channel   string `json:"channel"`
+	Enabled   bool   `json:"enabled"`
+	Required  bool   `json:"required,omitempty"` // cannot be turned off
+}
+
+// ChannelAddress is where a customer receives a channel's notifications
+type ChannelAddress struct {
+	Channel   string `json:"channel"`
+	Address   string `json:"address"`
+	Secret    string `json:"secret,omitempty"` // webhook signing secret, only returned when set
+	UpdatedAt string `json:"updated_at"`
+}
+
+const preferenceTablesSQL = `
+	CREATE TABLE IF NOT EXISTS notification_preferences (
+		customer_id INTEGER NOT NULL,
+		event_type VARCHAR(50) NOT NULL,
+		channel VARCHAR(20) NOT NULL,
+		enabled BOOLEAN NOT NULL,
+		updated_at TIMESTAMP NOT NULL DEFAULT NOW(),
+		PRIMARY KEY (customer_id, event_type, channel)
+	);
+	CREATE TABLE IF NOT EXISTS notification_channels (
+		customer_id INTEGER NOT NULL,
+		channel VARCHAR(20) NOT NULL,
+		address VARCHAR(500) NOT NULL,
+		secret VARCHAR(64) NOT NULL DEFAULT '',
+		updated_at TIMESTAMP NOT NULL DEFAULT NOW(),
+		PRIMARY KEY (customer_id, channel)
+	);`
+
+// channels are the delivery channels in the order preferences are listed
+var channels = []string{"email", "sms", "push", "webhook"}
+
+func validChannel(channel string) bool {
+	for _, c := range channels {
+		if c == channel {
+			return true
+		}
+	}
+	return false
+}
+
+// eventType describes an event producers may publish: the channels it goes
+// to until the customer says otherwise, and a channel security events always
+// use so a customer cannot silence warnings about their own account
+type eventType struct {
+	Defaults []string
+	Required string
+}
+
+var eventTypes = map[string]eventType{
+	"deposit":          {Defaults: []string{"email"}},
+	"withdrawal":       {Defaults: []string{"email", "sms"}},
+	"login_new_device": {Defaults: []string{"email", "sms"}, Required: "email"},
+	"password_changed": {Defaults: []string{"email"}, Required: "email"},
+	"mfa_changed":      {Defaults: []string{"email"}, Required: "email"},
+}
+
+// customerPreferences returns the customer's setting for every event type
+// and channel, stored choices overriding the defaults
+func customerPreferences(ctx context.Context, customerID int) ([]Preference, error) {
+	stored := map[string]bool{}
+	rows, err := db.QueryContext(ctx, `SELECT event_type, channel, enabled FROM notification_preferences
+									   WHERE customer_id = $1`, customerID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var event, channel string
+		var enabled bool
+		if err := rows.Scan(&event, &channel, &enabled); err != nil {
+			return nil, err
+		}
+		stored[event+"/"+channel] = enabled
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+
+	names := make([]string, 0, len(eventTypes))
+	for name := range eventTypes {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	preferences := []Preference{}
+	for _, name := range names {
+		event := eventTypes[name]
+		for _, channel := range channels {
+			p := Preference{EventType: name, Channel: channel, Required: event.Required == channel}
+			if enabled, ok := stored[name+"/"+channel]; ok {
+				p.Enabled = enabled
+			} else {
+				for _, c := range event.Defaults {
+					p.Enabled = p.Enabled || c == channel
+				}
+			}
+			p.Enabled = p.Enabled || p.Required
+			preferences = append(preferences, p)
+		}
+	}
+	return preferences, nil
+}
+
+// enabledChannels returns the channels an event of the given type goes to
+func enabledChannels(ctx context.Context, customerID int, event string) ([]string, error) {
+	preferences, err := customerPreferences(ctx, customerID)
+	if err != nil {
+		return nil, err
+	}
+	var enabled []string
+	for _, p := range preferences {
+		if p.EventType == event && p.Enabled {
+			enabled = append(enabled, p.Channel)
+		}
+	}
+	return enabled, nil
+}
+
+// channelAddress returns the customer's address and webhook secret for a
+// channel, or sql.ErrNoRows when none is registered
+func channelAddress(ctx context.Context, customerID int, channel string) (address, secret string, err error) {
+	err = db.QueryRowContext(ctx, `SELECT address, secret FROM notification_channels WHERE customer_id = $1 AND channel = $2`,
+		customerID, channel).Scan(&address, &secret)
+	return address, secret, err
+}
+
+// getPreferences lists a customer's notification preferences
+func getPreferences(w http.ResponseWriter, r *http.Request) {
+	customerID, ok := requireCustomerAccess(w, r)
+	if !ok {
+		return
+	}
+
+	preferences, err := customerPreferences(r.Context(), customerID)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(preferences)
+}
+
+// updatePreferences stores the given preferences. Settings not in the
+// request keep their current value.
+func updatePreferences(w http.ResponseWriter, r *http.Request) {
+	customerID, ok := requireCustomerAccess(w, r)
+	if !ok {
+		return
+	}
+
+	var preferences []Preference
+	if err := json.NewDecoder(r.Body).Decode(&preferences); err != nil {
+		http.Error(w, "Invalid request body", http.StatusBadRequest)
+		return
+	}
+	for _, p := range preferences {
+		event, known := eventTypes[p.EventType]
+		if !known {
+			http.Error(w, "Unknown event type "+p.EventType, http.StatusBadRequest)
+			return
+		}
+		if !validChannel(p.Channel) {
+			http.Error(w, "Unknown channel "+p.Channel, http.StatusBadRequest)
+			return
+		}
+		if !p.Enabled && event.Required == p.Channel {
+			http.Error(w, p.EventType+" notifications cannot be turned off on "+p.Channel, http.StatusUnprocessableEntity)
+			return
+		}
+	}
+
+	tx, err := db.BeginTx(r.Context(), nil)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	defer tx.Rollback()
+	for _, p := range preferences {
+		_, err := tx.ExecContext(r.Context(), `INSERT INTO notification_preferences (customer_id, event_type, channel, enabled)
+											   VALUES ($1, $2, $3, $4)
+											   ON CONFLICT (customer_id, event_type, channel)
+											   DO UPDATE SET enabled = EXCLUDED.enabled, updated_at = NOW()`,
+			customerID, p.EventType, p.Channel, p.Enabled)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+	}
+	if err := tx.Commit(); err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	getPreferences(w, r)
+}
+
+// getChannels lists the addresses a customer has registered
+func getChannels(w http.ResponseWriter, r *http.Request) {
+	customerID, ok := requireCustomerAccess(w, r)
+	if !ok {
+		return
+	}
+
+	rows, err := db.QueryContext(r.Context(), `SELECT channel, address, updated_at FROM notification_channels
+											   WHERE customer_id = $1 ORDER BY channel`, customerID)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	defer rows.Close()
+
+	addresses := []ChannelAddress{}
+	for rows.Next() {
+		var a ChannelAddress
+		if err := rows.Scan(&a.Channel, &a.Address, &a.UpdatedAt); err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		addresses = append(addresses, a)
+	}
+	if err := rows.Err(); err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(addresses)
+}
+
+var phoneNumberPattern = regexp.MustCompile(`^\+[1-9][0-9]{7,14}$`)
+
+// validAddress checks an address suits its channel: an email address, an
+// E.164 phone number, a push device token or an https webhook URL
+func validAddress(channel, address string) bool {
+	if address == "" || len(address) > 500 || strings.ContainsAny(address, "\r\n") {
+		return false
+	}
+	switch channel {
+	case "email":
+		at := strings.LastIndex(address, "@")
+		return at > 0 && at < len(address)-1 && !strings.ContainsAny(address, " <>,")
+	case "sms":
+		return phoneNumberPattern.MatchString(address)
+	case "webhook":
+		u, err := url.Parse(address)
+		if err != nil || u.Host == "" {
+			return false
+		}
+		return u.Scheme == "https" || (u.Scheme == "http" && getEnv("APP_ENV", "development") == "development")
+	}
+	return true
+}
+
+// setChannel registers or replaces the customer's address for a channel.
+// Registering a webhook returns a new signing secret, shown only this once.
+func setChannel(w http.ResponseWriter, r *http.Request) {
+	customerID, ok := requireCustomerAccess(w, r)
+	if !ok {
+		return
+	}
+	channel := mux.Vars(r)["channel"]
+	if !validChannel(channel) {
+		http.Error(w, "Unknown channel", http.StatusBadRequest)
+		return
+	}
+
+	var requestBody struct {
+		Address string `json:"address"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&requestBody); err != nil {
+		http.Error(w, "Invalid request body", http.StatusBadRequest)
+		return
+	}
+	a := ChannelAddress{Channel: channel, Address: strings.TrimSpace(requestBody.Address)}
+	if !validAddress(channel, a.Address) {
+		http.Error(w, "Invalid address for "+channel, http.StatusBadRequest)
+		return
+	}
+	if channel == "webhook" {
+		b := make([]byte, 32)
+		rand.Read(b)
+		a.Secret = hex.EncodeToString(b)
+	}
+
+	err := db.QueryRowContext(r.Context(), `INSERT INTO notification_channels (customer_id, channel, address, secret)
+											VALUES ($1, $2, $3, $4)
+											ON CONFLICT (customer_id, channel) DO UPDATE SET address = EXCLUDED.address,
+												secret = EXCLUDED.secret, updated_at = NOW()
+											RETURNING updated_at`, customerID, channel, a.Address, a.Secret).Scan(&a.UpdatedAt)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(a)
+}
+
+// deleteChannel removes the customer's address for a channel
+func deleteChannel(w http.ResponseWriter, r *http.Request) {
+	customerID, ok := requireCustomerAccess(w, r)
+	if !ok {
+		return
+	}
+
+	result, err := db.ExecContext(r.Context(), `DELETE FROM notification_channels WHERE customer_id = $1 AND channel = $2`,
+		customerID, mux.Vars(r)["channel"])
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	if n, _ := result.RowsAffected(); n == 0 {
+		http.Error(w, "Channel not found", http.StatusNotFound)
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
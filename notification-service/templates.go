@@ -0,0 +1,238 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"sort"
+	"strings"
+	"text/template"
+
+	"github.com/gorilla/mux"
+)
+
+// Template is the subject and body of one notification template on one
+// channel, written in text/template syntax over the notification's data
+type Template struct {
+	Name      string `json:"name"`
+	Channel   string `json:"channel"`
+	Subject   string `json:"subject"` // email only
+	Body      string `json:"body"`
+	UpdatedBy string `json:"updated_by,omitempty"`
+	UpdatedAt string `json:"updated_at"`
+}
+
+const templateTablesSQL = `
+	CREATE TABLE IF NOT EXISTS notification_templates (
+		name VARCHAR(100) NOT NULL,
+		channel VARCHAR(20) NOT NULL,
+		subject TEXT NOT NULL DEFAULT '',
+		body TEXT NOT NULL,
+		updated_by VARCHAR(100) NOT NULL DEFAULT '',
+		updated_at TIMESTAMP NOT NULL DEFAULT NOW(),
+		PRIMARY KEY (name, channel)
+	);`
+
+// defaultTemplates are installed on first start; edits made through the API
+// are kept
+var defaultTemplates = []Template{
+	{Name: "deposit", Channel: "email", Subject: "Deposit received",
+		Body: "A deposit of {{.amount}} {{.currency_code}} was made to account {{.account_id}}.\nYour new balance is {{.balance}} {{.currency_code}}.\n"},
+	{Name: "deposit", Channel: "sms", Body: "Deposit of {{.amount}} {{.currency_code}} to {{.account_id}}. Balance {{.balance}}."},
+	{Name: "deposit", Channel: "push", Body: "{{.amount}} {{.currency_code}} deposited to {{.account_id}}"},
+	{Name: "withdrawal", Channel: "email", Subject: "Withdrawal made",
+		Body: "A withdrawal of {{.amount}} {{.currency_code}} was made from account {{.account_id}}.\nYour new balance is {{.balance}} {{.currency_code}}.\n\nIf you did not make this withdrawal, contact us immediately.\n"},
+	{Name: "withdrawal", Channel: "sms", Body: "Withdrawal of {{.amount}} {{.currency_code}} from {{.account_id}}. Balance {{.balance}}. Not you? Call us."},
+	{Name: "withdrawal", Channel: "push", Body: "{{.amount}} {{.currency_code}} withdrawn from {{.account_id}}"},
+	{Name: "login_new_device", Channel: "email", Subject: "New sign-in to your account",
+		Body: "Hello {{.username}},\n\nYour account was signed in to from a device we have not seen before:\n\n{{.user_agent}}\nIP address {{.source_ip}} at {{.time}}\n\nIf this was not you, reset your password and contact us.\n"},
+	{Name: "login_new_device", Channel: "sms", Body: "New sign-in to your bank account from {{.source_ip}}. Not you? Reset your password."},
+	{Name: "login_new_device", Channel: "push", Body: "New sign-in from {{.source_ip}}"},
+	{Name: "password_changed", Channel: "email", Subject: "Your password was changed",
+		Body: "Hello {{.username}},\n\nThe password of your account was changed at {{.time}}.\n\nIf you did not change it, contact us immediately.\n"},
+	{Name: "password_changed", Channel: "sms", Body: "Your bank password was changed. Not you? Contact us immediately."},
+	{Name: "mfa_changed", Channel: "email", Subject: "Two-factor authentication was {{.change}}",
+		Body: "Hello {{.username}},\n\nTwo-factor authentication was {{.change}} for your account at {{.time}}, from IP address {{.source_ip}}.\n\nIf you did not do this, contact us immediately.\n"},
+	{Name: "password_reset", Channel: "email", Subject: "Reset your password",
+		Body: "Hello {{.username}},\n\nUse this link to choose a new password. It expires at {{.expires_at}} and can be used once:\n\n{{.reset_url}}\n\nIf you did not ask to reset your password, ignore this email.\n"},
+}
+
+// seedTemplates installs the default templates that do not exist yet
+func seedTemplates(ctx context.Context) error {
+	for _, t := range defaultTemplates {
+		_, err := db.ExecContext(ctx, `INSERT INTO notification_templates (name, channel, subject, body, updated_by)
+									   VALUES ($1, $2, $3, $4, 'system') ON CONFLICT (name, channel) DO NOTHING`,
+			t.Name, t.Channel, t.Subject, t.Body)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// renderNotification renders the named template for channel. Notifications
+// whose template is not in the table are still delivered, with the data
+// listed as "key: value" lines, so a producer adding a template name does
+// not lose messages before the template is written.
+func renderNotification(ctx context.Context, name, channel string, data map[string]interface{}) (subject, body string, err error) {
+	var subjectText, bodyText string
+	err = db.QueryRowContext(ctx, `SELECT subject, body FROM notification_templates WHERE name = $1 AND channel = $2`,
+		name, channel).Scan(&subjectText, &bodyText)
+	if err == sql.ErrNoRows {
+		keys := make([]string, 0, len(data))
+		for key := range data {
+			keys = append(keys, key)
+		}
+		sort.Strings(keys)
+		var lines []string
+		for _, key := range keys {
+			lines = append(lines, fmt.Sprintf("%s: %v", key, data[key]))
+		}
+		return strings.ReplaceAll(name, "_", " "), strings.Join(lines, "\n"), nil
+	}
+	if err != nil {
+		return "", "", err
+	}
+
+	if subject, err = executeTemplate(subjectText, data); err != nil {
+		return "", "", err
+	}
+	body, err = executeTemplate(bodyText, data)
+	return subject, body, err
+}
+
+func executeTemplate(text string, data map[string]interface{}) (string, error) {
+	t, err := template.New("").Option("missingkey=zero").Parse(text)
+	if err != nil {
+		return "", err
+	}
+	var out bytes.Buffer
+	if err := t.Execute(&out, data); err != nil {
+		return "", err
+	}
+	return out.String(), nil
+}
+
+// listTemplates lists every template (admin only)
+func listTemplates(w http.ResponseWriter, r *http.Request) {
+	if !requireRole(w, r, "admin") {
+		return
+	}
+
+	rows, err := db.QueryContext(r.Context(), `SELECT name, channel, subject, body, updated_by, updated_at
+											   FROM notification_templates ORDER BY name, channel`)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	defer rows.Close()
+
+	templates := []Template{}
+	for rows.Next() {
+		var t Template
+		if err := rows.Scan(&t.Name, &t.Channel, &t.Subject, &t.Body, &t.UpdatedBy, &t.UpdatedAt); err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		templates = append(templates, t)
+	}
+	if err := rows.Err(); err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(templates)
+}
+
+// getTemplate returns one template (admin only)
+func getTemplate(w http.ResponseWriter, r *http.Request) {
+	if !requireRole(w, r, "admin") {
+		return
+	}
+	params := mux.Vars(r)
+
+	t := Template{Name: params["name"], Channel: params["channel"]}
+	err := db.QueryRowContext(r.Context(), `SELECT subject, body, updated_by, updated_at FROM notification_templates
+											WHERE name = $1 AND channel = $2`, t.Name, t.Channel).
+		Scan(&t.Subject, &t.Body, &t.UpdatedBy, &t.UpdatedAt)
+	if err != nil {
+		if err == sql.ErrNoRows {
+			http.Error(w, "Template not found", http.StatusNotFound)
+		} else {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+		}
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(t)
+}
+
+// putTemplate creates or replaces a template (admin only). Templates that do
+// not parse are rejected so a typo cannot break delivery.
+func putTemplate(w http.ResponseWriter, r *http.Request) {
+	if !requireRole(w, r, "admin") {
+		return
+	}
+	params := mux.Vars(r)
+
+	var t Template
+	if err := json.NewDecoder(r.Body).Decode(&t); err != nil {
+		http.Error(w, "Invalid request body", http.StatusBadRequest)
+		return
+	}
+	t.Name, t.Channel = params["name"], params["channel"]
+	if !validChannel(t.Channel) {
+		http.Error(w, "Unknown channel", http.StatusBadRequest)
+		return
+	}
+	if strings.TrimSpace(t.Body) == "" {
+		http.Error(w, "Body is required", http.StatusBadRequest)
+		return
+	}
+	for _, text := range []string{t.Subject, t.Body} {
+		if _, err := template.New("").Parse(text); err != nil {
+			http.Error(w, "Invalid template syntax", http.StatusBadRequest)
+			return
+		}
+	}
+
+	t.UpdatedBy = "user:" + r.Header.Get("X-User-ID")
+	err := db.QueryRowContext(r.Context(), `INSERT INTO notification_templates (name, channel, subject, body, updated_by)
+											VALUES ($1, $2, $3, $4, $5)
+											ON CONFLICT (name, channel) DO UPDATE SET subject = EXCLUDED.subject,
+												body = EXCLUDED.body, updated_by = EXCLUDED.updated_by, updated_at = NOW()
+											RETURNING updated_at`,
+		t.Name, t.Channel, t.Subject, t.Body, t.UpdatedBy).Scan(&t.UpdatedAt)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(t)
+}
+
+// deleteTemplate removes a template (admin only)
+func deleteTemplate(w http.ResponseWriter, r *http.Request) {
+	if !requireRole(w, r, "admin") {
+		return
+	}
+	params := mux.Vars(r)
+
+	result, err := db.ExecContext(r.Context(), `DELETE FROM notification_templates WHERE name = $1 AND channel = $2`,
+		params["name"], params["channel"])
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	if n, _ := result.RowsAffected(); n == 0 {
+		http.Error(w, "Template not found", http.StatusNotFound)
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
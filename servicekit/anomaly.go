@@ -0,0 +1,324 @@
+package servicekit
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"math"
+	"net/http"
+	"os"
+	"strconv"
+	"sync"
+	"time"
+
+	"go.uber.org/zap"
+)
+
+// Event counts are kept per interval in the database rather than per
+// replica, so the baseline and the alert reflect the whole service however
+// many replicas serve it. Each replica adds its own counts every interval; the
+// replica that evaluates an interval first records it in ops_baselines, so
+// each interval is judged, and alerted on, once.
+
+const AnomalyTablesSQL = `
+	CREATE TABLE IF NOT EXISTS ops_event_counts (
+		service VARCHAR(50) NOT NULL,
+		metric VARCHAR(50) NOT NULL,
+		interval_start TIMESTAMP NOT NULL,
+		count INTEGER NOT NULL DEFAULT 0,
+		PRIMARY KEY (service, metric, interval_start)
+	);
+	CREATE TABLE IF NOT EXISTS ops_baselines (
+		service VARCHAR(50) NOT NULL,
+		metric VARCHAR(50) NOT NULL,
+		mean DOUBLE PRECISION NOT NULL DEFAULT 0,
+		variance DOUBLE PRECISION NOT NULL DEFAULT 0,
+		samples INTEGER NOT NULL DEFAULT 0,
+		evaluated_through TIMESTAMP NOT NULL,
+		PRIMARY KEY (service, metric)
+	);`
+
+// anomalyBaseline is the exponentially weighted baseline of a counter's
+// previous intervals
+type anomalyBaseline struct {
+	mean     float64
+	variance float64
+	samples  int
+}
+
+// Operational counters watched for spikes; a service counts them with
+// RecordOpsEvent
+const (
+	MetricFailedLogins         = "failed_logins"
+	MetricDeclinedTransactions = "declined_transactions"
+	MetricServerErrors         = "http_5xx"
+)
+
+var watchedOpsMetrics = []string{MetricFailedLogins, MetricDeclinedTransactions, MetricServerErrors}
+
+type opsEventKey struct {
+	metric        string
+	intervalStart time.Time
+}
+
+var (
+	anomalyInterval = time.Minute
+	opsEventsMu     sync.Mutex
+	opsEvents       = map[opsEventKey]int{}
+)
+
+// RecordOpsEvent counts one occurrence of an operational event
+func RecordOpsEvent(name string) {
+	key := opsEventKey{metric: name, intervalStart: time.Now().UTC().Truncate(anomalyInterval)}
+	opsEventsMu.Lock()
+	opsEvents[key]++
+	opsEventsMu.Unlock()
+}
+
+// flushOpsEvents adds the counts gathered since the last flush to
+// ops_event_counts
+func flushOpsEvents(ctx context.Context) error {
+	opsEventsMu.Lock()
+	pending := opsEvents
+	opsEvents = map[opsEventKey]int{}
+	opsEventsMu.Unlock()
+
+	for key, count := range pending {
+		_, err := db().ExecContext(ctx, `INSERT INTO ops_event_counts (service, metric, interval_start, count)
+									   VALUES ($1, $2, $3, $4)
+									   ON CONFLICT (service, metric, interval_start) DO UPDATE SET
+										   count = ops_event_counts.count + EXCLUDED.count`,
+			service.Name, key.metric, key.intervalStart, count)
+		if err != nil {
+			// Keep the rest for the next flush
+			opsEventsMu.Lock()
+			for k, rest := range pending {
+				opsEvents[k] += rest
+			}
+			opsEventsMu.Unlock()
+			return err
+		}
+		delete(pending, key)
+	}
+	return nil
+}
+
+// observe reports whether count is anomalous against the baseline and folds
+// it into the baseline when it is not
+func (b *anomalyBaseline) observe(count, sensitivity float64, minCount, warmup int) (float64, bool) {
+	baseline := b.mean
+	stddev := math.Sqrt(b.variance)
+	anomalous := b.samples >= warmup && int(count) >= minCount &&
+		count > baseline+sensitivity*math.Max(stddev, 1)
+
+	// Anomalous intervals are kept out of the baseline so a sustained incident
+	// keeps alerting instead of becoming the new normal
+	if !anomalous {
+		const alpha = 0.1
+		diff := count - b.mean
+		b.mean += alpha * diff
+		b.variance = (1 - alpha) * (b.variance + alpha*diff*diff)
+		b.samples++
+	}
+	return baseline, anomalous
+}
+
+// opsAnomaly is an interval that exceeded its baseline
+type opsAnomaly struct {
+	metric   string
+	count    int
+	baseline float64
+}
+
+// evaluateOpsMetric judges the intervals of metric that every replica has
+// flushed and not yet been judged. An interval is judged once it is a full
+// interval old, by whichever replica gets there first.
+func evaluateOpsMetric(ctx context.Context, metric string, sensitivity float64, minCount int) ([]opsAnomaly, error) {
+	tx, err := db().BeginTx(ctx, nil)
+	if err != nil {
+		return nil, err
+	}
+	defer tx.Rollback()
+
+	// Intervals ending before this one have been flushed by every replica
+	through := time.Now().UTC().Truncate(anomalyInterval).Add(-2 * anomalyInterval)
+	_, err = tx.ExecContext(ctx, `INSERT INTO ops_baselines (service, metric, evaluated_through) VALUES ($1, $2, $3)
+								  ON CONFLICT (service, metric) DO NOTHING`, service.Name, metric, through)
+	if err != nil {
+		return nil, err
+	}
+	var b anomalyBaseline
+	var evaluated time.Time
+	err = tx.QueryRowContext(ctx, `SELECT mean, variance, samples, evaluated_through FROM ops_baselines
+								   WHERE service = $1 AND metric = $2 FOR UPDATE`, service.Name, metric).Scan(
+		&b.mean, &b.variance, &b.samples, &evaluated)
+	if err != nil {
+		return nil, err
+	}
+	evaluated = evaluated.UTC().Truncate(anomalyInterval)
+	if !evaluated.Before(through) {
+		return nil, nil
+	}
+	// After an outage of every replica, judge the last day rather than replaying all of it
+	if oldest := through.Add(-24 * time.Hour); evaluated.Before(oldest) {
+		evaluated = oldest
+	}
+
+	counts := map[time.Time]int{}
+	rows, err := tx.QueryContext(ctx, `SELECT interval_start, count FROM ops_event_counts
+									   WHERE service = $1 AND metric = $2 AND interval_start > $3 AND interval_start <= $4`,
+		service.Name, metric, evaluated, through)
+	if err != nil {
+		return nil, err
+	}
+	for rows.Next() {
+		var start time.Time
+		var count int
+		if err := rows.Scan(&start, &count); err != nil {
+			rows.Close()
+			return nil, err
+		}
+		counts[start.UTC()] = count
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+
+	var anomalies []opsAnomaly
+	for start := evaluated.Add(anomalyInterval); !start.After(through); start = start.Add(anomalyInterval) {
+		count := counts[start]
+		baseline, anomalous := b.observe(float64(count), sensitivity, minCount, 10)
+		if anomalous {
+			anomalies = append(anomalies, opsAnomaly{metric: metric, count: count, baseline: baseline})
+		}
+	}
+	_, err = tx.ExecContext(ctx, `UPDATE ops_baselines SET mean = $3, variance = $4, samples = $5, evaluated_through = $6
+								  WHERE service = $1 AND metric = $2`, service.Name, metric, b.mean, b.variance, b.samples, through)
+	if err != nil {
+		return nil, err
+	}
+	return anomalies, tx.Commit()
+}
+
+// StartAnomalyDetection flushes and evaluates every counter once per interval
+func StartAnomalyDetection() {
+	interval, err := time.ParseDuration(getEnv("ANOMALY_INTERVAL", "1m"))
+	if err != nil || interval <= 0 {
+		interval = time.Minute
+	}
+	anomalyInterval = interval
+	sensitivity, err := strconv.ParseFloat(getEnv("ANOMALY_SENSITIVITY", "4"), 64)
+	if err != nil {
+		sensitivity = 4
+	}
+	minCount, err := strconv.Atoi(getEnv("ANOMALY_MIN_COUNT", "10"))
+	if err != nil {
+		minCount = 10
+	}
+
+	go func() {
+		defer ReportJobPanic("Anomaly detection")
+		for range time.Tick(interval) {
+			if err := flushOpsEvents(service.Context); err != nil {
+				ReportJobError("Anomaly event flush", err)
+				continue
+			}
+			// The watched counters are evaluated even when quiet so they build a baseline
+			for _, metric := range watchedOpsMetrics {
+				anomalies, err := evaluateOpsMetric(service.Context, metric, sensitivity, minCount)
+				if err != nil {
+					ReportJobError("Anomaly detection", err)
+					continue
+				}
+				for _, a := range anomalies {
+					raiseOpsAlert(a.metric, a.count, a.baseline, interval)
+				}
+			}
+			_, err := db().ExecContext(service.Context, `DELETE FROM ops_event_counts WHERE service = $1 AND interval_start < $2`,
+				service.Name, time.Now().UTC().Add(-48*time.Hour))
+			if err != nil {
+				ReportJobError("Anomaly event expiry", err)
+			}
+		}
+	}()
+}
+
+// raiseOpsAlert sends the alert to PagerDuty when a routing key is configured,
+// otherwise to the notification service
+func raiseOpsAlert(metric string, count int, baseline float64, interval time.Duration) {
+	hostname, _ := os.Hostname()
+	summary := fmt.Sprintf("%s spike on %s: %d in the last %s (baseline %.1f)",
+		metric, service.Name, count, interval, baseline)
+	logger.Warn("operational anomaly", zap.String("metric", metric), zap.Int("count", count),
+		zap.Float64("baseline", baseline), zap.String("summary", summary))
+
+	var url string
+	var payload interface{}
+	if key := getEnv("PAGERDUTY_ROUTING_KEY", ""); key != "" {
+		url = "https://events.pagerduty.com/v2/enqueue"
+		payload = map[string]interface{}{
+			"routing_key":  key,
+			"event_action": "trigger",
+			"dedup_key":    service.Name + ":" + metric,
+			"payload": map[string]interface{}{
+				"summary":   summary,
+				"source":    hostname,
+				"severity":  "error",
+				"component": service.Name,
+				"custom_details": map[string]interface{}{
+					"metric":   metric,
+					"count":    count,
+					"baseline": baseline,
+				},
+			},
+		}
+	} else if recipient := getEnv("OPS_ALERT_EMAIL", ""); recipient != "" {
+		url = getEnv("NOTIFICATION_SERVICE_URL", "http://localhost:8083") + "/v1/notifications"
+		payload = map[string]interface{}{
+			"channel":   "email",
+			"recipient": recipient,
+			"template":  "ops_alert",
+			"data": map[string]interface{}{
+				"summary": summary,
+				"service": service.Name,
+				"metric":  metric,
+			},
+		}
+	} else {
+		return
+	}
+
+	body, _ := json.Marshal(payload)
+	resp, err := alertClient.Post(url, "application/json", bytes.NewReader(body))
+	if err != nil {
+		logger.Error("failed to send operational alert", zap.Error(err))
+		return
+	}
+	resp.Body.Close()
+}
+
+var alertClient = &http.Client{Timeout: 5 * time.Second}
+
+// statusRecorder captures the response status written by a handler
+type statusRecorder struct {
+	http.ResponseWriter
+	status int
+}
+
+func (r *statusRecorder) WriteHeader(status int) {
+	r.status = status
+	r.ResponseWriter.WriteHeader(status)
+}
+
+// ServerErrorMiddleware counts 5xx responses for anomaly detection
+func ServerErrorMiddleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		rec := &statusRecorder{ResponseWriter: w, status: http.StatusOK}
+		next.ServeHTTP(rec, r)
+		if rec.status >= 500 {
+			RecordOpsEvent(MetricServerErrors)
+		}
+	})
+}
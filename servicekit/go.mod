@@ -0,0 +1,16 @@
+module bank/servicekit
+
+go 1.19
+
+require (
+	github.com/golang-jwt/jwt/v5 v5.2.2
+	github.com/gorilla/mux v1.8.0
+	github.com/pressly/goose/v3 v3.11.2
+	github.com/swaggo/files/v2 v2.0.0
+	go.uber.org/zap v1.24.0
+)
+
+require (
+	go.uber.org/atomic v1.7.0 // indirect
+	go.uber.org/multierr v1.6.0 // indirect
+)
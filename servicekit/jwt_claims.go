@@ -0,0 +1,66 @@
+package servicekit
+
+import (
+	"errors"
+	"time"
+
+	"github.com/golang-jwt/jwt/v5"
+)
+
+// Access tokens are issued by auth-service (iss) for one service (aud). Each
+// service only accepts tokens that name its own audience, so a token minted
+// for one service cannot be replayed against another.
+
+// AccessClaims are the claims of an access token. Decoding into a struct
+// rejects tokens whose claims have the wrong types instead of panicking on a
+// type assertion later.
+type AccessClaims struct {
+	UserID    int    `json:"user_id"`
+	Username  string `json:"username"`
+	Role      string `json:"role"`
+	SessionID string `json:"sid,omitempty"`
+	jwt.RegisteredClaims
+}
+
+// JWTIssuer is the iss claim of access tokens, JWT_ISSUER
+func JWTIssuer() string {
+	return getEnv("JWT_ISSUER", "bank-auth-service")
+}
+
+// JWTAudience is the aud value this service accepts, JWT_AUDIENCE
+func JWTAudience() string {
+	return getEnv("JWT_AUDIENCE", service.Name)
+}
+
+// JWTClockSkew is the clock difference tolerated for exp, nbf and iat
+func JWTClockSkew() time.Duration {
+	skew, err := time.ParseDuration(getEnv("JWT_CLOCK_SKEW", "30s"))
+	if err != nil || skew < 0 {
+		return 30 * time.Second
+	}
+	return skew
+}
+
+// ParseAccessToken verifies a token signed with algorithm and checks its
+// claims: it must come from JWTIssuer, name audience, carry exp and iat, be
+// within its validity window and identify a user
+func ParseAccessToken(tokenString, algorithm, audience string, key jwt.Keyfunc) (*AccessClaims, error) {
+	claims := &AccessClaims{}
+	_, err := jwt.ParseWithClaims(tokenString, claims, key,
+		jwt.WithValidMethods([]string{algorithm}),
+		jwt.WithIssuer(JWTIssuer()),
+		jwt.WithAudience(audience),
+		jwt.WithExpirationRequired(),
+		jwt.WithIssuedAt(),
+		jwt.WithLeeway(JWTClockSkew()))
+	if err != nil {
+		return nil, err
+	}
+	if claims.IssuedAt == nil {
+		return nil, errors.New("token has no issue time")
+	}
+	if claims.UserID <= 0 || claims.Role == "" {
+		return nil, errors.New("token does not identify a user")
+	}
+	return claims, nil
+}
@@ -0,0 +1,192 @@
+package servicekit
+
+import (
+	"testing"
+	"time"
+
+	"github.com/golang-jwt/jwt/v5"
+)
+
+var testJWTSecret = []byte("test-jwt-secret")
+
+const testAudience = "account-service"
+
+func testKey(*jwt.Token) (interface{}, error) { return testJWTSecret, nil }
+
+// testAccessClaims returns valid claims of an access token for audience
+func testAccessClaims(audience ...string) AccessClaims {
+	now := time.Now()
+	return AccessClaims{
+		UserID:   7,
+		Username: "alice",
+		Role:     "customer",
+		RegisteredClaims: jwt.RegisteredClaims{
+			Issuer:    JWTIssuer(),
+			Audience:  audience,
+			IssuedAt:  jwt.NewNumericDate(now),
+			NotBefore: jwt.NewNumericDate(now),
+			ExpiresAt: jwt.NewNumericDate(now.Add(15 * time.Minute)),
+		},
+	}
+}
+
+func signTestToken(t *testing.T, method jwt.SigningMethod, key interface{}, claims AccessClaims) string {
+	t.Helper()
+	token, err := jwt.NewWithClaims(method, claims).SignedString(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return token
+}
+
+// TestParseAccessToken covers forged, expired and cross-service tokens
+func TestParseAccessToken(t *testing.T) {
+	past := time.Now().Add(-time.Hour)
+	future := time.Now().Add(time.Hour)
+
+	cases := []struct {
+		name   string
+		token  func(t *testing.T) string
+		accept bool
+	}{
+		{"valid", func(t *testing.T) string {
+			return signTestToken(t, jwt.SigningMethodHS256, testJWTSecret, testAccessClaims(testAudience))
+		}, true},
+		{"one of several audiences", func(t *testing.T) string {
+			return signTestToken(t, jwt.SigningMethodHS256, testJWTSecret, testAccessClaims("account-service", testAudience))
+		}, true},
+		{"signed with another key", func(t *testing.T) string {
+			return signTestToken(t, jwt.SigningMethodHS256, []byte("forged"), testAccessClaims(testAudience))
+		}, false},
+		{"signature stripped", func(t *testing.T) string {
+			token := signTestToken(t, jwt.SigningMethodHS256, testJWTSecret, testAccessClaims(testAudience))
+			return token[:len(token)-4] + "AAAA"
+		}, false},
+		{"unsigned", func(t *testing.T) string {
+			return signTestToken(t, jwt.SigningMethodNone, jwt.UnsafeAllowNoneSignatureType, testAccessClaims(testAudience))
+		}, false},
+		{"another algorithm", func(t *testing.T) string {
+			return signTestToken(t, jwt.SigningMethodHS512, testJWTSecret, testAccessClaims(testAudience))
+		}, false},
+		{"minted for another service", func(t *testing.T) string {
+			return signTestToken(t, jwt.SigningMethodHS256, testJWTSecret, testAccessClaims("transaction-service"))
+		}, false},
+		{"no audience", func(t *testing.T) string {
+			return signTestToken(t, jwt.SigningMethodHS256, testJWTSecret, testAccessClaims())
+		}, false},
+		{"another issuer", func(t *testing.T) string {
+			claims := testAccessClaims(testAudience)
+			claims.Issuer = "someone-else"
+			return signTestToken(t, jwt.SigningMethodHS256, testJWTSecret, claims)
+		}, false},
+		{"expired", func(t *testing.T) string {
+			claims := testAccessClaims(testAudience)
+			claims.IssuedAt, claims.NotBefore = jwt.NewNumericDate(past), jwt.NewNumericDate(past)
+			claims.ExpiresAt = jwt.NewNumericDate(time.Now().Add(-time.Minute))
+			return signTestToken(t, jwt.SigningMethodHS256, testJWTSecret, claims)
+		}, false},
+		{"expired within the clock skew", func(t *testing.T) string {
+			claims := testAccessClaims(testAudience)
+			claims.ExpiresAt = jwt.NewNumericDate(time.Now().Add(-JWTClockSkew() / 2))
+			return signTestToken(t, jwt.SigningMethodHS256, testJWTSecret, claims)
+		}, true},
+		{"no expiry", func(t *testing.T) string {
+			claims := testAccessClaims(testAudience)
+			claims.ExpiresAt = nil
+			return signTestToken(t, jwt.SigningMethodHS256, testJWTSecret, claims)
+		}, false},
+		{"not yet valid", func(t *testing.T) string {
+			claims := testAccessClaims(testAudience)
+			claims.NotBefore = jwt.NewNumericDate(future)
+			return signTestToken(t, jwt.SigningMethodHS256, testJWTSecret, claims)
+		}, false},
+		{"issued in the future", func(t *testing.T) string {
+			claims := testAccessClaims(testAudience)
+			claims.IssuedAt = jwt.NewNumericDate(future)
+			return signTestToken(t, jwt.SigningMethodHS256, testJWTSecret, claims)
+		}, false},
+		{"no issue time", func(t *testing.T) string {
+			claims := testAccessClaims(testAudience)
+			claims.IssuedAt = nil
+			return signTestToken(t, jwt.SigningMethodHS256, testJWTSecret, claims)
+		}, false},
+		{"no user", func(t *testing.T) string {
+			claims := testAccessClaims(testAudience)
+			claims.UserID = 0
+			return signTestToken(t, jwt.SigningMethodHS256, testJWTSecret, claims)
+		}, false},
+		{"not a token", func(*testing.T) string { return "not.a.token" }, false},
+	}
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			claims, err := ParseAccessToken(c.token(t), jwt.SigningMethodHS256.Alg(), testAudience, testKey)
+			if c.accept && err != nil {
+				t.Fatalf("rejected: %v", err)
+			}
+			if !c.accept && err == nil {
+				t.Fatalf("accepted claims %+v", claims)
+			}
+			if c.accept && claims.UserID != 7 {
+				t.Errorf("user %d, want 7", claims.UserID)
+			}
+		})
+	}
+}
+
+// FuzzParseAccessToken checks parsing never panics on malformed tokens, such
+// as claims of the wrong type, and accepts only signed tokens identifying a
+// user
+func FuzzParseAccessToken(f *testing.F) {
+	now := time.Now()
+	registered := jwt.MapClaims{
+		"iss": JWTIssuer(),
+		"aud": testAudience,
+		"iat": now.Unix(),
+		"exp": now.Add(time.Hour).Unix(),
+	}
+	seeds := []jwt.MapClaims{
+		{"user_id": 7, "username": "alice", "role": "customer"},
+		{"user_id": "7", "username": "alice", "role": "customer"},
+		{"user_id": 7.5, "role": []string{"admin"}},
+		{"user_id": nil, "username": 42},
+		{"user_id": 7, "role": "admin", "aud": []interface{}{testAudience, 1}},
+		{"user_id": 7, "role": "admin", "exp": "tomorrow"},
+		{"user_id": 7, "role": "admin", "iat": nil},
+	}
+	for _, seed := range seeds {
+		claims := jwt.MapClaims{}
+		for k, v := range registered {
+			claims[k] = v
+		}
+		for k, v := range seed {
+			claims[k] = v
+		}
+		token, err := jwt.NewWithClaims(jwt.SigningMethodHS256, claims).SignedString(testJWTSecret)
+		if err != nil {
+			f.Fatal(err)
+		}
+		f.Add(token)
+	}
+	unsigned, err := jwt.NewWithClaims(jwt.SigningMethodNone, registered).SignedString(jwt.UnsafeAllowNoneSignatureType)
+	if err != nil {
+		f.Fatal(err)
+	}
+	f.Add(unsigned)
+	for _, seed := range []string{"", ".", "..", "a.b.c", "eyJhbGciOiJIUzI1NiJ9..", "eyJhbGciOiJIUzI1NiJ9.e30.", "e30.e30.e30"} {
+		f.Add(seed)
+	}
+
+	f.Fuzz(func(t *testing.T, token string) {
+		claims, err := ParseAccessToken(token, jwt.SigningMethodHS256.Alg(), testAudience, testKey)
+		if err != nil {
+			return
+		}
+		if claims.UserID <= 0 || claims.Role == "" || claims.Issuer != JWTIssuer() || claims.IssuedAt == nil {
+			t.Fatalf("accepted claims %+v", claims)
+		}
+		if _, err := ParseAccessToken(token, jwt.SigningMethodHS256.Alg(), testAudience,
+			func(*jwt.Token) (interface{}, error) { return []byte("another key"), nil }); err == nil {
+			t.Fatal("accepted under another key")
+		}
+	})
+}
@@ -0,0 +1,232 @@
+package servicekit
+
+import (
+	"container/list"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gorilla/mux"
+)
+
+// Under overload requests are admitted by priority. Every route has one of
+// four priorities; each may only fill its share of MAX_CONCURRENT_REQUESTS,
+// so low priority traffic such as lists and exports is turned away while
+// there is still room for critical paths. A request that does not fit waits
+// briefly in a queue, and freed slots go to the highest priority waiter.
+
+// Request priorities, most important first
+const (
+	priorityCritical = iota
+	priorityHigh
+	priorityNormal
+	priorityLow
+	priorityLevels
+)
+
+var priorityNames = [priorityLevels]string{"critical", "high", "normal", "low"}
+
+// priorityShares is the share of the capacity each priority may fill
+var priorityShares = [priorityLevels]float64{1, 0.9, 0.75, 0.5}
+
+func parsePriority(name string) (int, bool) {
+	for p, n := range priorityNames {
+		if n == strings.TrimSpace(name) {
+			return p, true
+		}
+	}
+	return 0, false
+}
+
+// LoadRoutePriorities returns the priority of each route ("POST /auth/validate"),
+// defaults overridden by ROUTE_PRIORITIES, e.g.
+// "GET /accounts=low;POST /accounts/{id}/authorizations=critical". Other
+// routes are normal.
+func LoadRoutePriorities(defaults map[string]string) map[string]int {
+	priorities := map[string]int{}
+	set := func(route, name string) {
+		if p, ok := parsePriority(name); ok {
+			priorities[strings.TrimSpace(route)] = p
+		}
+	}
+	for route, name := range defaults {
+		set(route, name)
+	}
+	for _, entry := range strings.Split(getEnv("ROUTE_PRIORITIES", ""), ";") {
+		if route, name, ok := strings.Cut(entry, "="); ok {
+			set(route, name)
+		}
+	}
+	return priorities
+}
+
+// admissionController limits the requests served at once
+type admissionController struct {
+	capacity int
+	timeout  time.Duration
+
+	mu       sync.Mutex
+	inFlight int
+	queues   [priorityLevels]*list.List // of chan struct{}, closed when admitted
+	queued   int
+}
+
+func newAdmissionController(capacity int, timeout time.Duration) *admissionController {
+	a := &admissionController{capacity: capacity, timeout: timeout}
+	for p := range a.queues {
+		a.queues[p] = list.New()
+	}
+	return a
+}
+
+// limit is the in-flight count below which priority p is admitted
+func (a *admissionController) limit(p int) int {
+	limit := int(float64(a.capacity) * priorityShares[p])
+	if limit < 1 {
+		limit = 1
+	}
+	return limit
+}
+
+// waitingAtOrAbove reports whether requests of priority p or higher are queued
+func (a *admissionController) waitingAtOrAbove(p int) bool {
+	for q := 0; q <= p; q++ {
+		if a.queues[q].Len() > 0 {
+			return true
+		}
+	}
+	return false
+}
+
+// acquire admits a request of priority p, waiting up to the queue timeout.
+// It returns false when the request should be shed.
+func (a *admissionController) acquire(r *http.Request, p int) bool {
+	a.mu.Lock()
+	if a.inFlight < a.limit(p) && !a.waitingAtOrAbove(p) {
+		a.inFlight++
+		a.mu.Unlock()
+		return true
+	}
+	if a.timeout <= 0 || a.queued >= a.capacity {
+		a.mu.Unlock()
+		return false
+	}
+	admitted := make(chan struct{})
+	element := a.queues[p].PushBack(admitted)
+	a.queued++
+	a.mu.Unlock()
+
+	timer := time.NewTimer(a.timeout)
+	defer timer.Stop()
+	select {
+	case <-admitted:
+		return true
+	case <-timer.C:
+	case <-r.Context().Done():
+	}
+
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	select {
+	case <-admitted:
+		// Admitted while giving up; hand the slot on
+		a.inFlight--
+		a.admitWaiters()
+	default:
+		a.queues[p].Remove(element)
+		a.queued--
+	}
+	return false
+}
+
+// release frees the slot of a finished request
+func (a *admissionController) release() {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	a.inFlight--
+	a.admitWaiters()
+}
+
+// admitWaiters fills free slots with queued requests, highest priority first.
+// The caller holds a.mu.
+func (a *admissionController) admitWaiters() {
+	for p := 0; p < priorityLevels; p++ {
+		for a.queues[p].Len() > 0 && a.inFlight < a.limit(p) {
+			admitted := a.queues[p].Remove(a.queues[p].Front()).(chan struct{})
+			a.queued--
+			a.inFlight++
+			close(admitted)
+		}
+		if a.queues[p].Len() > 0 {
+			// Lower priorities wait behind this one
+			return
+		}
+	}
+}
+
+var (
+	requestsShed = NewCounterVec("http_requests_shed_total",
+		"Requests rejected by admission control, by priority.", "priority")
+	admission *admissionController
+)
+
+func init() {
+	newGaugeFunc("http_requests_queued", "Requests waiting for admission.", func() float64 {
+		if admission == nil {
+			return 0
+		}
+		admission.mu.Lock()
+		defer admission.mu.Unlock()
+		return float64(admission.queued)
+	})
+}
+
+// LoadSheddingMiddleware admits requests by the priority of their route.
+// MAX_CONCURRENT_REQUESTS (default 256, 0 disables shedding) is the capacity
+// and LOAD_SHED_QUEUE_TIMEOUT (default 250ms) how long a request may wait;
+// shed requests get a 503 with Retry-After. Probes, metrics and SLO reports
+// are always served.
+func LoadSheddingMiddleware(priorities map[string]int) mux.MiddlewareFunc {
+	capacity, err := strconv.Atoi(getEnv("MAX_CONCURRENT_REQUESTS", "256"))
+	if err != nil || capacity < 0 {
+		capacity = 256
+	}
+	timeout, err := time.ParseDuration(getEnv("LOAD_SHED_QUEUE_TIMEOUT", "250ms"))
+	if err != nil || timeout < 0 {
+		timeout = 250 * time.Millisecond
+	}
+	if capacity > 0 {
+		admission = newAdmissionController(capacity, timeout)
+	}
+
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			template := ""
+			if route := mux.CurrentRoute(r); route != nil {
+				template, _ = route.GetPathTemplate()
+			}
+			if admission == nil || template == "/health" || template == "/startup" || template == "/metrics" || template == "/slo" {
+				next.ServeHTTP(w, r)
+				return
+			}
+			for _, prefix := range []string{"/v1", "/v2"} {
+				template = strings.TrimPrefix(template, prefix)
+			}
+			priority, ok := priorities[r.Method+" "+template]
+			if !ok {
+				priority = priorityNormal
+			}
+
+			if !admission.acquire(r, priority) {
+				requestsShed.Inc(priorityNames[priority])
+				w.Header().Set("Retry-After", "1")
+				http.Error(w, "Service overloaded, please retry", http.StatusServiceUnavailable)
+				return
+			}
+			defer admission.release()
+			next.ServeHTTP(w, r)
+		})
+	}
+}
@@ -0,0 +1,130 @@
+package servicekit
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"net/http"
+	"strings"
+	"time"
+
+	"go.uber.org/zap"
+	"go.uber.org/zap/zapcore"
+)
+
+// Logs are written as JSON lines to stderr. Lines logged while serving a
+// request carry its request ID, which callers may set with X-Request-ID and
+// which is passed on to peer services, so one request can be followed
+// across the services it touches.
+
+// newLogger builds the service logger. LOG_LEVEL (debug, info, warn or
+// error, default info) sets the minimum level.
+func newLogger() *zap.Logger {
+	config := zap.NewProductionConfig()
+	config.Sampling = nil
+	config.EncoderConfig.TimeKey = "time"
+	config.EncoderConfig.EncodeTime = zapcore.ISO8601TimeEncoder
+	config.InitialFields = map[string]interface{}{"service": service.Name}
+	if level, err := zapcore.ParseLevel(getEnv("LOG_LEVEL", "info")); err == nil {
+		config.Level = zap.NewAtomicLevelAt(level)
+	}
+	l, err := config.Build()
+	if err != nil {
+		panic(err)
+	}
+	return l
+}
+
+type requestIDKey struct{}
+
+// RequestID returns the ID of the request ctx belongs to, or ""
+func RequestID(ctx context.Context) string {
+	id, _ := ctx.Value(requestIDKey{}).(string)
+	return id
+}
+
+// WithRequestID returns a copy of ctx belonging to the request id, for
+// requests that do not pass through RequestIDMiddleware such as RPCs
+func WithRequestID(ctx context.Context, id string) context.Context {
+	return context.WithValue(ctx, requestIDKey{}, id)
+}
+
+// RequestLogger returns the logger for work done on behalf of the request
+// ctx belongs to
+func RequestLogger(ctx context.Context) *zap.Logger {
+	if id := RequestID(ctx); id != "" {
+		return logger.With(zap.String("request_id", id))
+	}
+	return logger
+}
+
+// NewCorrelationID returns a random UUID
+func NewCorrelationID() string {
+	b := make([]byte, 16)
+	rand.Read(b)
+	b[6] = b[6]&0x0f | 0x40
+	b[8] = b[8]&0x3f | 0x80
+	h := hex.EncodeToString(b)
+	return h[0:8] + "-" + h[8:12] + "-" + h[12:16] + "-" + h[16:20] + "-" + h[20:]
+}
+
+// incomingRequestID keeps a caller's X-Request-ID when it is reasonable, so
+// the gateway's and the peers' logs line up, and generates one otherwise
+func incomingRequestID(r *http.Request) string {
+	id := r.Header.Get("X-Request-ID")
+	if id == "" || len(id) > 128 || strings.IndexFunc(id, func(c rune) bool { return c <= ' ' || c > '~' }) >= 0 {
+		return NewCorrelationID()
+	}
+	return id
+}
+
+// RequestIDMiddleware gives every request an ID, returned to the client as
+// X-Request-ID on every response, errors included, and logs each request
+// when it completes. Probes and metrics scrapes are not logged.
+func RequestIDMiddleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		id := incomingRequestID(r)
+		r.Header.Set("X-Request-ID", id)
+		w.Header().Set("X-Request-ID", id)
+		r = r.WithContext(WithRequestID(r.Context(), id))
+
+		start := time.Now()
+		rec := &metricsRecorder{ResponseWriter: w}
+		defer func() {
+			if r.URL.Path == "/health" || r.URL.Path == "/startup" || r.URL.Path == "/metrics" {
+				return
+			}
+			status := rec.status
+			if status == 0 {
+				status = http.StatusOK
+			}
+			level := zapcore.InfoLevel
+			if status >= 500 {
+				level = zapcore.ErrorLevel
+			}
+			RequestLogger(r.Context()).Check(level, "request completed").Write(
+				zap.String("method", r.Method),
+				zap.String("path", r.URL.Path),
+				zap.Int("status", status),
+				zap.Duration("duration", time.Since(start)),
+				zap.String("user_id", r.Header.Get("X-User-ID")),
+				zap.String("remote_addr", r.RemoteAddr),
+			)
+		}()
+		next.ServeHTTP(rec, r)
+	})
+}
+
+// RequestIDTransport passes the request ID of an outgoing request's context
+// on to the peer service
+type RequestIDTransport struct {
+	Base http.RoundTripper
+}
+
+func (t RequestIDTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	if id := RequestID(req.Context()); id != "" && req.Header.Get("X-Request-ID") == "" {
+		req = req.Clone(req.Context())
+		req.Header.Set("X-Request-ID", id)
+	}
+	return t.Base.RoundTrip(req)
+}
@@ -0,0 +1,327 @@
+package servicekit
+
+import (
+	"database/sql"
+	"fmt"
+	"math"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/gorilla/mux"
+)
+
+// Metrics are served at /metrics in the Prometheus text format. The few
+// metric types needed are implemented here rather than pulling in the client
+// library.
+
+// metric writes its samples in the exposition format
+type metric interface {
+	write(b *strings.Builder)
+}
+
+var (
+	metricsMu       sync.Mutex
+	metricsRegistry []metric
+)
+
+func registerMetric(m metric) {
+	metricsMu.Lock()
+	defer metricsMu.Unlock()
+	metricsRegistry = append(metricsRegistry, m)
+}
+
+// labelKey joins label values; \xff cannot appear in valid UTF-8 values
+func labelKey(values []string) string {
+	return strings.Join(values, "\xff")
+}
+
+func formatLabels(names, values []string, extra ...string) string {
+	if len(names) == 0 && len(extra) == 0 {
+		return ""
+	}
+	pairs := make([]string, 0, len(names)+1)
+	for i, name := range names {
+		pairs = append(pairs, name+`="`+escapeLabel(values[i])+`"`)
+	}
+	for i := 0; i+1 < len(extra); i += 2 {
+		pairs = append(pairs, extra[i]+`="`+escapeLabel(extra[i+1])+`"`)
+	}
+	return "{" + strings.Join(pairs, ",") + "}"
+}
+
+func escapeLabel(value string) string {
+	return strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`).Replace(value)
+}
+
+func formatFloat(v float64) string {
+	if math.IsInf(v, 1) {
+		return "+Inf"
+	}
+	return strconv.FormatFloat(v, 'g', -1, 64)
+}
+
+// CounterVec is a counter partitioned by labels
+type CounterVec struct {
+	name, help string
+	labels     []string
+
+	mu     sync.Mutex
+	values map[string]float64
+	keys   map[string][]string
+}
+
+func NewCounterVec(name, help string, labels ...string) *CounterVec {
+	c := &CounterVec{name: name, help: help, labels: labels, values: map[string]float64{}, keys: map[string][]string{}}
+	if len(labels) == 0 {
+		// Export 0 before the first increment so rate() works from the start
+		c.values[""] = 0
+	}
+	registerMetric(c)
+	return c
+}
+
+// Add increases the counter of the given label values
+func (c *CounterVec) Add(v float64, labelValues ...string) {
+	key := labelKey(labelValues)
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if _, ok := c.keys[key]; !ok {
+		c.keys[key] = labelValues
+	}
+	c.values[key] += v
+}
+
+// Inc increases the counter of the given label values by one
+func (c *CounterVec) Inc(labelValues ...string) {
+	c.Add(1, labelValues...)
+}
+
+func (c *CounterVec) write(b *strings.Builder) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	fmt.Fprintf(b, "# HELP %s %s\n# TYPE %s counter\n", c.name, c.help, c.name)
+	keys := make([]string, 0, len(c.values))
+	for key := range c.values {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	for _, key := range keys {
+		fmt.Fprintf(b, "%s%s %s\n", c.name, formatLabels(c.labels, c.keys[key]), formatFloat(c.values[key]))
+	}
+}
+
+// HistogramVec is a histogram partitioned by labels
+type HistogramVec struct {
+	name, help string
+	labels     []string
+	buckets    []float64
+
+	mu     sync.Mutex
+	series map[string]*histogramSeries
+}
+
+type histogramSeries struct {
+	labelValues []string
+	counts      []uint64 // per bucket, not cumulative
+	sum         float64
+	count       uint64
+}
+
+// DefaultLatencyBuckets are request latency buckets in seconds
+var DefaultLatencyBuckets = []float64{0.005, 0.01, 0.025, 0.05, 0.1, 0.25, 0.5, 1, 2.5, 5, 10}
+
+func NewHistogramVec(name, help string, buckets []float64, labels ...string) *HistogramVec {
+	h := &HistogramVec{name: name, help: help, labels: labels, buckets: buckets, series: map[string]*histogramSeries{}}
+	registerMetric(h)
+	return h
+}
+
+// Observe records one value for the given label values
+func (h *HistogramVec) Observe(v float64, labelValues ...string) {
+	key := labelKey(labelValues)
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	s, ok := h.series[key]
+	if !ok {
+		s = &histogramSeries{labelValues: labelValues, counts: make([]uint64, len(h.buckets))}
+		h.series[key] = s
+	}
+	for i, upper := range h.buckets {
+		if v <= upper {
+			s.counts[i]++
+			break
+		}
+	}
+	s.sum += v
+	s.count++
+}
+
+func (h *HistogramVec) write(b *strings.Builder) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	fmt.Fprintf(b, "# HELP %s %s\n# TYPE %s histogram\n", h.name, h.help, h.name)
+	keys := make([]string, 0, len(h.series))
+	for key := range h.series {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	for _, key := range keys {
+		s := h.series[key]
+		var cumulative uint64
+		for i, upper := range h.buckets {
+			cumulative += s.counts[i]
+			fmt.Fprintf(b, "%s_bucket%s %d\n", h.name, formatLabels(h.labels, s.labelValues, "le", formatFloat(upper)), cumulative)
+		}
+		fmt.Fprintf(b, "%s_bucket%s %d\n", h.name, formatLabels(h.labels, s.labelValues, "le", "+Inf"), s.count)
+		fmt.Fprintf(b, "%s_sum%s %s\n", h.name, formatLabels(h.labels, s.labelValues), formatFloat(s.sum))
+		fmt.Fprintf(b, "%s_count%s %d\n", h.name, formatLabels(h.labels, s.labelValues), s.count)
+	}
+}
+
+// gaugeFunc is a gauge or counter read when metrics are scraped
+type gaugeFunc struct {
+	name, help, kind string
+	value            func() float64
+}
+
+func newGaugeFunc(name, help string, value func() float64) {
+	registerMetric(gaugeFunc{name: name, help: help, kind: "gauge", value: value})
+}
+
+func newCounterFunc(name, help string, value func() float64) {
+	registerMetric(gaugeFunc{name: name, help: help, kind: "counter", value: value})
+}
+
+func (g gaugeFunc) write(b *strings.Builder) {
+	fmt.Fprintf(b, "# HELP %s %s\n# TYPE %s %s\n%s %s\n", g.name, g.help, g.name, g.kind, g.name, formatFloat(g.value()))
+}
+
+var (
+	httpRequestsTotal = NewCounterVec("http_requests_total",
+		"HTTP requests by route template, method and status code.", "route", "method", "status")
+	httpRequestDuration = NewHistogramVec("http_request_duration_seconds",
+		"HTTP request latency by route template and method.", DefaultLatencyBuckets, "route", "method")
+	httpRequestsInFlight int64
+)
+
+func init() {
+	newGaugeFunc("http_requests_in_flight", "HTTP requests being served.", func() float64 {
+		return float64(atomic.LoadInt64(&httpRequestsInFlight))
+	})
+
+	// Connection pool statistics of the service database
+	pool := func(read func(s sql.DBStats) float64) func() float64 {
+		return func() float64 {
+			database := db()
+			if database == nil {
+				return 0
+			}
+			return read(database.Stats())
+		}
+	}
+	newGaugeFunc("db_pool_max_open_connections", "Maximum open database connections (0 is unlimited).",
+		pool(func(s sql.DBStats) float64 { return float64(s.MaxOpenConnections) }))
+	newGaugeFunc("db_pool_open_connections", "Open database connections.",
+		pool(func(s sql.DBStats) float64 { return float64(s.OpenConnections) }))
+	newGaugeFunc("db_pool_in_use_connections", "Database connections in use.",
+		pool(func(s sql.DBStats) float64 { return float64(s.InUse) }))
+	newGaugeFunc("db_pool_idle_connections", "Idle database connections.",
+		pool(func(s sql.DBStats) float64 { return float64(s.Idle) }))
+	newCounterFunc("db_pool_wait_count_total", "Database connection requests that had to wait.",
+		pool(func(s sql.DBStats) float64 { return float64(s.WaitCount) }))
+	newCounterFunc("db_pool_wait_seconds_total", "Time spent waiting for a database connection.",
+		pool(func(s sql.DBStats) float64 { return s.WaitDuration.Seconds() }))
+	newCounterFunc("db_pool_max_idle_closed_total", "Connections closed because the idle pool was full.",
+		pool(func(s sql.DBStats) float64 { return float64(s.MaxIdleClosed) }))
+	newCounterFunc("db_pool_max_lifetime_closed_total", "Connections closed at their maximum lifetime.",
+		pool(func(s sql.DBStats) float64 { return float64(s.MaxLifetimeClosed) }))
+}
+
+// metricsRecorder captures the status code of a response
+type metricsRecorder struct {
+	http.ResponseWriter
+	status int
+}
+
+func (m *metricsRecorder) WriteHeader(status int) {
+	if m.status == 0 {
+		m.status = status
+	}
+	m.ResponseWriter.WriteHeader(status)
+}
+
+func (m *metricsRecorder) Write(b []byte) (int, error) {
+	if m.status == 0 {
+		m.status = http.StatusOK
+	}
+	return m.ResponseWriter.Write(b)
+}
+
+// MetricsMiddleware counts requests and observes their latency per route
+// template, so paths with IDs do not create a series each
+func MetricsMiddleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		route := "unmatched"
+		if current := mux.CurrentRoute(r); current != nil {
+			if template, err := current.GetPathTemplate(); err == nil {
+				route = template
+			}
+		}
+		if route == "/metrics" || route == "/slo" {
+			next.ServeHTTP(w, r)
+			return
+		}
+
+		atomic.AddInt64(&httpRequestsInFlight, 1)
+		start := time.Now()
+		rec := &metricsRecorder{ResponseWriter: w}
+		defer func() {
+			atomic.AddInt64(&httpRequestsInFlight, -1)
+			status := rec.status
+			if status == 0 {
+				// A panic unwinding through here becomes a 500
+				status = http.StatusInternalServerError
+			}
+			elapsed := time.Since(start)
+			httpRequestsTotal.Inc(route, r.Method, strconv.Itoa(status))
+			httpRequestDuration.Observe(elapsed.Seconds(), route, r.Method)
+			if route != "/health" && route != "/startup" && route != "unmatched" {
+				recordSLOSample(r.Method+" "+route, status, elapsed)
+			}
+		}()
+		next.ServeHTTP(rec, r)
+	})
+}
+
+// MetricsHandler serves every registered metric. With METRICS_TOKEN set the
+// scraper must send it as a bearer token.
+func MetricsHandler(w http.ResponseWriter, r *http.Request) {
+	if !metricsAuthorized(w, r) {
+		return
+	}
+
+	metricsMu.Lock()
+	registered := append([]metric(nil), metricsRegistry...)
+	metricsMu.Unlock()
+	var b strings.Builder
+	for _, m := range registered {
+		m.write(&b)
+	}
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4; charset=utf-8")
+	w.Write([]byte(b.String()))
+}
+
+// metricsAuthorized writes a 401 and returns false unless METRICS_TOKEN is
+// unset or sent as the bearer token
+func metricsAuthorized(w http.ResponseWriter, r *http.Request) bool {
+	if token := getEnv("METRICS_TOKEN", ""); token != "" && r.Header.Get("Authorization") != "Bearer "+token {
+		http.Error(w, "Authentication required", http.StatusUnauthorized)
+		return false
+	}
+	return true
+}
@@ -0,0 +1,219 @@
+package servicekit
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/pressly/goose/v3"
+	"go.uber.org/zap"
+)
+
+// The schema is versioned with goose. Version 1 is the baseline, the
+// CREATE ... IF NOT EXISTS statements the service ran before, which is
+// frozen; every later change is a numbered SQL file in migrations/ with an
+// Up and a Down section, embedded in the binary and passed in as
+// Service.Migrations. Each service records its
+// versions in its own table, <service>_schema_versions.
+//
+// Migrations run on startup unless MIGRATE_ON_STARTUP is false, in which case
+// startup fails while the schema is behind. They can also be run with
+//
+//	<service> migrate up|up-to VERSION|down|down-to VERSION|redo|status|version
+//	<service> migrate create NAME sql
+//
+// where create writes the file to ./migrations.
+
+const migrationsDir = "migrations"
+
+// migrationLockKey is the advisory lock every service takes to migrate.
+// The services share one database and some tables, so they migrate one at
+// a time rather than per service.
+const migrationLockKey = 7220419
+
+// migrationLockTimeout is how long a replica waits for another to finish
+// migrating, MIGRATION_LOCK_TIMEOUT
+func migrationLockTimeout() time.Duration {
+	timeout, err := time.ParseDuration(getEnv("MIGRATION_LOCK_TIMEOUT", "5m"))
+	if err != nil || timeout <= 0 {
+		return 5 * time.Minute
+	}
+	return timeout
+}
+
+func migrationTable() string {
+	return strings.ReplaceAll(service.Name, "-", "_") + "_schema_versions"
+}
+
+// gooseLogger writes goose's progress through the service logger
+type gooseLogger struct{}
+
+func (gooseLogger) Fatal(v ...interface{}) { logger.Fatal(strings.TrimSpace(fmt.Sprint(v...))) }
+func (gooseLogger) Fatalf(format string, v ...interface{}) {
+	logger.Fatal(strings.TrimSpace(fmt.Sprintf(format, v...)))
+}
+func (gooseLogger) Print(v ...interface{})   { logger.Info(strings.TrimSpace(fmt.Sprint(v...))) }
+func (gooseLogger) Println(v ...interface{}) { logger.Info(strings.TrimSpace(fmt.Sprint(v...))) }
+func (gooseLogger) Printf(format string, v ...interface{}) {
+	logger.Info(strings.TrimSpace(fmt.Sprintf(format, v...)))
+}
+
+var (
+	configureOnce  sync.Once
+	expectedSchema int64
+)
+
+// configureMigrations registers the baseline and returns the version the
+// service's migrations bring the schema to
+func configureMigrations(baseline []string) (int64, error) {
+	var err error
+	configureOnce.Do(func() {
+		goose.SetBaseFS(service.Migrations)
+		goose.SetTableName(migrationTable())
+		goose.SetLogger(gooseLogger{})
+		if err = goose.SetDialect("postgres"); err != nil {
+			return
+		}
+		goose.AddNamedMigration("00001_baseline.go", func(tx *sql.Tx) error {
+			for _, stmt := range baseline {
+				if _, err := tx.Exec(stmt); err != nil {
+					return err
+				}
+			}
+			return nil
+		}, func(*sql.Tx) error {
+			return fmt.Errorf("the baseline schema cannot be rolled back")
+		})
+
+		var migrations goose.Migrations
+		migrations, err = goose.CollectMigrations(migrationsDir, 0, goose.MaxVersion)
+		if err == nil && len(migrations) > 0 {
+			expectedSchema = migrations[len(migrations)-1].Version
+		}
+	})
+	return expectedSchema, err
+}
+
+// withMigrationLock runs fn while holding the migration lock, so replicas
+// starting together do not race on schema changes
+func withMigrationLock(ctx context.Context, fn func() error) error {
+	// Advisory locks belong to a session, so lock and unlock on one connection
+	conn, err := db().Conn(ctx)
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+
+	deadline := time.Now().Add(migrationLockTimeout())
+	for {
+		var locked bool
+		if err := conn.QueryRowContext(ctx, `SELECT pg_try_advisory_lock($1)`, migrationLockKey).Scan(&locked); err != nil {
+			return err
+		}
+		if locked {
+			break
+		}
+		if time.Now().After(deadline) {
+			return fmt.Errorf("timed out waiting for the migration lock")
+		}
+		logger.Info("waiting for another replica to finish migrating")
+		time.Sleep(2 * time.Second)
+	}
+	defer conn.ExecContext(context.Background(), `SELECT pg_advisory_unlock($1)`, migrationLockKey)
+	return fn()
+}
+
+// schemaVersion returns the latest version applied to the database
+func schemaVersion(ctx context.Context) (int64, error) {
+	var version int64
+	err := db().QueryRowContext(ctx, `SELECT COALESCE(MAX(version_id), 0) FROM `+migrationTable()+` WHERE is_applied`).
+		Scan(&version)
+	return version, err
+}
+
+// RunMigrations brings the schema up to date, or with MIGRATE_ON_STARTUP
+// false only checks that it is
+func RunMigrations(ctx context.Context, baseline []string) error {
+	expected, err := configureMigrations(baseline)
+	if err != nil {
+		return err
+	}
+
+	if getEnv("MIGRATE_ON_STARTUP", "true") == "false" {
+		current, err := schemaVersion(ctx)
+		if err != nil {
+			return err
+		}
+		if current < expected {
+			return fmt.Errorf("schema is at version %d, %d is required; run migrate up", current, expected)
+		}
+		return nil
+	}
+
+	start := time.Now()
+	err = withMigrationLock(ctx, func() error { return goose.Up(db(), migrationsDir) })
+	if err != nil {
+		return err
+	}
+	logger.Info("schema is up to date", zap.Int64("version", expected), zap.Duration("duration", time.Since(start)))
+	return nil
+}
+
+// runMigrateCommand runs the migrate subcommand with args, e.g. ["status"]
+func runMigrateCommand(args []string, baseline []string) error {
+	if len(args) == 0 {
+		return fmt.Errorf("usage: %s migrate up|up-to VERSION|down|down-to VERSION|redo|status|version|create NAME sql",
+			service.Name)
+	}
+	if _, err := configureMigrations(baseline); err != nil {
+		return err
+	}
+	switch args[0] {
+	case "create":
+		// New files are written to the source tree rather than the embedded copy
+		goose.SetBaseFS(nil)
+		return goose.Run(args[0], db(), migrationsDir, args[1:]...)
+	case "status", "version":
+		return goose.Run(args[0], db(), migrationsDir, args[1:]...)
+	}
+	return withMigrationLock(service.Context, func() error {
+		return goose.Run(args[0], db(), migrationsDir, args[1:]...)
+	})
+}
+
+// MigrateCommand runs the migrate subcommand and exits if the service was
+// started as "<service> migrate ...", and returns otherwise
+func MigrateCommand(connect func(), baseline func() []string) {
+	if len(os.Args) < 2 || os.Args[1] != "migrate" {
+		return
+	}
+	connect()
+	err := runMigrateCommand(os.Args[2:], baseline())
+	db().Close()
+	if err != nil {
+		logger.Fatal("migration failed", zap.Error(err))
+	}
+	os.Exit(0)
+}
+
+// HealthCheck reports the service healthy while the database schema is at
+// least the version this build expects
+func HealthCheck(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	current, err := schemaVersion(r.Context())
+	healthy := err == nil && current >= expectedSchema
+	if !healthy {
+		w.WriteHeader(http.StatusServiceUnavailable)
+	}
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"status":                  healthy,
+		"schema_version":          current,
+		"expected_schema_version": expectedSchema,
+	})
+}
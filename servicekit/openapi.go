@@ -0,0 +1,344 @@
+package servicekit
+
+import (
+	"encoding/json"
+	"net/http"
+	"reflect"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gorilla/mux"
+	swaggerFiles "github.com/swaggo/files/v2"
+	"go.uber.org/zap"
+)
+
+// The OpenAPI document is built from the router itself, so every versioned
+// route is in it and none that is not served. apiDocs adds what the router
+// cannot know: summaries, tags, query parameters and the Go types of the
+// request and response bodies, whose schemas are derived from their json
+// tags.
+
+// APIOperation documents one route, keyed in apiDocs by method and
+// unversioned path like "POST /accounts/{id}/deposit". A key with a version,
+// "GET /v2/accounts/{id}", documents that version only.
+type APIOperation struct {
+	Summary     string
+	Description string
+	Tags        []string
+	Query       map[string]string // query parameter name to description
+	Request     interface{}       // a value of the JSON request body type
+	Response    interface{}       // a value of the JSON response body type
+	Status      int               // success status, 200 when unset
+	Public      bool              // callable without a bearer token
+}
+
+// schemaProvider is implemented by types whose JSON form differs from their
+// Go type, such as Money
+type schemaProvider interface {
+	OpenAPISchema() map[string]interface{}
+}
+
+// openAPIPath converts a mux path template, whose variables may carry a
+// pattern, to an OpenAPI path and returns the path parameters
+func openAPIPath(template string) (string, []string) {
+	var params []string
+	var b strings.Builder
+	for {
+		start := strings.Index(template, "{")
+		if start < 0 {
+			b.WriteString(template)
+			break
+		}
+		end := strings.Index(template[start:], "}")
+		if end < 0 {
+			b.WriteString(template)
+			break
+		}
+		name := template[start+1 : start+end]
+		if i := strings.Index(name, ":"); i >= 0 {
+			name = name[:i]
+		}
+		params = append(params, name)
+		b.WriteString(template[:start] + "{" + name + "}")
+		template = template[start+end+1:]
+	}
+	return b.String(), params
+}
+
+// operationID names an operation for generated clients, e.g.
+// "postV1AccountsIdDeposit"
+func operationID(method, path string) string {
+	id := strings.ToLower(method)
+	for _, part := range strings.FieldsFunc(path, func(c rune) bool {
+		return c == '/' || c == '{' || c == '}' || c == '-' || c == '_' || c == '.'
+	}) {
+		id += strings.ToUpper(part[:1]) + part[1:]
+	}
+	return id
+}
+
+// openAPISchemas derives JSON schemas from Go types into components
+type openAPISchemas map[string]interface{}
+
+var timeType = reflect.TypeOf(time.Time{})
+
+func (c openAPISchemas) schema(t reflect.Type) map[string]interface{} {
+	if t.Kind() != reflect.Ptr && t.Kind() != reflect.Interface {
+		if provider, ok := reflect.Zero(t).Interface().(schemaProvider); ok {
+			return provider.OpenAPISchema()
+		}
+	}
+	switch t.Kind() {
+	case reflect.Ptr:
+		s := c.schema(t.Elem())
+		if _, isRef := s["$ref"]; isRef {
+			return map[string]interface{}{"allOf": []interface{}{s}, "nullable": true}
+		}
+		s["nullable"] = true
+		return s
+	case reflect.Bool:
+		return map[string]interface{}{"type": "boolean"}
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32:
+		return map[string]interface{}{"type": "integer", "format": "int32"}
+	case reflect.Int64, reflect.Uint64:
+		return map[string]interface{}{"type": "integer", "format": "int64"}
+	case reflect.Float32, reflect.Float64:
+		return map[string]interface{}{"type": "number"}
+	case reflect.String:
+		return map[string]interface{}{"type": "string"}
+	case reflect.Slice, reflect.Array:
+		if t.Elem().Kind() == reflect.Uint8 {
+			return map[string]interface{}{"type": "string", "format": "byte"}
+		}
+		return map[string]interface{}{"type": "array", "items": c.schema(t.Elem())}
+	case reflect.Map:
+		return map[string]interface{}{"type": "object", "additionalProperties": c.schema(t.Elem())}
+	case reflect.Struct:
+		if t == timeType {
+			return map[string]interface{}{"type": "string", "format": "date-time"}
+		}
+		if t.Name() == "" {
+			return c.object(t)
+		}
+		if _, ok := c[t.Name()]; !ok {
+			c[t.Name()] = map[string]interface{}{} // placeholder for recursive types
+			c[t.Name()] = c.object(t)
+		}
+		return map[string]interface{}{"$ref": "#/components/schemas/" + t.Name()}
+	}
+	return map[string]interface{}{}
+}
+
+// object describes a struct by its exported fields and their json tags
+func (c openAPISchemas) object(t reflect.Type) map[string]interface{} {
+	properties := map[string]interface{}{}
+	var required []string
+	var addFields func(t reflect.Type)
+	addFields = func(t reflect.Type) {
+		for i := 0; i < t.NumField(); i++ {
+			field := t.Field(i)
+			tag := field.Tag.Get("json")
+			if tag == "-" || (!field.IsExported() && !field.Anonymous) {
+				continue
+			}
+			name, options, _ := strings.Cut(tag, ",")
+			if field.Anonymous && name == "" && field.Type.Kind() == reflect.Struct {
+				addFields(field.Type)
+				continue
+			}
+			if name == "" {
+				name = field.Name
+			}
+			properties[name] = c.schema(field.Type)
+			if !strings.Contains(options, "omitempty") && field.Type.Kind() != reflect.Ptr {
+				required = append(required, name)
+			}
+		}
+	}
+	addFields(t)
+	s := map[string]interface{}{"type": "object", "properties": properties}
+	if len(required) > 0 {
+		sort.Strings(required)
+		s["required"] = required
+	}
+	return s
+}
+
+func (c openAPISchemas) content(body interface{}) map[string]interface{} {
+	return map[string]interface{}{
+		"application/json": map[string]interface{}{"schema": c.schema(reflect.TypeOf(body))},
+	}
+}
+
+// openAPIDocument describes the versioned routes of router. Unversioned
+// aliases and operational endpoints (/health, /metrics) are left out.
+func openAPIDocument(router *mux.Router, docs map[string]APIOperation, title string) map[string]interface{} {
+	schemas := openAPISchemas{}
+	paths := map[string]map[string]interface{}{}
+	documented := map[string]bool{}
+
+	router.Walk(func(route *mux.Route, _ *mux.Router, _ []*mux.Route) error {
+		template, err := route.GetPathTemplate()
+		if err != nil || !(strings.HasPrefix(template, "/v1/") || strings.HasPrefix(template, "/v2/")) {
+			return nil
+		}
+		methods, err := route.GetMethods()
+		if err != nil {
+			return nil
+		}
+		path, params := openAPIPath(template)
+		unversioned := path[strings.Index(path[1:], "/")+1:]
+		for _, method := range methods {
+			method = strings.ToLower(method)
+			if paths[path] == nil {
+				paths[path] = map[string]interface{}{}
+			}
+			if _, seen := paths[path][method]; seen {
+				// mux serves the first registration of a route
+				continue
+			}
+			key := strings.ToUpper(method) + " " + path
+			if _, ok := docs[key]; !ok {
+				key = strings.ToUpper(method) + " " + unversioned
+			}
+			doc, ok := docs[key]
+			documented[key] = ok
+
+			op := map[string]interface{}{
+				"operationId": operationID(method, path),
+				"tags":        doc.Tags,
+			}
+			if len(doc.Tags) == 0 {
+				op["tags"] = []string{strings.SplitN(strings.TrimPrefix(unversioned, "/"), "/", 2)[0]}
+			}
+			if doc.Summary != "" {
+				op["summary"] = doc.Summary
+			}
+			if doc.Description != "" {
+				op["description"] = doc.Description
+			}
+			var parameters []interface{}
+			for _, name := range params {
+				parameters = append(parameters, map[string]interface{}{
+					"name": name, "in": "path", "required": true, "schema": map[string]string{"type": "string"},
+				})
+			}
+			names := make([]string, 0, len(doc.Query))
+			for name := range doc.Query {
+				names = append(names, name)
+			}
+			sort.Strings(names)
+			for _, name := range names {
+				parameters = append(parameters, map[string]interface{}{
+					"name": name, "in": "query", "description": doc.Query[name], "schema": map[string]string{"type": "string"},
+				})
+			}
+			if len(parameters) > 0 {
+				op["parameters"] = parameters
+			}
+			if doc.Request != nil {
+				op["requestBody"] = map[string]interface{}{"required": true, "content": schemas.content(doc.Request)}
+			}
+			status := doc.Status
+			if status == 0 {
+				status = http.StatusOK
+			}
+			success := map[string]interface{}{"description": http.StatusText(status)}
+			if doc.Response != nil {
+				success["content"] = schemas.content(doc.Response)
+			}
+			op["responses"] = map[string]interface{}{
+				strconv.Itoa(status): success,
+				"default": map[string]interface{}{
+					"description": "Error",
+					"content":     map[string]interface{}{"text/plain": map[string]interface{}{"schema": map[string]string{"type": "string"}}},
+				},
+			}
+			if doc.Public {
+				op["security"] = []interface{}{}
+			}
+			paths[path][method] = op
+		}
+		return nil
+	})
+
+	// apiDocs entries for routes that no longer exist are stale annotations
+	for key := range docs {
+		if _, ok := documented[key]; !ok {
+			logger.Warn("API documentation for a route that is not registered", zap.String("route", key))
+		}
+	}
+
+	return map[string]interface{}{
+		"openapi": "3.0.3",
+		"info": map[string]interface{}{
+			"title":   title,
+			"version": getEnv("RELEASE", "dev"),
+		},
+		"paths": paths,
+		"components": map[string]interface{}{
+			"schemas": schemas,
+			"securitySchemes": map[string]interface{}{
+				"bearerAuth": map[string]string{"type": "http", "scheme": "bearer", "bearerFormat": "JWT"},
+			},
+		},
+		"security": []interface{}{map[string][]string{"bearerAuth": {}}},
+	}
+}
+
+// OpenAPIHandler serves the document for router at /openapi.json. It is
+// built on the first request, once every route is registered; ?version=v1
+// limits it to one API version.
+func OpenAPIHandler(router *mux.Router, docs map[string]APIOperation, title string) http.HandlerFunc {
+	var once sync.Once
+	var document map[string]interface{}
+	return func(w http.ResponseWriter, r *http.Request) {
+		once.Do(func() { document = openAPIDocument(router, docs, title) })
+		result := document
+		if version := r.URL.Query().Get("version"); version != "" {
+			filtered := map[string]map[string]interface{}{}
+			for path, item := range document["paths"].(map[string]map[string]interface{}) {
+				if strings.HasPrefix(path, "/"+version+"/") {
+					filtered[path] = item
+				}
+			}
+			result = map[string]interface{}{}
+			for key, value := range document {
+				result[key] = value
+			}
+			result["paths"] = filtered
+		}
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(result)
+	}
+}
+
+// swaggerInitializer points the bundled Swagger UI at /openapi.json. It is
+// a script file rather than inline so the html CSP can stay script-src 'self'.
+const swaggerInitializer = `window.onload = function() {
+  window.ui = SwaggerUIBundle({
+    url: "/openapi.json",
+    dom_id: "#swagger-ui",
+    deepLinking: true,
+    presets: [SwaggerUIBundle.presets.apis, SwaggerUIStandalonePreset],
+    layout: "StandaloneLayout"
+  });
+};
+`
+
+// SwaggerUIHandler serves Swagger UI under /docs/. The service adds its html
+// security headers.
+func SwaggerUIHandler() http.Handler {
+	files := http.StripPrefix("/docs/", http.FileServer(http.FS(swaggerFiles.FS)))
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/docs/swagger-initializer.js" {
+			w.Header().Set("Content-Type", "application/javascript")
+			w.Write([]byte(swaggerInitializer))
+			return
+		}
+		files.ServeHTTP(w, r)
+	})
+}
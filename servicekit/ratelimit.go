@@ -0,0 +1,548 @@
+package servicekit
+
+import (
+	"bufio"
+	"context"
+	"crypto/sha1"
+	"crypto/tls"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"math"
+	"net"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gorilla/mux"
+	"go.uber.org/zap"
+)
+
+// Requests are rate limited with token buckets per client IP, per
+// authenticated user and, for sensitive routes such as logins, per route and
+// client IP. A bucket holds up to a limit's count of tokens and refills at
+// count per period; each request takes one, so a client may burst to the
+// count and then continues at the refill rate. Buckets are kept in memory per
+// replica, or with RATE_LIMIT_BACKEND=redis in Redis and shared by every
+// replica. Peer services other than the gateway are not limited.
+
+// rateLimitPolicy allows Count requests per Period, in bursts of up to Count
+type rateLimitPolicy struct {
+	Count  int
+	Period time.Duration
+}
+
+// parseRateLimitPolicy reads "COUNT/PERIOD" such as "10/1m", or a bare COUNT
+// per minute as the gateway takes; a count of 0 disables the limit
+func parseRateLimitPolicy(value string) (rateLimitPolicy, error) {
+	value = strings.TrimSpace(value)
+	count, period, ok := strings.Cut(value, "/")
+	if !ok {
+		period = "1m"
+	}
+	n, err := strconv.Atoi(count)
+	if err != nil || n < 0 {
+		return rateLimitPolicy{}, fmt.Errorf("invalid rate limit %q", value)
+	}
+	d, err := time.ParseDuration(period)
+	if err != nil || d <= 0 {
+		return rateLimitPolicy{}, fmt.Errorf("invalid rate limit %q", value)
+	}
+	return rateLimitPolicy{Count: n, Period: d}, nil
+}
+
+// rateLimitPolicyEnv reads a policy from key, falling back to defaultValue
+func rateLimitPolicyEnv(key, defaultValue string) rateLimitPolicy {
+	policy, err := parseRateLimitPolicy(getEnv(key, defaultValue))
+	if err != nil {
+		logger.Warn("ignoring invalid rate limit", zap.String("key", key), zap.Error(err))
+		policy, _ = parseRateLimitPolicy(defaultValue)
+	}
+	return policy
+}
+
+// loadRouteRateLimits returns the per-route limits ("POST /auth/login"),
+// defaults overridden by RATE_LIMIT_ROUTES, e.g.
+// "POST /auth/login=10/1m;POST /auth/register=0"
+func loadRouteRateLimits(defaults map[string]string) map[string]rateLimitPolicy {
+	limits := map[string]rateLimitPolicy{}
+	set := func(route, value string) {
+		policy, err := parseRateLimitPolicy(value)
+		if err != nil {
+			logger.Warn("ignoring invalid route rate limit", zap.String("route", route), zap.Error(err))
+			return
+		}
+		limits[strings.TrimSpace(route)] = policy
+	}
+	for route, value := range defaults {
+		set(route, value)
+	}
+	for _, entry := range strings.Split(getEnv("RATE_LIMIT_ROUTES", ""), ";") {
+		if route, value, ok := strings.Cut(entry, "="); ok {
+			set(route, value)
+		}
+	}
+	return limits
+}
+
+// rateLimitStore takes a token from the bucket named key, or reports how long
+// until one is available
+type rateLimitStore interface {
+	take(ctx context.Context, key string, policy rateLimitPolicy) (bool, time.Duration, error)
+}
+
+// RateLimiter applies the limits of this service
+type RateLimiter struct {
+	store    rateLimitStore
+	fallback *memoryRateLimitStore // used while the shared store is unreachable
+	perIP    rateLimitPolicy
+	perUser  rateLimitPolicy
+	routes   map[string]rateLimitPolicy
+	proxies  []*net.IPNet // whose X-Forwarded-For is believed
+}
+
+var (
+	requestsRateLimited = NewCounterVec("http_requests_rate_limited_total",
+		"Requests rejected by rate limiting, by the bucket that was empty (ip, user or route).", "scope")
+	rateLimitStoreErrors = NewCounterVec("rate_limit_store_errors_total",
+		"Rate limit checks answered from memory because the Redis store failed.")
+)
+
+// NewRateLimiter configures rate limiting from the environment:
+// RATE_LIMIT_PER_IP and RATE_LIMIT_PER_USER (COUNT/PERIOD, 0 disables),
+// RATE_LIMIT_ROUTES, RATE_LIMIT_TRUSTED_PROXIES (comma-separated CIDRs) and
+// RATE_LIMIT_BACKEND ("memory", the default, or "redis" with REDIS_URL)
+func NewRateLimiter(perIP, perUser string, routes map[string]string) *RateLimiter {
+	l := &RateLimiter{
+		fallback: newMemoryRateLimitStore(),
+		perIP:    rateLimitPolicyEnv("RATE_LIMIT_PER_IP", perIP),
+		perUser:  rateLimitPolicyEnv("RATE_LIMIT_PER_USER", perUser),
+		routes:   loadRouteRateLimits(routes),
+	}
+	for _, cidr := range strings.Split(getEnv("RATE_LIMIT_TRUSTED_PROXIES", ""), ",") {
+		if cidr = strings.TrimSpace(cidr); cidr == "" {
+			continue
+		}
+		_, network, err := net.ParseCIDR(cidr)
+		if err != nil {
+			logger.Fatal("invalid RATE_LIMIT_TRUSTED_PROXIES", zap.Error(err))
+		}
+		l.proxies = append(l.proxies, network)
+	}
+	l.store = l.fallback
+	switch backend := getEnv("RATE_LIMIT_BACKEND", "memory"); backend {
+	case "memory":
+	case "redis":
+		store, err := newRedisRateLimitStore(getEnv("REDIS_URL", "redis://localhost:6379/0"))
+		if err != nil {
+			logger.Fatal("invalid REDIS_URL", zap.Error(err))
+		}
+		l.store = store
+	default:
+		logger.Fatal("unsupported rate limit backend", zap.String("backend", backend))
+	}
+	go l.fallback.expire(service.Context)
+	return l
+}
+
+// allow takes a token for key. A Redis failure falls back to this replica's
+// own buckets rather than letting every request through.
+func (l *RateLimiter) allow(ctx context.Context, key string, policy rateLimitPolicy) (bool, time.Duration) {
+	if policy.Count == 0 {
+		return true, 0
+	}
+	ok, retryAfter, err := l.store.take(ctx, key, policy)
+	if err != nil {
+		rateLimitStoreErrors.Inc()
+		RequestLogger(ctx).Warn("rate limit store unavailable", zap.Error(err))
+		ok, retryAfter, _ = l.fallback.take(ctx, key, policy)
+	}
+	return ok, retryAfter
+}
+
+// route returns the route template of r without the version prefix, and
+// whether r is exempt from limits: probes, metrics and calls from peer
+// services other than the gateway
+func (l *RateLimiter) route(r *http.Request) (string, bool) {
+	template := ""
+	if route := mux.CurrentRoute(r); route != nil {
+		template, _ = route.GetPathTemplate()
+	}
+	if template == "/health" || template == "/startup" || template == "/metrics" || template == "/slo" {
+		return "", true
+	}
+	if peer := VerifiedPeer(r.Context()); peer != "" && peer != "api-gateway" {
+		return "", true
+	}
+	for _, prefix := range []string{"/v1", "/v2"} {
+		template = strings.TrimPrefix(template, prefix)
+	}
+	return r.Method + " " + template, false
+}
+
+// clientIP returns the client's address. X-Forwarded-For is only believed
+// from the gateway, a trusted proxy, or anyone while service identity is not
+// enforced, as in development.
+func (l *RateLimiter) clientIP(r *http.Request) string {
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		host = r.RemoteAddr
+	}
+	trusted := VerifiedPeer(r.Context()) == "api-gateway" || !PeerIdentityEnabled()
+	if ip := net.ParseIP(host); ip != nil {
+		for _, network := range l.proxies {
+			trusted = trusted || network.Contains(ip)
+		}
+	}
+	if forwarded := r.Header.Get("X-Forwarded-For"); forwarded != "" && trusted {
+		return strings.TrimSpace(strings.Split(forwarded, ",")[0])
+	}
+	return host
+}
+
+func rejectRateLimited(w http.ResponseWriter, r *http.Request, scope, key string, retryAfter time.Duration) {
+	requestsRateLimited.Inc(scope)
+	RequestLogger(r.Context()).Warn("rate limit exceeded", zap.String("key", key))
+	w.Header().Set("Retry-After", strconv.Itoa(int(math.Ceil(retryAfter.Seconds()))))
+	http.Error(w, "Too many requests", http.StatusTooManyRequests)
+}
+
+// IPMiddleware applies the per-IP and per-route limits. It runs after the
+// middleware that verifies peer services, so they can be told apart, and
+// before authentication, so it also bounds invalid credentials.
+func (l *RateLimiter) IPMiddleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		route, exempt := l.route(r)
+		if exempt {
+			next.ServeHTTP(w, r)
+			return
+		}
+		ip := l.clientIP(r)
+		if policy, ok := l.routes[route]; ok {
+			key := "route:" + route + ":ip:" + ip
+			if ok, retryAfter := l.allow(r.Context(), key, policy); !ok {
+				rejectRateLimited(w, r, "route", key, retryAfter)
+				return
+			}
+		}
+		key := "ip:" + ip
+		if ok, retryAfter := l.allow(r.Context(), key, l.perIP); !ok {
+			rejectRateLimited(w, r, "ip", key, retryAfter)
+			return
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+// UserMiddleware applies the per-user limit to requests userID attributes to
+// a user ("" for anonymous requests), across every address they use
+func (l *RateLimiter) UserMiddleware(userID func(*http.Request) string) mux.MiddlewareFunc {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			if _, exempt := l.route(r); !exempt {
+				if id := userID(r); id != "" {
+					key := "user:" + id
+					if ok, retryAfter := l.allow(r.Context(), key, l.perUser); !ok {
+						rejectRateLimited(w, r, "user", key, retryAfter)
+						return
+					}
+				}
+			}
+			next.ServeHTTP(w, r)
+		})
+	}
+}
+
+// memoryRateLimitStore keeps buckets in this replica's memory
+type memoryRateLimitStore struct {
+	mu      sync.Mutex
+	buckets map[string]*memoryBucket
+}
+
+type memoryBucket struct {
+	tokens  float64
+	updated time.Time
+	fullAt  time.Time // after which the bucket is as good as new
+}
+
+func newMemoryRateLimitStore() *memoryRateLimitStore {
+	return &memoryRateLimitStore{buckets: map[string]*memoryBucket{}}
+}
+
+func (s *memoryRateLimitStore) take(_ context.Context, key string, policy rateLimitPolicy) (bool, time.Duration, error) {
+	now := time.Now()
+	capacity := float64(policy.Count)
+	perSecond := capacity / policy.Period.Seconds()
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	b := s.buckets[key]
+	if b == nil {
+		b = &memoryBucket{tokens: capacity, updated: now}
+		s.buckets[key] = b
+	}
+	b.tokens = math.Min(capacity, b.tokens+now.Sub(b.updated).Seconds()*perSecond)
+	b.updated = now
+	allowed := b.tokens >= 1
+	if allowed {
+		b.tokens--
+	}
+	b.fullAt = now.Add(time.Duration((capacity - b.tokens) / perSecond * float64(time.Second)))
+	if !allowed {
+		return false, time.Duration((1 - b.tokens) / perSecond * float64(time.Second)), nil
+	}
+	return true, 0, nil
+}
+
+// expire drops refilled buckets every minute until ctx is done
+func (s *memoryRateLimitStore) expire(ctx context.Context) {
+	ticker := time.NewTicker(time.Minute)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case now := <-ticker.C:
+			s.mu.Lock()
+			for key, b := range s.buckets {
+				if now.After(b.fullAt) {
+					delete(s.buckets, key)
+				}
+			}
+			s.mu.Unlock()
+		}
+	}
+}
+
+// tokenBucketScript takes a token from the bucket KEYS[1] holding up to
+// ARGV[1] tokens refilled over ARGV[2] milliseconds. It returns 0 when a
+// token was taken, or else the milliseconds until one is available. Redis's
+// clock is used so replicas agree.
+const tokenBucketScript = `
+local count = tonumber(ARGV[1])
+local period = tonumber(ARGV[2])
+local time = redis.call('TIME')
+local now = tonumber(time[1]) * 1000 + math.floor(tonumber(time[2]) / 1000)
+local state = redis.call('HMGET', KEYS[1], 'tokens', 'updated')
+local tokens = tonumber(state[1]) or count
+local updated = tonumber(state[2]) or now
+tokens = math.min(count, tokens + math.max(0, now - updated) * count / period)
+local wait = 0
+if tokens >= 1 then
+	tokens = tokens - 1
+else
+	wait = math.ceil((1 - tokens) * period / count)
+end
+redis.call('HSET', KEYS[1], 'tokens', tostring(tokens), 'updated', tostring(now))
+redis.call('PEXPIRE', KEYS[1], period)
+return wait
+`
+
+var tokenBucketSHA = func() string {
+	sum := sha1.Sum([]byte(tokenBucketScript))
+	return hex.EncodeToString(sum[:])
+}()
+
+// redisTimeout bounds each rate limit check against Redis
+const redisTimeout = 500 * time.Millisecond
+
+// redisRateLimitStore keeps buckets in Redis, speaking its protocol (RESP)
+// directly over a small pool of connections
+type redisRateLimitStore struct {
+	address  string
+	useTLS   bool
+	username string
+	password string
+	database int
+	prefix   string
+	idle     chan *redisConn
+}
+
+type redisConn struct {
+	net.Conn
+	reader *bufio.Reader
+	writer *bufio.Writer
+}
+
+// redisError is an error reply from Redis
+type redisError string
+
+func (e redisError) Error() string { return "redis: " + string(e) }
+
+// newRedisRateLimitStore connects lazily to rawURL,
+// redis[s]://[[user]:password@]host:port[/database]
+func newRedisRateLimitStore(rawURL string) (*redisRateLimitStore, error) {
+	u, err := url.Parse(rawURL)
+	if err != nil {
+		return nil, err
+	}
+	if u.Scheme != "redis" && u.Scheme != "rediss" {
+		return nil, fmt.Errorf("unsupported scheme %q", u.Scheme)
+	}
+	s := &redisRateLimitStore{
+		address: u.Host,
+		useTLS:  u.Scheme == "rediss",
+		prefix:  "ratelimit:" + service.Name + ":",
+		idle:    make(chan *redisConn, 16),
+	}
+	if u.Port() == "" {
+		s.address = net.JoinHostPort(u.Hostname(), "6379")
+	}
+	if u.User != nil {
+		s.username = u.User.Username()
+		s.password, _ = u.User.Password()
+	}
+	if path := strings.Trim(u.Path, "/"); path != "" {
+		if s.database, err = strconv.Atoi(path); err != nil {
+			return nil, fmt.Errorf("invalid database %q", path)
+		}
+	}
+	return s, nil
+}
+
+func (s *redisRateLimitStore) take(ctx context.Context, key string, policy rateLimitPolicy) (bool, time.Duration, error) {
+	args := []string{"1", s.prefix + key, strconv.Itoa(policy.Count), strconv.FormatInt(policy.Period.Milliseconds(), 10)}
+	reply, err := s.do(ctx, append([]string{"EVALSHA", tokenBucketSHA}, args...)...)
+	if e, ok := err.(redisError); ok && strings.HasPrefix(string(e), "NOSCRIPT") {
+		reply, err = s.do(ctx, append([]string{"EVAL", tokenBucketScript}, args...)...)
+	}
+	if err != nil {
+		return false, 0, err
+	}
+	wait, ok := reply.(int64)
+	if !ok {
+		return false, 0, fmt.Errorf("redis: unexpected reply %v", reply)
+	}
+	return wait == 0, time.Duration(wait) * time.Millisecond, nil
+}
+
+// do sends one command and reads its reply. Connections are reused unless
+// they failed.
+func (s *redisRateLimitStore) do(ctx context.Context, args ...string) (interface{}, error) {
+	var conn *redisConn
+	select {
+	case conn = <-s.idle:
+	default:
+		var err error
+		if conn, err = s.dial(ctx); err != nil {
+			return nil, err
+		}
+	}
+	reply, err := conn.command(redisDeadline(ctx), args...)
+	if _, isReply := err.(redisError); err != nil && !isReply {
+		conn.Close()
+		return nil, err
+	}
+	select {
+	case s.idle <- conn:
+	default:
+		conn.Close()
+	}
+	return reply, err
+}
+
+func redisDeadline(ctx context.Context) time.Time {
+	deadline := time.Now().Add(redisTimeout)
+	if d, ok := ctx.Deadline(); ok && d.Before(deadline) {
+		return d
+	}
+	return deadline
+}
+
+// dial opens a connection, authenticated and on the configured database
+func (s *redisRateLimitStore) dial(ctx context.Context) (*redisConn, error) {
+	dialer := &net.Dialer{Timeout: redisTimeout}
+	var raw net.Conn
+	var err error
+	if s.useTLS {
+		host, _, _ := net.SplitHostPort(s.address)
+		raw, err = (&tls.Dialer{NetDialer: dialer, Config: &tls.Config{ServerName: host}}).DialContext(ctx, "tcp", s.address)
+	} else {
+		raw, err = dialer.DialContext(ctx, "tcp", s.address)
+	}
+	if err != nil {
+		return nil, err
+	}
+	conn := &redisConn{Conn: raw, reader: bufio.NewReader(raw), writer: bufio.NewWriter(raw)}
+	var setup [][]string
+	switch {
+	case s.username != "":
+		setup = append(setup, []string{"AUTH", s.username, s.password})
+	case s.password != "":
+		setup = append(setup, []string{"AUTH", s.password})
+	}
+	if s.database != 0 {
+		setup = append(setup, []string{"SELECT", strconv.Itoa(s.database)})
+	}
+	for _, args := range setup {
+		if _, err := conn.command(redisDeadline(ctx), args...); err != nil {
+			conn.Close()
+			return nil, err
+		}
+	}
+	return conn, nil
+}
+
+// command writes args as a RESP array of bulk strings and reads the reply
+func (c *redisConn) command(deadline time.Time, args ...string) (interface{}, error) {
+	if err := c.SetDeadline(deadline); err != nil {
+		return nil, err
+	}
+	fmt.Fprintf(c.writer, "*%d\r\n", len(args))
+	for _, arg := range args {
+		fmt.Fprintf(c.writer, "$%d\r\n%s\r\n", len(arg), arg)
+	}
+	if err := c.writer.Flush(); err != nil {
+		return nil, err
+	}
+	return readRedisReply(c.reader)
+}
+
+// readRedisReply reads one RESP reply: a string, an int64, nil, a
+// []interface{} or a redisError
+func readRedisReply(r *bufio.Reader) (interface{}, error) {
+	line, err := r.ReadString('\n')
+	if err != nil {
+		return nil, err
+	}
+	line = strings.TrimSuffix(line, "\r\n")
+	if line == "" {
+		return nil, fmt.Errorf("redis: empty reply")
+	}
+	switch line[0] {
+	case '+':
+		return line[1:], nil
+	case '-':
+		return nil, redisError(line[1:])
+	case ':':
+		return strconv.ParseInt(line[1:], 10, 64)
+	case '$':
+		n, err := strconv.Atoi(line[1:])
+		if err != nil || n < 0 {
+			return nil, err
+		}
+		buf := make([]byte, n+2)
+		if _, err := io.ReadFull(r, buf); err != nil {
+			return nil, err
+		}
+		return string(buf[:n]), nil
+	case '*':
+		n, err := strconv.Atoi(line[1:])
+		if err != nil || n < 0 {
+			return nil, err
+		}
+		items := make([]interface{}, n)
+		for i := range items {
+			item, err := readRedisReply(r)
+			if _, isReply := err.(redisError); err != nil && !isReply {
+				return nil, err
+			}
+			items[i] = item
+		}
+		return items, nil
+	}
+	return nil, fmt.Errorf("redis: unexpected reply %q", line)
+}
@@ -0,0 +1,49 @@
+package servicekit
+
+import (
+	"context"
+	"fmt"
+	"testing"
+	"time"
+)
+
+// This test runs two replicas side by side against the same Redis
+// (TEST_REDIS_URL), as in docker-compose, and is skipped without it. Each
+// replica has its own rate limiter.
+
+// TestReplicasShareRateLimits checks a client cannot multiply its limit by
+// spreading requests over replicas
+func TestReplicasShareRateLimits(t *testing.T) {
+	redisURL := getEnv("TEST_REDIS_URL", "")
+	if redisURL == "" {
+		t.Skip("TEST_REDIS_URL is not set")
+	}
+	t.Setenv("RATE_LIMIT_BACKEND", "redis")
+	t.Setenv("REDIS_URL", redisURL)
+	a := NewRateLimiter("0", "0", nil)
+	b := NewRateLimiter("0", "0", nil)
+
+	ctx := context.Background()
+	policy := rateLimitPolicy{Count: 3, Period: time.Minute}
+	key := fmt.Sprintf("test:replicas:%d", time.Now().UnixNano())
+	// The shared store is asked directly: allow would hide a Redis failure
+	// behind each replica's own buckets
+	for i, replica := range []*RateLimiter{a, b, a} {
+		ok, _, err := replica.store.take(ctx, key, policy)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !ok {
+			t.Fatalf("request %d refused within the limit", i+1)
+		}
+	}
+	for _, replica := range []*RateLimiter{a, b} {
+		ok, _, err := replica.store.take(ctx, key, policy)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if ok {
+			t.Fatal("request over the limit allowed by another replica")
+		}
+	}
+}
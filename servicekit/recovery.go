@@ -0,0 +1,414 @@
+package servicekit
+
+import (
+	"bytes"
+	"context"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	mathrand "math/rand"
+	"net/http"
+	"net/url"
+	"runtime/debug"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gorilla/mux"
+	"go.uber.org/zap"
+)
+
+// ErrorReport describes a recovered panic, a 5xx response or a failed
+// background job
+type ErrorReport struct {
+	ID          string    `json:"id"`   // correlation ID returned to the client as X-Request-ID
+	Kind        string    `json:"kind"` // panic, http_error or job
+	Level       string    `json:"level"`
+	Service     string    `json:"service"`
+	Release     string    `json:"release,omitempty"`
+	Environment string    `json:"environment"`
+	Message     string    `json:"message"`
+	Stack       string    `json:"stack,omitempty"`
+	Method      string    `json:"method,omitempty"`
+	Path        string    `json:"path,omitempty"`
+	Route       string    `json:"route,omitempty"` // path template, which groups reports of one endpoint
+	Status      int       `json:"status,omitempty"`
+	UserID      string    `json:"user_id,omitempty"`
+	Job         string    `json:"job,omitempty"`
+	Time        time.Time `json:"time"`
+}
+
+// ErrorReporter sends recovered panics to an error tracker
+type ErrorReporter interface {
+	Report(ctx context.Context, report ErrorReport) error
+}
+
+var errorReporter ErrorReporter = logReporter{}
+
+// errorReports queues reports for the sender goroutine; reports are
+// dropped rather than delaying requests when the tracker falls behind
+var errorReports = make(chan ErrorReport, 100)
+
+// errorSampleRate is the share of 5xx responses and job failures reported,
+// ERROR_SAMPLE_RATE (0 to 1, default 1). Panics are always reported.
+var errorSampleRate = 1.0
+
+// InitErrorReporting selects the reporter from ERROR_REPORTER: "log"
+// (default), "sentry" (SENTRY_DSN) or "rollbar" (ROLLBAR_ACCESS_TOKEN).
+// Reports are tagged with RELEASE and APP_ENV.
+func InitErrorReporting() {
+	if rate, err := strconv.ParseFloat(getEnv("ERROR_SAMPLE_RATE", "1"), 64); err == nil && rate >= 0 && rate <= 1 {
+		errorSampleRate = rate
+	} else {
+		logger.Warn("invalid ERROR_SAMPLE_RATE, reporting every error")
+	}
+	go func() {
+		for report := range errorReports {
+			sendErrorReport(report)
+		}
+	}()
+
+	switch name := getEnv("ERROR_REPORTER", "log"); name {
+	case "log":
+	case "sentry":
+		reporter, err := newSentryReporter(getEnv("SENTRY_DSN", ""))
+		if err != nil {
+			logger.Fatal("invalid SENTRY_DSN", zap.Error(err))
+		}
+		errorReporter = reporter
+	case "rollbar":
+		token := getEnv("ROLLBAR_ACCESS_TOKEN", "")
+		if token == "" {
+			logger.Fatal("ROLLBAR_ACCESS_TOKEN is required for the rollbar error reporter")
+		}
+		errorReporter = rollbarReporter{token: token}
+	default:
+		logger.Fatal("unknown ERROR_REPORTER", zap.String("reporter", name))
+	}
+}
+
+var errorReportClient = &http.Client{Timeout: 5 * time.Second}
+
+// ReportError fills in the service details and queues the report. Reports
+// other than panics are sampled.
+func ReportError(report ErrorReport) {
+	if report.Kind != "panic" && errorSampleRate < 1 && mathrand.Float64() >= errorSampleRate {
+		return
+	}
+	report.Service = service.Name
+	report.Release = getEnv("RELEASE", "")
+	report.Environment = getEnv("APP_ENV", "development")
+	if report.ID == "" {
+		report.ID = NewCorrelationID()
+	}
+	if report.Time.IsZero() {
+		report.Time = time.Now().UTC()
+	}
+	select {
+	case errorReports <- report:
+	default:
+		logger.Warn("error report queue full, dropped report",
+			zap.String("kind", report.Kind), zap.String("report_id", report.ID))
+	}
+}
+
+func sendErrorReport(report ErrorReport) {
+	ctx, cancel := context.WithTimeout(service.Context, 10*time.Second)
+	defer cancel()
+	if err := errorReporter.Report(ctx, report); err != nil {
+		logger.Error("failed to send error report",
+			zap.String("kind", report.Kind), zap.String("report_id", report.ID), zap.Error(err))
+	}
+}
+
+// ReportJobError logs and reports a failed run of a background job
+func ReportJobError(job string, err error) {
+	logger.Error("background job failed", zap.String("job", job), zap.Error(err))
+	ReportError(ErrorReport{Kind: "job", Level: "error", Job: job, Message: err.Error()})
+}
+
+// ReportJobPanic is deferred by background job goroutines. It reports a
+// panic synchronously, since the process is about to exit, and re-panics.
+func ReportJobPanic(job string) {
+	recovered := recover()
+	if recovered == nil {
+		return
+	}
+	sendErrorReport(ErrorReport{
+		ID:          NewCorrelationID(),
+		Kind:        "panic",
+		Level:       "fatal",
+		Service:     service.Name,
+		Release:     getEnv("RELEASE", ""),
+		Environment: getEnv("APP_ENV", "development"),
+		Job:         job,
+		Message:     fmt.Sprint(recovered),
+		Stack:       string(debug.Stack()),
+		Time:        time.Now().UTC(),
+	})
+	panic(recovered)
+}
+
+// internalErrorMessages are what clients are told instead of the plain text
+// body of these statuses, which is how handlers answer with an internal error
+// such as a failed query or an unreachable peer
+var internalErrorMessages = map[int]string{
+	http.StatusInternalServerError: "Internal server error",
+	http.StatusBadGateway:          "A service this request depends on failed",
+}
+
+// errorBodyLimit is how much of a 5xx body is kept for the log and the report
+const errorBodyLimit = 2048
+
+// errorCapture records the status and the start of the body of a response.
+// An internal error is held back rather than written.
+type errorCapture struct {
+	http.ResponseWriter
+	status int
+	body   []byte
+	masked bool
+}
+
+func (c *errorCapture) WriteHeader(status int) {
+	if c.status == 0 {
+		c.status = status
+		_, internal := internalErrorMessages[status]
+		c.masked = internal && strings.HasPrefix(c.Header().Get("Content-Type"), "text/plain")
+	}
+	if !c.masked {
+		c.ResponseWriter.WriteHeader(status)
+	}
+}
+
+func (c *errorCapture) Write(b []byte) (int, error) {
+	if c.status == 0 {
+		c.status = http.StatusOK
+	}
+	if c.status >= 500 && len(c.body) < errorBodyLimit {
+		n := len(b)
+		if n > errorBodyLimit-len(c.body) {
+			n = errorBodyLimit - len(c.body)
+		}
+		c.body = append(c.body, b[:n]...)
+	}
+	if c.masked {
+		return len(b), nil
+	}
+	return c.ResponseWriter.Write(b)
+}
+
+// ErrorReportingMiddleware reports 5xx responses with their route, status,
+// caller and error message. It runs inside the router so the route template
+// and the authenticated user are known. Internal errors are logged with the
+// request ID, which the client gets in their place, so SQL and driver
+// details never leave the service.
+func ErrorReportingMiddleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		capture := &errorCapture{ResponseWriter: w}
+		next.ServeHTTP(capture, r)
+		if capture.status < 500 {
+			return
+		}
+
+		route := ""
+		if current := mux.CurrentRoute(r); current != nil {
+			route, _ = current.GetPathTemplate()
+		}
+		message := strings.TrimSpace(string(capture.body))
+		if message == "" {
+			message = http.StatusText(capture.status)
+		}
+		if capture.masked {
+			RequestLogger(r.Context()).Error("internal error serving request", zap.String("method", r.Method),
+				zap.String("route", route), zap.Int("status", capture.status), zap.String("error", message))
+			http.Error(w, internalErrorMessages[capture.status]+" (request "+RequestID(r.Context())+")", capture.status)
+		}
+		ReportError(ErrorReport{
+			ID:      RequestID(r.Context()),
+			Kind:    "http_error",
+			Level:   "error",
+			Message: fmt.Sprintf("%d %s %s: %s", capture.status, r.Method, route, message),
+			Method:  r.Method,
+			Path:    r.URL.Path,
+			Route:   route,
+			Status:  capture.status,
+			UserID:  r.Header.Get("X-User-ID"),
+		})
+	})
+}
+
+// RecoveryMiddleware turns a handler panic into a 500 carrying a correlation
+// ID and reports the panic with its stack. Aborted handlers
+// (http.ErrAbortHandler) are left to net/http.
+func RecoveryMiddleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		defer func() {
+			recovered := recover()
+			if recovered == nil {
+				return
+			}
+			if recovered == http.ErrAbortHandler {
+				panic(recovered)
+			}
+
+			report := ErrorReport{
+				ID:      RequestID(r.Context()),
+				Kind:    "panic",
+				Level:   "fatal",
+				Message: fmt.Sprint(recovered),
+				Stack:   string(debug.Stack()),
+				Method:  r.Method,
+				Path:    r.URL.Path,
+				Status:  http.StatusInternalServerError,
+				UserID:  r.Header.Get("X-User-ID"),
+			}
+			if report.ID == "" {
+				report.ID = NewCorrelationID()
+			}
+			RequestLogger(r.Context()).Error("panic serving request",
+				zap.String("method", r.Method), zap.String("path", r.URL.Path), zap.String("panic", report.Message))
+			ReportError(report)
+
+			// The response may have started already; then this only ends it
+			http.Error(w, "Internal server error (request "+report.ID+")", http.StatusInternalServerError)
+		}()
+		next.ServeHTTP(w, r)
+	})
+}
+
+// logReporter writes the stack to the service log
+type logReporter struct{}
+
+func (logReporter) Report(_ context.Context, report ErrorReport) error {
+	if report.Kind == "panic" {
+		logger.Error("panic stack", zap.String("report_id", report.ID), zap.String("stack", report.Stack))
+	}
+	return nil
+}
+
+func postErrorReport(ctx context.Context, endpoint string, headers map[string]string, payload interface{}) error {
+	body, err := json.Marshal(payload)
+	if err != nil {
+		return err
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, endpoint, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	for name, value := range headers {
+		req.Header.Set(name, value)
+	}
+	resp, err := errorReportClient.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode >= 300 {
+		return fmt.Errorf("error tracker returned status %d", resp.StatusCode)
+	}
+	return nil
+}
+
+// sentryReporter posts events to a Sentry project's store endpoint
+type sentryReporter struct {
+	endpoint  string
+	publicKey string
+}
+
+// newSentryReporter parses a DSN of the form https://<key>@<host>/<project>
+func newSentryReporter(dsn string) (sentryReporter, error) {
+	u, err := url.Parse(dsn)
+	if err != nil {
+		return sentryReporter{}, err
+	}
+	project := strings.Trim(u.Path, "/")
+	if u.User == nil || u.User.Username() == "" || project == "" {
+		return sentryReporter{}, fmt.Errorf("DSN must include a key and a project")
+	}
+	return sentryReporter{
+		endpoint:  fmt.Sprintf("%s://%s/api/%s/store/", u.Scheme, u.Host, project),
+		publicKey: u.User.Username(),
+	}, nil
+}
+
+func (s sentryReporter) Report(ctx context.Context, report ErrorReport) error {
+	// Sentry requires a UUID event ID; a caller's other X-Request-ID is kept as a tag
+	eventID := strings.ReplaceAll(report.ID, "-", "")
+	if _, err := hex.DecodeString(eventID); err != nil || len(eventID) != 32 {
+		eventID = strings.ReplaceAll(NewCorrelationID(), "-", "")
+	}
+	event := map[string]interface{}{
+		"event_id":    eventID,
+		"timestamp":   report.Time.Format(time.RFC3339),
+		"level":       report.Level,
+		"platform":    "go",
+		"logger":      report.Service,
+		"release":     report.Release,
+		"environment": report.Environment,
+		"message":     report.Message,
+		"exception": map[string]interface{}{
+			"values": []map[string]string{{"type": report.Kind, "value": report.Message}},
+		},
+		"request": map[string]string{"method": report.Method, "url": report.Path},
+		"tags":    reportTags(report),
+		"extra":   map[string]string{"stack": report.Stack},
+	}
+	if report.UserID != "" {
+		event["user"] = map[string]string{"id": report.UserID}
+	}
+	// Group by endpoint or job rather than by message, which carries details
+	if report.Route != "" || report.Job != "" {
+		event["fingerprint"] = []string{report.Kind, report.Method, report.Route, report.Job}
+	}
+	auth := fmt.Sprintf("Sentry sentry_version=7, sentry_client=bank-%s/1.0, sentry_key=%s", report.Service, s.publicKey)
+	return postErrorReport(ctx, s.endpoint, map[string]string{"X-Sentry-Auth": auth}, event)
+}
+
+// rollbarReporter posts items to the Rollbar API
+type rollbarReporter struct {
+	token string
+}
+
+func (r rollbarReporter) Report(ctx context.Context, report ErrorReport) error {
+	level := report.Level
+	if level == "fatal" {
+		level = "critical"
+	}
+	data := map[string]interface{}{
+		"environment":  report.Environment,
+		"code_version": report.Release,
+		"level":        level,
+		"timestamp":    report.Time.Unix(),
+		"platform":     "go",
+		"language":     "go",
+		"body": map[string]interface{}{
+			"message": map[string]string{"body": report.Message, "stack": report.Stack},
+		},
+		"request": map[string]string{"method": report.Method, "url": report.Path},
+		"custom":  reportTags(report),
+	}
+	if report.UserID != "" {
+		data["person"] = map[string]string{"id": report.UserID}
+	}
+	if report.Route != "" || report.Job != "" {
+		data["fingerprint"] = strings.Join([]string{report.Kind, report.Method, report.Route, report.Job}, " ")
+	}
+	return postErrorReport(ctx, "https://api.rollbar.com/api/1/item/", map[string]string{"X-Rollbar-Access-Token": r.token},
+		map[string]interface{}{"data": data})
+}
+
+// reportTags are the searchable attributes of a report
+func reportTags(report ErrorReport) map[string]string {
+	tags := map[string]string{"service": report.Service, "request_id": report.ID, "kind": report.Kind}
+	if report.Route != "" {
+		tags["route"] = report.Route
+	}
+	if report.Status != 0 {
+		tags["status"] = strconv.Itoa(report.Status)
+	}
+	if report.Job != "" {
+		tags["job"] = report.Job
+	}
+	return tags
+}
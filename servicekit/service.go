@@ -0,0 +1,67 @@
+// Package servicekit is the code the bank services share: logging, metrics,
+// SLO tracking, anomaly detection, load shedding, error reporting, schema
+// migrations, service identity, access token claims, signing keys, the
+// startup probe, API versioning and the OpenAPI document. A service calls
+// Configure once, from the initializer of its logger, before using anything
+// else in the package.
+package servicekit
+
+import (
+	"context"
+	"database/sql"
+	"io/fs"
+	"os"
+
+	"go.uber.org/zap"
+)
+
+// Service describes the service using the package
+type Service struct {
+	// Name identifies the service in logs, metrics, reports and its schema
+	// version table, e.g. "account-service"
+	Name string
+	// DB returns the service database, nil until it is connected
+	DB func() *sql.DB
+	// Context is canceled once the service has shut down. Background jobs
+	// run their queries with it.
+	Context context.Context
+	// Migrations holds the service's numbered SQL migrations in a
+	// migrations directory, usually embedded in the binary
+	Migrations fs.FS
+}
+
+var (
+	service = Service{Context: context.Background()}
+	logger  = zap.NewNop()
+)
+
+// Configure sets up the package for s and returns the service logger
+func Configure(s Service) *zap.Logger {
+	if s.Context == nil {
+		s.Context = context.Background()
+	}
+	service = s
+	logger = newLogger()
+	// Anything still using the standard logger, such as net/http's own
+	// errors, is written through the service logger as well
+	zap.RedirectStdLog(logger)
+	return logger
+}
+
+// db returns the service database, or nil before it is connected
+func db() *sql.DB {
+	if service.DB == nil {
+		return nil
+	}
+	return service.DB()
+}
+
+// getEnv returns the environment variable key, or defaultValue when it is
+// unset or empty
+func getEnv(key, defaultValue string) string {
+	value := os.Getenv(key)
+	if value == "" {
+		return defaultValue
+	}
+	return value
+}
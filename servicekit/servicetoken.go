@@ -0,0 +1,227 @@
+package servicekit
+
+import (
+	"context"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+
+	"go.uber.org/zap"
+)
+
+// Until every service has an SVID, internal calls carry a short-lived service
+// token in X-Service-Token. The token names the calling service (iss), the
+// service it is for (aud), the method and path of the one request it
+// authorizes, and a nonce that the receiving service records so the token
+// cannot be replayed. Each service signs with its own SERVICE_TOKEN_KEY and
+// verifies peers with SERVICE_TOKEN_PEER_KEYS. A customer JWT is never
+// accepted in its place.
+
+// ServiceTokenHeader carries the service token of an internal request
+const ServiceTokenHeader = "X-Service-Token"
+
+// ServiceTokenTablesSQL creates the table of spent token nonces. A service
+// accepting service tokens adds it to its schema.
+const ServiceTokenTablesSQL = `
+	CREATE TABLE IF NOT EXISTS service_token_nonces (
+		audience VARCHAR(100) NOT NULL,
+		nonce VARCHAR(64) NOT NULL,
+		expires_at TIMESTAMP NOT NULL,
+		PRIMARY KEY (audience, nonce)
+	);
+	CREATE INDEX IF NOT EXISTS idx_service_token_nonces_expires ON service_token_nonces(expires_at);`
+
+const (
+	// ServiceTokenSkew is the clock difference tolerated between services
+	ServiceTokenSkew = 5 * time.Second
+	// serviceTokenMaxTTL caps the lifetime a peer may give its tokens
+	serviceTokenMaxTTL = 2 * time.Minute
+)
+
+var ErrInvalidServiceToken = errors.New("Invalid service token")
+
+// ServiceTokenClaims are the claims of a service token
+type ServiceTokenClaims struct {
+	Issuer   string `json:"iss"`
+	Audience string `json:"aud"`
+	Method   string `json:"htm"`
+	Path     string `json:"htu"`
+	IssuedAt int64  `json:"iat"`
+	Expires  int64  `json:"exp"`
+	Nonce    string `json:"jti"`
+}
+
+var (
+	serviceTokenKey      []byte
+	serviceTokenPeerKeys = map[string][]byte{}
+	// serviceTokenAudiences maps the host of each known service URL to its name
+	serviceTokenAudiences = map[string]string{}
+)
+
+// InitServiceTokens loads the service token keys and the services they are
+// sent to. Tokens are not issued without SERVICE_TOKEN_KEY and not accepted
+// without SERVICE_TOKEN_PEER_KEYS ("auth-service=key;account-service=key").
+func InitServiceTokens() {
+	serviceTokenKey = []byte(getEnv("SERVICE_TOKEN_KEY", ""))
+	for _, entry := range strings.Split(getEnv("SERVICE_TOKEN_PEER_KEYS", ""), ";") {
+		name, key, ok := strings.Cut(strings.TrimSpace(entry), "=")
+		if ok && key != "" {
+			serviceTokenPeerKeys[name] = []byte(key)
+		}
+	}
+
+	services := map[string]string{
+		"account-service":      getEnv("ACCOUNT_SERVICE_URL", "http://localhost:8080"),
+		"transaction-service":  getEnv("TRANSACTION_SERVICE_URL", "http://localhost:8081"),
+		"auth-service":         getEnv("AUTH_SERVICE_URL", "http://localhost:8082"),
+		"notification-service": getEnv("NOTIFICATION_SERVICE_URL", "http://localhost:8083"),
+		"customer-service":     getEnv("CUSTOMER_SERVICE_URL", "http://localhost:8084"),
+	}
+	for name, serviceURL := range services {
+		if u, err := url.Parse(serviceURL); err == nil && name != service.Name {
+			serviceTokenAudiences[u.Host] = name
+		}
+	}
+}
+
+// ServiceTokensAccepted reports whether peers may authenticate with a
+// service token
+func ServiceTokensAccepted() bool {
+	return len(serviceTokenPeerKeys) > 0
+}
+
+// ServiceTokensIssued reports whether the service sends a service token with
+// its internal requests
+func ServiceTokensIssued() bool {
+	return len(serviceTokenKey) > 0
+}
+
+// serviceTokenTTL is the lifetime of tokens this service issues
+func serviceTokenTTL() time.Duration {
+	ttl, err := time.ParseDuration(getEnv("SERVICE_TOKEN_TTL", "30s"))
+	if err != nil || ttl <= 0 || ttl > serviceTokenMaxTTL {
+		return 30 * time.Second
+	}
+	return ttl
+}
+
+func signServiceToken(key []byte, payload string) string {
+	mac := hmac.New(sha256.New, key)
+	mac.Write([]byte(payload))
+	return base64.RawURLEncoding.EncodeToString(mac.Sum(nil))
+}
+
+// IssueServiceToken returns a token authorizing one request to audience
+func IssueServiceToken(audience, method, path string) (string, error) {
+	nonce := make([]byte, 16)
+	if _, err := rand.Read(nonce); err != nil {
+		return "", err
+	}
+	now := time.Now()
+	claims, err := json.Marshal(ServiceTokenClaims{
+		Issuer:   service.Name,
+		Audience: audience,
+		Method:   method,
+		Path:     path,
+		IssuedAt: now.Unix(),
+		Expires:  now.Add(serviceTokenTTL()).Unix(),
+		Nonce:    hex.EncodeToString(nonce),
+	})
+	if err != nil {
+		return "", err
+	}
+	payload := base64.RawURLEncoding.EncodeToString(claims)
+	return payload + "." + signServiceToken(serviceTokenKey, payload), nil
+}
+
+// VerifyServiceToken checks the request's service token and consumes its
+// nonce, returning the calling service
+func VerifyServiceToken(r *http.Request) (string, error) {
+	return VerifyServiceTokenFor(r.Context(), r.Header.Get(ServiceTokenHeader), r.Method, r.URL.Path)
+}
+
+// VerifyServiceTokenFor checks a service token presented for method and path
+// and consumes its nonce, returning the calling service. gRPC calls present
+// theirs for POST and the full method name.
+func VerifyServiceTokenFor(ctx context.Context, token, method, path string) (string, error) {
+	payload, signature, ok := strings.Cut(token, ".")
+	if !ok {
+		return "", ErrInvalidServiceToken
+	}
+	raw, err := base64.RawURLEncoding.DecodeString(payload)
+	if err != nil {
+		return "", ErrInvalidServiceToken
+	}
+	var claims ServiceTokenClaims
+	if err := json.Unmarshal(raw, &claims); err != nil {
+		return "", ErrInvalidServiceToken
+	}
+	key, known := serviceTokenPeerKeys[claims.Issuer]
+	if !known || !hmac.Equal([]byte(signature), []byte(signServiceToken(key, payload))) {
+		return "", ErrInvalidServiceToken
+	}
+
+	now := time.Now()
+	issued, expires := time.Unix(claims.IssuedAt, 0), time.Unix(claims.Expires, 0)
+	switch {
+	case claims.Audience != service.Name, claims.Method != method, claims.Path != path, claims.Nonce == "":
+		return "", ErrInvalidServiceToken
+	case issued.After(now.Add(ServiceTokenSkew)), now.After(expires.Add(ServiceTokenSkew)),
+		expires.Sub(issued) > serviceTokenMaxTTL:
+		return "", ErrInvalidServiceToken
+	}
+
+	result, err := db().ExecContext(ctx, `INSERT INTO service_token_nonces (audience, nonce, expires_at)
+										VALUES ($1, $2, $3) ON CONFLICT DO NOTHING`,
+		service.Name, claims.Issuer+":"+claims.Nonce, expires.Add(ServiceTokenSkew))
+	if err != nil {
+		return "", err
+	}
+	if n, _ := result.RowsAffected(); n == 0 {
+		RequestLogger(ctx).Warn("rejected replayed service token",
+			zap.String("issuer", claims.Issuer), zap.String("method", method), zap.String("path", path))
+		return "", ErrInvalidServiceToken
+	}
+	return claims.Issuer, nil
+}
+
+// ServiceTokenTransport adds a service token to requests for known services
+type ServiceTokenTransport struct {
+	Base http.RoundTripper
+}
+
+func (t ServiceTokenTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	audience := serviceTokenAudiences[req.URL.Host]
+	if audience == "" {
+		return t.Base.RoundTrip(req)
+	}
+	token, err := IssueServiceToken(audience, req.Method, req.URL.Path)
+	if err != nil {
+		return nil, err
+	}
+	req = req.Clone(req.Context())
+	req.Header.Set(ServiceTokenHeader, token)
+	return t.Base.RoundTrip(req)
+}
+
+// StartServiceTokenNonceExpiry removes nonces of expired tokens every minute
+func StartServiceTokenNonceExpiry() {
+	go func() {
+		defer ReportJobPanic("Service token nonce expiry")
+		for {
+			_, err := db().ExecContext(service.Context, `DELETE FROM service_token_nonces WHERE expires_at < NOW()`)
+			if err != nil {
+				ReportJobError("Service token nonce expiry", err)
+			}
+			time.Sleep(time.Minute)
+		}
+	}()
+}
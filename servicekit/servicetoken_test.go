@@ -0,0 +1,86 @@
+package servicekit
+
+import (
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"testing"
+	"time"
+)
+
+// testServiceToken returns a token from issuer signed with key, after edit
+// changes its claims
+func testServiceToken(t *testing.T, issuer string, key []byte, edit func(*ServiceTokenClaims)) string {
+	t.Helper()
+	now := time.Now()
+	claims := ServiceTokenClaims{
+		Issuer:   issuer,
+		Audience: service.Name,
+		Method:   "POST",
+		Path:     "/v1/accounts/70/hold",
+		IssuedAt: now.Unix(),
+		Expires:  now.Add(30 * time.Second).Unix(),
+		Nonce:    "0123456789abcdef",
+	}
+	if edit != nil {
+		edit(&claims)
+	}
+	raw, err := json.Marshal(claims)
+	if err != nil {
+		t.Fatal(err)
+	}
+	payload := base64.RawURLEncoding.EncodeToString(raw)
+	return payload + "." + signServiceToken(key, payload)
+}
+
+// TestVerifyServiceTokenRejects covers forged tokens and tokens minted for
+// another service or request, which are refused before their nonce is spent
+func TestVerifyServiceTokenRejects(t *testing.T) {
+	previous := service
+	service.Name = "account-service"
+	peerKey := []byte("transaction-service-key")
+	serviceTokenPeerKeys = map[string][]byte{"transaction-service": peerKey}
+	defer func() { service, serviceTokenPeerKeys = previous, map[string][]byte{} }()
+
+	cases := []struct {
+		name  string
+		token string
+	}{
+		{"signed with another key", testServiceToken(t, "transaction-service", []byte("forged"), nil)},
+		{"from an unknown service", testServiceToken(t, "billing-service", peerKey, nil)},
+		{"claiming another issuer", testServiceToken(t, "auth-service", peerKey, nil)},
+		{"minted for another service", testServiceToken(t, "transaction-service", peerKey, func(c *ServiceTokenClaims) {
+			c.Audience = "customer-service"
+		})},
+		{"for another path", testServiceToken(t, "transaction-service", peerKey, func(c *ServiceTokenClaims) {
+			c.Path = "/v1/accounts/80/hold"
+		})},
+		{"for another method", testServiceToken(t, "transaction-service", peerKey, func(c *ServiceTokenClaims) {
+			c.Method = "DELETE"
+		})},
+		{"expired", testServiceToken(t, "transaction-service", peerKey, func(c *ServiceTokenClaims) {
+			c.IssuedAt = time.Now().Add(-time.Minute).Unix()
+			c.Expires = time.Now().Add(-30 * time.Second).Unix()
+		})},
+		{"issued in the future", testServiceToken(t, "transaction-service", peerKey, func(c *ServiceTokenClaims) {
+			c.IssuedAt = time.Now().Add(time.Minute).Unix()
+			c.Expires = time.Now().Add(90 * time.Second).Unix()
+		})},
+		{"living too long", testServiceToken(t, "transaction-service", peerKey, func(c *ServiceTokenClaims) {
+			c.Expires = time.Now().Add(time.Hour).Unix()
+		})},
+		{"without a nonce", testServiceToken(t, "transaction-service", peerKey, func(c *ServiceTokenClaims) {
+			c.Nonce = ""
+		})},
+		{"not a token", "garbage"},
+	}
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			_, err := VerifyServiceTokenFor(context.Background(), c.token, "POST", "/v1/accounts/70/hold")
+			if !errors.Is(err, ErrInvalidServiceToken) {
+				t.Fatalf("error %v, want ErrInvalidServiceToken", err)
+			}
+		})
+	}
+}
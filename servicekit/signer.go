@@ -0,0 +1,369 @@
+package servicekit
+
+import (
+	"bytes"
+	"context"
+	"crypto"
+	"crypto/hmac"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/json"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"go.uber.org/zap"
+)
+
+// Signer produces signatures with a key held by a signing backend. Remote
+// backends keep the private key inside the KMS or HSM; only the message
+// leaves the process and only the signature comes back.
+type Signer interface {
+	// KeyID identifies the key version that signs, e.g. "jwt:v3"
+	KeyID() string
+	// Algorithm is the JOSE algorithm of the signatures (HS256, ES256 or RS256)
+	Algorithm() string
+	// Sign returns the raw signature of message. ECDSA signatures are the
+	// fixed-length r||s form used by JWS.
+	Sign(ctx context.Context, message []byte) ([]byte, error)
+	// PublicKeys returns the public key of every key version by key ID, or
+	// nil for symmetric keys
+	PublicKeys() map[string]crypto.PublicKey
+}
+
+var ErrSignerUnavailable = errors.New("signing backend unavailable")
+
+// NewSigner returns the signer selected by SIGNING_BACKEND for the named key.
+// "local" (the default) signs with HMAC-SHA256 using secret held in memory;
+// "vault" uses the transit engine of a Vault server, which can itself keep
+// keys in a PKCS#11 HSM or a cloud KMS through managed keys.
+func NewSigner(keyName string, secret []byte) (Signer, error) {
+	switch getEnv("SIGNING_BACKEND", "local") {
+	case "local":
+		return &localSigner{keyID: "local", secret: secret}, nil
+	case "vault":
+		return newVaultTransitSigner(keyName)
+	default:
+		return nil, fmt.Errorf("unsupported signing backend: %s", getEnv("SIGNING_BACKEND", ""))
+	}
+}
+
+// localSigner signs with an in-memory HMAC secret
+type localSigner struct {
+	keyID  string
+	secret []byte
+}
+
+func (s *localSigner) KeyID() string     { return s.keyID }
+func (s *localSigner) Algorithm() string { return "HS256" }
+
+func (s *localSigner) Sign(ctx context.Context, message []byte) ([]byte, error) {
+	mac := hmac.New(sha256.New, s.secret)
+	mac.Write(message)
+	return mac.Sum(nil), nil
+}
+
+func (s *localSigner) PublicKeys() map[string]crypto.PublicKey { return nil }
+
+// vaultTransitSigner signs through the Vault transit secrets engine
+type vaultTransitSigner struct {
+	addr   string
+	token  string
+	mount  string
+	name   string
+	client *http.Client
+
+	mu        sync.RWMutex
+	algorithm string
+	latest    int
+	keys      map[string]crypto.PublicKey
+}
+
+func newVaultTransitSigner(keyName string) (*vaultTransitSigner, error) {
+	s := &vaultTransitSigner{
+		addr:   strings.TrimRight(getEnv("VAULT_ADDR", "http://localhost:8200"), "/"),
+		token:  getEnv("VAULT_TOKEN", ""),
+		mount:  getEnv("VAULT_TRANSIT_MOUNT", "transit"),
+		name:   keyName,
+		client: &http.Client{Timeout: 3 * time.Second},
+	}
+	if s.token == "" {
+		return nil, fmt.Errorf("VAULT_TOKEN is required for the vault signing backend")
+	}
+	if err := s.refreshKeys(context.Background()); err != nil {
+		return nil, err
+	}
+	return s, nil
+}
+
+func (s *vaultTransitSigner) call(ctx context.Context, method, path string, body, out interface{}) error {
+	var payload []byte
+	if body != nil {
+		payload, _ = json.Marshal(body)
+	}
+	req, err := http.NewRequestWithContext(ctx, method, s.addr+"/v1/"+s.mount+path, bytes.NewReader(payload))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("X-Vault-Token", s.token)
+	req.Header.Set("Content-Type", "application/json")
+
+	resp, err := s.client.Do(req)
+	if err != nil {
+		return fmt.Errorf("%w: %v", ErrSignerUnavailable, err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("%w: vault returned status %d for %s", ErrSignerUnavailable, resp.StatusCode, path)
+	}
+	return json.NewDecoder(resp.Body).Decode(out)
+}
+
+// refreshKeys loads the public key of every version so tokens signed before
+// a rotation still verify
+func (s *vaultTransitSigner) refreshKeys(ctx context.Context) error {
+	var resp struct {
+		Data struct {
+			Type          string `json:"type"`
+			LatestVersion int    `json:"latest_version"`
+			Keys          map[string]struct {
+				PublicKey string `json:"public_key"`
+			} `json:"keys"`
+		} `json:"data"`
+	}
+	if err := s.call(ctx, http.MethodGet, "/keys/"+s.name, nil, &resp); err != nil {
+		return err
+	}
+
+	var algorithm string
+	switch {
+	case resp.Data.Type == "ecdsa-p256":
+		algorithm = "ES256"
+	case strings.HasPrefix(resp.Data.Type, "rsa-"):
+		algorithm = "RS256"
+	default:
+		return fmt.Errorf("vault key %s has unsupported type %q", s.name, resp.Data.Type)
+	}
+
+	keys := map[string]crypto.PublicKey{}
+	for version, k := range resp.Data.Keys {
+		block, _ := pem.Decode([]byte(k.PublicKey))
+		if block == nil {
+			return fmt.Errorf("vault key %s version %s has no public key", s.name, version)
+		}
+		public, err := x509.ParsePKIXPublicKey(block.Bytes)
+		if err != nil {
+			return fmt.Errorf("vault key %s version %s: %v", s.name, version, err)
+		}
+		keys[s.name+":v"+version] = public
+	}
+
+	s.mu.Lock()
+	s.algorithm, s.latest, s.keys = algorithm, resp.Data.LatestVersion, keys
+	s.mu.Unlock()
+	return nil
+}
+
+func (s *vaultTransitSigner) KeyID() string {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	return s.name + ":v" + strconv.Itoa(s.latest)
+}
+
+func (s *vaultTransitSigner) Algorithm() string {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	return s.algorithm
+}
+
+func (s *vaultTransitSigner) PublicKeys() map[string]crypto.PublicKey {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	return s.keys
+}
+
+func (s *vaultTransitSigner) Sign(ctx context.Context, message []byte) ([]byte, error) {
+	s.mu.RLock()
+	version := s.latest
+	s.mu.RUnlock()
+
+	var resp struct {
+		Data struct {
+			Signature string `json:"signature"`
+		} `json:"data"`
+	}
+	err := s.call(ctx, http.MethodPost, "/sign/"+s.name+"/sha2-256", map[string]interface{}{
+		"input":                base64.StdEncoding.EncodeToString(message),
+		"key_version":          version,
+		"marshaling_algorithm": "jws",
+		"signature_algorithm":  "pkcs1v15",
+	}, &resp)
+	if err != nil {
+		return nil, err
+	}
+
+	// Signatures look like vault:v3:<base64url>
+	parts := strings.SplitN(resp.Data.Signature, ":", 3)
+	if len(parts) != 3 {
+		return nil, fmt.Errorf("unexpected vault signature format")
+	}
+	if parts[1] != "v"+strconv.Itoa(version) {
+		// The key was rotated between loading and signing; pick up the new version
+		if err := s.refreshKeys(ctx); err != nil {
+			RequestLogger(ctx).Error("failed to refresh vault key", zap.String("key", s.name), zap.Error(err))
+		}
+	}
+	return base64.RawURLEncoding.DecodeString(strings.TrimRight(parts[2], "="))
+}
+
+// SigningKeyUsage counts the operations performed with one key
+type SigningKeyUsage struct {
+	KeyID        string    `json:"key_id"`
+	Algorithm    string    `json:"algorithm"`
+	Purpose      string    `json:"purpose"`
+	Signatures   int64     `json:"signatures"`
+	Failures     int64     `json:"failures"`
+	AvgLatencyMs float64   `json:"avg_latency_ms"`
+	LastUsedAt   time.Time `json:"last_used_at"`
+
+	totalLatency time.Duration
+}
+
+// Usage is gathered per replica and added to signing_key_usage every minute,
+// so the report covers every replica of the service
+const SigningUsageTablesSQL = `
+	CREATE TABLE IF NOT EXISTS signing_key_usage (
+		service VARCHAR(50) NOT NULL,
+		purpose VARCHAR(50) NOT NULL,
+		key_id VARCHAR(255) NOT NULL,
+		algorithm VARCHAR(20) NOT NULL,
+		signatures BIGINT NOT NULL DEFAULT 0,
+		failures BIGINT NOT NULL DEFAULT 0,
+		total_latency_us BIGINT NOT NULL DEFAULT 0,
+		last_used_at TIMESTAMP NOT NULL,
+		PRIMARY KEY (service, purpose, key_id)
+	);`
+
+var (
+	signingUsage   = map[string]*SigningKeyUsage{}
+	signingUsageMu sync.Mutex
+)
+
+// MeteredSigner records per-key usage of the signer it wraps
+type MeteredSigner struct {
+	Signer
+	Purpose string
+}
+
+func (s MeteredSigner) Sign(ctx context.Context, message []byte) ([]byte, error) {
+	start := time.Now()
+	signature, err := s.Signer.Sign(ctx, message)
+	elapsed := time.Since(start)
+
+	key := s.Purpose + "/" + s.KeyID()
+	signingUsageMu.Lock()
+	u, ok := signingUsage[key]
+	if !ok {
+		u = &SigningKeyUsage{KeyID: s.KeyID(), Algorithm: s.Algorithm(), Purpose: s.Purpose}
+		signingUsage[key] = u
+	}
+	if err != nil {
+		u.Failures++
+	} else {
+		u.Signatures++
+		u.totalLatency += elapsed
+	}
+	u.LastUsedAt = start
+	signingUsageMu.Unlock()
+	return signature, err
+}
+
+// flushSigningKeyUsage adds the usage gathered since the last flush to
+// signing_key_usage
+func flushSigningKeyUsage(ctx context.Context) error {
+	signingUsageMu.Lock()
+	pending := signingUsage
+	signingUsage = map[string]*SigningKeyUsage{}
+	signingUsageMu.Unlock()
+
+	for key, u := range pending {
+		_, err := db().ExecContext(ctx, `INSERT INTO signing_key_usage (service, purpose, key_id, algorithm, signatures,
+									   failures, total_latency_us, last_used_at)
+									   VALUES ($1, $2, $3, $4, $5, $6, $7, $8)
+									   ON CONFLICT (service, purpose, key_id) DO UPDATE SET
+										   signatures = signing_key_usage.signatures + EXCLUDED.signatures,
+										   failures = signing_key_usage.failures + EXCLUDED.failures,
+										   total_latency_us = signing_key_usage.total_latency_us + EXCLUDED.total_latency_us,
+										   last_used_at = GREATEST(signing_key_usage.last_used_at, EXCLUDED.last_used_at)`,
+			service.Name, u.Purpose, u.KeyID, u.Algorithm, u.Signatures, u.Failures, u.totalLatency.Microseconds(),
+			u.LastUsedAt.UTC())
+		if err != nil {
+			// Keep the rest for the next flush
+			signingUsageMu.Lock()
+			for k, rest := range pending {
+				if p, ok := signingUsage[k]; ok {
+					p.Signatures += rest.Signatures
+					p.Failures += rest.Failures
+					p.totalLatency += rest.totalLatency
+					if rest.LastUsedAt.After(p.LastUsedAt) {
+						p.LastUsedAt = rest.LastUsedAt
+					}
+				} else {
+					signingUsage[k] = rest
+				}
+			}
+			signingUsageMu.Unlock()
+			return err
+		}
+		delete(pending, key)
+	}
+	return nil
+}
+
+// StartSigningKeyUsageFlush writes this replica's key usage every minute
+func StartSigningKeyUsageFlush() {
+	go func() {
+		defer ReportJobPanic("Signing key usage flush")
+		for {
+			time.Sleep(time.Minute)
+			if err := flushSigningKeyUsage(service.Context); err != nil {
+				ReportJobError("Signing key usage flush", err)
+			}
+		}
+	}()
+}
+
+// SigningKeyUsageReport returns the usage of every key across the service's
+// replicas, ordered by key. This replica's usage is flushed first so the
+// report includes it.
+func SigningKeyUsageReport(ctx context.Context) ([]SigningKeyUsage, error) {
+	if err := flushSigningKeyUsage(ctx); err != nil {
+		return nil, err
+	}
+	rows, err := db().QueryContext(ctx, `SELECT purpose, key_id, algorithm, signatures, failures, total_latency_us, last_used_at
+									   FROM signing_key_usage WHERE service = $1 ORDER BY purpose, key_id`, service.Name)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	report := []SigningKeyUsage{}
+	for rows.Next() {
+		var u SigningKeyUsage
+		var latencyUs int64
+		if err := rows.Scan(&u.Purpose, &u.KeyID, &u.Algorithm, &u.Signatures, &u.Failures, &latencyUs, &u.LastUsedAt); err != nil {
+			return nil, err
+		}
+		if u.Signatures > 0 {
+			u.AvgLatencyMs = float64(latencyUs) / 1000 / float64(u.Signatures)
+		}
+		report = append(report, u)
+	}
+	return report, rows.Err()
+}
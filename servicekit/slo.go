@@ -0,0 +1,496 @@
+package servicekit
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"go.uber.org/zap"
+)
+
+// Service level objectives are tracked per endpoint ("GET /v1/accounts/{id}").
+// Two SLIs are computed from the requests MetricsMiddleware sees:
+// availability, the share of requests not answered with a 5xx, and latency,
+// the share answered within the endpoint's threshold. Each replica adds its
+// per-minute counts to slo_samples, so reports and alerts cover the whole
+// service rather than one instance.
+
+const SLOTablesSQL = `
+	CREATE TABLE IF NOT EXISTS slo_samples (
+		service VARCHAR(50) NOT NULL,
+		endpoint VARCHAR(200) NOT NULL,
+		minute TIMESTAMP NOT NULL,
+		total BIGINT NOT NULL DEFAULT 0,
+		errors BIGINT NOT NULL DEFAULT 0,
+		slow BIGINT NOT NULL DEFAULT 0,
+		PRIMARY KEY (service, endpoint, minute)
+	);
+	CREATE INDEX IF NOT EXISTS idx_slo_samples_minute ON slo_samples(service, minute);
+	CREATE TABLE IF NOT EXISTS slo_alerts (
+		service VARCHAR(50) NOT NULL,
+		endpoint VARCHAR(200) NOT NULL,
+		sli VARCHAR(20) NOT NULL,
+		severity VARCHAR(20) NOT NULL,
+		burn_rate DOUBLE PRECISION NOT NULL,
+		fired_at TIMESTAMP NOT NULL DEFAULT NOW(),
+		PRIMARY KEY (service, endpoint, sli, severity)
+	);`
+
+// SLOObjective is the target of both SLIs of an endpoint
+type SLOObjective struct {
+	Availability     float64       `json:"availability_target"` // e.g. 0.999
+	Latency          float64       `json:"latency_target"`      // share of requests within LatencyThreshold
+	LatencyThreshold time.Duration `json:"-"`
+}
+
+// sloDefaultObjective applies to endpoints without an override:
+// SLO_AVAILABILITY_TARGET (0.999), SLO_LATENCY_TARGET (0.99) and
+// SLO_LATENCY_THRESHOLD (500ms)
+func sloDefaultObjective() SLOObjective {
+	o := SLOObjective{Availability: 0.999, Latency: 0.99, LatencyThreshold: 500 * time.Millisecond}
+	if v, err := strconv.ParseFloat(getEnv("SLO_AVAILABILITY_TARGET", ""), 64); err == nil && v > 0 && v < 1 {
+		o.Availability = v
+	}
+	if v, err := strconv.ParseFloat(getEnv("SLO_LATENCY_TARGET", ""), 64); err == nil && v > 0 && v < 1 {
+		o.Latency = v
+	}
+	if d, err := time.ParseDuration(getEnv("SLO_LATENCY_THRESHOLD", "")); err == nil && d > 0 {
+		o.LatencyThreshold = d
+	}
+	return o
+}
+
+var (
+	sloObjectivesOnce sync.Once
+	sloDefault        SLOObjective
+	sloOverrides      map[string]SLOObjective
+)
+
+// sloObjective returns the endpoint's objective. SLO_OBJECTIVES overrides
+// endpoints as "GET /v1/accounts/{id}=0.9995,0.99,300ms;POST /v1/auth/login=0.999,0.95,1s"
+// (availability, latency target, latency threshold).
+func sloObjective(endpoint string) SLOObjective {
+	sloObjectivesOnce.Do(func() {
+		sloDefault = sloDefaultObjective()
+		sloOverrides = map[string]SLOObjective{}
+		for _, entry := range strings.Split(getEnv("SLO_OBJECTIVES", ""), ";") {
+			name, value, ok := strings.Cut(strings.TrimSpace(entry), "=")
+			if !ok {
+				continue
+			}
+			o := sloDefault
+			parts := strings.Split(value, ",")
+			if v, err := strconv.ParseFloat(strings.TrimSpace(parts[0]), 64); err == nil && v > 0 && v < 1 {
+				o.Availability = v
+			}
+			if len(parts) > 1 {
+				if v, err := strconv.ParseFloat(strings.TrimSpace(parts[1]), 64); err == nil && v > 0 && v < 1 {
+					o.Latency = v
+				}
+			}
+			if len(parts) > 2 {
+				if d, err := time.ParseDuration(strings.TrimSpace(parts[2])); err == nil && d > 0 {
+					o.LatencyThreshold = d
+				}
+			}
+			sloOverrides[strings.TrimSpace(name)] = o
+		}
+	})
+	if o, ok := sloOverrides[endpoint]; ok {
+		return o
+	}
+	return sloDefault
+}
+
+// sloWindow is the period error budgets are computed over, SLO_WINDOW
+func sloWindow() time.Duration {
+	window, err := time.ParseDuration(getEnv("SLO_WINDOW", "720h"))
+	if err != nil || window <= time.Hour {
+		return 720 * time.Hour
+	}
+	return window
+}
+
+type sloCounts struct {
+	total, errors, slow int64
+}
+
+type sloSampleKey struct {
+	endpoint string
+	minute   time.Time
+}
+
+var (
+	sloMu      sync.Mutex
+	sloPending = map[sloSampleKey]*sloCounts{}
+)
+
+// recordSLOSample counts a request towards its endpoint's SLIs
+func recordSLOSample(endpoint string, status int, elapsed time.Duration) {
+	key := sloSampleKey{endpoint: endpoint, minute: time.Now().UTC().Truncate(time.Minute)}
+	sloMu.Lock()
+	defer sloMu.Unlock()
+	c, ok := sloPending[key]
+	if !ok {
+		c = &sloCounts{}
+		sloPending[key] = c
+	}
+	c.total++
+	if status >= 500 {
+		c.errors++
+	}
+	if elapsed > sloObjective(endpoint).LatencyThreshold {
+		c.slow++
+	}
+}
+
+// flushSLOSamples adds the counts gathered since the last flush to slo_samples
+func flushSLOSamples(ctx context.Context) error {
+	sloMu.Lock()
+	pending := sloPending
+	sloPending = map[sloSampleKey]*sloCounts{}
+	sloMu.Unlock()
+
+	for key, c := range pending {
+		_, err := db().ExecContext(ctx, `INSERT INTO slo_samples (service, endpoint, minute, total, errors, slow)
+									   VALUES ($1, $2, $3, $4, $5, $6)
+									   ON CONFLICT (service, endpoint, minute) DO UPDATE SET
+										   total = slo_samples.total + EXCLUDED.total,
+										   errors = slo_samples.errors + EXCLUDED.errors,
+										   slow = slo_samples.slow + EXCLUDED.slow`,
+			service.Name, key.endpoint, key.minute, c.total, c.errors, c.slow)
+		if err != nil {
+			// Keep the rest for the next flush
+			sloMu.Lock()
+			for k, rest := range pending {
+				if p, ok := sloPending[k]; ok {
+					p.total += rest.total
+					p.errors += rest.errors
+					p.slow += rest.slow
+				} else {
+					sloPending[k] = rest
+				}
+			}
+			sloMu.Unlock()
+			return err
+		}
+		delete(pending, key)
+	}
+	return nil
+}
+
+// SLIReport is one SLI of an endpoint over the SLO window
+type SLIReport struct {
+	Target          float64            `json:"target"`
+	SLI             float64            `json:"sli"` // 1 when there was no traffic
+	Good            int64              `json:"good"`
+	Total           int64              `json:"total"`
+	BudgetRemaining float64            `json:"error_budget_remaining"` // share of the budget left, negative once exhausted
+	BurnRates       map[string]float64 `json:"burn_rates"`             // per lookback window; 1 spends the budget exactly over the SLO window
+}
+
+// SLOReport is the SLO status of one endpoint
+type SLOReport struct {
+	Endpoint           string    `json:"endpoint"`
+	LatencyThresholdMs int64     `json:"latency_threshold_ms"`
+	Availability       SLIReport `json:"availability"`
+	Latency            SLIReport `json:"latency"`
+}
+
+// burnRateWindows are the lookbacks burn rates are reported for
+var burnRateWindows = []struct {
+	name   string
+	period time.Duration
+}{
+	{"5m", 5 * time.Minute},
+	{"30m", 30 * time.Minute},
+	{"1h", time.Hour},
+	{"6h", 6 * time.Hour},
+	{"3d", 72 * time.Hour},
+}
+
+// sloWindowCounts sums each endpoint's samples since from
+func sloWindowCounts(ctx context.Context, from time.Time) (map[string]sloCounts, error) {
+	rows, err := db().QueryContext(ctx, `SELECT endpoint, SUM(total), SUM(errors), SUM(slow) FROM slo_samples
+									   WHERE service = $1 AND minute >= $2 GROUP BY endpoint`, service.Name, from)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	counts := map[string]sloCounts{}
+	for rows.Next() {
+		var endpoint string
+		var c sloCounts
+		if err := rows.Scan(&endpoint, &c.total, &c.errors, &c.slow); err != nil {
+			return nil, err
+		}
+		counts[endpoint] = c
+	}
+	return counts, rows.Err()
+}
+
+func burnRate(bad, total int64, target float64) float64 {
+	if total == 0 {
+		return 0
+	}
+	return (float64(bad) / float64(total)) / (1 - target)
+}
+
+func sliReport(bad, total int64, target float64) SLIReport {
+	r := SLIReport{Target: target, SLI: 1, Good: total - bad, Total: total, BudgetRemaining: 1, BurnRates: map[string]float64{}}
+	if total > 0 {
+		r.SLI = float64(total-bad) / float64(total)
+		r.BudgetRemaining = 1 - burnRate(bad, total, target)
+	}
+	return r
+}
+
+// sloReports computes the status of every endpoint with traffic in the window
+func sloReports(ctx context.Context) ([]SLOReport, error) {
+	now := time.Now().UTC()
+	window, err := sloWindowCounts(ctx, now.Add(-sloWindow()))
+	if err != nil {
+		return nil, err
+	}
+	reports := map[string]*SLOReport{}
+	for endpoint, c := range window {
+		o := sloObjective(endpoint)
+		reports[endpoint] = &SLOReport{
+			Endpoint:           endpoint,
+			LatencyThresholdMs: o.LatencyThreshold.Milliseconds(),
+			Availability:       sliReport(c.errors, c.total, o.Availability),
+			Latency:            sliReport(c.slow, c.total, o.Latency),
+		}
+	}
+	for _, w := range burnRateWindows {
+		counts, err := sloWindowCounts(ctx, now.Add(-w.period))
+		if err != nil {
+			return nil, err
+		}
+		for endpoint, report := range reports {
+			c := counts[endpoint]
+			o := sloObjective(endpoint)
+			report.Availability.BurnRates[w.name] = burnRate(c.errors, c.total, o.Availability)
+			report.Latency.BurnRates[w.name] = burnRate(c.slow, c.total, o.Latency)
+		}
+	}
+
+	list := make([]SLOReport, 0, len(reports))
+	for _, report := range reports {
+		list = append(list, *report)
+	}
+	sort.Slice(list, func(i, j int) bool { return list[i].Endpoint < list[j].Endpoint })
+	return list, nil
+}
+
+// SLOHandler reports the SLO status of every endpoint, or of ?endpoint=.
+// Like /metrics it requires METRICS_TOKEN when that is set.
+func SLOHandler(w http.ResponseWriter, r *http.Request) {
+	if !metricsAuthorized(w, r) {
+		return
+	}
+	reports, err := sloReports(r.Context())
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	if endpoint := r.URL.Query().Get("endpoint"); endpoint != "" {
+		filtered := []SLOReport{}
+		for _, report := range reports {
+			if report.Endpoint == endpoint {
+				filtered = append(filtered, report)
+			}
+		}
+		reports = filtered
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"service":      service.Name,
+		"window_hours": int(sloWindow().Hours()),
+		"endpoints":    reports,
+	})
+}
+
+// SLOAlert is raised when an SLI burns its error budget too fast
+type SLOAlert struct {
+	Service  string  `json:"service"`
+	Endpoint string  `json:"endpoint"`
+	SLI      string  `json:"sli"`      // availability or latency
+	Severity string  `json:"severity"` // page or ticket
+	BurnRate float64 `json:"burn_rate"`
+	Window   string  `json:"window"`
+	Target   float64 `json:"target"`
+	Message  string  `json:"message"`
+}
+
+// SLOAlertHook is notified of SLO alerts
+type SLOAlertHook interface {
+	Fire(ctx context.Context, alert SLOAlert) error
+}
+
+// sloAlertHooks always log; SLO_ALERT_WEBHOOK_URL adds a JSON webhook
+// (Alertmanager, Slack workflow or incident tooling)
+var sloAlertHooks = []SLOAlertHook{logAlertHook{}}
+
+// sloBurnAlerts are multiwindow burn rate alerts: both the long and the
+// short window must burn faster than the threshold, so an alert fires quickly
+// on a sharp outage and clears soon after it ends
+var sloBurnAlerts = []struct {
+	severity    string
+	long, short string
+	threshold   float64
+}{
+	{"page", "1h", "5m", 14.4},  // 2% of a 30 day budget in an hour
+	{"ticket", "6h", "30m", 6},  // 5% of the budget in six hours
+	{"ticket", "3d", "6h", 1.0}, // on course to exhaust the budget
+}
+
+// sloMinRequests is the traffic an endpoint needs in the short window before
+// it can alert, so one failed request on a quiet endpoint does not page
+const sloMinRequests = 20
+
+// sloAlertInterval is how long an alert stays quiet after firing
+const sloAlertInterval = time.Hour
+
+// StartSLOTracking flushes samples every minute, evaluates burn rate alerts
+// and deletes samples older than the SLO window
+func StartSLOTracking() {
+	if url := getEnv("SLO_ALERT_WEBHOOK_URL", ""); url != "" {
+		sloAlertHooks = append(sloAlertHooks, webhookAlertHook{url: url})
+	}
+	go func() {
+		defer ReportJobPanic("SLO tracking")
+		for {
+			time.Sleep(time.Minute)
+			if err := flushSLOSamples(service.Context); err != nil {
+				ReportJobError("SLO sample flush", err)
+				continue
+			}
+			if err := evaluateSLOAlerts(service.Context); err != nil {
+				ReportJobError("SLO alert evaluation", err)
+			}
+			_, err := db().ExecContext(service.Context, `DELETE FROM slo_samples WHERE service = $1 AND minute < $2`,
+				service.Name, time.Now().UTC().Add(-sloWindow()-24*time.Hour))
+			if err != nil {
+				ReportJobError("SLO sample expiry", err)
+			}
+		}
+	}()
+}
+
+// evaluateSLOAlerts fires the burn rate alerts that hold. The slo_alerts row
+// makes only one replica fire each alert per sloAlertInterval.
+func evaluateSLOAlerts(ctx context.Context) error {
+	reports, err := sloReports(ctx)
+	if err != nil {
+		return err
+	}
+	now := time.Now().UTC()
+	shortCounts := map[string]map[string]sloCounts{}
+	for _, rule := range sloBurnAlerts {
+		if _, ok := shortCounts[rule.short]; ok {
+			continue
+		}
+		for _, w := range burnRateWindows {
+			if w.name == rule.short {
+				if shortCounts[rule.short], err = sloWindowCounts(ctx, now.Add(-w.period)); err != nil {
+					return err
+				}
+			}
+		}
+	}
+
+	for _, report := range reports {
+		for _, sli := range []struct {
+			name   string
+			report SLIReport
+		}{{"availability", report.Availability}, {"latency", report.Latency}} {
+			for _, rule := range sloBurnAlerts {
+				long, short := sli.report.BurnRates[rule.long], sli.report.BurnRates[rule.short]
+				if long < rule.threshold || short < rule.threshold || shortCounts[rule.short][report.Endpoint].total < sloMinRequests {
+					continue
+				}
+				alert := SLOAlert{
+					Service:  service.Name,
+					Endpoint: report.Endpoint,
+					SLI:      sli.name,
+					Severity: rule.severity,
+					BurnRate: long,
+					Window:   rule.long,
+					Target:   sli.report.Target,
+					Message: fmt.Sprintf("%s %s %s error budget burning %.1fx over %s (threshold %.1fx)",
+						service.Name, report.Endpoint, sli.name, long, rule.long, rule.threshold),
+				}
+				if err := fireSLOAlert(ctx, alert); err != nil {
+					return err
+				}
+				break // the most severe matching rule only
+			}
+		}
+	}
+	return nil
+}
+
+func fireSLOAlert(ctx context.Context, alert SLOAlert) error {
+	result, err := db().ExecContext(ctx, `INSERT INTO slo_alerts (service, endpoint, sli, severity, burn_rate)
+										VALUES ($1, $2, $3, $4, $5)
+										ON CONFLICT (service, endpoint, sli, severity) DO UPDATE
+										SET burn_rate = EXCLUDED.burn_rate, fired_at = NOW()
+										WHERE slo_alerts.fired_at < NOW() - $6 * INTERVAL '1 second'`,
+		alert.Service, alert.Endpoint, alert.SLI, alert.Severity, alert.BurnRate, int(sloAlertInterval/time.Second))
+	if err != nil {
+		return err
+	}
+	if n, _ := result.RowsAffected(); n == 0 {
+		return nil
+	}
+	for _, hook := range sloAlertHooks {
+		if err := hook.Fire(ctx, alert); err != nil {
+			logger.Error("SLO alert hook failed", zap.String("endpoint", alert.Endpoint), zap.Error(err))
+		}
+	}
+	return nil
+}
+
+// logAlertHook writes alerts to the service log
+type logAlertHook struct{}
+
+func (logAlertHook) Fire(_ context.Context, alert SLOAlert) error {
+	logger.Warn("SLO alert", zap.String("severity", alert.Severity), zap.String("endpoint", alert.Endpoint),
+		zap.String("sli", alert.SLI), zap.Float64("burn_rate", alert.BurnRate), zap.String("message", alert.Message))
+	return nil
+}
+
+// webhookAlertHook posts alerts as JSON
+type webhookAlertHook struct {
+	url string
+}
+
+func (h webhookAlertHook) Fire(ctx context.Context, alert SLOAlert) error {
+	payload, err := json.Marshal(alert)
+	if err != nil {
+		return err
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, h.url, bytes.NewReader(payload))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	resp, err := errorReportClient.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode >= 300 {
+		return fmt.Errorf("alert webhook returned status %d", resp.StatusCode)
+	}
+	return nil
+}
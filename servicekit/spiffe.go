@@ -0,0 +1,310 @@
+package servicekit
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gorilla/mux"
+	"go.uber.org/zap"
+)
+
+// Service identity follows SPIFFE. With SPIFFE_ENABLED=true the service reads
+// its X.509 SVID and the trust bundle from SPIFFE_SVID_DIR, where the SPIRE
+// agent (through spiffe-helper) writes and rotates svid.pem, svid_key.pem and
+// bundle.pem. It then serves mTLS, presents its SVID when calling other
+// services and authorizes peers by their SPIFFE ID rather than shared secrets.
+
+// SPIFFESource holds the current SVID and trust bundle
+type SPIFFESource struct {
+	trustDomain string
+	dir         string
+
+	mu    sync.RWMutex
+	id    string
+	cert  *tls.Certificate
+	roots *x509.CertPool
+}
+
+// WorkloadIdentity is nil unless SPIFFE is enabled
+var WorkloadIdentity *SPIFFESource
+
+// InitSPIFFE loads the workload SVID when SPIFFE_ENABLED is true and keeps it
+// fresh as the agent rotates it
+func InitSPIFFE() {
+	if getEnv("SPIFFE_ENABLED", "false") != "true" {
+		return
+	}
+	s := &SPIFFESource{
+		trustDomain: getEnv("SPIFFE_TRUST_DOMAIN", "bank.internal"),
+		dir:         getEnv("SPIFFE_SVID_DIR", "/run/spiffe/certs"),
+	}
+	if err := s.reload(); err != nil {
+		logger.Fatal("failed to load SPIFFE SVID", zap.Error(err))
+	}
+	logger.Info("using SPIFFE identity", zap.String("spiffe_id", s.id))
+	go func() {
+		for {
+			time.Sleep(time.Minute)
+			if err := s.reload(); err != nil {
+				logger.Error("failed to reload SPIFFE SVID", zap.Error(err))
+			}
+		}
+	}()
+	WorkloadIdentity = s
+}
+
+// PeerIdentityEnabled reports whether peers prove their identity, with an SVID
+// or a service token
+func PeerIdentityEnabled() bool {
+	return WorkloadIdentity != nil || ServiceTokensAccepted()
+}
+
+func (s *SPIFFESource) reload() error {
+	cert, err := tls.LoadX509KeyPair(filepath.Join(s.dir, "svid.pem"), filepath.Join(s.dir, "svid_key.pem"))
+	if err != nil {
+		return err
+	}
+	leaf, err := x509.ParseCertificate(cert.Certificate[0])
+	if err != nil {
+		return err
+	}
+	id, err := s.SPIFFEID(leaf)
+	if err != nil {
+		return err
+	}
+
+	bundle, err := os.ReadFile(filepath.Join(s.dir, "bundle.pem"))
+	if err != nil {
+		return err
+	}
+	roots := x509.NewCertPool()
+	for block, rest := pem.Decode(bundle); block != nil; block, rest = pem.Decode(rest) {
+		ca, err := x509.ParseCertificate(block.Bytes)
+		if err != nil {
+			return err
+		}
+		roots.AddCert(ca)
+	}
+
+	s.mu.Lock()
+	s.id, s.cert, s.roots = id, &cert, roots
+	s.mu.Unlock()
+	return nil
+}
+
+// SPIFFEID returns the SPIFFE ID of an SVID in our trust domain
+func (s *SPIFFESource) SPIFFEID(cert *x509.Certificate) (string, error) {
+	var ids []*url.URL
+	for _, uri := range cert.URIs {
+		if uri.Scheme == "spiffe" {
+			ids = append(ids, uri)
+		}
+	}
+	if len(ids) != 1 {
+		return "", errors.New("SVID must have exactly one SPIFFE ID")
+	}
+	if ids[0].Host != s.trustDomain {
+		return "", fmt.Errorf("SPIFFE ID %s is not in trust domain %s", ids[0], s.trustDomain)
+	}
+	return ids[0].String(), nil
+}
+
+// verifyPeer checks a peer's SVID chains to the trust bundle. SVIDs carry no
+// DNS names, so this replaces hostname verification.
+func (s *SPIFFESource) verifyPeer(rawCerts [][]byte, _ [][]*x509.Certificate) error {
+	if len(rawCerts) == 0 {
+		return nil
+	}
+	certs := make([]*x509.Certificate, len(rawCerts))
+	for i, raw := range rawCerts {
+		cert, err := x509.ParseCertificate(raw)
+		if err != nil {
+			return err
+		}
+		certs[i] = cert
+	}
+	intermediates := x509.NewCertPool()
+	for _, cert := range certs[1:] {
+		intermediates.AddCert(cert)
+	}
+
+	s.mu.RLock()
+	roots := s.roots
+	s.mu.RUnlock()
+	_, err := certs[0].Verify(x509.VerifyOptions{Roots: roots, Intermediates: intermediates,
+		KeyUsages: []x509.ExtKeyUsage{x509.ExtKeyUsageAny}})
+	if err != nil {
+		return err
+	}
+	_, err = s.SPIFFEID(certs[0])
+	return err
+}
+
+func (s *SPIFFESource) currentCertificate() *tls.Certificate {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	return s.cert
+}
+
+// ServerTLSConfig requests an SVID from every client. Set
+// SPIFFE_REQUIRE_PEER_SVID=true once all callers, including the gateway, have
+// one.
+func (s *SPIFFESource) ServerTLSConfig() *tls.Config {
+	clientAuth := tls.RequestClientCert
+	if getEnv("SPIFFE_REQUIRE_PEER_SVID", "false") == "true" {
+		clientAuth = tls.RequireAnyClientCert
+	}
+	return &tls.Config{
+		MinVersion: tls.VersionTLS12,
+		ClientAuth: clientAuth,
+		GetCertificate: func(*tls.ClientHelloInfo) (*tls.Certificate, error) {
+			return s.currentCertificate(), nil
+		},
+		VerifyPeerCertificate: s.verifyPeer,
+	}
+}
+
+// ClientTLSConfig presents our SVID and accepts servers with an SVID from the
+// trust domain
+func (s *SPIFFESource) ClientTLSConfig() *tls.Config {
+	return &tls.Config{
+		MinVersion: tls.VersionTLS12,
+		// Chain and SPIFFE ID are checked by verifyPeer instead of the hostname
+		InsecureSkipVerify: true,
+		GetClientCertificate: func(*tls.CertificateRequestInfo) (*tls.Certificate, error) {
+			return s.currentCertificate(), nil
+		},
+		VerifyPeerCertificate: func(rawCerts [][]byte, chains [][]*x509.Certificate) error {
+			if len(rawCerts) == 0 {
+				return errors.New("server presented no SVID")
+			}
+			return s.verifyPeer(rawCerts, chains)
+		},
+	}
+}
+
+// UseWorkloadIdentity makes clients of other services present the SVID and,
+// when SERVICE_TOKEN_KEY is set, a service token, and pass on the request ID
+func UseWorkloadIdentity(clients ...*http.Client) {
+	for _, client := range clients {
+		var transport http.RoundTripper = http.DefaultTransport
+		if WorkloadIdentity != nil {
+			tlsTransport := http.DefaultTransport.(*http.Transport).Clone()
+			tlsTransport.TLSClientConfig = WorkloadIdentity.ClientTLSConfig()
+			transport = tlsTransport
+		}
+		if ServiceTokensIssued() {
+			transport = ServiceTokenTransport{Base: transport}
+		}
+		client.Transport = RequestIDTransport{Base: transport}
+	}
+}
+
+// peerService returns the service name of the peer's SVID, the last segment
+// of its SPIFFE ID (spiffe://bank.internal/ns/bank/sa/account-service), or ""
+// for callers without one
+func peerService(r *http.Request) string {
+	if WorkloadIdentity == nil || r.TLS == nil || len(r.TLS.PeerCertificates) == 0 {
+		return ""
+	}
+	id, err := WorkloadIdentity.SPIFFEID(r.TLS.PeerCertificates[0])
+	if err != nil {
+		return ""
+	}
+	return id[strings.LastIndex(id, "/")+1:]
+}
+
+// peerServiceKey holds the peer service ServiceIdentityMiddleware verified
+type peerServiceKey struct{}
+
+// VerifiedPeer returns the peer service a request came from, or "" for
+// callers without a service identity
+func VerifiedPeer(ctx context.Context) string {
+	peer, _ := ctx.Value(peerServiceKey{}).(string)
+	return peer
+}
+
+// LoadServicePermissions returns the routes each peer service may call, from
+// SPIFFE_PERMISSIONS ("account-service=POST /transactions|GET /transactions/{id};api-gateway=*")
+// or defaults. Routes are written without the version prefix.
+func LoadServicePermissions(defaults map[string][]string) map[string]map[string]bool {
+	grants := defaults
+	if value := getEnv("SPIFFE_PERMISSIONS", ""); value != "" {
+		grants = map[string][]string{}
+		for _, entry := range strings.Split(value, ";") {
+			peer, routes, ok := strings.Cut(strings.TrimSpace(entry), "=")
+			if ok {
+				grants[peer] = strings.Split(routes, "|")
+			}
+		}
+	}
+	permissions := map[string]map[string]bool{}
+	for peer, routes := range grants {
+		permissions[peer] = map[string]bool{}
+		for _, route := range routes {
+			permissions[peer][strings.TrimSpace(route)] = true
+		}
+	}
+	return permissions
+}
+
+// ServiceIdentityMiddleware limits peers presenting an SVID or a service
+// token to the routes their service is granted, and serviceOnly routes to
+// such peers
+func ServiceIdentityMiddleware(permissions map[string]map[string]bool, serviceOnly map[string]bool) mux.MiddlewareFunc {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			if !PeerIdentityEnabled() {
+				next.ServeHTTP(w, r)
+				return
+			}
+			template := ""
+			if route := mux.CurrentRoute(r); route != nil {
+				template, _ = route.GetPathTemplate()
+			}
+			for _, prefix := range []string{"/v1", "/v2"} {
+				template = strings.TrimPrefix(template, prefix)
+			}
+			route := r.Method + " " + template
+
+			peer := peerService(r)
+			if peer == "" && r.Header.Get(ServiceTokenHeader) != "" && ServiceTokensAccepted() {
+				var err error
+				peer, err = VerifyServiceToken(r)
+				if errors.Is(err, ErrInvalidServiceToken) {
+					http.Error(w, ErrInvalidServiceToken.Error(), http.StatusUnauthorized)
+					return
+				}
+				if err != nil {
+					http.Error(w, err.Error(), http.StatusInternalServerError)
+					return
+				}
+			}
+			if peer == "" {
+				if serviceOnly[route] {
+					http.Error(w, "Service identity required", http.StatusUnauthorized)
+					return
+				}
+				next.ServeHTTP(w, r)
+				return
+			}
+			if granted := permissions[peer]; !granted["*"] && !granted[route] {
+				RequestLogger(r.Context()).Warn("denied peer service", zap.String("route", route), zap.String("peer", peer))
+				http.Error(w, "Service not permitted", http.StatusForbidden)
+				return
+			}
+			next.ServeHTTP(w, r.WithContext(context.WithValue(r.Context(), peerServiceKey{}, peer)))
+		})
+	}
+}
@@ -0,0 +1,130 @@
+package servicekit
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"math/big"
+	"net/http/httptest"
+	"net/url"
+	"testing"
+	"time"
+)
+
+// testCA is a certificate authority issuing test SVIDs
+type testCA struct {
+	cert *x509.Certificate
+	key  *ecdsa.PrivateKey
+}
+
+func newTestCA(t *testing.T) testCA {
+	t.Helper()
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	template := &x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		Subject:               pkix.Name{CommonName: "test trust bundle"},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(time.Hour),
+		IsCA:                  true,
+		BasicConstraintsValid: true,
+		KeyUsage:              x509.KeyUsageCertSign,
+	}
+	raw, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cert, err := x509.ParseCertificate(raw)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return testCA{cert: cert, key: key}
+}
+
+// issue returns the DER of an SVID carrying spiffeIDs
+func (ca testCA) issue(t *testing.T, spiffeIDs ...string) []byte {
+	t.Helper()
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(2),
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+		KeyUsage:     x509.KeyUsageDigitalSignature,
+	}
+	for _, id := range spiffeIDs {
+		u, err := url.Parse(id)
+		if err != nil {
+			t.Fatal(err)
+		}
+		template.URIs = append(template.URIs, u)
+	}
+	raw, err := x509.CreateCertificate(rand.Reader, template, ca.cert, &key.PublicKey, ca.key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return raw
+}
+
+// TestVerifyPeerSVID covers SVIDs that are forged or name a workload outside
+// the trust domain
+func TestVerifyPeerSVID(t *testing.T) {
+	ca, rogue := newTestCA(t), newTestCA(t)
+	roots := x509.NewCertPool()
+	roots.AddCert(ca.cert)
+	source := &SPIFFESource{trustDomain: "bank.internal", roots: roots}
+
+	cases := []struct {
+		name   string
+		svid   []byte
+		accept bool
+	}{
+		{"issued by the trust bundle", ca.issue(t, "spiffe://bank.internal/ns/bank/sa/transaction-service"), true},
+		{"issued by another CA", rogue.issue(t, "spiffe://bank.internal/ns/bank/sa/transaction-service"), false},
+		{"another trust domain", ca.issue(t, "spiffe://evil.example/ns/bank/sa/transaction-service"), false},
+		{"two SPIFFE IDs", ca.issue(t, "spiffe://bank.internal/ns/bank/sa/transaction-service",
+			"spiffe://bank.internal/ns/bank/sa/auth-service"), false},
+		{"no SPIFFE ID", ca.issue(t), false},
+	}
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			err := source.verifyPeer([][]byte{c.svid}, nil)
+			if c.accept && err != nil {
+				t.Fatalf("rejected: %v", err)
+			}
+			if !c.accept && err == nil {
+				t.Fatal("accepted")
+			}
+		})
+	}
+}
+
+// TestPeerService checks peers are named by their SPIFFE ID, and not at all
+// when it is outside the trust domain
+func TestPeerService(t *testing.T) {
+	ca := newTestCA(t)
+	WorkloadIdentity = &SPIFFESource{trustDomain: "bank.internal"}
+	defer func() { WorkloadIdentity = nil }()
+
+	for id, want := range map[string]string{
+		"spiffe://bank.internal/ns/bank/sa/transaction-service": "transaction-service",
+		"spiffe://evil.example/ns/bank/sa/transaction-service":  "",
+	} {
+		cert, err := x509.ParseCertificate(ca.issue(t, id))
+		if err != nil {
+			t.Fatal(err)
+		}
+		r := httptest.NewRequest("GET", "/v1/accounts/70", nil)
+		r.TLS = &tls.ConnectionState{PeerCertificates: []*x509.Certificate{cert}}
+		if got := peerService(r); got != want {
+			t.Errorf("peer %s: service %q, want %q", id, got, want)
+		}
+	}
+}
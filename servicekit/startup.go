@@ -0,0 +1,60 @@
+package servicekit
+
+import (
+	"encoding/json"
+	"net/http"
+	"strings"
+	"sync/atomic"
+
+	"go.uber.org/zap"
+)
+
+// The listener comes up before the database is migrated so Kubernetes can
+// tell a replica that is still migrating from one that is stuck. Until the
+// router takes over, /health answers for the liveness probe, /startup
+// reports the startup phase and every other request gets a 503.
+
+// Startup phases reported by /startup
+const (
+	PhaseStarting  = "starting"
+	PhaseMigrating = "migrating"
+	PhaseReady     = "ready"
+)
+
+var startupPhase atomic.Value
+
+func init() {
+	startupPhase.Store(PhaseStarting)
+}
+
+// SetStartupPhase records the phase the service has reached
+func SetStartupPhase(phase string) {
+	startupPhase.Store(phase)
+	logger.Info("startup phase", zap.String("phase", phase))
+}
+
+// StartupProbe answers 200 once the service is ready and 503 before, with
+// the phase in the body; use it as the startup and readiness probe
+func StartupProbe(w http.ResponseWriter, r *http.Request) {
+	phase := startupPhase.Load().(string)
+	w.Header().Set("Content-Type", "application/json")
+	if phase != PhaseReady {
+		w.WriteHeader(http.StatusServiceUnavailable)
+	}
+	json.NewEncoder(w).Encode(map[string]string{"status": phase})
+}
+
+// StartingHandler serves requests that arrive before the router is ready
+func StartingHandler() http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch strings.TrimPrefix(strings.TrimPrefix(r.URL.Path, "/v1"), "/v2") {
+		case "/health":
+			json.NewEncoder(w).Encode(map[string]bool{"status": true})
+		case "/startup":
+			StartupProbe(w, r)
+		default:
+			w.Header().Set("Retry-After", "5")
+			http.Error(w, "Service starting", http.StatusServiceUnavailable)
+		}
+	})
+}
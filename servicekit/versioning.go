@@ -0,0 +1,53 @@
+package servicekit
+
+import (
+	"net/http"
+
+	"github.com/gorilla/mux"
+)
+
+// APIVersion is a set of routes served under a version prefix such as /v1.
+// Several versions can be mounted side by side while clients migrate.
+type APIVersion struct {
+	Prefix     string
+	Register   func(r *mux.Router)
+	Deprecated bool
+	Sunset     string // HTTP-date after which the version is removed
+	Successor  string // prefix of the version replacing this one
+}
+
+// MountAPIVersions registers every version on its own subrouter
+func MountAPIVersions(router *mux.Router, versions ...APIVersion) {
+	for _, v := range versions {
+		sub := router.PathPrefix(v.Prefix).Subrouter()
+		if v.Deprecated {
+			sub.Use(deprecationMiddleware(v.Sunset, v.Successor))
+		}
+		v.Register(sub)
+	}
+}
+
+// MountLegacyRoutes keeps the original unversioned paths working as aliases of
+// the given version, flagged as deprecated so clients move to the prefixed paths
+func MountLegacyRoutes(router *mux.Router, v APIVersion) {
+	legacy := router.NewRoute().Subrouter()
+	legacy.Use(deprecationMiddleware(getEnv("LEGACY_ROUTES_SUNSET", ""), v.Prefix))
+	v.Register(legacy)
+}
+
+// deprecationMiddleware advertises deprecation using the Deprecation, Sunset and
+// Link headers
+func deprecationMiddleware(sunset, successor string) mux.MiddlewareFunc {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			w.Header().Set("Deprecation", "true")
+			if sunset != "" {
+				w.Header().Set("Sunset", sunset)
+			}
+			if successor != "" {
+				w.Header().Set("Link", "<"+successor+">; rel=\"successor-version\"")
+			}
+			next.ServeHTTP(w, r)
+		})
+	}
+}
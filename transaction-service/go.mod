@@ -4,7 +4,20 @@ go 1.19
 
 require (
 	github.com/gorilla/mux v1.8.0
-	github.com/lib/pq v1.10.7
-	github.com/joho/godotenv v1.4.0
-	github.com/sirupsen/logrus v1.9.0
-)
\ No newline at end of file
+	github.com/lib/pq v1.10.9
+	go.uber.org/zap v1.24.0
+)
+
+require (
+	github.com/golang-jwt/jwt/v5 v5.2.2 // indirect
+	github.com/pressly/goose/v3 v3.11.2 // indirect
+	github.com/swaggo/files/v2 v2.0.0 // indirect
+)
+
+require (
+	bank/servicekit v0.0.0
+	go.uber.org/atomic v1.7.0 // indirect
+	go.uber.org/multierr v1.6.0 // indirect
+)
+
+replace bank/servicekit => ../servicekit
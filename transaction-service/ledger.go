@@ -0,0 +1,375 @@
+package main
+
+import (
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gorilla/mux"
+)
+
+const ledgerTablesSQL = `
+	CREATE TABLE IF NOT EXISTS transactions (
+		id SERIAL PRIMARY KEY,
+		transaction_type VARCHAR(20) NOT NULL,
+		amount DECIMAL(15,2) NOT NULL CHECK (amount > 0),
+		currency_code VARCHAR(3) NOT NULL,
+		source_account_id INTEGER REFERENCES accounts(id),
+		destination_account_id INTEGER REFERENCES accounts(id),
+		gl_account VARCHAR(30) NOT NULL DEFAULT '',
+		status VARCHAR(10) NOT NULL DEFAULT 'completed',
+		description TEXT NOT NULL DEFAULT '',
+		reference VARCHAR(100) NOT NULL DEFAULT '',
+		created_at TIMESTAMP NOT NULL DEFAULT NOW()
+	);
+	CREATE INDEX IF NOT EXISTS idx_transactions_created ON transactions(created_at);
+	CREATE TABLE IF NOT EXISTS ledger_entries (
+		id SERIAL PRIMARY KEY,
+		transaction_id INTEGER NOT NULL REFERENCES transactions(id),
+		account_id INTEGER REFERENCES accounts(id),
+		gl_account VARCHAR(30),
+		direction VARCHAR(6) NOT NULL CHECK (direction IN ('debit', 'credit')),
+		amount DECIMAL(15,2) NOT NULL CHECK (amount > 0),
+		currency_code VARCHAR(3) NOT NULL,
+		created_at TIMESTAMP NOT NULL DEFAULT NOW(),
+		CHECK ((account_id IS NULL) <> (gl_account IS NULL))
+	);
+	CREATE INDEX IF NOT EXISTS idx_ledger_entries_transaction ON ledger_entries(transaction_id);
+	CREATE INDEX IF NOT EXISTS idx_ledger_entries_account ON ledger_entries(account_id, created_at);`
+
+// Default GL accounts used as the other side of single-account movements
+const (
+	glCash     = "cash"
+	glClearing = "clearing"
+)
+
+var (
+	transactionTypePattern = regexp.MustCompile(`^[a-z_]{1,20}$`)
+	glAccountPattern       = regexp.MustCompile(`^[a-z0-9_.:-]{1,30}$`)
+	currencyPattern        = regexp.MustCompile(`^[A-Z]{3}$`)
+)
+
+const transactionColumns = `id, transaction_type, amount, currency_code, source_account_id, destination_account_id,
+	gl_account, status, description, reference, created_at`
+
+func scanTransaction(row interface{ Scan(...interface{}) error }, t *Transaction) error {
+	var source, destination sql.NullInt64
+	err := row.Scan(&t.ID, &t.Type, &t.Amount, &t.CurrencyCode, &source, &destination, &t.GLAccount, &t.Status,
+		&t.Description, &t.Reference, &t.CreatedAt)
+	if source.Valid {
+		id := int(source.Int64)
+		t.SourceAccountID = &id
+	}
+	if destination.Valid {
+		id := int(destination.Int64)
+		t.DestinationAccountID = &id
+	}
+	return err
+}
+
+// ledgerEntries returns the debit and credit legs of a transaction: the source
+// (or GL account) is debited and the destination (or GL account) credited
+func ledgerEntries(t Transaction) []LedgerEntry {
+	debit := LedgerEntry{Direction: "debit", Amount: t.Amount, CurrencyCode: t.CurrencyCode, GLAccount: t.GLAccount}
+	if t.SourceAccountID != nil {
+		debit.AccountID, debit.GLAccount = *t.SourceAccountID, ""
+	}
+	credit := LedgerEntry{Direction: "credit", Amount: t.Amount, CurrencyCode: t.CurrencyCode, GLAccount: t.GLAccount}
+	if t.DestinationAccountID != nil {
+		credit.AccountID, credit.GLAccount = *t.DestinationAccountID, ""
+	}
+	return []LedgerEntry{debit, credit}
+}
+
+// createTransaction records a movement as a debit/credit pair. Deposits debit
+// the cash GL account and credit the customer; withdrawals do the reverse.
+// Other single-account movements use gl_account (default clearing).
+func createTransaction(w http.ResponseWriter, r *http.Request) {
+	var t Transaction
+	err := json.NewDecoder(r.Body).Decode(&t)
+	if err != nil {
+		http.Error(w, "Invalid request body", http.StatusBadRequest)
+		return
+	}
+
+	t.Type = strings.ToLower(strings.TrimSpace(t.Type))
+	t.CurrencyCode = strings.ToUpper(t.CurrencyCode)
+	if !transactionTypePattern.MatchString(t.Type) {
+		http.Error(w, "transaction_type is required", http.StatusBadRequest)
+		return
+	}
+	if t.Amount <= 0 {
+		http.Error(w, "Amount must be positive", http.StatusBadRequest)
+		return
+	}
+	if !currencyPattern.MatchString(t.CurrencyCode) {
+		http.Error(w, "currency_code must be a 3 letter ISO code", http.StatusBadRequest)
+		return
+	}
+	if t.SourceAccountID == nil && t.DestinationAccountID == nil {
+		http.Error(w, "source_account_id or destination_account_id is required", http.StatusBadRequest)
+		return
+	}
+	if t.SourceAccountID != nil && t.DestinationAccountID != nil {
+		if *t.SourceAccountID == *t.DestinationAccountID {
+			http.Error(w, "Source and destination accounts must differ", http.StatusBadRequest)
+			return
+		}
+		t.GLAccount = ""
+	} else if t.GLAccount == "" {
+		t.GLAccount = glClearing
+		if t.Type == "deposit" || t.Type == "withdrawal" {
+			t.GLAccount = glCash
+		}
+	} else if !glAccountPattern.MatchString(t.GLAccount) {
+		http.Error(w, "Invalid gl_account", http.StatusBadRequest)
+		return
+	}
+
+	tx, err := db.BeginTx(r.Context(), nil)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	defer tx.Rollback()
+
+	// A reference is recorded once, so a poster retrying after a lost reply
+	// gets the transaction it already created
+	t.Reference = strings.TrimSpace(t.Reference)
+	err = scanTransaction(tx.QueryRowContext(r.Context(), `INSERT INTO transactions (transaction_type, amount, currency_code,
+									  source_account_id, destination_account_id, gl_account, description, reference)
+									  VALUES ($1, $2, $3, $4, $5, $6, $7, $8)
+									  ON CONFLICT (reference) WHERE reference <> '' DO NOTHING
+									  RETURNING `+transactionColumns,
+		t.Type, t.Amount, t.CurrencyCode, t.SourceAccountID, t.DestinationAccountID, t.GLAccount,
+		strings.TrimSpace(t.Description), t.Reference), &t)
+	if err == sql.ErrNoRows {
+		err = scanTransaction(db.QueryRowContext(r.Context(), `SELECT `+transactionColumns+` FROM transactions
+															   WHERE reference = $1`, t.Reference), &t)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(t)
+		return
+	}
+	if err != nil {
+		if strings.Contains(err.Error(), "foreign key") {
+			http.Error(w, "Account not found", http.StatusNotFound)
+		} else {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+		}
+		return
+	}
+
+	t.Entries = ledgerEntries(t)
+	for i := range t.Entries {
+		e := &t.Entries[i]
+		var account, gl interface{}
+		if e.AccountID != 0 {
+			account = e.AccountID
+		} else {
+			gl = e.GLAccount
+		}
+		err = tx.QueryRowContext(r.Context(), `INSERT INTO ledger_entries (transaction_id, account_id, gl_account,
+											   direction, amount, currency_code) VALUES ($1, $2, $3, $4, $5, $6)
+											   RETURNING id`, t.ID, account, gl, e.Direction, t.Amount, t.CurrencyCode).Scan(&e.ID)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+	}
+
+	err = tx.Commit()
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusCreated)
+	json.NewEncoder(w).Encode(t)
+}
+
+// dateRange reads the inclusive from and to dates (YYYY-MM-DD) of a listing
+func dateRange(r *http.Request) (from, to interface{}, err error) {
+	for _, p := range []struct {
+		key string
+		out *interface{}
+	}{{"from", &from}, {"to", &to}} {
+		value := r.URL.Query().Get(p.key)
+		if value == "" {
+			continue
+		}
+		day, err := time.Parse("2006-01-02", value)
+		if err != nil {
+			return nil, nil, fmt.Errorf("%s must be a date (YYYY-MM-DD)", p.key)
+		}
+		if p.key == "to" {
+			day = day.AddDate(0, 0, 1)
+		}
+		*p.out = day
+	}
+	return from, to, nil
+}
+
+// paging reads limit (default 100, at most 500) and offset
+func paging(r *http.Request) (int, int, error) {
+	limit, err := queryInt(r, "limit", 100, 500)
+	if err != nil {
+		return 0, 0, err
+	}
+	offset, err := queryInt(r, "offset", 0, 0)
+	return limit, offset, err
+}
+
+// listTransactions returns transactions newest first, optionally filtered by
+// ?account_id=, ?transaction_type= and a ?from=&to= date range
+func listTransactions(w http.ResponseWriter, r *http.Request) {
+	from, to, err := dateRange(r)
+	if err != nil {
+		http.Error(w, "from and to must be dates (YYYY-MM-DD)", http.StatusBadRequest)
+		return
+	}
+	limit, offset, err := paging(r)
+	if err != nil {
+		http.Error(w, "limit and offset must be non-negative integers", http.StatusBadRequest)
+		return
+	}
+	var accountID interface{}
+	if value := r.URL.Query().Get("account_id"); value != "" {
+		id, err := strconv.Atoi(value)
+		if err != nil {
+			http.Error(w, "Invalid account ID", http.StatusBadRequest)
+			return
+		}
+		accountID = id
+	}
+
+	rows, err := db.QueryContext(r.Context(), `SELECT `+transactionColumns+` FROM transactions
+											   WHERE ($1::int IS NULL OR $1 IN (source_account_id, destination_account_id))
+											   AND ($2 = '' OR transaction_type = $2)
+											   AND ($3::timestamp IS NULL OR created_at >= $3)
+											   AND ($4::timestamp IS NULL OR created_at < $4)
+											   ORDER BY created_at DESC, id DESC LIMIT $5 OFFSET $6`,
+		accountID, r.URL.Query().Get("transaction_type"), from, to, limit, offset)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	defer rows.Close()
+
+	transactions := []Transaction{}
+	for rows.Next() {
+		var t Transaction
+		if err := scanTransaction(rows, &t); err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		transactions = append(transactions, t)
+	}
+	if err := rows.Err(); err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(transactions)
+}
+
+// getTransaction returns a transaction with its ledger entries
+func getTransaction(w http.ResponseWriter, r *http.Request) {
+	var t Transaction
+	err := scanTransaction(db.QueryRowContext(r.Context(), `SELECT `+transactionColumns+` FROM transactions WHERE id = $1`,
+		mux.Vars(r)["id"]), &t)
+	if err != nil {
+		if err == sql.ErrNoRows {
+			http.Error(w, "Transaction not found", http.StatusNotFound)
+		} else {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+		}
+		return
+	}
+
+	rows, err := db.QueryContext(r.Context(), `SELECT id, COALESCE(account_id, 0), COALESCE(gl_account, ''), direction,
+											   amount, currency_code FROM ledger_entries WHERE transaction_id = $1 ORDER BY id`, t.ID)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var e LedgerEntry
+		if err := rows.Scan(&e.ID, &e.AccountID, &e.GLAccount, &e.Direction, &e.Amount, &e.CurrencyCode); err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		t.Entries = append(t.Entries, e)
+	}
+	if err := rows.Err(); err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(t)
+}
+
+// getAccountTransactions returns an account's ledger entries newest first,
+// optionally within a ?from=&to= date range
+func getAccountTransactions(w http.ResponseWriter, r *http.Request) {
+	accountID, err := strconv.Atoi(mux.Vars(r)["id"])
+	if err != nil {
+		http.Error(w, "Invalid account ID", http.StatusBadRequest)
+		return
+	}
+	from, to, err := dateRange(r)
+	if err != nil {
+		http.Error(w, "from and to must be dates (YYYY-MM-DD)", http.StatusBadRequest)
+		return
+	}
+	limit, offset, err := paging(r)
+	if err != nil {
+		http.Error(w, "limit and offset must be non-negative integers", http.StatusBadRequest)
+		return
+	}
+
+	rows, err := db.QueryContext(r.Context(), `SELECT t.id, e.account_id, t.transaction_type, e.direction,
+											   CASE WHEN e.direction = 'debit' THEN -e.amount ELSE e.amount END,
+											   e.currency_code, t.description, t.reference, t.created_at
+											   FROM ledger_entries e JOIN transactions t ON t.id = e.transaction_id
+											   WHERE e.account_id = $1
+											   AND ($2::timestamp IS NULL OR e.created_at >= $2)
+											   AND ($3::timestamp IS NULL OR e.created_at < $3)
+											   ORDER BY e.created_at DESC, e.id DESC LIMIT $4 OFFSET $5`,
+		accountID, from, to, limit, offset)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	defer rows.Close()
+
+	transactions := []AccountTransaction{}
+	for rows.Next() {
+		var t AccountTransaction
+		if err := rows.Scan(&t.ID, &t.AccountID, &t.Type, &t.Direction, &t.Amount, &t.CurrencyCode, &t.Description,
+			&t.Reference, &t.CreatedAt); err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		transactions = append(transactions, t)
+	}
+	if err := rows.Err(); err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(transactions)
+}
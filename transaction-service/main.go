@@ -0,0 +1,201 @@
+package main
+
+import (
+	"database/sql"
+	"fmt"
+	"net/http"
+	"os"
+	"strconv"
+
+	"bank/servicekit"
+
+	"github.com/gorilla/mux"
+	_ "github.com/lib/pq"
+	"go.uber.org/zap"
+)
+
+// Transaction is a money movement recorded as balanced ledger entries
+type Transaction struct {
+	ID                   int           `json:"id"`
+	Type                 string        `json:"transaction_type"`
+	Amount               Money         `json:"amount"`
+	CurrencyCode         string        `json:"currency_code"`
+	SourceAccountID      *int          `json:"source_account_id,omitempty"`
+	DestinationAccountID *int          `json:"destination_account_id,omitempty"`
+	GLAccount            string        `json:"gl_account,omitempty"` // counterparty when only one side is a customer account
+	Status               string        `json:"status"`
+	Description          string        `json:"description"`
+	Reference            string        `json:"reference"`
+	CreatedAt            string        `json:"created_at"`
+	Entries              []LedgerEntry `json:"entries,omitempty"`
+}
+
+// LedgerEntry is one side of a transaction. Customer accounts are bank
+// liabilities, so a credit raises the account's balance and a debit lowers it.
+type LedgerEntry struct {
+	ID           int    `json:"id"`
+	AccountID    int    `json:"account_id,omitempty"`
+	GLAccount    string `json:"gl_account,omitempty"`
+	Direction    string `json:"direction"` // debit or credit
+	Amount       Money  `json:"amount"`
+	CurrencyCode string `json:"currency_code"`
+}
+
+// AccountTransaction is a transaction as seen from one account; the amount is
+// negative for debits
+type AccountTransaction struct {
+	ID           int    `json:"id"`
+	AccountID    int    `json:"account_id"`
+	Type         string `json:"transaction_type"`
+	Direction    string `json:"direction"`
+	Amount       Money  `json:"amount"`
+	CurrencyCode string `json:"currency_code"`
+	Description  string `json:"description"`
+	Reference    string `json:"reference"`
+	CreatedAt    string `json:"created_at"`
+}
+
+// serviceName identifies this service to its peers
+const serviceName = "transaction-service"
+
+var db *sql.DB
+
+// peerPermissions are the routes other services may call with their SPIFFE
+// identity or a service token; serviceOnlyRoutes reject callers without one
+var (
+	peerPermissions = map[string][]string{
+		"account-service": {"POST /transactions", "GET /transactions", "GET /transactions/{id}",
+			"GET /accounts/{id}/transactions", "GET /reports/profitability"},
+		"api-gateway": {"*"},
+	}
+	serviceOnlyRoutes = map[string]bool{"POST /transactions": true, "GET /reports/profitability": true}
+
+	// routePriorities decide what is shed first under overload: recording
+	// transactions last, history lists and reports first
+	routePriorities = map[string]string{
+		"POST /transactions":              "high",
+		"GET /transactions":               "low",
+		"GET /accounts/{id}/transactions": "low",
+		"GET /reports/profitability":      "low",
+	}
+)
+
+func main() {
+	servicekit.InitErrorReporting()
+	servicekit.InitSPIFFE()
+	servicekit.InitServiceTokens()
+
+	// "transaction-service migrate ..." runs the migrate subcommand and exits
+	servicekit.MigrateCommand(connectDB, baselineSchema)
+
+	// Answer probes while the database is migrated
+	port := getEnv("PORT", "8081")
+	if err := startServer(":" + port); err != nil {
+		logger.Fatal("server failed", zap.Error(err))
+	}
+
+	// Initialize database connection
+	initDB()
+	defer db.Close()
+	servicekit.StartServiceTokenNonceExpiry()
+	servicekit.StartSLOTracking()
+
+	// Create router
+	router := mux.NewRouter()
+	router.Use(servicekit.MetricsMiddleware)
+	router.Use(servicekit.LoadSheddingMiddleware(servicekit.LoadRoutePriorities(routePriorities)))
+	router.Use(servicekit.ErrorReportingMiddleware)
+	router.Use(servicekit.ServiceIdentityMiddleware(servicekit.LoadServicePermissions(peerPermissions), serviceOnlyRoutes))
+
+	// Define routes
+	router.HandleFunc("/health", servicekit.HealthCheck).Methods("GET")
+	router.HandleFunc("/startup", servicekit.StartupProbe).Methods("GET")
+	router.HandleFunc("/metrics", servicekit.MetricsHandler).Methods("GET")
+	router.HandleFunc("/slo", servicekit.SLOHandler).Methods("GET")
+	v1 := servicekit.APIVersion{Prefix: "/v1", Register: registerV1Routes}
+	servicekit.MountAPIVersions(router, v1)
+	servicekit.MountLegacyRoutes(router, v1)
+
+	// Start server
+	logger.Info("transaction service starting", zap.String("port", port))
+	if err := listenAndServe(":"+port, servicekit.RecoveryMiddleware(router)); err != nil {
+		logger.Fatal("server failed", zap.Error(err))
+	}
+}
+
+// registerV1Routes defines the v1 transaction API
+func registerV1Routes(r *mux.Router) {
+	r.HandleFunc("/transactions", createTransaction).Methods("POST")
+	r.HandleFunc("/transactions", listTransactions).Methods("GET")
+	r.HandleFunc("/transactions/{id}", getTransaction).Methods("GET")
+	r.HandleFunc("/accounts/{id}/transactions", getAccountTransactions).Methods("GET")
+	r.HandleFunc("/reports/profitability", getProfitabilityReport).Methods("GET")
+}
+
+func initDB() {
+	connectDB()
+	servicekit.SetStartupPhase(servicekit.PhaseMigrating)
+	if err := servicekit.RunMigrations(serviceContext, baselineSchema()); err != nil {
+		logger.Fatal("failed to migrate database", zap.Error(err))
+	}
+}
+
+func connectDB() {
+	// Get database connection parameters from environment variables
+	host := getEnv("DB_HOST", "localhost")
+	port := getEnv("DB_PORT", "5432")
+	user := getEnv("DB_USER", "postgres")
+	password := getEnv("DB_PASSWORD", "postgres")
+	dbname := getEnv("DB_NAME", "bankdb")
+
+	// Create connection string
+	connStr := fmt.Sprintf("host=%s port=%s user=%s password=%s dbname=%s sslmode=disable",
+		host, port, user, password, dbname)
+
+	// Open database connection
+	var err error
+	db, err = sql.Open("postgres", connStr)
+	if err != nil {
+		logger.Fatal("failed to connect to database", zap.Error(err))
+	}
+
+	// Check connection
+	err = db.PingContext(serviceContext)
+	if err != nil {
+		logger.Fatal("failed to ping database", zap.Error(err))
+	}
+
+	logger.Info("connected to database")
+}
+
+// baselineSchema is the schema before it was versioned, applied as version 1.
+// It is frozen: change the schema with a new file in migrations/.
+func baselineSchema() []string {
+	// Accounts are owned by the account service, which must have created them
+	return []string{ledgerTablesSQL, servicekit.ServiceTokenTablesSQL, servicekit.SLOTablesSQL}
+}
+
+// Helper function to get environment variable with default value
+func getEnv(key, defaultValue string) string {
+	value := os.Getenv(key)
+	if value == "" {
+		return defaultValue
+	}
+	return value
+}
+
+// queryInt reads a non-negative integer query parameter
+func queryInt(r *http.Request, key string, defaultValue, max int) (int, error) {
+	value := r.URL.Query().Get(key)
+	if value == "" {
+		return defaultValue, nil
+	}
+	n, err := strconv.Atoi(value)
+	if err != nil || n < 0 {
+		return 0, fmt.Errorf("%s must be a non-negative integer", key)
+	}
+	if max > 0 && n > max {
+		n = max
+	}
+	return n, nil
+}
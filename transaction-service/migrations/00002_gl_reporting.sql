@@ -0,0 +1,7 @@
+-- Reports read the GL legs of the ledger by account and posting date.
+
+-- +goose Up
+CREATE INDEX idx_ledger_entries_gl_account ON ledger_entries(gl_account, created_at) WHERE gl_account IS NOT NULL;
+
+-- +goose Down
+DROP INDEX idx_ledger_entries_gl_account;
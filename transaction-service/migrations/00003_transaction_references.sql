@@ -0,0 +1,8 @@
+-- Posters send a reference with each transaction and may deliver it more than
+-- once; each non-empty reference is recorded once.
+
+-- +goose Up
+CREATE UNIQUE INDEX idx_transactions_reference ON transactions(reference) WHERE reference <> '';
+
+-- +goose Down
+DROP INDEX idx_transactions_reference;
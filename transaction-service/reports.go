@@ -0,0 +1,133 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"strings"
+	"time"
+)
+
+// GL accounts account-service posts interest and fees against
+const (
+	glInterestIncome  = "interest_income"
+	glInterestExpense = "interest_expense"
+	glFeeIncome       = "fee_income"
+)
+
+// ProfitabilityLine is the income and expense of one group of accounts in one
+// currency. Dimensions not grouped by are left out.
+type ProfitabilityLine struct {
+	ProductCode     string `json:"product_code,omitempty"`
+	BranchCode      string `json:"branch_code,omitempty"`
+	Month           string `json:"month,omitempty"` // YYYY-MM
+	CurrencyCode    string `json:"currency_code"`
+	InterestIncome  Money  `json:"interest_income"`
+	InterestExpense Money  `json:"interest_expense"`
+	FeeIncome       Money  `json:"fee_income"`
+	NetIncome       Money  `json:"net_income"`
+}
+
+// profitabilityDimensions are the ?group_by= values and the column each
+// groups by. The product is the account type.
+var profitabilityDimensions = map[string]string{
+	"product": "a.account_type",
+	"branch":  "a.branch_code",
+	"month":   "to_char(g.created_at, 'YYYY-MM')",
+}
+
+// getProfitabilityReport sums the interest and fee GL legs by the product,
+// branch and month of the customer account on the other side, for the
+// months ?from= to ?to= (YYYY-MM, default the current year to date). Income
+// accounts count credits less debits, so reversals reduce them; the expense
+// account counts debits less credits.
+func getProfitabilityReport(w http.ResponseWriter, r *http.Request) {
+	now := time.Now().UTC()
+	from := time.Date(now.Year(), 1, 1, 0, 0, 0, 0, time.UTC)
+	to := time.Date(now.Year(), now.Month(), 1, 0, 0, 0, 0, time.UTC)
+	for key, month := range map[string]*time.Time{"from": &from, "to": &to} {
+		if value := r.URL.Query().Get(key); value != "" {
+			parsed, err := time.Parse("2006-01", value)
+			if err != nil {
+				http.Error(w, key+" must be a month (YYYY-MM)", http.StatusBadRequest)
+				return
+			}
+			*month = parsed
+		}
+	}
+	if to.Before(from) {
+		http.Error(w, "to must not be before from", http.StatusBadRequest)
+		return
+	}
+
+	groupBy := []string{"product", "branch", "month"}
+	if value := r.URL.Query().Get("group_by"); value != "" {
+		groupBy = nil
+		seen := map[string]bool{}
+		for _, dimension := range strings.Split(value, ",") {
+			dimension = strings.TrimSpace(dimension)
+			if _, ok := profitabilityDimensions[dimension]; !ok {
+				http.Error(w, "group_by must list product, branch or month", http.StatusBadRequest)
+				return
+			}
+			if !seen[dimension] {
+				seen[dimension] = true
+				groupBy = append(groupBy, dimension)
+			}
+		}
+	}
+	grouped := map[string]bool{}
+	for _, dimension := range groupBy {
+		grouped[dimension] = true
+	}
+	columns := make([]string, 0, 3)
+	for _, dimension := range []string{"product", "branch", "month"} {
+		if grouped[dimension] {
+			columns = append(columns, profitabilityDimensions[dimension])
+		} else {
+			columns = append(columns, "''")
+		}
+	}
+	dimensions := strings.Join(columns, ", ")
+
+	rows, err := db.QueryContext(r.Context(), `SELECT `+dimensions+`, g.currency_code,
+		COALESCE(SUM(CASE WHEN g.gl_account = $1 THEN CASE g.direction WHEN 'credit' THEN g.amount ELSE -g.amount END END), 0),
+		COALESCE(SUM(CASE WHEN g.gl_account = $2 THEN CASE g.direction WHEN 'debit' THEN g.amount ELSE -g.amount END END), 0),
+		COALESCE(SUM(CASE WHEN g.gl_account = $3 THEN CASE g.direction WHEN 'credit' THEN g.amount ELSE -g.amount END END), 0)
+		FROM ledger_entries g
+		JOIN ledger_entries c ON c.transaction_id = g.transaction_id AND c.account_id IS NOT NULL
+		JOIN accounts a ON a.id = c.account_id
+		WHERE g.gl_account IN ($1, $2, $3) AND g.created_at >= $4 AND g.created_at < $5
+		AND ($6 = '' OR a.account_type = $6) AND ($7 = '' OR a.branch_code = $7)
+		GROUP BY `+dimensions+`, g.currency_code ORDER BY `+dimensions+`, g.currency_code`,
+		glInterestIncome, glInterestExpense, glFeeIncome, from, to.AddDate(0, 1, 0),
+		strings.ToLower(r.URL.Query().Get("product_code")), strings.ToUpper(r.URL.Query().Get("branch_code")))
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	defer rows.Close()
+
+	lines := []ProfitabilityLine{}
+	for rows.Next() {
+		var l ProfitabilityLine
+		if err := rows.Scan(&l.ProductCode, &l.BranchCode, &l.Month, &l.CurrencyCode, &l.InterestIncome,
+			&l.InterestExpense, &l.FeeIncome); err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		l.NetIncome = l.InterestIncome + l.FeeIncome - l.InterestExpense
+		lines = append(lines, l)
+	}
+	if err := rows.Err(); err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"from":     from.Format("2006-01"),
+		"to":       to.Format("2006-01"),
+		"group_by": groupBy,
+		"lines":    lines,
+	})
+}
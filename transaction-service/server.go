@@ -0,0 +1,114 @@
+package main
+
+import (
+	"context"
+	"net"
+	"net/http"
+	"os"
+	"os/signal"
+	"sync/atomic"
+	"syscall"
+	"time"
+
+	"bank/servicekit"
+
+	"go.uber.org/zap"
+)
+
+// serviceContext is canceled once the server has drained on shutdown.
+// Startup and background jobs run their queries with it.
+var serviceContext, stopService = context.WithCancel(context.Background())
+
+// requestTimeout bounds the context of every request, REQUEST_TIMEOUT, so
+// database and service calls made with it are canceled when it passes
+func requestTimeout() time.Duration {
+	timeout, err := time.ParseDuration(getEnv("REQUEST_TIMEOUT", "30s"))
+	if err != nil || timeout <= 0 {
+		return 30 * time.Second
+	}
+	return timeout
+}
+
+// shutdownTimeout is how long in-flight requests may take to finish after
+// SIGTERM, SHUTDOWN_TIMEOUT
+func shutdownTimeout() time.Duration {
+	timeout, err := time.ParseDuration(getEnv("SHUTDOWN_TIMEOUT", "20s"))
+	if err != nil || timeout <= 0 {
+		return 20 * time.Second
+	}
+	return timeout
+}
+
+// server is started by startServer, so probes are answered while the
+// service starts, and switched to the router by listenAndServe
+var (
+	server       *http.Server
+	serverErrs   = make(chan error, 1)
+	serveHandler atomic.Value // of servedHandler
+)
+
+type servedHandler struct {
+	http.Handler
+}
+
+// startServer listens on addr with plain HTTP, or mTLS with the SVID when
+// SPIFFE is enabled, and serves servicekit.StartingHandler until listenAndServe is
+// called
+func startServer(addr string) error {
+	serveHandler.Store(servedHandler{servicekit.StartingHandler()})
+	timeout := requestTimeout()
+	server = &http.Server{
+		Addr: addr,
+		Handler: servicekit.RequestIDMiddleware(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			ctx, cancel := context.WithTimeout(r.Context(), timeout)
+			defer cancel()
+			serveHandler.Load().(servedHandler).ServeHTTP(w, r.WithContext(ctx))
+		})),
+		ReadHeaderTimeout: 10 * time.Second,
+		IdleTimeout:       2 * time.Minute,
+	}
+	listener, err := net.Listen("tcp", addr)
+	if err != nil {
+		return err
+	}
+	serve := func() error { return server.Serve(listener) }
+	if servicekit.WorkloadIdentity != nil {
+		server.TLSConfig = servicekit.WorkloadIdentity.ServerTLSConfig()
+		serve = func() error { return server.ServeTLS(listener, "", "") }
+	}
+	go func() { serverErrs <- serve() }()
+	return nil
+}
+
+// listenAndServe serves handler, starting the server on addr unless
+// startServer already has, and reports the service ready. On SIGTERM or
+// SIGINT it stops accepting connections, waits for in-flight requests and
+// cancels serviceContext. It returns nil after a clean shutdown.
+func listenAndServe(addr string, handler http.Handler) error {
+	if server == nil {
+		if err := startServer(addr); err != nil {
+			return err
+		}
+	}
+	serveHandler.Store(servedHandler{handler})
+	servicekit.SetStartupPhase(servicekit.PhaseReady)
+
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, syscall.SIGTERM, syscall.SIGINT)
+	select {
+	case err := <-serverErrs:
+		return err
+	case sig := <-signals:
+		logger.Info("draining in-flight requests", zap.String("signal", sig.String()))
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), shutdownTimeout())
+	defer cancel()
+	err := server.Shutdown(ctx)
+	stopService()
+	if err != nil {
+		return err
+	}
+	logger.Info("shut down cleanly")
+	return nil
+}
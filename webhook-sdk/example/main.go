@@ -0,0 +1,49 @@
+// Sample partner endpoint receiving bank webhook events.
+//
+//	WEBHOOK_SECRET=whsec_test go run ./example
+package main
+
+import (
+	"encoding/json"
+	"log"
+	"net/http"
+	"os"
+
+	webhook "bank/webhook-sdk"
+)
+
+// Event is the envelope of every webhook delivery
+type Event struct {
+	ID        string                 `json:"id"`
+	Type      string                 `json:"type"`
+	CreatedAt string                 `json:"created_at"`
+	Data      map[string]interface{} `json:"data"`
+}
+
+func main() {
+	secret := os.Getenv("WEBHOOK_SECRET")
+	if secret == "" {
+		log.Fatal("WEBHOOK_SECRET is required")
+	}
+
+	http.HandleFunc("/webhooks/bank", func(w http.ResponseWriter, r *http.Request) {
+		body, err := webhook.VerifyRequest(r, secret, webhook.DefaultTolerance)
+		if err != nil {
+			log.Printf("Rejected webhook: %v", err)
+			http.Error(w, "Invalid signature", http.StatusUnauthorized)
+			return
+		}
+
+		var event Event
+		if err := json.Unmarshal(body, &event); err != nil {
+			http.Error(w, "Invalid request body", http.StatusBadRequest)
+			return
+		}
+
+		log.Printf("Received %s event %s", event.Type, event.ID)
+		w.WriteHeader(http.StatusNoContent)
+	})
+
+	log.Println("Listening for webhooks on :9000...")
+	log.Fatal(http.ListenAndServe(":9000", nil))
+}
@@ -0,0 +1,3 @@
+module bank/webhook-sdk
+
+go 1.19
@@ -0,0 +1,77 @@
+package webhook
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/pem"
+	"errors"
+	"io"
+	"math/big"
+	"net/http"
+	"time"
+)
+
+// ErrUnknownKey is returned when a v2 signature names a key that is not in
+// the verification key set
+var ErrUnknownKey = errors.New("webhook: unknown signing key")
+
+// ParsePublicKey decodes a PEM public key as published by the bank
+func ParsePublicKey(pemKey string) (crypto.PublicKey, error) {
+	block, _ := pem.Decode([]byte(pemKey))
+	if block == nil {
+		return nil, errors.New("webhook: public key is not PEM encoded")
+	}
+	return x509.ParsePKIXPublicKey(block.Bytes)
+}
+
+// VerifyWithPublicKey checks a v2 signature header against payload using the
+// public keys by kid. ECDSA P-256 and RSA PKCS#1 v1.5 keys are supported.
+func VerifyWithPublicKey(payload []byte, header string, keys map[string]crypto.PublicKey, tolerance time.Duration) error {
+	h, err := parseHeader(header, tolerance)
+	if err != nil {
+		return err
+	}
+	if h.kid == "" || len(h.v2) == 0 {
+		return ErrInvalidHeader
+	}
+	key, ok := keys[h.kid]
+	if !ok {
+		return ErrUnknownKey
+	}
+
+	digest := sha256.Sum256(append([]byte(h.ts+"."), payload...))
+	for _, encoded := range h.v2 {
+		sig, err := base64.RawURLEncoding.DecodeString(encoded)
+		if err != nil {
+			continue
+		}
+		switch k := key.(type) {
+		case *ecdsa.PublicKey:
+			// r||s, each padded to the curve size
+			size := (k.Curve.Params().BitSize + 7) / 8
+			if len(sig) == 2*size && ecdsa.Verify(k, digest[:],
+				new(big.Int).SetBytes(sig[:size]), new(big.Int).SetBytes(sig[size:])) {
+				return nil
+			}
+		case *rsa.PublicKey:
+			if rsa.VerifyPKCS1v15(k, crypto.SHA256, digest[:], sig) == nil {
+				return nil
+			}
+		}
+	}
+	return ErrNoMatch
+}
+
+// VerifyRequestWithPublicKey reads the request body and verifies its v2
+// signature. The body is returned so the caller can decode the event.
+func VerifyRequestWithPublicKey(r *http.Request, keys map[string]crypto.PublicKey, tolerance time.Duration) ([]byte, error) {
+	body, err := io.ReadAll(r.Body)
+	if err != nil {
+		return nil, err
+	}
+	return body, VerifyWithPublicKey(body, r.Header.Get(SignatureHeader), keys, tolerance)
+}
@@ -0,0 +1,134 @@
+// Package webhook verifies the signatures on webhook events sent by the bank.
+//
+// Every delivery carries an X-Bank-Signature header of the form
+//
+//	t=1700000000,v1=5257a869e7ecebeda32affa62cdca3fa51cad7e77a0e56ff536d0ce8e108d8bd
+//
+// where v1 is the hex encoded HMAC-SHA256 of "<t>.<raw request body>" using the
+// webhook secret shared with the partner. Several v1 values may be present while
+// a secret is being rotated.
+//
+// When the bank signs with a key held in its KMS the header instead carries
+//
+//	t=1700000000,kid=webhooks:v2,v2=MEUCIQ...
+//
+// where v2 is the base64url signature of the same string by the key version
+// named in kid. Its public key is published at /v1/webhooks/signing-keys;
+// verify these events with VerifyWithPublicKey.
+package webhook
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// SignatureHeader is the HTTP header carrying the event signature
+const SignatureHeader = "X-Bank-Signature"
+
+// DefaultTolerance is the maximum accepted age of an event timestamp
+const DefaultTolerance = 5 * time.Minute
+
+var (
+	ErrMissingHeader    = errors.New("webhook: missing signature header")
+	ErrInvalidHeader    = errors.New("webhook: malformed signature header")
+	ErrTimestampExpired = errors.New("webhook: timestamp outside tolerance")
+	ErrNoMatch          = errors.New("webhook: no matching signature")
+)
+
+// Sign computes the signature header value for payload at time t
+func Sign(payload []byte, secret string, t time.Time) string {
+	ts := strconv.FormatInt(t.Unix(), 10)
+	return fmt.Sprintf("t=%s,v1=%s", ts, computeSignature(ts, payload, secret))
+}
+
+// Verify checks the signature header against payload and secret, rejecting
+// timestamps further than tolerance from now to prevent replays
+func Verify(payload []byte, header, secret string, tolerance time.Duration) error {
+	h, err := parseHeader(header, tolerance)
+	if err != nil {
+		return err
+	}
+	if len(h.v1) == 0 {
+		return ErrInvalidHeader
+	}
+
+	expected := []byte(computeSignature(h.ts, payload, secret))
+	for _, sig := range h.v1 {
+		if hmac.Equal(expected, []byte(sig)) {
+			return nil
+		}
+	}
+	return ErrNoMatch
+}
+
+// VerifyRequest reads the request body and verifies its signature. The body is
+// returned so the caller can decode the event.
+func VerifyRequest(r *http.Request, secret string, tolerance time.Duration) ([]byte, error) {
+	body, err := io.ReadAll(r.Body)
+	if err != nil {
+		return nil, err
+	}
+	return body, Verify(body, r.Header.Get(SignatureHeader), secret, tolerance)
+}
+
+// signatureHeader is a parsed signature header
+type signatureHeader struct {
+	ts  string
+	kid string
+	v1  []string
+	v2  []string
+}
+
+// parseHeader splits a signature header and checks its timestamp
+func parseHeader(header string, tolerance time.Duration) (signatureHeader, error) {
+	var h signatureHeader
+	if header == "" {
+		return h, ErrMissingHeader
+	}
+
+	for _, part := range strings.Split(header, ",") {
+		kv := strings.SplitN(strings.TrimSpace(part), "=", 2)
+		if len(kv) != 2 {
+			return h, ErrInvalidHeader
+		}
+		switch kv[0] {
+		case "t":
+			h.ts = kv[1]
+		case "kid":
+			h.kid = kv[1]
+		case "v1":
+			h.v1 = append(h.v1, kv[1])
+		case "v2":
+			h.v2 = append(h.v2, kv[1])
+		}
+	}
+	if h.ts == "" {
+		return h, ErrInvalidHeader
+	}
+
+	unix, err := strconv.ParseInt(h.ts, 10, 64)
+	if err != nil {
+		return h, ErrInvalidHeader
+	}
+	age := time.Since(time.Unix(unix, 0))
+	if age > tolerance || age < -tolerance {
+		return h, ErrTimestampExpired
+	}
+	return h, nil
+}
+
+func computeSignature(ts string, payload []byte, secret string) string {
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write([]byte(ts))
+	mac.Write([]byte("."))
+	mac.Write(payload)
+	return hex.EncodeToString(mac.Sum(nil))
+}